@@ -0,0 +1,82 @@
+// Package ast exposes the syntax tree of Earthfiles, for tools such as linters, editor
+// plugins and generators.
+//
+// The tree is the Earthfile as written: build args are not expanded, and the arguments
+// of the commands are not validated, which is done when the Earthfile is converted.
+//
+// The types of this package follow the compatibility rules of Version: fields are only
+// added within a version, never removed, renamed or given another meaning. The JSON
+// encoding of the tree, via the field tags, follows the same rules.
+package ast
+
+// Version is the version of the syntax tree. It is incremented on incompatible changes
+// of the types of this package.
+const Version = 1
+
+// Node is a node of the syntax tree: *Earthfile, *Target, *Statement or *Comment.
+type Node interface {
+	node()
+}
+
+// Earthfile is the syntax tree of an Earthfile.
+type Earthfile struct {
+	// Version is the version of the syntax tree (see Version).
+	Version int `json:"version"`
+	// BaseRecipe are the statements preceding the first target, which are the recipe
+	// of the base target.
+	BaseRecipe Block    `json:"baseRecipe"`
+	Targets    []Target `json:"targets"`
+	// Comments are all the comments of the Earthfile, in order.
+	Comments []Comment `json:"comments"`
+}
+
+// Target is a target of an Earthfile.
+type Target struct {
+	Name string `json:"name"`
+	// Doc is the comment immediately preceding the target, without the leading # of
+	// its lines.
+	Doc    string `json:"doc,omitempty"`
+	Recipe Block  `json:"recipe"`
+	// SourceLocation spans from the name of the target to its last statement.
+	SourceLocation
+}
+
+// Block is a sequence of statements.
+type Block []Statement
+
+// Statement is a command of a recipe, such as RUN or SAVE ARTIFACT.
+type Statement struct {
+	// Command is the command, in upper case, such as RUN, SAVE ARTIFACT or
+	// FROM DOCKERFILE.
+	Command string `json:"command"`
+	// Args are the arguments of the command, with line continuations removed. For ARG
+	// and ENV, they are the key, and = followed by the value if the value is set. For
+	// LABEL, they are the key, = and the value of each label.
+	Args []string `json:"args"`
+	// ExecMode is set if the arguments are in exec form, as a JSON array, such as
+	// RUN ["echo", "hello"].
+	ExecMode bool `json:"execMode,omitempty"`
+	SourceLocation
+}
+
+// Comment is a comment of an Earthfile.
+type Comment struct {
+	// Text is the comment, including the leading #, without the trailing whitespace.
+	Text string `json:"text"`
+	SourceLocation
+}
+
+// SourceLocation is the location of a node in its Earthfile. Lines and columns start at
+// 1. The end is the position of the last character of the node, inclusive.
+type SourceLocation struct {
+	File        string `json:"file"`
+	StartLine   int    `json:"startLine"`
+	StartColumn int    `json:"startColumn"`
+	EndLine     int    `json:"endLine"`
+	EndColumn   int    `json:"endColumn"`
+}
+
+func (*Earthfile) node() {}
+func (*Target) node()    {}
+func (*Statement) node() {}
+func (*Comment) node()   {}
@@ -0,0 +1,103 @@
+package ast
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testEarthfile = `# The base image.
+FROM alpine:3.11
+ARG VERSION=dev
+
+# Builds the binary.
+# Set VERSION to stamp it.
+build:
+    ENV NAME world
+    RUN echo "hello $NAME" \
+        >out
+    CMD ["cat", "out"]
+    LABEL a=1 b=2
+    SAVE ARTIFACT out
+
+docker:
+    FROM +build
+    SAVE IMAGE app:$VERSION
+`
+
+func TestParse(t *testing.T) {
+	ef, err := ParseReader("Earthfile", strings.NewReader(testEarthfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ef.Version != Version {
+		t.Errorf("expected version %d, got %d", Version, ef.Version)
+	}
+	expectedBase := Block{
+		{Command: "FROM", Args: []string{"alpine:3.11"}, SourceLocation: SourceLocation{"Earthfile", 2, 1, 2, 16}},
+		{Command: "ARG", Args: []string{"VERSION", "=", "dev"}, SourceLocation: SourceLocation{"Earthfile", 3, 1, 3, 15}},
+	}
+	if !reflect.DeepEqual(ef.BaseRecipe, expectedBase) {
+		t.Errorf("expected base recipe %+v, got %+v", expectedBase, ef.BaseRecipe)
+	}
+	if len(ef.Targets) != 2 {
+		t.Fatalf("expected 2 targets, got %+v", ef.Targets)
+	}
+	build := ef.Targets[0]
+	if build.Name != "build" || build.Doc != "Builds the binary.\nSet VERSION to stamp it." {
+		t.Errorf("unexpected target %s with doc %q", build.Name, build.Doc)
+	}
+	if build.SourceLocation != (SourceLocation{"Earthfile", 7, 1, 13, 21}) {
+		t.Errorf("unexpected location of build %+v", build.SourceLocation)
+	}
+	expectedRecipe := Block{
+		{Command: "ENV", Args: []string{"NAME", "=", "world"}, SourceLocation: SourceLocation{"Earthfile", 8, 5, 8, 18}},
+		{Command: "RUN", Args: []string{"echo", `"hello $NAME"`, ">out"}, SourceLocation: SourceLocation{"Earthfile", 9, 5, 10, 12}},
+		{Command: "CMD", Args: []string{"cat", "out"}, ExecMode: true, SourceLocation: SourceLocation{"Earthfile", 11, 5, 11, 22}},
+		{Command: "LABEL", Args: []string{"a", "=", "1", "b", "=", "2"}, SourceLocation: SourceLocation{"Earthfile", 12, 5, 12, 17}},
+		{Command: "SAVE ARTIFACT", Args: []string{"out"}, SourceLocation: SourceLocation{"Earthfile", 13, 5, 13, 21}},
+	}
+	if !reflect.DeepEqual(build.Recipe, expectedRecipe) {
+		t.Errorf("expected recipe %+v, got %+v", expectedRecipe, build.Recipe)
+	}
+	if ef.Targets[1].Doc != "" {
+		t.Errorf("unexpected doc %q", ef.Targets[1].Doc)
+	}
+	expectedComments := []Comment{
+		{Text: "# The base image.", SourceLocation: SourceLocation{"Earthfile", 1, 1, 1, 17}},
+		{Text: "# Builds the binary.", SourceLocation: SourceLocation{"Earthfile", 5, 1, 5, 20}},
+		{Text: "# Set VERSION to stamp it.", SourceLocation: SourceLocation{"Earthfile", 6, 1, 6, 26}},
+	}
+	if !reflect.DeepEqual(ef.Comments, expectedComments) {
+		t.Errorf("expected comments %+v, got %+v", expectedComments, ef.Comments)
+	}
+}
+
+func TestParseSyntaxError(t *testing.T) {
+	_, err := ParseReader("Earthfile", strings.NewReader("build:\n    FROM alpine\n  RUN true\n"))
+	if err == nil {
+		t.Error("expected a syntax error")
+	}
+}
+
+func TestInspect(t *testing.T) {
+	ef, err := ParseReader("Earthfile", strings.NewReader(testEarthfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var commands []string
+	Inspect(ef, func(node Node) bool {
+		switch n := node.(type) {
+		case *Target:
+			// Skips the statements of the target.
+			return n.Name != "docker"
+		case *Statement:
+			commands = append(commands, n.Command)
+		}
+		return true
+	})
+	expected := []string{"FROM", "ARG", "ENV", "RUN", "CMD", "LABEL", "SAVE ARTIFACT"}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Errorf("expected commands %v, got %v", expected, commands)
+	}
+}
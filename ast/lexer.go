@@ -1,4 +1,4 @@
-package earthfile2llb
+package ast
 
 import (
 	"github.com/antlr/antlr4/runtime/Go/antlr"
@@ -16,7 +16,9 @@ type lexer struct {
 	wsChannel, wsStart, wsStop, wsLine, wsColumn int
 }
 
-func newLexer(input antlr.CharStream) antlr.Lexer {
+// NewLexer returns a lexer of Earthfiles, which emits the indentation and
+// dedentation tokens expected by the parser.
+func NewLexer(input antlr.CharStream) antlr.Lexer {
 	l := new(lexer)
 	l.EarthLexer = parser.NewEarthLexer(input)
 	return l
@@ -0,0 +1,226 @@
+package ast
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/antlr/antlr4/runtime/Go/antlr"
+	"github.com/earthly/earthly/earthfile2llb/antlrhandler"
+	"github.com/earthly/earthly/earthfile2llb/parser"
+	"github.com/pkg/errors"
+)
+
+// Parse parses the Earthfile at the given path.
+func Parse(filename string) (*Earthfile, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %s", filename)
+	}
+	defer f.Close()
+	return ParseReader(filename, f)
+}
+
+// ParseReader parses an Earthfile read from r, such as the unsaved contents of an
+// editor. The filename is only used for the locations of the nodes.
+func ParseReader(filename string, r io.Reader) (ef *Earthfile, err error) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			err = fmt.Errorf("parser failure: %v", r)
+		}
+	}()
+	dt, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", filename)
+	}
+	stream := antlr.NewCommonTokenStream(NewLexer(antlr.NewInputStream(string(dt))), 0)
+	p := parser.NewEarthParser(stream)
+	errorListener := antlrhandler.NewReturnErrorListener()
+	errorStrategy := antlrhandler.NewReturnErrorStrategy()
+	p.RemoveErrorListeners()
+	p.AddErrorListener(errorListener)
+	p.SetErrorHandler(errorStrategy)
+	p.BuildParseTrees = true
+	tree := p.EarthFile()
+	if len(errorListener.Errs) > 0 {
+		return nil, errors.Wrapf(errorListener.Errs[0], "parse %s", filename)
+	}
+	if errorStrategy.Err != nil {
+		token := errorStrategy.RE.GetOffendingToken()
+		return nil, fmt.Errorf(
+			"parse %s: syntax error: line %d:%d: %s",
+			filename, token.GetLine(), token.GetColumn()+1, errorStrategy.RE.GetMessage())
+	}
+	b := &builder{
+		filename: filename,
+		ef:       &Earthfile{Version: Version, BaseRecipe: Block{}, Targets: []Target{}, Comments: []Comment{}},
+	}
+	b.collectComments(stream.GetAllTokens())
+	antlr.ParseTreeWalkerDefault.Walk(b, tree)
+	return b.ef, nil
+}
+
+// builder builds the syntax tree while walking the parse tree.
+type builder struct {
+	*parser.BaseEarthParserListener
+	filename string
+	ef       *Earthfile
+	stmt     *Statement
+	// commentLines are the indices of the comments, keyed by line.
+	commentLines map[int]int
+}
+
+// collectComments adds the comments of the Earthfile, which are part of the newline
+// tokens.
+func (b *builder) collectComments(tokens []antlr.Token) {
+	b.commentLines = make(map[int]int)
+	for _, token := range tokens {
+		if token.GetTokenType() != parser.EarthLexerNL {
+			continue
+		}
+		text := token.GetText()
+		i := strings.Index(text, "#")
+		if i == -1 {
+			continue
+		}
+		text = strings.TrimRight(text[i:], " \t\r\n")
+		column := token.GetColumn() + utf8.RuneCountInString(token.GetText()[:i]) + 1
+		b.commentLines[token.GetLine()] = len(b.ef.Comments)
+		b.ef.Comments = append(b.ef.Comments, Comment{
+			Text: text,
+			SourceLocation: SourceLocation{
+				File:        b.filename,
+				StartLine:   token.GetLine(),
+				StartColumn: column,
+				EndLine:     token.GetLine(),
+				EndColumn:   column + utf8.RuneCountInString(text) - 1,
+			},
+		})
+	}
+}
+
+// docComment returns the comment lines immediately preceding the given line, without
+// their leading #.
+func (b *builder) docComment(line int) string {
+	var doc []string
+	for l := line - 1; ; l-- {
+		i, found := b.commentLines[l]
+		if !found || b.ef.Comments[i].StartColumn != 1 {
+			break
+		}
+		text := strings.TrimPrefix(b.ef.Comments[i].Text, "#")
+		doc = append([]string{strings.TrimPrefix(text, " ")}, doc...)
+	}
+	return strings.Join(doc, "\n")
+}
+
+// location returns the location spanning from the start token to the stop token.
+func (b *builder) location(start antlr.Token, stop antlr.Token) SourceLocation {
+	loc := SourceLocation{
+		File:        b.filename,
+		StartLine:   start.GetLine(),
+		StartColumn: start.GetColumn() + 1,
+	}
+	if stop == nil {
+		stop = start
+	}
+	lines := strings.Split(stop.GetText(), "\n")
+	loc.EndLine = stop.GetLine() + len(lines) - 1
+	if len(lines) == 1 {
+		loc.EndColumn = stop.GetColumn() + utf8.RuneCountInString(lines[0])
+	} else {
+		loc.EndColumn = utf8.RuneCountInString(lines[len(lines)-1])
+	}
+	return loc
+}
+
+func (b *builder) currentBlock() *Block {
+	if len(b.ef.Targets) == 0 {
+		return &b.ef.BaseRecipe
+	}
+	return &b.ef.Targets[len(b.ef.Targets)-1].Recipe
+}
+
+func (b *builder) EnterTargetHeader(c *parser.TargetHeaderContext) {
+	b.ef.Targets = append(b.ef.Targets, Target{
+		Name:           strings.TrimSuffix(c.GetText(), ":"),
+		Doc:            b.docComment(c.GetStart().GetLine()),
+		Recipe:         Block{},
+		SourceLocation: b.location(c.GetStart(), c.GetStop()),
+	})
+}
+
+func (b *builder) EnterStmt(c *parser.StmtContext) {
+	b.stmt = &Statement{
+		Command: c.GetStart().GetText(),
+		Args:    []string{},
+	}
+}
+
+func (b *builder) ExitStmt(c *parser.StmtContext) {
+	b.stmt.SourceLocation = b.location(c.GetStart(), c.GetStop())
+	block := b.currentBlock()
+	*block = append(*block, *b.stmt)
+	if len(b.ef.Targets) > 0 {
+		target := &b.ef.Targets[len(b.ef.Targets)-1]
+		target.EndLine = b.stmt.EndLine
+		target.EndColumn = b.stmt.EndColumn
+	}
+	b.stmt = nil
+}
+
+func (b *builder) EnterStmtWord(c *parser.StmtWordContext) {
+	b.stmt.Args = append(b.stmt.Args, replaceEscape(c.GetText()))
+}
+
+func (b *builder) ExitStmtWordsMaybeJSON(c *parser.StmtWordsMaybeJSONContext) {
+	var args []string
+	err := json.Unmarshal([]byte(c.GetText()), &args)
+	if err == nil {
+		b.stmt.Args = args
+		b.stmt.ExecMode = true
+	}
+}
+
+func (b *builder) ExitEnvStmt(c *parser.EnvStmtContext) {
+	b.stmt.Args = keyValueArgs(c.EnvArgKey(), c.EQUALS() != nil, c.EnvArgValue())
+}
+
+func (b *builder) ExitArgStmt(c *parser.ArgStmtContext) {
+	b.stmt.Args = keyValueArgs(c.EnvArgKey(), c.EQUALS() != nil, c.EnvArgValue())
+}
+
+func (b *builder) ExitLabelStmt(c *parser.LabelStmtContext) {
+	keys := c.AllLabelKey()
+	values := c.AllLabelValue()
+	for i := range keys {
+		if i >= len(values) {
+			break
+		}
+		b.stmt.Args = append(b.stmt.Args, keys[i].GetText(), "=", values[i].GetText())
+	}
+}
+
+// keyValueArgs returns the arguments of an ARG or ENV statement.
+func keyValueArgs(key parser.IEnvArgKeyContext, equals bool, value parser.IEnvArgValueContext) []string {
+	args := []string{key.GetText()}
+	if equals || value != nil {
+		args = append(args, "=")
+	}
+	if value != nil {
+		args = append(args, replaceEscape(value.GetText()))
+	}
+	return args
+}
+
+var lineContinuationRegexp = regexp.MustCompile("\\\\(\\n|(\\r\\n))[\\t ]*")
+
+func replaceEscape(str string) string {
+	return lineContinuationRegexp.ReplaceAllString(str, "")
+}
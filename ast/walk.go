@@ -0,0 +1,57 @@
+package ast
+
+import "fmt"
+
+// Visitor visits the nodes of a syntax tree. See Walk.
+type Visitor interface {
+	// Visit is called for each node. If the returned visitor w is not nil, the
+	// children of the node are visited with w, followed by a call of w.Visit(nil).
+	Visit(node Node) (w Visitor)
+}
+
+// Walk traverses a syntax tree in depth-first order. The children of an Earthfile are
+// the statements of its base recipe, its targets and then its comments. The children
+// of a Target are the statements of its recipe. Statements and comments have no
+// children.
+func Walk(v Visitor, node Node) {
+	v = v.Visit(node)
+	if v == nil {
+		return
+	}
+	switch n := node.(type) {
+	case *Earthfile:
+		for i := range n.BaseRecipe {
+			Walk(v, &n.BaseRecipe[i])
+		}
+		for i := range n.Targets {
+			Walk(v, &n.Targets[i])
+		}
+		for i := range n.Comments {
+			Walk(v, &n.Comments[i])
+		}
+	case *Target:
+		for i := range n.Recipe {
+			Walk(v, &n.Recipe[i])
+		}
+	case *Statement, *Comment:
+	default:
+		panic(fmt.Sprintf("ast.Walk: unexpected node type %T", n))
+	}
+	v.Visit(nil)
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses a syntax tree in depth-first order, like Walk, calling f for each
+// node. The children of a node are not visited if f returns false. f is called with nil
+// once the children of a node have been visited.
+func Inspect(node Node, f func(Node) bool) {
+	Walk(inspector(f), node)
+}
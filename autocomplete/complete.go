@@ -7,6 +7,8 @@ import (
 	"path"
 	"strings"
 
+	"github.com/earthly/earthly/buildcontext"
+	"github.com/earthly/earthly/domain"
 	"github.com/earthly/earthly/earthfile2llb"
 )
 
@@ -61,6 +63,32 @@ func isLocalPath(path string) bool {
 	return false
 }
 
+// earthfilePath returns the path of the Earthfile for the part of a target ref
+// preceding the +. The Earthfiles of remote targets are looked up in the cache
+// of previously resolved remote Earthfiles.
+func earthfilePath(dirPath string) (string, error) {
+	if dirPath == "" || isLocalPath(dirPath) {
+		realDirPath := dirPath
+		if strings.HasPrefix(dirPath, "~/") {
+			currentUser, err := user.Current()
+			if err != nil {
+				return "", err
+			}
+			realDirPath = currentUser.HomeDir + "/" + dirPath[2:]
+		}
+		return path.Join(realDirPath, "Earthfile"), nil
+	}
+	target, err := domain.ParseTarget(dirPath + "+base")
+	if err != nil {
+		return "", err
+	}
+	cacheDir, err := buildcontext.DefaultEarthfileCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return buildcontext.CachedEarthfilePath(cacheDir, target), nil
+}
+
 func getPotentialTarget(prefix string) ([]string, error) {
 	splits := strings.SplitN(prefix, "+", 2)
 	if len(splits) < 2 {
@@ -68,17 +96,16 @@ func getPotentialTarget(prefix string) ([]string, error) {
 	}
 	dirPath := splits[0]
 
-	currentUser, err := user.Current()
+	earthfile, err := earthfilePath(dirPath)
 	if err != nil {
 		return nil, err
 	}
-
-	realDirPath := dirPath
-	if strings.HasPrefix(prefix, "~/") {
-		realDirPath = currentUser.HomeDir + "/" + dirPath[2:]
+	if _, err := os.Stat(earthfile); os.IsNotExist(err) {
+		// Remote project not cached yet.
+		return []string{}, nil
 	}
 
-	targets, err := earthfile2llb.GetTargets(path.Join(realDirPath, "Earthfile"))
+	targets, err := earthfile2llb.GetTargets(earthfile)
 	if err != nil {
 		return nil, err
 	}
@@ -94,6 +121,64 @@ func getPotentialTarget(prefix string) ([]string, error) {
 	return potentials, nil
 }
 
+// findTarget returns the target ref present in the command line, if any, ignoring
+// the word being completed.
+func findTarget(line string, cursorLoc int) string {
+	prefix := parseLine(line, cursorLoc)
+	for _, s := range strings.Split(line[:cursorLoc-len(prefix)]+line[cursorLoc:], " ") {
+		if len(s) == 0 || s[0] == '-' || strings.Contains(s, "=") {
+			continue
+		}
+		if strings.Contains(s, "+") {
+			return s
+		}
+	}
+	return ""
+}
+
+// previousWord returns the word preceding the word being completed.
+func previousWord(line string, cursorLoc int) string {
+	prefix := parseLine(line, cursorLoc)
+	words := strings.Fields(line[:cursorLoc-len(prefix)])
+	if len(words) == 0 {
+		return ""
+	}
+	return words[len(words)-1]
+}
+
+// getPotentialBuildArgs returns the ARGs of the target as KEY= suggestions, each
+// prefixed with flagPrefix.
+func getPotentialBuildArgs(targetRef string, flagPrefix string, prefix string) ([]string, error) {
+	potentials := []string{}
+	if targetRef == "" {
+		return potentials, nil
+	}
+	splits := strings.SplitN(targetRef, "+", 2)
+	earthfile, err := earthfilePath(splits[0])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(earthfile); os.IsNotExist(err) {
+		return potentials, nil
+	}
+	infos, err := earthfile2llb.GetTargetInfos(earthfile)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if info.Name != splits[1] {
+			continue
+		}
+		for _, arg := range info.Args {
+			s := flagPrefix + arg.Name + "="
+			if strings.HasPrefix(s, prefix) {
+				potentials = append(potentials, s)
+			}
+		}
+	}
+	return potentials, nil
+}
+
 func getPotentialPaths(prefix string) ([]string, error) {
 	if prefix == "." {
 		return []string{"./", "../"}, nil
@@ -158,6 +243,14 @@ func GetPotentials(compLine string, compPoint int, flags, commands []string) ([]
 
 	prefix := parseLine(compLine, compPoint)
 
+	// build arg of the target
+	if previousWord(compLine, compPoint) == "--build-arg" {
+		return getPotentialBuildArgs(findTarget(compLine, compPoint), "", prefix)
+	}
+	if strings.HasPrefix(prefix, "--build-arg=") {
+		return getPotentialBuildArgs(findTarget(compLine, compPoint), "--build-arg=", prefix)
+	}
+
 	// already has a full command or target (we're done now)
 	if hasTargetOrCommand(compLine) && prefix == "" {
 		return potentials, nil
@@ -172,10 +265,11 @@ func GetPotentials(compLine string, compPoint int, flags, commands []string) ([]
 		return potentials, nil
 	}
 
-	if isLocalPath(prefix) || strings.HasPrefix(prefix, "+") {
-		if strings.Contains(prefix, "+") {
-			return getPotentialTarget(prefix)
-		}
+	if strings.Contains(prefix, "+") {
+		return getPotentialTarget(prefix)
+	}
+
+	if isLocalPath(prefix) {
 		return getPotentialPaths(prefix)
 	}
 
@@ -1,6 +1,9 @@
 package autocomplete
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	. "github.com/stretchr/testify/assert"
@@ -23,3 +26,22 @@ func TestPathCompletion(t *testing.T) {
 	NoError(t, err, "GetPotentials failed")
 	Equal(t, []string{"./", "../"}, matches)
 }
+
+func TestBuildArgCompletion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "earth-complete-test")
+	NoError(t, err, "TempDir failed")
+	defer os.RemoveAll(dir)
+	earthfile := "FROM alpine:3.11\n\nbuild:\n    FROM alpine:3.11\n    ARG VERSION=dev\n    ARG NAME\n"
+	err = ioutil.WriteFile(filepath.Join(dir, "Earthfile"), []byte(earthfile), 0644)
+	NoError(t, err, "WriteFile failed")
+
+	line := "earth " + dir + "+build --build-arg "
+	matches, err := GetPotentials(line, len(line), nil, nil)
+	NoError(t, err, "GetPotentials failed")
+	Equal(t, []string{"VERSION=", "NAME="}, matches)
+
+	line = "earth --build-arg=N " + dir + "+build"
+	matches, err = GetPotentials(line, len("earth --build-arg=N"), nil, nil)
+	NoError(t, err, "GetPotentials failed")
+	Equal(t, []string{"--build-arg=NAME="}, matches)
+}
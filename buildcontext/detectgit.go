@@ -273,3 +273,35 @@ func TargetWithGitMeta(target domain.Target, gitMeta *GitMetadata) domain.Target
 	}
 	return targetRet
 }
+
+// ChangedFiles returns the absolute paths of the files changed in the given git diff
+// range (eg main...HEAD), in the repository of dir. Renamed files are listed under both
+// their old and new paths.
+func ChangedFiles(ctx context.Context, dir string, diffRange string) ([]string, error) {
+	err := detectGitBinary(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = detectIsGitDir(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	baseDir, err := detectGitBaseDir(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, "git", "diff", "--name-only", "--no-renames", diffRange, "--")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "git diff %s", diffRange)
+	}
+	var files []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line == "" {
+			continue
+		}
+		files = append(files, filepath.Join(baseDir, filepath.FromSlash(line)))
+	}
+	return files, nil
+}
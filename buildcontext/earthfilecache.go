@@ -0,0 +1,45 @@
+package buildcontext
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/earthly/earthly/domain"
+	"github.com/pkg/errors"
+)
+
+// DefaultEarthfileCacheDir returns the directory in which the Earthfiles of remote
+// targets are cached after being resolved. The cache is used by shell completion,
+// to avoid fetching the remote project.
+func DefaultEarthfileCacheDir() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.Wrap(err, "get user home dir")
+	}
+	return filepath.Join(homeDir, ".earthly", "earthfile-cache"), nil
+}
+
+// CachedEarthfilePath returns the path at which the Earthfile of the project of
+// a remote target is cached, within cacheDir.
+func CachedEarthfilePath(cacheDir string, target domain.Target) string {
+	return filepath.Join(cacheDir, filepath.FromSlash(target.ProjectCanonical()), "Earthfile")
+}
+
+// cacheEarthfile copies the Earthfile of a resolved remote target into the cache.
+func cacheEarthfile(cacheDir string, target domain.Target, buildFilePath string) error {
+	dt, err := ioutil.ReadFile(buildFilePath)
+	if err != nil {
+		return errors.Wrapf(err, "read %s", buildFilePath)
+	}
+	cachePath := CachedEarthfilePath(cacheDir, target)
+	err = os.MkdirAll(filepath.Dir(cachePath), 0755)
+	if err != nil {
+		return errors.Wrapf(err, "create dir %s", filepath.Dir(cachePath))
+	}
+	err = ioutil.WriteFile(cachePath, dt, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "write %s", cachePath)
+	}
+	return nil
+}
@@ -17,21 +17,32 @@ var ImplicitExcludes = []string{
 	"build.earth",
 	"Earthfile",
 	EarthIgnoreFile,
+	ProjectFile,
 }
 
 func readExcludes(dir string) ([]string, error) {
+	excludes, err := readEarthIgnore(dir)
+	if err != nil {
+		return nil, err
+	}
+	return append(excludes, ImplicitExcludes...), nil
+}
+
+// readEarthIgnore returns the patterns of the earth ignore file of dir, if any.
+func readEarthIgnore(dir string) ([]string, error) {
 	filePath := filepath.Join(dir, EarthIgnoreFile)
 	f, err := os.Open(filePath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			// No earthignore file present.
-			return ImplicitExcludes, nil
+			return nil, nil
 		}
 		return nil, errors.Wrapf(err, "read %s", filePath)
 	}
+	defer f.Close()
 	excludes, err := dockerignore.ReadAll(f)
 	if err != nil {
 		return nil, errors.Wrapf(err, "parse %s", filePath)
 	}
-	return append(excludes, ImplicitExcludes...), nil
+	return excludes, nil
 }
@@ -0,0 +1,218 @@
+package buildcontext
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/builder/dockerignore"
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/llbutil"
+	"github.com/moby/buildkit/client/llb"
+	gwclient "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/pkg/errors"
+)
+
+const (
+	// GatewayLocalNameContext is the name of the local dir holding the build context,
+	// when running as a buildkit frontend.
+	GatewayLocalNameContext = "context"
+	// GatewayLocalNameDockerfile is the name of the local dir holding the Earthfile
+	// of the target being built, when running as a buildkit frontend.
+	GatewayLocalNameDockerfile = "dockerfile"
+)
+
+// gatewayResolver resolves local targets when running as a buildkit frontend, where
+// the local dirs are not readable directly, but via the buildkit session of the
+// client. The Earthfiles are read via the gateway, and written into tempDir for
+// parsing.
+type gatewayResolver struct {
+	client gwclient.Client
+	// filename is the name of the Earthfile of the main dir, in the dockerfile local
+	// dir. Earthfile and build.earth are detected if empty.
+	filename string
+	tempDir  string
+	// cache holds the resolved build contexts, by dir and build file name.
+	cache map[string]*Data
+}
+
+// NewGatewayResolver returns a new Resolver of the targets of a build run as a
+// buildkit frontend, via the gateway client c. The Earthfile of the main dir is
+// read from the dockerfile local dir, as filename, and the rest of the build
+// context from the context local dir. Only local targets are supported: the
+// targets of remote repositories are not resolved.
+func NewGatewayResolver(c gwclient.Client, filename string) (*Resolver, error) {
+	tempDir, err := ioutil.TempDir("", "earthly-frontend")
+	if err != nil {
+		return nil, errors.Wrap(err, "make temp dir for Earthfiles")
+	}
+	return &Resolver{
+		gwr: &gatewayResolver{
+			client:   c,
+			filename: filename,
+			tempDir:  tempDir,
+			cache:    make(map[string]*Data),
+		},
+	}, nil
+}
+
+func (gr *gatewayResolver) resolveLocal(ctx context.Context, target domain.Target) (*Data, error) {
+	if target.IsRemote() {
+		return nil, fmt.Errorf("remote target %s is not supported by the buildkit frontend", target.String())
+	}
+	dir := path.Clean(filepath.ToSlash(target.LocalPath))
+	if path.IsAbs(dir) || dir == ".." || strings.HasPrefix(dir, "../") {
+		return nil, fmt.Errorf("target %s is outside of the build context", target.String())
+	}
+	var candidates []string
+	localName := GatewayLocalNameContext
+	switch {
+	case target.Target == DockerfileMetaTarget:
+		candidates = []string{"Dockerfile"}
+	case dir == "." && gr.filename != "":
+		localName = GatewayLocalNameDockerfile
+		candidates = []string{gr.filename}
+	case dir == ".":
+		localName = GatewayLocalNameDockerfile
+		candidates = []string{"Earthfile", "build.earth"}
+	default:
+		candidates = []string{"Earthfile", "build.earth"}
+	}
+	key := fmt.Sprintf("%s:%s", dir, strings.Join(candidates, ","))
+	d, found := gr.cache[key]
+	if found {
+		return d, nil
+	}
+	// The Earthfile of the main dir is at the root of the dockerfile local dir.
+	paths := candidates
+	if localName == GatewayLocalNameContext {
+		paths = make([]string, 0, len(candidates))
+		for _, c := range candidates {
+			paths = append(paths, path.Join(dir, c))
+		}
+	}
+	ref, err := gr.solveLocal(ctx, localName, paths, fmt.Sprintf("[internal] load build file of %s", dir))
+	if err != nil {
+		return nil, err
+	}
+	var buildFileName string
+	var dt []byte
+	for i, c := range candidates {
+		dt, err = ref.ReadFile(ctx, gwclient.ReadRequest{Filename: paths[i]})
+		if err == nil {
+			buildFileName = c
+			break
+		}
+	}
+	if buildFileName == "" {
+		if target.Target == DockerfileMetaTarget {
+			return nil, fmt.Errorf("No Dockerfile found for target %s", target.String())
+		}
+		return nil, fmt.Errorf("No Earthfile nor build.earth file found for target %s", target.String())
+	}
+	buildFilePath := filepath.Join(gr.tempDir, filepath.FromSlash(dir), buildFileName)
+	err = os.MkdirAll(filepath.Dir(buildFilePath), 0755)
+	if err != nil {
+		return nil, errors.Wrapf(err, "make dir for %s", buildFileName)
+	}
+	err = ioutil.WriteFile(buildFilePath, dt, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "write %s", buildFileName)
+	}
+	excludes, err := gr.readExcludes(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	project, err := loadProject(nil)
+	if err != nil {
+		return nil, err
+	}
+	d = &Data{
+		Project:       project,
+		BuildFilePath: buildFilePath,
+		BuildContext:  gr.buildContext(dir, excludes),
+	}
+	gr.cache[key] = d
+	return d, nil
+}
+
+// readExcludes returns the patterns of the earth ignore file of dir, in the context
+// local dir, and the implicit excludes.
+func (gr *gatewayResolver) readExcludes(ctx context.Context, dir string) ([]string, error) {
+	filePath := path.Join(dir, EarthIgnoreFile)
+	ref, err := gr.solveLocal(ctx, GatewayLocalNameContext, []string{filePath}, fmt.Sprintf("[internal] load %s", filePath))
+	if err != nil {
+		return nil, err
+	}
+	dt, err := ref.ReadFile(ctx, gwclient.ReadRequest{Filename: filePath})
+	if err != nil {
+		// No earthignore file present.
+		return append([]string{}, ImplicitExcludes...), nil
+	}
+	excludes, err := dockerignore.ReadAll(bytes.NewReader(dt))
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse %s", filePath)
+	}
+	return append(excludes, ImplicitExcludes...), nil
+}
+
+// buildContext returns the build context of the targets of dir, from the context
+// local dir.
+func (gr *gatewayResolver) buildContext(dir string, excludes []string) llb.State {
+	opts := []llb.LocalOption{
+		llb.SharedKeyHint(GatewayLocalNameContext),
+		llb.SessionID(gr.client.BuildOpts().SessionID),
+		llb.Platform(llbutil.TargetPlatform),
+		llb.WithCustomNamef("[context %s] local context %s", dir, dir),
+	}
+	if dir == "." {
+		return llb.Local(GatewayLocalNameContext, append(opts, llb.ExcludePatterns(excludes))...)
+	}
+	// The excludes are relative to dir.
+	dirExcludes := make([]string, 0, len(excludes))
+	for _, e := range excludes {
+		if strings.HasPrefix(e, "!") {
+			dirExcludes = append(dirExcludes, "!"+path.Join(dir, e[1:]))
+			continue
+		}
+		dirExcludes = append(dirExcludes, path.Join(dir, e))
+	}
+	opts = append(opts, llb.FollowPaths([]string{dir}), llb.ExcludePatterns(dirExcludes))
+	return llb.Scratch().Platform(llbutil.TargetPlatform).File(
+		llb.Copy(llb.Local(GatewayLocalNameContext, opts...), dir, "/", &llb.CopyInfo{
+			CopyDirContentsOnly: true,
+		}),
+		llb.WithCustomNamef("[context %s] local context %s", dir, dir))
+}
+
+// solveLocal solves the given paths of a local dir, via the gateway.
+func (gr *gatewayResolver) solveLocal(ctx context.Context, localName string, paths []string, name string) (gwclient.Reference, error) {
+	st := llb.Local(localName,
+		llb.FollowPaths(paths),
+		llb.SessionID(gr.client.BuildOpts().SessionID),
+		llb.SharedKeyHint(localName+"-build-files"),
+		llb.WithCustomName(name),
+	)
+	def, err := st.Marshal(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "marshal %s", localName)
+	}
+	res, err := gr.client.Solve(ctx, gwclient.SolveRequest{Definition: def.ToPB()})
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", localName)
+	}
+	ref, err := res.SingleRef()
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", localName)
+	}
+	return ref, nil
+}
+
+func (gr *gatewayResolver) close() error {
+	return os.RemoveAll(gr.tempDir)
+}
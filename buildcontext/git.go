@@ -14,6 +14,7 @@ import (
 	"github.com/earthly/earthly/llbutil/llbgit"
 	"github.com/moby/buildkit/client"
 	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/session"
 	"github.com/pkg/errors"
 	"golang.org/x/sync/errgroup"
 )
@@ -27,6 +28,15 @@ type gitResolver struct {
 	console  conslogging.ConsoleLogger
 
 	projectCache map[string]*resolvedGitProject
+
+	earthfileCacheDir string
+
+	gitAuth GitAuth
+
+	trustPolicy TrustPolicy
+	// verified holds the local paths of the remote Earthfiles which passed the
+	// verification of the trust policy.
+	verified map[string]bool
 }
 
 type resolvedGitProject struct {
@@ -40,6 +50,8 @@ type resolvedGitProject struct {
 	branches []string
 	// tags is the git tags
 	tags []string
+	// commit is the raw git commit, as output by git cat-file commit.
+	commit []byte
 	// state is the state holding the git files.
 	state llb.State
 }
@@ -71,9 +83,32 @@ func (gr *gitResolver) resolveEarthProject(ctx context.Context, target domain.Ta
 	if err != nil {
 		return nil, err
 	}
+	if !gr.verified[buildFilePath] {
+		err = gr.trustPolicy.verify(ctx, target, buildFilePath, rgp.commit)
+		if err != nil {
+			return nil, err
+		}
+		gr.verified[buildFilePath] = true
+	}
+	projectFiles, err := findProjectFiles(localEarthfileDir, rgp.localGitDir)
+	if err != nil {
+		return nil, err
+	}
+	project, err := loadProject(projectFiles)
+	if err != nil {
+		return nil, err
+	}
+	if gr.earthfileCacheDir != "" && target.Target != DockerfileMetaTarget {
+		err = cacheEarthfile(gr.earthfileCacheDir, target, buildFilePath)
+		if err != nil {
+			// Only used for shell completion.
+			gr.console.Warnf("Warning: failed to cache Earthfile of %s: %v\n", target.ProjectCanonical(), err)
+		}
+	}
 	return &Data{
 		BuildFilePath: buildFilePath,
 		BuildContext:  buildContext,
+		Project:       project,
 		GitMetadata: &GitMetadata{
 			BaseDir:    "",
 			RelDir:     subDir,
@@ -95,7 +130,7 @@ func (gr *gitResolver) resolveGitProject(ctx context.Context, target domain.Targ
 	githubUsername := projectPathParts[0]
 	githubProject := projectPathParts[1]
 	subDir = strings.Join(projectPathParts[2:], "/")
-	gitURL = fmt.Sprintf("git@%s:%s/%s.git", target.Registry, githubUsername, githubProject)
+	gitURL, authOpts := gr.gitAuth.remote(target.Registry, fmt.Sprintf("%s/%s", githubUsername, githubProject))
 	ref := target.Tag
 
 	// Check the cache first.
@@ -111,12 +146,14 @@ func (gr *gitResolver) resolveGitProject(ctx context.Context, target domain.Targ
 		llb.WithCustomNamef("[context %s] GIT CLONE %s", gitURL, gitURL),
 		llb.KeepGitDir(),
 	}
+	gitOpts = append(gitOpts, authOpts...)
 	gitState := llbgit.Git(gitURL, ref, gitOpts...)
 	copyOpts := []llb.RunOption{
 		llb.Args([]string{
 			"find",
 			"-type", "f",
-			"(", "-name", "build.earth", "-o", "-name", "Earthfile", "-o", "-name", "Dockerfile", ")",
+			"(", "-name", "build.earth", "-o", "-name", "Earthfile", "-o", "-name", "Dockerfile", "-o", "-name", ProjectFile,
+			"-o", "-name", "build.earth.sig", "-o", "-name", "Earthfile.sig", ")",
 			"-exec", "cp", "--parents", "{}", "/dest", ";",
 		}),
 		llb.Dir("/git-src"),
@@ -136,7 +173,8 @@ func (gr *gitResolver) resolveGitProject(ctx context.Context, target domain.Targ
 			"/bin/sh", "-c",
 			"git rev-parse HEAD >/dest/git-hash ; " +
 				"git rev-parse --abbrev-ref HEAD >/dest/git-branch  || touch /dest/git-branch ; " +
-				"git describe --exact-match --tags >/dest/git-tags || touch /dest/git-tags",
+				"git describe --exact-match --tags >/dest/git-tags || touch /dest/git-tags ; " +
+				"git cat-file commit HEAD >/dest/git-commit",
 		}),
 		llb.Dir("/git-src"),
 		llb.ReadonlyRootFS(),
@@ -160,7 +198,7 @@ func (gr *gitResolver) resolveGitProject(ctx context.Context, target domain.Targ
 			os.RemoveAll(earthfileTmpDir)
 		}
 	}()
-	solveOpt := newSolveOptGit(earthfileTmpDir)
+	solveOpt := newSolveOptGit(earthfileTmpDir, gr.gitAuth.Attachables)
 	ch := make(chan *client.SolveStatus)
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -171,22 +209,17 @@ func (gr *gitResolver) resolveGitProject(ctx context.Context, target domain.Targ
 		return err
 	})
 	eg.Go(func() error {
-		for {
-			select {
-			case ss, ok := <-ch:
-				if !ok {
-					return nil
+		// The statuses are read until the solve closes the channel, including once
+		// ctx is canceled, as the solve blocks on sending them otherwise.
+		for ss := range ch {
+			for _, vertex := range ss.Vertexes {
+				if vertex.Error != "" {
+					// TODO: Should also print full logs in case of error.
+					gr.console.Warnf("ERROR: %s\n", vertex.Error)
 				}
-				for _, vertex := range ss.Vertexes {
-					if vertex.Error != "" {
-						// TODO: Should also print full logs in case of error.
-						gr.console.Warnf("ERROR: %s\n", vertex.Error)
-					}
-				}
-			case <-ctx.Done():
-				return nil
 			}
 		}
+		return nil
 	})
 	err = eg.Wait()
 	if err != nil {
@@ -234,17 +267,25 @@ func (gr *gitResolver) resolveGitProject(ctx context.Context, target domain.Targ
 		}
 	}
 
+	gitCommit, err := ioutil.ReadFile(filepath.Join(earthfileTmpDir, "git-commit"))
+	if err != nil {
+		return nil, "", "", errors.Wrap(err, "read git commit after solve")
+	}
+
 	// Add to cache.
 	resolved := &resolvedGitProject{
 		localGitDir: earthfileTmpDir,
 		hash:        gitHash,
 		branches:    gitBranches2,
 		tags:        gitTags2,
+		commit:      gitCommit,
 		gitProject:  fmt.Sprintf("%s/%s", githubUsername, githubProject),
 		state: llbgit.Git(
 			gitURL,
 			gitHash,
-			llb.WithCustomNamef("[context %s] git context %s", gitURL, target.StringCanonical()),
+			append([]llb.GitOption{
+				llb.WithCustomNamef("[context %s] git context %s", gitURL, target.StringCanonical()),
+			}, authOpts...)...,
 		),
 	}
 	gr.projectCache[cacheKey] = resolved
@@ -275,7 +316,7 @@ func (gr *gitResolver) close() error {
 	return nil
 }
 
-func newSolveOptGit(outDir string) *client.SolveOpt {
+func newSolveOptGit(outDir string, attachables []session.Attachable) *client.SolveOpt {
 	return &client.SolveOpt{
 		Exports: []client.ExportEntry{
 			{
@@ -284,5 +325,6 @@ func newSolveOptGit(outDir string) *client.SolveOpt {
 			},
 		},
 		LocalDirs: make(map[string]string),
+		Session:   attachables,
 	}
 }
@@ -0,0 +1,35 @@
+package buildcontext
+
+import (
+	"fmt"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/session"
+)
+
+// GitTokenSecret is the ID of the secret holding the token which authenticates the
+// clones of the remote repositories of the sites configured with auth token. The
+// secret GitTokenSecret.<site> (eg GIT_AUTH_TOKEN.github.com) takes precedence, if
+// set.
+const GitTokenSecret = "GIT_AUTH_TOKEN"
+
+// GitAuth holds the settings authenticating the clones of remote repositories.
+type GitAuth struct {
+	// TokenSites are the git sites whose repositories are cloned over https, with the
+	// token held by the secret GitTokenSecret, rather than over ssh.
+	TokenSites []string
+	// Attachables are the session attachables of the clones, providing the secrets.
+	Attachables []session.Attachable
+}
+
+// remote returns the URL the repository of a site is cloned from, and the git options
+// authenticating the clone.
+func (ga GitAuth) remote(site string, repoPath string) (string, []llb.GitOption) {
+	for _, tokenSite := range ga.TokenSites {
+		if tokenSite == site {
+			return fmt.Sprintf("https://%s/%s.git", site, repoPath),
+				[]llb.GitOption{llb.AuthTokenSecret(GitTokenSecret)}
+		}
+	}
+	return fmt.Sprintf("git@%s:%s.git", site, repoPath), nil
+}
@@ -0,0 +1,15 @@
+package buildcontext
+
+import "testing"
+
+func TestGitAuthRemote(t *testing.T) {
+	ga := GitAuth{TokenSites: []string{"github.com"}}
+	url, opts := ga.remote("github.com", "foo/bar")
+	if url != "https://github.com/foo/bar.git" || len(opts) != 1 {
+		t.Errorf("unexpected remote %s %v", url, opts)
+	}
+	url, opts = ga.remote("gitlab.com", "foo/bar")
+	if url != "git@gitlab.com:foo/bar.git" || len(opts) != 0 {
+		t.Errorf("unexpected remote %s %v", url, opts)
+	}
+}
@@ -14,6 +14,7 @@ import (
 
 type localResolver struct {
 	gitMetaCache map[string]*GitMetadata
+	projectCache map[string]*Project
 	sessionID    string
 }
 
@@ -53,7 +54,20 @@ func (lr *localResolver) resolveLocal(ctx context.Context, target domain.Target)
 	if err != nil {
 		return nil, err
 	}
+	project, found := lr.projectCache[target.LocalPath]
+	if !found {
+		files, err := findProjectFiles(filepath.FromSlash(target.LocalPath), "")
+		if err != nil {
+			return nil, err
+		}
+		project, err = loadProject(files)
+		if err != nil {
+			return nil, err
+		}
+		lr.projectCache[target.LocalPath] = project
+	}
 	return &Data{
+		Project:       project,
 		BuildFilePath: buildFilePath,
 		BuildContext: llb.Local(
 			target.LocalPath,
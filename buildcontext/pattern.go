@@ -0,0 +1,50 @@
+package buildcontext
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// FindBuildFiles returns the Earthfiles (or build.earth files) under dir, including
+// the one of dir itself, sorted by path. Hidden dirs, such as .git, are not searched.
+func FindBuildFiles(dir string) ([]string, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "stat %s", dir)
+	}
+	if !fi.IsDir() {
+		return nil, errors.Errorf("%s is not a dir", dir)
+	}
+	var files []string
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		if p != dir && strings.HasPrefix(fi.Name(), ".") {
+			return filepath.SkipDir
+		}
+		for _, name := range []string{"Earthfile", "build.earth"} {
+			buildFile := filepath.Join(p, name)
+			bfi, err := os.Stat(buildFile)
+			if err == nil && !bfi.IsDir() {
+				files = append(files, buildFile)
+				break
+			} else if err != nil && !os.IsNotExist(err) {
+				return errors.Wrapf(err, "stat %s", buildFile)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "walk %s", dir)
+	}
+	sort.Strings(files)
+	return files, nil
+}
@@ -0,0 +1,51 @@
+package buildcontext
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFindBuildFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "earth-pattern-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{
+		"Earthfile",
+		"services/a/Earthfile",
+		"services/b/build.earth",
+		"services/b/nested/Earthfile",
+		"services/c/main.go",
+		"services/.hidden/Earthfile",
+	} {
+		p := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(p), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(p, []byte{}, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := FindBuildFiles(filepath.Join(dir, "services"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		filepath.Join(dir, "services/a/Earthfile"),
+		filepath.Join(dir, "services/b/build.earth"),
+		filepath.Join(dir, "services/b/nested/Earthfile"),
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("got %v, expected %v", files, expected)
+	}
+	_, err = FindBuildFiles(filepath.Join(dir, "missing"))
+	if err == nil {
+		t.Errorf("expected an error for a missing dir")
+	}
+}
@@ -0,0 +1,98 @@
+package buildcontext
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// ProjectFile is the name of the project config file. The project files found in the
+// dir of an Earthfile and in its parent dirs, up to the root of the repository, apply
+// to the targets of the Earthfile.
+const ProjectFile = "earth-project.yml"
+
+// Project is the config shared by the Earthfiles of a project, as per its project
+// files.
+type Project struct {
+	// Args are the default values of the args declared by the targets, which take
+	// precedence over the defaults of the ARG commands. They are typically used for
+	// the base images and the registries of the project.
+	Args map[string]string `yaml:"args"`
+	// Files are the project files the project is read from, the nearest one first.
+	Files []string `yaml:"-"`
+}
+
+var argNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// findProjectFiles returns the project files applying to the Earthfiles of dir, the
+// nearest one first. The parent dirs are searched up to rootDir (included) if it is
+// set. Otherwise, they are searched up to the root of the git repository, or of the
+// filesystem.
+func findProjectFiles(dir string, rootDir string) ([]string, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "abs %s", dir)
+	}
+	if rootDir != "" {
+		rootDir, err = filepath.Abs(rootDir)
+		if err != nil {
+			return nil, errors.Wrapf(err, "abs %s", rootDir)
+		}
+	}
+	var files []string
+	for {
+		p := filepath.Join(absDir, ProjectFile)
+		_, err := os.Stat(p)
+		if err == nil {
+			files = append(files, p)
+		} else if !os.IsNotExist(err) {
+			return nil, errors.Wrapf(err, "stat %s", p)
+		}
+		if absDir == rootDir {
+			break
+		}
+		if rootDir == "" {
+			_, err = os.Stat(filepath.Join(absDir, ".git"))
+			if err == nil {
+				break
+			}
+		}
+		parent := filepath.Dir(absDir)
+		if parent == absDir {
+			break
+		}
+		absDir = parent
+	}
+	return files, nil
+}
+
+// loadProject reads the project files, the nearest one first. The settings of nearer
+// files take precedence over those of farther ones.
+func loadProject(files []string) (*Project, error) {
+	project := &Project{
+		Args:  make(map[string]string),
+		Files: files,
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		dt, err := ioutil.ReadFile(files[i])
+		if err != nil {
+			return nil, errors.Wrapf(err, "read %s", files[i])
+		}
+		var pf Project
+		err = yaml.UnmarshalStrict(dt, &pf)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse %s", files[i])
+		}
+		for name, value := range pf.Args {
+			if !argNameRe.MatchString(name) {
+				return nil, errors.Errorf("invalid arg name %s in %s", name, files[i])
+			}
+			project.Args[name] = value
+		}
+	}
+	return project, nil
+}
@@ -0,0 +1,81 @@
+package buildcontext
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestProject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "earth-project-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(name string, content string) {
+		p := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(p), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(p, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The project file outside of the repository does not apply.
+	write(ProjectFile, "args:\n  OUTSIDE: \"true\"\n")
+	write("repo/.git/HEAD", "")
+	write("repo/"+ProjectFile, "args:\n  BASE_IMAGE: golang:1.15-alpine\n  REGISTRY: registry.example.com\n")
+	write("repo/services/"+ProjectFile, "args:\n  REGISTRY: registry.example.com/services\n")
+	write("repo/services/api/Earthfile", "build:\n")
+
+	files, err := findProjectFiles(filepath.Join(dir, "repo", "services", "api"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedFiles := []string{
+		filepath.Join(dir, "repo", "services", ProjectFile),
+		filepath.Join(dir, "repo", ProjectFile),
+	}
+	if !reflect.DeepEqual(files, expectedFiles) {
+		t.Errorf("expected files %v, got %v", expectedFiles, files)
+	}
+	project, err := loadProject(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedArgs := map[string]string{
+		"BASE_IMAGE": "golang:1.15-alpine",
+		"REGISTRY":   "registry.example.com/services",
+	}
+	if !reflect.DeepEqual(project.Args, expectedArgs) {
+		t.Errorf("expected args %v, got %v", expectedArgs, project.Args)
+	}
+
+	// Bounded by the root dir, rather than by the repository.
+	files, err = findProjectFiles(filepath.Join(dir, "repo", "services", "api"), filepath.Join(dir, "repo", "services"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(files, expectedFiles[:1]) {
+		t.Errorf("expected files %v, got %v", expectedFiles[:1], files)
+	}
+
+	write("repo/services/"+ProjectFile, "args:\n  NOT-AN-ARG: x\n")
+	_, err = loadProject(expectedFiles)
+	if err == nil {
+		t.Errorf("expected an error for an invalid arg name")
+	}
+	write("repo/services/"+ProjectFile, "registry: registry.example.com\n")
+	_, err = loadProject(expectedFiles)
+	if err == nil {
+		t.Errorf("expected an error for an unknown setting")
+	}
+}
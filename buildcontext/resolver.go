@@ -25,24 +25,36 @@ type Data struct {
 	Target domain.Target
 	// LocalDirs is the local dirs map to be passed as part of the buildkit solve.
 	LocalDirs map[string]string
+	// Project is the project config applying to the target.
+	Project *Project
 }
 
 // Resolver is a build context resolver.
 type Resolver struct {
 	gr *gitResolver
 	lr *localResolver
+	// gwr resolves the targets instead of gr and lr, when running as a buildkit
+	// frontend. See NewGatewayResolver.
+	gwr *gatewayResolver
 }
 
-// NewResolver returns a new NewResolver.
-func NewResolver(bkClient *client.Client, console conslogging.ConsoleLogger, sessionID string) *Resolver {
+// NewResolver returns a new NewResolver. The Earthfiles of resolved remote targets
+// are cached in earthfileCacheDir, if not empty. The remote repositories are cloned
+// as per gitAuth, and their Earthfiles are verified as per trustPolicy.
+func NewResolver(bkClient *client.Client, console conslogging.ConsoleLogger, sessionID string, earthfileCacheDir string, gitAuth GitAuth, trustPolicy TrustPolicy) *Resolver {
 	return &Resolver{
 		gr: &gitResolver{
-			bkClient:     bkClient,
-			console:      console,
-			projectCache: make(map[string]*resolvedGitProject),
+			bkClient:          bkClient,
+			console:           console,
+			projectCache:      make(map[string]*resolvedGitProject),
+			earthfileCacheDir: earthfileCacheDir,
+			gitAuth:           gitAuth,
+			trustPolicy:       trustPolicy,
+			verified:          make(map[string]bool),
 		},
 		lr: &localResolver{
 			gitMetaCache: make(map[string]*GitMetadata),
+			projectCache: make(map[string]*Project),
 			sessionID:    sessionID,
 		},
 	}
@@ -51,6 +63,16 @@ func NewResolver(bkClient *client.Client, console conslogging.ConsoleLogger, ses
 // Resolve returns resolved build context data.
 func (r *Resolver) Resolve(ctx context.Context, target domain.Target) (*Data, error) {
 	localDirs := make(map[string]string)
+	if r.gwr != nil {
+		// The local dirs are read via the session of the client of the frontend.
+		d, err := r.gwr.resolveLocal(ctx, target)
+		if err != nil {
+			return nil, err
+		}
+		d.Target = target
+		d.LocalDirs = localDirs
+		return d, nil
+	}
 	if target.IsRemote() {
 		// Remote.
 		d, err := r.gr.resolveEarthProject(ctx, target)
@@ -76,5 +98,8 @@ func (r *Resolver) Resolve(ctx context.Context, target domain.Target) (*Data, er
 
 // Close closes the resolver, freeing up any internal resources.
 func (r *Resolver) Close() error {
+	if r.gwr != nil {
+		return r.gwr.close()
+	}
 	return r.gr.close()
 }
@@ -0,0 +1,212 @@
+package buildcontext
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/errcode"
+	"github.com/pkg/errors"
+)
+
+// Ways of verifying remote Earthfiles.
+const (
+	// VerifyNone trusts the Earthfiles without verifying them.
+	VerifyNone = "none"
+	// VerifyGitCommit requires the commit the Earthfiles are read from to be signed
+	// by one of the GPG keys of the rule.
+	VerifyGitCommit = "git-commit"
+	// VerifySignature requires each Earthfile to have a detached signature next to it
+	// (eg Earthfile.sig), as produced by cosign sign-blob, made by one of the cosign
+	// keys of the rule.
+	VerifySignature = "signature"
+)
+
+// TrustPolicy decides which remote Earthfiles may be executed, depending on their
+// signatures.
+type TrustPolicy struct {
+	// Rules are the trust rules. The first rule matching the project of a remote target
+	// applies. The Earthfiles of projects no rule matches are not verified.
+	Rules []TrustRule
+}
+
+// TrustRule is how the Earthfiles of the projects matching a pattern are verified.
+type TrustRule struct {
+	// Projects is the pattern of the projects the rule applies to, such as
+	// github.com/acme or github.com/acme/*, in which * matches any sequence of
+	// characters other than /. A pattern also applies to the subdirectories of the
+	// projects it matches, such that github.com applies to all the projects of GitHub,
+	// and * to all the remote projects.
+	Projects string
+	// Verify is VerifyNone, VerifyGitCommit or VerifySignature.
+	Verify string
+	// Keys are the paths of the public keys trusted: armored GPG keys for
+	// VerifyGitCommit and cosign keys for VerifySignature.
+	Keys []string
+}
+
+// UntrustedEarthfileError is returned when a remote Earthfile fails the verification
+// required by the trust policy.
+type UntrustedEarthfileError struct {
+	// Project is the canonical project of the target.
+	Project string
+	Verify  string
+	Reason  error
+}
+
+func (uee *UntrustedEarthfileError) Error() string {
+	return fmt.Sprintf("untrusted Earthfile of %s: %s verification failed: %v", uee.Project, uee.Verify, uee.Reason)
+}
+
+// ErrorCategory implements errcode.Categorized.
+func (uee *UntrustedEarthfileError) ErrorCategory() errcode.Category {
+	return errcode.PolicyViolation
+}
+
+// Validate returns an error if a rule of the policy is invalid.
+func (tp TrustPolicy) Validate() error {
+	for _, rule := range tp.Rules {
+		_, err := path.Match(rule.Projects, "")
+		if err != nil || rule.Projects == "" {
+			return fmt.Errorf("invalid project pattern %q", rule.Projects)
+		}
+		switch rule.Verify {
+		case VerifyNone:
+		case VerifyGitCommit, VerifySignature:
+			if len(rule.Keys) == 0 {
+				return fmt.Errorf("no keys for the %s verification of %s", rule.Verify, rule.Projects)
+			}
+		default:
+			return fmt.Errorf("invalid verification %q of %s. Valid values: %s, %s, %s", rule.Verify, rule.Projects, VerifyNone, VerifyGitCommit, VerifySignature)
+		}
+	}
+	return nil
+}
+
+// rule returns the rule applying to the remote target. Nil if none does.
+func (tp TrustPolicy) rule(target domain.Target) *TrustRule {
+	project := path.Join(target.Registry, target.ProjectPath)
+	for i, rule := range tp.Rules {
+		for p := project; p != "." && p != "/"; p = path.Dir(p) {
+			matched, err := path.Match(rule.Projects, p)
+			if err == nil && matched {
+				return &tp.Rules[i]
+			}
+		}
+	}
+	return nil
+}
+
+// verify returns an UntrustedEarthfileError if the Earthfile at buildFilePath, read
+// from the given git commit, fails the verification required by the trust policy.
+func (tp TrustPolicy) verify(ctx context.Context, target domain.Target, buildFilePath string, commit []byte) error {
+	rule := tp.rule(target)
+	if rule == nil || rule.Verify == VerifyNone {
+		return nil
+	}
+	var err error
+	switch rule.Verify {
+	case VerifyGitCommit:
+		err = verifyGitCommit(ctx, commit, rule.Keys)
+	case VerifySignature:
+		err = verifySignatureFile(ctx, buildFilePath, rule.Keys)
+	}
+	if err != nil {
+		return &UntrustedEarthfileError{
+			Project: target.ProjectCanonical(),
+			Verify:  rule.Verify,
+			Reason:  err,
+		}
+	}
+	return nil
+}
+
+// verifyGitCommit verifies the GPG signature of the raw git commit (as output by git
+// cat-file commit) via the gpg CLI, against the keys.
+func verifyGitCommit(ctx context.Context, commit []byte, keys []string) error {
+	payload, sig, err := splitCommitSignature(commit)
+	if err != nil {
+		return err
+	}
+	homeDir, err := ioutil.TempDir("", "earthly-gpg")
+	if err != nil {
+		return errors.Wrap(err, "make temp dir for gpg")
+	}
+	defer os.RemoveAll(homeDir)
+	importArgs := append([]string{"--batch", "--homedir", homeDir, "--import"}, keys...)
+	out, err := exec.CommandContext(ctx, "gpg", importArgs...).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "gpg import keys: %s", strings.TrimSpace(string(out)))
+	}
+	sigPath := filepath.Join(homeDir, "commit.sig")
+	payloadPath := filepath.Join(homeDir, "commit")
+	err = ioutil.WriteFile(sigPath, sig, 0600)
+	if err != nil {
+		return errors.Wrap(err, "write commit signature")
+	}
+	err = ioutil.WriteFile(payloadPath, payload, 0600)
+	if err != nil {
+		return errors.Wrap(err, "write commit")
+	}
+	cmd := exec.CommandContext(
+		ctx, "gpg", "--batch", "--homedir", homeDir, "--status-fd", "1", "--verify", sigPath, payloadPath)
+	out, err = cmd.Output()
+	if err != nil || !bytes.Contains(out, []byte("[GNUPG:] GOODSIG ")) {
+		return errors.New("the commit is not signed by a trusted key")
+	}
+	return nil
+}
+
+// splitCommitSignature splits a raw git commit into the commit without its gpgsig
+// header, which is what is signed, and the signature.
+func splitCommitSignature(commit []byte) ([]byte, []byte, error) {
+	var payload, sig bytes.Buffer
+	inHeaders := true
+	inSig := false
+	for _, line := range strings.SplitAfter(string(commit), "\n") {
+		switch {
+		case !inHeaders:
+			payload.WriteString(line)
+		case inSig && strings.HasPrefix(line, " "):
+			sig.WriteString(line[1:])
+		case strings.HasPrefix(line, "gpgsig "):
+			inSig = true
+			sig.WriteString(strings.TrimPrefix(line, "gpgsig "))
+		default:
+			inSig = false
+			if line == "\n" {
+				inHeaders = false
+			}
+			payload.WriteString(line)
+		}
+	}
+	if sig.Len() == 0 {
+		return nil, nil, errors.New("the commit is not signed")
+	}
+	return payload.Bytes(), sig.Bytes(), nil
+}
+
+// verifySignatureFile verifies the detached signature of the Earthfile, at
+// <Earthfile>.sig, via cosign verify-blob, against the keys.
+func verifySignatureFile(ctx context.Context, buildFilePath string, keys []string) error {
+	sigPath := buildFilePath + ".sig"
+	_, err := os.Stat(sigPath)
+	if err != nil {
+		return fmt.Errorf("no signature %s next to the Earthfile", filepath.Base(sigPath))
+	}
+	for _, key := range keys {
+		cmd := exec.CommandContext(
+			ctx, "cosign", "verify-blob", "--key", key, "--signature", sigPath, buildFilePath)
+		if cmd.Run() == nil {
+			return nil
+		}
+	}
+	return errors.New("the Earthfile is not signed by a trusted key")
+}
@@ -0,0 +1,128 @@
+package buildcontext
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/errcode"
+)
+
+func TestTrustPolicyRule(t *testing.T) {
+	tp := TrustPolicy{Rules: []TrustRule{
+		{Projects: "github.com/acme/tools", Verify: VerifyNone},
+		{Projects: "github.com/acme", Verify: VerifyGitCommit, Keys: []string{"acme.asc"}},
+		{Projects: "gitlab.com/*/earthly-lib", Verify: VerifySignature, Keys: []string{"cosign.pub"}},
+	}}
+	tests := []struct {
+		projectPath string
+		registry    string
+		expected    string
+	}{
+		{"acme/tools", "github.com", VerifyNone},
+		{"acme/tools/go", "github.com", VerifyNone},
+		{"acme/app", "github.com", VerifyGitCommit},
+		{"acme2/app", "github.com", ""},
+		{"foo/earthly-lib/sub", "gitlab.com", VerifySignature},
+		{"foo/other", "gitlab.com", ""},
+	}
+	for _, tt := range tests {
+		target := domain.Target{Registry: tt.registry, ProjectPath: tt.projectPath, Target: "build"}
+		rule := tp.rule(target)
+		actual := ""
+		if rule != nil {
+			actual = rule.Verify
+		}
+		if actual != tt.expected {
+			t.Errorf("%s/%s: expected %q, got %q", tt.registry, tt.projectPath, tt.expected, actual)
+		}
+	}
+	all := TrustPolicy{Rules: []TrustRule{{Projects: "*", Verify: VerifyNone}}}
+	if all.rule(domain.Target{Registry: "example.com", ProjectPath: "a/b", Target: "build"}) == nil {
+		t.Error("expected * to match all the projects")
+	}
+}
+
+func TestTrustPolicyValidate(t *testing.T) {
+	tests := []struct {
+		rule  TrustRule
+		valid bool
+	}{
+		{TrustRule{Projects: "github.com/acme", Verify: VerifyNone}, true},
+		{TrustRule{Projects: "github.com/acme", Verify: VerifyGitCommit, Keys: []string{"acme.asc"}}, true},
+		{TrustRule{Projects: "github.com/acme", Verify: VerifySignature}, false},
+		{TrustRule{Projects: "github.com/acme", Verify: "sigstore"}, false},
+		{TrustRule{Projects: "github.com/[acme", Verify: VerifyNone}, false},
+		{TrustRule{Verify: VerifyNone}, false},
+	}
+	for _, tt := range tests {
+		err := TrustPolicy{Rules: []TrustRule{tt.rule}}.Validate()
+		if (err == nil) != tt.valid {
+			t.Errorf("%+v: expected valid %v, got %v", tt.rule, tt.valid, err)
+		}
+	}
+}
+
+func TestSplitCommitSignature(t *testing.T) {
+	commit := "tree 4b825dc642cb6eb9a060e54bf8d69288fbee4904\n" +
+		"author Jane Doe <jane@example.com> 1600000000 +0000\n" +
+		"committer Jane Doe <jane@example.com> 1600000000 +0000\n" +
+		"gpgsig -----BEGIN PGP SIGNATURE-----\n" +
+		" \n" +
+		" iQEzBAABCAAdFiEE\n" +
+		" -----END PGP SIGNATURE-----\n" +
+		"\n" +
+		"Initial commit\n"
+	payload, sig, err := splitCommitSignature([]byte(commit))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedPayload := "tree 4b825dc642cb6eb9a060e54bf8d69288fbee4904\n" +
+		"author Jane Doe <jane@example.com> 1600000000 +0000\n" +
+		"committer Jane Doe <jane@example.com> 1600000000 +0000\n" +
+		"\n" +
+		"Initial commit\n"
+	if string(payload) != expectedPayload {
+		t.Errorf("unexpected payload %q", payload)
+	}
+	expectedSig := "-----BEGIN PGP SIGNATURE-----\n\niQEzBAABCAAdFiEE\n-----END PGP SIGNATURE-----\n"
+	if string(sig) != expectedSig {
+		t.Errorf("unexpected signature %q", sig)
+	}
+	_, _, err = splitCommitSignature([]byte(expectedPayload))
+	if err == nil {
+		t.Error("expected an error for an unsigned commit")
+	}
+}
+
+func TestTrustPolicyVerifyMissingSignature(t *testing.T) {
+	dir, err := ioutil.TempDir("", "earthly-trust-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	buildFilePath := filepath.Join(dir, "Earthfile")
+	err = ioutil.WriteFile(buildFilePath, []byte("build:\n\tRUN true\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp := TrustPolicy{Rules: []TrustRule{
+		{Projects: "github.com/acme", Verify: VerifySignature, Keys: []string{"cosign.pub"}},
+	}}
+	target := domain.Target{Registry: "github.com", ProjectPath: "acme/lib", Tag: "main", Target: "build"}
+	err = tp.verify(context.Background(), target, buildFilePath, nil)
+	uee, ok := err.(*UntrustedEarthfileError)
+	if !ok || uee.Project != "github.com/acme/lib:main" {
+		t.Fatalf("expected an untrusted Earthfile error, got %v", err)
+	}
+	if errcode.CategoryOf(err) != errcode.PolicyViolation {
+		t.Errorf("expected a policy violation, got %s", errcode.CategoryOf(err))
+	}
+	err = tp.verify(context.Background(), domain.Target{Registry: "github.com", ProjectPath: "other/lib", Target: "build"}, buildFilePath, nil)
+	if err != nil {
+		t.Errorf("expected projects without rules not to be verified, got %v", err)
+	}
+}
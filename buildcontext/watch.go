@@ -0,0 +1,185 @@
+package buildcontext
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/fileutils"
+	"github.com/pkg/errors"
+)
+
+// Watcher detects changes to the files of local build contexts, by polling. The
+// files excluded via .earthignore and the .git dir are not watched, the Earthfiles
+// are.
+type Watcher struct {
+	dirs     []watchedDir
+	ignored  []string
+	interval time.Duration
+	snapshot map[string]fileState
+}
+
+type watchedDir struct {
+	path    string
+	matcher *fileutils.PatternMatcher
+}
+
+type fileState struct {
+	size    int64
+	modTime int64
+	mode    os.FileMode
+}
+
+// NewWatcher returns a watcher of the given build context dirs, which polls them
+// every interval. The paths in ignored (such as the destinations of the artifacts
+// output by the build) are not watched. The current state of the files is the
+// reference for detecting changes.
+func NewWatcher(dirs []string, ignored []string, interval time.Duration) (*Watcher, error) {
+	w := &Watcher{interval: interval}
+	for _, p := range ignored {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "abs %s", p)
+		}
+		w.ignored = append(w.ignored, abs)
+	}
+	for _, dir := range dirs {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, errors.Wrapf(err, "abs %s", dir)
+		}
+		excludes, err := readEarthIgnore(dir)
+		if err != nil {
+			return nil, err
+		}
+		// The git metadata changes on git operations which do not change the files.
+		matcher, err := fileutils.NewPatternMatcher(append(excludes, ".git", ".tmp-earth-out/"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse %s", filepath.Join(dir, EarthIgnoreFile))
+		}
+		w.dirs = append(w.dirs, watchedDir{path: abs, matcher: matcher})
+	}
+	var err error
+	w.snapshot, err = w.scan()
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Wait blocks until files change, and returns the absolute paths of the files which
+// were added, modified or removed. A burst of changes is reported at once: the changes
+// are reported once the files have not changed for an interval.
+func (w *Watcher) Wait(ctx context.Context) ([]string, error) {
+	var changed map[string]bool
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(w.interval):
+		}
+		snapshot, err := w.scan()
+		if err != nil {
+			return nil, err
+		}
+		diff := diffSnapshots(w.snapshot, snapshot)
+		w.snapshot = snapshot
+		if len(diff) == 0 {
+			if len(changed) > 0 {
+				break
+			}
+			continue
+		}
+		if changed == nil {
+			changed = make(map[string]bool)
+		}
+		for _, p := range diff {
+			changed[p] = true
+		}
+	}
+	ret := make([]string, 0, len(changed))
+	for p := range changed {
+		ret = append(ret, p)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (w *Watcher) scan() (map[string]fileState, error) {
+	snapshot := make(map[string]fileState)
+	for _, wd := range w.dirs {
+		err := filepath.Walk(wd.path, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					// Removed while walking.
+					return nil
+				}
+				return err
+			}
+			if w.isIgnored(p) {
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			rel, err := filepath.Rel(wd.path, p)
+			if err != nil {
+				return err
+			}
+			if rel != "." && !isEarthfile(rel) {
+				excluded, err := wd.matcher.Matches(rel)
+				if err != nil {
+					return err
+				}
+				if excluded {
+					if fi.IsDir() && !wd.matcher.Exclusions() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+			}
+			if fi.IsDir() {
+				return nil
+			}
+			snapshot[p] = fileState{size: fi.Size(), modTime: fi.ModTime().UnixNano(), mode: fi.Mode()}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "walk %s", wd.path)
+		}
+	}
+	return snapshot, nil
+}
+
+func (w *Watcher) isIgnored(p string) bool {
+	for _, ignored := range w.ignored {
+		if p == ignored || strings.HasPrefix(p, ignored+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func isEarthfile(rel string) bool {
+	return rel == "Earthfile" || rel == "build.earth"
+}
+
+// diffSnapshots returns the paths which differ between the two snapshots, sorted.
+func diffSnapshots(before map[string]fileState, after map[string]fileState) []string {
+	var ret []string
+	for p, st := range after {
+		if prev, found := before[p]; !found || prev != st {
+			ret = append(ret, p)
+		}
+	}
+	for p := range before {
+		if _, found := after[p]; !found {
+			ret = append(ret, p)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
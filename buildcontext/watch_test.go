@@ -0,0 +1,76 @@
+package buildcontext
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "earth-watch-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(name string, content string) {
+		p := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(p), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(p, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(EarthIgnoreFile, "Earthfile\nlogs/\n")
+	write("Earthfile", "build:\n")
+	write("main.go", "package main\n")
+	write("logs/out.log", "")
+	write("out/bin", "")
+
+	w, err := NewWatcher([]string{dir}, []string{filepath.Join(dir, "out")}, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Changes to ignored and excluded files are not reported, while the Earthfile is
+	// always watched.
+	write("logs/out.log", "more output")
+	write("out/bin", "new binary")
+	write("Earthfile", "build:\n    RUN true\n")
+	write("pkg/lib.go", "package pkg\n")
+	err = os.Remove(filepath.Join(dir, "main.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	changed, err := w.Wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		filepath.Join(dir, "Earthfile"),
+		filepath.Join(dir, "main.go"),
+		filepath.Join(dir, "pkg", "lib.go"),
+	}
+	if !reflect.DeepEqual(changed, expected) {
+		t.Errorf("got %v, expected %v", changed, expected)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = w.Wait(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected no further changes, got %v", err)
+	}
+}
@@ -0,0 +1,384 @@
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/earthly/earthly/conslogging"
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/earthly/earthly/earthfile2llb/dedup"
+	"github.com/earthly/earthly/llbutil"
+	"github.com/golang/protobuf/proto"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/solver/pb"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// BuildRecord is the record of the cache keys of the commands of a build, for comparing
+// builds with DiffBuilds.
+type BuildRecord struct {
+	Target  string           `json:"target"`
+	Targets []RecordedTarget `json:"targets"`
+	// Sources are the named ops which are not attributed to a target, such as the
+	// build contexts.
+	Sources []RecordedCommand `json:"sources"`
+}
+
+// RecordedTarget is a target of a recorded build.
+type RecordedTarget struct {
+	Target   string            `json:"target"`
+	Salt     string            `json:"salt"`
+	Input    dedup.TargetInput `json:"input"`
+	Commands []RecordedCommand `json:"commands"`
+}
+
+// RecordedCommand is a command of a recorded build, with its cache key.
+type RecordedCommand struct {
+	Command string `json:"command"`
+	// Digest is the normalized digest of the op of the command (see normalizeDigests),
+	// which changes with the command itself and with any of its inputs.
+	Digest digest.Digest `json:"digest"`
+	// OwnDigest is the digest of the op without its inputs, which only changes with the
+	// command itself.
+	OwnDigest digest.Digest `json:"ownDigest"`
+	// Inputs are the normalized digests of the inputs of the op.
+	Inputs []digest.Digest `json:"inputs,omitempty"`
+}
+
+// RecordBuild records the cache keys of the commands of the targets, as they would be
+// solved by Build.
+func RecordBuild(ctx context.Context, mts *earthfile2llb.MultiTargetStates) (*BuildRecord, error) {
+	record := &BuildRecord{Target: mts.FinalStates.Target.StringCanonical()}
+	allStates := planOrder(mts)
+	targetIndices := make(map[string]int)
+	states := []llb.State{mts.FinalStates.SideEffectsState}
+	for _, sts := range allStates {
+		targetIndices[sts.Target.String()+" "+sts.Salt] = len(record.Targets)
+		record.Targets = append(record.Targets, RecordedTarget{
+			Target: sts.Target.StringCanonical(),
+			Salt:   sts.Salt,
+			Input:  sts.TargetInput,
+		})
+		for _, saveImage := range sts.SaveImages {
+			states = append(states, saveImage.State)
+		}
+		states = append(states, sts.SeparateArtifactsState...)
+	}
+	seen := make(map[digest.Digest]bool)
+	for _, state := range states {
+		def, err := state.Marshal(ctx, llb.Platform(llbutil.TargetPlatform))
+		if err != nil {
+			return nil, errors.Wrap(err, "state marshal")
+		}
+		normalizedDef, _, _, err := normalizeDefinition(def)
+		if err != nil {
+			return nil, err
+		}
+		for _, dt := range normalizedDef.Def {
+			dgst := digest.FromBytes(dt)
+			if seen[dgst] {
+				continue
+			}
+			seen[dgst] = true
+			var op pb.Op
+			err = proto.Unmarshal(dt, &op)
+			if err != nil {
+				return nil, errors.Wrap(err, "proto unmarshal of op")
+			}
+			if op.Op == nil {
+				// The terminal op, which only references the output.
+				continue
+			}
+			name := normalizedDef.Metadata[dgst].Description["llb.customname"]
+			targetStr, salt, operation := parseVertexName(name)
+			if name == "" || targetStr == "internal" {
+				continue
+			}
+			rc := RecordedCommand{Command: name, Digest: dgst}
+			for _, input := range op.Inputs {
+				rc.Inputs = append(rc.Inputs, input.Digest)
+			}
+			op.Inputs = nil
+			ownDt, err := op.Marshal()
+			if err != nil {
+				return nil, errors.Wrap(err, "proto marshal of op")
+			}
+			rc.OwnDigest = digest.FromBytes(ownDt)
+			index, found := targetIndices[targetStr+" "+salt]
+			if !found || operation == "" {
+				record.Sources = append(record.Sources, rc)
+				continue
+			}
+			rc.Command = operation
+			record.Targets[index].Commands = append(record.Targets[index].Commands, rc)
+		}
+	}
+	return record, nil
+}
+
+// WriteBuildRecord writes the build record to path, as JSON.
+func WriteBuildRecord(record *BuildRecord, path string) error {
+	dt, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "json marshal build record")
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return errors.Wrapf(err, "mkdir all %s", filepath.Dir(path))
+	}
+	err = ioutil.WriteFile(path, dt, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "write build record %s", path)
+	}
+	return nil
+}
+
+// ReadBuildRecord reads a build record written by WriteBuildRecord.
+func ReadBuildRecord(path string) (*BuildRecord, error) {
+	dt, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read build record %s", path)
+	}
+	var record BuildRecord
+	err = json.Unmarshal(dt, &record)
+	if err != nil {
+		return nil, errors.Wrapf(err, "json unmarshal build record %s", path)
+	}
+	return &record, nil
+}
+
+// Changes of commands and targets between two builds.
+const (
+	// ChangeAdded means that the command or target is only part of the second build.
+	ChangeAdded = "added"
+	// ChangeRemoved means that the command or target is only part of the first build.
+	ChangeRemoved = "removed"
+	// ChangeCommand means that the command itself changed, such as its arguments, its
+	// env vars or its mounts.
+	ChangeCommand = "changed"
+	// ChangeInputs means that the command is unchanged, but its inputs changed, such as
+	// the result of the previous command.
+	ChangeInputs = "inputs-changed"
+)
+
+// BuildDiff lists the differences between the cache keys of two builds.
+type BuildDiff struct {
+	Targets []TargetDiff `json:"targets"`
+}
+
+// TargetDiff lists the differences of a target between two builds.
+type TargetDiff struct {
+	Target string `json:"target"`
+	// Change is set if the target is only part of one of the builds.
+	Change string `json:"change,omitempty"`
+	// InputChanges describe the changes of the input of the target (build args and
+	// platform), which cause it to be built differently.
+	InputChanges []string      `json:"inputChanges,omitempty"`
+	Commands     []CommandDiff `json:"commands,omitempty"`
+}
+
+// CommandDiff is a command whose cache key differs between two builds.
+type CommandDiff struct {
+	Command string `json:"command"`
+	Change  string `json:"change"`
+	// ChangedInputs are the names of the inputs which changed, for ChangeInputs.
+	ChangedInputs []string `json:"changedInputs,omitempty"`
+}
+
+// DiffBuilds compares the cache keys of the commands of two recorded builds. The targets
+// are matched by their canonical name and salt, or only by their name if the build has
+// it once, as the salt changes with the build args. The commands of a target are matched
+// by their text and order of appearance.
+func DiffBuilds(before, after *BuildRecord) *BuildDiff {
+	diff := &BuildDiff{}
+	beforeNames := recordedNames(before)
+	afterNames := recordedNames(after)
+	matched := make(map[int]bool)
+	for _, at := range after.Targets {
+		i, found := matchTarget(before, at)
+		if !found || matched[i] {
+			diff.Targets = append(diff.Targets, TargetDiff{Target: at.Target, Change: ChangeAdded})
+			continue
+		}
+		matched[i] = true
+		td := diffTarget(before.Targets[i], at, beforeNames, afterNames)
+		if len(td.InputChanges) > 0 || len(td.Commands) > 0 {
+			diff.Targets = append(diff.Targets, td)
+		}
+	}
+	for i, bt := range before.Targets {
+		if !matched[i] {
+			diff.Targets = append(diff.Targets, TargetDiff{Target: bt.Target, Change: ChangeRemoved})
+		}
+	}
+	return diff
+}
+
+// matchTarget returns the index of the target of the record matching the given one.
+func matchTarget(record *BuildRecord, rt RecordedTarget) (int, bool) {
+	byName := -1
+	numByName := 0
+	for i, other := range record.Targets {
+		if other.Target != rt.Target {
+			continue
+		}
+		if other.Salt == rt.Salt {
+			return i, true
+		}
+		byName = i
+		numByName++
+	}
+	return byName, numByName == 1
+}
+
+// recordedNames returns the names of the commands of the record, keyed by digest.
+func recordedNames(record *BuildRecord) map[digest.Digest]string {
+	names := make(map[digest.Digest]string)
+	for _, rc := range record.Sources {
+		names[rc.Digest] = rc.Command
+	}
+	for _, rt := range record.Targets {
+		for _, rc := range rt.Commands {
+			names[rc.Digest] = fmt.Sprintf("%s %s", rt.Target, rc.Command)
+		}
+	}
+	return names
+}
+
+// diffTarget compares the inputs and the commands of a target between two builds.
+func diffTarget(before, after RecordedTarget, beforeNames, afterNames map[digest.Digest]string) TargetDiff {
+	td := TargetDiff{Target: after.Target, InputChanges: diffTargetInputs(before.Input, after.Input)}
+	key := func(counts map[string]int, rc RecordedCommand) string {
+		counts[rc.Command]++
+		return fmt.Sprintf("%s#%d", rc.Command, counts[rc.Command])
+	}
+	beforeCommands := make(map[string]RecordedCommand)
+	counts := make(map[string]int)
+	for _, rc := range before.Commands {
+		beforeCommands[key(counts, rc)] = rc
+	}
+	matched := make(map[string]bool)
+	counts = make(map[string]int)
+	for _, rc := range after.Commands {
+		k := key(counts, rc)
+		brc, found := beforeCommands[k]
+		if !found {
+			td.Commands = append(td.Commands, CommandDiff{Command: rc.Command, Change: ChangeAdded})
+			continue
+		}
+		matched[k] = true
+		switch {
+		case brc.Digest == rc.Digest:
+		case brc.OwnDigest != rc.OwnDigest:
+			td.Commands = append(td.Commands, CommandDiff{Command: rc.Command, Change: ChangeCommand})
+		default:
+			cd := CommandDiff{Command: rc.Command, Change: ChangeInputs}
+			for _, input := range rc.Inputs {
+				if _, unchanged := beforeNames[input]; unchanged {
+					continue
+				}
+				name, found := afterNames[input]
+				if !found {
+					name = fmt.Sprintf("(unnamed %s)", shortDigest(input))
+				}
+				cd.ChangedInputs = append(cd.ChangedInputs, name)
+			}
+			td.Commands = append(td.Commands, cd)
+		}
+	}
+	counts = make(map[string]int)
+	for _, rc := range before.Commands {
+		if !matched[key(counts, rc)] {
+			td.Commands = append(td.Commands, CommandDiff{Command: rc.Command, Change: ChangeRemoved})
+		}
+	}
+	return td
+}
+
+// diffTargetInputs describes the changes of the build args and of the platform of a
+// target between two builds.
+func diffTargetInputs(before, after dedup.TargetInput) []string {
+	var changes []string
+	describe := func(bai dedup.BuildArgInput) string {
+		if !bai.IsConstant {
+			return "(the output of a command)"
+		}
+		return fmt.Sprintf("%q", bai.ConstantValue)
+	}
+	beforeArgs := make(map[string]dedup.BuildArgInput)
+	for _, bai := range before.BuildArgs {
+		beforeArgs[bai.Name] = bai
+	}
+	afterArgs := make(map[string]dedup.BuildArgInput)
+	for _, bai := range after.BuildArgs {
+		afterArgs[bai.Name] = bai
+		bbai, found := beforeArgs[bai.Name]
+		switch {
+		case !found:
+			changes = append(changes, fmt.Sprintf("build arg %s set to %s", bai.Name, describe(bai)))
+		case !bbai.Equals(bai):
+			changes = append(changes, fmt.Sprintf(
+				"build arg %s changed from %s to %s", bai.Name, describe(bbai), describe(bai)))
+		}
+	}
+	for _, bai := range before.BuildArgs {
+		if _, found := afterArgs[bai.Name]; !found {
+			changes = append(changes, fmt.Sprintf("build arg %s no longer set (was %s)", bai.Name, describe(bai)))
+		}
+	}
+	if before.Platform != after.Platform {
+		platformStr := func(p string) string {
+			if p == "" {
+				return "the default platform"
+			}
+			return p
+		}
+		changes = append(changes, fmt.Sprintf(
+			"platform changed from %s to %s", platformStr(before.Platform), platformStr(after.Platform)))
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// PrintBuildDiff prints the differences between two builds. The commands which changed
+// themselves are the causes of the other differences.
+func PrintBuildDiff(console conslogging.ConsoleLogger, diff *BuildDiff) {
+	if len(diff.Targets) == 0 {
+		console.Printf("The builds have the same cache keys\n")
+		return
+	}
+	for _, td := range diff.Targets {
+		targetConsole := console.WithPrefix(td.Target)
+		switch td.Change {
+		case ChangeAdded:
+			targetConsole.Printf("Target only part of the second build\n")
+			continue
+		case ChangeRemoved:
+			targetConsole.Printf("Target only part of the first build\n")
+			continue
+		}
+		for _, change := range td.InputChanges {
+			targetConsole.Printf("Target input: %s\n", change)
+		}
+		for _, cd := range td.Commands {
+			switch cd.Change {
+			case ChangeInputs:
+				if len(cd.ChangedInputs) == 0 {
+					targetConsole.Printf("--> %s: inputs changed\n", cd.Command)
+					continue
+				}
+				for _, input := range cd.ChangedInputs {
+					targetConsole.Printf("--> %s: input changed: %s\n", cd.Command, input)
+				}
+			default:
+				targetConsole.Printf("--> %s: %s\n", cd.Command, cd.Change)
+			}
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package builder
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/earthly/earthly/earthfile2llb/dedup"
+	"github.com/moby/buildkit/client/llb"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// recordOf records a build of +build, which depends on +dep built with the build arg
+// VERSION.
+func recordOf(t *testing.T, version string, makeCmd string) *BuildRecord {
+	depSalt := "d" + version
+	depState := llb.Image("alpine:3.11").Run(
+		llb.Shlex("echo "+version),
+		llb.WithCustomName("[+dep "+depSalt+"] RUN echo "+version)).Root()
+	buildState := depState.Run(
+		llb.Shlex(makeCmd),
+		llb.WithCustomName("[+build b] RUN "+makeCmd)).Root()
+	dep := &earthfile2llb.SingleTargetStates{
+		Target: domain.Target{LocalPath: ".", Target: "dep"},
+		Salt:   depSalt,
+		TargetInput: dedup.TargetInput{
+			TargetCanonical: "+dep",
+			BuildArgs: []dedup.BuildArgInput{
+				{Name: "VERSION", IsConstant: true, ConstantValue: version},
+			},
+		},
+		SideEffectsState: depState,
+	}
+	build := &earthfile2llb.SingleTargetStates{
+		Target:           domain.Target{LocalPath: ".", Target: "build"},
+		Salt:             "b",
+		TargetInput:      dedup.TargetInput{TargetCanonical: "+build"},
+		SideEffectsState: buildState,
+		Deps:             []*earthfile2llb.SingleTargetStates{dep},
+	}
+	mts := &earthfile2llb.MultiTargetStates{
+		FinalStates: build,
+		VisitedStates: map[string][]*earthfile2llb.SingleTargetStates{
+			"+build": {build},
+			"+dep":   {dep},
+		},
+	}
+	record, err := RecordBuild(context.Background(), mts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestRecordBuild(t *testing.T) {
+	record := recordOf(t, "1", "make")
+	if len(record.Targets) != 2 {
+		t.Fatalf("expected 2 targets, got %d", len(record.Targets))
+	}
+	expected := map[string][]string{
+		"+build": {"RUN make"},
+		"+dep":   {"RUN echo 1"},
+	}
+	for _, rt := range record.Targets {
+		var commands []string
+		for _, rc := range rt.Commands {
+			commands = append(commands, rc.Command)
+		}
+		if !reflect.DeepEqual(commands, expected[rt.Target]) {
+			t.Errorf("%s: expected commands %v, got %v", rt.Target, expected[rt.Target], commands)
+		}
+	}
+}
+
+func TestDiffBuilds(t *testing.T) {
+	tests := []struct {
+		name     string
+		before   *BuildRecord
+		after    *BuildRecord
+		expected []TargetDiff
+	}{
+		{
+			name:   "same build",
+			before: recordOf(t, "1", "make"),
+			after:  recordOf(t, "1", "make"),
+		},
+		{
+			name:   "build arg changed",
+			before: recordOf(t, "1", "make"),
+			after:  recordOf(t, "2", "make"),
+			expected: []TargetDiff{
+				{
+					Target: "+build",
+					Commands: []CommandDiff{
+						{Command: "RUN make", Change: ChangeInputs, ChangedInputs: []string{"+dep RUN echo 2"}},
+					},
+				},
+				{
+					Target:       "+dep",
+					InputChanges: []string{`build arg VERSION changed from "1" to "2"`},
+					Commands: []CommandDiff{
+						{Command: "RUN echo 2", Change: ChangeAdded},
+						{Command: "RUN echo 1", Change: ChangeRemoved},
+					},
+				},
+			},
+		},
+		{
+			name:   "command changed",
+			before: recordOf(t, "1", "make"),
+			after:  recordOf(t, "1", "make all"),
+			expected: []TargetDiff{
+				{
+					Target: "+build",
+					Commands: []CommandDiff{
+						{Command: "RUN make all", Change: ChangeAdded},
+						{Command: "RUN make", Change: ChangeRemoved},
+					},
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		diff := DiffBuilds(test.before, test.after)
+		if !reflect.DeepEqual(diff.Targets, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expected, diff.Targets)
+		}
+	}
+}
+
+func TestDiffBuildsCommandChanged(t *testing.T) {
+	before := &BuildRecord{Targets: []RecordedTarget{{
+		Target: "+build",
+		Commands: []RecordedCommand{
+			{Command: "RUN make", Digest: "sha256:1", OwnDigest: "sha256:a"},
+			{Command: "RUN make", Digest: "sha256:2", OwnDigest: "sha256:b", Inputs: []digest.Digest{"sha256:1"}},
+		},
+	}}}
+	after := &BuildRecord{Targets: []RecordedTarget{{
+		Target: "+build",
+		Commands: []RecordedCommand{
+			{Command: "RUN make", Digest: "sha256:3", OwnDigest: "sha256:c"},
+			{Command: "RUN make", Digest: "sha256:4", OwnDigest: "sha256:b", Inputs: []digest.Digest{"sha256:3"}},
+		},
+	}}}
+	diff := DiffBuilds(before, after)
+	expected := []TargetDiff{{
+		Target: "+build",
+		Commands: []CommandDiff{
+			{Command: "RUN make", Change: ChangeCommand},
+			{Command: "RUN make", Change: ChangeInputs, ChangedInputs: []string{"+build RUN make"}},
+		},
+	}}
+	if !reflect.DeepEqual(diff.Targets, expected) {
+		t.Errorf("expected %+v, got %+v", expected, diff.Targets)
+	}
+}
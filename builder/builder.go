@@ -7,11 +7,15 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/earthly/earthly/conslogging"
 	"github.com/earthly/earthly/domain"
 	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/earthly/earthly/localrun"
 	"github.com/earthly/earthly/logging"
 	"github.com/moby/buildkit/client"
 	"github.com/moby/buildkit/client/llb"
@@ -26,20 +30,117 @@ type BuildOpt struct {
 	PrintSuccess bool
 	NoOutput     bool
 	Push         bool
+	// SBOMFormat is the format of the SBOM generated for each saved image. No SBOM
+	// is generated if empty.
+	SBOMFormat string
+	// SBOMDir is the local dir where generated SBOMs are written.
+	SBOMDir string
+	// Provenance enables writing an in-toto SLSA provenance statement for each
+	// output image.
+	Provenance bool
+	// ProvenanceDir is the local dir where provenance statements are written.
+	ProvenanceDir string
+	// Sign holds the settings for signing pushed images.
+	Sign SignOpt
+	// Rekor holds the settings of the upload of the SBOMs and provenance statements
+	// to a transparency log. The key of Sign is used to sign them, if any.
+	Rekor RekorOpt
+	// OCIArchiveDir is the local dir where each saved image is additionally written
+	// as an OCI archive. No archives are written if empty.
+	OCIArchiveDir string
+	// FaithfulArtifacts preserves file modes, ownership (when running as root), mtimes
+	// and extended attributes of artifacts saved locally.
+	FaithfulArtifacts bool
+	// RejectDanglingSymlinks fails the build if an artifact saved locally contains
+	// symlinks which do not resolve on the host.
+	RejectDanglingSymlinks bool
+	// ChecksumsDir is the local dir where the checksum manifest of all artifacts saved
+	// locally is written. No manifest is written if empty.
+	ChecksumsDir string
+	// SummaryPath is the local path where a JSON summary of the build is written. No
+	// summary is written if empty.
+	SummaryPath string
+	// SizeReport enables reporting the size of each artifact saved locally and each
+	// image loaded into docker, via ReportSizes.
+	SizeReport bool
+	// SizeBaselinePath is the local path of the sizes to compare the size report
+	// with. Not compared if empty.
+	SizeBaselinePath string
+	// SizeRegressionThreshold is the growth, in percent, beyond which an output is
+	// flagged as a regression compared to the baseline.
+	SizeRegressionThreshold float64
+	// Interrupt, once closed, stops the build gracefully: the commands in progress
+	// are canceled, but the output in progress is completed, and the artifacts of the
+	// targets which completed are saved locally. Build then returns ErrInterrupted.
+	Interrupt <-chan struct{}
+	// CheckpointPath is the local path where the checkpoint of an interrupted build
+	// is written. No checkpoint is written if empty.
+	CheckpointPath string
+	// TargetTimeout is the maximum duration of the commands of each target, from the
+	// start of its first command. The build fails with a TimeoutError once a target
+	// exceeds it. Not limited if zero. The whole build is limited via the deadline
+	// of the context.
+	TargetTimeout time.Duration
+	// PushRetry holds the settings of the retries of failed image pushes. A push which
+	// fails even so does not stop the other outputs of the build: Build returns a
+	// PushError once they completed.
+	PushRetry PushRetryOpt
+	// Scan holds the settings of the vulnerability scan of the images, before they
+	// are pushed. An image whose scan fails is not pushed, and is reported as a failed
+	// push.
+	Scan ScanOpt
 }
 
 // Builder provides a earth commands executor.
 type Builder struct {
-	s           *solver
+	s *solver
+	// workers are the solvers of the buildkitd instances targets are scheduled on,
+	// the first one being s. Only set if there is more than one. See AddWorker.
+	workers     []*solver
 	bkClient    *client.Client
 	console     conslogging.ConsoleLogger
 	attachables []session.Attachable
 	enttlmnts   []entitlements.Entitlement
 	noCache     bool
+	startTime   time.Time
+	// pushDigests holds the registry digests of images pushed via buildkit, by tag.
+	pushDigests map[string]string
+	// imageIDs holds the IDs of the images loaded into docker, by tag, for reproducible
+	// builds.
+	imageIDs map[string]string
+	// pushes holds the outcomes of the image pushes, for the push report.
+	pushes []pushResult
+	// failedPushTargets holds the targets (canonical) whose image pushes failed or were
+	// skipped.
+	failedPushTargets map[string]bool
+	// checksums holds the digests of the files of artifacts saved locally.
+	checksums []artifactChecksum
+	// images holds the images output, for the build summary.
+	images []imageSummary
+	// attestations holds the attestations written locally, for the build summary.
+	attestations []attestationSummary
+	// imageSizes holds the sizes of the images output, for the size report.
+	imageSizes []imageSize
+	// sizeReport is the size report of the build, once reported, for the build
+	// summary.
+	sizeReport *sizeReport
+	// sources holds the remote repositories the targets were read from, for the build
+	// summary.
+	sources []sourceSummary
+	// dockerLoads serves the images of DOCKER LOAD and WITH DOCKER --load.
+	dockerLoads *dockerLoadProvider
+	// localRunner executes the commands of the targets declared LOCALLY on the host.
+	localRunner *localrun.Runner
+	// localSteps holds the executions of the commands of the targets declared LOCALLY,
+	// by target states. It is protected by localStepsMu.
+	localSteps   map[*earthfile2llb.SingleTargetStates]*localSteps
+	localStepsMu sync.Mutex
 }
 
 // NewBuilder returns a new earth Builder.
 func NewBuilder(ctx context.Context, bkClient *client.Client, console conslogging.ConsoleLogger, attachables []session.Attachable, enttlmnts []entitlements.Entitlement, noCache bool, remoteCache string) (*Builder, error) {
+	dockerLoads := newDockerLoadProvider()
+	attachables = withSSHForwarder(attachables, dockerLoads)
 	return &Builder{
 		s: &solver{
 			sm:          newSolverMonitor(console),
@@ -48,8 +149,16 @@ func NewBuilder(ctx context.Context, bkClient *client.Client, console consloggin
 			attachables: attachables,
 			enttlmnts:   enttlmnts,
 		},
-		console: console,
-		noCache: noCache,
+		console:     console,
+		noCache:     noCache,
+		startTime:   time.Now(),
+		pushDigests: make(map[string]string),
+		imageIDs:    make(map[string]string),
+
+		failedPushTargets: make(map[string]bool),
+		dockerLoads:       dockerLoads,
+		localRunner:       localrun.NewRunner(runtime.GOOS),
+		localSteps:        make(map[*earthfile2llb.SingleTargetStates]*localSteps),
 	}, nil
 }
 
@@ -58,55 +167,100 @@ func NewBuilder(ctx context.Context, bkClient *client.Client, console consloggin
 func (b *Builder) Build(ctx context.Context, mts *earthfile2llb.MultiTargetStates, opt BuildOpt) error {
 	// Start with final side-effects. This will automatically trigger the dependency builds too,
 	// in parallel.
-	cacheLocalDir, localDirs, err := b.buildCommon(ctx, mts, opt)
+	sideEffectsCtx, cancelSideEffects := cancelOnInterrupt(ctx, opt)
+	defer cancelSideEffects()
+	cacheLocalDir, localDirs, err := b.buildCommon(sideEffectsCtx, mts, opt)
+	if cacheLocalDir != "" {
+		defer os.RemoveAll(cacheLocalDir)
+	}
+	if interrupted(opt) {
+		return b.stopGracefully(ctx, localDirs, mts, nil, opt)
+	}
 	if err != nil {
+		if !opt.NoOutput {
+			saveErr := b.saveOnFailure(ctx, localDirs, mts, opt)
+			if saveErr != nil {
+				b.console.Warnf("Failed to save the SAVE ARTIFACT --on-failure artifacts: %v\n", saveErr)
+			}
+		}
+		b.printPatternSummaries(mts, err)
 		return err
 	}
-	defer os.RemoveAll(cacheLocalDir)
+	b.printPatternSummaries(mts, nil)
 	if opt.PrintSuccess {
 		b.console.PrintSuccess()
 	}
 
 	// Then output images and artifacts.
 	if !opt.NoOutput {
-		for _, states := range mts.AllStates() {
+		outputStates, err := outputOrder(mts)
+		if err != nil {
+			return err
+		}
+		output := make(map[*earthfile2llb.SingleTargetStates]bool)
+		for _, states := range outputStates {
+			if interrupted(opt) {
+				// The outputs of the previous target have been completed.
+				return b.stopGracefully(ctx, localDirs, mts, output, opt)
+			}
+			after := b.failedPushAfter(states)
+			if after != "" {
+				b.skipPushes(states, after)
+				continue
+			}
 			err = b.buildOutputs(ctx, localDirs, states, opt)
 			if err != nil {
 				return err
 			}
+			output[states] = true
 		}
+		err = b.writeChecksums(opt)
+		if err != nil {
+			return err
+		}
+		return b.pushReport()
 	}
 	return nil
 }
 
-// BuildOnlyLastImageAsTar performs the build for the given multi target states,
-// and outputs only a docker tar of the last saved image.
-func (b *Builder) BuildOnlyLastImageAsTar(ctx context.Context, mts *earthfile2llb.MultiTargetStates, dockerTag string, outFile string, opt BuildOpt) error {
+// BuildOnlyLastImageToRegistry performs the build for the given multi target states,
+// and pushes only the last saved image to the given registry ref. The digest of the
+// pushed image is returned.
+func (b *Builder) BuildOnlyLastImageToRegistry(ctx context.Context, mts *earthfile2llb.MultiTargetStates, imageRef string, opt BuildOpt) (string, error) {
 	saveImage, ok := mts.FinalStates.LastSaveImage()
 	if !ok {
-		return fmt.Errorf("No save image exists for %s", mts.FinalStates.Target.String())
+		return "", fmt.Errorf("No save image exists for %s", mts.FinalStates.Target.String())
 	}
 
 	cacheLocalDir, localDirs, err := b.buildCommon(ctx, mts, opt)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer os.RemoveAll(cacheLocalDir)
 	if opt.PrintSuccess {
 		b.console.PrintSuccess()
 	}
 
-	err = b.buildImageTar(ctx, localDirs, saveImage, dockerTag, outFile)
+	solveCtx := logging.With(ctx, "image", imageRef)
+	solveCtx = logging.With(solveCtx, "solve", "image-registry")
+	dgst, err := b.solverFor(mts.FinalStates).solveRegistry(
+		solveCtx, localDirs, saveImage.State, saveImage.Image, imageRef, true, earthfile2llb.LayerCompression{})
 	if err != nil {
-		return err
+		return "", errors.Wrapf(err, "solve image registry %s", imageRef)
 	}
-	return nil
+	return dgst, nil
 }
 
-// MakeImageAsTarBuilderFun returns a fun which can be used to build an image as a tar.
-func (b *Builder) MakeImageAsTarBuilderFun() func(context.Context, *earthfile2llb.MultiTargetStates, string, string) error {
-	return func(ctx context.Context, mts *earthfile2llb.MultiTargetStates, dockerTag string, outFile string) error {
-		return b.BuildOnlyLastImageAsTar(ctx, mts, dockerTag, outFile, BuildOpt{})
+// MakeImageToRegistryBuilderFun returns a fun which can be used to build an image and
+// push it to the registry at registryAddr.
+func (b *Builder) MakeImageToRegistryBuilderFun(registryAddr string) func(context.Context, *earthfile2llb.MultiTargetStates, string) (string, error) {
+	return func(ctx context.Context, mts *earthfile2llb.MultiTargetStates, repoName string) (string, error) {
+		imageRef := fmt.Sprintf("%s/%s", registryAddr, repoName)
+		dgst, err := b.BuildOnlyLastImageToRegistry(ctx, mts, imageRef, BuildOpt{})
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s@%s", imageRef, dgst), nil
 	}
 }
 
@@ -128,7 +282,7 @@ func (b *Builder) BuildOnlyImages(ctx context.Context, mts *earthfile2llb.MultiT
 	if err != nil {
 		return err
 	}
-	return nil
+	return b.pushReport()
 }
 
 // BuildOnlyArtifact performs the build for the given multi target states, outputting only
@@ -158,8 +312,7 @@ func (b *Builder) BuildOnlyArtifact(ctx context.Context, mts *earthfile2llb.Mult
 	if err != nil {
 		return err
 	}
-
-	return nil
+	return b.writeChecksums(opt)
 }
 
 // MakeArtifactBuilderFun returns a function that can be used to build artifacts.
@@ -170,35 +323,60 @@ func (b *Builder) MakeArtifactBuilderFun() func(context.Context, *earthfile2llb.
 }
 
 func (b *Builder) buildCommon(ctx context.Context, mts *earthfile2llb.MultiTargetStates, opt BuildOpt) (string, map[string]string, error) {
+	b.recordSources(mts)
 	cacheLocalDir, err := ioutil.TempDir("/tmp", "earthly-cache")
 	if err != nil {
 		return "", nil, errors.Wrap(err, "make temp dir for cache")
 	}
-	// Collect all local dirs.
+	localDirs, err := collectLocalDirs(mts, cacheLocalDir)
+	if err != nil {
+		return "", nil, err
+	}
+
+	finalTarget := mts.FinalStates.Target
+	finalTargetConsole := b.console.WithPrefixAndSalt(finalTarget.String(), mts.FinalStates.Salt)
+	solveCtx, stopTimeouts := b.watchTimeouts(ctx, opt)
+	err = b.runLocalSteps(solveCtx, mts)
+	if err == nil {
+		if len(b.workers) > 1 {
+			err = b.buildSideEffectsDistributed(solveCtx, localDirs, mts)
+		} else {
+			err = b.buildSideEffects(solveCtx, localDirs, mts.FinalStates)
+		}
+	}
+	timeoutErr := stopTimeouts()
+	if err != nil && timeoutErr != nil {
+		b.printTimeout(timeoutErr)
+		err = timeoutErr
+	}
+	if err != nil {
+		// The local dirs are still returned, for saving the artifacts of the targets
+		// which completed, if the build was interrupted.
+		return cacheLocalDir, localDirs, err
+	}
+	if opt.PrintSuccess {
+		finalTargetConsole.Printf("Target %s built successfully\n", finalTarget.StringCanonical())
+	}
+	return cacheLocalDir, localDirs, nil
+}
+
+// collectLocalDirs returns the local dirs of all the states, together with the given
+// cache dir.
+func collectLocalDirs(mts *earthfile2llb.MultiTargetStates, cacheLocalDir string) (map[string]string, error) {
 	localDirs := make(map[string]string)
 	localDirs["earthly-cache"] = cacheLocalDir
 	for _, states := range mts.AllStates() {
 		for key, value := range states.LocalDirs {
 			existingValue, alreadyExists := localDirs[key]
 			if alreadyExists && existingValue != value {
-				return "", nil, fmt.Errorf(
+				return nil, fmt.Errorf(
 					"inconsistent local dirs. For dir entry %s found both %s and %s",
 					key, value, existingValue)
 			}
 			localDirs[key] = value
 		}
 	}
-
-	finalTarget := mts.FinalStates.Target
-	finalTargetConsole := b.console.WithPrefixAndSalt(finalTarget.String(), mts.FinalStates.Salt)
-	err = b.buildSideEffects(ctx, localDirs, mts.FinalStates)
-	if err != nil {
-		return "", nil, err
-	}
-	if opt.PrintSuccess {
-		finalTargetConsole.Printf("Target %s built successfully\n", finalTarget.StringCanonical())
-	}
-	return cacheLocalDir, localDirs, nil
+	return localDirs, nil
 }
 
 func (b *Builder) buildSideEffects(ctx context.Context, localDirs map[string]string, states *earthfile2llb.SingleTargetStates) error {
@@ -208,7 +386,8 @@ func (b *Builder) buildSideEffects(ctx context.Context, localDirs map[string]str
 	if b.noCache {
 		state = state.SetMarshalDefaults(llb.IgnoreCache)
 	}
-	err := b.s.solveSideEffects(solveCtx, localDirs, state)
+	retries := commandRetries(dependencyClosure(states))
+	err := b.s.solveSideEffects(solveCtx, localDirs, state, retries)
 	if err != nil {
 		return errors.Wrapf(err, "solve side effects")
 	}
@@ -219,7 +398,7 @@ func (b *Builder) buildOutputs(ctx context.Context, localDirs map[string]string,
 	targetCtx := logging.With(ctx, "target", states.Target.String())
 
 	// Run --push commands.
-	err := b.buildRunPush(targetCtx, localDirs, states, opt)
+	err := b.buildRunPush(targetCtx, localDirs, states, states.RunPush, opt)
 	if err != nil {
 		return err
 	}
@@ -230,6 +409,19 @@ func (b *Builder) buildOutputs(ctx context.Context, localDirs map[string]string,
 		return err
 	}
 
+	// Run --push commands declared after SAVE IMAGE --push.
+	if b.failedPushTargets[states.Target.StringCanonical()] {
+		console := b.console.WithPrefixAndSalt(states.Target.String(), states.Salt)
+		for _, commandStr := range states.RunPushAfterImages.CommandStrs {
+			console.Warnf("Did not execute push command %s, as the image pushes failed\n", commandStr)
+		}
+		return nil
+	}
+	err = b.buildRunPush(targetCtx, localDirs, states, states.RunPushAfterImages, opt)
+	if err != nil {
+		return err
+	}
+
 	// Artifacts.
 	if !states.Target.IsRemote() {
 		// Don't output artifacts for remote images.
@@ -237,38 +429,114 @@ func (b *Builder) buildOutputs(ctx context.Context, localDirs map[string]string,
 		if err != nil {
 			return err
 		}
+		err = b.buildSaveRemotes(targetCtx, localDirs, states, opt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Builder) buildSaveRemotes(ctx context.Context, localDirs map[string]string, states *earthfile2llb.SingleTargetStates, opt BuildOpt) error {
+	console := b.console.WithPrefixAndSalt(states.Target.String(), states.Salt)
+	for _, saveRemote := range states.SaveRemotes {
+		artifact := domain.Artifact{
+			Target:   states.Target,
+			Artifact: saveRemote.ArtifactPath,
+		}
+		if !opt.Push {
+			console.Printf(
+				"Did not upload %s to %s. Use earth --push to enable pushing\n",
+				artifact.StringCanonical(), saveRemote.DestURL)
+			continue
+		}
+		solveCtx := logging.With(ctx, "solve", "save-remote")
+		solveCtx = logging.With(solveCtx, "url", saveRemote.DestURL)
+		err := b.solverFor(states).solveSideEffects(solveCtx, localDirs, saveRemote.State, nil)
+		if err != nil {
+			return errors.Wrapf(err, "upload %s to %s", artifact.StringCanonical(), saveRemote.DestURL)
+		}
+		console.Printf("Artifact %s as remote %s\n", artifact.StringCanonical(), saveRemote.DestURL)
 	}
 	return nil
 }
 
-func (b *Builder) buildRunPush(ctx context.Context, localDirs map[string]string, states *earthfile2llb.SingleTargetStates, opt BuildOpt) error {
-	if !states.RunPush.Initialized {
+func (b *Builder) buildRunPush(ctx context.Context, localDirs map[string]string, states *earthfile2llb.SingleTargetStates, runPush earthfile2llb.RunPush, opt BuildOpt) error {
+	if !runPush.Initialized {
 		// No run --push commands here. Quick way out.
 		return nil
 	}
 	console := b.console.WithPrefixAndSalt(states.Target.String(), states.Salt)
 	if !opt.Push {
-		for _, commandStr := range states.RunPush.CommandStrs {
+		for _, commandStr := range runPush.CommandStrs {
 			console.Printf("Did not execute push command %s. Use earth --push to enable pushing\n", commandStr)
 		}
 		return nil
 	}
 	targetCtx := logging.With(ctx, "target", states.Target.String())
 	solveCtx := logging.With(targetCtx, "solve", "run-push")
-	err := b.s.solveSideEffects(solveCtx, localDirs, states.RunPush.State)
+	err := b.solverFor(states).solveSideEffects(solveCtx, localDirs, runPush.State, states.Retries)
 	if err != nil {
 		return errors.Wrapf(err, "solve run-push")
 	}
 	return nil
 }
 
-func (b *Builder) buildImages(ctx context.Context, localDirs map[string]string, states *earthfile2llb.SingleTargetStates, opt BuildOpt) error {
-	for _, imageToSave := range states.SaveImages {
-		if imageToSave.DockerTag == "" {
-			// Not a docker export. Skip.
-			continue
+// outputOrder returns all the states of mts in the order in which their outputs are
+// built. The outputs of a target are built after those of the targets it declares
+// via RUN --push --after.
+func outputOrder(mts *earthfile2llb.MultiTargetStates) ([]*earthfile2llb.SingleTargetStates, error) {
+	allStates := planOrder(mts)
+	byTarget := make(map[string][]*earthfile2llb.SingleTargetStates)
+	for _, sts := range allStates {
+		key := sts.Target.StringCanonical()
+		byTarget[key] = append(byTarget[key], sts)
+	}
+	var ret []*earthfile2llb.SingleTargetStates
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	marks := make(map[*earthfile2llb.SingleTargetStates]int)
+	var visit func(sts *earthfile2llb.SingleTargetStates) error
+	visit = func(sts *earthfile2llb.SingleTargetStates) error {
+		switch marks[sts] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("cycle in the push order of %s", sts.Target.StringCanonical())
 		}
-		err := b.buildImage(ctx, imageToSave, localDirs, states, opt)
+		marks[sts] = visiting
+		for _, after := range sts.PushAfter {
+			afterStates, found := byTarget[after.StringCanonical()]
+			if !found {
+				return fmt.Errorf(
+					"%s is to be pushed after %s, which is not part of the build",
+					sts.Target.StringCanonical(), after.StringCanonical())
+			}
+			for _, afterSts := range afterStates {
+				err := visit(afterSts)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		marks[sts] = visited
+		ret = append(ret, sts)
+		return nil
+	}
+	for _, sts := range allStates {
+		err := visit(sts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func (b *Builder) buildImages(ctx context.Context, localDirs map[string]string, states *earthfile2llb.SingleTargetStates, opt BuildOpt) error {
+	for _, images := range groupSaveImages(states.SaveImages) {
+		err := b.buildImage(ctx, images, localDirs, states, opt)
 		if err != nil {
 			return err
 		}
@@ -276,33 +544,130 @@ func (b *Builder) buildImages(ctx context.Context, localDirs map[string]string,
 	return nil
 }
 
-func (b *Builder) buildImage(ctx context.Context, imageToSave earthfile2llb.SaveImage, localDirs map[string]string, states *earthfile2llb.SingleTargetStates, opt BuildOpt) error {
-	shouldPush := opt.Push && imageToSave.Push
-	console := b.console.WithPrefixAndSalt(states.Target.String(), states.Salt)
-	solveCtx := logging.With(ctx, "image", imageToSave.DockerTag)
+// buildImage exports the given images, which are the names of the same image, to the
+// docker daemon at once, and pushes them if needed.
+func (b *Builder) buildImage(ctx context.Context, images []earthfile2llb.SaveImage, localDirs map[string]string, states *earthfile2llb.SingleTargetStates, opt BuildOpt) error {
+	var tags []string
+	for _, imageToSave := range images {
+		tags = append(tags, imageToSave.DockerTag)
+	}
+	solveCtx := logging.With(ctx, "image", tags)
 	solveCtx = logging.With(solveCtx, "solve", "image")
-	err := b.s.solveDocker(solveCtx, localDirs, imageToSave.State, imageToSave.Image, imageToSave.DockerTag, shouldPush)
+	err := b.solverFor(states).solveDocker(
+		solveCtx, localDirs, images[0].State, images[0].Image, strings.Join(tags, ","),
+		images[0].Compression)
 	if err != nil {
-		return errors.Wrapf(err, "solve image %s", imageToSave.DockerTag)
+		return errors.Wrapf(err, "solve image %s", strings.Join(tags, ", "))
+	}
+	pushed := make(map[string]bool)
+	if opt.Push && images[0].Push {
+		err = b.scanImage(ctx, images[0], states, opt)
+		if err != nil {
+			// The other outputs are still completed. See pushReport.
+			console := b.console.WithPrefixAndSalt(states.Target.String(), states.Salt)
+			for _, imageToSave := range images {
+				console.Warnf("Did not push %s: %v\n", imageToSave.DockerTag, err)
+				b.recordPush(states, imageToSave.DockerTag, "", err)
+			}
+		} else {
+			pushed = b.pushImages(ctx, images, localDirs, states, opt)
+		}
+	}
+	for _, imageToSave := range images {
+		err = b.completeImage(ctx, imageToSave, pushed[imageToSave.DockerTag], localDirs, states, opt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// completeImage produces the outputs of an image exported to the docker daemon, other
+// than its push.
+func (b *Builder) completeImage(ctx context.Context, imageToSave earthfile2llb.SaveImage, shouldPush bool, localDirs map[string]string, states *earthfile2llb.SingleTargetStates, opt BuildOpt) error {
+	console := b.console.WithPrefixAndSalt(states.Target.String(), states.Salt)
+	var err error
+	if b.s.reproducible {
+		id, err := dockerImageDigest(ctx, imageToSave.DockerTag, false)
+		if err != nil {
+			return err
+		}
+		b.imageIDs[imageToSave.DockerTag] = id
 	}
 	pushStr := ""
 	if shouldPush {
 		pushStr = " (pushed)"
+		if opt.Sign.Enabled {
+			err = b.signImage(ctx, imageToSave, states, opt)
+			if err != nil {
+				return err
+			}
+			pushStr = " (pushed, signed)"
+		}
+	}
+	if opt.SummaryPath != "" {
+		b.recordImage(ctx, imageToSave, states, shouldPush)
 	}
+	if opt.SizeReport {
+		b.recordImageSize(ctx, imageToSave, states)
+	}
+	console.PrintEvent(conslogging.Event{
+		Type:   conslogging.ImageExportedEvent,
+		Image:  imageToSave.DockerTag,
+		Pushed: shouldPush,
+	})
 	console.Printf("Image %s as %s%s\n", states.Target.StringCanonical(), imageToSave.DockerTag, pushStr)
 	if imageToSave.Push && !opt.Push {
 		console.Printf("Did not push %s. Use earth --push to enable pushing\n", imageToSave.DockerTag)
 	}
+	if opt.OCIArchiveDir != "" {
+		err = b.buildOCIArchive(ctx, imageToSave, localDirs, states, opt)
+		if err != nil {
+			return err
+		}
+	}
+	if opt.SBOMFormat != "" {
+		err = b.buildSBOM(ctx, imageToSave, localDirs, states, opt)
+		if err != nil {
+			return err
+		}
+	}
+	if opt.Provenance {
+		err = b.buildProvenance(ctx, imageToSave, shouldPush, states, opt)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (b *Builder) buildImageTar(ctx context.Context, localDirs map[string]string, saveImage earthfile2llb.SaveImage, dockerTag string, outFile string) error {
+// imageDigest returns the digest of a saved image. See dockerImageDigest.
+func (b *Builder) imageDigest(ctx context.Context, dockerTag string, pushed bool) (string, error) {
+	if pushed {
+		dgst, ok := b.pushDigests[dockerTag]
+		if ok {
+			return dgst, nil
+		}
+	}
+	return dockerImageDigest(ctx, dockerTag, pushed)
+}
+
+func (b *Builder) buildOCIArchive(ctx context.Context, imageToSave earthfile2llb.SaveImage, localDirs map[string]string, states *earthfile2llb.SingleTargetStates, opt BuildOpt) error {
+	console := b.console.WithPrefixAndSalt(states.Target.String(), states.Salt)
+	err := os.MkdirAll(opt.OCIArchiveDir, 0755)
+	if err != nil {
+		return errors.Wrapf(err, "mkdir all %s", opt.OCIArchiveDir)
+	}
+	outFile := filepath.Join(opt.OCIArchiveDir, fmt.Sprintf("%s.oci.tar", localFileName(imageToSave.DockerTag)))
 	solveCtx := logging.With(ctx, "image", outFile)
-	solveCtx = logging.With(solveCtx, "solve", "image-tar")
-	err := b.s.solveDockerTar(solveCtx, localDirs, saveImage.State, saveImage.Image, dockerTag, outFile)
+	solveCtx = logging.With(solveCtx, "solve", "image-oci-archive")
+	_, err = b.solverFor(states).solveDockerTar(
+		solveCtx, localDirs, imageToSave.State, imageToSave.Image, imageToSave.DockerTag, outFile, true,
+		imageToSave.Compression)
 	if err != nil {
-		return errors.Wrapf(err, "solve image tar %s", outFile)
+		return errors.Wrapf(err, "solve oci archive %s", outFile)
 	}
+	console.Printf("OCI archive of %s as local %s\n", imageToSave.DockerTag, outFile)
 	return nil
 }
 
@@ -332,12 +697,12 @@ func (b *Builder) buildSpecifiedArtifact(ctx context.Context, artifact domain.Ar
 		return errors.Wrap(err, "mk index dir")
 	}
 	artifactsState := states.ArtifactsState
-	err = b.s.solveArtifacts(solveCtx, localDirs, artifactsState, indexOutDir)
+	err = b.solverFor(states).solveArtifacts(solveCtx, localDirs, artifactsState, indexOutDir)
 	if err != nil {
 		return errors.Wrap(err, "solve combined artifacts")
 	}
 
-	err = b.saveArtifactLocally(ctx, artifact, indexOutDir, destPath, states.Salt, opt)
+	_, err = b.saveArtifactLocally(ctx, artifact, indexOutDir, destPath, states.Salt, opt)
 	if err != nil {
 		return err
 	}
@@ -356,7 +721,11 @@ func (b *Builder) buildArtifact(ctx context.Context, artifactToSaveLocally earth
 		if err != nil {
 			return errors.Wrap(err, "mk index dir")
 		}
-		err = b.s.solveArtifacts(solveCtx, localDirs, artifactsState, indexOutDir)
+		if opt.FaithfulArtifacts {
+			err = b.solverFor(states).solveArtifactsFaithful(solveCtx, localDirs, artifactsState, indexOutDir)
+		} else {
+			err = b.solverFor(states).solveArtifacts(solveCtx, localDirs, artifactsState, indexOutDir)
+		}
 		if err != nil {
 			return errors.Wrap(err, "solve artifacts")
 		}
@@ -366,14 +735,20 @@ func (b *Builder) buildArtifact(ctx context.Context, artifactToSaveLocally earth
 		Target:   states.Target,
 		Artifact: artifactToSaveLocally.ArtifactPath,
 	}
-	err := b.saveArtifactLocally(ctx, artifact, indexOutDir, artifactToSaveLocally.DestPath, states.Salt, opt)
+	savedPaths, err := b.saveArtifactLocally(ctx, artifact, indexOutDir, artifactToSaveLocally.DestPath, states.Salt, opt)
 	if err != nil {
 		return err
 	}
+	if opt.Provenance {
+		err = b.buildArtifactProvenance(ctx, artifact, savedPaths, states, opt)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (b *Builder) saveArtifactLocally(ctx context.Context, artifact domain.Artifact, indexOutDir string, destPath string, salt string, opt BuildOpt) error {
+func (b *Builder) saveArtifactLocally(ctx context.Context, artifact domain.Artifact, indexOutDir string, destPath string, salt string, opt BuildOpt) ([]string, error) {
 	console := b.console.WithPrefixAndSalt(artifact.Target.String(), salt)
 	fromPattern := filepath.Join(indexOutDir, filepath.FromSlash(artifact.Artifact))
 	// Resolve possible wildcards.
@@ -381,15 +756,18 @@ func (b *Builder) saveArtifactLocally(ctx context.Context, artifact domain.Artif
 	//       while the pattern is also guest-platform dependent.
 	fromGlobMatches, err := filepath.Glob(fromPattern)
 	if err != nil {
-		return errors.Wrapf(err, "glob")
+		return nil, errors.Wrapf(err, "glob")
 	}
 	isWildcard := (len(fromGlobMatches) > 1)
+	var savedPaths []string
 	for _, from := range fromGlobMatches {
-		fiSrc, err := os.Stat(from)
+		// Symlinks are exported as they are, rather than following them.
+		fiSrc, err := os.Lstat(from)
 		if err != nil {
-			return errors.Wrapf(err, "os stat %s", from)
+			return nil, errors.Wrapf(err, "os lstat %s", from)
 		}
 		srcIsDir := fiSrc.IsDir()
+		srcIsSymlink := fiSrc.Mode()&os.ModeSymlink != 0
 		to := destPath
 		destIsDir := strings.HasSuffix(to, "/")
 		if artifact.Target.IsLocalExternal() && !filepath.IsAbs(to) {
@@ -406,7 +784,7 @@ func (b *Builder) saveArtifactLocally(ctx context.Context, artifact domain.Artif
 		if err != nil {
 			// Ignore err. Likely dest path does not exist.
 			if isWildcard && !destIsDir {
-				return errors.New(
+				return nil, errors.New(
 					"Artifact is a wildcard, but AS LOCAL destination does not end with /")
 			}
 			destIsDir = fiSrc.IsDir()
@@ -415,7 +793,7 @@ func (b *Builder) saveArtifactLocally(ctx context.Context, artifact domain.Artif
 			destIsDir = fiDest.IsDir()
 		}
 		if srcIsDir && !destIsDir {
-			return errors.New(
+			return nil, errors.New(
 				"Artifact is a directory, but existing AS LOCAL destination is a file")
 		}
 		if destExists {
@@ -423,13 +801,13 @@ func (b *Builder) saveArtifactLocally(ctx context.Context, artifact domain.Artif
 				// Remove pre-existing dest file.
 				err = os.Remove(to)
 				if err != nil {
-					return errors.Wrapf(err, "rm %s", to)
+					return nil, errors.Wrapf(err, "rm %s", to)
 				}
 			} else {
 				// Remove pre-existing dest dir.
 				err = os.RemoveAll(to)
 				if err != nil {
-					return errors.Wrapf(err, "rm -rf %s", to)
+					return nil, errors.Wrapf(err, "rm -rf %s", to)
 				}
 			}
 		}
@@ -441,17 +819,41 @@ func (b *Builder) saveArtifactLocally(ctx context.Context, artifact domain.Artif
 		toDir := path.Dir(to)
 		err = os.MkdirAll(toDir, 0755)
 		if err != nil {
-			return errors.Wrapf(err, "mkdir all for artifact %s", toDir)
+			return nil, errors.Wrapf(err, "mkdir all for artifact %s", toDir)
+		}
+		if srcIsSymlink {
+			// Recreate the link, as hard linking a symlink follows it on some platforms.
+			err = copySymlink(from, to)
+		} else {
+			err = os.Link(from, to)
 		}
-		err = os.Link(from, to)
 		if err != nil {
 			// Hard linking did not work. Try recursive copy.
-			errCopy := reccopy.Copy(from, to)
+			var errCopy error
+			if opt.FaithfulArtifacts {
+				errCopy = copyFaithful(from, to)
+			} else {
+				errCopy = reccopy.Copy(from, to)
+			}
 			if errCopy != nil {
-				return errors.Wrapf(errCopy, "copy artifact %s", from)
+				return nil, errors.Wrapf(errCopy, "copy artifact %s", from)
 			}
 		}
 
+		if opt.RejectDanglingSymlinks {
+			err = checkDanglingSymlinks(to)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if opt.ChecksumsDir != "" || opt.SummaryPath != "" || opt.SizeReport {
+			err = b.recordChecksums(artifact, from, to)
+			if err != nil {
+				return nil, errors.Wrapf(err, "digest artifact %s", from)
+			}
+		}
+		savedPaths = append(savedPaths, to)
+
 		// Write to console about this artifact.
 		parts := strings.Split(filepath.ToSlash(from), "/")
 		artifactPath := artifact.Artifact
@@ -466,9 +868,14 @@ func (b *Builder) saveArtifactLocally(ctx context.Context, artifact domain.Artif
 		if strings.HasSuffix(destPath, "/") {
 			destPath2 = filepath.Join(destPath2, filepath.Base(artifactPath))
 		}
+		console.PrintEvent(conslogging.Event{
+			Type:     conslogging.ArtifactExportedEvent,
+			Artifact: artifact2.StringCanonical(),
+			Path:     destPath2,
+		})
 		if opt.PrintSuccess {
 			console.Printf("Artifact %s as local %s\n", artifact2.StringCanonical(), destPath2)
 		}
 	}
-	return nil
+	return savedPaths, nil
 }
@@ -0,0 +1,294 @@
+package builder
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// maxCacheHistoryEntries is the number of commands kept in the cache history. The
+// least recently executed ones are dropped first.
+const maxCacheHistoryEntries = 100000
+
+// cacheHistory is the record of the commands which completed successfully in previous
+// builds, keyed by their normalized LLB digest (see normalizeDigests). As buildkit
+// caches the result of commands, it is used to predict cache hits when planning a
+// build. Entries may be stale, if the buildkit cache has been pruned since.
+type cacheHistory struct {
+	path    string
+	entries map[digest.Digest]time.Time
+}
+
+// loadCacheHistory reads the cache history from path. A missing file is an empty
+// history.
+func loadCacheHistory(path string) (*cacheHistory, error) {
+	ch := &cacheHistory{
+		path:    path,
+		entries: make(map[digest.Digest]time.Time),
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return ch, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "open cache history %s", path)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			// Ignore malformed lines. The history is only a hint.
+			continue
+		}
+		unix, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		ch.entries[digest.Digest(fields[0])] = time.Unix(unix, 0)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, errors.Wrapf(err, "read cache history %s", path)
+	}
+	return ch, nil
+}
+
+func (ch *cacheHistory) has(dgst digest.Digest) bool {
+	_, found := ch.entries[dgst]
+	return found
+}
+
+func (ch *cacheHistory) add(dgst digest.Digest, at time.Time) {
+	ch.entries[dgst] = at
+}
+
+// save writes the history back to its file, dropping the oldest entries beyond
+// maxCacheHistoryEntries.
+func (ch *cacheHistory) save() error {
+	dgsts := make([]digest.Digest, 0, len(ch.entries))
+	for dgst := range ch.entries {
+		dgsts = append(dgsts, dgst)
+	}
+	sort.Slice(dgsts, func(i, j int) bool {
+		ti, tj := ch.entries[dgsts[i]], ch.entries[dgsts[j]]
+		if ti.Equal(tj) {
+			return dgsts[i] < dgsts[j]
+		}
+		return ti.After(tj)
+	})
+	if len(dgsts) > maxCacheHistoryEntries {
+		dgsts = dgsts[:maxCacheHistoryEntries]
+	}
+	var b strings.Builder
+	for _, dgst := range dgsts {
+		fmt.Fprintf(&b, "%s %d\n", dgst, ch.entries[dgst].Unix())
+	}
+	dir := filepath.Dir(ch.path)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return errors.Wrapf(err, "mkdir all %s", dir)
+	}
+	// Write to a temp file first, as concurrent builds may update the history.
+	tmp, err := ioutil.TempFile(dir, ".cache-history")
+	if err != nil {
+		return errors.Wrap(err, "create temp cache history")
+	}
+	_, err = tmp.WriteString(b.String())
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "write cache history %s", tmp.Name())
+	}
+	err = tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "close cache history %s", tmp.Name())
+	}
+	err = os.Rename(tmp.Name(), ch.path)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "rename cache history to %s", ch.path)
+	}
+	return nil
+}
+
+// SaveCacheHistory adds the commands which completed successfully during the builds
+// performed by this builder to the cache history at path. The history is used by
+// Plan to predict cache hits.
+func (b *Builder) SaveCacheHistory(path string) error {
+	dgsts := b.s.sm.completedVertices()
+	if len(dgsts) == 0 {
+		return nil
+	}
+	ch, err := loadCacheHistory(path)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, dgst := range dgsts {
+		ch.add(dgst, now)
+	}
+	return ch.save()
+}
+
+// recordDefinition records the normalized digests of the ops of a definition about to
+// be solved, such that the vertices which complete can be added to the cache history.
+func (sm *solverMonitor) recordDefinition(def *llb.Definition) error {
+	normalized, _, err := normalizeDigests(def)
+	if err != nil {
+		return err
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.normalizedDigests == nil {
+		sm.normalizedDigests = make(map[digest.Digest]digest.Digest)
+	}
+	for dgst, normalizedDgst := range normalized {
+		sm.normalizedDigests[dgst] = normalizedDgst
+	}
+	return nil
+}
+
+// completedVertices returns the normalized digests of the vertices which completed
+// without error.
+func (sm *solverMonitor) completedVertices() []digest.Digest {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	var ret []digest.Digest
+	for dgst, vm := range sm.vertices {
+		if vm.vertex.Completed == nil || vm.vertex.Error != "" {
+			continue
+		}
+		normalizedDgst, found := sm.normalizedDigests[dgst]
+		if found {
+			ret = append(ret, normalizedDgst)
+		}
+	}
+	return ret
+}
+
+// normalizeDigests computes the digests of the ops of def, with the session of local
+// sources removed. See normalizeDefinition.
+//
+// It returns the normalized digests keyed by the actual digest and, keyed by the
+// normalized digest, whether the op depends on a local source.
+func normalizeDigests(def *llb.Definition) (map[digest.Digest]digest.Digest, map[digest.Digest]bool, error) {
+	_, normalized, usesLocal, err := normalizeDefinition(def)
+	return normalized, usesLocal, err
+}
+
+// normalizeDefinition returns def with the session of local sources removed. The
+// session of local sources (eg the build context) is unique to each invocation of
+// earth, which would otherwise cause the digests of all the ops depending on them to
+// vary between builds. Buildkit caches local sources based on their contents instead.
+//
+// Besides the normalized definition, it returns the normalized digests keyed by the
+// actual digest and, keyed by the normalized digest, whether the op depends on a
+// local source.
+func normalizeDefinition(def *llb.Definition) (*llb.Definition, map[digest.Digest]digest.Digest, map[digest.Digest]bool, error) {
+	ret := &llb.Definition{
+		Metadata: make(map[digest.Digest]pb.OpMetadata),
+		Source:   def.Source,
+	}
+	normalized := make(map[digest.Digest]digest.Digest)
+	usesLocal := make(map[digest.Digest]bool)
+	ops, err := sortedOps(def)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, sop := range ops {
+		op, dt := sop.op, sop.dt
+		local := false
+		src := op.GetSource()
+		if src != nil && strings.HasPrefix(src.Identifier, "local://") {
+			local = true
+			delete(src.Attrs, pb.AttrLocalSessionID)
+			delete(src.Attrs, pb.AttrLocalUniqueID)
+		}
+		for _, input := range op.Inputs {
+			normalizedInput, found := normalized[input.Digest]
+			if !found {
+				return nil, nil, nil, fmt.Errorf("input %s not found in definition", input.Digest)
+			}
+			input.Digest = normalizedInput
+			local = local || usesLocal[normalizedInput]
+		}
+		normalizedDt, err := op.Marshal()
+		if err != nil {
+			return nil, nil, nil, errors.Wrap(err, "proto marshal of op")
+		}
+		dgst := digest.FromBytes(dt)
+		normalizedDgst := digest.FromBytes(normalizedDt)
+		normalized[dgst] = normalizedDgst
+		usesLocal[normalizedDgst] = local
+		ret.Def = append(ret.Def, normalizedDt)
+		md, found := def.Metadata[dgst]
+		if found {
+			ret.Metadata[normalizedDgst] = md
+		}
+	}
+	return ret, normalized, usesLocal, nil
+}
+
+type defOp struct {
+	op pb.Op
+	dt []byte
+}
+
+// sortedOps returns the ops of the definition such that inputs precede the ops
+// using them. Unlike the order of the marshalled definition, which depends on map
+// iteration, the order is deterministic: it follows the inputs of each op, starting
+// from the terminal op.
+func sortedOps(def *llb.Definition) ([]*defOp, error) {
+	byDigest := make(map[digest.Digest]*defOp)
+	for _, dt := range def.Def {
+		dop := &defOp{dt: dt}
+		err := proto.Unmarshal(dt, &dop.op)
+		if err != nil {
+			return nil, errors.Wrap(err, "proto unmarshal of op")
+		}
+		byDigest[digest.FromBytes(dt)] = dop
+	}
+	var ret []*defOp
+	visited := make(map[*defOp]bool)
+	var visit func(dop *defOp) error
+	visit = func(dop *defOp) error {
+		if visited[dop] {
+			return nil
+		}
+		visited[dop] = true
+		for _, input := range dop.op.Inputs {
+			inputOp, found := byDigest[input.Digest]
+			if !found {
+				return fmt.Errorf("input %s not found in definition", input.Digest)
+			}
+			err := visit(inputOp)
+			if err != nil {
+				return err
+			}
+		}
+		ret = append(ret, dop)
+		return nil
+	}
+	// The terminal op is always last.
+	for i := len(def.Def) - 1; i >= 0; i-- {
+		err := visit(byDigest[digest.FromBytes(def.Def[i])])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
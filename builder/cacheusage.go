@@ -0,0 +1,95 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/earthly/earthly/earthfile2llb"
+
+	"github.com/moby/buildkit/client"
+	"github.com/pkg/errors"
+)
+
+// CacheUsage is the disk usage of the cache records of a target, of a project, or of
+// a kind of records which are not attributed to targets.
+type CacheUsage struct {
+	// Name is the target or the project, or the record type in parentheses (for
+	// example "(source.local)") for the records not attributed to targets.
+	Name string `json:"name"`
+	// Records is the number of cache records.
+	Records int `json:"records"`
+	// Size is the disk space used by the records, in bytes.
+	Size int64 `json:"size"`
+	// Reclaimable is the part of Size which prune would free: the records which are
+	// neither in use nor shared.
+	Reclaimable int64 `json:"reclaimable"`
+	// LastUsedAt is when the records were last used.
+	LastUsedAt time.Time `json:"lastUsedAt"`
+}
+
+// CacheUsageOf reports the disk usage of the cache of the buildkitd, broken down by
+// target or, if byProject is set, by project, from the largest to the smallest. The
+// records produced by RUN and WITH DOCKER commands are attributed to targets (see
+// earthfile2llb.CacheTargetOf); the others are grouped by record type.
+func CacheUsageOf(ctx context.Context, bkClient *client.Client, byProject bool) ([]CacheUsage, error) {
+	du, err := bkClient.DiskUsage(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "buildkit disk usage")
+	}
+	return groupCacheUsage(du, byProject), nil
+}
+
+func groupCacheUsage(du []*client.UsageInfo, byProject bool) []CacheUsage {
+	byName := make(map[string]*CacheUsage)
+	for _, info := range du {
+		name, ok := earthfile2llb.CacheTargetOf(info.Description)
+		if ok {
+			if byProject {
+				name = projectOf(name)
+			}
+		} else {
+			recordType := info.RecordType
+			if recordType == "" {
+				recordType = client.UsageRecordTypeRegular
+			}
+			name = fmt.Sprintf("(%s)", recordType)
+		}
+		cu, found := byName[name]
+		if !found {
+			cu = &CacheUsage{Name: name}
+			byName[name] = cu
+		}
+		cu.Records++
+		cu.Size += info.Size
+		if !info.InUse && !info.Shared {
+			cu.Reclaimable += info.Size
+		}
+		if lastUsed(info).After(cu.LastUsedAt) {
+			cu.LastUsedAt = lastUsed(info)
+		}
+	}
+	ret := make([]CacheUsage, 0, len(byName))
+	for _, cu := range byName {
+		ret = append(ret, *cu)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Size != ret[j].Size {
+			return ret[i].Size > ret[j].Size
+		}
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+// projectOf returns the project of a canonical target name, such as github.com/foo/bar
+// for github.com/foo/bar+build.
+func projectOf(target string) string {
+	i := strings.LastIndex(target, "+")
+	if i == -1 {
+		return target
+	}
+	return target[:i]
+}
@@ -0,0 +1,39 @@
+package builder
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/moby/buildkit/client"
+)
+
+func TestGroupCacheUsage(t *testing.T) {
+	desc := func(target string) string {
+		return "mount / from exec /bin/sh -c EARTHLY_CACHE_TARGET='" + target + "' /usr/bin/earth_debugger"
+	}
+	du := []*client.UsageInfo{
+		{ID: "1", Description: desc("github.com/foo/bar+build"), Size: 100},
+		{ID: "2", Description: desc("github.com/foo/bar+build"), Size: 50, InUse: true},
+		{ID: "3", Description: desc("github.com/foo/bar+test"), Size: 120},
+		{ID: "4", Description: desc("github.com/foo/baz+build"), Size: 10},
+		{ID: "5", Description: "local source for context", Size: 30, RecordType: client.UsageRecordTypeLocalSource},
+		{ID: "6", Description: "pulled from docker.io/library/alpine", Size: 5},
+	}
+	byTarget := groupCacheUsage(du, false)
+	var names []string
+	for _, cu := range byTarget {
+		names = append(names, cu.Name)
+	}
+	expected := []string{"github.com/foo/bar+build", "github.com/foo/bar+test", "(source.local)", "github.com/foo/baz+build", "(regular)"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+	if byTarget[0].Records != 2 || byTarget[0].Size != 150 || byTarget[0].Reclaimable != 100 {
+		t.Errorf("unexpected usage of +build: %+v", byTarget[0])
+	}
+
+	byProject := groupCacheUsage(du, true)
+	if byProject[0].Name != "github.com/foo/bar" || byProject[0].Size != 270 || byProject[0].Records != 3 {
+		t.Errorf("unexpected usage of github.com/foo/bar: %+v", byProject[0])
+	}
+}
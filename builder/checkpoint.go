@@ -0,0 +1,189 @@
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/pkg/errors"
+)
+
+// ErrInterrupted is returned by Build when the build was stopped via
+// BuildOpt.Interrupt.
+var ErrInterrupted = errors.New("build interrupted")
+
+// Checkpoint is the record of an interrupted build, written to
+// BuildOpt.CheckpointPath. As the commands which completed are in the buildkit cache,
+// building the same target again resumes from where the build stopped.
+type Checkpoint struct {
+	Target        string             `json:"target"`
+	InterruptedAt time.Time          `json:"interruptedAt"`
+	Targets       []CheckpointTarget `json:"targets"`
+}
+
+// CheckpointTarget is the state of one of the targets of an interrupted build.
+type CheckpointTarget struct {
+	Target string `json:"target"`
+	Salt   string `json:"salt"`
+	// Completed is set if all the commands of the target completed.
+	Completed bool `json:"completed"`
+	// ArtifactsSaved is set if the SAVE ARTIFACT ... AS LOCAL artifacts of the target
+	// have been written.
+	ArtifactsSaved bool `json:"artifactsSaved"`
+}
+
+// NumCompleted returns the number of targets which completed before the interruption.
+func (cp *Checkpoint) NumCompleted() int {
+	n := 0
+	for _, t := range cp.Targets {
+		if t.Completed {
+			n++
+		}
+	}
+	return n
+}
+
+// LoadCheckpoint reads the checkpoint at path. It returns nil if there is none.
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	dt, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "read checkpoint %s", path)
+	}
+	var cp Checkpoint
+	err = json.Unmarshal(dt, &cp)
+	if err != nil {
+		return nil, errors.Wrapf(err, "json unmarshal checkpoint %s", path)
+	}
+	return &cp, nil
+}
+
+// interrupted returns whether the build has been asked to stop.
+func interrupted(opt BuildOpt) bool {
+	select {
+	case <-opt.Interrupt:
+		return true
+	default:
+		return false
+	}
+}
+
+// cancelOnInterrupt returns a context which is canceled when the build is asked to
+// stop, in addition to when ctx is.
+func cancelOnInterrupt(ctx context.Context, opt BuildOpt) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-opt.Interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// stopGracefully wraps up an interrupted build: the SAVE ARTIFACT ... AS LOCAL
+// artifacts of the targets which completed, and which have not been output yet, are
+// written, and the checkpoint of the build is recorded. Images are neither output
+// nor pushed. output holds the target states which have been output already.
+func (b *Builder) stopGracefully(ctx context.Context, localDirs map[string]string, mts *earthfile2llb.MultiTargetStates, output map[*earthfile2llb.SingleTargetStates]bool, opt BuildOpt) error {
+	b.console.Warnf("Build interrupted. Saving the artifacts of the completed targets...\n")
+	saved := make(map[*earthfile2llb.SingleTargetStates]bool)
+	for sts := range output {
+		saved[sts] = true
+	}
+	if !opt.NoOutput && localDirs != nil {
+		outputStates, err := outputOrder(mts)
+		if err != nil {
+			return err
+		}
+		for _, states := range outputStates {
+			if saved[states] || states.Target.IsRemote() ||
+				!b.s.sm.targetFinished(states.Target.String(), states.Salt) {
+				continue
+			}
+			err = b.buildArtifacts(ctx, localDirs, states, opt)
+			if err != nil {
+				b.console.Warnf("Warning: could not save the artifacts of %s: %v\n", states.Target.String(), err)
+				continue
+			}
+			saved[states] = true
+		}
+		err = b.writeChecksums(opt)
+		if err != nil {
+			b.console.Warnf("Warning: could not write the checksums: %v\n", err)
+		}
+	}
+	if opt.CheckpointPath != "" {
+		err := b.writeCheckpoint(mts, saved, opt.CheckpointPath)
+		if err != nil {
+			b.console.Warnf("Warning: could not write the checkpoint: %v\n", err)
+		}
+	}
+	return ErrInterrupted
+}
+
+// writeCheckpoint records the state of the targets visited by the build.
+func (b *Builder) writeCheckpoint(mts *earthfile2llb.MultiTargetStates, saved map[*earthfile2llb.SingleTargetStates]bool, path string) error {
+	cp := Checkpoint{
+		Target:        mts.FinalStates.Target.StringCanonical(),
+		InterruptedAt: time.Now(),
+	}
+	for _, stss := range mts.VisitedStates {
+		for _, sts := range stss {
+			cp.Targets = append(cp.Targets, CheckpointTarget{
+				Target:         sts.Target.StringCanonical(),
+				Salt:           sts.Salt,
+				Completed:      b.s.sm.targetFinished(sts.Target.String(), sts.Salt),
+				ArtifactsSaved: saved[sts],
+			})
+		}
+	}
+	sort.Slice(cp.Targets, func(i, j int) bool {
+		if cp.Targets[i].Target != cp.Targets[j].Target {
+			return cp.Targets[i].Target < cp.Targets[j].Target
+		}
+		return cp.Targets[i].Salt < cp.Targets[j].Salt
+	})
+	dt, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "json marshal checkpoint")
+	}
+	dir := filepath.Dir(path)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return errors.Wrapf(err, "mkdir all %s", dir)
+	}
+	err = ioutil.WriteFile(path, dt, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "write checkpoint %s", path)
+	}
+	b.console.Printf("Checkpoint (%d of %d targets completed) as local %s\n", cp.NumCompleted(), len(cp.Targets), path)
+	return nil
+}
+
+// targetFinished returns whether all the commands of the target have completed
+// successfully. Only the commands which buildkit has reported are known; buildkit
+// reports all the commands of a solve as soon as it starts.
+func (sm *solverMonitor) targetFinished(targetStr string, salt string) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	found := false
+	for _, vm := range sm.vertices {
+		if vm.targetStr != targetStr || vm.salt != salt {
+			continue
+		}
+		if vm.vertex.Completed == nil || vm.vertex.Error != "" {
+			return false
+		}
+		found = true
+	}
+	return found
+}
@@ -0,0 +1,102 @@
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/earthly/earthly/conslogging"
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/moby/buildkit/client"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestTargetFinished(t *testing.T) {
+	sm := newSolverMonitor(conslogging.Current(conslogging.NoColor))
+	now := time.Now()
+	add := func(dgst digest.Digest, targetStr string, completed bool, vertexError string) {
+		vertex := &client.Vertex{Digest: dgst, Error: vertexError}
+		if completed {
+			vertex.Completed = &now
+		}
+		sm.vertices[dgst] = &vertexMonitor{vertex: vertex, targetStr: targetStr, salt: "s"}
+	}
+	add("sha256:1", "+done", true, "")
+	add("sha256:2", "+done", true, "")
+	add("sha256:3", "+running", true, "")
+	add("sha256:4", "+running", false, "")
+	add("sha256:5", "+failed", true, "exit code: 1")
+
+	tests := map[string]bool{
+		"+done":    true,
+		"+running": false,
+		"+failed":  false,
+		"+unknown": false,
+	}
+	for targetStr, expected := range tests {
+		if actual := sm.targetFinished(targetStr, "s"); actual != expected {
+			t.Errorf("targetFinished(%s) = %v, expected %v", targetStr, actual, expected)
+		}
+	}
+	if sm.targetFinished("+done", "other") {
+		t.Errorf("targetFinished with another salt")
+	}
+}
+
+func TestWriteCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "earth-checkpoint-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoints", "build.json")
+
+	cp, err := LoadCheckpoint(path)
+	if err != nil || cp != nil {
+		t.Fatalf("LoadCheckpoint of a missing checkpoint = %v, %v", cp, err)
+	}
+
+	console := conslogging.Current(conslogging.NoColor)
+	sm := newSolverMonitor(console)
+	now := time.Now()
+	sm.vertices["sha256:1"] = &vertexMonitor{
+		vertex: &client.Vertex{Digest: "sha256:1", Completed: &now}, targetStr: "+dep", salt: "a",
+	}
+	sm.vertices["sha256:2"] = &vertexMonitor{
+		vertex: &client.Vertex{Digest: "sha256:2"}, targetStr: "+build", salt: "b",
+	}
+	dep := &earthfile2llb.SingleTargetStates{Target: domain.Target{LocalPath: ".", Target: "dep"}, Salt: "a"}
+	build := &earthfile2llb.SingleTargetStates{Target: domain.Target{LocalPath: ".", Target: "build"}, Salt: "b"}
+	mts := &earthfile2llb.MultiTargetStates{
+		FinalStates: build,
+		VisitedStates: map[string][]*earthfile2llb.SingleTargetStates{
+			"+dep":   {dep},
+			"+build": {build},
+		},
+	}
+	b := &Builder{console: console, s: &solver{sm: sm}}
+	err = b.writeCheckpoint(mts, map[*earthfile2llb.SingleTargetStates]bool{dep: true}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cp, err = LoadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.Target != "+build" || len(cp.Targets) != 2 || cp.NumCompleted() != 1 {
+		t.Fatalf("unexpected checkpoint %+v", cp)
+	}
+	expected := []CheckpointTarget{
+		{Target: "+build", Salt: "b"},
+		{Target: "+dep", Salt: "a", Completed: true, ArtifactsSaved: true},
+	}
+	for i, ct := range cp.Targets {
+		if ct != expected[i] {
+			t.Errorf("target %d: got %+v, expected %+v", i, ct, expected[i])
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/earthly/earthly/domain"
+	"github.com/pkg/errors"
+)
+
+const (
+	checksumsFileName     = "SHA256SUMS"
+	checksumsJSONFileName = "SHA256SUMS.json"
+)
+
+// artifactChecksum is an entry of the checksum manifest of locally saved artifacts.
+type artifactChecksum struct {
+	// Path is the local path the file was saved to.
+	Path string `json:"path"`
+	// Artifact is the canonical artifact reference the file is part of.
+	Artifact string `json:"artifact"`
+	SHA256   string `json:"sha256"`
+	Size     int64  `json:"size"`
+}
+
+// recordChecksums digests the regular files of the artifact output from (as exported
+// from the artifacts state) and records them as saved at to. The files are digested on
+// the host, as the local exporter of buildkit does not report digests, and the content
+// store only holds those of image blobs.
+func (b *Builder) recordChecksums(artifact domain.Artifact, from string, to string) error {
+	return filepath.Walk(from, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(from, p)
+		if err != nil {
+			return errors.Wrapf(err, "rel path of %s", p)
+		}
+		dgst, err := fileSHA256(p)
+		if err != nil {
+			return err
+		}
+		b.checksums = append(b.checksums, artifactChecksum{
+			Path:     filepath.ToSlash(filepath.Join(to, rel)),
+			Artifact: artifact.StringCanonical(),
+			SHA256:   dgst,
+			Size:     fi.Size(),
+		})
+		return nil
+	})
+}
+
+// savedChecksums returns the checksums of the files saved locally, sorted by path.
+func (b *Builder) savedChecksums() []artifactChecksum {
+	checksums := make([]artifactChecksum, 0, len(b.checksums))
+	// The same file may have been saved several times. Keep the last one.
+	seen := make(map[string]int)
+	for _, c := range b.checksums {
+		if i, found := seen[c.Path]; found {
+			checksums[i] = c
+			continue
+		}
+		seen[c.Path] = len(checksums)
+		checksums = append(checksums, c)
+	}
+	sort.Slice(checksums, func(i, j int) bool {
+		return checksums[i].Path < checksums[j].Path
+	})
+	return checksums
+}
+
+// writeChecksums writes the checksum manifest of all the artifacts saved locally
+// during the build, both in the sha256sum format and as JSON.
+func (b *Builder) writeChecksums(opt BuildOpt) error {
+	if opt.ChecksumsDir == "" || len(b.checksums) == 0 {
+		return nil
+	}
+	checksums := b.savedChecksums()
+	err := os.MkdirAll(opt.ChecksumsDir, 0755)
+	if err != nil {
+		return errors.Wrapf(err, "mkdir all %s", opt.ChecksumsDir)
+	}
+	var sums strings.Builder
+	for _, c := range checksums {
+		// Same format as sha256sum, such that the manifest can be verified via
+		// sha256sum -c.
+		sums.WriteString(fmt.Sprintf("%s  %s\n", c.SHA256, c.Path))
+	}
+	sumsPath := filepath.Join(opt.ChecksumsDir, checksumsFileName)
+	err = ioutil.WriteFile(sumsPath, []byte(sums.String()), 0644)
+	if err != nil {
+		return errors.Wrapf(err, "write checksums %s", sumsPath)
+	}
+	dt, err := json.MarshalIndent(checksums, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "json marshal checksums")
+	}
+	jsonPath := filepath.Join(opt.ChecksumsDir, checksumsJSONFileName)
+	err = ioutil.WriteFile(jsonPath, dt, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "write checksums %s", jsonPath)
+	}
+	b.console.Printf("Checksums of artifacts as local %s\n", sumsPath)
+	return nil
+}
@@ -0,0 +1,56 @@
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/earthly/earthly/conslogging"
+	"github.com/earthly/earthly/domain"
+)
+
+func TestWriteChecksums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "earth-checksums-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	from := filepath.Join(dir, "from")
+	err = os.MkdirAll(filepath.Join(from, "sub"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(from, "sub", "file"), []byte("hello\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("sub/file", filepath.Join(from, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Builder{console: conslogging.Current(conslogging.NoColor)}
+	artifact := domain.Artifact{Target: domain.Target{LocalPath: ".", Target: "build"}, Artifact: "out"}
+	err = b.recordChecksums(artifact, from, "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt := BuildOpt{ChecksumsDir: filepath.Join(dir, "sums")}
+	err = b.writeChecksums(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt, err := ioutil.ReadFile(filepath.Join(opt.ChecksumsDir, checksumsFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03  out/sub/file\n"
+	if string(dt) != expected {
+		t.Errorf("unexpected checksums %q", string(dt))
+	}
+	_, err = os.Stat(filepath.Join(opt.ChecksumsDir, checksumsJSONFileName))
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,172 @@
+package builder
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// criticalPath is the chain of commands which determined the duration of a build: each
+// command of the chain is the last input to complete of the command following it.
+// Speeding up any other command does not make the build faster.
+type criticalPath struct {
+	DurationSeconds float64 `json:"durationSeconds"`
+	// Targets are the targets of the commands of the chain, from the one which spent
+	// the most time on it to the one which spent the least, which are the targets to
+	// optimize first.
+	Targets []criticalPathTarget `json:"targets"`
+	// Commands are the commands of the chain, in order of execution.
+	Commands []criticalPathCommand `json:"commands"`
+}
+
+type criticalPathTarget struct {
+	Target string `json:"target"`
+	Salt   string `json:"salt"`
+	// DurationSeconds is the time spent executing the commands of the target which
+	// are part of the chain.
+	DurationSeconds float64 `json:"durationSeconds"`
+	Commands        int     `json:"commands"`
+}
+
+type criticalPathCommand struct {
+	// Target is empty for the internal operations of buildkit, such as loading the
+	// build context.
+	Target          string    `json:"target,omitempty"`
+	Command         string    `json:"command"`
+	Cached          bool      `json:"cached"`
+	Started         time.Time `json:"started"`
+	Completed       time.Time `json:"completed"`
+	DurationSeconds float64   `json:"durationSeconds"`
+}
+
+// recordTimes records when the vertex was first executed. Vertices solved again in a
+// later solve of the build, such as for outputting an image, are reported as cached
+// then, which is not recorded.
+func (vm *vertexMonitor) recordTimes() {
+	if vm.completed != nil || vm.vertex.Completed == nil {
+		return
+	}
+	completed := *vm.vertex.Completed
+	started := completed
+	if vm.vertex.Started != nil {
+		started = *vm.vertex.Started
+	}
+	vm.started = &started
+	vm.completed = &completed
+	vm.cached = vm.vertex.Cached
+}
+
+// criticalPath returns the critical path of the commands completed so far, if any.
+func (sm *solverMonitor) criticalPath() *criticalPath {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return criticalPathOf(sm.vertices)
+}
+
+// criticalPathOf returns the critical path of the given vertices, ending with the
+// command which completed last. Nil if no command completed.
+func criticalPathOf(vertices map[digest.Digest]*vertexMonitor) *criticalPath {
+	var last *vertexMonitor
+	for _, vm := range vertices {
+		// The exporters of buildkit, which complete last, have no inputs.
+		if vm.completed == nil || vm.isInternal || vm.operation == "" {
+			continue
+		}
+		if last == nil || vm.completed.After(*last.completed) {
+			last = vm
+		}
+	}
+	if last == nil {
+		return nil
+	}
+	var chain []*vertexMonitor
+	visited := make(map[*vertexMonitor]bool)
+	for vm := last; vm != nil && !visited[vm]; {
+		visited[vm] = true
+		chain = append([]*vertexMonitor{vm}, chain...)
+		var next *vertexMonitor
+		for _, input := range vm.vertex.Inputs {
+			ivm, ok := vertices[input]
+			if !ok || ivm.completed == nil {
+				continue
+			}
+			if next == nil || ivm.completed.After(*next.completed) {
+				next = ivm
+			}
+		}
+		vm = next
+	}
+
+	cp := &criticalPath{
+		DurationSeconds: last.completed.Sub(*chain[0].started).Seconds(),
+		Targets:         []criticalPathTarget{},
+	}
+	targetIndices := make(map[string]int)
+	for _, vm := range chain {
+		cmd := criticalPathCommand{
+			Command:         vm.operation,
+			Cached:          vm.cached,
+			Started:         *vm.started,
+			Completed:       *vm.completed,
+			DurationSeconds: vm.completed.Sub(*vm.started).Seconds(),
+		}
+		if cmd.Command == "" {
+			cmd.Command = vm.vertex.Name
+		}
+		if vm.isInternal || vm.targetStr == "" {
+			cp.Commands = append(cp.Commands, cmd)
+			continue
+		}
+		cmd.Target = vm.targetStr
+		cp.Commands = append(cp.Commands, cmd)
+		key := vm.targetStr + " " + vm.salt
+		i, found := targetIndices[key]
+		if !found {
+			i = len(cp.Targets)
+			targetIndices[key] = i
+			cp.Targets = append(cp.Targets, criticalPathTarget{Target: vm.targetStr, Salt: vm.salt})
+		}
+		cp.Targets[i].DurationSeconds += cmd.DurationSeconds
+		cp.Targets[i].Commands++
+	}
+	sort.SliceStable(cp.Targets, func(i, j int) bool {
+		return cp.Targets[i].DurationSeconds > cp.Targets[j].DurationSeconds
+	})
+	return cp
+}
+
+// PrintCriticalPath prints the critical path of the build: the targets which spent the
+// most time on it, which are the ones to optimize first, and its commands.
+func (b *Builder) PrintCriticalPath() {
+	cp := b.s.sm.criticalPath()
+	if cp == nil {
+		return
+	}
+	b.console.Printf("Critical path: %s, %d commands\n", formatSeconds(cp.DurationSeconds), len(cp.Commands))
+	b.console.Printf("Targets on the critical path:\n")
+	for _, t := range cp.Targets {
+		share := 0.0
+		if cp.DurationSeconds > 0 {
+			share = 100 * t.DurationSeconds / cp.DurationSeconds
+		}
+		b.console.Printf("  %-40s %10s %4.0f%%  %d commands\n", t.Target, formatSeconds(t.DurationSeconds), share, t.Commands)
+	}
+	b.console.Printf("Commands on the critical path:\n")
+	for _, cmd := range cp.Commands {
+		cached := ""
+		if cmd.Cached {
+			cached = " (cached)"
+		}
+		target := cmd.Target
+		if target == "" {
+			target = "(internal)"
+		}
+		b.console.Printf("  %10s  %s %s%s\n", formatSeconds(cmd.DurationSeconds), target, cmd.Command, cached)
+	}
+}
+
+func formatSeconds(seconds float64) string {
+	return fmt.Sprint(time.Duration(seconds * float64(time.Second)).Round(100 * time.Millisecond))
+}
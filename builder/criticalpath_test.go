@@ -0,0 +1,84 @@
+package builder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestCriticalPathOf(t *testing.T) {
+	start := time.Date(2021, 2, 1, 10, 0, 0, 0, time.UTC)
+	vertices := make(map[digest.Digest]*vertexMonitor)
+	add := func(name string, from, to int, inputs ...string) {
+		var inputDigests []digest.Digest
+		for _, input := range inputs {
+			inputDigests = append(inputDigests, digest.FromString(input))
+		}
+		started := start.Add(time.Duration(from) * time.Second)
+		completed := start.Add(time.Duration(to) * time.Second)
+		vm := &vertexMonitor{vertex: &client.Vertex{
+			Digest:    digest.FromString(name),
+			Name:      name,
+			Inputs:    inputDigests,
+			Started:   &started,
+			Completed: &completed,
+		}}
+		vm.targetStr, vm.salt, vm.operation = parseVertexName(name)
+		vm.isInternal = vm.targetStr == "internal"
+		vm.recordTimes()
+		vertices[vm.vertex.Digest] = vm
+	}
+	add("[internal] load build context", 0, 1)
+	add("[+deps 1] RUN go mod download", 1, 11, "[internal] load build context")
+	add("[+lint 2] RUN golint", 1, 4, "[internal] load build context")
+	add("[+build 3] RUN go build", 11, 31, "[+deps 1] RUN go mod download", "[+lint 2] RUN golint")
+	add("exporting to image", 31, 33)
+
+	cp := criticalPathOf(vertices)
+	if cp == nil {
+		t.Fatal("expected a critical path")
+	}
+	if cp.DurationSeconds != 31 {
+		t.Errorf("expected 31s, got %v", cp.DurationSeconds)
+	}
+	var commands []string
+	for _, cmd := range cp.Commands {
+		commands = append(commands, cmd.Target+" "+cmd.Command)
+	}
+	expected := []string{" load build context", "+deps RUN go mod download", "+build RUN go build"}
+	if len(commands) != len(expected) {
+		t.Fatalf("expected commands %q, got %q", expected, commands)
+	}
+	for i := range expected {
+		if commands[i] != expected[i] {
+			t.Errorf("expected commands %q, got %q", expected, commands)
+			break
+		}
+	}
+	if len(cp.Targets) != 2 ||
+		cp.Targets[0].Target != "+build" || cp.Targets[0].DurationSeconds != 20 ||
+		cp.Targets[1].Target != "+deps" || cp.Targets[1].Commands != 1 {
+		t.Errorf("unexpected targets %+v", cp.Targets)
+	}
+}
+
+func TestRecordTimes(t *testing.T) {
+	started := time.Date(2021, 2, 1, 10, 0, 0, 0, time.UTC)
+	completed := started.Add(time.Minute)
+	vm := &vertexMonitor{vertex: &client.Vertex{Started: &started}}
+	vm.recordTimes()
+	if vm.completed != nil {
+		t.Fatal("expected no times before completion")
+	}
+	vm.vertex = &client.Vertex{Started: &started, Completed: &completed}
+	vm.recordTimes()
+	// Solved again, as cached, for the outputs of the build.
+	later := completed.Add(time.Minute)
+	vm.vertex = &client.Vertex{Started: &later, Completed: &later, Cached: true}
+	vm.recordTimes()
+	if !vm.started.Equal(started) || !vm.completed.Equal(completed) || vm.cached {
+		t.Errorf("unexpected times %v %v %v", vm.started, vm.completed, vm.cached)
+	}
+}
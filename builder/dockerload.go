@@ -0,0 +1,157 @@
+package builder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/earthly/earthly/logging"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/pkg/errors"
+)
+
+// dockerLoadSocketPrefix prefixes the IDs of the SSH sockets serving the images of
+// DOCKER LOAD and WITH DOCKER --load.
+const dockerLoadSocketPrefix = "earthly-docker-load-"
+
+// streamFun writes the docker tar of an image to w.
+type streamFun func(ctx context.Context, w io.Writer) error
+
+// dockerLoadProvider serves the images of DOCKER LOAD and WITH DOCKER --load as docker
+// tars, via sockets forwarded into the RUN commands loading them, such that they are
+// streamed from the exporter of buildkit straight into docker load, without being
+// written anywhere. The image is exported when the RUN reads the socket, by which
+// point it has been built, as the RUN mounts it.
+type dockerLoadProvider struct {
+	mu      sync.Mutex
+	streams map[string]streamFun
+}
+
+func newDockerLoadProvider() *dockerLoadProvider {
+	return &dockerLoadProvider{
+		streams: make(map[string]streamFun),
+	}
+}
+
+// register serves the docker tar written by fn via the socket of the given ID, unless
+// the socket is already served.
+func (dlp *dockerLoadProvider) register(socketID string, fn streamFun) {
+	dlp.mu.Lock()
+	defer dlp.mu.Unlock()
+	if _, found := dlp.streams[socketID]; !found {
+		dlp.streams[socketID] = fn
+	}
+}
+
+func (dlp *dockerLoadProvider) stream(socketID string) (streamFun, bool) {
+	dlp.mu.Lock()
+	defer dlp.mu.Unlock()
+	fn, ok := dlp.streams[socketID]
+	return fn, ok
+}
+
+// hasSocket implements socketProvider.
+func (dlp *dockerLoadProvider) hasSocket(id string) bool {
+	if !strings.HasPrefix(id, dockerLoadSocketPrefix) {
+		return false
+	}
+	_, ok := dlp.stream(id)
+	return ok
+}
+
+// serveSocket implements socketProvider.
+func (dlp *dockerLoadProvider) serveSocket(ctx context.Context, id string, w io.Writer) error {
+	fn, ok := dlp.stream(id)
+	if !ok {
+		return fmt.Errorf("unknown docker load socket %s", id)
+	}
+	err := fn(ctx, w)
+	if err != nil {
+		// The load fails due to the truncated tar. The cause is only known here.
+		logging.GetLogger(ctx).Error(errors.Wrapf(err, "stream docker load image %s", id))
+		return err
+	}
+	return nil
+}
+
+// dockerLoadSocketID returns the ID of the socket serving the image of the given
+// definition and config as dockerTag. The ID changes whenever the definition or the
+// config of the image does, such that the RUN loading it is not cached when they do.
+// The changes of the build contexts the image is built from are accounted for by the
+// RUN mounting the image.
+func dockerLoadSocketID(dockerTag string, def *llb.Definition, imgJSON []byte) string {
+	h := sha256.New()
+	h.Write([]byte(dockerTag))
+	for _, dt := range def.Def {
+		h.Write([]byte{0})
+		h.Write(dt)
+	}
+	h.Write([]byte{0})
+	h.Write(imgJSON)
+	return dockerLoadSocketPrefix + hex.EncodeToString(h.Sum(nil))
+}
+
+// BuildOnlyLastImageForDockerLoad performs the build for the given multi target
+// states, and serves the last saved image as a docker tar via a socket forwarded by the
+// session, for DOCKER LOAD and WITH DOCKER --load. The ID of the socket is returned.
+func (b *Builder) BuildOnlyLastImageForDockerLoad(ctx context.Context, mts *earthfile2llb.MultiTargetStates, dockerTag string, opt BuildOpt) (string, error) {
+	saveImage, ok := mts.FinalStates.LastSaveImage()
+	if !ok {
+		return "", fmt.Errorf("No save image exists for %s", mts.FinalStates.Target.String())
+	}
+
+	cacheLocalDir, _, err := b.buildCommon(ctx, mts, opt)
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(cacheLocalDir)
+	if opt.PrintSuccess {
+		b.console.PrintSuccess()
+	}
+
+	s := b.solverFor(mts.FinalStates)
+	def, err := s.marshal(ctx, saveImage.State)
+	if err != nil {
+		return "", errors.Wrap(err, "state marshal")
+	}
+	imgJSON, err := json.Marshal(saveImage.Image)
+	if err != nil {
+		return "", errors.Wrap(err, "image json marshal")
+	}
+	// The image is solved once, when the RUN loading it reads the socket.
+	socketID := dockerLoadSocketID(dockerTag, def, imgJSON)
+	b.dockerLoads.register(socketID, func(ctx context.Context, w io.Writer) error {
+		cacheLocalDir, err := ioutil.TempDir("/tmp", "earthly-cache")
+		if err != nil {
+			return errors.Wrap(err, "make temp dir for cache")
+		}
+		defer os.RemoveAll(cacheLocalDir)
+		localDirs, err := collectLocalDirs(mts, cacheLocalDir)
+		if err != nil {
+			return err
+		}
+		solveCtx := logging.With(ctx, "image", dockerTag)
+		solveCtx = logging.With(solveCtx, "solve", "image-docker-load")
+		_, err = s.solveDockerTarTo(
+			solveCtx, localDirs, saveImage.State, saveImage.Image, dockerTag, w, false,
+			earthfile2llb.LayerCompression{})
+		return err
+	})
+	return socketID, nil
+}
+
+// MakeDockerLoadBuilderFun returns a fun which can be used to build an image for
+// DOCKER LOAD and WITH DOCKER --load.
+func (b *Builder) MakeDockerLoadBuilderFun() earthfile2llb.DockerBuilderFun {
+	return func(ctx context.Context, mts *earthfile2llb.MultiTargetStates, dockerTag string) (string, error) {
+		return b.BuildOnlyLastImageForDockerLoad(ctx, mts, dockerTag, BuildOpt{})
+	}
+}
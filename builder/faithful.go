@@ -0,0 +1,293 @@
+package builder
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const paxXattrPrefix = "SCHILY.xattr."
+
+// fileMeta is the metadata of a file which is preserved by faithful artifact exports.
+type fileMeta struct {
+	mode    os.FileMode
+	uid     int
+	gid     int
+	modTime time.Time
+	xattrs  map[string]string
+}
+
+// extractTarFaithful extracts the tar stream r into dest, preserving file modes
+// (including setuid, setgid and sticky bits), mtimes, extended attributes and, when
+// running as root, ownership.
+func extractTarFaithful(r io.Reader, dest string) error {
+	tarR := tar.NewReader(r)
+	// Dir metadata is applied at the end, as creating entries within a dir changes
+	// its mtime (and its mode may not allow writing).
+	dirMetas := make(map[string]fileMeta)
+	var dirOrder []string
+	for {
+		header, err := tarR.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read artifacts tar")
+		}
+		target, err := safeJoin(dest, header.Name)
+		if err != nil {
+			return err
+		}
+		meta := fileMeta{
+			mode:    tarHeaderMode(header),
+			uid:     header.Uid,
+			gid:     header.Gid,
+			modTime: header.ModTime,
+			xattrs:  tarHeaderXattrs(header),
+		}
+		err = os.MkdirAll(filepath.Dir(target), 0755)
+		if err != nil {
+			return errors.Wrapf(err, "mkdir all %s", filepath.Dir(target))
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.Mkdir(target, 0755)
+			if err != nil && !os.IsExist(err) {
+				return errors.Wrapf(err, "mkdir %s", target)
+			}
+			if _, found := dirMetas[target]; !found {
+				dirOrder = append(dirOrder, target)
+			}
+			dirMetas[target] = meta
+			continue
+		case tar.TypeReg, tar.TypeRegA:
+			err = writeFileFrom(target, tarR)
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			err = os.Symlink(header.Linkname, target)
+			if err != nil {
+				return errors.Wrapf(err, "symlink %s -> %s", target, header.Linkname)
+			}
+		case tar.TypeLink:
+			linkTarget, err := safeJoin(dest, header.Linkname)
+			if err != nil {
+				return err
+			}
+			err = os.Link(linkTarget, target)
+			if err != nil {
+				return errors.Wrapf(err, "hard link %s -> %s", target, linkTarget)
+			}
+			// Hard links share the metadata of the link target.
+			continue
+		default:
+			// Device files, fifos etc are not exported.
+			continue
+		}
+		err = applyFileMeta(target, meta, header.Typeflag == tar.TypeSymlink)
+		if err != nil {
+			return err
+		}
+	}
+	// Apply in reverse order, such that parents are done last.
+	for i := len(dirOrder) - 1; i >= 0; i-- {
+		err := applyFileMeta(dirOrder[i], dirMetas[dirOrder[i]], false)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFaithful recursively copies from to to, preserving the same metadata as
+// extractTarFaithful.
+func copyFaithful(from string, to string) error {
+	fi, err := os.Lstat(from)
+	if err != nil {
+		return errors.Wrapf(err, "lstat %s", from)
+	}
+	meta, err := fileMetaFromInfo(from, fi)
+	if err != nil {
+		return err
+	}
+	switch {
+	case fi.IsDir():
+		err = os.MkdirAll(to, 0755)
+		if err != nil {
+			return errors.Wrapf(err, "mkdir all %s", to)
+		}
+		f, err := os.Open(from)
+		if err != nil {
+			return errors.Wrapf(err, "open dir %s", from)
+		}
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			return errors.Wrapf(err, "read dir %s", from)
+		}
+		for _, name := range names {
+			err = copyFaithful(filepath.Join(from, name), filepath.Join(to, name))
+			if err != nil {
+				return err
+			}
+		}
+		return applyFileMeta(to, meta, false)
+	case fi.Mode()&os.ModeSymlink != 0:
+		linkname, err := os.Readlink(from)
+		if err != nil {
+			return errors.Wrapf(err, "read link %s", from)
+		}
+		err = os.Symlink(linkname, to)
+		if err != nil {
+			return errors.Wrapf(err, "symlink %s -> %s", to, linkname)
+		}
+		return applyFileMeta(to, meta, true)
+	case fi.Mode().IsRegular():
+		f, err := os.Open(from)
+		if err != nil {
+			return errors.Wrapf(err, "open %s", from)
+		}
+		defer f.Close()
+		err = writeFileFrom(to, f)
+		if err != nil {
+			return err
+		}
+		return applyFileMeta(to, meta, false)
+	default:
+		return nil
+	}
+}
+
+func fileMetaFromInfo(p string, fi os.FileInfo) (fileMeta, error) {
+	meta := fileMeta{
+		mode:    fi.Mode(),
+		uid:     -1,
+		gid:     -1,
+		modTime: fi.ModTime(),
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		meta.uid = int(st.Uid)
+		meta.gid = int(st.Gid)
+	}
+	xattrs, err := listXattrs(p)
+	if err != nil {
+		return fileMeta{}, err
+	}
+	meta.xattrs = xattrs
+	return meta, nil
+}
+
+func writeFileFrom(target string, r io.Reader) error {
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "create %s", target)
+	}
+	defer f.Close()
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return errors.Wrapf(err, "write %s", target)
+	}
+	return nil
+}
+
+func applyFileMeta(target string, meta fileMeta, isSymlink bool) error {
+	if os.Geteuid() == 0 && meta.uid >= 0 && meta.gid >= 0 {
+		err := os.Lchown(target, meta.uid, meta.gid)
+		if err != nil {
+			return errors.Wrapf(err, "chown %s", target)
+		}
+	}
+	if isSymlink {
+		// Symlink modes, mtimes and xattrs are not meaningful on most platforms.
+		return nil
+	}
+	for key, value := range meta.xattrs {
+		err := setXattr(target, key, value)
+		if err != nil {
+			return errors.Wrapf(err, "set xattr %s on %s", key, target)
+		}
+	}
+	// Chmod is done after chown, as chown clears the setuid and setgid bits.
+	err := os.Chmod(target, meta.mode)
+	if err != nil {
+		return errors.Wrapf(err, "chmod %s", target)
+	}
+	err = os.Chtimes(target, meta.modTime, meta.modTime)
+	if err != nil {
+		return errors.Wrapf(err, "chtimes %s", target)
+	}
+	return nil
+}
+
+func tarHeaderMode(header *tar.Header) os.FileMode {
+	mode := os.FileMode(header.Mode).Perm()
+	if header.Mode&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if header.Mode&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if header.Mode&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+func tarHeaderXattrs(header *tar.Header) map[string]string {
+	xattrs := make(map[string]string)
+	for key, value := range header.PAXRecords {
+		if strings.HasPrefix(key, paxXattrPrefix) {
+			xattrs[strings.TrimPrefix(key, paxXattrPrefix)] = value
+		}
+	}
+	return xattrs
+}
+
+// safeJoin joins name to dir, making sure that the result does not escape dir.
+func safeJoin(dir string, name string) (string, error) {
+	joined := filepath.Join(dir, filepath.FromSlash(name))
+	rel, err := filepath.Rel(dir, joined)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("artifacts tar entry %s escapes output dir", name)
+	}
+	return joined, nil
+}
+
+func copySymlink(from string, to string) error {
+	linkname, err := os.Readlink(from)
+	if err != nil {
+		return errors.Wrapf(err, "read link %s", from)
+	}
+	err = os.Symlink(linkname, to)
+	if err != nil {
+		return errors.Wrapf(err, "symlink %s -> %s", to, linkname)
+	}
+	return nil
+}
+
+// checkDanglingSymlinks returns an error if p is, or contains, a symlink which does
+// not resolve.
+func checkDanglingSymlinks(p string) error {
+	return filepath.Walk(p, func(walkPath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		_, err = os.Stat(walkPath)
+		if err != nil {
+			linkname, _ := os.Readlink(walkPath)
+			return fmt.Errorf("artifact contains dangling symlink %s -> %s", walkPath, linkname)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,131 @@
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExtractTarFaithful(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	headers := []*tar.Header{
+		{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0555, ModTime: mtime},
+		{Name: "bin/tool", Typeflag: tar.TypeReg, Mode: 04755, Size: 4, ModTime: mtime},
+		{Name: "bin/link", Typeflag: tar.TypeSymlink, Linkname: "tool", ModTime: mtime},
+	}
+	for _, h := range headers {
+		err := tw.WriteHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Size > 0 {
+			_, err = tw.Write([]byte("tool"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest, err := ioutil.TempDir("", "earth-faithful-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		// The extracted dir is read-only.
+		_ = os.Chmod(filepath.Join(dest, "bin"), 0755)
+		os.RemoveAll(dest)
+	}()
+	err = extractTarFaithful(&buf, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(filepath.Join(dest, "bin", "tool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0755 || fi.Mode()&os.ModeSetuid == 0 {
+		t.Errorf("unexpected mode %v", fi.Mode())
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Errorf("unexpected mtime %v", fi.ModTime())
+	}
+	fi, err = os.Stat(filepath.Join(dest, "bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0555 || !fi.ModTime().Equal(mtime) {
+		t.Errorf("unexpected dir mode %v or mtime %v", fi.Mode(), fi.ModTime())
+	}
+	linkname, err := os.Readlink(filepath.Join(dest, "bin", "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linkname != "tool" {
+		t.Errorf("unexpected link target %s", linkname)
+	}
+}
+
+func TestExtractTarFaithfulEscape(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	err := tw.WriteHeader(&tar.Header{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0644})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest, err := ioutil.TempDir("", "earth-faithful-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	err = extractTarFaithful(&buf, dest)
+	if err == nil {
+		t.Error("expected error for tar entry outside of the output dir")
+	}
+}
+
+func TestCheckDanglingSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "earth-symlink-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "file"), []byte("x"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("file", filepath.Join(dir, "rel"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(filepath.Join(dir, "file"), filepath.Join(dir, "abs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkDanglingSymlinks(dir)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	err = os.Symlink("missing", filepath.Join(dir, "dangling"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkDanglingSymlinks(dir)
+	if err == nil {
+		t.Error("expected error for dangling symlink")
+	}
+}
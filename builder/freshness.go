@@ -0,0 +1,225 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/earthly/earthly/earthfile2llb"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// BaseImageRegistry queries the current state of the repositories of the base images.
+type BaseImageRegistry interface {
+	// ResolveDigest returns the digest the image reference currently points to.
+	ResolveDigest(ctx context.Context, ref string) (digest.Digest, error)
+	// ListTags returns the tags of the repository of the image.
+	ListTags(ctx context.Context, name string) ([]string, error)
+}
+
+// FreshnessReport lists the base images of the targets of a build, and whether newer
+// versions of them are available.
+type FreshnessReport struct {
+	Target  string            `json:"target"`
+	Targets []FreshnessTarget `json:"targets"`
+}
+
+// FreshnessTarget lists the base images of a target.
+type FreshnessTarget struct {
+	Target     string               `json:"target"`
+	BaseImages []BaseImageFreshness `json:"baseImages"`
+}
+
+// BaseImageFreshness is whether a base image, as referenced by FROM, is outdated.
+type BaseImageFreshness struct {
+	Image string `json:"image"`
+	// Digest is the digest the image resolved to when converting the build.
+	Digest string `json:"digest,omitempty"`
+	// LatestDigest is the digest the tag of an image pinned by digest currently points
+	// to, if it differs from the pinned one.
+	LatestDigest string `json:"latestDigest,omitempty"`
+	// NewerTag is the newest version tag of the repository, of the same form as the tag
+	// of the image (e.g. 3.12 for 3.11, or 1.16.0-alpine for 1.15.2-alpine), if newer.
+	NewerTag string `json:"newerTag,omitempty"`
+	// Error is why the freshness of the image could not be checked, if so.
+	Error string `json:"error,omitempty"`
+}
+
+// Outdated returns whether a newer version of the image is available.
+func (bif BaseImageFreshness) Outdated() bool {
+	return bif.LatestDigest != "" || bif.NewerTag != ""
+}
+
+// NumOutdated returns the number of distinct base images which are outdated.
+func (r *FreshnessReport) NumOutdated() int {
+	outdated := make(map[string]bool)
+	for _, ft := range r.Targets {
+		for _, bif := range ft.BaseImages {
+			if bif.Outdated() {
+				outdated[bif.Image] = true
+			}
+		}
+	}
+	return len(outdated)
+}
+
+// CheckBaseImages checks the base images (referenced via FROM) of every target of the
+// build against the current state of their repositories. An image pinned by digest is
+// outdated if its tag (latest if none) now points to another digest. An image whose tag
+// is a version is outdated if the repository has a newer version tag of the same form.
+func CheckBaseImages(ctx context.Context, mts *earthfile2llb.MultiTargetStates, registry BaseImageRegistry) *FreshnessReport {
+	report := &FreshnessReport{Target: mts.FinalStates.Target.StringCanonical()}
+	checked := make(map[string]BaseImageFreshness)
+	for _, sts := range mts.AllStates() {
+		ft := FreshnessTarget{Target: sts.Target.StringCanonical()}
+		for _, m := range sts.Materials {
+			if !strings.HasPrefix(m.URI, "pkg:docker/") {
+				continue
+			}
+			image := strings.TrimPrefix(m.URI, "pkg:docker/")
+			bif, found := checked[image]
+			if !found {
+				bif = checkBaseImage(ctx, image, registry)
+				for alg, hex := range m.Digest {
+					bif.Digest = fmt.Sprintf("%s:%s", alg, hex)
+				}
+				checked[image] = bif
+			}
+			ft.BaseImages = append(ft.BaseImages, bif)
+		}
+		if len(ft.BaseImages) > 0 {
+			report.Targets = append(report.Targets, ft)
+		}
+	}
+	sort.Slice(report.Targets, func(i, j int) bool {
+		return report.Targets[i].Target < report.Targets[j].Target
+	})
+	return report
+}
+
+// checkBaseImage checks whether a newer version of the image is available.
+func checkBaseImage(ctx context.Context, image string, registry BaseImageRegistry) BaseImageFreshness {
+	bif := BaseImageFreshness{Image: image}
+	ref, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		bif.Error = err.Error()
+		return bif
+	}
+	tag := "latest"
+	if tagged, ok := ref.(reference.Tagged); ok {
+		tag = tagged.Tag()
+	}
+	if digested, ok := ref.(reference.Digested); ok {
+		tagRef := fmt.Sprintf("%s:%s", ref.Name(), tag)
+		latest, err := registry.ResolveDigest(ctx, tagRef)
+		if err != nil {
+			bif.Error = err.Error()
+			return bif
+		}
+		if latest != digested.Digest() {
+			bif.LatestDigest = latest.String()
+		}
+	}
+	if _, ok := parseVersionTag(tag); !ok {
+		return bif
+	}
+	tags, err := registry.ListTags(ctx, ref.Name())
+	if err != nil {
+		bif.Error = err.Error()
+		return bif
+	}
+	bif.NewerTag = newestVersionTag(tag, tags)
+	return bif
+}
+
+// versionTagRegexp matches image tags which are versions, such as 3.11, v1.2.3 or
+// 1.15.2-alpine.
+var versionTagRegexp = regexp.MustCompile(`^(v?)([0-9]+(?:\.[0-9]+)*)(.*)$`)
+
+// versionTag is an image tag which is a version.
+type versionTag struct {
+	prefix  string
+	numbers []int
+	suffix  string
+}
+
+// parseVersionTag parses the tag as a version, if it is one.
+func parseVersionTag(tag string) (versionTag, bool) {
+	m := versionTagRegexp.FindStringSubmatch(tag)
+	if m == nil {
+		return versionTag{}, false
+	}
+	vt := versionTag{prefix: m[1], suffix: m[3]}
+	for _, s := range strings.Split(m[2], ".") {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return versionTag{}, false
+		}
+		vt.numbers = append(vt.numbers, n)
+	}
+	return vt, true
+}
+
+// sameForm returns whether the two versions have the same prefix, suffix and number
+// of components, such that they can be compared.
+func (vt versionTag) sameForm(other versionTag) bool {
+	return vt.prefix == other.prefix && vt.suffix == other.suffix && len(vt.numbers) == len(other.numbers)
+}
+
+// less returns whether the version is lower than the other one, of the same form.
+func (vt versionTag) less(other versionTag) bool {
+	for i := range vt.numbers {
+		if vt.numbers[i] != other.numbers[i] {
+			return vt.numbers[i] < other.numbers[i]
+		}
+	}
+	return false
+}
+
+// newestVersionTag returns the newest of the tags which are versions of the same form as
+// tag, if it is newer than tag.
+func newestVersionTag(tag string, tags []string) string {
+	newest, ok := parseVersionTag(tag)
+	if !ok {
+		return ""
+	}
+	newestTag := ""
+	for _, t := range tags {
+		vt, ok := parseVersionTag(t)
+		if !ok || !vt.sameForm(newest) || !newest.less(vt) {
+			continue
+		}
+		newest = vt
+		newestTag = t
+	}
+	return newestTag
+}
+
+// PrintFreshness prints the base images of the targets of the build, and which are
+// outdated.
+func (b *Builder) PrintFreshness(r *FreshnessReport) {
+	for _, ft := range r.Targets {
+		targetConsole := b.console.WithPrefix(ft.Target)
+		for _, bif := range ft.BaseImages {
+			switch {
+			case bif.Error != "":
+				targetConsole.Warnf("Could not check base image %s: %s\n", bif.Image, bif.Error)
+			case bif.LatestDigest != "" && bif.NewerTag != "":
+				targetConsole.Printf(
+					"Base image %s is outdated: its tag now points to %s, and %s is available\n",
+					bif.Image, bif.LatestDigest, bif.NewerTag)
+			case bif.LatestDigest != "":
+				targetConsole.Printf("Base image %s is outdated: its tag now points to %s\n", bif.Image, bif.LatestDigest)
+			case bif.NewerTag != "":
+				targetConsole.Printf("Base image %s is outdated: %s is available\n", bif.Image, bif.NewerTag)
+			default:
+				targetConsole.Printf("Base image %s is up to date\n", bif.Image)
+			}
+		}
+	}
+	b.console.Printf("%d base images outdated\n", r.NumOutdated())
+}
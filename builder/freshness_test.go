@@ -0,0 +1,103 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/earthfile2llb"
+	digest "github.com/opencontainers/go-digest"
+)
+
+type fakeRegistry struct {
+	digests map[string]digest.Digest
+	tags    map[string][]string
+}
+
+func (fr *fakeRegistry) ResolveDigest(ctx context.Context, ref string) (digest.Digest, error) {
+	dgst, found := fr.digests[ref]
+	if !found {
+		return "", fmt.Errorf("%s not found", ref)
+	}
+	return dgst, nil
+}
+
+func (fr *fakeRegistry) ListTags(ctx context.Context, name string) ([]string, error) {
+	return fr.tags[name], nil
+}
+
+func TestNewestVersionTag(t *testing.T) {
+	tags := []string{"latest", "3.10", "3.11", "3.12", "3.12.1", "3.13-rc1", "edge", "v3.14", "1.15.2-alpine", "1.16.0-alpine", "1.16.0"}
+	tests := []struct {
+		tag      string
+		expected string
+	}{
+		{"3.11", "3.12"},
+		{"3.12", ""},
+		{"3.12.0", "3.12.1"},
+		{"1.15.2-alpine", "1.16.0-alpine"},
+		{"v3.13", "v3.14"},
+		{"latest", ""},
+		{"edge", ""},
+	}
+	for _, test := range tests {
+		actual := newestVersionTag(test.tag, tags)
+		if actual != test.expected {
+			t.Errorf("newestVersionTag(%s): expected %q, got %q", test.tag, test.expected, actual)
+		}
+	}
+}
+
+func TestCheckBaseImages(t *testing.T) {
+	pinned := digest.FromString("pinned")
+	current := digest.FromString("current")
+	registry := &fakeRegistry{
+		digests: map[string]digest.Digest{
+			"docker.io/library/alpine:3.11":   current,
+			"docker.io/library/golang:latest": pinned,
+		},
+		tags: map[string][]string{
+			"docker.io/library/alpine": {"3.10", "3.11", "3.12"},
+		},
+	}
+	material := func(image string) earthfile2llb.Material {
+		return earthfile2llb.Material{URI: "pkg:docker/" + image}
+	}
+	build := &earthfile2llb.SingleTargetStates{
+		Target: domain.Target{LocalPath: ".", Target: "build"},
+		Materials: []earthfile2llb.Material{
+			{URI: "git+https://github.com/foo/bar"},
+			material("docker.io/library/alpine:3.11@" + pinned.String()),
+		},
+	}
+	dep := &earthfile2llb.SingleTargetStates{
+		Target: domain.Target{LocalPath: ".", Target: "dep"},
+		Materials: []earthfile2llb.Material{
+			material("docker.io/library/golang@" + pinned.String()),
+			material("docker.io/library/busybox:latest"),
+		},
+	}
+	mts := &earthfile2llb.MultiTargetStates{
+		FinalStates: build,
+		VisitedStates: map[string][]*earthfile2llb.SingleTargetStates{
+			"+build": {build},
+			"+dep":   {dep},
+		},
+	}
+	report := CheckBaseImages(context.Background(), mts, registry)
+	if len(report.Targets) != 2 || report.Targets[0].Target != "+build" || report.Targets[1].Target != "+dep" {
+		t.Fatalf("unexpected targets %v", report.Targets)
+	}
+	buildImages := report.Targets[0].BaseImages
+	if len(buildImages) != 1 || buildImages[0].LatestDigest != current.String() || buildImages[0].NewerTag != "3.12" {
+		t.Errorf("unexpected base images of +build %v", buildImages)
+	}
+	depImages := report.Targets[1].BaseImages
+	if len(depImages) != 2 || depImages[0].Outdated() || depImages[1].Outdated() || depImages[0].Error != "" {
+		t.Errorf("unexpected base images of +dep %v", depImages)
+	}
+	if report.NumOutdated() != 1 {
+		t.Errorf("expected 1 outdated base image, got %d", report.NumOutdated())
+	}
+}
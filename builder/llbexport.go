@@ -0,0 +1,90 @@
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/earthly/earthly/llbutil"
+	"github.com/golang/protobuf/proto"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// LLBFormat is the format in which the LLB definition of a target is exported.
+type LLBFormat string
+
+const (
+	// LLBFormatPB is the protobuf encoding of the definition, as accepted by
+	// buildctl build.
+	LLBFormatPB LLBFormat = "pb"
+	// LLBFormatJSON is a JSON array of the ops of the definition, decoded, in the
+	// same form as the output of buildctl debug dump-llb.
+	LLBFormatJSON LLBFormat = "json"
+)
+
+// ParseLLBFormat parses the name of an LLB export format.
+func ParseLLBFormat(name string) (LLBFormat, error) {
+	switch LLBFormat(name) {
+	case LLBFormatPB, LLBFormatJSON:
+		return LLBFormat(name), nil
+	default:
+		return "", fmt.Errorf("invalid LLB format %s. Supported formats: pb, json", name)
+	}
+}
+
+// llbOp is an op of an exported definition, in JSON form.
+type llbOp struct {
+	Op         pb.Op
+	Digest     digest.Digest
+	OpMetadata pb.OpMetadata
+}
+
+// ExportLLB writes the LLB definition of the target states to w, in the given format.
+// The definition is that of the side effects of the target, which include those of
+// the targets it depends on. The session of local sources (eg the build context) is
+// removed, such that the definition is stable across invocations and can be solved
+// by other clients. The local sources are referenced by the keys of LocalDirs.
+func ExportLLB(ctx context.Context, states *earthfile2llb.SingleTargetStates, format LLBFormat, w io.Writer) error {
+	def, err := states.SideEffectsState.Marshal(ctx, llb.Platform(llbutil.TargetPlatform))
+	if err != nil {
+		return errors.Wrap(err, "state marshal")
+	}
+	def, _, _, err = normalizeDefinition(def)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case LLBFormatPB:
+		err = llb.WriteTo(def, w)
+		if err != nil {
+			return errors.Wrap(err, "write llb definition")
+		}
+	case LLBFormatJSON:
+		ops := make([]llbOp, 0, len(def.Def))
+		for _, dt := range def.Def {
+			var op pb.Op
+			err = proto.Unmarshal(dt, &op)
+			if err != nil {
+				return errors.Wrap(err, "proto unmarshal of op")
+			}
+			dgst := digest.FromBytes(dt)
+			ops = append(ops, llbOp{Op: op, Digest: dgst, OpMetadata: def.Metadata[dgst]})
+		}
+		dt, err := json.MarshalIndent(ops, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "json marshal of ops")
+		}
+		_, err = w.Write(append(dt, '\n'))
+		if err != nil {
+			return errors.Wrap(err, "write llb definition")
+		}
+	default:
+		return fmt.Errorf("invalid LLB format %s", format)
+	}
+	return nil
+}
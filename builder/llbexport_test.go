@@ -0,0 +1,42 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/moby/buildkit/client/llb"
+)
+
+func TestExportLLB(t *testing.T) {
+	ctx := context.Background()
+	export := func(sessionID string, format LLBFormat) []byte {
+		sts := &earthfile2llb.SingleTargetStates{SideEffectsState: planTestState(sessionID, "make")}
+		var buf bytes.Buffer
+		err := ExportLLB(ctx, sts, format, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	// The export does not depend on the session.
+	json1 := export("session1", LLBFormatJSON)
+	json2 := export("session2", LLBFormatJSON)
+	if !bytes.Equal(json1, json2) {
+		t.Errorf("JSON export differs between sessions:\n%s\n%s", json1, json2)
+	}
+	if bytes.Contains(json1, []byte("session1")) {
+		t.Errorf("JSON export contains the local session:\n%s", json1)
+	}
+
+	def, err := llb.ReadFrom(bytes.NewReader(export("session1", LLBFormatPB)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Image, RUN, local, COPY, RUN and the terminal op.
+	if len(def.Def) != 6 {
+		t.Errorf("expected 6 ops, got %d", len(def.Def))
+	}
+}
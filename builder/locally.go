@@ -0,0 +1,112 @@
+package builder
+
+import (
+	"context"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/earthly/earthly/conslogging"
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/earthly/earthly/errcode"
+	"github.com/pkg/errors"
+)
+
+// localSteps is the execution of the LOCALLY commands of a target, which happens once
+// per build.
+type localSteps struct {
+	once sync.Once
+	err  error
+}
+
+// runLocalSteps executes the commands of the targets declared LOCALLY among the states
+// of mts on the host. The commands of a target are executed after those of the targets
+// it depends on, and once per build. They need to be executed before the states of mts
+// are solved, as the states may read the files they output from the build contexts.
+func (b *Builder) runLocalSteps(ctx context.Context, mts *earthfile2llb.MultiTargetStates) error {
+	allStates := planOrder(mts)
+	// Dependencies first.
+	for i := len(allStates) - 1; i >= 0; i-- {
+		states := allStates[i]
+		if len(states.LocalSteps) == 0 {
+			continue
+		}
+		b.localStepsMu.Lock()
+		ls, found := b.localSteps[states]
+		if !found {
+			ls = &localSteps{}
+			b.localSteps[states] = ls
+		}
+		b.localStepsMu.Unlock()
+		ls.once.Do(func() {
+			ls.err = b.runTargetLocalSteps(ctx, states)
+		})
+		if ls.err != nil {
+			return ls.err
+		}
+	}
+	return nil
+}
+
+func (b *Builder) runTargetLocalSteps(ctx context.Context, states *earthfile2llb.SingleTargetStates) error {
+	console := b.console.WithPrefixAndSalt(states.Target.String(), states.Salt)
+	for _, step := range states.LocalSteps {
+		started := time.Now()
+		console.PrintEvent(conslogging.Event{
+			Type:    conslogging.VertexStartedEvent,
+			Command: step.CommandStr,
+			Started: &started,
+		})
+		if !console.JSONOutput() {
+			console.Printf("--> %s\n", step.CommandStr)
+		}
+		var err error
+		if step.IsCopy() {
+			err = b.BuildOnlyArtifact(ctx, step.ArtifactStates, step.Artifact, step.Dest, BuildOpt{})
+		} else {
+			err = b.localRunner.Run(ctx, step.Dir, step.Args, step.WithShell, step.Env, consoleWriter{console})
+		}
+		completed := time.Now()
+		if err != nil {
+			ev := conslogging.Event{
+				Type:      conslogging.VertexFailedEvent,
+				Command:   step.CommandStr,
+				Started:   &started,
+				Completed: &completed,
+				Failed:    true,
+				Error:     err.Error(),
+			}
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				exitCode := exitErr.ExitCode()
+				ev.ExitCode = &exitCode
+			}
+			console.PrintEvent(ev)
+			if !console.JSONOutput() {
+				console.Warnf("ERROR: (%s) %s\n", step.CommandStr, err.Error())
+			}
+			if step.IsCopy() {
+				return err
+			}
+			return errcode.Wrap(err, errcode.ExecFailure)
+		}
+		console.PrintEvent(conslogging.Event{
+			Type:      conslogging.VertexCompletedEvent,
+			Command:   step.CommandStr,
+			Started:   &started,
+			Completed: &completed,
+		})
+	}
+	return nil
+}
+
+// consoleWriter writes the output of the commands executed on the host to the console
+// of their target.
+type consoleWriter struct {
+	console conslogging.ConsoleLogger
+}
+
+func (cw consoleWriter) Write(p []byte) (int, error) {
+	cw.console.PrintBytes(p)
+	return len(p), nil
+}
@@ -0,0 +1,88 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/earthly/earthly/conslogging"
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/earthly/earthly/localrun"
+)
+
+func TestRunLocalSteps(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the commands are executed via sh")
+	}
+	dir, err := ioutil.TempDir("", "earthly-locally")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	step := func(cmd string) earthfile2llb.LocalStep {
+		return earthfile2llb.LocalStep{
+			CommandStr: "LOCALLY RUN " + cmd,
+			Dir:        dir,
+			Args:       []string{cmd},
+			WithShell:  true,
+		}
+	}
+	generate := &earthfile2llb.SingleTargetStates{
+		Target:     domain.Target{LocalPath: ".", Target: "generate"},
+		LocalSteps: []earthfile2llb.LocalStep{step("echo generate >> log.txt")},
+	}
+	release := &earthfile2llb.SingleTargetStates{
+		Target:     domain.Target{LocalPath: ".", Target: "release"},
+		Deps:       []*earthfile2llb.SingleTargetStates{generate},
+		LocalSteps: []earthfile2llb.LocalStep{step("echo release >> log.txt"), step("echo out")},
+	}
+	mts := &earthfile2llb.MultiTargetStates{FinalStates: release}
+	var buf bytes.Buffer
+	b := &Builder{
+		console:     conslogging.Current(conslogging.NoColor).WithWriter(&buf),
+		localRunner: localrun.NewRunner(runtime.GOOS),
+		localSteps:  make(map[*earthfile2llb.SingleTargetStates]*localSteps),
+	}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		err = b.runLocalSteps(ctx, mts)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	dt, err := ioutil.ReadFile(filepath.Join(dir, "log.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dt) != "generate\nrelease\n" {
+		t.Errorf("expected the dependencies to be executed first, once, got %q", string(dt))
+	}
+	if !strings.Contains(buf.String(), "+release | out") {
+		t.Errorf("expected the output within the console of the target, got %q", buf.String())
+	}
+
+	failing := &earthfile2llb.SingleTargetStates{
+		Target:     domain.Target{LocalPath: ".", Target: "fail"},
+		LocalSteps: []earthfile2llb.LocalStep{step("exit 3"), step("echo never >> log.txt")},
+	}
+	err = b.runLocalSteps(ctx, &earthfile2llb.MultiTargetStates{FinalStates: failing})
+	if err == nil {
+		t.Fatal("expected the failure of the command to fail the build")
+	}
+	if !strings.Contains(buf.String(), "ERROR: (LOCALLY RUN exit 3)") {
+		t.Errorf("expected the failure to be reported, got %q", buf.String())
+	}
+	dt, err = ioutil.ReadFile(filepath.Join(dir, "log.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(dt), "never") {
+		t.Error("expected the commands after the failure not to be executed")
+	}
+}
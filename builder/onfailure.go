@@ -0,0 +1,121 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/earthly/earthly/llbutil"
+	"github.com/earthly/earthly/logging"
+	"github.com/golang/protobuf/proto"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// saveOnFailure outputs the SAVE ARTIFACT --on-failure artifacts of the target whose
+// RUN command caused the build to fail. The artifacts are taken from the state left
+// by the failed command, which is run again, without failing.
+func (b *Builder) saveOnFailure(ctx context.Context, localDirs map[string]string, mts *earthfile2llb.MultiTargetStates, opt BuildOpt) error {
+	failure := b.s.sm.failureSummary()
+	if failure == nil || failure.digest == "" {
+		return nil
+	}
+	for _, states := range mts.AllStates() {
+		if len(states.OnFailureSaves) == 0 {
+			continue
+		}
+		stepIndex, err := failedStep(ctx, states.RunSteps, failure.digest)
+		if err != nil {
+			return err
+		}
+		if stepIndex == -1 {
+			continue
+		}
+		console := b.console.WithPrefixAndSalt(states.Target.String(), states.Salt)
+		console.Printf("Saving the SAVE ARTIFACT --on-failure artifacts\n")
+		err = b.buildOnFailureArtifacts(ctx, localDirs, states, stepIndex, opt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Builder) buildOnFailureArtifacts(ctx context.Context, localDirs map[string]string, states *earthfile2llb.SingleTargetStates, stepIndex int, opt BuildOpt) error {
+	outDir, err := ioutil.TempDir(".", ".tmp-earth-out")
+	if err != nil {
+		return errors.Wrap(err, "mk temp dir for artifacts")
+	}
+	defer os.RemoveAll(outDir)
+	for i, ofs := range states.OnFailureSaves {
+		solveCtx := logging.With(ctx, "target", states.Target.String())
+		solveCtx = logging.With(solveCtx, "solve", "on-failure-artifacts")
+		solveCtx = logging.With(solveCtx, "index", i)
+		// Artifacts saved after the failed command are saved as they were before it.
+		artifactsState := ofs.State
+		if stepIndex < len(ofs.FailedStepStates) {
+			artifactsState = ofs.FailedStepStates[stepIndex]
+		}
+		indexOutDir := filepath.Join(outDir, fmt.Sprintf("index-%d", i))
+		err = os.Mkdir(indexOutDir, 0755)
+		if err != nil {
+			return errors.Wrap(err, "mk index dir")
+		}
+		err = b.solverFor(states).solveArtifacts(solveCtx, localDirs, artifactsState, indexOutDir)
+		if err != nil {
+			return errors.Wrap(err, "solve on-failure artifacts")
+		}
+		artifact := domain.Artifact{
+			Target:   states.Target,
+			Artifact: ofs.ArtifactPath,
+		}
+		_, err = b.saveArtifactLocally(ctx, artifact, indexOutDir, ofs.DestPath, states.Salt, opt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// failedStep returns the index of the RUN step whose command is the vertex with the
+// given digest, or -1 if none is.
+func failedStep(ctx context.Context, steps []earthfile2llb.RunStep, vertexDigest digest.Digest) (int, error) {
+	for i, step := range steps {
+		dgst, err := outputVertexDigest(ctx, step.State)
+		if err != nil {
+			return -1, err
+		}
+		if dgst == vertexDigest {
+			return i, nil
+		}
+	}
+	return -1, nil
+}
+
+// outputVertexDigest returns the digest of the vertex which outputs the state, as
+// reported by the solve status.
+func outputVertexDigest(ctx context.Context, state llb.State) (digest.Digest, error) {
+	def, err := state.Marshal(ctx, llb.Platform(llbutil.TargetPlatform))
+	if err != nil {
+		return "", errors.Wrap(err, "marshal state")
+	}
+	if len(def.Def) == 0 {
+		return "", nil
+	}
+	// The terminal op references the output of the state.
+	var terminal pb.Op
+	err = proto.Unmarshal(def.Def[len(def.Def)-1], &terminal)
+	if err != nil {
+		return "", errors.Wrap(err, "proto unmarshal of op")
+	}
+	if len(terminal.Inputs) == 0 {
+		return "", nil
+	}
+	return terminal.Inputs[0].Digest, nil
+}
@@ -0,0 +1,60 @@
+package builder
+
+import (
+	"context"
+	"testing"
+
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/earthly/earthly/llbutil"
+	"github.com/golang/protobuf/proto"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestFailedStep(t *testing.T) {
+	ctx := context.Background()
+	base := llb.Image("alpine:3.11")
+	var steps []earthfile2llb.RunStep
+	state := base
+	for _, cmd := range []string{"make", "make test", "make lint"} {
+		state = state.Run(llb.Args([]string{"/bin/sh", "-c", cmd})).Root()
+		steps = append(steps, earthfile2llb.RunStep{State: state})
+	}
+
+	// Find the digest of the exec of make test, as the solve status reports it.
+	def, err := steps[1].State.Marshal(ctx, llb.Platform(llbutil.TargetPlatform))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var execDigest digest.Digest
+	for _, dt := range def.Def {
+		var op pb.Op
+		err = proto.Unmarshal(dt, &op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exec := op.GetExec()
+		if exec != nil && exec.Meta.Args[2] == "make test" {
+			execDigest = digest.FromBytes(dt)
+		}
+	}
+	if execDigest == "" {
+		t.Fatal("exec of make test not found")
+	}
+
+	index, err := failedStep(ctx, steps, execDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != 1 {
+		t.Errorf("expected step 1, got %d", index)
+	}
+	index, err = failedStep(ctx, steps, digest.FromString("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != -1 {
+		t.Errorf("expected no step, got %d", index)
+	}
+}
@@ -0,0 +1,98 @@
+package builder
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/earthly/earthly/earthfile2llb"
+)
+
+// Outcomes of the targets matched by target patterns, as per the combined summary.
+const (
+	patternMatchSucceeded = "ok"
+	patternMatchFailed    = "FAILED"
+	patternMatchCanceled  = "canceled"
+)
+
+// printPatternSummaries prints the combined summary of the targets matched by each
+// target pattern of the build (given on the command line or via BUILD), with the
+// outcome of each.
+func (b *Builder) printPatternSummaries(mts *earthfile2llb.MultiTargetStates, buildErr error) {
+	var patternStates []*earthfile2llb.SingleTargetStates
+	for _, sts := range mts.AllStates() {
+		if len(sts.PatternMatches) > 0 {
+			patternStates = append(patternStates, sts)
+		}
+	}
+	sort.Slice(patternStates, func(i, j int) bool {
+		return patternStates[i].Target.String() < patternStates[j].Target.String()
+	})
+	for _, sts := range patternStates {
+		outcomes := make([]string, 0, len(sts.PatternMatches))
+		for _, match := range sts.PatternMatches {
+			outcome := patternMatchSucceeded
+			if buildErr != nil {
+				outcome = b.s.sm.patternMatchOutcome(match)
+			}
+			outcomes = append(outcomes, outcome)
+		}
+		b.console.Printf("%s", formatPatternSummary(sts, outcomes))
+	}
+}
+
+// formatPatternSummary returns the combined summary of the targets matched by the
+// target patterns of sts, given their outcomes.
+func formatPatternSummary(sts *earthfile2llb.SingleTargetStates, outcomes []string) string {
+	counts := make(map[string]int)
+	var lines []string
+	for i, match := range sts.PatternMatches {
+		counts[outcomes[i]]++
+		lines = append(lines, fmt.Sprintf("  %-8s %s", outcomes[i], match.Target.String()))
+	}
+	header := fmt.Sprintf("Targets matched by the target patterns of %s", sts.Target.String())
+	if sts.Target.IsPattern() {
+		header = fmt.Sprintf("Targets matched by %s", sts.Target.String())
+	}
+	return fmt.Sprintf(
+		"%s: %d succeeded, %d failed, %d canceled\n%s\n",
+		header, counts[patternMatchSucceeded], counts[patternMatchFailed], counts[patternMatchCanceled],
+		strings.Join(lines, "\n"))
+}
+
+// patternMatchOutcome returns the outcome of the build of a target matched by a target
+// pattern, including the targets it depends on, in a build which failed.
+func (sm *solverMonitor) patternMatchOutcome(match *earthfile2llb.SingleTargetStates) string {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	failed := false
+	completed := true
+	visited := make(map[*earthfile2llb.SingleTargetStates]bool)
+	var visit func(sts *earthfile2llb.SingleTargetStates)
+	visit = func(sts *earthfile2llb.SingleTargetStates) {
+		if visited[sts] {
+			return
+		}
+		visited[sts] = true
+		tm, found := sm.targets[sts.Target.String()+" "+sts.Salt]
+		if found {
+			failed = failed || tm.isError
+			completed = completed && tm.completed
+		} else if sts == match {
+			// Not started.
+			completed = false
+		}
+		for _, dep := range sts.Deps {
+			visit(dep)
+		}
+	}
+	visit(match)
+	switch {
+	case failed:
+		return patternMatchFailed
+	case completed:
+		return patternMatchSucceeded
+	default:
+		return patternMatchCanceled
+	}
+}
@@ -0,0 +1,53 @@
+package builder
+
+import (
+	"testing"
+
+	"github.com/earthly/earthly/conslogging"
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/earthfile2llb"
+)
+
+func TestPatternMatchOutcome(t *testing.T) {
+	sm := newSolverMonitor(conslogging.Current(conslogging.NoColor))
+	dep := &earthfile2llb.SingleTargetStates{Target: domain.Target{LocalPath: "./lib", Target: "build"}, Salt: "1"}
+	a := &earthfile2llb.SingleTargetStates{Target: domain.Target{LocalPath: "./a", Target: "test"}, Salt: "2"}
+	b := &earthfile2llb.SingleTargetStates{
+		Target: domain.Target{LocalPath: "./b", Target: "test"}, Salt: "3",
+		Deps: []*earthfile2llb.SingleTargetStates{dep},
+	}
+	c := &earthfile2llb.SingleTargetStates{Target: domain.Target{LocalPath: "./c", Target: "test"}, Salt: "4"}
+	sm.targets["./lib+build 1"] = &targetMonitor{completed: true, isError: true}
+	sm.targets["./a+test 2"] = &targetMonitor{completed: true}
+	sm.targets["./b+test 3"] = &targetMonitor{completed: true}
+
+	tests := []struct {
+		sts      *earthfile2llb.SingleTargetStates
+		expected string
+	}{
+		{a, patternMatchSucceeded},
+		// Failed via its dependency.
+		{b, patternMatchFailed},
+		// Never started.
+		{c, patternMatchCanceled},
+	}
+	for _, test := range tests {
+		outcome := sm.patternMatchOutcome(test.sts)
+		if outcome != test.expected {
+			t.Errorf("%s: got %s, expected %s", test.sts.Target.String(), outcome, test.expected)
+		}
+	}
+
+	pattern := &earthfile2llb.SingleTargetStates{
+		Target:         domain.Target{LocalPath: "./...", Target: "test"},
+		PatternMatches: []*earthfile2llb.SingleTargetStates{a, b, c},
+	}
+	summary := formatPatternSummary(pattern, []string{patternMatchSucceeded, patternMatchFailed, patternMatchCanceled})
+	expected := "Targets matched by ./...+test: 1 succeeded, 1 failed, 1 canceled\n" +
+		"  ok       ./a+test\n" +
+		"  FAILED   ./b+test\n" +
+		"  canceled ./c+test\n"
+	if summary != expected {
+		t.Errorf("got\n%s\nexpected\n%s", summary, expected)
+	}
+}
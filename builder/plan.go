@@ -0,0 +1,405 @@
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/earthly/earthly/debugger/common"
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/earthly/earthly/llbutil"
+	"github.com/golang/protobuf/proto"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// CacheExpectation is whether a command is expected to be a cache hit.
+type CacheExpectation string
+
+const (
+	// ExpectCached means that the command completed in a previous build, with the same
+	// inputs.
+	ExpectCached CacheExpectation = "cached"
+	// ExpectCachedIfLocalUnchanged means that the command completed in a previous
+	// build, but it depends on local files, which may have changed since.
+	ExpectCachedIfLocalUnchanged CacheExpectation = "cached-if-local-unchanged"
+	// ExpectRun means that the command is expected to be executed.
+	ExpectRun CacheExpectation = "run"
+)
+
+// Plan describes what a build would do, without executing it.
+type Plan struct {
+	Target          string               `json:"target"`
+	BaseImages      []PlanBaseImage      `json:"baseImages"`
+	Targets         []PlanTarget         `json:"targets"`
+	Images          []PlanImage          `json:"images"`
+	Artifacts       []PlanArtifact       `json:"artifacts"`
+	RemoteArtifacts []PlanRemoteArtifact `json:"remoteArtifacts"`
+	PushCommands    []PlanPushCommand    `json:"pushCommands"`
+}
+
+// PlanBaseImage is an image a target is built FROM, with its resolved digest.
+type PlanBaseImage struct {
+	Image  string `json:"image"`
+	Digest string `json:"digest,omitempty"`
+}
+
+// PlanTarget is a target which would be built.
+type PlanTarget struct {
+	Target   string        `json:"target"`
+	Salt     string        `json:"salt"`
+	Commands []PlanCommand `json:"commands"`
+}
+
+// PlanCommand is a command of a target which would be executed, or be a cache hit.
+type PlanCommand struct {
+	Command string           `json:"command"`
+	Cache   CacheExpectation `json:"cache"`
+	// Privileged is set for the commands which would run with all the capabilities,
+	// such as RUN --privileged and WITH DOCKER.
+	Privileged bool `json:"privileged,omitempty"`
+	// Secrets are the IDs of the secrets the command would have access to.
+	Secrets []string `json:"secrets,omitempty"`
+	// Host is set for the commands which would be executed on the host, after LOCALLY.
+	Host bool `json:"host,omitempty"`
+}
+
+// PlanImage is an image which would be output.
+type PlanImage struct {
+	Target string `json:"target"`
+	Image  string `json:"image"`
+	Push   bool   `json:"push"`
+}
+
+// PlanArtifact is an artifact which would be saved locally.
+type PlanArtifact struct {
+	Artifact string `json:"artifact"`
+	DestPath string `json:"destPath"`
+}
+
+// PlanRemoteArtifact is an artifact which would be uploaded to object storage.
+type PlanRemoteArtifact struct {
+	Artifact string `json:"artifact"`
+	DestURL  string `json:"destURL"`
+	Upload   bool   `json:"upload"`
+}
+
+// PlanPushCommand is a RUN --push command, which is only executed when pushing.
+type PlanPushCommand struct {
+	Target  string `json:"target"`
+	Command string `json:"command"`
+	Execute bool   `json:"execute"`
+}
+
+// Plan works out what Build would do for the given multi target states, without
+// executing anything. The cache history at cacheHistoryPath, which is recorded via
+// SaveCacheHistory, is used to predict which commands would be cache hits.
+func (b *Builder) Plan(ctx context.Context, mts *earthfile2llb.MultiTargetStates, cacheHistoryPath string, opt BuildOpt) (*Plan, error) {
+	history, err := loadCacheHistory(cacheHistoryPath)
+	if err != nil {
+		return nil, err
+	}
+	plan := &Plan{Target: mts.FinalStates.Target.StringCanonical()}
+	allStates := planOrder(mts)
+
+	// Work out the states which would be solved, as per Build.
+	states := []llb.State{mts.FinalStates.SideEffectsState}
+	if !opt.NoOutput {
+		outputStates, err := outputOrder(mts)
+		if err != nil {
+			return nil, err
+		}
+		for _, sts := range outputStates {
+			states = append(states, planRunPush(plan, sts, sts.RunPush, opt)...)
+			for _, saveImage := range sts.SaveImages {
+				if saveImage.DockerTag == "" {
+					continue
+				}
+				plan.Images = append(plan.Images, PlanImage{
+					Target: sts.Target.StringCanonical(),
+					Image:  saveImage.DockerTag,
+					Push:   opt.Push && saveImage.Push,
+				})
+				states = append(states, saveImage.State)
+			}
+			states = append(states, planRunPush(plan, sts, sts.RunPushAfterImages, opt)...)
+			if sts.Target.IsRemote() {
+				// Artifacts of remote targets are not output.
+				continue
+			}
+			for _, saveLocal := range sts.SaveLocals {
+				artifact := domain.Artifact{Target: sts.Target, Artifact: saveLocal.ArtifactPath}
+				plan.Artifacts = append(plan.Artifacts, PlanArtifact{
+					Artifact: artifact.StringCanonical(),
+					DestPath: saveLocal.DestPath,
+				})
+				states = append(states, sts.SeparateArtifactsState[saveLocal.Index])
+			}
+			for _, saveRemote := range sts.SaveRemotes {
+				artifact := domain.Artifact{Target: sts.Target, Artifact: saveRemote.ArtifactPath}
+				plan.RemoteArtifacts = append(plan.RemoteArtifacts, PlanRemoteArtifact{
+					Artifact: artifact.StringCanonical(),
+					DestURL:  saveRemote.DestURL,
+					Upload:   opt.Push,
+				})
+				if opt.Push {
+					states = append(states, saveRemote.State)
+				}
+			}
+		}
+	}
+
+	// Collect the commands of each target, across all the states.
+	commands := make(map[string][]PlanCommand)
+	seen := make(map[digest.Digest]bool)
+	for _, state := range states {
+		def, err := state.Marshal(ctx, llb.Platform(llbutil.TargetPlatform))
+		if err != nil {
+			return nil, errors.Wrap(err, "state marshal")
+		}
+		normalized, usesLocal, err := normalizeDigests(def)
+		if err != nil {
+			return nil, err
+		}
+		for _, dt := range def.Def {
+			dgst := digest.FromBytes(dt)
+			normalizedDgst := normalized[dgst]
+			if seen[normalizedDgst] {
+				continue
+			}
+			seen[normalizedDgst] = true
+			var op pb.Op
+			err = proto.Unmarshal(dt, &op)
+			if err != nil {
+				return nil, errors.Wrap(err, "proto unmarshal of op")
+			}
+			if op.Op == nil {
+				// The terminal op, which only references the output.
+				continue
+			}
+			targetStr, salt, operation := parseVertexName(def.Metadata[dgst].Description["llb.customname"])
+			if targetStr == "" || targetStr == "internal" || operation == "" {
+				continue
+			}
+			cache := ExpectRun
+			if !b.noCache && history.has(normalizedDgst) {
+				cache = ExpectCached
+				if usesLocal[normalizedDgst] {
+					cache = ExpectCachedIfLocalUnchanged
+				}
+			}
+			cmd := PlanCommand{Command: operation, Cache: cache}
+			if exec := op.GetExec(); exec != nil {
+				planExec(&cmd, exec)
+			}
+			key := targetStr + " " + salt
+			commands[key] = append(commands[key], cmd)
+		}
+	}
+
+	// Report the targets in dependency order. Commands not attributed to a target
+	// (eg the transfer of the build context) are left out.
+	for _, sts := range allStates {
+		key := sts.Target.String() + " " + sts.Salt
+		var targetCommands []PlanCommand
+		for _, step := range sts.LocalSteps {
+			// Executed on every build.
+			targetCommands = append(targetCommands, PlanCommand{Command: step.CommandStr, Cache: ExpectRun, Host: true})
+		}
+		plan.Targets = append(plan.Targets, PlanTarget{
+			Target:   sts.Target.String(),
+			Salt:     sts.Salt,
+			Commands: append(targetCommands, commands[key]...),
+		})
+		for _, m := range sts.Materials {
+			if !strings.HasPrefix(m.URI, "pkg:docker/") {
+				continue
+			}
+			baseImage := PlanBaseImage{Image: strings.TrimPrefix(m.URI, "pkg:docker/")}
+			for alg, hex := range m.Digest {
+				baseImage.Digest = fmt.Sprintf("%s:%s", alg, hex)
+			}
+			plan.addBaseImage(baseImage)
+		}
+	}
+	sort.Slice(plan.BaseImages, func(i, j int) bool {
+		return plan.BaseImages[i].Image < plan.BaseImages[j].Image
+	})
+	return plan, nil
+}
+
+// planExec records the privileges and the secrets the command would run with.
+func planExec(cmd *PlanCommand, exec *pb.ExecOp) {
+	for _, m := range exec.Mounts {
+		if m.MountType != pb.MountType_SECRET || m.SecretOpt == nil {
+			continue
+		}
+		if m.SecretOpt.ID == common.DebuggerSettingsSecretsKey {
+			// Mounted into every RUN, for the interactive debugger.
+			continue
+		}
+		cmd.Secrets = append(cmd.Secrets, m.SecretOpt.ID)
+	}
+	cmd.Privileged = exec.Security == pb.SecurityMode_INSECURE
+}
+
+func (p *Plan) addBaseImage(baseImage PlanBaseImage) {
+	for _, existing := range p.BaseImages {
+		if existing == baseImage {
+			return
+		}
+	}
+	p.BaseImages = append(p.BaseImages, baseImage)
+}
+
+// planOrder returns all the target states, with the final target first, followed by
+// its dependencies, depth first.
+// planRunPush adds the given push commands to the plan and returns the states which
+// would be solved for them.
+func planRunPush(plan *Plan, sts *earthfile2llb.SingleTargetStates, runPush earthfile2llb.RunPush, opt BuildOpt) []llb.State {
+	if !runPush.Initialized {
+		return nil
+	}
+	for _, commandStr := range runPush.CommandStrs {
+		plan.PushCommands = append(plan.PushCommands, PlanPushCommand{
+			Target:  sts.Target.StringCanonical(),
+			Command: commandStr,
+			Execute: opt.Push,
+		})
+	}
+	if !opt.Push {
+		return nil
+	}
+	return []llb.State{runPush.State}
+}
+
+func planOrder(mts *earthfile2llb.MultiTargetStates) []*earthfile2llb.SingleTargetStates {
+	var ret []*earthfile2llb.SingleTargetStates
+	visited := make(map[*earthfile2llb.SingleTargetStates]bool)
+	var visit func(sts *earthfile2llb.SingleTargetStates)
+	visit = func(sts *earthfile2llb.SingleTargetStates) {
+		if visited[sts] {
+			return
+		}
+		visited[sts] = true
+		ret = append(ret, sts)
+		for _, dep := range sts.Deps {
+			visit(dep)
+		}
+	}
+	visit(mts.FinalStates)
+	var rest []*earthfile2llb.SingleTargetStates
+	for _, sts := range mts.AllStates() {
+		if !visited[sts] {
+			rest = append(rest, sts)
+		}
+	}
+	sort.Slice(rest, func(i, j int) bool {
+		ki := rest[i].Target.String() + " " + rest[i].Salt
+		kj := rest[j].Target.String() + " " + rest[j].Salt
+		return ki < kj
+	})
+	for _, sts := range rest {
+		visit(sts)
+	}
+	return ret
+}
+
+// PrintPlan prints the plan to the console, in the style of the build output.
+func (b *Builder) PrintPlan(p *Plan) {
+	console := b.console
+	for _, baseImage := range p.BaseImages {
+		if baseImage.Digest == "" {
+			console.Printf("Base image %s\n", baseImage.Image)
+			continue
+		}
+		console.Printf("Base image %s resolved to %s\n", baseImage.Image, baseImage.Digest)
+	}
+	var total, cached, cachedIfLocal int
+	for _, pt := range p.Targets {
+		targetConsole := console.WithPrefixAndSalt(pt.Target, pt.Salt)
+		for _, cmd := range pt.Commands {
+			total++
+			status := "would run"
+			switch cmd.Cache {
+			case ExpectCached:
+				cached++
+				status = "expected cached"
+			case ExpectCachedIfLocalUnchanged:
+				cachedIfLocal++
+				status = "expected cached, unless local files changed"
+			}
+			if cmd.Privileged {
+				status += ", privileged"
+			}
+			if len(cmd.Secrets) > 0 {
+				status += fmt.Sprintf(", with secrets %s", strings.Join(cmd.Secrets, ", "))
+			}
+			targetConsole.Printf("--> %s (%s)\n", cmd.Command, status)
+		}
+	}
+	for _, pc := range p.PushCommands {
+		if pc.Execute {
+			console.Printf("Would execute push command %s of %s\n", pc.Command, pc.Target)
+		} else {
+			console.Printf("Would not execute push command %s of %s. Use earth --push to enable pushing\n", pc.Command, pc.Target)
+		}
+	}
+	for _, img := range p.Images {
+		pushStr := ""
+		if img.Push {
+			pushStr = " (would be pushed)"
+		}
+		console.Printf("Would output image %s as %s%s\n", img.Target, img.Image, pushStr)
+	}
+	for _, artifact := range p.Artifacts {
+		console.Printf("Would output artifact %s as local %s\n", artifact.Artifact, artifact.DestPath)
+	}
+	for _, ra := range p.RemoteArtifacts {
+		if ra.Upload {
+			console.Printf("Would upload artifact %s to %s\n", ra.Artifact, ra.DestURL)
+		} else {
+			console.Printf("Would not upload artifact %s to %s. Use earth --push to enable pushing\n", ra.Artifact, ra.DestURL)
+		}
+	}
+	console.Printf(
+		"Plan for %s: %d commands, %d expected cache hits, %d expected cache hits unless local files changed, %d would run\n",
+		p.Target, total, cached, cachedIfLocal, total-cached-cachedIfLocal)
+}
+
+// MakePlanDockerLoadBuilderFun returns a fun which stands in for the fun returned by
+// MakeDockerLoadBuilderFun when planning a build. It does not build the image, as
+// the build is not executed, but returns the same socket ID.
+func MakePlanDockerLoadBuilderFun() earthfile2llb.DockerBuilderFun {
+	return func(ctx context.Context, mts *earthfile2llb.MultiTargetStates, dockerTag string) (string, error) {
+		saveImage, ok := mts.FinalStates.LastSaveImage()
+		if !ok {
+			return "", fmt.Errorf("No save image exists for %s", mts.FinalStates.Target.String())
+		}
+		def, err := saveImage.State.Marshal(ctx, llb.Platform(llbutil.TargetPlatform))
+		if err != nil {
+			return "", errors.Wrap(err, "state marshal")
+		}
+		imgJSON, err := json.Marshal(saveImage.Image)
+		if err != nil {
+			return "", errors.Wrap(err, "image json marshal")
+		}
+		return dockerLoadSocketID(dockerTag, def, imgJSON), nil
+	}
+}
+
+// MakePlanArtifactBuilderFun returns a fun which stands in for the fun returned by
+// MakeArtifactBuilderFun when planning a build. The contents of the artifact are
+// needed for the conversion to continue, so it fails.
+func MakePlanArtifactBuilderFun() func(context.Context, *earthfile2llb.MultiTargetStates, domain.Artifact, string) error {
+	return func(ctx context.Context, mts *earthfile2llb.MultiTargetStates, artifact domain.Artifact, outFile string) error {
+		return fmt.Errorf(
+			"cannot plan the build: %s needs to be built for the conversion to continue",
+			artifact.StringCanonical())
+	}
+}
@@ -0,0 +1,212 @@
+package builder
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/earthly/earthly/conslogging"
+	"github.com/earthly/earthly/debugger/common"
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/earthly/earthly/llbutil"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/solver/pb"
+)
+
+func planTestState(sessionID string, cmd string) llb.State {
+	src := llb.Local("context", llb.SessionID(sessionID), llb.WithCustomName("[context .] local context ."))
+	return llb.Image("alpine:3.11", llb.WithCustomName("[+build 1] FROM alpine:3.11")).
+		Run(llb.Args([]string{"/bin/sh", "-c", "echo hello"}), llb.WithCustomName("[+build 1] RUN echo hello")).Root().
+		File(llb.Copy(src, "/src", "/src"), llb.WithCustomName("[+build 1] COPY src /src")).
+		Run(llb.Args([]string{"/bin/sh", "-c", cmd}), llb.WithCustomName("[+build 1] RUN "+cmd)).Root()
+}
+
+func TestNormalizeDigests(t *testing.T) {
+	ctx := context.Background()
+	def1, err := planTestState("session1", "make").Marshal(ctx, llb.Platform(llbutil.TargetPlatform))
+	if err != nil {
+		t.Fatal(err)
+	}
+	def2, err := planTestState("session2", "make").Marshal(ctx, llb.Platform(llbutil.TargetPlatform))
+	if err != nil {
+		t.Fatal(err)
+	}
+	normalized1, usesLocal, err := normalizeDigests(def1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	normalized2, _, err := normalizeDigests(def2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := make(map[string]bool)
+	for _, dgst := range normalized1 {
+		set[dgst.String()] = true
+	}
+	numLocal := 0
+	for _, dgst := range normalized2 {
+		if !set[dgst.String()] {
+			t.Errorf("normalized digest %s differs between sessions", dgst)
+		}
+		if usesLocal[dgst] {
+			numLocal++
+		}
+	}
+	// The local source, the COPY, the RUN after it and the terminal op.
+	if numLocal != 4 {
+		t.Errorf("expected 4 ops using local files, got %d", numLocal)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "earth-plan-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	historyPath := filepath.Join(dir, "cache-history")
+
+	// Record a previous build.
+	def, err := planTestState("session1", "make").Marshal(ctx, llb.Platform(llbutil.TargetPlatform))
+	if err != nil {
+		t.Fatal(err)
+	}
+	normalized, _, err := normalizeDigests(def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := loadCacheHistory(historyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dgst := range normalized {
+		history.add(dgst, time.Now())
+	}
+	err = history.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Plan a build in which the last command changed.
+	target := domain.Target{LocalPath: ".", Target: "build"}
+	sts := &earthfile2llb.SingleTargetStates{
+		Target:           target,
+		Salt:             "1",
+		SideEffectsState: planTestState("session2", "make test"),
+		SaveImages: []earthfile2llb.SaveImage{
+			{State: llb.Scratch(), DockerTag: "test:latest", Push: true},
+		},
+	}
+	mts := &earthfile2llb.MultiTargetStates{
+		FinalStates:   sts,
+		VisitedStates: map[string][]*earthfile2llb.SingleTargetStates{target.String(): {sts}},
+	}
+	b := &Builder{console: conslogging.Current(conslogging.NoColor)}
+	plan, err := b.Plan(ctx, mts, historyPath, BuildOpt{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Targets) != 1 {
+		t.Fatalf("expected 1 target, got %+v", plan.Targets)
+	}
+	expected := []PlanCommand{
+		{Command: "FROM alpine:3.11", Cache: ExpectCached},
+		{Command: "RUN echo hello", Cache: ExpectCached},
+		{Command: "COPY src /src", Cache: ExpectCachedIfLocalUnchanged},
+		{Command: "RUN make test", Cache: ExpectRun},
+	}
+	cmds := plan.Targets[0].Commands
+	if len(cmds) != len(expected) {
+		t.Fatalf("expected %+v, got %+v", expected, cmds)
+	}
+	for i := range expected {
+		if !reflect.DeepEqual(cmds[i], expected[i]) {
+			t.Errorf("command %d: expected %+v, got %+v", i, expected[i], cmds[i])
+		}
+	}
+	if len(plan.Images) != 1 || plan.Images[0].Push {
+		t.Errorf("unexpected images %+v", plan.Images)
+	}
+}
+
+func TestOutputOrder(t *testing.T) {
+	deploy := &earthfile2llb.SingleTargetStates{
+		Target: domain.Target{LocalPath: ".", Target: "deploy"},
+		PushAfter: []domain.Target{
+			{LocalPath: ".", Target: "image"},
+		},
+	}
+	image := &earthfile2llb.SingleTargetStates{
+		Target: domain.Target{LocalPath: ".", Target: "image"},
+	}
+	all := &earthfile2llb.SingleTargetStates{
+		Target: domain.Target{LocalPath: ".", Target: "all"},
+		Deps:   []*earthfile2llb.SingleTargetStates{deploy, image},
+	}
+	mts := &earthfile2llb.MultiTargetStates{
+		FinalStates: all,
+		VisitedStates: map[string][]*earthfile2llb.SingleTargetStates{
+			"+all":    {all},
+			"+deploy": {deploy},
+			"+image":  {image},
+		},
+	}
+	order, err := outputOrder(mts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(order) != 3 || order[0] != all || order[1] != image || order[2] != deploy {
+		t.Errorf("unexpected order %v, %v, %v", order[0].Target, order[1].Target, order[2].Target)
+	}
+
+	image.PushAfter = []domain.Target{{LocalPath: ".", Target: "deploy"}}
+	_, err = outputOrder(mts)
+	if err == nil {
+		t.Error("expected cycle error")
+	}
+
+	image.PushAfter = []domain.Target{{LocalPath: ".", Target: "missing"}}
+	_, err = outputOrder(mts)
+	if err == nil {
+		t.Error("expected missing target error")
+	}
+}
+
+func TestPlanExec(t *testing.T) {
+	tests := []struct {
+		name     string
+		exec     *pb.ExecOp
+		expected PlanCommand
+	}{
+		{
+			"secrets",
+			&pb.ExecOp{
+				Meta: &pb.Meta{},
+				Mounts: []*pb.Mount{
+					{Dest: "/", MountType: pb.MountType_BIND},
+					{Dest: "/run/secrets/token", MountType: pb.MountType_SECRET, SecretOpt: &pb.SecretOpt{ID: "token"}},
+					{Dest: "/run/secrets/debugger", MountType: pb.MountType_SECRET, SecretOpt: &pb.SecretOpt{ID: common.DebuggerSettingsSecretsKey}},
+				},
+			},
+			PlanCommand{Secrets: []string{"token"}},
+		},
+		{
+			"privileged",
+			&pb.ExecOp{Meta: &pb.Meta{}, Security: pb.SecurityMode_INSECURE},
+			PlanCommand{Privileged: true},
+		},
+	}
+	for _, tt := range tests {
+		var cmd PlanCommand
+		planExec(&cmd, tt.exec)
+		if !reflect.DeepEqual(cmd, tt.expected) {
+			t.Errorf("%s: expected %+v, got %+v", tt.name, tt.expected, cmd)
+		}
+	}
+}
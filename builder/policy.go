@@ -0,0 +1,148 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/earthly/earthly/errcode"
+	"github.com/pkg/errors"
+)
+
+// policyQuery is the Rego rule holding the reasons why a build is denied.
+const policyQuery = "data.earthly.deny"
+
+// PolicyInput is what the build policy decides on: the plan of the build and the
+// context it is run in.
+type PolicyInput struct {
+	Plan *Plan `json:"plan"`
+	// Push is whether the build pushes its images and executes its push commands.
+	Push bool `json:"push"`
+	// Git is the git metadata of the local directory of the target. Nil if the target
+	// is remote, or not within a git repository.
+	Git *PolicyGit `json:"git,omitempty"`
+}
+
+// PolicyGit is the git metadata of a build, for the build policy.
+type PolicyGit struct {
+	Branch string   `json:"branch"`
+	Hash   string   `json:"hash"`
+	Tags   []string `json:"tags"`
+}
+
+// Policy decides whether a build may be executed.
+type Policy interface {
+	// Evaluate returns the reasons why the build is denied. None if it is allowed.
+	Evaluate(ctx context.Context, input *PolicyInput) ([]string, error)
+}
+
+// PolicyError is returned by CheckPolicy when the build is denied.
+type PolicyError struct {
+	Violations []string
+}
+
+func (pe *PolicyError) Error() string {
+	return fmt.Sprintf("the build was rejected by the build policy: %s", strings.Join(pe.Violations, "; "))
+}
+
+// ErrorCategory implements errcode.Categorized.
+func (pe *PolicyError) ErrorCategory() errcode.Category {
+	return errcode.PolicyViolation
+}
+
+// CheckPolicy evaluates the policy and returns a PolicyError listing the violations if
+// the build is denied.
+func (b *Builder) CheckPolicy(ctx context.Context, policy Policy, input *PolicyInput) error {
+	violations, err := policy.Evaluate(ctx, input)
+	if err != nil {
+		return errors.Wrap(err, "evaluate build policy")
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	for _, v := range violations {
+		b.console.Warnf("Policy violation: %s\n", v)
+	}
+	return &PolicyError{Violations: violations}
+}
+
+// NewRegoPolicy returns a policy which evaluates the Rego policies at the given paths
+// (files or directories) via the opa CLI, which needs to be installed. The input of the
+// policies is the PolicyInput, as JSON. The build is denied with the messages of the
+// rule deny of the package earthly, if any.
+func NewRegoPolicy(paths []string) Policy {
+	return &regoPolicy{paths: paths}
+}
+
+type regoPolicy struct {
+	paths []string
+}
+
+func (rp *regoPolicy) Evaluate(ctx context.Context, input *PolicyInput) ([]string, error) {
+	dt, err := json.Marshal(input)
+	if err != nil {
+		return nil, errors.Wrap(err, "json marshal policy input")
+	}
+	args := []string{"eval", "--format", "json", "--stdin-input"}
+	for _, p := range rp.paths {
+		args = append(args, "--data", p)
+	}
+	args = append(args, policyQuery)
+	cmd := exec.CommandContext(ctx, "opa", args...)
+	cmd.Stdin = bytes.NewReader(dt)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "opa eval %s", policyQuery)
+	}
+	return parseOPAResult(out)
+}
+
+// parseOPAResult returns the messages of the deny rule, as output by opa eval. The
+// messages are either strings, or objects with a msg field. Other values are
+// reported as JSON.
+func parseOPAResult(out []byte) ([]string, error) {
+	var result struct {
+		Result []struct {
+			Expressions []struct {
+				Value json.RawMessage `json:"value"`
+			} `json:"expressions"`
+		} `json:"result"`
+	}
+	err := json.Unmarshal(out, &result)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse opa result")
+	}
+	var violations []string
+	for _, r := range result.Result {
+		for _, expr := range r.Expressions {
+			var values []json.RawMessage
+			err := json.Unmarshal(expr.Value, &values)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s is not a set or an array", policyQuery)
+			}
+			for _, v := range values {
+				violations = append(violations, violationMessage(v))
+			}
+		}
+	}
+	return violations, nil
+}
+
+func violationMessage(v json.RawMessage) string {
+	var str string
+	if json.Unmarshal(v, &str) == nil {
+		return str
+	}
+	var obj struct {
+		Msg string `json:"msg"`
+	}
+	if json.Unmarshal(v, &obj) == nil && obj.Msg != "" {
+		return obj.Msg
+	}
+	return string(v)
+}
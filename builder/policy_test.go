@@ -0,0 +1,64 @@
+package builder
+
+import (
+	"context"
+	"testing"
+
+	"github.com/earthly/earthly/conslogging"
+	"github.com/earthly/earthly/errcode"
+)
+
+func TestParseOPAResult(t *testing.T) {
+	out := `{"result": [{"expressions": [{
+		"value": ["FROM alpine:latest is not pinned", {"msg": "no pushes from feature/x"}, {"code": 3}],
+		"text": "data.earthly.deny",
+		"location": {"row": 1, "col": 1}
+	}]}]}`
+	violations, err := parseOPAResult([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"FROM alpine:latest is not pinned", "no pushes from feature/x", `{"code": 3}`}
+	if len(violations) != len(expected) {
+		t.Fatalf("expected %q, got %q", expected, violations)
+	}
+	for i := range expected {
+		if violations[i] != expected[i] {
+			t.Errorf("expected %q, got %q", expected[i], violations[i])
+		}
+	}
+	// The rule is undefined if the policy does not define it.
+	violations, err = parseOPAResult([]byte(`{}`))
+	if err != nil || len(violations) != 0 {
+		t.Errorf("expected no violations, got %q %v", violations, err)
+	}
+	_, err = parseOPAResult([]byte(`{"result": [{"expressions": [{"value": true}]}]}`))
+	if err == nil {
+		t.Error("expected an error for a boolean rule")
+	}
+}
+
+type fakePolicy struct {
+	violations []string
+}
+
+func (fp fakePolicy) Evaluate(ctx context.Context, input *PolicyInput) ([]string, error) {
+	return fp.violations, nil
+}
+
+func TestCheckPolicy(t *testing.T) {
+	b := &Builder{console: conslogging.Current(conslogging.NoColor)}
+	input := &PolicyInput{Plan: &Plan{Target: "+build"}}
+	err := b.CheckPolicy(context.Background(), fakePolicy{}, input)
+	if err != nil {
+		t.Errorf("expected the build to be allowed, got %v", err)
+	}
+	err = b.CheckPolicy(context.Background(), fakePolicy{violations: []string{"no latest"}}, input)
+	pe, ok := err.(*PolicyError)
+	if !ok || len(pe.Violations) != 1 {
+		t.Fatalf("expected a policy error, got %v", err)
+	}
+	if errcode.CategoryOf(err) != errcode.PolicyViolation {
+		t.Errorf("expected a policy violation, got %s", errcode.CategoryOf(err))
+	}
+}
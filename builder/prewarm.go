@@ -0,0 +1,82 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/earthly/earthly/llbutil"
+	"github.com/earthly/earthly/logging"
+	"github.com/moby/buildkit/client/llb"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// prewarmSource is a source of a target (image or remote build context) to be pulled
+// into the cache.
+type prewarmSource struct {
+	sts   *earthfile2llb.SingleTargetStates
+	state llb.State
+}
+
+// prewarmSources returns the sources of all the targets, without duplicates. A source
+// referenced by several targets is pulled for only one of them.
+func prewarmSources(ctx context.Context, mts *earthfile2llb.MultiTargetStates) ([]prewarmSource, error) {
+	var sources []prewarmSource
+	seen := make(map[digest.Digest]bool)
+	for _, sts := range mts.AllStates() {
+		for _, state := range sts.SourceStates {
+			def, err := state.Marshal(ctx, llb.Platform(llbutil.TargetPlatform))
+			if err != nil {
+				return nil, errors.Wrapf(err, "marshal source of %s", sts.Target.String())
+			}
+			if len(def.Def) == 0 {
+				continue
+			}
+			dgst := digest.FromBytes(def.Def[len(def.Def)-1])
+			if seen[dgst] {
+				continue
+			}
+			seen[dgst] = true
+			sources = append(sources, prewarmSource{sts: sts, state: state})
+		}
+	}
+	return sources, nil
+}
+
+// Prewarm pulls the images referenced by the targets (via FROM, DOCKER PULL etc) and the
+// build contexts of the remote targets into the cache of the buildkit daemon, without
+// executing any command of the targets. The sources are pulled in parallel. A failed
+// pull does not stop the others.
+func (b *Builder) Prewarm(ctx context.Context, mts *earthfile2llb.MultiTargetStates) error {
+	sources, err := prewarmSources(ctx, mts)
+	if err != nil {
+		return err
+	}
+	errs := make([]error, len(sources))
+	var wg sync.WaitGroup
+	for i, source := range sources {
+		wg.Add(1)
+		go func(i int, source prewarmSource) {
+			defer wg.Done()
+			solveCtx := logging.With(ctx, "target", source.sts.Target.String())
+			solveCtx = logging.With(solveCtx, "solve", "prewarm")
+			errs[i] = b.solverFor(source.sts).solveSideEffects(solveCtx, source.sts.LocalDirs, source.state, nil)
+		}(i, source)
+	}
+	wg.Wait()
+	failed := 0
+	for i, err := range errs {
+		if err != nil {
+			failed++
+			b.console.WithPrefixAndSalt(sources[i].sts.Target.String(), sources[i].sts.Salt).
+				Warnf("Failed to pre-warm the cache: %v\n", err)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d sources could not be pulled", failed, len(sources))
+	}
+	b.console.Printf("Pulled %d sources into the cache\n", len(sources))
+	return nil
+}
@@ -0,0 +1,41 @@
+package builder
+
+import (
+	"context"
+	"testing"
+
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/moby/buildkit/client/llb"
+)
+
+func TestPrewarmSources(t *testing.T) {
+	build := &earthfile2llb.SingleTargetStates{
+		Target: domain.Target{LocalPath: ".", Target: "build"},
+		SourceStates: []llb.State{
+			llb.Image("alpine:3.11"),
+			llb.Git("github.com/foo/bar", "main"),
+		},
+	}
+	dep := &earthfile2llb.SingleTargetStates{
+		Target: domain.Target{LocalPath: ".", Target: "dep"},
+		SourceStates: []llb.State{
+			llb.Image("alpine:3.11"),
+			llb.Image("golang:1.15"),
+		},
+	}
+	mts := &earthfile2llb.MultiTargetStates{
+		FinalStates: build,
+		VisitedStates: map[string][]*earthfile2llb.SingleTargetStates{
+			"+build": {build},
+			"+dep":   {dep},
+		},
+	}
+	sources, err := prewarmSources(context.Background(), mts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 3 {
+		t.Errorf("expected 3 distinct sources, got %d", len(sources))
+	}
+}
@@ -0,0 +1,271 @@
+package builder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/pkg/errors"
+)
+
+const (
+	inTotoStatementType     = "https://in-toto.io/Statement/v0.1"
+	slsaProvenanceType      = "https://slsa.dev/provenance/v0.1"
+	earthlyBuilderID        = "https://github.com/earthly/earthly"
+	earthfileRecipeType     = "https://github.com/earthly/earthly/Earthfile@v1"
+	provenanceFileExtension = "provenance.json"
+)
+
+type inTotoStatement struct {
+	Type          string          `json:"_type"`
+	Subject       []inTotoSubject `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     slsaProvenance  `json:"predicate"`
+}
+
+type inTotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type slsaProvenance struct {
+	Builder   slsaBuilder              `json:"builder"`
+	Recipe    slsaRecipe               `json:"recipe"`
+	Metadata  slsaMetadata             `json:"metadata"`
+	Materials []earthfile2llb.Material `json:"materials"`
+}
+
+type slsaBuilder struct {
+	ID string `json:"id"`
+}
+
+type slsaRecipe struct {
+	Type              string            `json:"type"`
+	DefinedInMaterial *int              `json:"definedInMaterial,omitempty"`
+	EntryPoint        string            `json:"entryPoint"`
+	Arguments         map[string]string `json:"arguments,omitempty"`
+}
+
+type slsaMetadata struct {
+	BuildStartedOn  time.Time        `json:"buildStartedOn"`
+	BuildFinishedOn time.Time        `json:"buildFinishedOn"`
+	Completeness    slsaCompleteness `json:"completeness"`
+	Reproducible    bool             `json:"reproducible"`
+}
+
+type slsaCompleteness struct {
+	Arguments   bool `json:"arguments"`
+	Environment bool `json:"environment"`
+	Materials   bool `json:"materials"`
+}
+
+func (b *Builder) buildProvenance(ctx context.Context, imageToSave earthfile2llb.SaveImage, pushed bool, states *earthfile2llb.SingleTargetStates, opt BuildOpt) error {
+	console := b.console.WithPrefixAndSalt(states.Target.String(), states.Salt)
+	dgst, err := b.imageDigest(ctx, imageToSave.DockerTag, pushed)
+	if err != nil {
+		return err
+	}
+	subjectDigest := make(map[string]string)
+	parts := strings.SplitN(dgst, ":", 2)
+	if len(parts) == 2 {
+		subjectDigest[parts[0]] = parts[1]
+	}
+	subjects := []inTotoSubject{
+		{
+			Name:   imageToSave.DockerTag,
+			Digest: subjectDigest,
+		},
+	}
+	statement := newProvenanceStatement(subjects, states, b.startTime, time.Now())
+	dest, err := writeProvenance(imageToSave.DockerTag, statement, opt)
+	if err != nil {
+		return err
+	}
+	console.Printf("Provenance of %s as local %s\n", imageToSave.DockerTag, dest)
+	if pushed {
+		// The statement is also pushed next to the image, such that it can be
+		// verified from the registry (cosign verify-attestation).
+		imageRef, err := digestRef(imageToSave.DockerTag, dgst)
+		if err != nil {
+			return err
+		}
+		err = cosignAttest(ctx, imageRef, statement.Predicate, opt.Sign)
+		if err != nil {
+			return err
+		}
+		console.Printf("Attached provenance to %s\n", imageRef)
+	}
+	return b.completeAttestation(ctx, console, provenanceAttestation, imageToSave.DockerTag, dest, states, opt)
+}
+
+func (b *Builder) buildArtifactProvenance(ctx context.Context, artifact domain.Artifact, savedPaths []string, states *earthfile2llb.SingleTargetStates, opt BuildOpt) error {
+	console := b.console.WithPrefixAndSalt(states.Target.String(), states.Salt)
+	var subjects []inTotoSubject
+	for _, savedPath := range savedPaths {
+		err := filepath.Walk(savedPath, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !fi.Mode().IsRegular() {
+				return nil
+			}
+			dgst, err := fileSHA256(p)
+			if err != nil {
+				return err
+			}
+			subjects = append(subjects, inTotoSubject{
+				Name:   filepath.ToSlash(p),
+				Digest: map[string]string{"sha256": dgst},
+			})
+			return nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "digest artifact %s", savedPath)
+		}
+	}
+	statement := newProvenanceStatement(subjects, states, b.startTime, time.Now())
+	dest, err := writeProvenance(artifact.String(), statement, opt)
+	if err != nil {
+		return err
+	}
+	console.Printf("Provenance of %s as local %s\n", artifact.StringCanonical(), dest)
+	return b.completeAttestation(ctx, console, provenanceAttestation, artifact.StringCanonical(), dest, states, opt)
+}
+
+func writeProvenance(name string, statement inTotoStatement, opt BuildOpt) (string, error) {
+	dt, err := json.MarshalIndent(statement, "", "  ")
+	if err != nil {
+		return "", errors.Wrap(err, "json marshal provenance")
+	}
+	err = os.MkdirAll(opt.ProvenanceDir, 0755)
+	if err != nil {
+		return "", errors.Wrapf(err, "mkdir all %s", opt.ProvenanceDir)
+	}
+	dest := filepath.Join(
+		opt.ProvenanceDir, fmt.Sprintf("%s.%s", localFileName(name), provenanceFileExtension))
+	err = ioutil.WriteFile(dest, dt, 0644)
+	if err != nil {
+		return "", errors.Wrapf(err, "write provenance %s", dest)
+	}
+	return dest, nil
+}
+
+func newProvenanceStatement(subjects []inTotoSubject, states *earthfile2llb.SingleTargetStates, startTime time.Time, endTime time.Time) inTotoStatement {
+	if subjects == nil {
+		subjects = []inTotoSubject{}
+	}
+	arguments := make(map[string]string)
+	completeArgs := true
+	for _, bai := range states.TargetInput.BuildArgs {
+		if !bai.IsConstant {
+			// The value of non-constant build args is only known within the build.
+			completeArgs = false
+			continue
+		}
+		arguments[bai.Name] = bai.ConstantValue
+	}
+	recipe := slsaRecipe{
+		Type:       earthfileRecipeType,
+		EntryPoint: states.Target.StringCanonical(),
+		Arguments:  arguments,
+	}
+	for index, m := range states.Materials {
+		if strings.HasPrefix(m.URI, "git+") {
+			i := index
+			recipe.DefinedInMaterial = &i
+			break
+		}
+	}
+	materials := states.Materials
+	if materials == nil {
+		materials = []earthfile2llb.Material{}
+	}
+	return inTotoStatement{
+		Type:          inTotoStatementType,
+		Subject:       subjects,
+		PredicateType: slsaProvenanceType,
+		Predicate: slsaProvenance{
+			Builder: slsaBuilder{ID: earthlyBuilderID},
+			Recipe:  recipe,
+			Metadata: slsaMetadata{
+				BuildStartedOn:  startTime.UTC(),
+				BuildFinishedOn: endTime.UTC(),
+				Completeness: slsaCompleteness{
+					Arguments:   completeArgs,
+					Environment: false,
+					Materials:   false,
+				},
+				Reproducible: false,
+			},
+			Materials: materials,
+		},
+	}
+}
+
+// cosignAttest pushes the provenance predicate to the registry as an attestation of
+// the image, signed via cosign. The private key of so is used if not nil, otherwise
+// keyless signing is used.
+func cosignAttest(ctx context.Context, imageRef string, predicate slsaProvenance, so SignOpt) error {
+	keyArgs, env, keyDir, err := cosignKeyArgs(so)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(keyDir)
+	predicateDir, err := ioutil.TempDir("", "earthly-provenance")
+	if err != nil {
+		return errors.Wrap(err, "make temp dir for provenance predicate")
+	}
+	defer os.RemoveAll(predicateDir)
+	dt, err := json.Marshal(predicate)
+	if err != nil {
+		return errors.Wrap(err, "json marshal provenance predicate")
+	}
+	predicatePath := filepath.Join(predicateDir, "predicate.json")
+	err = ioutil.WriteFile(predicatePath, dt, 0644)
+	if err != nil {
+		return errors.Wrap(err, "write provenance predicate")
+	}
+	cmd := exec.CommandContext(ctx, "cosign", cosignAttestArgs(imageRef, predicatePath, keyArgs)...)
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return errors.Wrapf(err, "cosign attest %s", imageRef)
+	}
+	return nil
+}
+
+// cosignAttestArgs returns the cosign args attaching the SLSA provenance predicate at
+// predicatePath to imageRef. cosign wraps the predicate in an in-toto statement, with
+// the image digest as its subject.
+func cosignAttestArgs(imageRef string, predicatePath string, keyArgs []string) []string {
+	args := []string{"attest", "--type", slsaProvenanceType, "--predicate", predicatePath}
+	args = append(args, keyArgs...)
+	return append(args, imageRef)
+}
+
+func fileSHA256(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", errors.Wrapf(err, "open %s", filePath)
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", errors.Wrapf(err, "read %s", filePath)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,136 @@
+package builder
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/earthly/earthly/earthfile2llb/dedup"
+)
+
+func TestNewProvenanceStatement(t *testing.T) {
+	target, err := domain.ParseTarget("github.com/foo/bar:main+docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gitMaterial := earthfile2llb.Material{
+		URI:    "git+https://github.com/foo/bar@main",
+		Digest: map[string]string{"sha1": "0123456789abcdef0123456789abcdef01234567"},
+	}
+	alpineMaterial := earthfile2llb.Material{
+		URI:    "pkg:docker/alpine:3.11",
+		Digest: map[string]string{"sha256": "cb8a924afdf0229ef7515d9e5b3024e23b3eb03ddbba287f4a19c6ac90b8d221"},
+	}
+	golangMaterial := earthfile2llb.Material{
+		URI:    "pkg:docker/golang:1.13-alpine3.11",
+		Digest: map[string]string{"sha256": "e9f6373299678506eaa6e632d5a8d7978209c430aa96c785e5edcb1eebf4885e"},
+	}
+	subjects := []inTotoSubject{
+		{
+			Name:   "foo/bar:latest",
+			Digest: map[string]string{"sha256": "6d2e1c5d0b3b8ff5b6c8c1e2d2a2ea3d58e4a2b9f0b3b7c6f3a8c1a2b3c4d5e6"},
+		},
+	}
+	start := time.Date(2020, 7, 1, 10, 0, 0, 0, time.UTC)
+	end := start.Add(time.Minute)
+
+	tests := []struct {
+		name              string
+		buildArgs         []dedup.BuildArgInput
+		materials         []earthfile2llb.Material
+		expectedArgs      map[string]string
+		completeArgs      bool
+		definedInMaterial *int
+	}{
+		{
+			"constant build args",
+			[]dedup.BuildArgInput{
+				{Name: "VERSION", IsConstant: true, ConstantValue: "1.2.3"},
+				{Name: "DEBUG", IsConstant: true, ConstantValue: ""},
+			},
+			[]earthfile2llb.Material{alpineMaterial, gitMaterial, golangMaterial},
+			map[string]string{"VERSION": "1.2.3", "DEBUG": ""},
+			true,
+			intPtr(1),
+		},
+		{
+			"non-constant build arg",
+			[]dedup.BuildArgInput{
+				{Name: "VERSION", IsConstant: true, ConstantValue: "1.2.3"},
+				{Name: "SHA", IsConstant: false},
+			},
+			[]earthfile2llb.Material{gitMaterial, alpineMaterial},
+			map[string]string{"VERSION": "1.2.3"},
+			false,
+			intPtr(0),
+		},
+		{
+			"no git material",
+			nil,
+			[]earthfile2llb.Material{alpineMaterial},
+			map[string]string{},
+			true,
+			nil,
+		},
+	}
+	for _, test := range tests {
+		states := &earthfile2llb.SingleTargetStates{
+			Target:    target,
+			Materials: test.materials,
+		}
+		states.TargetInput.BuildArgs = test.buildArgs
+		st := newProvenanceStatement(subjects, states, start, end)
+		if st.Type != inTotoStatementType || st.PredicateType != slsaProvenanceType {
+			t.Errorf("%s: unexpected statement types %s and %s", test.name, st.Type, st.PredicateType)
+		}
+		if !reflect.DeepEqual(st.Subject, subjects) {
+			t.Errorf("%s: expected subjects %v, got %v", test.name, subjects, st.Subject)
+		}
+		p := st.Predicate
+		if p.Recipe.EntryPoint != target.StringCanonical() {
+			t.Errorf("%s: expected entry point %s, got %s", test.name, target.StringCanonical(), p.Recipe.EntryPoint)
+		}
+		if !reflect.DeepEqual(p.Recipe.Arguments, test.expectedArgs) {
+			t.Errorf("%s: expected arguments %v, got %v", test.name, test.expectedArgs, p.Recipe.Arguments)
+		}
+		if p.Metadata.Completeness.Arguments != test.completeArgs {
+			t.Errorf("%s: expected arguments completeness %v", test.name, test.completeArgs)
+		}
+		if !reflect.DeepEqual(p.Recipe.DefinedInMaterial, test.definedInMaterial) {
+			t.Errorf("%s: expected defined in material %v, got %v", test.name, test.definedInMaterial, p.Recipe.DefinedInMaterial)
+		}
+		// The base images are recorded with their digests.
+		if !reflect.DeepEqual(p.Materials, test.materials) {
+			t.Errorf("%s: expected materials %v, got %v", test.name, test.materials, p.Materials)
+		}
+		if !p.Metadata.BuildStartedOn.Equal(start) || !p.Metadata.BuildFinishedOn.Equal(end) {
+			t.Errorf("%s: unexpected build times %v and %v", test.name, p.Metadata.BuildStartedOn, p.Metadata.BuildFinishedOn)
+		}
+	}
+}
+
+func TestNewProvenanceStatementEmpty(t *testing.T) {
+	states := &earthfile2llb.SingleTargetStates{}
+	st := newProvenanceStatement(nil, states, time.Now(), time.Now())
+	// Empty lists, rather than null, in the JSON.
+	if st.Subject == nil || st.Predicate.Materials == nil {
+		t.Error("expected empty subjects and materials, got nil")
+	}
+}
+
+func TestCosignAttestArgs(t *testing.T) {
+	args := cosignAttestArgs("docker.io/foo/bar@sha256:abcd", "/tmp/predicate.json", []string{"--key", "/tmp/cosign.key"})
+	expected := []string{
+		"attest", "--type", slsaProvenanceType, "--predicate", "/tmp/predicate.json",
+		"--key", "/tmp/cosign.key", "docker.io/foo/bar@sha256:abcd",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %v, got %v", expected, args)
+	}
+}
+
+func intPtr(i int) *int {
+	return &i
+}
@@ -0,0 +1,167 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/earthly/earthly/earthfile2llb"
+
+	"github.com/moby/buildkit/client"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+// PruneOpt selects the cache records removed by Prune.
+type PruneOpt struct {
+	// All also prunes the internal and shared records.
+	All bool
+	// TargetPrefix only prunes the records of the targets starting with the prefix, for
+	// example github.com/foo/bar+ for all the targets of a project.
+	TargetPrefix string
+	// OlderThan only prunes the records which have not been used for that long.
+	OlderThan time.Duration
+	// KeepLast keeps the records of the last KeepLast builds of each target, and only
+	// prunes records of targets. Disabled if zero.
+	KeepLast int
+}
+
+// PruneResult is the outcome of Prune.
+type PruneResult struct {
+	// Records is the number of cache records removed.
+	Records int
+	// Size is the disk space freed, in bytes.
+	Size int64
+}
+
+// Prune removes the cache records of the buildkitd selected by opt.
+func Prune(ctx context.Context, bkClient *client.Client, opt PruneOpt) (PruneResult, error) {
+	var pruneOpts []client.PruneOption
+	if opt.All {
+		pruneOpts = append(pruneOpts, client.PruneAll)
+	}
+	if opt.KeepLast > 0 {
+		du, err := bkClient.DiskUsage(ctx)
+		if err != nil {
+			return PruneResult{}, errors.Wrap(err, "buildkit disk usage")
+		}
+		ids := keepLastPruneIDs(du, opt, time.Now())
+		if len(ids) == 0 {
+			return PruneResult{}, nil
+		}
+		// The filters are alternatives: records matching any of them are pruned.
+		filters := make([]string, 0, len(ids))
+		for _, id := range ids {
+			filters = append(filters, fmt.Sprintf("id==%s", id))
+		}
+		pruneOpts = append(pruneOpts, client.WithFilter(filters))
+	} else {
+		if opt.TargetPrefix != "" {
+			pruneOpts = append(pruneOpts, client.WithFilter([]string{earthfile2llb.CacheTargetFilter(opt.TargetPrefix)}))
+		}
+		if opt.OlderThan > 0 {
+			pruneOpts = append(pruneOpts, client.WithKeepOpt(opt.OlderThan, 0))
+		}
+	}
+
+	var result PruneResult
+	ch := make(chan client.UsageInfo, 1)
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		err := bkClient.Prune(ctx, ch, pruneOpts...)
+		if err != nil {
+			return errors.Wrap(err, "buildkit prune")
+		}
+		close(ch)
+		return nil
+	})
+	eg.Go(func() error {
+		for {
+			select {
+			case info, ok := <-ch:
+				if !ok {
+					return nil
+				}
+				result.Records++
+				result.Size += info.Size
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	})
+	err := eg.Wait()
+	if err != nil {
+		return PruneResult{}, err
+	}
+	return result, nil
+}
+
+// keepLastPruneIDs returns the IDs of the records to prune in order to keep only the
+// last opt.KeepLast builds of each target. The RUN commands of a build of a target
+// produce a chain of records, each the parent of the next one. The chains are
+// identified by their last record, and the most recently used ones are kept,
+// together with the records they build upon.
+func keepLastPruneIDs(du []*client.UsageInfo, opt PruneOpt, now time.Time) []string {
+	targetOf := make(map[string]string)
+	byID := make(map[string]*client.UsageInfo)
+	for _, info := range du {
+		if info.RecordType != client.UsageRecordTypeRegular && info.RecordType != "" {
+			continue
+		}
+		target, ok := earthfile2llb.CacheTargetOf(info.Description)
+		if !ok || !strings.HasPrefix(target, opt.TargetPrefix) {
+			continue
+		}
+		targetOf[info.ID] = target
+		byID[info.ID] = info
+	}
+	hasChild := make(map[string]bool)
+	for id, target := range targetOf {
+		parent := byID[id].Parent
+		if parent != "" && targetOf[parent] == target {
+			hasChild[parent] = true
+		}
+	}
+	lastRecords := make(map[string][]*client.UsageInfo)
+	for id, target := range targetOf {
+		if !hasChild[id] {
+			lastRecords[target] = append(lastRecords[target], byID[id])
+		}
+	}
+	keep := make(map[string]bool)
+	for target, records := range lastRecords {
+		sort.Slice(records, func(i, j int) bool {
+			return lastUsed(records[i]).After(lastUsed(records[j]))
+		})
+		for i, record := range records {
+			if i >= opt.KeepLast {
+				break
+			}
+			for id := record.ID; id != "" && targetOf[id] == target; id = byID[id].Parent {
+				keep[id] = true
+			}
+		}
+	}
+	var ids []string
+	for id := range targetOf {
+		info := byID[id]
+		if keep[id] || info.InUse {
+			continue
+		}
+		if opt.OlderThan > 0 && lastUsed(info).After(now.Add(-opt.OlderThan)) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func lastUsed(info *client.UsageInfo) time.Time {
+	if info.LastUsedAt != nil {
+		return *info.LastUsedAt
+	}
+	return info.CreatedAt
+}
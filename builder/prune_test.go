@@ -0,0 +1,51 @@
+package builder
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/moby/buildkit/client"
+)
+
+func TestKeepLastPruneIDs(t *testing.T) {
+	now := time.Now()
+	record := func(id string, parent string, target string, age time.Duration) *client.UsageInfo {
+		lastUsedAt := now.Add(-age)
+		return &client.UsageInfo{
+			ID:          id,
+			Parent:      parent,
+			Description: "mount / from exec /bin/sh -c EARTHLY_CACHE_TARGET='" + target + "' /usr/bin/earth_debugger",
+			LastUsedAt:  &lastUsedAt,
+			RecordType:  client.UsageRecordTypeRegular,
+		}
+	}
+	du := []*client.UsageInfo{
+		{ID: "base", Description: "pulled from docker.io/library/alpine", RecordType: client.UsageRecordTypeRegular},
+		// Three builds of +build: a1 <- a2, a1 <- b2, c1 <- c2.
+		record("a1", "base", "github.com/foo/bar+build", 3*time.Hour),
+		record("a2", "a1", "github.com/foo/bar+build", 3*time.Hour),
+		record("b2", "a1", "github.com/foo/bar+build", 2*time.Hour),
+		record("c1", "base", "github.com/foo/bar+build", time.Hour),
+		record("c2", "c1", "github.com/foo/bar+build", time.Hour),
+		// Two builds of +test, which builds on +build.
+		record("t1", "c2", "github.com/foo/bar+test", 5*time.Hour),
+		record("t2", "c2", "github.com/foo/bar+test", 4*time.Hour),
+		{ID: "cache", Description: "cached mount /root/.cache from exec EARTHLY_CACHE_TARGET='github.com/foo/bar+test'", RecordType: client.UsageRecordTypeCacheMount},
+	}
+	tests := []struct {
+		opt      PruneOpt
+		expected []string
+	}{
+		{PruneOpt{KeepLast: 1}, []string{"a1", "a2", "b2", "t1"}},
+		{PruneOpt{KeepLast: 2}, []string{"a2"}},
+		{PruneOpt{KeepLast: 1, TargetPrefix: "github.com/foo/bar+test"}, []string{"t1"}},
+		{PruneOpt{KeepLast: 1, OlderThan: 150 * time.Minute}, []string{"a1", "a2", "t1"}},
+	}
+	for _, tt := range tests {
+		actual := keepLastPruneIDs(du, tt.opt, now)
+		if !reflect.DeepEqual(actual, tt.expected) {
+			t.Errorf("%+v: expected %v, got %v", tt.opt, tt.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/earthly/earthly/conslogging"
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/earthly/earthly/errcode"
+	"github.com/earthly/earthly/logging"
+	"github.com/pkg/errors"
+)
+
+// maxPushBackoff is the maximum delay between two attempts of the same push.
+const maxPushBackoff = time.Minute
+
+// PushRetryOpt holds the settings of the retries of failed image pushes.
+type PushRetryOpt struct {
+	// Retries is the number of times a failed push is attempted again.
+	Retries int
+	// Backoff is the delay before the first retry. It doubles with every retry, up to
+	// maxPushBackoff.
+	Backoff time.Duration
+}
+
+// pushResult is the outcome of the push of an image.
+type pushResult struct {
+	target string
+	image  string
+	// digest is the registry digest of the pushed image, if known.
+	digest string
+	// err is the error the push failed with, after all the retries.
+	err error
+	// skippedAfter is set if the push was not attempted, as the pushes of the target it
+	// is to be pushed after (via RUN --push --after) failed.
+	skippedAfter string
+}
+
+// PushError is returned by Build when pushes of images failed, after the other outputs
+// have been completed.
+type PushError struct {
+	// Failed is the number of pushes which failed or were skipped.
+	Failed int
+	// Total is the number of pushes of the build.
+	Total int
+}
+
+func (pe *PushError) Error() string {
+	return fmt.Sprintf("%d of %d image pushes failed", pe.Failed, pe.Total)
+}
+
+// ErrorCategory implements errcode.Categorized.
+func (pe *PushError) ErrorCategory() errcode.Category {
+	return errcode.PushFailure
+}
+
+// groupSaveImages groups the docker images to be exported by the names of the same image
+// (as listed by the same SAVE IMAGE command), which can be exported at once. The images
+// without a name are left out.
+func groupSaveImages(saveImages []earthfile2llb.SaveImage) [][]earthfile2llb.SaveImage {
+	var groups [][]earthfile2llb.SaveImage
+	for _, imageToSave := range saveImages {
+		if imageToSave.DockerTag == "" {
+			// Not a docker export. Skip.
+			continue
+		}
+		if len(groups) > 0 {
+			last := groups[len(groups)-1]
+			if sameImage(last[0], imageToSave) {
+				groups[len(groups)-1] = append(last, imageToSave)
+				continue
+			}
+		}
+		groups = append(groups, []earthfile2llb.SaveImage{imageToSave})
+	}
+	return groups
+}
+
+// sameImage returns whether the two images are names of the same image, saved and pushed
+// the same way.
+func sameImage(a, b earthfile2llb.SaveImage) bool {
+	return a.State.Output() == b.State.Output() &&
+		a.Push == b.Push &&
+		a.Insecure == b.Insecure &&
+		a.Compression == b.Compression
+}
+
+// imageRegistry returns the registry the image of the given name is pushed to. The name
+// itself is returned if it cannot be parsed.
+func imageRegistry(dockerTag string) string {
+	named, err := reference.ParseNormalizedNamed(dockerTag)
+	if err != nil {
+		return dockerTag
+	}
+	return reference.Domain(named)
+}
+
+// pushImages pushes the given images, which are the names of the same image, and records
+// the outcomes for the push report. The images of different registries are pushed in
+// parallel. The images of the same registry are pushed one after the other, so that the
+// layers are only uploaded once. It returns whether each image was pushed.
+func (b *Builder) pushImages(ctx context.Context, images []earthfile2llb.SaveImage, localDirs map[string]string, states *earthfile2llb.SingleTargetStates, opt BuildOpt) map[string]bool {
+	console := b.console.WithPrefixAndSalt(states.Target.String(), states.Salt)
+	var registries []string
+	byRegistry := make(map[string][]int)
+	for i, imageToSave := range images {
+		registry := imageRegistry(imageToSave.DockerTag)
+		if _, found := byRegistry[registry]; !found {
+			registries = append(registries, registry)
+		}
+		byRegistry[registry] = append(byRegistry[registry], i)
+	}
+	results := make([]pushResult, len(images))
+	var wg sync.WaitGroup
+	for _, registry := range registries {
+		wg.Add(1)
+		go func(indices []int) {
+			defer wg.Done()
+			for _, i := range indices {
+				imageToSave := images[i]
+				solveCtx := logging.With(ctx, "image", imageToSave.DockerTag)
+				solveCtx = logging.With(solveCtx, "solve", "image")
+				results[i].image = imageToSave.DockerTag
+				results[i].err = retryPush(ctx, console, opt.PushRetry, imageToSave.DockerTag, func() error {
+					var err error
+					results[i].digest, err = b.solverFor(states).pushImage(
+						solveCtx, localDirs, imageToSave.State, imageToSave.Image, imageToSave.DockerTag,
+						imageToSave.Insecure, imageToSave.Compression)
+					return err
+				})
+			}
+		}(byRegistry[registry])
+	}
+	wg.Wait()
+	pushed := make(map[string]bool)
+	for _, pr := range results {
+		if pr.err != nil {
+			// The other outputs are still completed. See pushReport.
+			console.Warnf("Failed to push %s: %v\n", pr.image, pr.err)
+			b.recordPush(states, pr.image, "", pr.err)
+			continue
+		}
+		if pr.digest != "" {
+			// Pushed by buildkit. The docker daemon does not know the registry digest.
+			b.pushDigests[pr.image] = pr.digest
+		}
+		dgst, err := b.imageDigest(ctx, pr.image, true)
+		if err != nil {
+			// The report is still useful without the digest.
+			logging.GetLogger(ctx).Error(errors.Wrap(err, "push digest"))
+		}
+		b.recordPush(states, pr.image, dgst, nil)
+		pushed[pr.image] = true
+	}
+	return pushed
+}
+
+// retryPush calls push until it succeeds, or it failed opt.Retries+1 times, waiting
+// longer and longer between the attempts. The error of the last attempt is returned.
+func retryPush(ctx context.Context, console conslogging.ConsoleLogger, opt PushRetryOpt, image string, push func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := push()
+		if err == nil || attempt >= opt.Retries || ctx.Err() != nil {
+			return err
+		}
+		delay := pushBackoff(opt, attempt)
+		console.Warnf(
+			"Push of %s failed (attempt %d of %d), retrying in %s: %v\n",
+			image, attempt+1, opt.Retries+1, delay, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// pushBackoff returns the delay before the retry following the given (0 based) attempt.
+func pushBackoff(opt PushRetryOpt, attempt int) time.Duration {
+	delay := opt.Backoff
+	for i := 0; i < attempt && delay < maxPushBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxPushBackoff {
+		delay = maxPushBackoff
+	}
+	return delay
+}
+
+// recordPush records the outcome of the push of an image, for the push report.
+func (b *Builder) recordPush(states *earthfile2llb.SingleTargetStates, image string, digest string, err error) {
+	target := states.Target.StringCanonical()
+	b.pushes = append(b.pushes, pushResult{
+		target: target,
+		image:  image,
+		digest: digest,
+		err:    err,
+	})
+	if err != nil {
+		b.failedPushTargets[target] = true
+	}
+}
+
+// failedPushAfter returns the target which the outputs of states are to be pushed after,
+// and whose pushes failed, if any.
+func (b *Builder) failedPushAfter(states *earthfile2llb.SingleTargetStates) string {
+	for _, after := range states.PushAfter {
+		if b.failedPushTargets[after.StringCanonical()] {
+			return after.StringCanonical()
+		}
+	}
+	return ""
+}
+
+// skipPushes records the image pushes of states as skipped, as the pushes of the
+// target after failed. The targets to be pushed after states are skipped in turn.
+func (b *Builder) skipPushes(states *earthfile2llb.SingleTargetStates, after string) {
+	target := states.Target.StringCanonical()
+	console := b.console.WithPrefixAndSalt(states.Target.String(), states.Salt)
+	console.Warnf("Skipping the outputs of %s, as the pushes of %s failed\n", target, after)
+	b.failedPushTargets[target] = true
+	for _, imageToSave := range states.SaveImages {
+		if imageToSave.DockerTag == "" || !imageToSave.Push {
+			continue
+		}
+		b.pushes = append(b.pushes, pushResult{
+			target:       target,
+			image:        imageToSave.DockerTag,
+			skippedAfter: after,
+		})
+	}
+}
+
+// pushReport prints which pushes of the build succeeded, with their digests, and which
+// failed. It returns a PushError if any failed.
+func (b *Builder) pushReport() error {
+	if len(b.pushes) == 0 {
+		return nil
+	}
+	failed := 0
+	b.console.Printf("Pushes:\n")
+	for _, pr := range b.pushes {
+		switch {
+		case pr.skippedAfter != "":
+			failed++
+			b.console.Printf("  skipped %s (%s): the pushes of %s failed\n", pr.image, pr.target, pr.skippedAfter)
+		case pr.err != nil:
+			failed++
+			b.console.Printf("  failed  %s (%s): %v\n", pr.image, pr.target, pr.err)
+		case pr.digest != "":
+			b.console.Printf("  pushed  %s (%s): %s\n", pr.image, pr.target, pr.digest)
+		default:
+			b.console.Printf("  pushed  %s (%s)\n", pr.image, pr.target)
+		}
+	}
+	if failed > 0 {
+		return &PushError{Failed: failed, Total: len(b.pushes)}
+	}
+	return nil
+}
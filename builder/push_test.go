@@ -0,0 +1,131 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/earthly/earthly/conslogging"
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/moby/buildkit/client/llb"
+)
+
+func TestGroupSaveImages(t *testing.T) {
+	state := llb.Scratch().File(llb.Mkdir("/a", 0755))
+	other := llb.Scratch().File(llb.Mkdir("/b", 0755))
+	uncompressed := earthfile2llb.LayerCompression{Type: "uncompressed"}
+	saveImages := []earthfile2llb.SaveImage{
+		{State: state, DockerTag: "foo:latest", Push: true},
+		{State: state, DockerTag: "gcr.io/proj/foo:latest", Push: true},
+		{State: state, DockerTag: ""},
+		{State: other, DockerTag: "bar:latest", Push: true},
+		{State: other, DockerTag: "bar:uncompressed", Push: true, Compression: uncompressed},
+		{State: other, DockerTag: "mirror.internal:5000/bar:uncompressed", Push: true, Compression: uncompressed},
+	}
+	var got []string
+	for _, group := range groupSaveImages(saveImages) {
+		var tags []string
+		for _, imageToSave := range group {
+			tags = append(tags, imageToSave.DockerTag)
+		}
+		got = append(got, fmt.Sprint(tags))
+	}
+	expected := "[[foo:latest gcr.io/proj/foo:latest] [bar:latest] [bar:uncompressed mirror.internal:5000/bar:uncompressed]]"
+	if fmt.Sprint(got) != expected {
+		t.Errorf("expected %s, got %v", expected, got)
+	}
+}
+
+func TestImageRegistry(t *testing.T) {
+	tests := []struct {
+		dockerTag string
+		expected  string
+	}{
+		{"foo:latest", "docker.io"},
+		{"user/foo", "docker.io"},
+		{"gcr.io/proj/foo:v1", "gcr.io"},
+		{"123456789012.dkr.ecr.us-east-1.amazonaws.com/foo", "123456789012.dkr.ecr.us-east-1.amazonaws.com"},
+		{"mirror.internal:5000/foo", "mirror.internal:5000"},
+		{"Invalid", "Invalid"},
+	}
+	for _, test := range tests {
+		got := imageRegistry(test.dockerTag)
+		if got != test.expected {
+			t.Errorf("imageRegistry(%q): expected %s, got %s", test.dockerTag, test.expected, got)
+		}
+	}
+}
+
+func TestPushBackoff(t *testing.T) {
+	opt := PushRetryOpt{Retries: 10, Backoff: 5 * time.Second}
+	expected := []time.Duration{
+		5 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute,
+	}
+	for attempt, want := range expected {
+		got := pushBackoff(opt, attempt)
+		if got != want {
+			t.Errorf("attempt %d: got %s, want %s", attempt, got, want)
+		}
+	}
+}
+
+func TestRetryPush(t *testing.T) {
+	console := conslogging.Current(conslogging.NoColor)
+	ctx := context.Background()
+	opt := PushRetryOpt{Retries: 2, Backoff: time.Millisecond}
+
+	attempts := 0
+	err := retryPush(ctx, console, opt, "test:latest", func() error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("transient")
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Errorf("expected success after 3 attempts, got %v after %d", err, attempts)
+	}
+
+	attempts = 0
+	err = retryPush(ctx, console, opt, "test:latest", func() error {
+		attempts++
+		return errors.New("permanent")
+	})
+	if err == nil || err.Error() != "permanent" || attempts != 3 {
+		t.Errorf("expected failure after 3 attempts, got %v after %d", err, attempts)
+	}
+}
+
+func TestPushReport(t *testing.T) {
+	b := &Builder{
+		console:           conslogging.Current(conslogging.NoColor),
+		failedPushTargets: make(map[string]bool),
+	}
+	build := &earthfile2llb.SingleTargetStates{Target: domain.Target{LocalPath: ".", Target: "build"}}
+	release := &earthfile2llb.SingleTargetStates{
+		Target:     domain.Target{LocalPath: ".", Target: "release"},
+		PushAfter:  []domain.Target{build.Target},
+		SaveImages: []earthfile2llb.SaveImage{{DockerTag: "release:latest", Push: true}},
+	}
+	b.recordPush(build, "ok:latest", "docker.io/library/ok@sha256:abc", nil)
+	if b.failedPushAfter(release) != "" {
+		t.Error("expected no failed push")
+	}
+	b.recordPush(build, "build:latest", "", errors.New("registry unavailable"))
+	after := b.failedPushAfter(release)
+	if after != "+build" {
+		t.Fatalf("unexpected failed push after %q", after)
+	}
+	b.skipPushes(release, after)
+	if !b.failedPushTargets["+release"] {
+		t.Error("expected the skipped target to be marked as failed")
+	}
+	err := b.pushReport()
+	pe, ok := err.(*PushError)
+	if !ok || pe.Failed != 2 || pe.Total != 3 {
+		t.Errorf("unexpected error %v", err)
+	}
+}
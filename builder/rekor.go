@@ -0,0 +1,126 @@
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/earthly/earthly/conslogging"
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/pkg/errors"
+)
+
+// DefaultRekorURL is the public Rekor instance of sigstore.
+const DefaultRekorURL = "https://rekor.sigstore.dev"
+
+// Kinds of attestations.
+const (
+	sbomAttestation       = "sbom"
+	provenanceAttestation = "provenance"
+)
+
+// RekorOpt holds the settings of the upload of the attestations (SBOMs and provenance
+// statements) to a Rekor transparency log.
+type RekorOpt struct {
+	// Enabled turns on the upload of the attestations.
+	Enabled bool
+	// URL is the URL of the Rekor server.
+	URL string
+}
+
+// attestationSummary is an attestation written locally, for the build summary.
+type attestationSummary struct {
+	Target string `json:"target"`
+	// Subject is the image or the artifact attested.
+	Subject string `json:"subject"`
+	// Type is sbom or provenance.
+	Type string `json:"type"`
+	Path string `json:"path"`
+	// RekorLogIndex is the index of the entry of the attestation in the Rekor
+	// transparency log. Nil if not uploaded.
+	RekorLogIndex *int64 `json:"rekorLogIndex,omitempty"`
+}
+
+// rekorEntry is an entry of the Rekor transparency log.
+type rekorEntry struct {
+	LogIndex       int64  `json:"logIndex"`
+	LogID          string `json:"logID"`
+	IntegratedTime int64  `json:"integratedTime"`
+}
+
+// completeAttestation uploads the attestation written at path to Rekor, if enabled,
+// and records it for the build summary.
+func (b *Builder) completeAttestation(ctx context.Context, console conslogging.ConsoleLogger, kind string, subject string, path string, states *earthfile2llb.SingleTargetStates, opt BuildOpt) error {
+	as := attestationSummary{
+		Target:  states.Target.StringCanonical(),
+		Subject: subject,
+		Type:    kind,
+		Path:    path,
+	}
+	if opt.Rekor.Enabled {
+		entry, err := rekorUpload(ctx, path, opt.Rekor.URL, opt.Sign)
+		if err != nil {
+			return errors.Wrapf(err, "upload %s of %s to rekor", kind, subject)
+		}
+		console.Printf("Uploaded %s of %s to %s, log index %d\n", kind, subject, opt.Rekor.URL, entry.LogIndex)
+		as.RekorLogIndex = &entry.LogIndex
+	}
+	if opt.SummaryPath != "" {
+		b.attestations = append(b.attestations, as)
+	}
+	return nil
+}
+
+// rekorUpload signs the file via cosign and uploads the signature to the Rekor server.
+// The private key of so is used if not nil, otherwise keyless signing is used.
+func rekorUpload(ctx context.Context, path string, rekorURL string, so SignOpt) (*rekorEntry, error) {
+	keyArgs, env, keyDir, err := cosignKeyArgs(so)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(keyDir)
+	bundleDir, err := ioutil.TempDir("", "earthly-rekor")
+	if err != nil {
+		return nil, errors.Wrap(err, "make temp dir for rekor bundle")
+	}
+	defer os.RemoveAll(bundleDir)
+	bundlePath := filepath.Join(bundleDir, "bundle.json")
+	args := []string{"sign-blob", "--rekor-url", rekorURL, "--bundle", bundlePath}
+	args = append(args, keyArgs...)
+	args = append(args, path)
+	cmd := exec.CommandContext(ctx, "cosign", args...)
+	// Older versions of cosign only upload to the transparency log in experimental mode.
+	cmd.Env = append(env, "COSIGN_EXPERIMENTAL=1")
+	cmd.Stdout = ioutil.Discard
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return nil, errors.Wrapf(err, "cosign sign-blob %s", path)
+	}
+	dt, err := ioutil.ReadFile(bundlePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "read rekor bundle")
+	}
+	return parseCosignBundle(dt)
+}
+
+// parseCosignBundle returns the transparency log entry of a bundle output by cosign
+// sign-blob.
+func parseCosignBundle(dt []byte) (*rekorEntry, error) {
+	var bundle struct {
+		RekorBundle *struct {
+			Payload rekorEntry `json:"Payload"`
+		} `json:"rekorBundle"`
+	}
+	err := json.Unmarshal(dt, &bundle)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse cosign bundle")
+	}
+	if bundle.RekorBundle == nil {
+		return nil, errors.New("cosign bundle has no transparency log entry")
+	}
+	return &bundle.RekorBundle.Payload, nil
+}
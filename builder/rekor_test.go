@@ -0,0 +1,59 @@
+package builder
+
+import (
+	"context"
+	"testing"
+
+	"github.com/earthly/earthly/conslogging"
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/earthfile2llb"
+)
+
+func TestParseCosignBundle(t *testing.T) {
+	bundle := `{
+		"base64Signature": "MEUCIQ==",
+		"cert": "",
+		"rekorBundle": {
+			"SignedEntryTimestamp": "MEQCIA==",
+			"Payload": {
+				"body": "eyJhcGlWZXJzaW9uIjoiMC4wLjEifQ==",
+				"integratedTime": 1634567890,
+				"logIndex": 1234567,
+				"logID": "c0d23d6ad406973f9559f3ba2d1ca01f84147d8ffc5b8445c224f98b9591801d"
+			}
+		}
+	}`
+	entry, err := parseCosignBundle([]byte(bundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.LogIndex != 1234567 || entry.IntegratedTime != 1634567890 {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+	_, err = parseCosignBundle([]byte(`{"base64Signature": "MEUCIQ=="}`))
+	if err == nil {
+		t.Error("expected an error for a bundle without a log entry")
+	}
+}
+
+func TestCompleteAttestation(t *testing.T) {
+	console := conslogging.Current(conslogging.NoColor)
+	b := &Builder{console: console}
+	states := &earthfile2llb.SingleTargetStates{Target: domain.Target{LocalPath: ".", Target: "docker"}}
+	err := b.completeAttestation(context.Background(), console, sbomAttestation, "app:latest", "sbom/app_latest.spdx.json", states, BuildOpt{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.attestations) != 0 {
+		t.Errorf("expected no attestation to be recorded without a summary, got %+v", b.attestations)
+	}
+	opt := BuildOpt{SummaryPath: "summary.json"}
+	err = b.completeAttestation(context.Background(), console, provenanceAttestation, "app:latest", "provenance/app_latest.provenance.json", states, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.attestations) != 1 || b.attestations[0].Type != provenanceAttestation ||
+		b.attestations[0].Target != "+docker" || b.attestations[0].RekorLogIndex != nil {
+		t.Errorf("unexpected attestations %+v", b.attestations)
+	}
+}
@@ -0,0 +1,51 @@
+package builder
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// SetReproducible makes the images output by the builder reproducible: built from the
+// same inputs, they always have the same image ID. Their timestamps are set to epoch.
+// See dockertar.Normalize.
+func (b *Builder) SetReproducible(epoch time.Time) {
+	b.s.reproducible = true
+	b.s.epoch = epoch
+	for _, w := range b.workers {
+		w.reproducible = true
+		w.epoch = epoch
+	}
+}
+
+// ImageIDs returns the IDs of the images loaded into the docker daemon by the build, by
+// tag. They are only recorded for reproducible builds.
+func (b *Builder) ImageIDs() map[string]string {
+	ret := make(map[string]string)
+	for tag, id := range b.imageIDs {
+		ret[tag] = id
+	}
+	return ret
+}
+
+// CompareImageIDs compares the image IDs of two builds of the same target, by tag, and
+// returns the differences found, sorted by tag.
+func CompareImageIDs(first map[string]string, second map[string]string) []string {
+	var diffs []string
+	for tag, id := range first {
+		secondID, found := second[tag]
+		switch {
+		case !found:
+			diffs = append(diffs, fmt.Sprintf("%s: only output by the first build", tag))
+		case secondID != id:
+			diffs = append(diffs, fmt.Sprintf("%s: %s != %s", tag, id, secondID))
+		}
+	}
+	for tag := range second {
+		if _, found := first[tag]; !found {
+			diffs = append(diffs, fmt.Sprintf("%s: only output by the second build", tag))
+		}
+	}
+	sort.Strings(diffs)
+	return diffs
+}
@@ -0,0 +1,44 @@
+package builder
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompareImageIDs(t *testing.T) {
+	tests := []struct {
+		name   string
+		first  map[string]string
+		second map[string]string
+		want   []string
+	}{
+		{
+			name:   "same",
+			first:  map[string]string{"a:latest": "sha256:1", "b:latest": "sha256:2"},
+			second: map[string]string{"a:latest": "sha256:1", "b:latest": "sha256:2"},
+		},
+		{
+			name:   "different",
+			first:  map[string]string{"a:latest": "sha256:1", "b:latest": "sha256:2"},
+			second: map[string]string{"a:latest": "sha256:1", "b:latest": "sha256:3"},
+			want:   []string{"b:latest: sha256:2 != sha256:3"},
+		},
+		{
+			name:   "missing",
+			first:  map[string]string{"a:latest": "sha256:1"},
+			second: map[string]string{"b:latest": "sha256:2"},
+			want: []string{
+				"a:latest: only output by the first build",
+				"b:latest: only output by the second build",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := CompareImageIDs(tt.first, tt.second)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
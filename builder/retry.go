@@ -0,0 +1,58 @@
+package builder
+
+import (
+	"context"
+	"time"
+
+	"github.com/earthly/earthly/earthfile2llb"
+)
+
+// retryBackoff is the delay before the first retry of a RUN --retry command. The
+// following retries back off linearly, to give transient failures time to go away.
+var retryBackoff = time.Second
+
+// commandRetries returns the number of retries of the RUN --retry commands of the given
+// states, by the name of their vertex.
+func commandRetries(statesList []*earthfile2llb.SingleTargetStates) map[string]int {
+	retries := make(map[string]int)
+	for _, states := range statesList {
+		for name, n := range states.Retries {
+			retries[name] = n
+		}
+	}
+	return retries
+}
+
+// solveWithRetries calls solve, which returns the vertex which failed the solve, if
+// any, until it succeeds. A failed vertex is solved again as many times as its number
+// of retries. As buildkit does not keep the filesystem of a failed command, the command
+// is executed again from the state it started from, whereas the commands which
+// completed are cached.
+func (s *solver) solveWithRetries(ctx context.Context, retries map[string]int, solve func() (*vertexMonitor, error)) error {
+	attempts := make(map[string]int)
+	for {
+		errVertex, err := solve()
+		if err == nil {
+			return nil
+		}
+		if errVertex == nil {
+			return s.categorize(err)
+		}
+		name := errVertex.vertex.Name
+		if attempts[name] >= retries[name] || ctx.Err() != nil {
+			s.sm.reprintFailure(errVertex)
+			return s.categorize(err)
+		}
+		attempts[name]++
+		errVertex.console.Warnf(
+			"Command %s failed. Retrying from the state before the command (attempt %d of %d)\n",
+			errVertex.operation, attempts[name]+1, retries[name]+1)
+		select {
+		case <-time.After(time.Duration(attempts[name]) * retryBackoff):
+		case <-ctx.Done():
+			s.sm.reprintFailure(errVertex)
+			return s.categorize(err)
+		}
+		s.sm.forgetFailure(errVertex)
+	}
+}
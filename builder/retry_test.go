@@ -0,0 +1,92 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/earthly/earthly/conslogging"
+	"github.com/moby/buildkit/client"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestSolveWithRetries(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the commands are executed via sh")
+	}
+	defer func(backoff time.Duration) { retryBackoff = backoff }(retryBackoff)
+	retryBackoff = time.Millisecond
+	dir, err := ioutil.TempDir("", "earthly-retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	const name = "[+test abc] RUN --retry 1 ./flaky.sh"
+	// The command leaves a file behind, and fails on its first attempt only. It fails
+	// with exit code 2 if it finds the file of a previous attempt.
+	flaky := "test ! -e leftover || exit 2; touch leftover; echo x >>../attempts; test $(wc -l <../attempts) -ge 2"
+	ctx := context.Background()
+	tests := []struct {
+		script   string
+		retries  map[string]int
+		attempts int
+		success  bool
+	}{
+		{flaky, map[string]int{name: 1}, 2, true},
+		{flaky, nil, 1, false},
+		{"touch leftover; exit 1", map[string]int{name: 2}, 3, false},
+	}
+	for i, tt := range tests {
+		testDir := filepath.Join(dir, string(rune('a'+i)))
+		err := os.Mkdir(testDir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		sm := newSolverMonitor(conslogging.Current(conslogging.NoColor).WithWriter(&buf))
+		s := &solver{sm: sm}
+		attempts := 0
+		err = s.solveWithRetries(ctx, tt.retries, func() (*vertexMonitor, error) {
+			attempts++
+			// As with buildkit, each attempt executes the command in a new copy of the
+			// filesystem the command started from.
+			rootfs, err := ioutil.TempDir(testDir, "rootfs")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cmd := exec.Command("/bin/sh", "-c", tt.script)
+			cmd.Dir = rootfs
+			runErr := cmd.Run()
+			if runErr == nil {
+				return nil, nil
+			}
+			vm, err := sm.handleStatus(ctx, &client.SolveStatus{
+				Vertexes: []*client.Vertex{{Digest: digest.FromString(name), Name: name, Error: runErr.Error()}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return vm, runErr
+		})
+		if attempts != tt.attempts {
+			t.Errorf("%d: expected %d attempts, got %d", i, tt.attempts, attempts)
+		}
+		if tt.success != (err == nil) {
+			t.Errorf("%d: unexpected error %v", i, err)
+		}
+		if err != nil && strings.Contains(err.Error(), "exit status 2") {
+			t.Errorf("%d: expected the file of the failed attempt not to be visible to the next one", i)
+		}
+		retried := strings.Contains(buf.String(), "Command RUN --retry 1 ./flaky.sh failed. Retrying")
+		if retried != (tt.attempts > 1) {
+			t.Errorf("%d: unexpected output %q", i, buf.String())
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/earthly/earthly/logging"
+	"github.com/moby/buildkit/client/llb"
+	reccopy "github.com/otiai10/copy"
+	"github.com/pkg/errors"
+)
+
+const (
+	sbomScannerImage = "docker.io/anchore/syft:v0.12.4"
+	sbomRootfsPath   = "/rootfs"
+	sbomOutDir       = "/sbom"
+	sbomFileName     = "sbom.json"
+)
+
+// SBOMFormats lists the SBOM formats which can be generated for saved images.
+var SBOMFormats = []string{"spdx-json", "cyclonedx-json"}
+
+// ValidateSBOMFormat returns an error if the format is not supported.
+func ValidateSBOMFormat(format string) error {
+	for _, f := range SBOMFormats {
+		if f == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid SBOM format %s. Supported formats: %s", format, strings.Join(SBOMFormats, ", "))
+}
+
+func (b *Builder) buildSBOM(ctx context.Context, imageToSave earthfile2llb.SaveImage, localDirs map[string]string, states *earthfile2llb.SingleTargetStates, opt BuildOpt) error {
+	console := b.console.WithPrefixAndSalt(states.Target.String(), states.Salt)
+	solveCtx := logging.With(ctx, "image", imageToSave.DockerTag)
+	solveCtx = logging.With(solveCtx, "solve", "sbom")
+	// The scanner runs for the platform of the target, as per FROM --platform, such as
+	// to report the packages of the image for that platform.
+	sbomState := llb.Image(sbomScannerImage, llb.Platform(states.Platform)).Run(
+		llb.Args([]string{
+			"/syft", fmt.Sprintf("dir:%s", sbomRootfsPath),
+			"-o", opt.SBOMFormat,
+			"--file", filepath.ToSlash(filepath.Join(sbomOutDir, sbomFileName)),
+		}),
+		llb.AddMount(sbomRootfsPath, imageToSave.State, llb.Readonly),
+		llb.WithCustomNamef(
+			"%sSBOM %s (%s)", vertexPrefix(states), imageToSave.DockerTag, opt.SBOMFormat),
+	).AddMount(sbomOutDir, llb.Scratch().Platform(states.Platform))
+
+	outDir, err := ioutil.TempDir(".", ".tmp-earth-sbom")
+	if err != nil {
+		return errors.Wrap(err, "mk temp dir for sbom")
+	}
+	defer os.RemoveAll(outDir)
+	err = b.solverFor(states).solveArtifacts(solveCtx, localDirs, sbomState, outDir)
+	if err != nil {
+		return errors.Wrapf(err, "solve sbom for %s", imageToSave.DockerTag)
+	}
+
+	err = os.MkdirAll(opt.SBOMDir, 0755)
+	if err != nil {
+		return errors.Wrapf(err, "mkdir all %s", opt.SBOMDir)
+	}
+	dest := filepath.Join(opt.SBOMDir, sbomLocalFileName(imageToSave.DockerTag, opt.SBOMFormat))
+	err = os.Rename(filepath.Join(outDir, sbomFileName), dest)
+	if err != nil {
+		// Rename did not work (possibly a different device). Try copying.
+		errCopy := reccopy.Copy(filepath.Join(outDir, sbomFileName), dest)
+		if errCopy != nil {
+			return errors.Wrapf(errCopy, "copy sbom to %s", dest)
+		}
+	}
+	console.Printf("SBOM of %s as local %s\n", imageToSave.DockerTag, dest)
+	return b.completeAttestation(ctx, console, sbomAttestation, imageToSave.DockerTag, dest, states, opt)
+}
+
+func sbomLocalFileName(dockerTag string, format string) string {
+	return fmt.Sprintf("%s.%s", localFileName(dockerTag), strings.Replace(format, "-json", ".json", 1))
+}
+
+// localFileName turns an image or artifact name into a name which can be used as
+// a local file name.
+func localFileName(name string) string {
+	return strings.NewReplacer("/", "_", ":", "_", "@", "_", "+", "").Replace(name)
+}
+
+func vertexPrefix(states *earthfile2llb.SingleTargetStates) string {
+	return fmt.Sprintf("[%s %s] ", states.Target.String(), states.Salt)
+}
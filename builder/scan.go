@@ -0,0 +1,313 @@
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/earthly/earthly/errcode"
+	"github.com/pkg/errors"
+)
+
+// Severity is the severity of a vulnerability. Higher is more severe.
+type Severity int
+
+const (
+	// SeverityNone is the threshold which no vulnerability reaches.
+	SeverityNone Severity = iota
+	// SeverityUnknown is the severity of the vulnerabilities the scanner could not
+	// rate.
+	SeverityUnknown
+	// SeverityLow is a low severity.
+	SeverityLow
+	// SeverityMedium is a medium severity.
+	SeverityMedium
+	// SeverityHigh is a high severity.
+	SeverityHigh
+	// SeverityCritical is a critical severity.
+	SeverityCritical
+)
+
+var severityNames = []string{"none", "unknown", "low", "medium", "high", "critical"}
+
+func (s Severity) String() string {
+	if s < 0 || int(s) >= len(severityNames) {
+		return fmt.Sprintf("severity(%d)", int(s))
+	}
+	return severityNames[s]
+}
+
+// ParseSeverity parses a severity threshold, as one of none, unknown, low, medium,
+// high or critical (case insensitive).
+func ParseSeverity(str string) (Severity, error) {
+	for i, name := range severityNames {
+		if strings.EqualFold(str, name) {
+			return Severity(i), nil
+		}
+	}
+	return SeverityNone, fmt.Errorf("invalid severity %s, expected one of %s", str, strings.Join(severityNames, ", "))
+}
+
+// scannerSeverity maps the severity reported by a scanner.
+func scannerSeverity(str string) Severity {
+	switch strings.ToLower(str) {
+	case "negligible", "low":
+		return SeverityLow
+	case "medium":
+		return SeverityMedium
+	case "high":
+		return SeverityHigh
+	case "critical":
+		return SeverityCritical
+	default:
+		return SeverityUnknown
+	}
+}
+
+// Vulnerability is a vulnerability found in an image.
+type Vulnerability struct {
+	ID           string
+	Package      string
+	Version      string
+	FixedVersion string
+	Severity     Severity
+}
+
+// Scanner scans images for vulnerabilities.
+type Scanner interface {
+	// Name returns the name of the scanner, for the output of the build.
+	Name() string
+	// Scan returns the vulnerabilities of the image of the given name, as loaded into
+	// the docker daemon.
+	Scan(ctx context.Context, image string) ([]Vulnerability, error)
+}
+
+// Scanners lists the names of the supported scanners. See NewScanner.
+var Scanners = []string{"trivy", "grype"}
+
+// NewScanner returns the scanner of the given name, which runs the CLI of the same
+// name. It needs to be installed.
+func NewScanner(name string) (Scanner, error) {
+	switch name {
+	case "trivy":
+		return trivyScanner{}, nil
+	case "grype":
+		return grypeScanner{}, nil
+	default:
+		return nil, fmt.Errorf("invalid scanner %s, expected one of %s", name, strings.Join(Scanners, ", "))
+	}
+}
+
+// ScanOpt holds the settings of the vulnerability scan of the images, before they are
+// pushed.
+type ScanOpt struct {
+	// Scanner scans the images. The images are not scanned if nil.
+	Scanner Scanner
+	// FailOn is the severity from which vulnerabilities prevent the push of the image.
+	FailOn Severity
+	// WarnOn is the severity from which vulnerabilities are printed as warnings.
+	WarnOn Severity
+}
+
+// ScanError is the reason why the push of an image was prevented by its vulnerability
+// scan.
+type ScanError struct {
+	Image string
+	// Found is the number of vulnerabilities of severity FailOn or above.
+	Found  int
+	FailOn Severity
+}
+
+func (se *ScanError) Error() string {
+	return fmt.Sprintf("vulnerability scan of %s found %d vulnerabilities of severity %s or above", se.Image, se.Found, se.FailOn)
+}
+
+// ErrorCategory implements errcode.Categorized.
+func (se *ScanError) ErrorCategory() errcode.Category {
+	return errcode.PushFailure
+}
+
+// scanImage scans the image, which was exported to docker, before it is pushed. It
+// returns a ScanError if vulnerabilities of severity opt.Scan.FailOn or above were
+// found.
+func (b *Builder) scanImage(ctx context.Context, imageToSave earthfile2llb.SaveImage, states *earthfile2llb.SingleTargetStates, opt BuildOpt) error {
+	scanner := opt.Scan.Scanner
+	if scanner == nil {
+		return nil
+	}
+	console := b.console.WithPrefixAndSalt(states.Target.String(), states.Salt)
+	console.Printf("Scanning %s for vulnerabilities with %s\n", imageToSave.DockerTag, scanner.Name())
+	vulns, err := scanner.Scan(ctx, imageToSave.DockerTag)
+	if err != nil {
+		return errors.Wrapf(err, "scan %s", imageToSave.DockerTag)
+	}
+	sortVulnerabilities(vulns)
+	failed := 0
+	for _, v := range vulns {
+		if opt.Scan.FailOn != SeverityNone && v.Severity >= opt.Scan.FailOn {
+			failed++
+		}
+		if opt.Scan.WarnOn != SeverityNone && v.Severity >= opt.Scan.WarnOn {
+			console.Warnf("%s\n", formatVulnerability(v))
+		}
+	}
+	console.Printf("Scanned %s: %s\n", imageToSave.DockerTag, countSeverities(vulns))
+	if failed > 0 {
+		return &ScanError{Image: imageToSave.DockerTag, Found: failed, FailOn: opt.Scan.FailOn}
+	}
+	return nil
+}
+
+// sortVulnerabilities sorts the vulnerabilities from the most severe to the least.
+func sortVulnerabilities(vulns []Vulnerability) {
+	sort.SliceStable(vulns, func(i, j int) bool {
+		if vulns[i].Severity != vulns[j].Severity {
+			return vulns[i].Severity > vulns[j].Severity
+		}
+		return vulns[i].ID < vulns[j].ID
+	})
+}
+
+func formatVulnerability(v Vulnerability) string {
+	fixed := "no fix available"
+	if v.FixedVersion != "" {
+		fixed = "fixed in " + v.FixedVersion
+	}
+	return fmt.Sprintf("%s (%s) in %s %s, %s", v.ID, v.Severity, v.Package, v.Version, fixed)
+}
+
+// countSeverities returns the number of vulnerabilities of each severity, from the
+// most severe.
+func countSeverities(vulns []Vulnerability) string {
+	if len(vulns) == 0 {
+		return "no vulnerabilities"
+	}
+	counts := make(map[Severity]int)
+	for _, v := range vulns {
+		counts[v.Severity]++
+	}
+	var parts []string
+	for s := SeverityCritical; s > SeverityNone; s-- {
+		if counts[s] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[s], s))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// runScanner runs a scanner CLI and returns its output. Its progress is left to go
+// to stderr.
+func runScanner(ctx context.Context, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s %s", name, strings.Join(args, " "))
+	}
+	return out, nil
+}
+
+type trivyScanner struct{}
+
+func (trivyScanner) Name() string {
+	return "trivy"
+}
+
+func (trivyScanner) Scan(ctx context.Context, image string) ([]Vulnerability, error) {
+	out, err := runScanner(ctx, "trivy", "image", "--quiet", "--format", "json", image)
+	if err != nil {
+		return nil, err
+	}
+	return parseTrivyReport(out)
+}
+
+type trivyResult struct {
+	Vulnerabilities []struct {
+		VulnerabilityID  string
+		PkgName          string
+		InstalledVersion string
+		FixedVersion     string
+		Severity         string
+	}
+}
+
+// parseTrivyReport parses the JSON report of trivy. Older versions of trivy output the
+// list of results directly, rather than as part of a report object.
+func parseTrivyReport(out []byte) ([]Vulnerability, error) {
+	var report struct {
+		Results []trivyResult
+	}
+	err := json.Unmarshal(out, &report)
+	if err != nil {
+		err = json.Unmarshal(out, &report.Results)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse trivy report")
+		}
+	}
+	var vulns []Vulnerability
+	for _, result := range report.Results {
+		for _, v := range result.Vulnerabilities {
+			vulns = append(vulns, Vulnerability{
+				ID:           v.VulnerabilityID,
+				Package:      v.PkgName,
+				Version:      v.InstalledVersion,
+				FixedVersion: v.FixedVersion,
+				Severity:     scannerSeverity(v.Severity),
+			})
+		}
+	}
+	return vulns, nil
+}
+
+type grypeScanner struct{}
+
+func (grypeScanner) Name() string {
+	return "grype"
+}
+
+func (grypeScanner) Scan(ctx context.Context, image string) ([]Vulnerability, error) {
+	out, err := runScanner(ctx, "grype", "--quiet", "--output", "json", "docker:"+image)
+	if err != nil {
+		return nil, err
+	}
+	return parseGrypeReport(out)
+}
+
+// parseGrypeReport parses the JSON report of grype.
+func parseGrypeReport(out []byte) ([]Vulnerability, error) {
+	var report struct {
+		Matches []struct {
+			Vulnerability struct {
+				ID       string `json:"id"`
+				Severity string `json:"severity"`
+				Fix      struct {
+					Versions []string `json:"versions"`
+				} `json:"fix"`
+			} `json:"vulnerability"`
+			Artifact struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			} `json:"artifact"`
+		} `json:"matches"`
+	}
+	err := json.Unmarshal(out, &report)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse grype report")
+	}
+	var vulns []Vulnerability
+	for _, m := range report.Matches {
+		vulns = append(vulns, Vulnerability{
+			ID:           m.Vulnerability.ID,
+			Package:      m.Artifact.Name,
+			Version:      m.Artifact.Version,
+			FixedVersion: strings.Join(m.Vulnerability.Fix.Versions, ", "),
+			Severity:     scannerSeverity(m.Vulnerability.Severity),
+		})
+	}
+	return vulns, nil
+}
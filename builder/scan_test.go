@@ -0,0 +1,119 @@
+package builder
+
+import (
+	"context"
+	"testing"
+
+	"github.com/earthly/earthly/conslogging"
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/earthly/earthly/errcode"
+)
+
+func TestParseSeverity(t *testing.T) {
+	s, err := ParseSeverity("HIGH")
+	if err != nil || s != SeverityHigh {
+		t.Errorf("expected high, got %v %v", s, err)
+	}
+	s, err = ParseSeverity("none")
+	if err != nil || s != SeverityNone {
+		t.Errorf("expected none, got %v %v", s, err)
+	}
+	_, err = ParseSeverity("severe")
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestParseTrivyReport(t *testing.T) {
+	report := `{"SchemaVersion": 2, "Results": [
+		{"Target": "alpine:3.12 (alpine 3.12.0)", "Vulnerabilities": [
+			{"VulnerabilityID": "CVE-2021-3711", "PkgName": "libssl1.1", "InstalledVersion": "1.1.1g-r0", "FixedVersion": "1.1.1l-r0", "Severity": "CRITICAL"},
+			{"VulnerabilityID": "CVE-2021-0001", "PkgName": "busybox", "InstalledVersion": "1.31.1-r16", "Severity": "UNKNOWN"}
+		]},
+		{"Target": "app/go.sum", "Vulnerabilities": null}
+	]}`
+	vulns, err := parseTrivyReport([]byte(report))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vulns) != 2 || vulns[0].Severity != SeverityCritical || vulns[0].FixedVersion != "1.1.1l-r0" ||
+		vulns[1].Severity != SeverityUnknown {
+		t.Errorf("unexpected vulnerabilities %+v", vulns)
+	}
+	// Older versions of trivy.
+	vulns, err = parseTrivyReport([]byte(`[{"Target": "x", "Vulnerabilities": [{"VulnerabilityID": "CVE-1", "Severity": "LOW"}]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vulns) != 1 || vulns[0].ID != "CVE-1" || vulns[0].Severity != SeverityLow {
+		t.Errorf("unexpected vulnerabilities %+v", vulns)
+	}
+}
+
+func TestParseGrypeReport(t *testing.T) {
+	report := `{"matches": [
+		{"vulnerability": {"id": "CVE-2021-3711", "severity": "Critical", "fix": {"versions": ["1.1.1l-r0"]}},
+		 "artifact": {"name": "libssl1.1", "version": "1.1.1g-r0"}},
+		{"vulnerability": {"id": "CVE-2020-0002", "severity": "Negligible", "fix": {"versions": []}},
+		 "artifact": {"name": "musl", "version": "1.1.24-r8"}}
+	]}`
+	vulns, err := parseGrypeReport([]byte(report))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vulns) != 2 || vulns[0].Package != "libssl1.1" || vulns[0].FixedVersion != "1.1.1l-r0" ||
+		vulns[1].Severity != SeverityLow {
+		t.Errorf("unexpected vulnerabilities %+v", vulns)
+	}
+}
+
+type fakeScanner struct {
+	vulns []Vulnerability
+}
+
+func (fs fakeScanner) Name() string {
+	return "fake"
+}
+
+func (fs fakeScanner) Scan(ctx context.Context, image string) ([]Vulnerability, error) {
+	return fs.vulns, nil
+}
+
+func TestScanImage(t *testing.T) {
+	b := &Builder{console: conslogging.Current(conslogging.NoColor)}
+	states := &earthfile2llb.SingleTargetStates{Target: domain.Target{LocalPath: ".", Target: "docker"}}
+	imageToSave := earthfile2llb.SaveImage{DockerTag: "app:latest"}
+	scanner := fakeScanner{vulns: []Vulnerability{
+		{ID: "CVE-1", Severity: SeverityMedium},
+		{ID: "CVE-2", Severity: SeverityHigh},
+		{ID: "CVE-3", Severity: SeverityCritical},
+	}}
+	tests := []struct {
+		failOn   Severity
+		expected int
+	}{
+		{SeverityNone, 0},
+		{SeverityCritical, 1},
+		{SeverityHigh, 2},
+		{SeverityLow, 3},
+	}
+	for _, tt := range tests {
+		opt := BuildOpt{Scan: ScanOpt{Scanner: scanner, FailOn: tt.failOn, WarnOn: SeverityHigh}}
+		err := b.scanImage(context.Background(), imageToSave, states, opt)
+		if tt.expected == 0 {
+			if err != nil {
+				t.Errorf("fail on %s: unexpected error %v", tt.failOn, err)
+			}
+			continue
+		}
+		se, ok := err.(*ScanError)
+		if !ok || se.Found != tt.expected {
+			t.Errorf("fail on %s: expected %d vulnerabilities, got %v", tt.failOn, tt.expected, err)
+			continue
+		}
+		if errcode.CategoryOf(err) != errcode.PushFailure {
+			t.Errorf("expected a push failure, got %s", errcode.CategoryOf(err))
+		}
+	}
+}
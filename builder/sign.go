@@ -0,0 +1,128 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/docker/distribution/reference"
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/pkg/errors"
+)
+
+// cosignPasswordEnvVar is the env var cosign reads the password of the private key
+// from.
+const cosignPasswordEnvVar = "COSIGN_PASSWORD"
+
+// SignOpt holds the settings used for signing pushed images.
+type SignOpt struct {
+	// Enabled turns on signing of pushed images.
+	Enabled bool
+	// Key is the cosign private key to sign with. Keyless signing is used if nil. An
+	// empty key (such as an empty secret) is an error.
+	Key []byte
+	// KeyPassword is the password of the Key, passed to cosign as COSIGN_PASSWORD. If
+	// nil, the COSIGN_PASSWORD env var of earth is used, if set.
+	KeyPassword []byte
+}
+
+// Validate returns an error if the key cannot be used for signing: if it is empty, or
+// if it is encrypted and no password is set, in which case cosign would prompt for it.
+func (so SignOpt) Validate() error {
+	if so.Key == nil {
+		return nil
+	}
+	if len(so.Key) == 0 {
+		return errors.New("the signing key is empty")
+	}
+	if so.KeyPassword != nil {
+		return nil
+	}
+	if _, found := os.LookupEnv(cosignPasswordEnvVar); !found && bytes.Contains(so.Key, []byte("ENCRYPTED")) {
+		return fmt.Errorf(
+			"the signing key is encrypted, but no password is set. Use --sign-key-password-secret, or set %s",
+			cosignPasswordEnvVar)
+	}
+	return nil
+}
+
+func (b *Builder) signImage(ctx context.Context, imageToSave earthfile2llb.SaveImage, states *earthfile2llb.SingleTargetStates, opt BuildOpt) error {
+	console := b.console.WithPrefixAndSalt(states.Target.String(), states.Salt)
+	dgst, err := b.imageDigest(ctx, imageToSave.DockerTag, true)
+	if err != nil {
+		return err
+	}
+	imageRef, err := digestRef(imageToSave.DockerTag, dgst)
+	if err != nil {
+		return err
+	}
+	err = cosignSign(ctx, imageRef, opt.Sign)
+	if err != nil {
+		return err
+	}
+	console.Printf("Signed %s\n", imageRef)
+	return nil
+}
+
+// digestRef returns the reference of the pushed image of the given tag by digest. The
+// images are always signed and attested by digest, such that the signature cannot end
+// up attached to a different image, if the tag is moved in the meantime.
+func digestRef(dockerTag string, dgst string) (string, error) {
+	ref, err := reference.ParseNormalizedNamed(dockerTag)
+	if err != nil {
+		return "", errors.Wrapf(err, "parse normalized named %s", dockerTag)
+	}
+	return fmt.Sprintf("%s@%s", ref.Name(), dgst), nil
+}
+
+func cosignSign(ctx context.Context, imageRef string, so SignOpt) error {
+	keyArgs, env, keyDir, err := cosignKeyArgs(so)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(keyDir)
+	args := append([]string{"sign"}, keyArgs...)
+	args = append(args, imageRef)
+	cmd := exec.CommandContext(ctx, "cosign", args...)
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return errors.Wrapf(err, "cosign sign %s", imageRef)
+	}
+	return nil
+}
+
+// cosignKeyArgs returns the cosign args and env to sign with the private key of so, or
+// to sign keyless if the key is nil. The key is written to a temp dir, which the caller
+// needs to remove. The dir is empty if there is no key.
+func cosignKeyArgs(so SignOpt) ([]string, []string, string, error) {
+	key := so.Key
+	env := os.Environ()
+	if key == nil {
+		return nil, append(env, "COSIGN_EXPERIMENTAL=1"), "", nil
+	}
+	err := so.Validate()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if so.KeyPassword != nil {
+		env = append(env, fmt.Sprintf("%s=%s", cosignPasswordEnvVar, so.KeyPassword))
+	}
+	keyDir, err := ioutil.TempDir("", "earthly-cosign")
+	if err != nil {
+		return nil, nil, "", errors.Wrap(err, "make temp dir for signing key")
+	}
+	keyPath := filepath.Join(keyDir, "cosign.key")
+	err = ioutil.WriteFile(keyPath, key, 0600)
+	if err != nil {
+		os.RemoveAll(keyDir)
+		return nil, nil, "", errors.Wrap(err, "write signing key")
+	}
+	return []string{"--key", keyPath}, env, keyDir, nil
+}
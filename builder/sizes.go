@@ -0,0 +1,314 @@
+package builder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/pkg/errors"
+)
+
+// sizeReport is the size of the outputs of a build.
+type sizeReport struct {
+	Artifacts []artifactSize `json:"artifacts"`
+	Images    []imageSize    `json:"images"`
+	// Regressions are the outputs which grew beyond the threshold, compared to the
+	// baseline.
+	Regressions []sizeRegression `json:"regressions,omitempty"`
+}
+
+// artifactSize is the total size of the files of an artifact saved locally.
+type artifactSize struct {
+	Artifact string `json:"artifact"`
+	Files    int    `json:"files"`
+	Size     int64  `json:"size"`
+}
+
+// imageSize is the size of an image loaded into docker, including its base image.
+type imageSize struct {
+	Target string `json:"target"`
+	Image  string `json:"image"`
+	Size   int64  `json:"size"`
+	// Layers are the non-empty layers of the image, from the bottom one up.
+	Layers []layerSize `json:"layers"`
+}
+
+type layerSize struct {
+	// CreatedBy is the command which created the layer, if known.
+	CreatedBy string `json:"createdBy,omitempty"`
+	Size      int64  `json:"size"`
+}
+
+// sizeRegression is an artifact or image which grew compared to the baseline.
+type sizeRegression struct {
+	Artifact     string `json:"artifact,omitempty"`
+	Image        string `json:"image,omitempty"`
+	BaselineSize int64  `json:"baselineSize"`
+	Size         int64  `json:"size"`
+	// Layers are the layers of the image which are new or grew, compared to the layer
+	// at the same position in the baseline.
+	Layers []layerSize `json:"layers,omitempty"`
+}
+
+// recordImageSize records the size of an image loaded into docker, for the size
+// report.
+func (b *Builder) recordImageSize(ctx context.Context, imageToSave earthfile2llb.SaveImage, states *earthfile2llb.SingleTargetStates) {
+	size, layers, err := dockerImageSize(ctx, imageToSave.DockerTag)
+	if err != nil {
+		// The rest of the report is still useful.
+		b.console.Warnf("Warning: could not determine the size of %s: %v\n", imageToSave.DockerTag, err)
+		return
+	}
+	b.imageSizes = append(b.imageSizes, imageSize{
+		Target: states.Target.StringCanonical(),
+		Image:  imageToSave.DockerTag,
+		Size:   size,
+		Layers: layers,
+	})
+}
+
+// dockerImageSize returns the size of the image, as known by the docker daemon, and
+// its non-empty layers.
+func dockerImageSize(ctx context.Context, imageName string) (int64, []layerSize, error) {
+	out, err := exec.CommandContext(ctx, "docker", "image", "inspect", "--format", "{{.Size}}", imageName).Output()
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "docker image inspect %s", imageName)
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "parse size of %s", imageName)
+	}
+	out, err = exec.CommandContext(
+		ctx, "docker", "history", "--no-trunc", "--human=false",
+		"--format", "{{.Size}}\t{{.CreatedBy}}", imageName).Output()
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "docker history %s", imageName)
+	}
+	layers, err := parseDockerHistory(out)
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "parse history of %s", imageName)
+	}
+	return size, layers, nil
+}
+
+// parseDockerHistory parses the output of docker history, as formatted by
+// dockerImageSize. The entries which did not create a layer are left out.
+func parseDockerHistory(out []byte) ([]layerSize, error) {
+	var layers []layerSize
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "\t", 2)
+		size, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse layer size %q", parts[0])
+		}
+		if size == 0 {
+			continue
+		}
+		layer := layerSize{Size: size}
+		if len(parts) == 2 {
+			layer.CreatedBy = strings.TrimSpace(parts[1])
+		}
+		// Listed from the top layer down.
+		layers = append([]layerSize{layer}, layers...)
+	}
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	return layers, nil
+}
+
+// artifactSizes returns the sizes of the artifacts saved locally, from the files
+// recorded for their checksums, in the order of their paths.
+func (b *Builder) artifactSizes() []artifactSize {
+	sizes := []artifactSize{}
+	indices := make(map[string]int)
+	for _, c := range b.savedChecksums() {
+		i, found := indices[c.Artifact]
+		if !found {
+			i = len(sizes)
+			indices[c.Artifact] = i
+			sizes = append(sizes, artifactSize{Artifact: c.Artifact})
+		}
+		sizes[i].Files++
+		sizes[i].Size += c.Size
+	}
+	return sizes
+}
+
+// ReportSizes prints the size of each artifact and image output by the build. If
+// opt.SizeBaselinePath is set, the outputs which grew beyond
+// opt.SizeRegressionThreshold percent compared to the baseline are flagged. The
+// baseline is written with the current sizes if it does not exist.
+func (b *Builder) ReportSizes(opt BuildOpt) error {
+	if !opt.SizeReport {
+		return nil
+	}
+	report := &sizeReport{
+		Artifacts: b.artifactSizes(),
+		Images:    append([]imageSize{}, b.imageSizes...),
+	}
+	b.sizeReport = report
+	b.printSizes(report)
+	if opt.SizeBaselinePath == "" {
+		return nil
+	}
+	baseline, err := loadSizeBaseline(opt.SizeBaselinePath)
+	if err != nil {
+		return err
+	}
+	if baseline == nil {
+		err = writeSizeBaseline(opt.SizeBaselinePath, report)
+		if err != nil {
+			return err
+		}
+		b.console.Printf("Size baseline as local %s\n", opt.SizeBaselinePath)
+		return nil
+	}
+	report.Regressions = compareSizes(baseline, report, opt.SizeRegressionThreshold)
+	for _, r := range report.Regressions {
+		name := r.Artifact
+		if name == "" {
+			name = r.Image
+		}
+		b.console.Warnf("Warning: %s grew from %s to %s (%s) compared to the baseline %s\n",
+			name, formatSize(r.BaselineSize), formatSize(r.Size), formatGrowth(r.BaselineSize, r.Size), opt.SizeBaselinePath)
+		for _, l := range r.Layers {
+			b.console.Warnf("  %10s  %s\n", formatSize(l.Size), l.CreatedBy)
+		}
+	}
+	return nil
+}
+
+func (b *Builder) printSizes(report *sizeReport) {
+	if len(report.Artifacts) == 0 && len(report.Images) == 0 {
+		return
+	}
+	b.console.Printf("Output sizes:\n")
+	for _, a := range report.Artifacts {
+		b.console.Printf("  %10s  %s (%d files)\n", formatSize(a.Size), a.Artifact, a.Files)
+	}
+	for _, img := range report.Images {
+		b.console.Printf("  %10s  %s (%s)\n", formatSize(img.Size), img.Image, img.Target)
+		for _, l := range img.Layers {
+			b.console.Printf("    %10s  %s\n", formatSize(l.Size), l.CreatedBy)
+		}
+	}
+}
+
+// compareSizes returns the artifacts and images of report which grew by more than
+// threshold percent compared to baseline. Outputs not in the baseline are not
+// compared.
+func compareSizes(baseline *sizeReport, report *sizeReport, threshold float64) []sizeRegression {
+	var regressions []sizeRegression
+	baselineArtifacts := make(map[string]artifactSize)
+	for _, a := range baseline.Artifacts {
+		baselineArtifacts[a.Artifact] = a
+	}
+	for _, a := range report.Artifacts {
+		ba, found := baselineArtifacts[a.Artifact]
+		if found && grewBeyond(ba.Size, a.Size, threshold) {
+			regressions = append(regressions, sizeRegression{
+				Artifact:     a.Artifact,
+				BaselineSize: ba.Size,
+				Size:         a.Size,
+			})
+		}
+	}
+	baselineImages := make(map[string]imageSize)
+	for _, img := range baseline.Images {
+		baselineImages[img.Image] = img
+	}
+	for _, img := range report.Images {
+		bimg, found := baselineImages[img.Image]
+		if !found || !grewBeyond(bimg.Size, img.Size, threshold) {
+			continue
+		}
+		r := sizeRegression{
+			Image:        img.Image,
+			BaselineSize: bimg.Size,
+			Size:         img.Size,
+		}
+		for i, l := range img.Layers {
+			if i < len(bimg.Layers) && bimg.Layers[i].CreatedBy == l.CreatedBy && bimg.Layers[i].Size >= l.Size {
+				continue
+			}
+			r.Layers = append(r.Layers, l)
+		}
+		regressions = append(regressions, r)
+	}
+	return regressions
+}
+
+func grewBeyond(baselineSize int64, size int64, threshold float64) bool {
+	if size <= baselineSize {
+		return false
+	}
+	if baselineSize == 0 {
+		return true
+	}
+	return float64(size-baselineSize)/float64(baselineSize)*100 > threshold
+}
+
+// loadSizeBaseline reads the size baseline from path. Nil if it does not exist.
+func loadSizeBaseline(path string) (*sizeReport, error) {
+	dt, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "read size baseline %s", path)
+	}
+	var baseline sizeReport
+	err = json.Unmarshal(dt, &baseline)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse size baseline %s", path)
+	}
+	return &baseline, nil
+}
+
+func writeSizeBaseline(path string, report *sizeReport) error {
+	baseline := sizeReport{
+		Artifacts: report.Artifacts,
+		Images:    report.Images,
+	}
+	dt, err := json.MarshalIndent(baseline, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "json marshal size baseline")
+	}
+	dir := filepath.Dir(path)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return errors.Wrapf(err, "mkdir all %s", dir)
+	}
+	err = ioutil.WriteFile(path, dt, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "write size baseline %s", path)
+	}
+	return nil
+}
+
+func formatSize(size int64) string {
+	return fmt.Sprintf("%.1f MB", float64(size)/1e6)
+}
+
+func formatGrowth(baselineSize int64, size int64) string {
+	if baselineSize == 0 {
+		return fmt.Sprintf("+%s", formatSize(size))
+	}
+	return fmt.Sprintf("+%.0f%%", float64(size-baselineSize)/float64(baselineSize)*100)
+}
@@ -0,0 +1,117 @@
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/earthly/earthly/conslogging"
+)
+
+func TestParseDockerHistory(t *testing.T) {
+	out := "1200000\t/bin/sh -c go build -o app\n" +
+		"0\t/bin/sh -c #(nop)  CMD [\"/app\"]\n" +
+		"\n" +
+		"5600000\t\n"
+	layers, err := parseDockerHistory([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 2 ||
+		layers[0].Size != 5600000 || layers[0].CreatedBy != "" ||
+		layers[1].Size != 1200000 || layers[1].CreatedBy != "/bin/sh -c go build -o app" {
+		t.Errorf("unexpected layers %+v", layers)
+	}
+	_, err = parseDockerHistory([]byte("12MB\tRUN x\n"))
+	if err == nil {
+		t.Error("expected an error for a human readable size")
+	}
+}
+
+func TestCompareSizes(t *testing.T) {
+	baseline := &sizeReport{
+		Artifacts: []artifactSize{
+			{Artifact: "+build/app", Size: 1000},
+			{Artifact: "+build/docs", Size: 1000},
+			{Artifact: "+build/empty", Size: 0},
+		},
+		Images: []imageSize{{
+			Image: "app:latest", Size: 10000,
+			Layers: []layerSize{{CreatedBy: "base", Size: 8000}, {CreatedBy: "RUN go build", Size: 2000}},
+		}},
+	}
+	report := &sizeReport{
+		Artifacts: []artifactSize{
+			{Artifact: "+build/app", Size: 1200},
+			{Artifact: "+build/docs", Size: 1050},
+			{Artifact: "+build/empty", Size: 10},
+			{Artifact: "+build/new", Size: 5000},
+		},
+		Images: []imageSize{{
+			Image: "app:latest", Size: 50000,
+			Layers: []layerSize{
+				{CreatedBy: "base", Size: 8000},
+				{CreatedBy: "RUN go build", Size: 2000},
+				{CreatedBy: "RUN apt-get install", Size: 40000},
+			},
+		}},
+	}
+	regressions := compareSizes(baseline, report, 10)
+	if len(regressions) != 3 {
+		t.Fatalf("unexpected regressions %+v", regressions)
+	}
+	if regressions[0].Artifact != "+build/app" || regressions[0].BaselineSize != 1000 {
+		t.Errorf("unexpected regression %+v", regressions[0])
+	}
+	if regressions[1].Artifact != "+build/empty" {
+		t.Errorf("unexpected regression %+v", regressions[1])
+	}
+	img := regressions[2]
+	if img.Image != "app:latest" || len(img.Layers) != 1 || img.Layers[0].CreatedBy != "RUN apt-get install" {
+		t.Errorf("unexpected regression %+v", img)
+	}
+}
+
+func TestReportSizes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "earth-sizes-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := &Builder{
+		console: conslogging.Current(conslogging.NoColor),
+		checksums: []artifactChecksum{
+			{Path: "out/app", Artifact: "+build/app", Size: 1000},
+			{Path: "out/lib/a.so", Artifact: "+build/lib", Size: 200},
+			{Path: "out/lib/b.so", Artifact: "+build/lib", Size: 300},
+		},
+		imageSizes: []imageSize{{Target: "+build", Image: "app:latest", Size: 10000}},
+	}
+	opt := BuildOpt{
+		SizeReport:              true,
+		SizeBaselinePath:        filepath.Join(dir, "sizes.json"),
+		SizeRegressionThreshold: 10,
+	}
+	err = b.ReportSizes(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.sizeReport.Artifacts) != 2 || b.sizeReport.Artifacts[1].Files != 2 || b.sizeReport.Artifacts[1].Size != 500 {
+		t.Errorf("unexpected artifacts %+v", b.sizeReport.Artifacts)
+	}
+	if _, err := os.Stat(opt.SizeBaselinePath); err != nil {
+		t.Fatalf("expected the baseline to be written: %v", err)
+	}
+
+	// Compared with the baseline written by the previous build.
+	b.checksums[0].Size = 2000
+	err = b.ReportSizes(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.sizeReport.Regressions) != 1 || b.sizeReport.Regressions[0].Artifact != "+build/app" {
+		t.Errorf("unexpected regressions %+v", b.sizeReport.Regressions)
+	}
+}
@@ -4,11 +4,21 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"strings"
+	"time"
 
+	"github.com/docker/distribution/reference"
+	dockerclient "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/earthly/earthly/dockertar"
+	"github.com/earthly/earthly/earthfile2llb"
 	"github.com/earthly/earthly/earthfile2llb/image"
+	"github.com/earthly/earthly/errcode"
 	"github.com/earthly/earthly/llbutil"
 	"github.com/earthly/earthly/logging"
 	"github.com/golang/protobuf/proto"
@@ -17,6 +27,7 @@ import (
 	"github.com/moby/buildkit/session"
 	"github.com/moby/buildkit/solver/pb"
 	"github.com/moby/buildkit/util/entitlements"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"golang.org/x/sync/errgroup"
 )
@@ -27,15 +38,24 @@ type solver struct {
 	attachables []session.Attachable
 	enttlmnts   []entitlements.Entitlement
 	remoteCache string
+	// reproducible enables the normalization of the image archives output, such that
+	// they are reproducible, with epoch as their timestamps. See dockertar.Normalize.
+	reproducible bool
+	epoch        time.Time
+	// platform is the platform the buildkit daemon runs natively, if known. Only set
+	// for the workers of a pool.
+	platform *specs.Platform
 }
 
-func (s *solver) solveDocker(ctx context.Context, localDirs map[string]string, state llb.State, img *image.Image, dockerTag string, push bool) error {
-	dt, err := state.Marshal(ctx, llb.Platform(llbutil.TargetPlatform))
+// solveDocker solves the given state and loads the resulting image into the docker
+// daemon.
+func (s *solver) solveDocker(ctx context.Context, localDirs map[string]string, state llb.State, img *image.Image, dockerTag string, compression earthfile2llb.LayerCompression) error {
+	dt, err := s.marshal(ctx, state)
 	if err != nil {
 		return errors.Wrap(err, "state marshal")
 	}
 	pipeR, pipeW := io.Pipe()
-	solveOpt, err := s.newSolveOptDocker(img, dockerTag, localDirs, pipeW)
+	solveOpt, err := s.newSolveOptDocker(img, dockerTag, localDirs, pipeW, client.ExporterDocker, compression)
 	if err != nil {
 		return errors.Wrap(err, "new solve opt")
 	}
@@ -55,20 +75,14 @@ func (s *solver) solveDocker(ctx context.Context, localDirs map[string]string, s
 	eg.Go(func() error {
 		return s.sm.monitorProgress(ctx, ch)
 	})
+	tarR := s.normalized(eg, pipeR)
 	eg.Go(func() error {
-		defer pipeR.Close()
-		err := loadDockerTar(ctx, pipeR)
+		defer tarR.Close()
+		err := loadDockerTar(ctx, tarR)
 		if err != nil {
 			return errors.Wrapf(err, "load docker tar for %s", dockerTag)
 		}
 		logging.GetLogger(ctx).Info("Docker load success")
-		if push {
-			err := pushDockerImage(ctx, dockerTag)
-			if err != nil {
-				return err
-			}
-			logging.GetLogger(ctx).Info("Docker push success")
-		}
 		return nil
 	})
 	go func() {
@@ -80,22 +94,76 @@ func (s *solver) solveDocker(ctx context.Context, localDirs map[string]string, s
 			}
 		}
 	}()
-	err = eg.Wait()
+	return s.categorize(eg.Wait())
+}
+
+// pushImage pushes the image loaded into the docker daemon by solveDocker. When saved
+// with a non-default layer compression, or pushed to an insecure registry, the push is
+// performed by buildkit and the registry digest of the pushed image is returned.
+func (s *solver) pushImage(ctx context.Context, localDirs map[string]string, state llb.State, img *image.Image, dockerTag string, insecure bool, compression earthfile2llb.LayerCompression) (string, error) {
+	// Docker always pushes gzip-compressed layers, and only allows the insecure
+	// registries of its own settings. Anything else requires buildkit to push the image.
+	if compression.Type == "" && !insecure {
+		err := pushDockerImage(ctx, dockerTag)
+		if err != nil {
+			return "", err
+		}
+		logging.GetLogger(ctx).Info("Docker push success")
+		return "", nil
+	}
+	if s.reproducible {
+		if insecure {
+			return "", errors.New("pushing images with --insecure is not supported for reproducible images")
+		}
+		return "", errors.Errorf(
+			"pushing images saved with --compression %s is not supported for reproducible images", compression.Type)
+	}
+	pushCtx := logging.With(ctx, "solve", "image-push")
+	dgst, err := s.solveRegistry(pushCtx, localDirs, state, img, dockerTag, insecure, compression)
 	if err != nil {
-		return err
+		return "", errors.Wrapf(err, "push %s", dockerTag)
 	}
-	return nil
+	logging.GetLogger(ctx).Info("Buildkit push success")
+	return dgst, nil
 }
 
-func (s *solver) solveDockerTar(ctx context.Context, localDirs map[string]string, state llb.State, img *image.Image, dockerTag string, outFile string) error {
-	dt, err := state.Marshal(ctx, llb.Platform(llbutil.TargetPlatform))
+// solveDockerTar solves the given state into an image tar at outFile and returns
+// the ID of the resulting image. The tar is a docker archive, or an OCI archive if
+// oci is set.
+func (s *solver) solveDockerTar(ctx context.Context, localDirs map[string]string, state llb.State, img *image.Image, dockerTag string, outFile string, oci bool, compression earthfile2llb.LayerCompression) (string, error) {
+	file, err := os.Create(outFile)
 	if err != nil {
-		return errors.Wrap(err, "state marshal")
+		return "", errors.Wrapf(err, "open file %s for writing", outFile)
+	}
+	defer file.Close()
+	bufFile := bufio.NewWriter(file)
+	id, err := s.solveDockerTarTo(ctx, localDirs, state, img, dockerTag, bufFile, oci, compression)
+	if err != nil {
+		return "", err
+	}
+	err = bufFile.Flush()
+	if err != nil {
+		return "", errors.Wrapf(err, "flush %s", outFile)
+	}
+	return id, nil
+}
+
+// solveDockerTarTo solves the given state into an image tar written to w, and returns
+// the ID of the resulting image. The tar is a docker archive, or an OCI archive if oci
+// is set.
+func (s *solver) solveDockerTarTo(ctx context.Context, localDirs map[string]string, state llb.State, img *image.Image, dockerTag string, w io.Writer, oci bool, compression earthfile2llb.LayerCompression) (string, error) {
+	dt, err := s.marshal(ctx, state)
+	if err != nil {
+		return "", errors.Wrap(err, "state marshal")
+	}
+	exporterType := client.ExporterDocker
+	if oci {
+		exporterType = client.ExporterOCI
 	}
 	pipeR, pipeW := io.Pipe()
-	solveOpt, err := s.newSolveOptDocker(img, dockerTag, localDirs, pipeW)
+	solveOpt, err := s.newSolveOptDocker(img, dockerTag, localDirs, pipeW, exporterType, compression)
 	if err != nil {
-		return errors.Wrap(err, "new solve opt")
+		return "", errors.Wrap(err, "new solve opt")
 	}
 	ch := make(chan *client.SolveStatus)
 	ctx, cancel := context.WithCancel(ctx)
@@ -113,27 +181,15 @@ func (s *solver) solveDockerTar(ctx context.Context, localDirs map[string]string
 	eg.Go(func() error {
 		return s.sm.monitorProgress(ctx, ch)
 	})
+	// The image ID is extracted while the tar is being written.
+	inspector := dockertar.NewInspector()
+	tarR := s.normalized(eg, pipeR)
 	eg.Go(func() error {
-		file, err := os.Create(outFile)
+		defer inspector.Close()
+		defer tarR.Close()
+		_, err := io.Copy(io.MultiWriter(w, inspector), tarR)
 		if err != nil {
-			return errors.Wrapf(err, "open file %s for writing", outFile)
-		}
-		defer file.Close()
-		bufFile := bufio.NewWriter(file)
-		defer bufFile.Flush()
-		buf := make([]byte, 1024)
-		for {
-			n, err := pipeR.Read(buf)
-			if err != nil && err != io.EOF {
-				return errors.Wrap(err, "pipe read")
-			}
-			if err == io.EOF {
-				break
-			}
-			_, err = bufFile.Write(buf[:n])
-			if err != nil {
-				return errors.Wrap(err, "write chunk to file")
-			}
+			return errors.Wrap(err, "write docker tar")
 		}
 		return nil
 	})
@@ -146,13 +202,55 @@ func (s *solver) solveDockerTar(ctx context.Context, localDirs map[string]string
 	}()
 	err = eg.Wait()
 	if err != nil {
-		return err
+		return "", s.categorize(err)
 	}
-	return nil
+	id, err := inspector.ID()
+	if err != nil {
+		return "", errors.Wrap(err, "inspect docker tar")
+	}
+	return id, nil
+}
+
+// solveRegistry solves the given state and pushes the resulting image via buildkit.
+// The digest of the pushed image is returned.
+func (s *solver) solveRegistry(ctx context.Context, localDirs map[string]string, state llb.State, img *image.Image, imageRef string, insecure bool, compression earthfile2llb.LayerCompression) (string, error) {
+	dt, err := s.marshal(ctx, state)
+	if err != nil {
+		return "", errors.Wrap(err, "state marshal")
+	}
+	solveOpt, err := s.newSolveOptRegistry(img, imageRef, localDirs, insecure, compression)
+	if err != nil {
+		return "", errors.Wrap(err, "new solve opt")
+	}
+	ch := make(chan *client.SolveStatus)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	eg, ctx := errgroup.WithContext(ctx)
+	var dgst string
+	eg.Go(func() error {
+		resp, err := s.bkClient.Solve(ctx, dt, *solveOpt, ch)
+		if err != nil {
+			return errors.Wrap(err, "solve")
+		}
+		dgst = resp.ExporterResponse["containerimage.digest"]
+		if dgst == "" {
+			return errors.New("no image digest in exporter response")
+		}
+		logging.GetLogger(ctx).Info("Solve successful")
+		return nil
+	})
+	eg.Go(func() error {
+		return s.sm.monitorProgress(ctx, ch)
+	})
+	err = eg.Wait()
+	if err != nil {
+		return "", s.categorize(err)
+	}
+	return dgst, nil
 }
 
 func (s *solver) solveArtifacts(ctx context.Context, localDirs map[string]string, state llb.State, outDir string) error {
-	dt, err := state.Marshal(ctx, llb.Platform(llbutil.TargetPlatform))
+	dt, err := s.marshal(ctx, state)
 	if err != nil {
 		return errors.Wrap(err, "state marshal")
 	}
@@ -178,14 +276,96 @@ func (s *solver) solveArtifacts(ctx context.Context, localDirs map[string]string
 	})
 	err = eg.Wait()
 	if err != nil {
-		return err
+		return s.categorize(err)
 	}
 	return nil
 }
 
-// when printDetailed is false, we only print non-cached items
-func (s *solver) solveSideEffects(ctx context.Context, localDirs map[string]string, state llb.State) error {
-	dt, err := state.Marshal(ctx, llb.Platform(llbutil.TargetPlatform))
+// solveArtifactsFaithful is like solveArtifacts, but exports the artifacts as a tar,
+// which is then extracted preserving file metadata. See extractTarFaithful.
+func (s *solver) solveArtifactsFaithful(ctx context.Context, localDirs map[string]string, state llb.State, outDir string) error {
+	dt, err := s.marshal(ctx, state)
+	if err != nil {
+		return errors.Wrap(err, "state marshal")
+	}
+	pipeR, pipeW := io.Pipe()
+	solveOpt := &client.SolveOpt{
+		Exports: []client.ExportEntry{
+			{
+				Type: client.ExporterTar,
+				Output: func(_ map[string]string) (io.WriteCloser, error) {
+					return pipeW, nil
+				},
+			},
+		},
+		Session:             s.attachables,
+		AllowedEntitlements: s.enttlmnts,
+		LocalDirs:           localDirs,
+	}
+	ch := make(chan *client.SolveStatus)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		var err error
+		_, err = s.bkClient.Solve(ctx, dt, *solveOpt, ch)
+		if err != nil {
+			return errors.Wrap(err, "solve")
+		}
+		logging.GetLogger(ctx).Info("Solve successful")
+		return nil
+	})
+	eg.Go(func() error {
+		return s.sm.monitorProgress(ctx, ch)
+	})
+	eg.Go(func() error {
+		defer pipeR.Close()
+		err := extractTarFaithful(pipeR, outDir)
+		if err != nil {
+			return err
+		}
+		// Drain any tar padding.
+		_, err = io.Copy(ioutil.Discard, pipeR)
+		if err != nil {
+			return errors.Wrap(err, "read artifacts tar")
+		}
+		return nil
+	})
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Close read pipe on cancels, otherwise the whole thing hangs.
+			pipeR.Close()
+		}
+	}()
+	err = eg.Wait()
+	if err != nil {
+		return s.categorize(err)
+	}
+	return nil
+}
+
+// solveSideEffects solves the side effects of state. The commands which fail are
+// retried as per retries, by vertex name (see solveWithRetries).
+func (s *solver) solveSideEffects(ctx context.Context, localDirs map[string]string, state llb.State, retries map[string]int) error {
+	var refs cacheRefs
+	if s.remoteCache != "" {
+		refs = cacheRefs{export: s.remoteCache, imports: []string{s.remoteCache}}
+	}
+	return s.solveSideEffectsCached(ctx, localDirs, state, refs, retries)
+}
+
+// cacheRefs are the refs of the remote cache a solve exports to and imports from.
+type cacheRefs struct {
+	export  string
+	imports []string
+}
+
+// solveSideEffectsCached solves the side effects of state, exporting the cache to and
+// importing it from the given refs. The commands which fail are retried as per retries,
+// by vertex name (see solveWithRetries).
+func (s *solver) solveSideEffectsCached(ctx context.Context, localDirs map[string]string, state llb.State, refs cacheRefs, retries map[string]int) error {
+	dt, err := s.marshal(ctx, state)
 	if err != nil {
 		return errors.Wrap(err, "state marshal")
 	}
@@ -210,46 +390,63 @@ func (s *solver) solveSideEffects(ctx context.Context, localDirs map[string]stri
 		With("ops", string(opsBytes)).
 		With("dt", string(dtBytes)).
 		Debug("Side effectsLLB")
-	solveOpt, err := s.newSolveOptSideEffects(localDirs)
+	solveOpt, err := s.newSolveOptSideEffects(localDirs, refs)
 	if err != nil {
 		return errors.Wrap(err, "new solve opt")
 	}
-	ch := make(chan *client.SolveStatus)
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-	eg, ctx := errgroup.WithContext(ctx)
-	eg.Go(func() error {
-		var err error
-		_, err = s.bkClient.Solve(ctx, dt, *solveOpt, ch)
-		if err != nil {
-			return errors.Wrap(err, "solve")
-		}
-		logging.GetLogger(ctx).Info("Solve successful")
-		return nil
-	})
-	eg.Go(func() error {
-		return s.sm.monitorProgress(ctx, ch)
+	return s.solveWithRetries(ctx, retries, func() (*vertexMonitor, error) {
+		ch := make(chan *client.SolveStatus)
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		eg, ctx := errgroup.WithContext(ctx)
+		eg.Go(func() error {
+			var err error
+			_, err = s.bkClient.Solve(ctx, dt, *solveOpt, ch)
+			if err != nil {
+				return errors.Wrap(err, "solve")
+			}
+			logging.GetLogger(ctx).Info("Solve successful")
+			return nil
+		})
+		var errVertex *vertexMonitor
+		eg.Go(func() error {
+			var err error
+			errVertex, err = s.sm.monitorSolve(ctx, ch)
+			return err
+		})
+		err := eg.Wait()
+		return errVertex, err
 	})
-	err = eg.Wait()
-	if err != nil {
+}
+
+// categorize returns err, the error of a solve, with the category of the failure of the
+// command which caused the build to fail, if any.
+func (s *solver) categorize(err error) error {
+	if err == nil {
+		return nil
+	}
+	failure := s.sm.failureSummary()
+	if failure == nil {
 		return err
 	}
-	return nil
+	return errcode.Wrap(err, failure.category)
 }
 
-func (s *solver) newSolveOptDocker(img *image.Image, dockerTag string, localDirs map[string]string, w io.WriteCloser) (*client.SolveOpt, error) {
+func (s *solver) newSolveOptDocker(img *image.Image, dockerTag string, localDirs map[string]string, w io.WriteCloser, exporterType string, compression earthfile2llb.LayerCompression) (*client.SolveOpt, error) {
 	imgJSON, err := json.Marshal(img)
 	if err != nil {
 		return nil, errors.Wrap(err, "image json marshal")
 	}
+	attrs := map[string]string{
+		"name":                  dockerTag,
+		"containerimage.config": string(imgJSON),
+	}
+	addCompressionAttrs(attrs, compression)
 	return &client.SolveOpt{
 		Exports: []client.ExportEntry{
 			{
-				Type: client.ExporterDocker,
-				Attrs: map[string]string{
-					"name":                  dockerTag,
-					"containerimage.config": string(imgJSON),
-				},
+				Type:  exporterType,
+				Attrs: attrs,
 				Output: func(_ map[string]string) (io.WriteCloser, error) {
 					return w, nil
 				},
@@ -261,6 +458,33 @@ func (s *solver) newSolveOptDocker(img *image.Image, dockerTag string, localDirs
 	}, nil
 }
 
+func (s *solver) newSolveOptRegistry(img *image.Image, imageRef string, localDirs map[string]string, insecure bool, compression earthfile2llb.LayerCompression) (*client.SolveOpt, error) {
+	imgJSON, err := json.Marshal(img)
+	if err != nil {
+		return nil, errors.Wrap(err, "image json marshal")
+	}
+	attrs := map[string]string{
+		"name":                  imageRef,
+		"push":                  "true",
+		"containerimage.config": string(imgJSON),
+	}
+	if insecure {
+		attrs["registry.insecure"] = "true"
+	}
+	addCompressionAttrs(attrs, compression)
+	return &client.SolveOpt{
+		Exports: []client.ExportEntry{
+			{
+				Type:  client.ExporterImage,
+				Attrs: attrs,
+			},
+		},
+		Session:             s.attachables,
+		AllowedEntitlements: s.enttlmnts,
+		LocalDirs:           localDirs,
+	}, nil
+}
+
 func (s *solver) newSolveOptArtifacts(outDir string, localDirs map[string]string) (*client.SolveOpt, error) {
 	return &client.SolveOpt{
 		Exports: []client.ExportEntry{
@@ -275,17 +499,20 @@ func (s *solver) newSolveOptArtifacts(outDir string, localDirs map[string]string
 	}, nil
 }
 
-func (s *solver) newSolveOptSideEffects(localDirs map[string]string) (*client.SolveOpt, error) {
-	var cacheImportExport []client.CacheOptionsEntry
-	if s.remoteCache != "" {
-		cacheImportExport = append(cacheImportExport, newRegistryCacheOpt(s.remoteCache))
+func (s *solver) newSolveOptSideEffects(localDirs map[string]string, refs cacheRefs) (*client.SolveOpt, error) {
+	var cacheImports, cacheExports []client.CacheOptionsEntry
+	for _, ref := range refs.imports {
+		cacheImports = append(cacheImports, newRegistryCacheOpt(ref))
+	}
+	if refs.export != "" {
+		cacheExports = append(cacheExports, newRegistryCacheOpt(refs.export))
 	}
 	return &client.SolveOpt{
 		Session:             s.attachables,
 		AllowedEntitlements: s.enttlmnts,
 		LocalDirs:           localDirs,
-		CacheImports:        cacheImportExport,
-		CacheExports:        cacheImportExport,
+		CacheImports:        cacheImports,
+		CacheExports:        cacheExports,
 	}, nil
 }
 
@@ -299,19 +526,97 @@ func newRegistryCacheOpt(ref string) client.CacheOptionsEntry {
 	}
 }
 
+// loadDockerTar streams the docker tar from r straight into the docker daemon, via
+// the docker API. No intermediate file is created.
 func loadDockerTar(ctx context.Context, r io.ReadCloser) error {
-	// TODO: This is a gross hack - should use proper docker client.
-	cmd := exec.CommandContext(ctx, "docker", "load")
-	cmd.Stdin = r
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
+	dockerClient, err := dockerclient.NewClientWithOpts(
+		dockerclient.FromEnv, dockerclient.WithAPIVersionNegotiation())
+	if err != nil {
+		return errors.Wrap(err, "new docker client")
+	}
+	defer dockerClient.Close()
+	resp, err := dockerClient.ImageLoad(ctx, r, true)
+	if err != nil {
+		return errors.Wrap(err, "docker image load")
+	}
+	defer resp.Body.Close()
+	if !resp.JSON {
+		_, err = io.Copy(os.Stdout, resp.Body)
+		if err != nil {
+			return errors.Wrap(err, "read docker image load response")
+		}
+		return nil
+	}
+	err = jsonmessage.DisplayJSONMessagesStream(resp.Body, os.Stdout, os.Stdout.Fd(), false, nil)
 	if err != nil {
-		return errors.Wrap(err, "docker load")
+		return errors.Wrap(err, "docker image load")
 	}
 	return nil
 }
 
+// normalized returns a reader of the image archive read from r, normalized as per
+// dockertar.Normalize if the solver is reproducible.
+func (s *solver) normalized(eg *errgroup.Group, r io.ReadCloser) io.ReadCloser {
+	if !s.reproducible {
+		return r
+	}
+	pipeR, pipeW := io.Pipe()
+	eg.Go(func() error {
+		defer r.Close()
+		err := dockertar.Normalize(r, pipeW, s.epoch)
+		if err != nil {
+			err = errors.Wrap(err, "normalize image archive")
+		}
+		pipeW.CloseWithError(err)
+		return err
+	})
+	return pipeR
+}
+
+// addCompressionAttrs sets the exporter attributes for the given layer compression.
+// The layers which already have a compressed blob, such as those of the base images,
+// keep it.
+func addCompressionAttrs(attrs map[string]string, compression earthfile2llb.LayerCompression) {
+	if compression.Type == "" {
+		return
+	}
+	attrs["compression"] = compression.Type
+}
+
+// dockerImageDigest returns the digest of the image, as known by the docker daemon. For
+// pushed images, the registry digest is returned. Otherwise, the image ID is returned.
+func dockerImageDigest(ctx context.Context, imageName string, pushed bool) (string, error) {
+	format := "{{.Id}}"
+	if pushed {
+		format = "{{range .RepoDigests}}{{println .}}{{end}}"
+	}
+	out, err := exec.CommandContext(ctx, "docker", "inspect", "--format", format, imageName).Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "docker inspect %s", imageName)
+	}
+	if !pushed {
+		return strings.TrimSpace(string(out)), nil
+	}
+	ref, err := reference.ParseNormalizedNamed(imageName)
+	if err != nil {
+		return "", errors.Wrapf(err, "parse normalized named %s", imageName)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), "@", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		repo, err := reference.ParseNormalizedNamed(parts[0])
+		if err != nil {
+			continue
+		}
+		if repo.Name() == ref.Name() {
+			return parts[1], nil
+		}
+	}
+	return "", fmt.Errorf("no registry digest found for %s", imageName)
+}
+
 func pushDockerImage(ctx context.Context, imageName string) error {
 	cmd := exec.CommandContext(ctx, "docker", "push", imageName)
 	cmd.Stdout = os.Stdout
@@ -322,3 +627,17 @@ func pushDockerImage(ctx context.Context, imageName string) error {
 	}
 	return nil
 }
+
+// marshal marshals the state to be solved.
+func (s *solver) marshal(ctx context.Context, state llb.State) (*llb.Definition, error) {
+	dt, err := state.Marshal(ctx, llb.Platform(llbutil.TargetPlatform))
+	if err != nil {
+		return nil, err
+	}
+	err = s.sm.recordDefinition(dt)
+	if err != nil {
+		// Only needed for the cache history.
+		logging.GetLogger(ctx).Error(errors.Wrap(err, "record definition"))
+	}
+	return dt, nil
+}
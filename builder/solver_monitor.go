@@ -3,11 +3,14 @@ package builder
 import (
 	"context"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/armon/circbuf"
 	"github.com/earthly/earthly/conslogging"
+	"github.com/earthly/earthly/errcode"
 	"github.com/earthly/earthly/logging"
 	"github.com/moby/buildkit/client"
 	"github.com/opencontainers/go-digest"
@@ -20,21 +23,29 @@ const (
 )
 
 type vertexMonitor struct {
-	vertex         *client.Vertex
-	targetStr      string
-	salt           string
-	operation      string
-	lastOutput     time.Time
-	lastPercentage int
-	logger         logging.Logger
-	console        conslogging.ConsoleLogger
-	headerPrinted  bool
-	isInternal     bool
-	isError        bool
-	tailOutput     *circbuf.Buffer
+	vertex            *client.Vertex
+	targetStr         string
+	salt              string
+	operation         string
+	lastOutput        time.Time
+	lastPercentage    int
+	logger            logging.Logger
+	console           conslogging.ConsoleLogger
+	headerPrinted     bool
+	completedReported bool
+	isInternal        bool
+	isError           bool
+	tailOutput        *circbuf.Buffer
+	// started and completed are the times of the first execution of the vertex, and
+	// cached whether it was cached then. See recordTimes.
+	started   *time.Time
+	completed *time.Time
+	cached    bool
 }
 
 func (vm *vertexMonitor) printHeader() {
+	// The header is printed again when repeating the output of a failure.
+	isRepeat := vm.headerPrinted
 	vm.headerPrinted = true
 	if vm.operation == "" {
 		return
@@ -45,9 +56,35 @@ func (vm *vertexMonitor) printHeader() {
 	if vm.vertex.Cached {
 		c = c.WithCached(true)
 	}
+	if !isRepeat {
+		c.PrintEvent(vm.event(conslogging.VertexStartedEvent))
+	}
+	if c.JSONOutput() {
+		return
+	}
 	c.Printf("%s\n", strings.Join(out, " "))
 }
 
+// printCompleted emits the completion event of the vertex.
+func (vm *vertexMonitor) printCompleted() {
+	vm.completedReported = true
+	if vm.operation == "" {
+		return
+	}
+	vm.console.PrintEvent(vm.event(conslogging.VertexCompletedEvent))
+}
+
+func (vm *vertexMonitor) event(eventType string) conslogging.Event {
+	return conslogging.Event{
+		Type:      eventType,
+		Vertex:    shortDigest(vm.vertex.Digest),
+		Command:   vm.operation,
+		Cached:    vm.vertex.Cached,
+		Started:   vm.vertex.Started,
+		Completed: vm.vertex.Completed,
+	}
+}
+
 func (vm *vertexMonitor) shouldPrintProgress(percent int) bool {
 	if !vm.headerPrinted {
 		return false
@@ -83,7 +120,20 @@ func (vm *vertexMonitor) printOutput(output []byte) error {
 	return nil
 }
 
+// reportError emits the failure event of the vertex.
+func (vm *vertexMonitor) reportError() {
+	ev := vm.event(conslogging.VertexFailedEvent)
+	ev.Failed = true
+	ev.Error = vm.vertex.Error
+	ev.ExitCode = parseExitCode(vm.vertex.Error)
+	vm.console.PrintEvent(ev)
+}
+
 func (vm *vertexMonitor) printError() {
+	if vm.console.JSONOutput() {
+		// Reported as an event instead.
+		return
+	}
 	if strings.Contains(vm.vertex.Error, "executor failed running") {
 		vm.console.Warnf("ERROR: Command exited with non-zero code: %s\n", vm.operation)
 	} else {
@@ -91,20 +141,140 @@ func (vm *vertexMonitor) printError() {
 	}
 }
 
+// targetMonitor tracks the lifecycle events of a target, across solves.
+type targetMonitor struct {
+	console conslogging.ConsoleLogger
+	target  string
+	salt    string
+	// order is the order in which targets started.
+	order int
+	// active is set while a solve which involves the target is in progress.
+	active      bool
+	completed   bool
+	isError     bool
+	started     time.Time
+	completedAt time.Time
+	numVertices int
+	numCached   int
+}
+
+// failureInfo describes the command which caused a build to fail.
+type failureInfo struct {
+	Target   string `json:"target"`
+	Command  string `json:"command"`
+	ExitCode *int   `json:"exitCode,omitempty"`
+	Error    string `json:"error"`
+	// digest is the digest of the vertex which failed.
+	digest digest.Digest
+	// category is the category of the failure of the vertex.
+	category errcode.Category
+}
+
+// vertexCategory returns the category of the failure of the vertex with the given name.
+// The vertices of buildkit which import and export the cache, or push images, are
+// internal, and have no command.
+func vertexCategory(vertexName string) errcode.Category {
+	switch {
+	case strings.HasPrefix(vertexName, "importing cache"),
+		strings.HasPrefix(vertexName, "exporting cache"):
+		return errcode.CacheError
+	case strings.HasPrefix(vertexName, "pushing "):
+		return errcode.PushFailure
+	default:
+		return errcode.ExecFailure
+	}
+}
+
 type solverMonitor struct {
 	console conslogging.ConsoleLogger
 
+	mu       sync.Mutex
 	vertices map[digest.Digest]*vertexMonitor
+	targets  map[string]*targetMonitor
+	failure  *failureInfo
+	// normalizedDigests maps the digests of the vertices solved to their normalized
+	// digest, for the cache history.
+	normalizedDigests map[digest.Digest]digest.Digest
 }
 
 func newSolverMonitor(console conslogging.ConsoleLogger) *solverMonitor {
 	return &solverMonitor{
 		console:  console,
 		vertices: make(map[digest.Digest]*vertexMonitor),
+		targets:  make(map[string]*targetMonitor),
+	}
+}
+
+// markTargetStarted emits the target started event, the first time a command of the
+// target of vm is seen.
+func (sm *solverMonitor) markTargetStarted(vm *vertexMonitor) {
+	// Assumes mu locked.
+	if vm.isInternal || vm.targetStr == "" {
+		return
+	}
+	key := vm.targetStr + " " + vm.salt
+	tm, ok := sm.targets[key]
+	if !ok {
+		tm = &targetMonitor{
+			console: vm.console,
+			target:  vm.targetStr,
+			salt:    vm.salt,
+			order:   len(sm.targets),
+			started: time.Now(),
+		}
+		sm.targets[key] = tm
+		tm.console.PrintEvent(conslogging.Event{Type: conslogging.TargetStartedEvent})
+	}
+	tm.active = true
+	tm.isError = tm.isError || vm.isError
+}
+
+// countVertex records the execution of the vertex vm, in the stats of its target.
+func (sm *solverMonitor) countVertex(vm *vertexMonitor) {
+	// Assumes mu locked.
+	tm, ok := sm.targets[vm.targetStr+" "+vm.salt]
+	if !ok || vm.operation == "" {
+		return
+	}
+	tm.numVertices++
+	if vm.vertex.Cached {
+		tm.numCached++
+	}
+}
+
+// markTargetsCompleted emits the target completed events of the targets involved in
+// the solve which has just finished.
+func (sm *solverMonitor) markTargetsCompleted() {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for _, tm := range sm.targets {
+		if !tm.active || tm.completed {
+			continue
+		}
+		tm.active = false
+		tm.completed = true
+		tm.completedAt = time.Now()
+		tm.console.PrintEvent(conslogging.Event{
+			Type:   conslogging.TargetCompletedEvent,
+			Failed: tm.isError,
+		})
 	}
 }
 
 func (sm *solverMonitor) monitorProgress(ctx context.Context, ch chan *client.SolveStatus) error {
+	errVertex, err := sm.monitorSolve(ctx, ch)
+	if err != nil {
+		return err
+	}
+	if errVertex != nil {
+		sm.reprintFailure(errVertex)
+	}
+	return nil
+}
+
+// monitorSolve prints the progress of a solve, until ch is closed. It returns the first
+// vertex which failed, if any, without repeating its output.
+func (sm *solverMonitor) monitorSolve(ctx context.Context, ch chan *client.SolveStatus) (*vertexMonitor, error) {
 	var errVertex *vertexMonitor
 Loop:
 	for {
@@ -113,96 +283,155 @@ Loop:
 			if !ok {
 				break Loop
 			}
-			for _, vertex := range ss.Vertexes {
-				vm, ok := sm.vertices[vertex.Digest]
-				if !ok {
-					targetStr, salt, operation := parseVertexName(vertex.Name)
-					vertexLogger := logging.GetLogger(ctx).
-						With("target", targetStr).
-						With("vertex", shortDigest(vertex.Digest)).
-						With("cached", vertex.Cached).
-						With("operation", operation)
-					vm = &vertexMonitor{
-						vertex:     vertex,
-						targetStr:  targetStr,
-						salt:       salt,
-						operation:  operation,
-						logger:     vertexLogger,
-						isInternal: (targetStr == "internal"),
-						console:    sm.console.WithPrefixAndSalt(targetStr, salt),
-					}
-					sm.vertices[vertex.Digest] = vm
-				}
-				vm.vertex = vertex
-				if !vm.headerPrinted &&
-					((!vm.isInternal && (vertex.Cached || vertex.Started != nil)) || vertex.Error != "") {
-					vm.printHeader()
-					vm.logger.Info("Vertex started or cached")
-				}
-				if vertex.Error != "" {
-					if strings.Contains(vertex.Error, "context canceled") {
-						if !vm.isInternal {
-							vm.console.Printf("WARN: Canceled\n")
-						}
-					} else {
-						vm.isError = true
-						if errVertex == nil {
-							errVertex = vm
-						}
-						vm.printError()
-					}
-					vm.logger.Error(errors.New(vertex.Error))
-				}
+			vm, err := sm.handleStatus(ctx, ss)
+			if err != nil {
+				return nil, err
 			}
-			for _, vs := range ss.Statuses {
-				vm, ok := sm.vertices[vs.Vertex]
-				if !ok || vm.isInternal {
-					// No logging for internal operations.
-					continue
-				}
-				progress := int(0)
-				if vs.Total != 0 {
-					progress = int(100.0 * float32(vs.Current) / float32(vs.Total))
+			if errVertex == nil {
+				errVertex = vm
+			}
+		}
+	}
+	sm.markTargetsCompleted()
+	return errVertex, nil
+}
+
+// forgetFailure forgets the failure of the vertex vm, which is about to be solved
+// again, such that its next attempt is monitored afresh.
+func (sm *solverMonitor) forgetFailure(vm *vertexMonitor) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	delete(sm.vertices, vm.vertex.Digest)
+	if sm.failure != nil && sm.failure.digest == vm.vertex.Digest {
+		sm.failure = nil
+	}
+	tm, ok := sm.targets[vm.targetStr+" "+vm.salt]
+	if ok {
+		tm.completed = false
+		tm.isError = false
+	}
+}
+
+// handleStatus processes a single solve status update. It returns the first vertex
+// which failed, if any.
+func (sm *solverMonitor) handleStatus(ctx context.Context, ss *client.SolveStatus) (*vertexMonitor, error) {
+	// Multiple solves may be monitored concurrently.
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	var errVertex *vertexMonitor
+	for _, vertex := range ss.Vertexes {
+		vm, ok := sm.vertices[vertex.Digest]
+		if !ok {
+			targetStr, salt, operation := parseVertexName(vertex.Name)
+			vertexLogger := logging.GetLogger(ctx).
+				With("target", targetStr).
+				With("vertex", shortDigest(vertex.Digest)).
+				With("cached", vertex.Cached).
+				With("operation", operation)
+			vm = &vertexMonitor{
+				vertex:     vertex,
+				targetStr:  targetStr,
+				salt:       salt,
+				operation:  operation,
+				logger:     vertexLogger,
+				isInternal: (targetStr == "internal"),
+				console:    sm.console.WithPrefixAndSalt(targetStr, salt),
+			}
+			sm.vertices[vertex.Digest] = vm
+		}
+		vm.vertex = vertex
+		vm.recordTimes()
+		if !vm.headerPrinted &&
+			((!vm.isInternal && (vertex.Cached || vertex.Started != nil)) || vertex.Error != "") {
+			sm.markTargetStarted(vm)
+			sm.countVertex(vm)
+			vm.printHeader()
+			vm.logger.Info("Vertex started or cached")
+		}
+		if vertex.Error != "" {
+			if strings.Contains(vertex.Error, "context canceled") {
+				if !vm.isInternal {
+					vm.console.Printf("WARN: Canceled\n")
 				}
-				if vs.Completed != nil {
-					progress = 100
+			} else {
+				vm.isError = true
+				if errVertex == nil {
+					errVertex = vm
 				}
-				if vm.shouldPrintProgress(progress) {
-					logger := vm.logger.
-						With("progress", progress).
-						With("name", vs.Name)
-					if !vm.headerPrinted {
-						vm.printHeader()
+				if sm.failure == nil {
+					sm.failure = &failureInfo{
+						Target:   vm.targetStr,
+						Command:  vm.operation,
+						ExitCode: parseExitCode(vertex.Error),
+						Error:    vertex.Error,
+						digest:   vertex.Digest,
+						category: vertexCategory(vertex.Name),
 					}
-					logger.Info(vs.ID)
-					vm.console.Printf("%s %d%%\n", vs.ID, progress)
 				}
+				vm.reportError()
+				vm.printError()
 			}
-			for _, logLine := range ss.Logs {
-				vm, ok := sm.vertices[logLine.Vertex]
-				if !ok || vm.isInternal {
-					// No logging for internal operations.
-					continue
-				}
-				if !vm.headerPrinted {
-					vm.printHeader()
-				}
-				vm.logger.Info(string(logLine.Data))
-				err := vm.printOutput(logLine.Data)
-				if err != nil {
-					return err
-				}
-
+			sm.markTargetStarted(vm)
+			vm.logger.Error(errors.New(vertex.Error))
+		} else if vertex.Completed != nil && !vm.completedReported && !vm.isInternal {
+			vm.printCompleted()
+		}
+	}
+	for _, vs := range ss.Statuses {
+		vm, ok := sm.vertices[vs.Vertex]
+		if !ok || vm.isInternal {
+			// No logging for internal operations.
+			continue
+		}
+		progress := int(0)
+		if vs.Total != 0 {
+			progress = int(100.0 * float32(vs.Current) / float32(vs.Total))
+		}
+		if vs.Completed != nil {
+			progress = 100
+		}
+		if vm.shouldPrintProgress(progress) {
+			logger := vm.logger.
+				With("progress", progress).
+				With("name", vs.Name)
+			if !vm.headerPrinted {
+				vm.printHeader()
+			}
+			logger.Info(vs.ID)
+			ev := vm.event(conslogging.VertexProgressEvent)
+			ev.Message = vs.ID
+			ev.Progress = progress
+			vm.console.PrintEvent(ev)
+			if !vm.console.JSONOutput() {
+				vm.console.Printf("%s %d%%\n", vs.ID, progress)
 			}
 		}
 	}
-	if errVertex != nil {
-		sm.reprintFailure(errVertex)
+	for _, logLine := range ss.Logs {
+		vm, ok := sm.vertices[logLine.Vertex]
+		if !ok || vm.isInternal {
+			// No logging for internal operations.
+			continue
+		}
+		if !vm.headerPrinted {
+			vm.printHeader()
+		}
+		vm.logger.Info(string(logLine.Data))
+		err := vm.printOutput(logLine.Data)
+		if err != nil {
+			return nil, err
+		}
+
 	}
-	return nil
+	return errVertex, nil
 }
 
 func (sm *solverMonitor) reprintFailure(errVertex *vertexMonitor) {
+	if sm.console.JSONOutput() {
+		// The output and the failure event have already been emitted.
+		sm.console.PrintFailure()
+		return
+	}
 	sm.console.Warnf("Repeating the output of the command that caused the failure\n")
 	sm.console.PrintFailure()
 	errVertex.console = errVertex.console.WithFailed(true)
@@ -223,6 +452,22 @@ func (sm *solverMonitor) reprintFailure(errVertex *vertexMonitor) {
 	errVertex.printError()
 }
 
+var exitCodeRegexp = regexp.MustCompile("exit code: ([0-9]+)")
+
+// parseExitCode extracts the exit code of a failed command from the vertex error, if
+// present.
+func parseExitCode(vertexError string) *int {
+	match := exitCodeRegexp.FindStringSubmatch(vertexError)
+	if len(match) < 2 {
+		return nil
+	}
+	code, err := strconv.Atoi(match[1])
+	if err != nil {
+		return nil
+	}
+	return &code
+}
+
 var bracketsRegexp = regexp.MustCompile("^\\[([^\\]]*)\\] (.*)$")
 
 func parseVertexName(vertexName string) (string, string, string) {
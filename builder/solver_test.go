@@ -0,0 +1,114 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/earthly/earthly/earthfile2llb/image"
+	"github.com/moby/buildkit/client"
+)
+
+func TestLoadDockerTar(t *testing.T) {
+	data := bytes.Repeat([]byte("layer"), 100000)
+	var loaded []byte
+	var loadErr error
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/_ping"):
+			w.Header().Set("API-Version", "1.40")
+			w.WriteHeader(http.StatusOK)
+		case strings.HasSuffix(r.URL.Path, "/images/load"):
+			loaded, loadErr = ioutil.ReadAll(r.Body)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			io.WriteString(w, `{"stream":"Loaded image: app:latest\n"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	oldHost := os.Getenv("DOCKER_HOST")
+	defer os.Setenv("DOCKER_HOST", oldHost)
+	os.Setenv("DOCKER_HOST", strings.Replace(srv.URL, "http://", "tcp://", 1))
+
+	// The tar is only available as a stream.
+	pipeR, pipeW := io.Pipe()
+	go func() {
+		_, err := io.Copy(pipeW, bytes.NewReader(data))
+		pipeW.CloseWithError(err)
+	}()
+	err := loadDockerTar(context.Background(), pipeR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loadErr != nil {
+		t.Fatal(loadErr)
+	}
+	if !bytes.Equal(loaded, data) {
+		t.Errorf("expected the daemon to receive %d bytes, got %d", len(data), len(loaded))
+	}
+}
+
+// exporterAttrs are the attrs the image exporters of the pinned buildkit parse
+// (exporter/containerimage and exporter/oci), with their accepted values, if
+// restricted. The exporters pass the attrs they do not know on as metadata, which is
+// only read for the image config.
+var exporterAttrs = map[string][]string{
+	"name":                  nil,
+	"push":                  {"true", "false"},
+	"registry.insecure":     {"true", "false"},
+	"compression":           {"gzip", "uncompressed"},
+	"containerimage.config": nil,
+}
+
+func TestCompressionAttrs(t *testing.T) {
+	s := &solver{}
+	for _, lc := range append([]string{""}, earthfile2llb.LayerCompressionTypes...) {
+		c := earthfile2llb.LayerCompression{Type: lc}
+		dockerOpt, err := s.newSolveOptDocker(image.NewImage(), "app:latest", nil, nil, client.ExporterDocker, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		registryOpt, err := s.newSolveOptRegistry(image.NewImage(), "registry.example.com/app:latest", nil, true, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, opt := range []*client.SolveOpt{dockerOpt, registryOpt} {
+			attrs := opt.Exports[0].Attrs
+			if attrs["compression"] != lc {
+				t.Errorf("%q: expected the compression attr %q, got %q", lc, lc, attrs["compression"])
+			}
+			for key, value := range attrs {
+				accepted, known := exporterAttrs[key]
+				if !known {
+					t.Errorf("%q: attr %s would be ignored by the exporter", lc, key)
+					continue
+				}
+				if accepted == nil {
+					continue
+				}
+				found := false
+				for _, a := range accepted {
+					found = found || a == value
+				}
+				if !found {
+					t.Errorf("%q: %s=%s would be rejected by the exporter", lc, key, value)
+				}
+			}
+		}
+	}
+	for _, lc := range []string{"zstd", "estargz"} {
+		err := earthfile2llb.LayerCompression{Type: lc}.Validate()
+		if err == nil {
+			t.Errorf("expected %s to be rejected, as the exporter does not support it", lc)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/sshforward"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// sshForwardChunkSize is the size of the messages the data of a socket is sent as.
+const sshForwardChunkSize = 32 * 1024
+
+// socketProvider serves sockets forwarded into RUN commands which are only read from,
+// such as those of the images of DOCKER LOAD and WITH DOCKER --load.
+type socketProvider interface {
+	// hasSocket returns whether the provider serves the socket of the given ID.
+	hasSocket(id string) bool
+	// serveSocket writes the data of the socket of the given ID to w.
+	serveSocket(ctx context.Context, id string, w io.Writer) error
+}
+
+// sshForwarder is the SSH socket forwarding attachable of the session. Buildkit only
+// supports one per session, which serves all of the sockets mounted into RUN commands.
+// The sockets of the IDs served by providers are served by them, and the others (the
+// SSH agents of RUN --ssh) by the SSH agent provider, if any.
+type sshForwarder struct {
+	agent     sshforward.SSHServer
+	providers []socketProvider
+}
+
+// withSSHForwarder returns the attachables, with the SSH agent provider among them (if
+// any) replaced by an sshForwarder serving the sockets of the given providers too.
+func withSSHForwarder(attachables []session.Attachable, providers ...socketProvider) []session.Attachable {
+	sf := &sshForwarder{providers: providers}
+	ret := make([]session.Attachable, 0, len(attachables)+1)
+	for _, a := range attachables {
+		agent, ok := a.(sshforward.SSHServer)
+		if ok && sf.agent == nil {
+			sf.agent = agent
+			continue
+		}
+		ret = append(ret, a)
+	}
+	return append(ret, sf)
+}
+
+func (sf *sshForwarder) provider(id string) (socketProvider, bool) {
+	for _, p := range sf.providers {
+		if p.hasSocket(id) {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// Register implements session.Attachable.
+func (sf *sshForwarder) Register(server *grpc.Server) {
+	sshforward.RegisterSSHServer(server, sf)
+}
+
+// CheckAgent implements sshforward.SSHServer.
+func (sf *sshForwarder) CheckAgent(ctx context.Context, req *sshforward.CheckAgentRequest) (*sshforward.CheckAgentResponse, error) {
+	if _, ok := sf.provider(req.ID); ok {
+		return &sshforward.CheckAgentResponse{}, nil
+	}
+	if sf.agent == nil {
+		return nil, fmt.Errorf("unset ssh forward key %s", req.ID)
+	}
+	return sf.agent.CheckAgent(ctx, req)
+}
+
+// ForwardAgent implements sshforward.SSHServer.
+func (sf *sshForwarder) ForwardAgent(stream sshforward.SSH_ForwardAgentServer) error {
+	var id string
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	if v := md[sshforward.KeySSHID]; len(v) > 0 {
+		id = v[0]
+	}
+	p, ok := sf.provider(id)
+	if !ok {
+		if sf.agent == nil {
+			return fmt.Errorf("unset ssh forward key %s", id)
+		}
+		return sf.agent.ForwardAgent(stream)
+	}
+	return p.serveSocket(stream.Context(), id, &streamWriter{stream: stream})
+}
+
+// streamWriter writes to an SSH forwarding stream.
+type streamWriter struct {
+	stream sshforward.SSH_ForwardAgentServer
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		end := n + sshForwardChunkSize
+		if end > len(p) {
+			end = len(p)
+		}
+		err := sw.stream.Send(&sshforward.BytesMessage{Data: p[n:end]})
+		if err != nil {
+			return n, err
+		}
+		n = end
+	}
+	return n, nil
+}
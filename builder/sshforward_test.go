@@ -0,0 +1,131 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/secrets/secretsprovider"
+	"github.com/moby/buildkit/session/sshforward"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// fakeSSHServer stands in for the SSH agent provider of RUN --ssh.
+type fakeSSHServer struct {
+	forwarded []string
+}
+
+func (f *fakeSSHServer) Register(server *grpc.Server) {}
+
+func (f *fakeSSHServer) CheckAgent(ctx context.Context, req *sshforward.CheckAgentRequest) (*sshforward.CheckAgentResponse, error) {
+	if req.ID != "default" {
+		return nil, errors.New("unset")
+	}
+	return &sshforward.CheckAgentResponse{}, nil
+}
+
+func (f *fakeSSHServer) ForwardAgent(stream sshforward.SSH_ForwardAgentServer) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	f.forwarded = append(f.forwarded, md[sshforward.KeySSHID]...)
+	return nil
+}
+
+// fakeForwardStream records the messages sent to the socket of the given ID.
+type fakeForwardStream struct {
+	grpc.ServerStream
+	id   string
+	sent [][]byte
+}
+
+func (f *fakeForwardStream) Context() context.Context {
+	return metadata.NewIncomingContext(
+		context.Background(), metadata.Pairs(sshforward.KeySSHID, f.id))
+}
+
+func (f *fakeForwardStream) Send(m *sshforward.BytesMessage) error {
+	f.sent = append(f.sent, append([]byte{}, m.Data...))
+	return nil
+}
+
+func (f *fakeForwardStream) Recv() (*sshforward.BytesMessage, error) {
+	return nil, io.EOF
+}
+
+func TestSSHForwarder(t *testing.T) {
+	agent := &fakeSSHServer{}
+	secrets := secretsprovider.FromMap(nil)
+	dlp := newDockerLoadProvider()
+	attachables := withSSHForwarder([]session.Attachable{secrets, agent}, dlp)
+	if len(attachables) != 2 || attachables[0] != secrets {
+		t.Fatalf("expected the agent provider to be replaced, got %v", attachables)
+	}
+	sf, ok := attachables[1].(*sshForwarder)
+	if !ok || sf.agent != agent {
+		t.Fatalf("expected the forwarder to fall back to the agent provider, got %v", attachables[1])
+	}
+
+	def := &llb.Definition{Def: [][]byte{[]byte("op")}}
+	data := bytes.Repeat([]byte("x"), 2*sshForwardChunkSize+1)
+	socketID := dockerLoadSocketID("app:latest", def, []byte("{}"))
+	dlp.register(socketID, func(ctx context.Context, w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	failingID := dockerLoadSocketID("app:latest", def, []byte(`{"config":{}}`))
+	dlp.register(failingID, func(ctx context.Context, w io.Writer) error {
+		return errors.New("solve failed")
+	})
+
+	ctx := context.Background()
+	for _, id := range []string{socketID, "default"} {
+		_, err := sf.CheckAgent(ctx, &sshforward.CheckAgentRequest{ID: id})
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", id, err)
+		}
+	}
+	for _, id := range []string{dockerLoadSocketID("app:other", def, []byte("{}")), "deploy"} {
+		_, err := sf.CheckAgent(ctx, &sshforward.CheckAgentRequest{ID: id})
+		if err == nil {
+			t.Errorf("%s: expected an error", id)
+		}
+	}
+
+	stream := &fakeForwardStream{id: socketID}
+	err := sf.ForwardAgent(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stream.sent) != 3 {
+		t.Errorf("expected 3 messages, got %d", len(stream.sent))
+	}
+	if !bytes.Equal(bytes.Join(stream.sent, nil), data) {
+		t.Error("the image tar was not sent unchanged")
+	}
+
+	err = sf.ForwardAgent(&fakeForwardStream{id: failingID})
+	if err == nil || !strings.Contains(err.Error(), "solve failed") {
+		t.Errorf("expected the error of the stream, got %v", err)
+	}
+
+	err = sf.ForwardAgent(&fakeForwardStream{id: "default"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(agent.forwarded) != 1 || agent.forwarded[0] != "default" {
+		t.Errorf("expected the default socket to be forwarded to the agent, got %v", agent.forwarded)
+	}
+}
+
+func TestSSHForwarderNoAgent(t *testing.T) {
+	sf := withSSHForwarder(nil)[0].(*sshForwarder)
+	_, err := sf.CheckAgent(context.Background(), &sshforward.CheckAgentRequest{ID: "default"})
+	if err == nil {
+		t.Error("expected an error without an agent provider")
+	}
+}
@@ -0,0 +1,261 @@
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/earthly/earthly/errcode"
+	"github.com/pkg/errors"
+)
+
+// buildSummary is the machine-readable summary of a build, meant to be consumed by CI
+// pipelines.
+type buildSummary struct {
+	Target          string               `json:"target"`
+	Success         bool                 `json:"success"`
+	Error           string               `json:"error,omitempty"`
+	ErrorCode       errcode.Category     `json:"errorCode,omitempty"`
+	Failure         *failureInfo         `json:"failure,omitempty"`
+	Started         time.Time            `json:"started"`
+	Completed       time.Time            `json:"completed"`
+	DurationSeconds float64              `json:"durationSeconds"`
+	Commands        int                  `json:"commands"`
+	CacheHits       int                  `json:"cacheHits"`
+	CacheHitRate    float64              `json:"cacheHitRate"`
+	Targets         []targetSummary      `json:"targets"`
+	Images          []imageSummary       `json:"images"`
+	Artifacts       []artifactChecksum   `json:"artifacts"`
+	Sources         []sourceSummary      `json:"sources"`
+	Pushes          []pushSummary        `json:"pushes"`
+	CriticalPath    *criticalPath        `json:"criticalPath,omitempty"`
+	Sizes           *sizeReport          `json:"sizes,omitempty"`
+	Attestations    []attestationSummary `json:"attestations"`
+}
+
+type targetSummary struct {
+	Target          string     `json:"target"`
+	Salt            string     `json:"salt"`
+	Success         bool       `json:"success"`
+	Started         time.Time  `json:"started"`
+	Completed       *time.Time `json:"completed,omitempty"`
+	DurationSeconds float64    `json:"durationSeconds,omitempty"`
+	Commands        int        `json:"commands"`
+	CacheHits       int        `json:"cacheHits"`
+	// CacheHitRate is the ratio of the commands of the target which were cached.
+	CacheHitRate float64 `json:"cacheHitRate"`
+}
+
+type imageSummary struct {
+	Target string `json:"target"`
+	Image  string `json:"image"`
+	Pushed bool   `json:"pushed"`
+	// Digest is the registry digest for pushed images and the image ID otherwise.
+	Digest string `json:"digest,omitempty"`
+}
+
+// pushSummary is the outcome of the push of an image.
+type pushSummary struct {
+	Target string `json:"target"`
+	Image  string `json:"image"`
+	Pushed bool   `json:"pushed"`
+	Digest string `json:"digest,omitempty"`
+	// Error is why the push failed, or was skipped.
+	Error string `json:"error,omitempty"`
+}
+
+// sourceSummary is a remote repository targets of the build were read from, with the
+// commit its ref resolved to.
+type sourceSummary struct {
+	Repository string   `json:"repository"`
+	Ref        string   `json:"ref"`
+	Hash       string   `json:"hash"`
+	Targets    []string `json:"targets"`
+}
+
+// recordSources records the remote repositories the targets were read from, for the
+// build summary.
+func (b *Builder) recordSources(mts *earthfile2llb.MultiTargetStates) {
+	for _, sts := range mts.AllStates() {
+		rs := sts.RemoteSource
+		if rs == nil {
+			continue
+		}
+		targetStr := sts.Target.StringCanonical()
+		found := false
+		for i, source := range b.sources {
+			if source.Repository == rs.Repository && source.Ref == rs.Ref {
+				found = true
+				b.sources[i].Targets = appendUnique(source.Targets, targetStr)
+				break
+			}
+		}
+		if !found {
+			b.sources = append(b.sources, sourceSummary{
+				Repository: rs.Repository,
+				Ref:        rs.Ref,
+				Hash:       rs.Hash,
+				Targets:    []string{targetStr},
+			})
+		}
+	}
+}
+
+func appendUnique(strs []string, str string) []string {
+	for _, s := range strs {
+		if s == str {
+			return strs
+		}
+	}
+	return append(strs, str)
+}
+
+// recordImage records an output image, for the build summary.
+func (b *Builder) recordImage(ctx context.Context, imageToSave earthfile2llb.SaveImage, states *earthfile2llb.SingleTargetStates, pushed bool) {
+	dgst, err := b.imageDigest(ctx, imageToSave.DockerTag, pushed)
+	if err != nil {
+		// The summary is still useful without the digest.
+		b.console.Warnf("Warning: could not determine the digest of %s for the build summary: %v\n", imageToSave.DockerTag, err)
+	}
+	b.images = append(b.images, imageSummary{
+		Target: states.Target.StringCanonical(),
+		Image:  imageToSave.DockerTag,
+		Pushed: pushed,
+		Digest: dgst,
+	})
+}
+
+// WriteSummary writes the JSON summary of the build of target to opt.SummaryPath.
+// buildErr is the error the build failed with, if any.
+func (b *Builder) WriteSummary(opt BuildOpt, target domain.Target, buildErr error) error {
+	if opt.SummaryPath == "" {
+		return nil
+	}
+	now := time.Now()
+	summary := buildSummary{
+		Target:          target.StringCanonical(),
+		Success:         buildErr == nil,
+		Started:         b.startTime,
+		Completed:       now,
+		DurationSeconds: now.Sub(b.startTime).Seconds(),
+		Targets:         b.s.sm.targetSummaries(),
+		Images:          b.images,
+		Artifacts:       b.savedChecksums(),
+		CriticalPath:    b.s.sm.criticalPath(),
+		Sizes:           b.sizeReport,
+	}
+	if buildErr != nil {
+		summary.Error = buildErr.Error()
+		summary.ErrorCode = errcode.CategoryOf(buildErr)
+		summary.Failure = b.s.sm.failureSummary()
+	}
+	for _, ts := range summary.Targets {
+		summary.Commands += ts.Commands
+		summary.CacheHits += ts.CacheHits
+	}
+	summary.CacheHitRate = cacheHitRate(summary.CacheHits, summary.Commands)
+	if summary.Images == nil {
+		summary.Images = []imageSummary{}
+	}
+	if summary.Artifacts == nil {
+		summary.Artifacts = []artifactChecksum{}
+	}
+	summary.Attestations = append([]attestationSummary{}, b.attestations...)
+	summary.Pushes = []pushSummary{}
+	for _, pr := range b.pushes {
+		ps := pushSummary{
+			Target: pr.target,
+			Image:  pr.image,
+			Pushed: pr.err == nil && pr.skippedAfter == "",
+			Digest: pr.digest,
+		}
+		if pr.err != nil {
+			ps.Error = pr.err.Error()
+		} else if pr.skippedAfter != "" {
+			ps.Error = fmt.Sprintf("skipped, as the pushes of %s failed", pr.skippedAfter)
+		}
+		summary.Pushes = append(summary.Pushes, ps)
+	}
+	summary.Sources = append([]sourceSummary{}, b.sources...)
+	sort.Slice(summary.Sources, func(i, j int) bool {
+		if summary.Sources[i].Repository != summary.Sources[j].Repository {
+			return summary.Sources[i].Repository < summary.Sources[j].Repository
+		}
+		return summary.Sources[i].Ref < summary.Sources[j].Ref
+	})
+	for _, source := range summary.Sources {
+		sort.Strings(source.Targets)
+	}
+	dt, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "json marshal build summary")
+	}
+	dir := filepath.Dir(opt.SummaryPath)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return errors.Wrapf(err, "mkdir all %s", dir)
+	}
+	err = ioutil.WriteFile(opt.SummaryPath, dt, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "write build summary %s", opt.SummaryPath)
+	}
+	b.console.Printf("Build summary as local %s\n", opt.SummaryPath)
+	return nil
+}
+
+// targetSummaries returns the stats of the targets executed, in the order in which
+// they started.
+func (sm *solverMonitor) targetSummaries() []targetSummary {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	tms := make([]*targetMonitor, 0, len(sm.targets))
+	for _, tm := range sm.targets {
+		tms = append(tms, tm)
+	}
+	sort.Slice(tms, func(i, j int) bool {
+		return tms[i].order < tms[j].order
+	})
+	summaries := make([]targetSummary, 0, len(tms))
+	for _, tm := range tms {
+		ts := targetSummary{
+			Target:    tm.target,
+			Salt:      tm.salt,
+			Success:   !tm.isError,
+			Started:   tm.started,
+			Commands:  tm.numVertices,
+			CacheHits: tm.numCached,
+		}
+		ts.CacheHitRate = cacheHitRate(ts.CacheHits, ts.Commands)
+		if tm.completed {
+			completed := tm.completedAt
+			ts.Completed = &completed
+			ts.DurationSeconds = completed.Sub(tm.started).Seconds()
+		}
+		summaries = append(summaries, ts)
+	}
+	return summaries
+}
+
+// failureSummary returns the command which caused the build to fail, if known.
+func (sm *solverMonitor) failureSummary() *failureInfo {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.failure
+}
+
+// cacheHitRate returns the ratio of the commands which were cached, rounded to
+// 3 decimals. Zero if there were no commands.
+func cacheHitRate(cacheHits int, commands int) float64 {
+	if commands == 0 {
+		return 0
+	}
+	return math.Round(1000*float64(cacheHits)/float64(commands)) / 1000
+}
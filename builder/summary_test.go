@@ -0,0 +1,120 @@
+package builder
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/earthly/earthly/conslogging"
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/earthly/earthly/errcode"
+)
+
+func TestWriteSummary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "earth-summary-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	console := conslogging.Current(conslogging.NoColor)
+	sm := newSolverMonitor(console)
+	start := time.Now().Add(-10 * time.Second)
+	sm.targets["+dep a"] = &targetMonitor{
+		target: "+dep", salt: "a", order: 0,
+		completed: true, started: start, completedAt: start.Add(2 * time.Second),
+		numVertices: 3, numCached: 2,
+	}
+	sm.targets["+build b"] = &targetMonitor{
+		target: "+build", salt: "b", order: 1,
+		completed: true, isError: true, started: start.Add(time.Second), completedAt: start.Add(5 * time.Second),
+		numVertices: 2, numCached: 0,
+	}
+	exitCode := 2
+	sm.failure = &failureInfo{Target: "+build", Command: "RUN false", ExitCode: &exitCode, Error: "exit code: 2"}
+	b := &Builder{
+		console:   console,
+		s:         &solver{sm: sm},
+		startTime: start,
+		images:    []imageSummary{{Target: "+build", Image: "test:latest", Digest: "sha256:abc"}},
+		pushes: []pushResult{
+			{target: "+build", image: "test:latest", err: errors.New("registry unavailable")},
+			{target: "+release", image: "release:latest", skippedAfter: "+build"},
+		},
+	}
+	remote := &earthfile2llb.SingleTargetStates{
+		Target: domain.Target{Registry: "github.com", ProjectPath: "foo/bar/base", Tag: "main", Target: "base"},
+		RemoteSource: &earthfile2llb.RemoteSource{
+			Repository: "github.com/foo/bar", Ref: "main", Hash: "0123456789abcdef0123456789abcdef01234567",
+		},
+	}
+	b.recordSources(&earthfile2llb.MultiTargetStates{
+		FinalStates: remote,
+		VisitedStates: map[string][]*earthfile2llb.SingleTargetStates{
+			"+build":               {{Target: domain.Target{LocalPath: ".", Target: "build"}}},
+			remote.Target.String(): {remote},
+		},
+	})
+	target := domain.Target{LocalPath: ".", Target: "build"}
+	opt := BuildOpt{SummaryPath: filepath.Join(dir, "out", "summary.json")}
+	err = b.WriteSummary(opt, target, errcode.Wrap(errors.New("build failed"), errcode.ExecFailure))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dt, err := ioutil.ReadFile(opt.SummaryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary buildSummary
+	err = json.Unmarshal(dt, &summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Success || summary.Error != "build failed" || summary.ErrorCode != errcode.ExecFailure {
+		t.Errorf("unexpected result %v %q %q", summary.Success, summary.Error, summary.ErrorCode)
+	}
+	if summary.Failure == nil || summary.Failure.Command != "RUN false" || *summary.Failure.ExitCode != 2 {
+		t.Errorf("unexpected failure %+v", summary.Failure)
+	}
+	if summary.Commands != 5 || summary.CacheHits != 2 || summary.CacheHitRate != 0.4 {
+		t.Errorf("unexpected counts %d %d %v", summary.Commands, summary.CacheHits, summary.CacheHitRate)
+	}
+	if len(summary.Targets) != 2 || summary.Targets[0].Target != "+dep" || summary.Targets[1].Success {
+		t.Fatalf("unexpected targets %+v", summary.Targets)
+	}
+	if summary.Targets[0].DurationSeconds != 2 {
+		t.Errorf("unexpected duration %v", summary.Targets[0].DurationSeconds)
+	}
+	if len(summary.Images) != 1 || summary.Images[0].Digest != "sha256:abc" {
+		t.Errorf("unexpected images %+v", summary.Images)
+	}
+	if len(summary.Sources) != 1 || summary.Sources[0].Hash != remote.RemoteSource.Hash ||
+		len(summary.Sources[0].Targets) != 1 || summary.Sources[0].Targets[0] != "github.com/foo/bar/base:main+base" {
+		t.Errorf("unexpected sources %+v", summary.Sources)
+	}
+	if len(summary.Pushes) != 2 || summary.Pushes[0].Pushed || summary.Pushes[0].Error != "registry unavailable" ||
+		summary.Pushes[1].Error != "skipped, as the pushes of +build failed" {
+		t.Errorf("unexpected pushes %+v", summary.Pushes)
+	}
+}
+
+func TestVertexCategory(t *testing.T) {
+	tests := map[string]errcode.Category{
+		"exporting cache": errcode.CacheError,
+		"importing cache manifest from example/cache": errcode.CacheError,
+		"pushing layers":              errcode.PushFailure,
+		"[+build 7cjeyvls] RUN false": errcode.ExecFailure,
+	}
+	for name, expected := range tests {
+		actual := vertexCategory(name)
+		if actual != expected {
+			t.Errorf("%s: expected %s, got %s", name, expected, actual)
+		}
+	}
+}
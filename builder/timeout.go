@@ -0,0 +1,129 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// targetTimeoutCheckInterval is how often the targets are checked against
+// BuildOpt.TargetTimeout.
+const targetTimeoutCheckInterval = time.Second
+
+// TimeoutError is returned when the build exceeds the deadline of its context, or
+// when one of its targets exceeds BuildOpt.TargetTimeout.
+type TimeoutError struct {
+	// Target is the target which exceeded BuildOpt.TargetTimeout. Empty if the whole
+	// build exceeded its deadline.
+	Target string
+	// Timeout is BuildOpt.TargetTimeout, if Target is set.
+	Timeout time.Duration
+	// Executing are the names of the commands which were executing when the timeout
+	// elapsed.
+	Executing []string
+}
+
+func (te *TimeoutError) Error() string {
+	if te.Target == "" {
+		return "build deadline exceeded"
+	}
+	return fmt.Sprintf("target %s exceeded its timeout of %s", te.Target, te.Timeout)
+}
+
+// watchTimeouts returns a context which is canceled once a target exceeds
+// opt.TargetTimeout, in addition to when ctx is. The returned stop function ends the
+// watch, and returns the timeout which elapsed, if any.
+func (b *Builder) watchTimeouts(ctx context.Context, opt BuildOpt) (context.Context, func() *TimeoutError) {
+	ctx, cancel := context.WithCancel(ctx)
+	var timeoutErr *TimeoutError
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var tick <-chan time.Time
+		if opt.TargetTimeout > 0 {
+			ticker := time.NewTicker(targetTimeoutCheckInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				if ctx.Err() == context.DeadlineExceeded {
+					timeoutErr = &TimeoutError{Executing: b.s.sm.executingVertices("")}
+				}
+				return
+			case now := <-tick:
+				timeoutErr = b.s.sm.timedOutTarget(opt.TargetTimeout, now)
+				if timeoutErr != nil {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return ctx, func() *TimeoutError {
+		cancel()
+		<-done
+		return timeoutErr
+	}
+}
+
+// printTimeout reports the timeout, together with the commands which were executing
+// when it elapsed.
+func (b *Builder) printTimeout(te *TimeoutError) {
+	if len(te.Executing) == 0 {
+		b.console.Warnf("Timed out: %s\n", te.Error())
+		return
+	}
+	b.console.Warnf("Timed out: %s. Executing at that point:\n", te.Error())
+	for _, name := range te.Executing {
+		b.console.Warnf("    %s\n", name)
+	}
+}
+
+// executingVertices returns the names of the vertices of the target which have started
+// and not completed yet, sorted. All targets are considered if targetKey is empty.
+func (sm *solverMonitor) executingVertices(targetKey string) []string {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.executingVerticesLocked(targetKey)
+}
+
+func (sm *solverMonitor) executingVerticesLocked(targetKey string) []string {
+	var ret []string
+	for _, vm := range sm.vertices {
+		if vm.isInternal || vm.vertex.Started == nil || vm.vertex.Completed != nil || vm.vertex.Error != "" {
+			continue
+		}
+		if targetKey != "" && vm.targetStr+" "+vm.salt != targetKey {
+			continue
+		}
+		ret = append(ret, vm.vertex.Name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// timedOutTarget returns the error of a target which is still executing, timeout
+// after its first command started, if any.
+func (sm *solverMonitor) timedOutTarget(timeout time.Duration, now time.Time) *TimeoutError {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	keys := make([]string, 0, len(sm.targets))
+	for key := range sm.targets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		tm := sm.targets[key]
+		if now.Sub(tm.started) <= timeout {
+			continue
+		}
+		executing := sm.executingVerticesLocked(key)
+		if len(executing) > 0 {
+			return &TimeoutError{Target: tm.target, Timeout: timeout, Executing: executing}
+		}
+	}
+	return nil
+}
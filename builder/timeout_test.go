@@ -0,0 +1,96 @@
+package builder
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/earthly/earthly/conslogging"
+	"github.com/moby/buildkit/client"
+	"github.com/opencontainers/go-digest"
+)
+
+func timeoutTestMonitor(now time.Time) *solverMonitor {
+	sm := newSolverMonitor(conslogging.Current(conslogging.NoColor))
+	started := now.Add(-time.Minute)
+	completed := now.Add(-30 * time.Second)
+	sm.targets["+dep a"] = &targetMonitor{target: "+dep", salt: "a", started: now.Add(-time.Hour)}
+	sm.targets["+test b"] = &targetMonitor{target: "+test", salt: "b", started: started}
+	vertices := []struct {
+		target    string
+		salt      string
+		name      string
+		completed *time.Time
+		err       string
+	}{
+		{"+dep", "a", "[+dep a] RUN make", &completed, ""},
+		{"+test", "b", "[+test b] RUN go test ./...", nil, ""},
+		{"+test", "b", "[+test b] RUN go vet ./...", nil, "context canceled"},
+		{"+test", "b", "[+test b] RUN go build", &completed, ""},
+	}
+	for _, v := range vertices {
+		dgst := digest.FromString(v.name)
+		sm.vertices[dgst] = &vertexMonitor{
+			targetStr: v.target,
+			salt:      v.salt,
+			vertex: &client.Vertex{
+				Digest:    dgst,
+				Name:      v.name,
+				Started:   &started,
+				Completed: v.completed,
+				Error:     v.err,
+			},
+		}
+	}
+	return sm
+}
+
+func TestTimedOutTarget(t *testing.T) {
+	now := time.Now()
+	sm := timeoutTestMonitor(now)
+	// +dep exceeded the timeout, but is not executing anymore.
+	te := sm.timedOutTarget(2*time.Minute, now)
+	if te != nil {
+		t.Errorf("expected no timeout, got %v", te)
+	}
+	te = sm.timedOutTarget(30*time.Second, now)
+	if te == nil {
+		t.Fatal("expected a timeout")
+	}
+	if te.Target != "+test" || te.Timeout != 30*time.Second {
+		t.Errorf("unexpected timeout %v", te)
+	}
+	expected := []string{"[+test b] RUN go test ./..."}
+	if !reflect.DeepEqual(te.Executing, expected) {
+		t.Errorf("expected executing %v, got %v", expected, te.Executing)
+	}
+}
+
+func TestWatchTimeoutsDeadline(t *testing.T) {
+	now := time.Now()
+	b := &Builder{
+		console: conslogging.Current(conslogging.NoColor),
+		s:       &solver{sm: timeoutTestMonitor(now)},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	solveCtx, stop := b.watchTimeouts(ctx, BuildOpt{})
+	<-solveCtx.Done()
+	te := stop()
+	if te == nil {
+		t.Fatal("expected a timeout")
+	}
+	if te.Target != "" || len(te.Executing) != 1 {
+		t.Errorf("unexpected timeout %v (executing %v)", te, te.Executing)
+	}
+
+	solveCtx, stop = b.watchTimeouts(context.Background(), BuildOpt{})
+	te = stop()
+	if te != nil {
+		t.Errorf("expected no timeout, got %v", te)
+	}
+	if solveCtx.Err() == nil {
+		t.Errorf("expected the context to be canceled once stopped")
+	}
+}
@@ -0,0 +1,244 @@
+package builder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/earthly/earthly/logging"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/docker/distribution/reference"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+// AddWorker adds a buildkitd instance to the pool of workers of the builder. When
+// the pool has more than one worker, the targets of a build are scheduled across
+// the workers, and their side effects are built in parallel. Images and artifacts
+// are output from the worker which built the target. The targets built for another
+// platform (via FROM --platform) are scheduled on the workers running that platform
+// natively, if any.
+func (b *Builder) AddWorker(ctx context.Context, bkClient *client.Client) error {
+	if b.s.remoteCache == "" {
+		// Without it, the dependencies shared by targets scheduled on different workers
+		// would be built again on each of them.
+		return errors.New("a pool of workers requires a remote cache (--remote-cache), to share the dependencies of the targets between the workers")
+	}
+	if len(b.workers) == 0 {
+		platform, err := nativePlatform(ctx, b.s.bkClient)
+		if err != nil {
+			return err
+		}
+		b.s.platform = platform
+		b.workers = append(b.workers, b.s)
+	}
+	platform, err := nativePlatform(ctx, bkClient)
+	if err != nil {
+		return err
+	}
+	b.workers = append(b.workers, &solver{
+		sm:           b.s.sm,
+		bkClient:     bkClient,
+		remoteCache:  b.s.remoteCache,
+		attachables:  b.s.attachables,
+		enttlmnts:    b.s.enttlmnts,
+		reproducible: b.s.reproducible,
+		epoch:        b.s.epoch,
+		platform:     platform,
+	})
+	return nil
+}
+
+// nativePlatform returns the platform the buildkit daemon runs natively, which buildkit
+// lists first among the platforms of its workers. Nil if unknown.
+func nativePlatform(ctx context.Context, bkClient *client.Client) (*specs.Platform, error) {
+	workers, err := bkClient.ListWorkers(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "list buildkit workers")
+	}
+	if len(workers) == 0 || len(workers[0].Platforms) == 0 {
+		return nil, nil
+	}
+	platform := platforms.Normalize(workers[0].Platforms[0])
+	return &platform, nil
+}
+
+// solverFor returns the solver of the worker the target is scheduled on. A target
+// is always scheduled on the same worker (as long as the pool does not change), such
+// that it keeps hitting the cache of previous builds.
+func (b *Builder) solverFor(states *earthfile2llb.SingleTargetStates) *solver {
+	if len(b.workers) == 0 {
+		return b.s
+	}
+	native := make([]*specs.Platform, 0, len(b.workers))
+	for _, w := range b.workers {
+		native = append(native, w.platform)
+	}
+	return b.workers[workerFor(states.Target.StringCanonical(), states.Platform, native)]
+}
+
+// workerFor picks the worker of the target with the given key, built for platform,
+// among workers running the given platforms natively (nil if unknown). The target is
+// scheduled on one of the workers running its platform natively, if any, and on any of
+// the workers otherwise, which then run the platform via emulation.
+func workerFor(key string, platform specs.Platform, native []*specs.Platform) int {
+	var candidates []int
+	for i, p := range native {
+		if p != nil && platforms.Only(*p).Match(platform) {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		return workerIndex(key, len(native))
+	}
+	return candidates[workerIndex(key, len(candidates))]
+}
+
+// workerIndex picks one of n workers for the given key, via rendezvous hashing:
+// adding or removing a worker only moves the keys of that worker.
+func workerIndex(key string, n int) int {
+	bestIndex := 0
+	var bestScore uint64
+	for i := 0; i < n; i++ {
+		var indexBytes [8]byte
+		binary.BigEndian.PutUint64(indexBytes[:], uint64(i))
+		h := sha256.Sum256(append([]byte(key), indexBytes[:]...))
+		score := binary.BigEndian.Uint64(h[:8])
+		if i == 0 || score > bestScore {
+			bestIndex = i
+			bestScore = score
+		}
+	}
+	return bestIndex
+}
+
+// buildSideEffectsDistributed builds the side effects of all the targets, each on
+// the worker it is scheduled on. A target is only built once the targets it depends
+// on are, and their cache is exported to the remote cache. The worker of the target
+// imports it from there, such that the dependencies shared by targets scheduled on
+// different workers are only built once. Independent targets are built in parallel.
+func (b *Builder) buildSideEffectsDistributed(ctx context.Context, localDirs map[string]string, mts *earthfile2llb.MultiTargetStates) error {
+	return solveInDependencyOrder(ctx, dependencyClosure(mts.FinalStates), func(ctx context.Context, states *earthfile2llb.SingleTargetStates) error {
+		targetCtx := logging.With(ctx, "target", states.Target.String())
+		solveCtx := logging.With(targetCtx, "solve", "side-effects")
+		state := states.OwnSideEffectsState
+		if b.noCache {
+			state = state.SetMarshalDefaults(llb.IgnoreCache)
+		}
+		refs, err := targetCacheRefs(b.s.remoteCache, states)
+		if err != nil {
+			return err
+		}
+		err = b.solverFor(states).solveSideEffectsCached(solveCtx, localDirs, state, refs, states.Retries)
+		if err != nil {
+			return errors.Wrapf(err, "solve side effects of %s", states.Target.String())
+		}
+		return nil
+	})
+}
+
+// solveInDependencyOrder calls solve once for each of the given states, which need to
+// include all the states they depend on. The states are solved in parallel, each once
+// all the states it depends on have been solved successfully.
+func solveInDependencyOrder(ctx context.Context, closure []*earthfile2llb.SingleTargetStates, solve func(context.Context, *earthfile2llb.SingleTargetStates) error) error {
+	done := make(map[*earthfile2llb.SingleTargetStates]chan struct{}, len(closure))
+	for _, states := range closure {
+		done[states] = make(chan struct{})
+	}
+	eg, ctx := errgroup.WithContext(ctx)
+	for _, states := range closure {
+		states := states
+		eg.Go(func() error {
+			for _, dep := range states.Deps {
+				select {
+				case <-done[dep]:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			err := solve(ctx, states)
+			if err != nil {
+				return err
+			}
+			close(done[states])
+			return nil
+		})
+	}
+	return eg.Wait()
+}
+
+// targetCacheRefs returns the remote cache refs of the side effects of a target built
+// on a pool of workers. Each target exports its cache to a tag of its own, as the
+// targets built concurrently would otherwise overwrite the cache of each other. The
+// cache of the target, of its direct dependencies (which contains that of their own
+// dependencies) and the shared remote cache are imported.
+func targetCacheRefs(remoteCache string, states *earthfile2llb.SingleTargetStates) (cacheRefs, error) {
+	export, err := targetCacheRef(remoteCache, states)
+	if err != nil {
+		return cacheRefs{}, err
+	}
+	refs := cacheRefs{
+		export:  export,
+		imports: []string{remoteCache, export},
+	}
+	for _, dep := range states.Deps {
+		depRef, err := targetCacheRef(remoteCache, dep)
+		if err != nil {
+			return cacheRefs{}, err
+		}
+		refs.imports = append(refs.imports, depRef)
+	}
+	return refs, nil
+}
+
+// targetCacheRef returns the remote cache ref the target exports its cache to: the tag
+// of the remote cache (latest if none), suffixed by a hash of the target and its build
+// args.
+func targetCacheRef(remoteCache string, states *earthfile2llb.SingleTargetStates) (string, error) {
+	named, err := reference.ParseNormalizedNamed(remoteCache)
+	if err != nil {
+		return "", errors.Wrapf(err, "parse remote cache %s", remoteCache)
+	}
+	tag := "latest"
+	if tagged, ok := named.(reference.Tagged); ok {
+		tag = tagged.Tag()
+	}
+	key, err := states.TargetInput.Hash()
+	if err != nil {
+		return "", errors.Wrapf(err, "hash target input of %s", states.Target.String())
+	}
+	if len(key) > 16 {
+		key = key[:16]
+	}
+	ref, err := reference.WithTag(reference.TrimNamed(named), fmt.Sprintf("%s-%s", tag, key))
+	if err != nil {
+		return "", errors.Wrapf(err, "tag remote cache %s", remoteCache)
+	}
+	return ref.String(), nil
+}
+
+// dependencyClosure returns the given target states, together with all the target
+// states they depend on, directly or indirectly.
+func dependencyClosure(sts *earthfile2llb.SingleTargetStates) []*earthfile2llb.SingleTargetStates {
+	visited := make(map[*earthfile2llb.SingleTargetStates]bool)
+	var ret []*earthfile2llb.SingleTargetStates
+	var visit func(*earthfile2llb.SingleTargetStates)
+	visit = func(s *earthfile2llb.SingleTargetStates) {
+		if visited[s] {
+			return
+		}
+		visited[s] = true
+		ret = append(ret, s)
+		for _, dep := range s.Deps {
+			visit(dep)
+		}
+	}
+	visit(sts)
+	return ret
+}
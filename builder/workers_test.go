@@ -0,0 +1,186 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/earthly/earthly/earthfile2llb/dedup"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestWorkerIndex(t *testing.T) {
+	counts := make(map[int]int)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("github.com/foo/bar+target%d", i)
+		idx := workerIndex(key, 4)
+		if idx != workerIndex(key, 4) {
+			t.Fatalf("%s: not stable", key)
+		}
+		counts[idx]++
+		// Removing the last worker only moves its own keys.
+		if idx != 3 && workerIndex(key, 3) != idx {
+			t.Errorf("%s: moved from worker %d to %d", key, idx, workerIndex(key, 3))
+		}
+	}
+	for i := 0; i < 4; i++ {
+		if counts[i] < 150 {
+			t.Errorf("worker %d: only %d keys of 1000", i, counts[i])
+		}
+	}
+}
+
+func TestDependencyClosure(t *testing.T) {
+	base := &earthfile2llb.SingleTargetStates{}
+	a := &earthfile2llb.SingleTargetStates{Deps: []*earthfile2llb.SingleTargetStates{base}}
+	b := &earthfile2llb.SingleTargetStates{Deps: []*earthfile2llb.SingleTargetStates{base, a}}
+	final := &earthfile2llb.SingleTargetStates{Deps: []*earthfile2llb.SingleTargetStates{a, b}}
+	closure := dependencyClosure(final)
+	if len(closure) != 4 {
+		t.Fatalf("expected 4 states, got %d", len(closure))
+	}
+	if closure[0] != final {
+		t.Errorf("expected the final states first")
+	}
+}
+
+func TestWorkerFor(t *testing.T) {
+	amd64 := platforms.MustParse("linux/amd64")
+	arm64 := platforms.MustParse("linux/arm64")
+	native := []*specs.Platform{&amd64, nil, &arm64, &amd64, &arm64}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("github.com/foo/bar+target%d", i)
+		idx := workerFor(key, arm64, native)
+		if idx != 2 && idx != 4 {
+			t.Errorf("%s: arm64 scheduled on worker %d", key, idx)
+		}
+		idx = workerFor(key, amd64, native)
+		if idx != 0 && idx != 3 {
+			t.Errorf("%s: amd64 scheduled on worker %d", key, idx)
+		}
+		// No native worker: any worker, via emulation.
+		idx = workerFor(key, platforms.MustParse("linux/s390x"), native)
+		if idx != workerIndex(key, len(native)) {
+			t.Errorf("%s: s390x scheduled on worker %d", key, idx)
+		}
+	}
+}
+
+func TestSolveInDependencyOrderSharedDep(t *testing.T) {
+	newStates := func(name string, deps ...*earthfile2llb.SingleTargetStates) *earthfile2llb.SingleTargetStates {
+		target, err := domain.ParseTarget("github.com/foo/bar+" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &earthfile2llb.SingleTargetStates{
+			Target:      target,
+			TargetInput: dedup.TargetInput{TargetCanonical: target.StringCanonical()},
+			Deps:        deps,
+		}
+	}
+	base := newStates("base")
+	// Two targets depending on base, scheduled on different workers of a pool of two.
+	a := newStates("a", base)
+	var b *earthfile2llb.SingleTargetStates
+	for i := 0; b == nil; i++ {
+		candidate := newStates(fmt.Sprintf("b%d", i), base)
+		if workerIndex(candidate.Target.StringCanonical(), 2) != workerIndex(a.Target.StringCanonical(), 2) {
+			b = candidate
+		}
+	}
+	final := newStates("final", a, b)
+
+	var mu sync.Mutex
+	solved := make(map[*earthfile2llb.SingleTargetStates]int)
+	err := solveInDependencyOrder(context.Background(), dependencyClosure(final), func(ctx context.Context, states *earthfile2llb.SingleTargetStates) error {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, dep := range states.Deps {
+			if solved[dep] == 0 {
+				t.Errorf("%s: solved before its dependency %s", states.Target.String(), dep.Target.String())
+			}
+		}
+		solved[states]++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, states := range []*earthfile2llb.SingleTargetStates{base, a, b, final} {
+		if solved[states] != 1 {
+			t.Errorf("%s: expected to be solved once, got %d", states.Target.String(), solved[states])
+		}
+	}
+
+	// The workers of a and b import the cache base exported, rather than building it
+	// again.
+	baseRefs, err := targetCacheRefs("example.com/cache:main", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, states := range []*earthfile2llb.SingleTargetStates{a, b} {
+		refs, err := targetCacheRefs("example.com/cache:main", states)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if refs.export == baseRefs.export {
+			t.Errorf("%s: expected its own cache ref, got %s", states.Target.String(), refs.export)
+		}
+		if !containsString(refs.imports, baseRefs.export) {
+			t.Errorf("%s: expected to import %s, got %v", states.Target.String(), baseRefs.export, refs.imports)
+		}
+	}
+}
+
+func TestSolveInDependencyOrderError(t *testing.T) {
+	base := &earthfile2llb.SingleTargetStates{}
+	a := &earthfile2llb.SingleTargetStates{Deps: []*earthfile2llb.SingleTargetStates{base}}
+	var mu sync.Mutex
+	var solvedA bool
+	err := solveInDependencyOrder(context.Background(), dependencyClosure(a), func(ctx context.Context, states *earthfile2llb.SingleTargetStates) error {
+		if states == base {
+			return fmt.Errorf("base failed")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		solvedA = true
+		return nil
+	})
+	if err == nil || err.Error() != "base failed" {
+		t.Errorf("expected the error of base, got %v", err)
+	}
+	if solvedA {
+		t.Error("expected a not to be solved after its dependency failed")
+	}
+}
+
+func TestTargetCacheRef(t *testing.T) {
+	states := &earthfile2llb.SingleTargetStates{
+		TargetInput: dedup.TargetInput{TargetCanonical: "github.com/foo/bar+build"},
+	}
+	hash, err := states.TargetInput.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		remoteCache string
+		expected    string
+	}{
+		{"myorg/cache", "docker.io/myorg/cache:latest-" + hash[:16]},
+		{"example.com:5000/cache:main", "example.com:5000/cache:main-" + hash[:16]},
+	}
+	for _, test := range tests {
+		ref, err := targetCacheRef(test.remoteCache, states)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.remoteCache, err)
+			continue
+		}
+		if ref != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.remoteCache, test.expected, ref)
+		}
+	}
+}
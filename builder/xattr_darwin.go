@@ -0,0 +1,12 @@
+package builder
+
+// Extended attributes are not preserved on macOS, as they have a different
+// namespace than the Linux ones found within build environments.
+
+func listXattrs(p string) (map[string]string, error) {
+	return nil, nil
+}
+
+func setXattr(p string, key string, value string) error {
+	return nil
+}
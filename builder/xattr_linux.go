@@ -0,0 +1,47 @@
+package builder
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+func listXattrs(p string) (map[string]string, error) {
+	size, err := unix.Llistxattr(p, nil)
+	if err == unix.ENOTSUP {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "list xattrs of %s", p)
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(p, buf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "list xattrs of %s", p)
+	}
+	xattrs := make(map[string]string)
+	for _, key := range bytes.Split(buf[:size], []byte{0}) {
+		if len(key) == 0 {
+			continue
+		}
+		valueSize, err := unix.Lgetxattr(p, string(key), nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get xattr %s of %s", key, p)
+		}
+		value := make([]byte, valueSize)
+		valueSize, err = unix.Lgetxattr(p, string(key), value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get xattr %s of %s", key, p)
+		}
+		xattrs[string(key)] = string(value[:valueSize])
+	}
+	return xattrs, nil
+}
+
+func setXattr(p string, key string, value string) error {
+	return unix.Lsetxattr(p, key, []byte(value), 0)
+}
@@ -21,11 +21,33 @@ const (
 	ContainerName = "earthly-buildkitd"
 	// VolumeName is the name of the docker volume used for storing the cache.
 	VolumeName = "earthly-cache"
+	// RootlessVolumeName is the name of the docker volume used for storing the cache
+	// of the rootless daemon, whose files are owned by the ids of its user namespace.
+	RootlessVolumeName = "earthly-cache-rootless"
+	// EmbeddedRegistryAddr is the address of the embedded registry, as seen from within
+	// the buildkitd container.
+	EmbeddedRegistryAddr = "127.0.0.1:8371"
 )
 
 // Address is the address at which the daemon is available.
 var Address = fmt.Sprintf("docker-container://%s", ContainerName)
 
+// rootlessEnv is the env of the rootless daemon, which runs as the unprivileged user
+// of the buildkitd image (uid 1000), as in the rootless image of buildkit. The
+// buildctl commands executed in the container to connect to the daemon (see Address)
+// run as that user too, and find the socket of the daemon via BUILDKIT_HOST.
+var rootlessEnv = []string{
+	"EARTHLY_ROOTLESS=true",
+	"HOME=/home/user",
+	"USER=user",
+	"XDG_RUNTIME_DIR=/run/user/1000",
+	"TMPDIR=/home/user/.local/tmp",
+	"BUILDKIT_HOST=unix:///run/user/1000/buildkit/buildkitd.sock",
+}
+
+// rootlessUser is the user the rootless daemon runs as.
+const rootlessUser = "1000:1000"
+
 // TODO: Implement all this properly with the docker client.
 
 // NewClient returns a new buildkitd client.
@@ -196,17 +218,38 @@ func Start(ctx context.Context, image string, settings Settings, reset bool) err
 	}
 	env := os.Environ()
 	runMount := fmt.Sprintf("%s:/run/earthly:consistent", settings.RunDir)
+	volumeName := VolumeName
+	if settings.Rootless {
+		volumeName = RootlessVolumeName
+	}
 	args := []string{
 		"run",
 		"-d",
-		"-v", fmt.Sprintf("%s:/tmp/earthly:rw", VolumeName),
+		"-v", fmt.Sprintf("%s:/tmp/earthly:rw", volumeName),
 		"-v", runMount,
-		"-e", fmt.Sprintf("ENABLE_LOOP_DEVICE=%t", !settings.DisableLoopDevice),
-		"-e", fmt.Sprintf("FORCE_LOOP_DEVICE=%t", !settings.DisableLoopDevice),
+		"-e", fmt.Sprintf("ENABLE_LOOP_DEVICE=%t", !settings.DisableLoopDevice && !settings.Rootless),
+		"-e", fmt.Sprintf("FORCE_LOOP_DEVICE=%t", !settings.DisableLoopDevice && !settings.Rootless),
 		"-e", fmt.Sprintf("BUILDKIT_DEBUG=%t", settings.Debug),
 		"--label", fmt.Sprintf("dev.earthly.settingshash=%s", settingsHash),
+		"--label", fmt.Sprintf("dev.earthly.insecureregistries=%s", strings.Join(settings.InsecureRegistries, ",")),
 		"--name", ContainerName,
-		"--privileged",
+	}
+	if settings.Rootless {
+		// Buildkitd runs within a user namespace (via rootlesskit), which the default
+		// seccomp and apparmor profiles do not allow creating. The commands of the build
+		// run in PID namespaces of their own, such that they cannot signal or trace
+		// buildkitd, which requires mounting a new /proc, masked by default.
+		args = append(args,
+			"--user", rootlessUser,
+			"--security-opt", "seccomp=unconfined",
+			"--security-opt", "apparmor=unconfined",
+			"--security-opt", "systempaths=unconfined",
+		)
+		for _, e := range rootlessEnv {
+			args = append(args, "-e", e)
+		}
+	} else {
+		args = append(args, "--privileged")
 	}
 	if os.Getenv("EARTHLY_WITH_DOCKER") == "1" {
 		// Add /sys/fs/cgroup if it's earthly-in-earthly.
@@ -218,12 +261,26 @@ func Start(ctx context.Context, image string, settings Settings, reset bool) err
 		args = append(args,
 			"-p", fmt.Sprintf("127.0.0.1:%d:5000", settings.DebuggerPort))
 	}
+	if settings.EmbeddedRegistry {
+		args = append(args,
+			"-e", fmt.Sprintf("EARTHLY_EMBEDDED_REGISTRY_ADDR=%s", EmbeddedRegistryAddr))
+	}
 	// Apply some buildkitd-related settings.
 	if settings.CacheSizeMb > 0 {
 		args = append(args,
 			"-e", fmt.Sprintf("CACHE_SIZE_MB=%d", settings.CacheSizeMb),
 		)
 	}
+	if len(settings.GCPolicies) > 0 {
+		args = append(args, "-e", "EARTHLY_GC_POLICIES")
+		env = append(env, fmt.Sprintf("EARTHLY_GC_POLICIES=%s",
+			base64.StdEncoding.EncodeToString([]byte(gcPoliciesTOML(settings.GCPolicies)))))
+	}
+	if len(settings.InsecureRegistries) > 0 {
+		args = append(args, "-e", "EARTHLY_REGISTRY_CONFIG")
+		env = append(env, fmt.Sprintf("EARTHLY_REGISTRY_CONFIG=%s",
+			base64.StdEncoding.EncodeToString([]byte(registriesTOML(settings.InsecureRegistries)))))
+	}
 	// Apply some git-related settings.
 	if settings.SSHAuthSock != "" {
 		args = append(args,
@@ -312,6 +369,25 @@ func WaitUntilStarted(ctx context.Context, address string, opTimeout time.Durati
 	}
 }
 
+// WaitUntilReconnected waits until an existing client is connected again to the
+// buildkitd daemon, after it was restarted.
+func WaitUntilReconnected(ctx context.Context, bkClient *client.Client, opTimeout time.Duration) error {
+	ctxTimeout, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	for {
+		_, err := bkClient.ListWorkers(ctxTimeout)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-time.After(1 * time.Second):
+			// Try again.
+		case <-ctxTimeout.Done():
+			return errors.New("Timeout: could not reconnect to buildkitd")
+		}
+	}
+}
+
 // WaitUntilStopped waits until the buildkitd daemon has stopped.
 func WaitUntilStopped(ctx context.Context, opTimeout time.Duration) error {
 	ctxTimeout, cancel := context.WithTimeout(ctx, opTimeout)
@@ -352,6 +428,20 @@ func GetSettingsHash(ctx context.Context) (string, error) {
 	return string(output), nil
 }
 
+// GetInsecureRegistries fetches the insecure registries of the currently running
+// buildkitd container.
+func GetInsecureRegistries(ctx context.Context) ([]string, error) {
+	cmd := exec.CommandContext(ctx,
+		"docker", "inspect",
+		"--format={{index .Config.Labels \"dev.earthly.insecureregistries\"}}",
+		ContainerName)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, errors.Wrap(err, "get output for insecure registries")
+	}
+	return parseInsecureRegistries(string(output)), nil
+}
+
 // GetContainerImageID fetches the ID of the image used for the running buildkitd container.
 func GetContainerImageID(ctx context.Context) (string, error) {
 	cmd := exec.CommandContext(ctx,
@@ -2,20 +2,181 @@
 
 set -e
 
+# Acquire the concurrency locks of the target (earth --max-parallelism and
+# --serialize-target) via the debugger, for the whole of WITH DOCKER, including the
+# services started before the command.
+if [ -z "$EARTHLY_LOCKED" ] && [ -x /usr/bin/earth_debugger ]; then
+    exec /usr/bin/earth_debugger --lock "$0" "$@"
+fi
+
 if [ -z "$EARTHLY_DOCKERD_DATA_ROOT" ]; then
     echo "EARTHLY_DOCKERD_DATA_ROOT not set"
     exit 1
 fi
 
+EARTHLY_DOCKERD_RUNTIME="${EARTHLY_DOCKERD_RUNTIME:-docker}"
+runtime_pid_file=/var/run/earthly-runtime.pid
+
+# container_cli runs the CLI of the selected container runtime.
+container_cli() {
+    case "$EARTHLY_DOCKERD_RUNTIME" in
+        podman)
+            podman --root "$EARTHLY_DOCKERD_DATA_ROOT" "$@"
+            ;;
+        nerdctl)
+            nerdctl "$@"
+            ;;
+        *)
+            docker "$@"
+            ;;
+    esac
+}
+
+compose_cli() {
+    if [ "$EARTHLY_DOCKERD_RUNTIME" = "nerdctl" ]; then
+        nerdctl compose "$@"
+    else
+        # Podman serves the docker API on the default docker socket.
+        docker-compose "$@"
+    fi
+}
+
+# ca_certs_file prints the path of a CA bundle combining the system certs with the
+# additional ones in $EARTHLY_CA_CERTS_FILE, or nothing if there are none.
+ca_certs_file() {
+    if [ -z "$EARTHLY_CA_CERTS_FILE" ]; then
+        return
+    fi
+    combined="$(dirname "$EARTHLY_CA_CERTS_FILE")/dockerd-ca-certificates.crt"
+    for f in /etc/ssl/certs/ca-certificates.crt /etc/pki/tls/certs/ca-bundle.crt /etc/ssl/cert.pem; do
+        if [ -f "$f" ]; then
+            cat "$f"
+            echo
+            break
+        fi
+    done >"$combined"
+    cat "$EARTHLY_CA_CERTS_FILE" >>"$combined"
+    echo "$combined"
+}
+
+# own_cgroup prints the path of the cgroup of this shell, for the cgroup v1 controller
+# $1, or for cgroup v2 if $1 is empty. The path is relative to the root of the
+# hierarchy mounted at /sys/fs/cgroup, eg /buildkit/<id>.
+own_cgroup() {
+    if [ -z "$1" ]; then
+        sed -n 's/^0:://p' /proc/self/cgroup
+        return
+    fi
+    awk -F: -v c="$1" '{ n = split($2, a, ","); for (i = 1; i <= n; i++) if (a[i] == c) print $3 }' /proc/self/cgroup
+}
+
+# only_own_processes returns whether the cgroup dir $1 only holds the processes of this
+# container. The processes of other PID namespaces are listed as 0.
+only_own_processes() {
+    ! grep -qx 0 "$1/cgroup.procs" 2>/dev/null && ! grep -qx 0 "$1/tasks" 2>/dev/null
+}
+
+# limit_resources moves this shell into a new cgroup limited to
+# $EARTHLY_DOCKERD_CPU_QUOTA (microseconds of CPU time per 100ms) and
+# $EARTHLY_DOCKERD_MEMORY (bytes), such that the daemon, its containers and the
+# command, all started afterwards, share the limits. The cgroup is a child of the
+# cgroup of this container, and release_resources removes it. The cgroups of the
+# host and of other containers are never modified.
+limit_resources() {
+    name="earthly-with-docker-$$"
+    if [ -f /sys/fs/cgroup/cgroup.controllers ]; then
+        # cgroup v2.
+        own="$(own_cgroup)"
+        base="/sys/fs/cgroup${own%/}"
+        only_own_processes "$base" || return 1
+        # Controllers can only be enabled for the children of a cgroup without
+        # processes, so the processes of this container are moved to a leaf cgroup
+        # first.
+        mkdir -p "$base/earthly-init" "$base/$name" || return 1
+        limited_cgroups="$base/$name"
+        release_to="$base/earthly-init/cgroup.procs"
+        for pid in $(cat "$base/cgroup.procs"); do
+            echo "$pid" >"$base/earthly-init/cgroup.procs" 2>/dev/null || true
+        done
+        echo "+cpu +memory" >"$base/cgroup.subtree_control" || return 1
+        if [ -n "$EARTHLY_DOCKERD_CPU_QUOTA" ]; then
+            echo "$EARTHLY_DOCKERD_CPU_QUOTA 100000" >"$base/$name/cpu.max" || return 1
+        fi
+        if [ -n "$EARTHLY_DOCKERD_MEMORY" ]; then
+            echo "$EARTHLY_DOCKERD_MEMORY" >"$base/$name/memory.max" || return 1
+        fi
+        echo "$$" >"$base/$name/cgroup.procs" || return 1
+    else
+        # cgroup v1, in which each controller has a hierarchy of its own.
+        for controller in cpu memory; do
+            case "$controller" in
+                cpu) [ -n "$EARTHLY_DOCKERD_CPU_QUOTA" ] || continue ;;
+                memory) [ -n "$EARTHLY_DOCKERD_MEMORY" ] || continue ;;
+            esac
+            own="$(own_cgroup "$controller")"
+            base="/sys/fs/cgroup/$controller${own%/}"
+            only_own_processes "$base" || return 1
+            mkdir -p "$base/$name" || return 1
+            limited_cgroups="$limited_cgroups $base/$name"
+            release_to="$release_to $base/tasks"
+            case "$controller" in
+                cpu)
+                    echo 100000 >"$base/$name/cpu.cfs_period_us" || return 1
+                    echo "$EARTHLY_DOCKERD_CPU_QUOTA" >"$base/$name/cpu.cfs_quota_us" || return 1
+                    ;;
+                memory)
+                    echo "$EARTHLY_DOCKERD_MEMORY" >"$base/$name/memory.limit_in_bytes" || return 1
+                    ;;
+            esac
+            echo "$$" >"$base/$name/tasks" || return 1
+        done
+    fi
+    # Containers are created under the given cgroup parent, rather than under /docker.
+    dockerd_cgroup_parent="${own%/}/$name"
+}
+
+# release_resources moves this shell back out of the cgroups of limit_resources and
+# removes them, once the daemon and its containers are stopped.
+release_resources() {
+    for f in $release_to; do
+        echo "$$" >"$f" 2>/dev/null || true
+    done
+    for d in $limited_cgroups; do
+        # The cgroups docker left behind, if any, are removed first.
+        find "$d" -mindepth 1 -depth -type d -exec rmdir {} \; 2>/dev/null || true
+        rmdir "$d" 2>/dev/null || true
+    done
+}
+
 start_dockerd() {
     mkdir -p "$EARTHLY_DOCKERD_DATA_ROOT"
-    dockerd --data-root="$EARTHLY_DOCKERD_DATA_ROOT" >/var/log/docker.log 2>&1 &
+    # The daemons pull images over TLS and honor SSL_CERT_FILE.
+    ssl_cert_file="$(ca_certs_file)"
+    case "$EARTHLY_DOCKERD_RUNTIME" in
+        docker)
+            if [ -n "$dockerd_cgroup_parent" ]; then
+                set -- --cgroup-parent="$dockerd_cgroup_parent"
+            fi
+            SSL_CERT_FILE="$ssl_cert_file" dockerd --data-root="$EARTHLY_DOCKERD_DATA_ROOT" "$@" >/var/log/docker.log 2>&1 &
+            ;;
+        podman)
+            SSL_CERT_FILE="$ssl_cert_file" podman --root "$EARTHLY_DOCKERD_DATA_ROOT" system service --time=0 unix:///var/run/docker.sock >/var/log/docker.log 2>&1 &
+            ;;
+        nerdctl)
+            SSL_CERT_FILE="$ssl_cert_file" containerd --root "$EARTHLY_DOCKERD_DATA_ROOT" >/var/log/docker.log 2>&1 &
+            ;;
+        *)
+            echo "Unsupported container runtime $EARTHLY_DOCKERD_RUNTIME"
+            exit 1
+            ;;
+    esac
+    echo "$!" >"$runtime_pid_file"
     i=1
     timeout=30
-    while ! docker ps >/dev/null 2>&1; do
+    while ! container_cli ps >/dev/null 2>&1; do
         sleep 1
         if [ "$i" -gt "$timeout" ]; then
-            # Print dockerd logs on start failure.
+            # Print daemon logs on start failure.
             cat /var/log/docker.log
             exit 1
         fi
@@ -24,7 +185,7 @@ start_dockerd() {
 }
 
 stop_dockerd() {
-    dockerd_pid="$(cat /var/run/docker.pid)"
+    dockerd_pid="$(cat "$runtime_pid_file")"
     timeout=10
     if [ -n "$dockerd_pid" ]; then
         kill "$dockerd_pid" >/dev/null 2>&1
@@ -37,22 +198,145 @@ stop_dockerd() {
             i=$((i+1))
         done
     fi
-    # Wipe dockerd data when done.
-    rm -rf "$EARTHLY_DOCKERD_DATA_ROOT"
+    rm -f "$runtime_pid_file"
+    if [ "$EARTHLY_DOCKERD_CACHE_DATA_ROOT" != "true" ]; then
+        # Wipe daemon data when done.
+        rm -rf "$EARTHLY_DOCKERD_DATA_ROOT"
+    fi
+}
+
+remove_containers() {
+    # When the data root is persisted, only the image layers should be kept across
+    # builds. Containers, networks and volumes are removed.
+    if [ "$EARTHLY_DOCKERD_CACHE_DATA_ROOT" = "true" ]; then
+        # shellcheck disable=SC2046
+        container_cli rm -f -v $(container_cli ps -aq) >/dev/null 2>&1 || true
+        container_cli network prune -f >/dev/null 2>&1 || true
+        container_cli volume prune -f >/dev/null 2>&1 || true
+    fi
+}
+
+# load_image streams the docker tar served by the socket $1 into the daemon. It fails
+# if either the read of the socket or the load does: sh has no pipefail, so the exit
+# code of the reader is passed out of the pipeline via fd 3.
+load_image() {
+    {
+        reader_code=$(
+            {
+                { /usr/bin/earth_debugger --read-socket "$1"; echo "$?" >&3; } | container_cli load >&4 3>&-
+            } 3>&1
+        )
+    } 4>&1
+    load_code=$?
+    if [ "$reader_code" != "0" ]; then
+        echo "Reading the image from $1 failed with exit code $reader_code" >&2
+        return 1
+    fi
+    return "$load_code"
 }
 
+# load_images streams the docker tars served by the sockets in
+# $EARTHLY_DOCKER_LOAD_SOCKETS into the daemon.
 load_images() {
-    if [ -n "$EARTHLY_DOCKER_LOAD_IMAGES" ]; then
+    if [ -n "$EARTHLY_DOCKER_LOAD_SOCKETS" ]; then
         echo "Loading images..."
-        for img in $EARTHLY_DOCKER_LOAD_IMAGES; do
-            docker load -i "$img" || (stop_dockerd; exit 1)
+        for sock in $EARTHLY_DOCKER_LOAD_SOCKETS; do
+            load_image "$sock" || (stop_dockerd; exit 1)
         done
         echo "...done"
     fi
 }
 
+pull_images() {
+    if [ -n "$EARTHLY_DOCKER_PULL_IMAGES" ]; then
+        echo "Pulling images from embedded registry..."
+        for entry in $EARTHLY_DOCKER_PULL_IMAGES; do
+            ref="${entry%%=*}"
+            tag="${entry#*=}"
+            (container_cli pull "$ref" && container_cli tag "$ref" "$tag") || (stop_dockerd; exit 1)
+        done
+        echo "...done"
+    fi
+}
+
+compose_args() {
+    for f in $EARTHLY_COMPOSE_FILES; do
+        printf -- '-f %s ' "$f"
+    done
+}
+
+# wait_healthy waits for the containers of the compose services to be running and, for
+# the ones which define a health check, to be healthy. Other containers are ignored.
+wait_healthy() {
+    timeout="${EARTHLY_WAIT_HEALTHY_TIMEOUT:-60}"
+    i=1
+    # shellcheck disable=SC2046,SC2086
+    while true; do
+        all_ready=true
+        for container in $(compose_cli $(compose_args) ps -q $EARTHLY_COMPOSE_SERVICES); do
+            status="$(container_cli inspect --format '{{if .State.Health}}{{.State.Health.Status}}{{else}}{{.State.Status}}{{end}}' "$container")"
+            case "$status" in
+                healthy|running)
+                    ;;
+                unhealthy|exited|dead)
+                    echo "Container $container is $status"
+                    container_cli logs "$container" || true
+                    return 1
+                    ;;
+                *)
+                    all_ready=false
+                    ;;
+            esac
+        done
+        if [ "$all_ready" = "true" ]; then
+            return 0
+        fi
+        if [ "$i" -gt "$timeout" ]; then
+            echo "Timed out after ${timeout}s waiting for compose services to become healthy"
+            return 1
+        fi
+        sleep 1
+        i=$((i+1))
+    done
+}
+
+start_compose() {
+    if [ -n "$EARTHLY_COMPOSE_FILES" ]; then
+        echo "Starting compose services..."
+        # shellcheck disable=SC2046,SC2086
+        compose_cli $(compose_args) up -d $EARTHLY_COMPOSE_SERVICES || (stop_dockerd; exit 1)
+        echo "...done"
+    fi
+}
+
+wait_services() {
+    if [ -n "$EARTHLY_COMPOSE_FILES" ] && [ "$EARTHLY_WAIT_HEALTHY" = "true" ]; then
+        echo "Waiting for compose services to become healthy..."
+        wait_healthy || (stop_compose; stop_dockerd; exit 1)
+        echo "...done"
+    fi
+}
+
+stop_compose() {
+    if [ -n "$EARTHLY_COMPOSE_FILES" ]; then
+        # shellcheck disable=SC2046
+        compose_cli $(compose_args) down --remove-orphans || true
+    fi
+}
+
 export EARTHLY_WITH_DOCKER=1
 
+dockerd_cgroup_parent=""
+limited_cgroups=""
+release_to=""
+if [ -n "$EARTHLY_DOCKERD_CPU_QUOTA" ] || [ -n "$EARTHLY_DOCKERD_MEMORY" ]; then
+    if ! limit_resources 2>/dev/null; then
+        release_resources
+        dockerd_cgroup_parent=""
+        echo "Warning: could not apply the WITH DOCKER --cpus and --memory limits (cgroups not writable, or shared with other processes)"
+    fi
+fi
+
 # Lock the creation and destruction of the docker daemon - only one daemon can be started at a time
 # (dockerd race conditions in handling networking setup).
 # shellcheck disable=SC2039
@@ -63,17 +347,24 @@ export EARTHLY_WITH_DOCKER=1
 ) 200>/var/earthly/dind/lock
 
 load_images
+pull_images
+start_compose
+wait_services
 
 set +e
 "$@"
 exit_code="$?"
 set -e
 
+stop_compose
+remove_containers
+
 # shellcheck disable=SC2039
 (
     flock -x 200
     stop_dockerd
     flock -u 200
 ) 200>/var/earthly/dind/lock
+release_resources
 
 exit "$exit_code"
@@ -0,0 +1,124 @@
+package buildkitd
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/earthly/earthly/conslogging"
+	"github.com/moby/buildkit/client"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// binfmtImage is the image which registers the QEMU emulators of foreign architectures
+// with the kernel, via binfmt_misc.
+const binfmtImage = "tonistiigi/binfmt:qemu-v5.0.1"
+
+// EnsurePlatforms makes sure that the buildkit daemon started by earth can run the
+// commands of the given platforms, registering the QEMU emulators of the platforms it
+// cannot run natively. The emulators are registered with the kernel of the docker host,
+// which the daemon shares.
+func EnsurePlatforms(ctx context.Context, console conslogging.ConsoleLogger, bkClient *client.Client, targetPlatforms []specs.Platform) error {
+	missing, supported, err := missingPlatforms(ctx, bkClient, targetPlatforms)
+	if err != nil {
+		return err
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	for _, p := range missing {
+		console.
+			WithPrefix("buildkitd").
+			Printf("Setting up QEMU emulation for %s...\n", platforms.Format(p))
+		cmd := exec.CommandContext(ctx, "docker", "run", "--rm", "--privileged", binfmtImage, "--install", p.Architecture)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return errors.Wrapf(
+				platformError(missing, supported, ""),
+				"docker run %s: %v: %s", binfmtImage, err, strings.TrimSpace(string(output)))
+		}
+	}
+	missing, supported, err = missingPlatforms(ctx, bkClient, targetPlatforms)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return platformError(missing, supported, "")
+	}
+	console.
+		WithPrefix("buildkitd").
+		Printf("...Done\n")
+	return nil
+}
+
+// CheckPlatforms returns an error if the buildkit daemon at address, which earth did not
+// start, cannot run the commands of the given platforms.
+func CheckPlatforms(ctx context.Context, bkClient *client.Client, address string, targetPlatforms []specs.Platform) error {
+	missing, supported, err := missingPlatforms(ctx, bkClient, targetPlatforms)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return platformError(missing, supported, address)
+	}
+	return nil
+}
+
+// missingPlatforms returns the platforms the workers of the buildkit daemon cannot run
+// commands for, natively or via emulation, as well as those they can.
+func missingPlatforms(ctx context.Context, bkClient *client.Client, targetPlatforms []specs.Platform) ([]specs.Platform, []specs.Platform, error) {
+	workers, err := bkClient.ListWorkers(ctx)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "list buildkit workers")
+	}
+	var supported []specs.Platform
+	for _, w := range workers {
+		supported = append(supported, w.Platforms...)
+	}
+	return unsupportedPlatforms(targetPlatforms, supported), supported, nil
+}
+
+// unsupportedPlatforms returns the target platforms which are not among the supported
+// ones.
+func unsupportedPlatforms(targetPlatforms []specs.Platform, supported []specs.Platform) []specs.Platform {
+	var ret []specs.Platform
+	for _, tp := range targetPlatforms {
+		found := false
+		for _, sp := range supported {
+			if platforms.Only(sp).Match(tp) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ret = append(ret, tp)
+		}
+	}
+	return ret
+}
+
+// platformError describes the platforms the buildkit daemon cannot run commands for, and
+// how to set up their emulation. The address is empty for the daemon started by earth.
+func platformError(missing []specs.Platform, supported []specs.Platform, address string) error {
+	var missingStrs, supportedStrs, archs []string
+	for _, p := range missing {
+		missingStrs = append(missingStrs, platforms.Format(p))
+		archs = append(archs, p.Architecture)
+	}
+	for _, p := range supported {
+		supportedStrs = append(supportedStrs, platforms.Format(p))
+	}
+	daemon := "the buildkit daemon"
+	if address != "" {
+		daemon = fmt.Sprintf("the buildkit daemon %s", address)
+	}
+	return fmt.Errorf(
+		"%s cannot run commands for %s (it supports %s): no QEMU emulator is registered "+
+			"for them via binfmt_misc. Register the emulators on the host of the daemon via "+
+			"docker run --rm --privileged %s --install %s",
+		daemon, strings.Join(missingStrs, ", "), strings.Join(supportedStrs, ", "),
+		binfmtImage, strings.Join(archs, ","))
+}
@@ -0,0 +1,42 @@
+package buildkitd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/platforms"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestUnsupportedPlatforms(t *testing.T) {
+	amd64 := platforms.MustParse("linux/amd64")
+	arm64 := platforms.MustParse("linux/arm64")
+	armv7 := platforms.MustParse("linux/arm/v7")
+	tests := []struct {
+		target    []specs.Platform
+		supported []specs.Platform
+		expected  int
+	}{
+		{[]specs.Platform{amd64}, []specs.Platform{amd64}, 0},
+		{[]specs.Platform{amd64}, []specs.Platform{arm64, armv7}, 1},
+		{[]specs.Platform{amd64, arm64}, []specs.Platform{arm64}, 1},
+		{[]specs.Platform{armv7}, []specs.Platform{amd64, arm64, armv7}, 0},
+	}
+	for _, test := range tests {
+		got := unsupportedPlatforms(test.target, test.supported)
+		if len(got) != test.expected {
+			t.Errorf("unsupportedPlatforms(%v, %v) = %v", test.target, test.supported, got)
+		}
+	}
+}
+
+func TestPlatformError(t *testing.T) {
+	err := platformError(
+		[]specs.Platform{platforms.MustParse("linux/amd64")},
+		[]specs.Platform{platforms.MustParse("linux/arm64")}, "tcp://worker:1234")
+	for _, expected := range []string{"tcp://worker:1234", "linux/amd64", "linux/arm64", "--install amd64"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q in %q", expected, err.Error())
+		}
+	}
+}
@@ -27,6 +27,13 @@ rm -rf "$EARTHLY_TMP_DIR/dind"
 mkdir -p "$EARTHLY_TMP_DIR/dind"
 
 # setup git credentials and config
+# The git config references the credential helpers in /usr/bin. Rootless, they are
+# written to the home of the user instead, which is the only place writable.
+git_credentials_dir=/usr/bin
+if [ "$EARTHLY_ROOTLESS" = "true" ]; then
+    git_credentials_dir="$HOME/.local/bin"
+    mkdir -p "$git_credentials_dir"
+fi
 i=0
 while true
 do
@@ -35,14 +42,15 @@ do
     # shellcheck disable=SC2154
     if [ -n "$data" ]
     then
-        echo 'echo $'$varname' | base64 -d' > /usr/bin/git_credentials_"$i"
-        chmod +x /usr/bin/git_credentials_"$i"
+        echo 'echo $'$varname' | base64 -d' > "$git_credentials_dir"/git_credentials_"$i"
+        chmod +x "$git_credentials_dir"/git_credentials_"$i"
     else
         break
     fi
     i=$((i+1))
 done
-echo "$EARTHLY_GIT_CONFIG" | base64 -d > /root/.gitconfig
+echo "$EARTHLY_GIT_CONFIG" | base64 -d | \
+    sed 's^helper=/usr/bin/git_credentials_^helper='"$git_credentials_dir"'/git_credentials_^' > "$HOME/.gitconfig"
 
 if [ -n "$GIT_URL_INSTEAD_OF" ]; then
     # GIT_URL_INSTEAD_OF can support multiple comma-separated values
@@ -62,11 +70,25 @@ echo "BUILDKIT_ROOT_DIR=$BUILDKIT_ROOT_DIR"
 echo "CACHE_SIZE_MB=$CACHE_SIZE_MB"
 sed 's^:BUILDKIT_ROOT_DIR:^'"$BUILDKIT_ROOT_DIR"'^g; s/:CACHE_SIZE_MB:/'"$CACHE_SIZE_MB"'/g; s/:BUILDKIT_DEBUG:/'"$BUILDKIT_DEBUG"'/g' \
     /etc/buildkitd.toml.template > /etc/buildkitd.toml
+if [ -n "$EARTHLY_GC_POLICIES" ]; then
+    # Replace the default gc policies with the configured ones, which are the last
+    # section of the config.
+    echo "Using custom gc policies"
+    sed -i '/# GC_POLICIES_BEGIN/,/# GC_POLICIES_END/d' /etc/buildkitd.toml
+    echo "$EARTHLY_GC_POLICIES" | base64 -d >> /etc/buildkitd.toml
+fi
+if [ -n "$EARTHLY_REGISTRY_CONFIG" ]; then
+    echo "Using insecure registries"
+    echo "$EARTHLY_REGISTRY_CONFIG" | base64 -d >> /etc/buildkitd.toml
+fi
 
 echo "ENABLE_LOOP_DEVICE=$ENABLE_LOOP_DEVICE"
 echo "FORCE_LOOP_DEVICE=$FORCE_LOOP_DEVICE"
 use_loop_device=false
-if [ "$FORCE_LOOP_DEVICE" = "true" ]; then
+if [ "$EARTHLY_ROOTLESS" = "true" ]; then
+    # Loop devices require privileges.
+    echo "Not using a loop device, as running rootless"
+elif [ "$FORCE_LOOP_DEVICE" = "true" ]; then
     use_loop_device=true
 else
     if [ "$ENABLE_LOOP_DEVICE" = "true" ]; then
@@ -125,12 +147,41 @@ echo starting shellrepeater
 shellrepeater &
 shellrepeaterpid=$!
 
-"$@" &
+# start the embedded registry, used for loading images in WITH DOCKER
+registrypid=""
+if [ -n "$EARTHLY_EMBEDDED_REGISTRY_ADDR" ]; then
+    echo "starting embedded registry at $EARTHLY_EMBEDDED_REGISTRY_ADDR"
+    mkdir -p "$EARTHLY_TMP_DIR/registry"
+    REGISTRY_HTTP_ADDR="$EARTHLY_EMBEDDED_REGISTRY_ADDR" \
+        REGISTRY_STORAGE_FILESYSTEM_ROOTDIRECTORY="$EARTHLY_TMP_DIR/registry" \
+        REGISTRY_STORAGE_DELETE_ENABLED=true \
+        REGISTRY_LOG_LEVEL=warn \
+        registry serve /etc/docker/registry/config.yml &
+    registrypid=$!
+fi
+
+if [ "$EARTHLY_ROOTLESS" = "true" ]; then
+    if [ "$(id -u)" = "0" ]; then
+        echo "Error: rootless buildkitd needs to run as an unprivileged user"
+        exit 1
+    fi
+    # Run within a user namespace, mapped to the subordinate ids of the user (see
+    # /etc/subuid and /etc/subgid). The build commands run in namespaces of their own,
+    # including a PID namespace, which requires /proc not to be masked.
+    echo "running buildkitd rootless"
+    rootlesskit "$@" &
+else
+    "$@" &
+fi
 execpid=$!
 
-# quit if either buildkit or shellrepeater die
+# quit if either buildkit, shellrepeater or the registry die
 while true
 do
+    if [ -n "$registrypid" ] && ! kill -0 $registrypid > /dev/null 2>&1; then
+        echo "Error: embedded registry process has exited"
+        exit 1
+    fi
     if ! kill -0 $shellrepeaterpid > /dev/null 2>&1; then
         echo "Error: shellrepeater process has exited"
         exit 1
@@ -0,0 +1,50 @@
+package buildkitd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GCPolicy is a garbage collection policy of the buildkit cache. When the cache grows
+// beyond the size of the policy, the least recently used records matching the policy
+// are removed, starting with the ones unused for longer than its age.
+type GCPolicy struct {
+	// All applies the policy to all the records, including the internal and shared
+	// ones.
+	All bool `json:"all"`
+	// KeepBytes is the size to which the cache is reduced.
+	KeepBytes int64 `json:"keepBytes"`
+	// KeepDuration is the age beyond which unused records are removed first.
+	KeepDuration time.Duration `json:"keepDuration"`
+	// Filters are buildkit filters restricting the records the policy applies to, for
+	// example type==source.local.
+	Filters []string `json:"filters"`
+}
+
+// gcPoliciesTOML returns the policies as gcpolicy sections of the buildkitd.toml
+// config file.
+func gcPoliciesTOML(policies []GCPolicy) string {
+	var sb strings.Builder
+	for _, p := range policies {
+		sb.WriteString("  [[worker.oci.gcpolicy]]\n")
+		if p.All {
+			sb.WriteString("    all = true\n")
+		}
+		if p.KeepBytes > 0 {
+			fmt.Fprintf(&sb, "    keepBytes = %d\n", p.KeepBytes)
+		}
+		if p.KeepDuration > 0 {
+			fmt.Fprintf(&sb, "    keepDuration = %d\n", int64(p.KeepDuration.Seconds()))
+		}
+		if len(p.Filters) > 0 {
+			quoted := make([]string, 0, len(p.Filters))
+			for _, f := range p.Filters {
+				quoted = append(quoted, strconv.Quote(f))
+			}
+			fmt.Fprintf(&sb, "    filters = [ %s ]\n", strings.Join(quoted, ", "))
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,201 @@
+package buildkitd
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/earthly/earthly/cleanup"
+	"github.com/earthly/earthly/conslogging"
+	"github.com/moby/buildkit/client"
+	_ "github.com/moby/buildkit/client/connhelper/kubepod" // Load "kube-pod://" helper.
+	"github.com/pkg/errors"
+)
+
+// KubernetesOpt holds the options for running buildkitd on a Kubernetes cluster.
+type KubernetesOpt struct {
+	// Context is the kubectl context to use. The current context is used if empty.
+	Context string
+	// Namespace is the namespace of the pod. The default namespace of the context is
+	// used if empty.
+	Namespace string
+}
+
+// kubectlArgs returns the kubectl args selecting the context and the namespace.
+func (ko KubernetesOpt) kubectlArgs(args ...string) []string {
+	var ret []string
+	if ko.Context != "" {
+		ret = append(ret, "--context", ko.Context)
+	}
+	if ko.Namespace != "" {
+		ret = append(ret, "--namespace", ko.Namespace)
+	}
+	return append(ret, args...)
+}
+
+// NewKubernetesClient starts a buildkitd pod on a Kubernetes cluster, via kubectl, and
+// returns a client connected to it. The connection goes through the Kubernetes API
+// (kubectl exec), which carries the build contexts, the secrets and the outputs of the
+// build. The pod is deleted via cleanCollection. Its cache is lost, unless a remote
+// cache is used.
+func NewKubernetesClient(ctx context.Context, console conslogging.ConsoleLogger, image string, settings Settings, ko KubernetesOpt, opTimeout time.Duration, cleanCollection *cleanup.Collection, opts ...client.ClientOpt) (*client.Client, error) {
+	podName, err := kubernetesPodName()
+	if err != nil {
+		return nil, err
+	}
+	console.
+		WithPrefix("buildkitd").
+		Printf("Starting buildkit daemon as a Kubernetes pod (%s)...\n", podName)
+	manifest, err := kubernetesPodManifest(podName, image, settings)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, "kubectl", ko.kubectlArgs("create", "-f", "-")...)
+	cmd.Stdin = bytes.NewReader(manifest)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, errors.Wrapf(err, "kubectl create pod %s: %s", podName, string(output))
+	}
+	cleanCollection.Add(func() error {
+		// Not bound to ctx, which may be canceled already.
+		cmd := exec.Command("kubectl", ko.kubectlArgs("delete", "pod", podName, "--wait=false")...)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return errors.Wrapf(err, "kubectl delete pod %s: %s", podName, string(output))
+		}
+		return nil
+	})
+	cmd = exec.CommandContext(ctx, "kubectl", ko.kubectlArgs(
+		"wait", "--for=condition=Ready", fmt.Sprintf("pod/%s", podName),
+		fmt.Sprintf("--timeout=%s", opTimeout))...)
+	output, err = cmd.CombinedOutput()
+	if err != nil {
+		return nil, errors.Wrapf(err, "kubectl wait for pod %s: %s", podName, string(output))
+	}
+	address := kubernetesAddress(podName, ko)
+	err = WaitUntilStarted(ctx, address, opTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "wait until started")
+	}
+	console.
+		WithPrefix("buildkitd").
+		Printf("...Done\n")
+	bkClient, err := client.New(ctx, address, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "new buildkit client")
+	}
+	return bkClient, nil
+}
+
+// kubernetesAddress returns the URL at which the buildkitd of the pod is available.
+func kubernetesAddress(podName string, ko KubernetesOpt) string {
+	q := url.Values{}
+	if ko.Context != "" {
+		q.Set("context", ko.Context)
+	}
+	if ko.Namespace != "" {
+		q.Set("namespace", ko.Namespace)
+	}
+	u := url.URL{Scheme: "kube-pod", Host: podName, RawQuery: q.Encode()}
+	return u.String()
+}
+
+func kubernetesPodName() (string, error) {
+	suffix := make([]byte, 4)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return "", errors.Wrap(err, "rand read")
+	}
+	return fmt.Sprintf("%s-%s", ContainerName, hex.EncodeToString(suffix)), nil
+}
+
+// kubernetesPodManifest returns the JSON manifest of the buildkitd pod. As with the
+// docker container, buildkitd runs privileged, unless rootless. Git credentials are
+// not passed on, as they would be visible in the pod spec.
+func kubernetesPodManifest(podName string, image string, settings Settings) ([]byte, error) {
+	type envVar struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	env := []envVar{
+		// Loop devices are not available within pods.
+		{Name: "ENABLE_LOOP_DEVICE", Value: "false"},
+		{Name: "FORCE_LOOP_DEVICE", Value: "false"},
+		{Name: "BUILDKIT_DEBUG", Value: strconv.FormatBool(settings.Debug)},
+		{Name: "GIT_URL_INSTEAD_OF", Value: settings.GitURLInsteadOf},
+		{Name: "EARTHLY_GIT_CONFIG", Value: base64.StdEncoding.EncodeToString([]byte(settings.GitConfig))},
+	}
+	if settings.CacheSizeMb > 0 {
+		env = append(env, envVar{Name: "CACHE_SIZE_MB", Value: strconv.Itoa(settings.CacheSizeMb)})
+	}
+	if len(settings.GCPolicies) > 0 {
+		env = append(env, envVar{
+			Name:  "EARTHLY_GC_POLICIES",
+			Value: base64.StdEncoding.EncodeToString([]byte(gcPoliciesTOML(settings.GCPolicies))),
+		})
+	}
+	annotations := map[string]string{}
+	securityContext := map[string]interface{}{
+		"privileged": true,
+	}
+	if settings.Rootless {
+		for _, e := range rootlessEnv {
+			kv := strings.SplitN(e, "=", 2)
+			env = append(env, envVar{Name: kv[0], Value: kv[1]})
+		}
+		annotations["container.apparmor.security.beta.kubernetes.io/buildkitd"] = "unconfined"
+		annotations["container.seccomp.security.alpha.kubernetes.io/buildkitd"] = "unconfined"
+		// As for the docker container (see Start). Unmasked requires the ProcMountType
+		// feature gate of the cluster.
+		securityContext = map[string]interface{}{
+			"runAsUser":  1000,
+			"runAsGroup": 1000,
+			"procMount":  "Unmasked",
+		}
+	}
+	pod := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata": map[string]interface{}{
+			"name":        podName,
+			"annotations": annotations,
+			"labels": map[string]string{
+				"app.kubernetes.io/name":       ContainerName,
+				"app.kubernetes.io/managed-by": "earth",
+			},
+		},
+		"spec": map[string]interface{}{
+			"restartPolicy": "Never",
+			"containers": []map[string]interface{}{
+				{
+					"name":            "buildkitd",
+					"image":           image,
+					"env":             env,
+					"securityContext": securityContext,
+					"volumeMounts": []map[string]string{
+						{"name": "cache", "mountPath": "/tmp/earthly"},
+						{"name": "run", "mountPath": "/run/earthly"},
+					},
+				},
+			},
+			"volumes": []map[string]interface{}{
+				{"name": "cache", "emptyDir": map[string]interface{}{}},
+				{"name": "run", "emptyDir": map[string]interface{}{}},
+			},
+		},
+	}
+	dt, err := json.Marshal(pod)
+	if err != nil {
+		return nil, errors.Wrap(err, "json marshal pod manifest")
+	}
+	return dt, nil
+}
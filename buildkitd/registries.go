@@ -0,0 +1,28 @@
+package buildkitd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// registriesTOML returns the registry sections of the buildkitd.toml config file, which
+// allow plain HTTP and untrusted TLS connections to the given insecure registries.
+func registriesTOML(insecureRegistries []string) string {
+	var sb strings.Builder
+	for _, registry := range insecureRegistries {
+		fmt.Fprintf(&sb, "[registry.%q]\n", registry)
+		sb.WriteString("  http = true\n")
+		sb.WriteString("  insecure = true\n")
+	}
+	return sb.String()
+}
+
+// parseInsecureRegistries parses the value of the insecure registries label of the
+// buildkitd container. Containers started by older versions of earth have no such label.
+func parseInsecureRegistries(label string) []string {
+	label = strings.TrimSpace(label)
+	if label == "" || label == "<no value>" {
+		return nil
+	}
+	return strings.Split(label, ",")
+}
@@ -0,0 +1,34 @@
+package buildkitd
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRegistriesTOML(t *testing.T) {
+	got := registriesTOML([]string{"localhost:5000", "registry.internal"})
+	expected := "[registry.\"localhost:5000\"]\n  http = true\n  insecure = true\n" +
+		"[registry.\"registry.internal\"]\n  http = true\n  insecure = true\n"
+	if got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestParseInsecureRegistries(t *testing.T) {
+	tests := []struct {
+		label    string
+		expected string
+	}{
+		{"", "[]"},
+		{"\n", "[]"},
+		{"<no value>\n", "[]"},
+		{"localhost:5000\n", "[localhost:5000]"},
+		{"localhost:5000,registry.internal", "[localhost:5000 registry.internal]"},
+	}
+	for _, test := range tests {
+		got := fmt.Sprint(parseInsecureRegistries(test.label))
+		if got != test.expected {
+			t.Errorf("parseInsecureRegistries(%q): expected %s, got %s", test.label, test.expected, got)
+		}
+	}
+}
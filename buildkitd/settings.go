@@ -20,6 +20,15 @@ type Settings struct {
 	RunDir            string   `json:"runDir"`
 	Debug             bool     `json:"debug"`
 	DebuggerPort      int      `json:"debuggerPort"`
+	EmbeddedRegistry  bool     `json:"embeddedRegistry"`
+	// Rootless runs buildkitd without privileges. Commands requiring privileges
+	// (RUN --privileged, WITH DOCKER) are not available.
+	Rootless bool `json:"rootless"`
+	// GCPolicies replace the default garbage collection policies of the cache, if any.
+	GCPolicies []GCPolicy `json:"gcPolicies"`
+	// InsecureRegistries are the registries images may be pulled from over plain HTTP, or
+	// with an untrusted TLS certificate (FROM --insecure).
+	InsecureRegistries []string `json:"insecureRegistries"`
 }
 
 // Hash returns a secure hash of the settings.
@@ -0,0 +1,278 @@
+package cigen
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/pkg/errors"
+)
+
+// Providers of CI pipelines.
+const (
+	GitHub = "github"
+	GitLab = "gitlab"
+)
+
+// Opt are the settings of a generated CI pipeline.
+type Opt struct {
+	// Provider is the CI system to generate the pipeline for: GitHub or GitLab.
+	Provider string
+	// Dir is the dir of the Earthfile, relative to the root of the repository.
+	Dir string
+	// Targets are the targets to build, in order. If empty, the entry targets of the
+	// Earthfile are built, as per EntryTargets.
+	Targets []string
+	// Branch is the branch whose builds push the images (earth --push). Builds of
+	// other branches and of pull requests do not push.
+	Branch string
+	// RemoteCache is the image repository used as a build cache, shared by the builds
+	// of the pipeline. Builds do not share a cache if empty.
+	RemoteCache string
+	// Registry is the registry to log in to before building, when images are pushed
+	// or a remote cache is used. Docker Hub if empty.
+	Registry string
+	// EarthVersion is the version of earth to install (eg v0.3.6). The latest version
+	// if empty.
+	EarthVersion string
+}
+
+// registryUserVar and registryPasswordVar are the names of the CI secrets holding the
+// credentials of the registry.
+const (
+	registryUserVar     = "REGISTRY_USERNAME"
+	registryPasswordVar = "REGISTRY_PASSWORD"
+)
+
+var jobIDRe = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// EntryTargets returns the targets of the Earthfile which no other target of the
+// Earthfile depends on, in the order of their declaration. Building them builds all
+// the targets of the Earthfile.
+func EntryTargets(infos []earthfile2llb.TargetInfo) []string {
+	referenced := make(map[string]bool)
+	for _, info := range infos {
+		for _, dep := range info.Deps {
+			if strings.HasPrefix(dep, "+") {
+				referenced[strings.TrimPrefix(dep, "+")] = true
+			}
+		}
+	}
+	var ret []string
+	for _, info := range infos {
+		if info.Name == "base" || referenced[info.Name] {
+			continue
+		}
+		ret = append(ret, info.Name)
+	}
+	return ret
+}
+
+// ciJob is a job of the pipeline, which builds a target.
+type ciJob struct {
+	id        string
+	targetRef string
+	push      bool
+}
+
+// Generate returns the CI pipeline building the targets of the Earthfile described by
+// infos, as per opt: a GitHub Actions workflow or a GitLab CI config. Each target is
+// built by a job of its own, and the jobs run in parallel.
+func Generate(infos []earthfile2llb.TargetInfo, opt Opt) ([]byte, error) {
+	if opt.Branch == "" {
+		return nil, errors.New("the branch which pushes is not set")
+	}
+	targets := opt.Targets
+	if len(targets) == 0 {
+		targets = EntryTargets(infos)
+	}
+	if len(targets) == 0 {
+		return nil, errors.New("the Earthfile declares no targets")
+	}
+	byName := make(map[string]earthfile2llb.TargetInfo)
+	for _, info := range infos {
+		byName[info.Name] = info
+	}
+	var jobs []ciJob
+	usedIDs := make(map[string]bool)
+	for _, target := range targets {
+		target = strings.TrimPrefix(target, "+")
+		info, found := byName[target]
+		if !found {
+			return nil, errors.Errorf("the Earthfile does not declare the target %s", target)
+		}
+		job := ciJob{
+			id:        jobIDRe.ReplaceAllString(target, "-"),
+			targetRef: "+" + target,
+			push:      pushes(info, byName),
+		}
+		if opt.Dir != "" && path.Clean(opt.Dir) != "." {
+			job.targetRef = "./" + strings.TrimPrefix(path.Clean(opt.Dir), "./") + job.targetRef
+		}
+		for usedIDs[job.id] {
+			job.id += "_"
+		}
+		usedIDs[job.id] = true
+		jobs = append(jobs, job)
+	}
+	switch opt.Provider {
+	case GitHub:
+		return generateGitHub(jobs, opt), nil
+	case GitLab:
+		return generateGitLab(jobs, opt), nil
+	default:
+		return nil, errors.Errorf("unknown CI provider %s, expected %s or %s", opt.Provider, GitHub, GitLab)
+	}
+}
+
+// pushes returns whether building the target with --push pushes images, as the target
+// or one of the targets of the Earthfile it depends on declares SAVE IMAGE --push.
+func pushes(info earthfile2llb.TargetInfo, byName map[string]earthfile2llb.TargetInfo) bool {
+	visited := make(map[string]bool)
+	var visit func(info earthfile2llb.TargetInfo) bool
+	visit = func(info earthfile2llb.TargetInfo) bool {
+		if visited[info.Name] {
+			return false
+		}
+		visited[info.Name] = true
+		for _, img := range info.Images {
+			if img.Push {
+				return true
+			}
+		}
+		for _, dep := range info.Deps {
+			depInfo, found := byName[strings.TrimPrefix(dep, "+")]
+			if strings.HasPrefix(dep, "+") && found && visit(depInfo) {
+				return true
+			}
+		}
+		return false
+	}
+	return visit(info)
+}
+
+func earthURL(version string) string {
+	if version == "" {
+		return "https://github.com/earthly/earthly/releases/latest/download/earth-linux-amd64"
+	}
+	return fmt.Sprintf("https://github.com/earthly/earthly/releases/download/%s/earth-linux-amd64", version)
+}
+
+func header(opt Opt) string {
+	dir := opt.Dir
+	if dir == "" {
+		dir = "."
+	}
+	return fmt.Sprintf(
+		"# Generated by earth ci-gen from %s/Earthfile. Generate it again when the\n"+
+			"# targets change, rather than editing it.\n", strings.TrimSuffix(dir, "/"))
+}
+
+// needsLogin returns whether the job logs in to the registry: if it pushes images or
+// uses the remote cache.
+func needsLogin(job ciJob, opt Opt) bool {
+	return job.push || opt.RemoteCache != ""
+}
+
+func generateGitHub(jobs []ciJob, opt Opt) []byte {
+	var b strings.Builder
+	b.WriteString(header(opt))
+	fmt.Fprintf(&b, "\nname: Earthly\n\non:\n")
+	fmt.Fprintf(&b, "  push:\n    branches: [ %s ]\n", opt.Branch)
+	fmt.Fprintf(&b, "  pull_request:\n    branches: [ %s ]\n", opt.Branch)
+	fmt.Fprintf(&b, "\njobs:\n")
+	for i, job := range jobs {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "  %s:\n", job.id)
+		fmt.Fprintf(&b, "    runs-on: ubuntu-latest\n")
+		fmt.Fprintf(&b, "    env:\n")
+		fmt.Fprintf(&b, "      FORCE_COLOR: 1\n")
+		if opt.RemoteCache != "" {
+			fmt.Fprintf(&b, "      EARTHLY_REMOTE_CACHE: %q\n", opt.RemoteCache)
+		}
+		login := needsLogin(job, opt)
+		if login {
+			fmt.Fprintf(&b, "      %s: ${{ secrets.%s }}\n", registryUserVar, registryUserVar)
+			fmt.Fprintf(&b, "      %s: ${{ secrets.%s }}\n", registryPasswordVar, registryPasswordVar)
+		}
+		fmt.Fprintf(&b, "    steps:\n")
+		fmt.Fprintf(&b, "    - uses: actions/checkout@v2\n")
+		if login {
+			fmt.Fprintf(&b, "    - name: Docker login\n")
+			if opt.RemoteCache == "" {
+				// Only needed for pushing.
+				fmt.Fprintf(&b, "      if: github.event_name == 'push'\n")
+			}
+			fmt.Fprintf(&b, "      run: %s\n", loginCommand(opt))
+		}
+		fmt.Fprintf(&b, "    - name: Download earth\n")
+		fmt.Fprintf(&b, "      run: \"sudo /bin/sh -c 'wget %s -O /usr/local/bin/earth && chmod +x /usr/local/bin/earth'\"\n", earthURL(opt.EarthVersion))
+		fmt.Fprintf(&b, "    - name: Build %s\n", job.targetRef)
+		if job.push {
+			fmt.Fprintf(&b, "      run: earth ${{ github.event_name == 'push' && '--push' || '' }} %s\n", job.targetRef)
+		} else {
+			fmt.Fprintf(&b, "      run: earth %s\n", job.targetRef)
+		}
+	}
+	return []byte(b.String())
+}
+
+// gitLabKeywords are the top level keys of a GitLab CI config which are not jobs.
+var gitLabKeywords = map[string]bool{
+	"image": true, "services": true, "stages": true, "types": true, "before_script": true,
+	"after_script": true, "variables": true, "cache": true, "include": true, "workflow": true,
+	"default": true,
+}
+
+func generateGitLab(jobs []ciJob, opt Opt) []byte {
+	var b strings.Builder
+	b.WriteString(header(opt))
+	b.WriteString("\n")
+	b.WriteString(".earthly:\n")
+	b.WriteString("  image: docker:19.03\n")
+	b.WriteString("  services:\n    - docker:19.03-dind\n")
+	b.WriteString("  variables:\n")
+	b.WriteString("    DOCKER_HOST: tcp://docker:2375\n")
+	b.WriteString("    DOCKER_TLS_CERTDIR: \"\"\n")
+	b.WriteString("    FORCE_COLOR: 1\n")
+	if opt.RemoteCache != "" {
+		fmt.Fprintf(&b, "    EARTHLY_REMOTE_CACHE: %q\n", opt.RemoteCache)
+	}
+	b.WriteString("  before_script:\n")
+	fmt.Fprintf(&b, "    - wget %s -O /usr/local/bin/earth && chmod +x /usr/local/bin/earth\n", earthURL(opt.EarthVersion))
+	b.WriteString("  rules:\n")
+	b.WriteString("    - if: $CI_PIPELINE_SOURCE == \"merge_request_event\"\n")
+	fmt.Fprintf(&b, "    - if: $CI_COMMIT_BRANCH == %q\n", opt.Branch)
+	for _, job := range jobs {
+		id := job.id
+		if gitLabKeywords[id] {
+			id += "-target"
+		}
+		fmt.Fprintf(&b, "\n%s:\n", id)
+		b.WriteString("  extends: .earthly\n")
+		b.WriteString("  script:\n")
+		if needsLogin(job, opt) {
+			fmt.Fprintf(&b, "    - %s\n", loginCommand(opt))
+		}
+		if job.push {
+			fmt.Fprintf(&b, "    - if [ \"$CI_COMMIT_BRANCH\" = %q ]; then PUSH_FLAG=--push; fi\n", opt.Branch)
+			fmt.Fprintf(&b, "    - earth $PUSH_FLAG %s\n", job.targetRef)
+		} else {
+			fmt.Fprintf(&b, "    - earth %s\n", job.targetRef)
+		}
+	}
+	return []byte(b.String())
+}
+
+func loginCommand(opt Opt) string {
+	cmd := fmt.Sprintf(
+		"echo \"$%s\" | docker login --username \"$%s\" --password-stdin", registryPasswordVar, registryUserVar)
+	if opt.Registry != "" {
+		cmd += " " + opt.Registry
+	}
+	return cmd
+}
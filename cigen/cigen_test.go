@@ -0,0 +1,70 @@
+package cigen
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/earthly/earthly/earthfile2llb"
+	"gopkg.in/yaml.v2"
+)
+
+var testInfos = []earthfile2llb.TargetInfo{
+	{Name: "base"},
+	{Name: "deps", Deps: []string{}},
+	{Name: "build", Deps: []string{"+deps"}},
+	{Name: "test", Deps: []string{"+build", "./lib+test"}},
+	{Name: "docker", Deps: []string{"+build"}, Images: []earthfile2llb.ImageInfo{{Names: []string{"org/app"}, Push: true}}},
+	{Name: "release", Deps: []string{"+docker"}},
+}
+
+func TestEntryTargets(t *testing.T) {
+	entries := EntryTargets(testInfos)
+	expected := []string{"test", "release"}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("got %v, expected %v", entries, expected)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	for _, provider := range []string{GitHub, GitLab} {
+		dt, err := Generate(testInfos, Opt{Provider: provider, Dir: "./services/app", Branch: "main"})
+		if err != nil {
+			t.Fatalf("%s: %v", provider, err)
+		}
+		var pipeline map[string]interface{}
+		err = yaml.Unmarshal(dt, &pipeline)
+		if err != nil {
+			t.Fatalf("%s: invalid YAML: %v\n%s", provider, err, dt)
+		}
+		jobs := pipeline
+		if provider == GitHub {
+			jobs = make(map[string]interface{})
+			for k, v := range pipeline["jobs"].(map[interface{}]interface{}) {
+				jobs[k.(string)] = v
+			}
+		}
+		for _, id := range []string{"test", "release"} {
+			if _, found := jobs[id]; !found {
+				t.Errorf("%s: missing job %s:\n%s", provider, id, dt)
+			}
+		}
+		out := string(dt)
+		if !strings.Contains(out, "./services/app+release") {
+			t.Errorf("%s: expected the target refs to be relative to the root:\n%s", provider, out)
+		}
+		// Only +release pushes, as it depends on +docker.
+		if strings.Count(out, "--push") != 1 || strings.Count(out, "docker login") != 1 {
+			t.Errorf("%s: expected a single job to push:\n%s", provider, out)
+		}
+	}
+
+	_, err := Generate(testInfos, Opt{Provider: GitHub, Branch: "main", Targets: []string{"+missing"}})
+	if err == nil {
+		t.Errorf("expected an error for an undeclared target")
+	}
+	_, err = Generate(testInfos, Opt{Provider: "jenkins", Branch: "main"})
+	if err == nil {
+		t.Errorf("expected an error for an unknown provider")
+	}
+}
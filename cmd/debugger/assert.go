@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/earthly/earthly/conslogging"
+	"github.com/earthly/earthly/debugger/common"
+)
+
+// maxDiffLines is the number of lines beyond which files are not diffed line by line.
+const maxDiffLines = 2000
+
+// assertMode checks the assertion of an ASSERT command, given as its kind followed by
+// its arguments. If it does not hold, a description of the difference is printed. It
+// returns the exit code of the debugger.
+func assertMode(conslogger conslogging.ConsoleLogger, args []string) int {
+	if len(args) == 0 {
+		conslogger.Warnf("ASSERT: missing assertion\n")
+		return 1
+	}
+	msg, err := checkAssertion(args[0], args[1:])
+	if err != nil {
+		conslogger.Warnf("ASSERT %s: %v\n", args[0], err)
+		return 1
+	}
+	if msg != "" {
+		conslogger.Warnf("ASSERT %s failed: %s\n", args[0], msg)
+		return 1
+	}
+	return 0
+}
+
+// checkAssertion returns a description of why the assertion does not hold, or an
+// empty string if it holds.
+func checkAssertion(kind string, args []string) (string, error) {
+	switch kind {
+	case common.AssertExists, common.AssertNotExists:
+		if len(args) != 1 {
+			return "", fmt.Errorf("expected a path, got %v", args)
+		}
+		_, err := os.Lstat(args[0])
+		exists := err == nil
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		if kind == common.AssertExists && !exists {
+			return fmt.Sprintf("%s does not exist", args[0]), nil
+		}
+		if kind == common.AssertNotExists && exists {
+			return fmt.Sprintf("%s exists", args[0]), nil
+		}
+		return "", nil
+	case common.AssertContent, common.AssertContains:
+		if len(args) != 2 {
+			return "", fmt.Errorf("expected a path and a text, got %v", args)
+		}
+		dt, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			return "", err
+		}
+		actual := string(dt)
+		if kind == common.AssertContains {
+			if !strings.Contains(actual, args[1]) {
+				return fmt.Sprintf("%s does not contain %q", args[0], args[1]), nil
+			}
+			return "", nil
+		}
+		// A single trailing newline is not significant.
+		expected := strings.TrimSuffix(args[1], "\n")
+		actual = strings.TrimSuffix(actual, "\n")
+		if actual == expected {
+			return "", nil
+		}
+		return fmt.Sprintf(
+			"unexpected content of %s (- expected, + actual):\n%s",
+			args[0], strings.Join(lineDiff(strings.Split(expected, "\n"), strings.Split(actual, "\n")), "\n")), nil
+	case common.AssertExitCode:
+		if len(args) != 2 {
+			return "", fmt.Errorf("expected an exit code and a command, got %v", args)
+		}
+		expected, err := strconv.Atoi(args[0])
+		if err != nil {
+			return "", fmt.Errorf("invalid exit code %s", args[0])
+		}
+		cmd := exec.Command("/bin/sh", "-c", args[1])
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+		actual := 0
+		if err != nil {
+			exitErr, ok := err.(*exec.ExitError)
+			if !ok {
+				return "", err
+			}
+			actual = exitErr.ExitCode()
+		}
+		if actual != expected {
+			return fmt.Sprintf("command %s exited with code %d, expected %d", args[1], actual, expected), nil
+		}
+		return "", nil
+	default:
+		return "", fmt.Errorf("unknown assertion")
+	}
+}
+
+// lineDiff returns the difference between the expected and the actual lines, as the
+// lines of both, prefixed with "- " if only expected, "+ " if only actual and "  " if
+// common to both.
+func lineDiff(expected []string, actual []string) []string {
+	if len(expected) > maxDiffLines || len(actual) > maxDiffLines {
+		return []string{fmt.Sprintf("  (%d lines expected, %d lines actual, too long to diff)", len(expected), len(actual))}
+	}
+	// lcs[i][j] is the length of the longest common subsequence of expected[i:] and
+	// actual[j:].
+	lcs := make([][]int, len(expected)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(actual)+1)
+	}
+	for i := len(expected) - 1; i >= 0; i-- {
+		for j := len(actual) - 1; j >= 0; j-- {
+			if expected[i] == actual[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var ret []string
+	i, j := 0, 0
+	for i < len(expected) || j < len(actual) {
+		switch {
+		case i < len(expected) && j < len(actual) && expected[i] == actual[j]:
+			ret = append(ret, "  "+expected[i])
+			i++
+			j++
+		case j == len(actual) || (i < len(expected) && lcs[i+1][j] >= lcs[i][j+1]):
+			ret = append(ret, "- "+expected[i])
+			i++
+		default:
+			ret = append(ret, "+ "+actual[j])
+			j++
+		}
+	}
+	return ret
+}
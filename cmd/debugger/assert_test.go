@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/earthly/earthly/debugger/common"
+)
+
+func TestCheckAssertion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "earth-assert-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "out.txt")
+	err = ioutil.WriteFile(file, []byte("one\ntwo\nthree\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing")
+
+	tests := []struct {
+		kind    string
+		args    []string
+		failure string
+	}{
+		{common.AssertExists, []string{file}, ""},
+		{common.AssertExists, []string{missing}, "does not exist"},
+		{common.AssertNotExists, []string{missing}, ""},
+		{common.AssertNotExists, []string{file}, "exists"},
+		{common.AssertContent, []string{file, "one\ntwo\nthree"}, ""},
+		{common.AssertContent, []string{file, "one\n2\nthree"}, "- 2\n+ two"},
+		{common.AssertContains, []string{file, "two"}, ""},
+		{common.AssertContains, []string{file, "four"}, "does not contain"},
+		{common.AssertExitCode, []string{"0", "true"}, ""},
+		{common.AssertExitCode, []string{"3", "exit 3"}, ""},
+		{common.AssertExitCode, []string{"0", "exit 3"}, "exited with code 3, expected 0"},
+	}
+	for _, test := range tests {
+		msg, err := checkAssertion(test.kind, test.args)
+		if err != nil {
+			t.Errorf("%s %v: %v", test.kind, test.args, err)
+			continue
+		}
+		if (test.failure == "") != (msg == "") || !strings.Contains(msg, test.failure) {
+			t.Errorf("%s %v: got %q, expected failure %q", test.kind, test.args, msg, test.failure)
+		}
+	}
+
+	_, err = checkAssertion(common.AssertContent, []string{missing, "x"})
+	if err == nil {
+		t.Errorf("expected an error for the content of a missing file")
+	}
+}
+
+func TestLineDiff(t *testing.T) {
+	diff := lineDiff([]string{"a", "b", "c", "d"}, []string{"a", "c", "x", "d"})
+	expected := []string{"  a", "- b", "  c", "+ x", "  d"}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("got %v, expected %v", diff, expected)
+	}
+}
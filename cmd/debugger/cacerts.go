@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/earthly/earthly/debugger/common"
+
+	"github.com/pkg/errors"
+)
+
+// systemCACertsFiles are the locations of the system CA bundle, in the various distros.
+var systemCACertsFiles = []string{
+	"/etc/ssl/certs/ca-certificates.crt", // Debian, Ubuntu, Alpine
+	"/etc/pki/tls/certs/ca-bundle.crt",   // Fedora, RHEL, CentOS
+	"/etc/ssl/ca-bundle.pem",             // OpenSUSE
+	"/etc/pki/tls/cacert.pem",            // OpenELEC
+	"/etc/ssl/cert.pem",                  // Alpine (LibreSSL)
+}
+
+// caCertsEnvVars are the env vars which point tools at a CA bundle, replacing the
+// system one.
+var caCertsEnvVars = []string{
+	"SSL_CERT_FILE",
+	"CURL_CA_BUNDLE",
+	"REQUESTS_CA_BUNDLE",
+	"PIP_CERT",
+	"GIT_SSL_CAINFO",
+	"AWS_CA_BUNDLE",
+}
+
+const (
+	combinedCACertsFile = "ca-certificates.crt"
+	aptCACertsConfFile  = "apt-ca-certificates.conf"
+)
+
+// installCACerts makes the command trust the additional CA certificates at
+// extraCertsPath. The image is left untouched: the certificates are combined with the
+// system ones in a separate bundle, and the command is pointed at it via env vars. Env
+// vars already set for the command are preserved.
+func installCACerts(extraCertsPath string) error {
+	extraCerts, err := ioutil.ReadFile(extraCertsPath)
+	if err != nil {
+		return errors.Wrapf(err, "read %s", extraCertsPath)
+	}
+	dir := filepath.Dir(extraCertsPath)
+	combinedPath := filepath.Join(dir, combinedCACertsFile)
+	err = ioutil.WriteFile(combinedPath, combineCACerts(systemCACerts(), extraCerts), 0644)
+	if err != nil {
+		return errors.Wrapf(err, "write %s", combinedPath)
+	}
+	env := map[string]string{
+		// Node adds these to its built-in certificates.
+		"NODE_EXTRA_CA_CERTS": extraCertsPath,
+	}
+	for _, envVar := range caCertsEnvVars {
+		env[envVar] = combinedPath
+	}
+	// apt does not look at any of the above.
+	aptConfPath := filepath.Join(dir, aptCACertsConfFile)
+	aptConf := fmt.Sprintf("Acquire::https::CaInfo \"%s\";\n", combinedPath)
+	err = ioutil.WriteFile(aptConfPath, []byte(aptConf), 0644)
+	if err != nil {
+		return errors.Wrapf(err, "write %s", aptConfPath)
+	}
+	env["APT_CONFIG"] = aptConfPath
+	for k, v := range env {
+		_, found := os.LookupEnv(k)
+		if found {
+			continue
+		}
+		err = os.Setenv(k, v)
+		if err != nil {
+			return errors.Wrapf(err, "set %s", k)
+		}
+	}
+	return nil
+}
+
+// systemCACerts returns the system CA bundle of the image, if any.
+func systemCACerts() []byte {
+	for _, f := range systemCACertsFiles {
+		dt, err := ioutil.ReadFile(f)
+		if err == nil {
+			return dt
+		}
+	}
+	return nil
+}
+
+// combineCACerts concatenates two PEM bundles.
+func combineCACerts(system []byte, extra []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(system)
+	if len(system) > 0 && !bytes.HasSuffix(system, []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	buf.Write(extra)
+	return buf.Bytes()
+}
+
+// caCertsFromEnv returns the path of the additional CA certificates, if any, and
+// removes it from the env such that the command does not see it.
+func caCertsFromEnv() (string, bool) {
+	extraCertsPath, found := os.LookupEnv(common.CACertsEnvVar)
+	if found {
+		os.Unsetenv(common.CACertsEnvVar)
+	}
+	return extraCertsPath, found
+}
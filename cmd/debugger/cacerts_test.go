@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestCombineCACerts(t *testing.T) {
+	tests := []struct {
+		system   string
+		extra    string
+		expected string
+	}{
+		{"", "B\n", "B\n"},
+		{"A\n", "B\n", "A\nB\n"},
+		{"A", "B\n", "A\nB\n"},
+	}
+	for _, tt := range tests {
+		actual := string(combineCACerts([]byte(tt.system), []byte(tt.extra)))
+		if actual != tt.expected {
+			t.Errorf("combineCACerts(%q, %q): expected %q, got %q", tt.system, tt.extra, tt.expected, actual)
+		}
+	}
+}
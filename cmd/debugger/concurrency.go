@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/earthly/earthly/conslogging"
+	"github.com/earthly/earthly/debugger/common"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// slotPollInterval is how often the slots are checked for a free one, while waiting.
+const slotPollInterval = 200 * time.Millisecond
+
+// acquireConcurrencyLocks waits for the concurrency limits of the settings to allow the
+// command of the target to run, and returns the lock files, which must be kept open for
+// as long as the command runs. Locks are released when the files are closed, including
+// when the process exits.
+func acquireConcurrencyLocks(conslogger conslogging.ConsoleLogger, settings *common.DebuggerSettings, target string) ([]*os.File, error) {
+	var files []*os.File
+	lockName, serialized := common.SerializationLock(settings.SerializedTargets, target)
+	if serialized {
+		f, err := acquireLock(conslogger, lockName)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	if settings.MaxParallelism > 0 {
+		f, err := acquireSlot(conslogger, settings.MaxParallelism)
+		if err != nil {
+			closeAll(files)
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// acquireLock waits for the exclusive lock of the given name.
+func acquireLock(conslogger conslogging.ConsoleLogger, name string) (*os.File, error) {
+	h := sha256.Sum256([]byte(name))
+	f, err := openLockFile(fmt.Sprintf("serialize-%s.lock", hex.EncodeToString(h[:8])))
+	if err != nil {
+		return nil, err
+	}
+	err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if err == unix.EWOULDBLOCK {
+		conslogger.Printf("Waiting for other commands of %s to complete (serialized)\n", name)
+		err = unix.Flock(int(f.Fd()), unix.LOCK_EX)
+	}
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "lock %s", f.Name())
+	}
+	return f, nil
+}
+
+// acquireSlot waits for one of n slots to be free, and takes it.
+func acquireSlot(conslogger conslogging.ConsoleLogger, n int) (*os.File, error) {
+	files := make([]*os.File, n)
+	for i := range files {
+		f, err := openLockFile(fmt.Sprintf("slot-%d.lock", i))
+		if err != nil {
+			closeAll(files[:i])
+			return nil, err
+		}
+		files[i] = f
+	}
+	waiting := false
+	for {
+		// Start from a random slot, to spread the contention.
+		start := rand.Intn(n)
+		for j := 0; j < n; j++ {
+			f := files[(start+j)%n]
+			err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+			if err == nil {
+				for _, other := range files {
+					if other != f {
+						other.Close()
+					}
+				}
+				return f, nil
+			}
+			if err != unix.EWOULDBLOCK {
+				closeAll(files)
+				return nil, errors.Wrapf(err, "lock %s", f.Name())
+			}
+		}
+		if !waiting {
+			conslogger.Printf("Waiting for one of the %d parallel command slots to be free\n", n)
+			waiting = true
+		}
+		time.Sleep(slotPollInterval)
+	}
+}
+
+func openLockFile(name string) (*os.File, error) {
+	err := os.MkdirAll(common.LocksDir, 0755)
+	if err != nil {
+		return nil, errors.Wrapf(err, "create %s", common.LocksDir)
+	}
+	path := filepath.Join(common.LocksDir, name)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %s", path)
+	}
+	return f, nil
+}
+
+func closeAll(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// lockMode acquires the concurrency locks and then execs the command, which inherits
+// the lock files and thus holds the locks until it exits.
+func lockMode(conslogger conslogging.ConsoleLogger, settings *common.DebuggerSettings, args []string) error {
+	files, err := acquireConcurrencyLocks(conslogger, settings, os.Getenv(common.CacheTargetEnvVar))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		// Keep open across exec.
+		_, err = unix.FcntlInt(f.Fd(), unix.F_SETFD, 0)
+		if err != nil {
+			return errors.Wrapf(err, "fcntl %s", f.Name())
+		}
+	}
+	os.Setenv(common.LockedEnvVar, "true")
+	argv0, err := exec.LookPath(args[0])
+	if err != nil {
+		return errors.Wrapf(err, "look path %s", args[0])
+	}
+	return unix.Exec(argv0, args, os.Environ())
+}
@@ -8,6 +8,7 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"time"
 
 	"github.com/earthly/earthly/conslogging"
@@ -67,22 +68,50 @@ func handleWinChangeData(ptmx *os.File, data []byte) error {
 	return nil
 }
 
-func populateShellHistory(cmd string) error {
-	f, err := os.Create("/root/.bash_history")
+// shellHistoryFiles maps shells to the name of their history file, within the home dir.
+var shellHistoryFiles = map[string]string{
+	"bash": ".bash_history",
+	"ksh":  ".sh_history",
+	"zsh":  ".zsh_history",
+	"ash":  ".ash_history",
+	"sh":   ".ash_history",
+}
+
+// populateShellHistory places cmd in the history of the given shell, such that the
+// failed command can be recalled via the up arrow. It returns the path of the history
+// file.
+func populateShellHistory(shellPath string, cmd string) (string, error) {
+	home := os.Getenv("HOME")
+	if home == "" {
+		home = "/root"
+	}
+	historyFile, ok := shellHistoryFiles[filepath.Base(shellPath)]
+	if !ok {
+		historyFile = ".sh_history"
+	}
+	historyPath := filepath.Join(home, historyFile)
+	f, err := os.Create(historyPath)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer f.Close()
-	f.Write([]byte(cmd + "\n"))
-	return nil
+	_, err = f.Write([]byte(cmd + "\n"))
+	if err != nil {
+		return "", err
+	}
+	return historyPath, nil
 }
 
-func interactiveMode(ctx context.Context, remoteConsoleAddr, cmd string) error {
+// interactiveMode starts a shell within the container of the command and connects it
+// to the remote console. The shell inherits the env of the command (including build
+// args and secrets), with extraEnv added, and runs with the same mounts. If history is
+// not empty, it is placed in the shell history. It returns the exit code of the shell.
+func interactiveMode(ctx context.Context, remoteConsoleAddr string, history string, extraEnv []string) (int, error) {
 	log := logging.GetLogger(ctx)
 
 	conn, err := net.Dial("tcp", remoteConsoleAddr)
 	if err != nil {
-		return errors.Wrap(err, "failed to connect to remote debugger")
+		return 0, errors.Wrap(err, "failed to connect to remote debugger")
 	}
 	defer func() {
 		err := conn.Close()
@@ -93,27 +122,42 @@ func interactiveMode(ctx context.Context, remoteConsoleAddr, cmd string) error {
 
 	_, err = conn.Write([]byte{common.ShellID})
 	if err != nil {
-		return err
+		return 0, err
 	}
+	return shellSession(ctx, conn, history, extraEnv)
+}
+
+// shellSession runs a shell session over conn, which is connected to a terminal via
+// the remote console.
+func shellSession(ctx context.Context, conn net.Conn, history string, extraEnv []string) (int, error) {
+	log := logging.GetLogger(ctx)
 
-	err = common.WriteDataPacket(conn, common.StartShellSession, nil)
+	err := common.WriteDataPacket(conn, common.StartShellSession, nil)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	_ = populateShellHistory(cmd) // best effort
-
 	shellPath, ok := getShellPath()
 	if !ok {
-		return ErrNoShellFound
+		return 0, ErrNoShellFound
 	}
 	log.With("shell", shellPath).Debug("found shell")
 	c := exec.Command(shellPath)
+	c.Env = append(os.Environ(), extraEnv...)
+	if history != "" {
+		historyPath, err := populateShellHistory(shellPath, history)
+		if err == nil {
+			c.Env = append(c.Env, fmt.Sprintf("HISTFILE=%s", historyPath))
+		} else {
+			// Best effort.
+			log.With("error", err).Debug("failed to populate shell history")
+		}
+	}
 
 	ptmx, err := pty.Start(c)
 	if err != nil {
 		log.Error(errors.Wrap(err, "failed to start pty"))
-		return err
+		return 0, err
 	}
 	defer func() { _ = ptmx.Close() }() // Best effort.
 
@@ -157,8 +201,14 @@ func interactiveMode(ctx context.Context, remoteConsoleAddr, cmd string) error {
 		cancel()
 	}()
 
+	shellExitCode := 0
+	shellDone := make(chan struct{})
 	go func() {
-		c.Wait()
+		defer close(shellDone)
+		err := c.Wait()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			shellExitCode = exitErr.ExitCode()
+		}
 		cancel()
 	}()
 
@@ -166,7 +216,79 @@ func interactiveMode(ctx context.Context, remoteConsoleAddr, cmd string) error {
 
 	common.WriteDataPacket(conn, common.EndShellSession, nil)
 
-	return nil
+	select {
+	case <-shellDone:
+	case <-time.After(time.Second):
+		// The connection was closed while the shell is still running.
+		_ = c.Process.Kill()
+		return 1, nil
+	}
+	return shellExitCode, nil
+}
+
+// attachableMode allows terminals to attach to the running command via earth attach,
+// until ctx is done.
+func attachableMode(ctx context.Context, remoteConsoleAddr string, buildID string) {
+	log := logging.GetLogger(ctx)
+	for ctx.Err() == nil {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", remoteConsoleAddr)
+		if err != nil {
+			log.With("error", err).Debug("failed to connect to remote debugger")
+			return
+		}
+		go func() {
+			// Unblock the read below once the command finishes.
+			<-ctx.Done()
+			conn.Close()
+		}()
+		_, err = conn.Write([]byte{common.AttachableID})
+		if err != nil {
+			conn.Close()
+			return
+		}
+		err = common.WriteDataPacket(conn, common.BuildIDData, []byte(buildID))
+		if err != nil {
+			conn.Close()
+			return
+		}
+		dataType, _, err := common.ReadDataPacket(conn)
+		if err != nil || dataType != common.StartShellSession {
+			conn.Close()
+			return
+		}
+		_, err = shellSession(ctx, conn, "", []string{"EARTHLY_ATTACHED=true"})
+		if err != nil {
+			log.Error(err)
+		}
+		conn.Close()
+	}
+}
+
+// breakpointMode opens a debugger shell at a BREAKPOINT. The build resumes if the
+// shell exits successfully and is aborted otherwise.
+func breakpointMode(ctx context.Context, conslogger conslogging.ConsoleLogger, debuggerSettings *common.DebuggerSettings) int {
+	if !debuggerSettings.Enabled {
+		conslogger.Printf("Skipping BREAKPOINT, as interactive mode is not enabled. Use earth --interactive to enable it\n")
+		return 0
+	}
+	c := color.New(color.FgYellow)
+	c.Println("Reached BREAKPOINT. Entering interactive debugger (**Warning: only a single debugger per host is supported**)")
+	c.Println("Exit the shell to resume the build, or exit with a non-zero code (eg exit 1) to abort it.")
+	time.Sleep(time.Millisecond * 5)
+	err := os.Setenv("TERM", debuggerSettings.Term)
+	if err != nil {
+		conslogger.Warnf("Failed to set term: %v", err)
+	}
+	exitCode, err := interactiveMode(ctx, remoteConsoleAddr, "", []string{"EARTHLY_BREAKPOINT=true"})
+	if err != nil {
+		logging.GetLogger(ctx).Error(err)
+		return 1
+	}
+	if exitCode != 0 {
+		conslogger.Warnf("Aborting the build at BREAKPOINT (the debugger shell exited with code %d)\n", exitCode)
+	}
+	return exitCode
 }
 
 func getSettings(path string) (*common.DebuggerSettings, error) {
@@ -193,6 +315,11 @@ func main() {
 	conslogger := conslogging.Current(conslogging.ForceColor)
 	color.NoColor = false
 
+	if args[0] == common.ReadSocketArg {
+		// Run without the debugger settings, as stdout is the data read.
+		os.Exit(readSocketMode(conslogger, args[1:]))
+	}
+
 	debuggerSettings, err := getSettings(fmt.Sprintf("/run/secrets/%s", common.DebuggerSettingsSecretsKey))
 	if err != nil {
 		conslogger.Warnf("failed to read settings: %v\n", debuggerSettings)
@@ -207,12 +334,55 @@ func main() {
 
 	log := logging.GetLogger(ctx)
 
+	if args[0] == common.BreakpointArg {
+		os.Exit(breakpointMode(ctx, conslogger, debuggerSettings))
+	}
+
+	if args[0] == common.AssertArg {
+		os.Exit(assertMode(conslogger, args[1:]))
+	}
+
+	if args[0] == common.LockArg {
+		err = lockMode(conslogger, debuggerSettings, args[1:])
+		conslogger.Warnf("failed to run %s with concurrency locks: %v\n", shellescape.QuoteCommand(args[1:]), err)
+		os.Exit(1)
+	}
+
+	extraCertsPath, found := caCertsFromEnv()
+	if found {
+		err = installCACerts(extraCertsPath)
+		if err != nil {
+			conslogger.Warnf("failed to install CA certs: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	opts, err := runOptsFromEnv()
+	if err != nil {
+		conslogger.Warnf("failed to read run options: %v\n", err)
+		os.Exit(1)
+	}
+
+	if os.Getenv(common.LockedEnvVar) == "" {
+		lockFiles, err := acquireConcurrencyLocks(conslogger, debuggerSettings, os.Getenv(common.CacheTargetEnvVar))
+		if err != nil {
+			conslogger.Warnf("failed to acquire concurrency locks: %v\n", err)
+			os.Exit(1)
+		}
+		defer closeAll(lockFiles)
+	}
+	os.Unsetenv(common.LockedEnvVar)
+
 	log.With("command", args).With("version", Version).Debug("running command")
 
-	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err = cmd.Run()
+	if debuggerSettings.BuildID != "" {
+		attachCtx, cancelAttach := context.WithCancel(ctx)
+		go attachableMode(attachCtx, remoteConsoleAddr, debuggerSettings.BuildID)
+		err = runCommand(args, opts)
+		cancelAttach()
+	} else {
+		err = runCommand(args, opts)
+	}
 	if err != nil {
 
 		quotedCmd := shellescape.QuoteCommand(args)
@@ -221,13 +391,22 @@ func main() {
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			exitCode = exitErr.ExitCode()
 			conslogger.Warnf("Command %s failed with exit code %d\n", quotedCmd, exitCode)
+		} else if _, ok := err.(*timeoutError); ok {
+			exitCode = common.TimeoutExitCode
+			conslogger.Warnf("Command %s %v\n", quotedCmd, err)
 		} else {
 			conslogger.Warnf("Command %s failed with unexpected execution error %v\n", quotedCmd, err)
 		}
 
+		if opts.ignoreFailure {
+			conslogger.Warnf("Ignoring the failure, for saving the SAVE ARTIFACT --on-failure artifacts\n")
+			os.Exit(0)
+		}
+
 		if debuggerSettings.Enabled {
 			c := color.New(color.FgYellow)
 			c.Println("Entering interactive debugger (**Warning: only a single debugger per host is supported**)")
+			c.Println("Exit the shell to continue. The failed command is in the shell history and the build will fail once the shell exits.")
 
 			// Sometimes the interactive shell doesn't correctly get a newline
 			// Take a brief pause and issue a new line as a work around.
@@ -238,7 +417,10 @@ func main() {
 				conslogger.Warnf("Failed to set term: %v", err)
 			}
 
-			err = interactiveMode(ctx, remoteConsoleAddr, quotedCmd)
+			_, err = interactiveMode(ctx, remoteConsoleAddr, quotedCmd, []string{
+				fmt.Sprintf("EARTHLY_FAILED_COMMAND=%s", quotedCmd),
+				fmt.Sprintf("EARTHLY_FAILED_EXIT_CODE=%d", exitCode),
+			})
 			if err != nil {
 				log.Error(err)
 			}
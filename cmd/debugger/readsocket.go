@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+
+	"github.com/earthly/earthly/conslogging"
+	"github.com/pkg/errors"
+)
+
+// readSocketMode copies what is read from the unix socket given as argument to
+// stdout, until the other end closes the connection. It returns the exit code of the
+// debugger.
+func readSocketMode(conslogger conslogging.ConsoleLogger, args []string) int {
+	if len(args) != 1 {
+		conslogger.Warnf("expected the path of a socket, got %v\n", args)
+		return 1
+	}
+	err := readSocket(args[0], os.Stdout)
+	if err != nil {
+		conslogger.Warnf("%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func readSocket(socketPath string, w io.Writer) error {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return errors.Wrapf(err, "dial %s", socketPath)
+	}
+	defer conn.Close()
+	bufW := bufio.NewWriterSize(w, 1024*1024)
+	_, err = io.Copy(bufW, conn)
+	if err != nil {
+		return errors.Wrapf(err, "read %s", socketPath)
+	}
+	return bufW.Flush()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "earth-read-socket-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "load.sock")
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	data := bytes.Repeat([]byte("0123456789"), 500000)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(data)
+	}()
+
+	var out bytes.Buffer
+	err = readSocket(socketPath, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("expected %d bytes, got %d", len(data), out.Len())
+	}
+
+	err = readSocket(filepath.Join(dir, "missing.sock"), &out)
+	if err == nil {
+		t.Error("expected an error for a missing socket")
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/earthly/earthly/debugger/common"
+
+	"github.com/pkg/errors"
+)
+
+// runOpts control how the command is run, as per RUN --timeout.
+type runOpts struct {
+	timeout time.Duration
+	// ignoreFailure is set when the command is run again for SAVE ARTIFACT --on-failure.
+	ignoreFailure bool
+}
+
+// timeoutError is returned when the command is killed because of its timeout.
+type timeoutError struct {
+	timeout time.Duration
+}
+
+func (te *timeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s", te.timeout)
+}
+
+// runOptsFromEnv reads the run options from the env, and removes them from the env
+// such that the command does not see them.
+func runOptsFromEnv() (runOpts, error) {
+	var opts runOpts
+	timeoutStr, found := os.LookupEnv(common.RunTimeoutEnvVar)
+	if found {
+		os.Unsetenv(common.RunTimeoutEnvVar)
+		timeout, err := time.ParseDuration(timeoutStr)
+		if err != nil {
+			return runOpts{}, errors.Wrapf(err, "parse %s", common.RunTimeoutEnvVar)
+		}
+		opts.timeout = timeout
+	}
+	_, found = os.LookupEnv(common.RunIgnoreFailureEnvVar)
+	if found {
+		os.Unsetenv(common.RunIgnoreFailureEnvVar)
+		opts.ignoreFailure = true
+	}
+	return opts, nil
+}
+
+// runCommand runs the command. If the timeout is not zero and elapses, the command is
+// killed, together with any processes it started. The command is not retried here on
+// failure, as the failed attempt may have modified the filesystem: RUN --retry is
+// handled by the builder, which solves the command again from a clean state.
+func runCommand(args []string, opts runOpts) error {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if opts.timeout == 0 {
+		return cmd.Run()
+	}
+	// Run in a new process group, such that children of the shell can be killed too.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	timer := time.NewTimer(opts.timeout)
+	defer timer.Stop()
+	select {
+	case err = <-done:
+		return err
+	case <-timer.C:
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return &timeoutError{timeout: opts.timeout}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/earthly/earthly/debugger/common"
+)
+
+func TestRunCommandFailure(t *testing.T) {
+	err := runCommand([]string{"/bin/sh", "-c", "exit 3"}, runOpts{})
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 3 {
+		t.Fatalf("expected exit code 3, got %v", err)
+	}
+}
+
+func TestRunCommandTimeout(t *testing.T) {
+	start := time.Now()
+	err := runCommand([]string{"/bin/sh", "-c", "sleep 10 & wait"}, runOpts{timeout: 100 * time.Millisecond})
+	if _, ok := err.(*timeoutError); !ok {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("command was not killed on timeout")
+	}
+}
+
+func TestRunOptsFromEnvIgnoreFailure(t *testing.T) {
+	os.Setenv(common.RunIgnoreFailureEnvVar, "true")
+	defer os.Unsetenv(common.RunIgnoreFailureEnvVar)
+	opts, err := runOptsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.ignoreFailure {
+		t.Errorf("expected the failure to be ignored")
+	}
+	if _, found := os.LookupEnv(common.RunIgnoreFailureEnvVar); found {
+		t.Errorf("expected %s to be removed from the env", common.RunIgnoreFailureEnvVar)
+	}
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -16,24 +20,39 @@ import (
 	"regexp"
 	"runtime"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
+	"github.com/containerd/containerd/platforms"
 	"github.com/earthly/earthly/autocomplete"
 	"github.com/earthly/earthly/buildcontext"
 	"github.com/earthly/earthly/builder"
 	"github.com/earthly/earthly/buildkitd"
+	"github.com/earthly/earthly/cigen"
 	"github.com/earthly/earthly/cleanup"
 	"github.com/earthly/earthly/config"
 	"github.com/earthly/earthly/conslogging"
 	debuggercommon "github.com/earthly/earthly/debugger/common"
+	"github.com/earthly/earthly/debugger/portforward"
 	"github.com/earthly/earthly/debugger/terminal"
 	"github.com/earthly/earthly/domain"
 	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/earthly/earthly/earthfile2llb/imr"
 	"github.com/earthly/earthly/earthfile2llb/variables"
+	"github.com/earthly/earthly/errcode"
+	"github.com/earthly/earthly/eventstream"
+	"github.com/earthly/earthly/llbutil"
+	"github.com/earthly/earthly/localrun"
 	"github.com/earthly/earthly/logging"
+	"github.com/earthly/earthly/metrics"
+	"github.com/earthly/earthly/migrate"
+	"github.com/earthly/earthly/tracing"
+	"github.com/earthly/earthly/tui"
 
 	"github.com/fatih/color"
 	"github.com/joho/godotenv"
@@ -45,10 +64,10 @@ import (
 	"github.com/moby/buildkit/session/secrets/secretsprovider"
 	"github.com/moby/buildkit/session/sshforward/sshprovider"
 	"github.com/moby/buildkit/util/entitlements"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
-	"golang.org/x/sync/errgroup"
 )
 
 var dotEnvPath = ".env"
@@ -58,32 +77,109 @@ type earthApp struct {
 	console   conslogging.ConsoleLogger
 	cfg       *config.Config
 	sessionID string
+	// gracefulStop stops the build in progress gracefully on the first signal.
+	gracefulStop *gracefulStop
 	cliFlags
 }
 
 type cliFlags struct {
-	buildArgs            cli.StringSlice
-	secrets              cli.StringSlice
-	artifactMode         bool
-	imageMode            bool
-	pull                 bool
-	push                 bool
-	noOutput             bool
-	noCache              bool
-	pruneAll             bool
-	pruneReset           bool
-	buildkitdSettings    buildkitd.Settings
-	allowPrivileged      bool
-	enableProfiler       bool
-	buildkitHost         string
-	buildkitdImage       string
-	remoteCache          string
-	configPath           string
-	gitUsernameOverride  string
-	gitPasswordOverride  string
-	interactiveDebugging bool
-	sshAuthSock          string
-	homebrewSource       string
+	buildArgs             cli.StringSlice
+	buildArgMatrix        cli.StringSlice
+	secrets               cli.StringSlice
+	artifactMode          bool
+	imageMode             bool
+	pull                  bool
+	push                  bool
+	noOutput              bool
+	noCache               bool
+	pruneAll              bool
+	pruneReset            bool
+	pruneTarget           string
+	pruneOlderThan        time.Duration
+	pruneKeepLast         int
+	duByProject           bool
+	duJSON                bool
+	buildkitdSettings     buildkitd.Settings
+	allowPrivileged       bool
+	caCerts               cli.StringSlice
+	defaultCPUs           string
+	maxParallelism        int
+	serializeTargets      cli.StringSlice
+	defaultMemory         string
+	enableProfiler        bool
+	buildkitHost          string
+	buildkitWorkers       cli.StringSlice
+	kubernetes            bool
+	kubernetesOpt         buildkitd.KubernetesOpt
+	buildkitdImage        string
+	remoteCache           string
+	configPath            string
+	gitUsernameOverride   string
+	gitPasswordOverride   string
+	interactiveDebugging  bool
+	forwardPorts          cli.StringSlice
+	attachable            bool
+	sshAuthSock           string
+	sshAgents             cli.StringSlice
+	homebrewSource        string
+	sbomFormat            string
+	sbomDir               string
+	provenance            bool
+	provenanceDir         string
+	sign                  bool
+	signKeySecret         string
+	signKeyPasswordSecret string
+	rekor                 bool
+	rekorURL              string
+	ociArchiveDir         string
+	faithfulArtifacts     bool
+	rejectDanglingLinks   bool
+	checksumsDir          string
+	logFormat             string
+	eventStreamAddr       string
+	metricsAddr           string
+	otlpEndpoint          string
+	targetLogDir          string
+	summaryPath           string
+	criticalPath          bool
+	sizeReport            bool
+	sizeBaseline          string
+	sizeThreshold         float64
+	watch                 bool
+	timeout               time.Duration
+	targetTimeout         time.Duration
+	imageResolveTimeout   time.Duration
+	gitResolveTimeout     time.Duration
+	labels                cli.StringSlice
+	excludeLabels         cli.StringSlice
+	autoCacheMounts       bool
+	ociLabels             bool
+	reproducible          bool
+	pushRetries           int
+	pushRetryBackoff      time.Duration
+	scanner               string
+	scanFailOn            string
+	scanWarnOn            string
+	verifyReproducible    bool
+	plan                  bool
+	policies              cli.StringSlice
+	checkBaseImages       bool
+	prewarm               bool
+	recordBuild           string
+	buildDiffJSON         bool
+	exportLLB             string
+	exportLLBFormat       string
+	lsJSON                bool
+	affectedJSON          bool
+	affectedBuild         bool
+	affectedTargets       []domain.Target
+	lintJSON              bool
+	migrateWrite          bool
+	ciGenOpt              cigen.Opt
+	ciGenTargets          cli.StringSlice
+	ciGenOutput           string
+	ciLogGroups           string
+	tui                   bool
 }
 
 var (
@@ -112,11 +208,20 @@ func main() {
 		signal.Stop(c)
 		cancel()
 	}()
+	gs := newGracefulStop()
 	go func() {
 		receivedSignal := false
+		stopping := false
 		for {
 			select {
 			case sig := <-c:
+				if !stopping && gs.stop() {
+					// A build is in progress. Let it complete its output in progress and
+					// save what it can first.
+					stopping = true
+					fmt.Printf("Received signal %s. Stopping the build gracefully (signal again to cancel)...\n", sig.String())
+					continue
+				}
 				cancel()
 				if receivedSignal {
 					// This is the second time we have received a signal. Quit immediately.
@@ -158,6 +263,7 @@ func main() {
 	}
 
 	app := newEarthApp(ctx, conslogging.Current(colorMode))
+	app.gracefulStop = gs
 	app.autoComplete()
 
 	// Set up file-based logging.
@@ -232,6 +338,11 @@ func newEarthApp(ctx context.Context, console conslogging.ConsoleLogger) *earthA
 			Usage:   "A build arg override, specified as <key>=[<value>]",
 			Value:   &app.buildArgs,
 		},
+		&cli.StringSliceFlag{
+			Name:  "build-arg-matrix",
+			Usage: "Build the target for each of the comma separated values of a build arg, specified as <key>=<value>,<value>... Repeating it builds every combination",
+			Value: &app.buildArgMatrix,
+		},
 		&cli.StringSliceFlag{
 			Name:    "secret",
 			Aliases: []string{"s"},
@@ -289,6 +400,12 @@ func newEarthApp(ctx context.Context, console conslogging.ConsoleLogger) *earthA
 			Usage:       "The SSH auth socket to use for ssh-agent forwarding",
 			Destination: &app.sshAuthSock,
 		},
+		&cli.StringSliceFlag{
+			Name:    "ssh",
+			EnvVars: []string{"EARTHLY_SSH"},
+			Usage:   "An SSH agent socket or private key files to expose to RUN --ssh-id, specified as <id>=<path>[,<path>...]",
+			Value:   &app.sshAgents,
+		},
 		&cli.StringFlag{
 			Name:        "git-username",
 			EnvVars:     []string{"GIT_USERNAME"},
@@ -315,6 +432,12 @@ func newEarthApp(ctx context.Context, console conslogging.ConsoleLogger) *earthA
 			Usage:       "Allow build to use the --privileged flag in RUN commands",
 			Destination: &app.allowPrivileged,
 		},
+		&cli.StringSliceFlag{
+			Name:    "ca-cert",
+			EnvVars: []string{"EARTHLY_CA_CERTS"},
+			Usage:   "A PEM file of additional CA certificates to trust within RUN commands and WITH DOCKER",
+			Value:   &app.caCerts,
+		},
 		&cli.BoolFlag{
 			Name:        "profiler",
 			EnvVars:     []string{"EARTHLY_PROFILER"},
@@ -328,6 +451,60 @@ func newEarthApp(ctx context.Context, console conslogging.ConsoleLogger) *earthA
 			Usage:       "The URL to use for connecting to a buildkit host. If empty, earth will attempt to start a buildkitd instance via docker run",
 			Destination: &app.buildkitHost,
 		},
+		&cli.BoolFlag{
+			Name:        "kubernetes",
+			EnvVars:     []string{"EARTHLY_KUBERNETES"},
+			Usage:       "Start buildkitd as a pod on a Kubernetes cluster, via kubectl, instead of a docker container",
+			Destination: &app.kubernetes,
+		},
+		&cli.StringFlag{
+			Name:        "kubernetes-context",
+			EnvVars:     []string{"EARTHLY_KUBERNETES_CONTEXT"},
+			Usage:       "The kubectl context to use with --kubernetes",
+			Destination: &app.kubernetesOpt.Context,
+		},
+		&cli.StringFlag{
+			Name:        "kubernetes-namespace",
+			EnvVars:     []string{"EARTHLY_KUBERNETES_NAMESPACE"},
+			Usage:       "The namespace of the buildkitd pod started with --kubernetes",
+			Destination: &app.kubernetesOpt.Namespace,
+		},
+		&cli.BoolFlag{
+			Name:        "rootless",
+			EnvVars:     []string{"EARTHLY_ROOTLESS"},
+			Usage:       "Run buildkitd without privileges. RUN --privileged and WITH DOCKER are not available",
+			Destination: &app.buildkitdSettings.Rootless,
+		},
+		&cli.StringFlag{
+			Name:        "default-cpus",
+			EnvVars:     []string{"EARTHLY_DEFAULT_CPUS"},
+			Usage:       "The CPU limit of the WITH DOCKER commands which do not set --cpus",
+			Destination: &app.defaultCPUs,
+		},
+		&cli.StringFlag{
+			Name:        "default-memory",
+			EnvVars:     []string{"EARTHLY_DEFAULT_MEMORY"},
+			Usage:       "The memory limit (eg 512m, 2g) of the WITH DOCKER commands which do not set --memory",
+			Destination: &app.defaultMemory,
+		},
+		&cli.IntFlag{
+			Name:        "max-parallelism",
+			EnvVars:     []string{"EARTHLY_MAX_PARALLELISM"},
+			Usage:       "The maximum number of commands run at the same time by the buildkit daemon",
+			Destination: &app.maxParallelism,
+		},
+		&cli.StringSliceFlag{
+			Name:    "serialize-target",
+			EnvVars: []string{"EARTHLY_SERIALIZE_TARGETS"},
+			Usage:   "A target whose commands never run at the same time, as <target>[=<group>]",
+			Value:   &app.serializeTargets,
+		},
+		&cli.StringSliceFlag{
+			Name:    "buildkit-worker",
+			EnvVars: []string{"EARTHLY_BUILDKIT_WORKERS"},
+			Usage:   "The URL of an additional buildkit host, which targets of the build may be scheduled on",
+			Value:   &app.buildkitWorkers,
+		},
 		&cli.IntFlag{
 			Name:        "buildkit-cache-size-mb",
 			Value:       10000,
@@ -355,6 +532,94 @@ func newEarthApp(ctx context.Context, console conslogging.ConsoleLogger) *earthA
 			Destination: &app.remoteCache,
 			Hidden:      true, // Experimental.
 		},
+		&cli.StringFlag{
+			Name:        "sbom",
+			EnvVars:     []string{"EARTHLY_SBOM"},
+			Usage:       fmt.Sprintf("Generate an SBOM for each output image, in the given format (%s)", strings.Join(builder.SBOMFormats, ", ")),
+			Destination: &app.sbomFormat,
+		},
+		&cli.StringFlag{
+			Name:        "sbom-dir",
+			Value:       "sbom",
+			EnvVars:     []string{"EARTHLY_SBOM_DIR"},
+			Usage:       "The local dir where generated SBOMs are written",
+			Destination: &app.sbomDir,
+		},
+		&cli.BoolFlag{
+			Name:        "provenance",
+			EnvVars:     []string{"EARTHLY_PROVENANCE"},
+			Usage:       "Generate an in-toto SLSA provenance statement for each output image and local artifact",
+			Destination: &app.provenance,
+		},
+		&cli.StringFlag{
+			Name:        "provenance-dir",
+			Value:       "provenance",
+			EnvVars:     []string{"EARTHLY_PROVENANCE_DIR"},
+			Usage:       "The local dir where generated provenance statements are written",
+			Destination: &app.provenanceDir,
+		},
+		&cli.BoolFlag{
+			Name:        "sign",
+			EnvVars:     []string{"EARTHLY_SIGN"},
+			Usage:       "Sign pushed images using cosign",
+			Destination: &app.sign,
+		},
+		&cli.StringFlag{
+			Name:        "sign-key-secret",
+			EnvVars:     []string{"EARTHLY_SIGN_KEY_SECRET"},
+			Usage:       "The ID of the secret holding the cosign private key used for --sign and --rekor. If empty, keyless signing is used",
+			Destination: &app.signKeySecret,
+		},
+		&cli.StringFlag{
+			Name:        "sign-key-password-secret",
+			EnvVars:     []string{"EARTHLY_SIGN_KEY_PASSWORD_SECRET"},
+			Usage:       "The ID of the secret holding the password of the cosign private key of --sign-key-secret. If empty, the env var COSIGN_PASSWORD is used",
+			Destination: &app.signKeyPasswordSecret,
+		},
+		&cli.BoolFlag{
+			Name:        "rekor",
+			EnvVars:     []string{"EARTHLY_REKOR"},
+			Usage:       "Sign the SBOMs and provenance statements using cosign and upload them to a Rekor transparency log",
+			Destination: &app.rekor,
+		},
+		&cli.StringFlag{
+			Name:        "rekor-url",
+			Value:       builder.DefaultRekorURL,
+			EnvVars:     []string{"EARTHLY_REKOR_URL"},
+			Usage:       "The URL of the Rekor server used for --rekor",
+			Destination: &app.rekorURL,
+		},
+		&cli.StringFlag{
+			Name:        "oci-archive-dir",
+			EnvVars:     []string{"EARTHLY_OCI_ARCHIVE_DIR"},
+			Usage:       "Also write each output image as an OCI archive into the given local dir",
+			Destination: &app.ociArchiveDir,
+		},
+		&cli.BoolFlag{
+			Name:        "faithful-artifacts",
+			EnvVars:     []string{"EARTHLY_FAITHFUL_ARTIFACTS"},
+			Usage:       "Preserve file modes, ownership, mtimes and extended attributes of artifacts saved locally",
+			Destination: &app.faithfulArtifacts,
+		},
+		&cli.BoolFlag{
+			Name:        "reject-dangling-symlinks",
+			EnvVars:     []string{"EARTHLY_REJECT_DANGLING_SYMLINKS"},
+			Usage:       "Fail if an artifact saved locally contains symlinks which do not resolve",
+			Destination: &app.rejectDanglingLinks,
+		},
+		&cli.StringFlag{
+			Name:        "checksums-dir",
+			EnvVars:     []string{"EARTHLY_CHECKSUMS_DIR"},
+			Usage:       "The local dir where a SHA256SUMS manifest of all artifacts saved locally is written",
+			Destination: &app.checksumsDir,
+		},
+		&cli.BoolFlag{
+			Name:        "with-docker-registry",
+			EnvVars:     []string{"EARTHLY_WITH_DOCKER_REGISTRY"},
+			Usage:       "Use an embedded registry for loading images in WITH DOCKER, instead of tar files",
+			Destination: &app.buildkitdSettings.EmbeddedRegistry,
+			Hidden:      true, // Experimental.
+		},
 		&cli.BoolFlag{
 			Name:        "interactive",
 			Aliases:     []string{"i"},
@@ -362,6 +627,18 @@ func newEarthApp(ctx context.Context, console conslogging.ConsoleLogger) *earthA
 			Usage:       "Enable interactive debugging",
 			Destination: &app.interactiveDebugging,
 		},
+		&cli.BoolFlag{
+			Name:        "attachable",
+			EnvVars:     []string{"EARTHLY_ATTACHABLE"},
+			Usage:       "Allow opening a shell into the currently executing step of the build, via earth attach",
+			Destination: &app.attachable,
+		},
+		&cli.StringSliceFlag{
+			Name:    "forward-port",
+			EnvVars: []string{"EARTHLY_FORWARD_PORTS"},
+			Usage:   "A port to forward from the build environment to the host during interactive debugging, specified as <host-port>:<container-port>",
+			Value:   &app.forwardPorts,
+		},
 		&cli.BoolFlag{
 			Name:        "verbose",
 			Aliases:     []string{"V"},
@@ -369,6 +646,220 @@ func newEarthApp(ctx context.Context, console conslogging.ConsoleLogger) *earthA
 			Usage:       "enable verbose logging of the earthly-buildkitd container",
 			Destination: &app.buildkitdSettings.Debug,
 		},
+		&cli.StringFlag{
+			Name:        "log-format",
+			Value:       "text",
+			EnvVars:     []string{"EARTHLY_LOG_FORMAT"},
+			Usage:       "The format of the build output: text or json (newline-delimited JSON events)",
+			Destination: &app.logFormat,
+		},
+		&cli.StringFlag{
+			Name:        "ci-log-groups",
+			Value:       "auto",
+			EnvVars:     []string{"EARTHLY_CI_LOG_GROUPS"},
+			Usage:       "Group the output of each target into collapsible sections of the CI system: auto (detect the CI system), none, github or gitlab",
+			Destination: &app.ciLogGroups,
+		},
+		&cli.BoolFlag{
+			Name:        "tui",
+			EnvVars:     []string{"EARTHLY_TUI"},
+			Usage:       "Display the progress of the build in a full-screen view, instead of the regular output",
+			Destination: &app.tui,
+		},
+		&cli.StringFlag{
+			Name:        "event-stream-addr",
+			EnvVars:     []string{"EARTHLY_EVENT_STREAM_ADDR"},
+			Usage:       "The address (eg 127.0.0.1:8372) on which to stream build events over HTTP, for dashboards and IDE integrations",
+			Destination: &app.eventStreamAddr,
+		},
+		&cli.StringFlag{
+			Name:        "metrics-addr",
+			EnvVars:     []string{"EARTHLY_METRICS_ADDR"},
+			Usage:       "The address (eg 127.0.0.1:9372) on which to serve the cache hit metrics of the build, for Prometheus",
+			Destination: &app.metricsAddr,
+		},
+		&cli.StringFlag{
+			Name:        "otlp-endpoint",
+			EnvVars:     []string{"EARTHLY_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_ENDPOINT"},
+			Usage:       "The OTLP HTTP endpoint (eg http://localhost:4318) to export a trace of the build to",
+			Destination: &app.otlpEndpoint,
+		},
+		&cli.StringFlag{
+			Name:        "target-log-dir",
+			EnvVars:     []string{"EARTHLY_TARGET_LOG_DIR"},
+			Usage:       "A local directory into which to additionally write the output of each target, as a separate file",
+			Destination: &app.targetLogDir,
+		},
+		&cli.StringFlag{
+			Name:        "summary-path",
+			EnvVars:     []string{"EARTHLY_SUMMARY_PATH"},
+			Usage:       "A local path to write a JSON summary of the build to, including the images and artifacts output, the duration of each target and cache hits",
+			Destination: &app.summaryPath,
+		},
+		&cli.BoolFlag{
+			Name:        "critical-path",
+			EnvVars:     []string{"EARTHLY_CRITICAL_PATH"},
+			Usage:       "Print the critical path of the build once it completes, with the targets which spent the most time on it",
+			Destination: &app.criticalPath,
+		},
+		&cli.BoolFlag{
+			Name:        "size-report",
+			EnvVars:     []string{"EARTHLY_SIZE_REPORT"},
+			Usage:       "Print the size of each artifact and image output, once the build completes",
+			Destination: &app.sizeReport,
+		},
+		&cli.StringFlag{
+			Name:        "size-baseline",
+			EnvVars:     []string{"EARTHLY_SIZE_BASELINE"},
+			Usage:       "A local JSON file of output sizes to flag size regressions against. Written with the current sizes if it does not exist. Implies --size-report",
+			Destination: &app.sizeBaseline,
+		},
+		&cli.Float64Flag{
+			Name:        "size-regression-threshold",
+			EnvVars:     []string{"EARTHLY_SIZE_REGRESSION_THRESHOLD"},
+			Usage:       "The growth, in percent, beyond which an output is flagged as a regression compared to --size-baseline",
+			Value:       10,
+			Destination: &app.sizeThreshold,
+		},
+		&cli.BoolFlag{
+			Name:        "watch",
+			EnvVars:     []string{"EARTHLY_WATCH"},
+			Usage:       "Build the target again whenever the files of its local build contexts change, until interrupted",
+			Destination: &app.watch,
+		},
+		&cli.DurationFlag{
+			Name:        "timeout",
+			EnvVars:     []string{"EARTHLY_TIMEOUT"},
+			Usage:       "Fail the build if it takes longer than the given duration (eg 30m), including the interpretation of the Earthfiles",
+			Destination: &app.timeout,
+		},
+		&cli.DurationFlag{
+			Name:        "target-timeout",
+			EnvVars:     []string{"EARTHLY_TARGET_TIMEOUT"},
+			Usage:       "Fail the build if the commands of a target take longer than the given duration (eg 10m)",
+			Destination: &app.targetTimeout,
+		},
+		&cli.DurationFlag{
+			Name:        "image-resolve-timeout",
+			EnvVars:     []string{"EARTHLY_IMAGE_RESOLVE_TIMEOUT"},
+			Usage:       "Fail the build if resolving the config of an image takes longer than the given duration (0 for no limit)",
+			Value:       5 * time.Minute,
+			Destination: &app.imageResolveTimeout,
+		},
+		&cli.DurationFlag{
+			Name:        "git-resolve-timeout",
+			EnvVars:     []string{"EARTHLY_GIT_RESOLVE_TIMEOUT"},
+			Usage:       "Fail the build if resolving a remote repository takes longer than the given duration (0 for no limit)",
+			Value:       30 * time.Minute,
+			Destination: &app.gitResolveTimeout,
+		},
+		&cli.StringSliceFlag{
+			Name:    "label",
+			EnvVars: []string{"EARTHLY_LABELS"},
+			Usage:   "Only build the targets matched by target patterns which are tagged with one of the given labels",
+			Value:   &app.labels,
+		},
+		&cli.StringSliceFlag{
+			Name:    "exclude-label",
+			EnvVars: []string{"EARTHLY_EXCLUDE_LABELS"},
+			Usage:   "Do not build the targets matched by target patterns which are tagged with one of the given labels",
+			Value:   &app.excludeLabels,
+		},
+		&cli.BoolFlag{
+			Name:        "auto-cache-mounts",
+			EnvVars:     []string{"EARTHLY_AUTO_CACHE_MOUNTS"},
+			Usage:       "Mount the package caches of the toolchains detected in the images (go, npm, pip, cargo, maven) into the RUN commands using them",
+			Destination: &app.autoCacheMounts,
+		},
+		&cli.BoolFlag{
+			Name:        "oci-labels",
+			EnvVars:     []string{"EARTHLY_OCI_LABELS"},
+			Usage:       "Label the saved images with the OCI annotations org.opencontainers.image.* (source, revision, created, version), from the git metadata of their targets",
+			Destination: &app.ociLabels,
+		},
+		&cli.BoolFlag{
+			Name:        "reproducible",
+			EnvVars:     []string{"EARTHLY_REPRODUCIBLE"},
+			Usage:       "Output reproducible images, whose timestamps are set to SOURCE_DATE_EPOCH (0 if unset), such that the same inputs always produce the same image digests",
+			Destination: &app.reproducible,
+		},
+		&cli.BoolFlag{
+			Name:        "verify-reproducible",
+			EnvVars:     []string{"EARTHLY_VERIFY_REPRODUCIBLE"},
+			Usage:       "Build the target twice, the second time without the cache, and fail if the digests of the reproducible images output differ (implies --reproducible)",
+			Destination: &app.verifyReproducible,
+		},
+		&cli.IntFlag{
+			Name:        "push-retries",
+			EnvVars:     []string{"EARTHLY_PUSH_RETRIES"},
+			Usage:       "The number of times a failed image push is retried",
+			Value:       2,
+			Destination: &app.pushRetries,
+		},
+		&cli.DurationFlag{
+			Name:        "push-retry-backoff",
+			EnvVars:     []string{"EARTHLY_PUSH_RETRY_BACKOFF"},
+			Usage:       "The delay before retrying a failed image push, doubled with every retry",
+			Value:       2 * time.Second,
+			Destination: &app.pushRetryBackoff,
+		},
+		&cli.StringFlag{
+			Name:        "scan",
+			EnvVars:     []string{"EARTHLY_SCAN"},
+			Usage:       fmt.Sprintf("The vulnerability scanner to run against images before they are pushed (%s)", strings.Join(builder.Scanners, ", ")),
+			Destination: &app.scanner,
+		},
+		&cli.StringFlag{
+			Name:        "scan-fail-on",
+			EnvVars:     []string{"EARTHLY_SCAN_FAIL_ON"},
+			Usage:       "The severity from which vulnerabilities prevent the push of an image (none, unknown, low, medium, high, critical)",
+			Value:       "critical",
+			Destination: &app.scanFailOn,
+		},
+		&cli.StringFlag{
+			Name:        "scan-warn-on",
+			EnvVars:     []string{"EARTHLY_SCAN_WARN_ON"},
+			Usage:       "The severity from which vulnerabilities are printed as warnings (none, unknown, low, medium, high, critical)",
+			Value:       "high",
+			Destination: &app.scanWarnOn,
+		},
+		&cli.BoolFlag{
+			Name:        "plan",
+			EnvVars:     []string{"EARTHLY_PLAN"},
+			Usage:       "Report what the build would execute, output and push, including the expected cache hits, without executing it",
+			Destination: &app.plan,
+		},
+		&cli.StringSliceFlag{
+			Name:    "policy",
+			EnvVars: []string{"EARTHLY_POLICY"},
+			Usage:   "A Rego policy file or directory to evaluate, via opa, against the plan of the build before executing it",
+			Value:   &app.policies,
+		},
+		&cli.BoolFlag{
+			Name:        "check-base-images",
+			EnvVars:     []string{"EARTHLY_CHECK_BASE_IMAGES"},
+			Usage:       "Report the base images of the targets which are outdated, without building them. Fails if any is outdated",
+			Destination: &app.checkBaseImages,
+		},
+		&cli.StringFlag{
+			Name:        "record-build",
+			EnvVars:     []string{"EARTHLY_RECORD_BUILD"},
+			Usage:       "Write the cache keys of the commands of the build to a local path, for comparing builds with build-diff",
+			Destination: &app.recordBuild,
+		},
+		&cli.StringFlag{
+			Name:        "export-llb",
+			EnvVars:     []string{"EARTHLY_EXPORT_LLB"},
+			Usage:       "Write the LLB definition of the target to a local path (- for stdout), instead of building it",
+			Destination: &app.exportLLB,
+		},
+		&cli.StringFlag{
+			Name:        "export-llb-format",
+			EnvVars:     []string{"EARTHLY_EXPORT_LLB_FORMAT"},
+			Usage:       "The format in which to write the LLB definition: pb or json",
+			Value:       "pb",
+			Destination: &app.exportLLBFormat,
+		},
 	}
 
 	app.cliApp.Commands = []*cli.Command{
@@ -395,6 +886,168 @@ func newEarthApp(ctx context.Context, console conslogging.ConsoleLogger) *earthA
 			Hidden:      true,
 			Action:      app.actionDebug,
 		},
+		{
+			Name:        "ls",
+			Usage:       "List the targets of an Earthfile",
+			Description: "List the targets of an Earthfile, with their build args and outputs",
+			ArgsUsage:   "[<path>]",
+			Action:      app.actionLs,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:        "json",
+					EnvVars:     []string{"EARTHLY_LS_JSON"},
+					Usage:       "Output the targets as JSON",
+					Destination: &app.lsJSON,
+				},
+			},
+		},
+		{
+			Name:        "affected",
+			Usage:       "List the targets affected by the changes of a git diff range",
+			Description: "List, or build, the targets of the Earthfiles of a directory tree which are affected by the files changed in a git diff range (eg main...HEAD)",
+			ArgsUsage:   "<diff-range> [<path>]",
+			Action:      app.actionAffected,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:        "json",
+					EnvVars:     []string{"EARTHLY_AFFECTED_JSON"},
+					Usage:       "Output the affected targets as JSON",
+					Destination: &app.affectedJSON,
+				},
+				&cli.BoolFlag{
+					Name:        "build",
+					EnvVars:     []string{"EARTHLY_AFFECTED_BUILD"},
+					Usage:       "Build the affected targets, rather than listing them",
+					Destination: &app.affectedBuild,
+				},
+			},
+		},
+		{
+			Name:        "lint",
+			Usage:       "Check an Earthfile for common problems",
+			Description: "Check an Earthfile for common problems, such as unused ARGs or COPY sources missing from the build context",
+			ArgsUsage:   "[<path>]",
+			Action:      app.actionLint,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:        "json",
+					EnvVars:     []string{"EARTHLY_LINT_JSON"},
+					Usage:       "Output the issues found as JSON",
+					Destination: &app.lintJSON,
+				},
+			},
+		},
+		{
+			Name:        "migrate",
+			Usage:       "Rewrite the deprecated syntax of an Earthfile",
+			Description: "Rewrite the deprecated syntax of an Earthfile into the current syntax, such as RUN --with-docker into WITH DOCKER clauses, preserving its comments and formatting. The migrated Earthfile is printed, unless --write is used",
+			ArgsUsage:   "[<path>]",
+			Action:      app.actionMigrate,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:        "write",
+					Aliases:     []string{"w"},
+					Usage:       "Rewrite the Earthfile in place, rather than printing the migrated Earthfile",
+					Destination: &app.migrateWrite,
+				},
+			},
+		},
+		{
+			Name:        "ci-gen",
+			Usage:       "Generate a CI pipeline from the targets of an Earthfile",
+			Description: "Generate a GitHub Actions workflow or a GitLab CI config which builds the entry targets of an Earthfile (the targets no other target depends on), or the given targets",
+			ArgsUsage:   "[<path>]",
+			Action:      app.actionCIGen,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:        "provider",
+					Value:       cigen.GitHub,
+					Usage:       "The CI system to generate the pipeline for: github or gitlab",
+					Destination: &app.ciGenOpt.Provider,
+				},
+				&cli.StringSliceFlag{
+					Name:  "target",
+					Usage: "A target to build, instead of the entry targets of the Earthfile",
+					Value: &app.ciGenTargets,
+				},
+				&cli.StringFlag{
+					Name:        "branch",
+					Value:       "main",
+					Usage:       "The branch whose builds push the images",
+					Destination: &app.ciGenOpt.Branch,
+				},
+				&cli.StringFlag{
+					Name:        "remote-cache",
+					Usage:       "A docker image repository to be used as the build cache of the pipeline",
+					Destination: &app.ciGenOpt.RemoteCache,
+				},
+				&cli.StringFlag{
+					Name:        "registry",
+					Usage:       "The registry to log in to, for pushing images and the remote cache (Docker Hub if not set)",
+					Destination: &app.ciGenOpt.Registry,
+				},
+				&cli.StringFlag{
+					Name:        "earth-version",
+					Usage:       "The version of earth installed by the pipeline (the latest if not set)",
+					Destination: &app.ciGenOpt.EarthVersion,
+				},
+				&cli.StringFlag{
+					Name:        "output",
+					Aliases:     []string{"o"},
+					Usage:       "The file to write the pipeline to, rather than stdout",
+					Destination: &app.ciGenOutput,
+				},
+			},
+		},
+		{
+			Name:        "attach",
+			Usage:       "Open a shell into the currently executing step of a build",
+			Description: "Open a shell into the currently executing step of a build started with --attachable",
+			ArgsUsage:   "<build-id>",
+			Action:      app.actionAttach,
+		},
+		{
+			Name:        "prewarm",
+			Usage:       "Pull the base images and remote contexts of targets into the build cache",
+			Description: "Pull the images and remote git contexts referenced by the targets into the earthly build cache, without executing any of their commands",
+			ArgsUsage:   "<target-ref>...",
+			Action:      app.actionPrewarm,
+		},
+		{
+			Name:        "build-diff",
+			Usage:       "Compare the cache keys of two recorded builds",
+			Description: "List the commands whose cache keys differ between two builds recorded with --record-build, and why",
+			ArgsUsage:   "<before-record> <after-record>",
+			Action:      app.actionBuildDiff,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:        "json",
+					EnvVars:     []string{"EARTHLY_BUILD_DIFF_JSON"},
+					Usage:       "Output the differences as JSON",
+					Destination: &app.buildDiffJSON,
+				},
+			},
+		},
+		{
+			Name:        "du",
+			Usage:       "Show the disk usage of the earthly build cache",
+			Description: "Show the disk usage of the earthly build cache, broken down by target or project",
+			Action:      app.actionDu,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:        "by-project",
+					EnvVars:     []string{"EARTHLY_DU_BY_PROJECT"},
+					Usage:       "Break the disk usage down by project rather than by target",
+					Destination: &app.duByProject,
+				},
+				&cli.BoolFlag{
+					Name:        "json",
+					EnvVars:     []string{"EARTHLY_DU_JSON"},
+					Usage:       "Output the disk usage as JSON",
+					Destination: &app.duJSON,
+				},
+			},
+		},
 		{
 			Name:        "prune",
 			Usage:       "Prune earthly build cache",
@@ -414,6 +1067,24 @@ func newEarthApp(ctx context.Context, console conslogging.ConsoleLogger) *earthA
 					Usage:       "Reset cache entirely by wiping cache dir",
 					Destination: &app.pruneReset,
 				},
+				&cli.StringFlag{
+					Name:        "target",
+					EnvVars:     []string{"EARTHLY_PRUNE_TARGET"},
+					Usage:       "Only prune the cache of the targets starting with the given prefix (eg github.com/foo/bar+)",
+					Destination: &app.pruneTarget,
+				},
+				&cli.DurationFlag{
+					Name:        "older-than",
+					EnvVars:     []string{"EARTHLY_PRUNE_OLDER_THAN"},
+					Usage:       "Only prune the cache which has not been used for the given duration (eg 168h)",
+					Destination: &app.pruneOlderThan,
+				},
+				&cli.IntFlag{
+					Name:        "keep-last",
+					EnvVars:     []string{"EARTHLY_PRUNE_KEEP_LAST"},
+					Usage:       "Only prune the cache of targets, keeping the cache of the last N builds of each target",
+					Destination: &app.pruneKeepLast,
+				},
 			},
 		},
 	}
@@ -461,6 +1132,35 @@ func (app *earthApp) before(context *cli.Context) error {
 	if !context.IsSet("buildkit-image") && app.cfg.Global.BuildkitImage != "" {
 		app.buildkitdImage = app.cfg.Global.BuildkitImage
 	}
+	if !context.IsSet("log-format") && app.cfg.Global.LogFormat != "" {
+		app.logFormat = app.cfg.Global.LogFormat
+	}
+	if !context.IsSet("ca-cert") && len(app.cfg.Global.CACerts) > 0 {
+		app.caCerts = *cli.NewStringSlice(app.cfg.Global.CACerts...)
+	}
+	if !context.IsSet("max-parallelism") && app.cfg.Global.MaxParallelism > 0 {
+		app.maxParallelism = app.cfg.Global.MaxParallelism
+	}
+	if !context.IsSet("serialize-target") && len(app.cfg.Global.SerializeTargets) > 0 {
+		app.serializeTargets = *cli.NewStringSlice(app.cfg.Global.SerializeTargets...)
+	}
+	if app.maxParallelism < 0 {
+		return errors.New("invalid --max-parallelism")
+	}
+	switch app.logFormat {
+	case "text":
+	case "json":
+		app.console = app.console.WithJSONOutput(true)
+	default:
+		return fmt.Errorf("invalid log format %s. Supported formats: text, json", app.logFormat)
+	}
+	ciGroupMode, err := conslogging.ParseCIGroupMode(app.ciLogGroups)
+	if err != nil {
+		return err
+	}
+	if ciGroupMode != conslogging.NoCIGroups && !app.console.JSONOutput() {
+		app.console = app.console.WithCIGroups(ciGroupMode)
+	}
 
 	if runtime.GOOS == "darwin" {
 		// on darwin buildkit is running inside a docker container and must reference this sock instead
@@ -542,6 +1242,11 @@ func (app *earthApp) processDeprecatedCommandOptions(context *cli.Context, cfg *
 	} else {
 		app.buildkitdSettings.CacheSizeMb = cfg.Global.BuildkitCacheSizeMb
 	}
+	gcPolicies, err := gcPolicies(cfg.Global.CacheGCPolicies, app.buildkitdSettings.CacheSizeMb)
+	if err != nil {
+		return errors.Wrap(err, "invalid cache_gc_policies")
+	}
+	app.buildkitdSettings.GCPolicies = gcPolicies
 
 	return nil
 }
@@ -738,10 +1443,15 @@ func (app *earthApp) run(ctx context.Context, args []string) int {
 		} else {
 			app.console.Warnf("Error: %v\n", err)
 		}
-		if errors.Is(err, context.Canceled) {
-			return 2
-		}
-		return 1
+		category := errcode.CategoryOf(err)
+		exitCode := category.ExitCode()
+		app.console.PrintEvent(conslogging.Event{
+			Type:      conslogging.ErrorEvent,
+			Error:     err.Error(),
+			ErrorCode: string(category),
+			ExitCode:  &exitCode,
+		})
+		return exitCode
 	}
 	return 0
 }
@@ -793,83 +1503,409 @@ func (app *earthApp) actionDebug(c *cli.Context) error {
 	return nil
 }
 
-func (app *earthApp) actionPrune(c *cli.Context) error {
-	if c.NArg() != 0 {
-		return errors.New("invalid arguments")
+func (app *earthApp) actionLs(c *cli.Context) error {
+	if c.NArg() > 1 {
+		return errors.New("invalid number of arguments provided")
 	}
-	if app.pruneReset {
-		// Prune by resetting container.
-		if app.buildkitHost != "" {
-			return errors.New("Cannot use prune --reset on non-default buildkit-host setting")
-		}
-		// Use twice the restart timeout for reset operations
-		// (needs extra time to also remove the files).
-		opTimeout := 2 * time.Duration(app.cfg.Global.BuildkitRestartTimeoutS) * time.Second
-		err := buildkitd.ResetCache(
-			c.Context, app.console, app.buildkitdImage, app.buildkitdSettings,
-			opTimeout)
-		if err != nil {
-			return errors.Wrap(err, "reset cache")
-		}
-		return nil
+	path := "."
+	if c.NArg() == 1 {
+		path = c.Args().First()
 	}
-
-	// Prune via API.
-	bkClient, err := app.newBuildkitdClient(c.Context)
+	infos, err := earthfile2llb.GetTargetInfos(filepath.Join(path, "Earthfile"))
 	if err != nil {
-		return errors.Wrap(err, "buildkitd new client")
+		return errors.Wrap(err, "get target infos")
 	}
-	defer bkClient.Close()
-	var opts []client.PruneOption
-	if app.pruneAll {
-		opts = append(opts, client.PruneAll)
-	}
-	ch := make(chan client.UsageInfo, 1)
-	eg, ctx := errgroup.WithContext(c.Context)
-	eg.Go(func() error {
-		err = bkClient.Prune(ctx, ch, opts...)
+	if app.lsJSON {
+		dt, err := json.MarshalIndent(infos, "", "  ")
 		if err != nil {
-			return errors.Wrap(err, "buildkit prune")
+			return errors.Wrap(err, "json marshal target infos")
 		}
-		close(ch)
+		fmt.Printf("%s\n", dt)
 		return nil
-	})
-	eg.Go(func() error {
-		for {
-			select {
-			case _, ok := <-ch:
-				if !ok {
-					return nil
-				}
-				// TODO: Print some progress info.
-			case <-ctx.Done():
-				return nil
+	}
+	for _, info := range infos {
+		fmt.Printf("+%s\n", info.Name)
+		if info.Doc != "" {
+			for _, line := range strings.Split(info.Doc, "\n") {
+				fmt.Printf("    # %s\n", line)
 			}
 		}
-	})
-	err = eg.Wait()
-	if err != nil {
-		return errors.Wrap(err, "err group")
+		if len(info.Labels) > 0 {
+			fmt.Printf("    labels: %s\n", strings.Join(info.Labels, ", "))
+		}
+		for _, arg := range info.Args {
+			if arg.Required {
+				fmt.Printf("    ARG %s (required)\n", arg.Name)
+			} else {
+				fmt.Printf("    ARG %s=%s\n", arg.Name, arg.Default)
+			}
+		}
+		for _, artifact := range info.Artifacts {
+			switch {
+			case artifact.Local != "":
+				fmt.Printf("    SAVE ARTIFACT %s AS LOCAL %s\n", artifact.From, artifact.Local)
+			case artifact.Remote != "":
+				fmt.Printf("    SAVE ARTIFACT %s AS REMOTE %s\n", artifact.From, artifact.Remote)
+			default:
+				fmt.Printf("    SAVE ARTIFACT %s %s\n", artifact.From, artifact.To)
+			}
+		}
+		for _, img := range info.Images {
+			pushStr := ""
+			if img.Push {
+				pushStr = "--push "
+			}
+			fmt.Printf("    SAVE IMAGE %s%s\n", pushStr, strings.Join(img.Names, " "))
+		}
 	}
 	return nil
 }
 
-func (app *earthApp) actionBuild(c *cli.Context) error {
-	sockName := fmt.Sprintf("debugger.sock.%d", time.Now().UnixNano())
-
-	if app.imageMode && app.artifactMode {
-		return errors.New("both image and artifact modes cannot be active at the same time")
-	}
-	if (app.imageMode && app.noOutput) || (app.artifactMode && app.noOutput) {
-		return errors.New("cannot use --no-output with image or artifact modes")
+func (app *earthApp) actionLint(c *cli.Context) error {
+	if c.NArg() > 1 {
+		return errors.New("invalid number of arguments provided")
+	}
+	path := "."
+	if c.NArg() == 1 {
+		path = c.Args().First()
+	}
+	issues, err := earthfile2llb.Lint(filepath.Join(path, "Earthfile"))
+	if err != nil {
+		return errors.Wrap(err, "lint")
+	}
+	if app.lintJSON {
+		dt, err := json.MarshalIndent(issues, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "json marshal lint issues")
+		}
+		fmt.Printf("%s\n", dt)
+	} else {
+		for _, issue := range issues {
+			fmt.Printf("%s\n", issue.String())
+		}
+	}
+	if len(issues) > 0 {
+		return fmt.Errorf("%d lint issue(s) found", len(issues))
+	}
+	return nil
+}
+
+func (app *earthApp) actionMigrate(c *cli.Context) error {
+	if c.NArg() > 1 {
+		return errors.New("invalid number of arguments provided")
+	}
+	path := "."
+	if c.NArg() == 1 {
+		path = c.Args().First()
+	}
+	earthfilePath := filepath.Join(path, "Earthfile")
+	dt, err := ioutil.ReadFile(earthfilePath)
+	if err != nil {
+		return errors.Wrapf(err, "read %s", earthfilePath)
+	}
+	result, err := migrate.Migrate(earthfilePath, dt)
+	if err != nil {
+		return errors.Wrap(err, "migrate")
+	}
+	// The changes are reported on stderr, as the migrated Earthfile may be printed.
+	for _, change := range result.Changes {
+		fmt.Fprintf(os.Stderr, "%s:%d: %s\n", earthfilePath, change.Line, change.Message)
+	}
+	for _, change := range result.Manual {
+		fmt.Fprintf(os.Stderr, "%s:%d: warning: %s\n", earthfilePath, change.Line, change.Message)
+	}
+	if !app.migrateWrite {
+		fmt.Printf("%s", result.Earthfile)
+	} else if len(result.Changes) > 0 {
+		fi, err := os.Stat(earthfilePath)
+		if err != nil {
+			return errors.Wrapf(err, "stat %s", earthfilePath)
+		}
+		err = ioutil.WriteFile(earthfilePath, result.Earthfile, fi.Mode().Perm())
+		if err != nil {
+			return errors.Wrapf(err, "write %s", earthfilePath)
+		}
+		app.console.Printf("Migrated %s\n", earthfilePath)
+	}
+	if len(result.Manual) > 0 {
+		return fmt.Errorf("%d statement(s) need to be migrated by hand", len(result.Manual))
+	}
+	return nil
+}
+
+func (app *earthApp) actionAffected(c *cli.Context) error {
+	if c.NArg() < 1 || c.NArg() > 2 {
+		return errors.New("invalid number of arguments provided")
+	}
+	diffRange := c.Args().Get(0)
+	path := "."
+	if c.NArg() == 2 {
+		path = c.Args().Get(1)
+	}
+	if app.affectedBuild && app.affectedJSON {
+		return errors.New("cannot use --json with --build")
+	}
+	if app.affectedBuild && (app.watch || app.verifyReproducible) {
+		return errors.New("affected --build is not supported with --watch or --verify-reproducible")
+	}
+	g, err := earthfile2llb.LoadDepGraph(path)
+	if err != nil {
+		return errors.Wrap(err, "load dependency graph")
+	}
+	changedFiles, err := buildcontext.ChangedFiles(c.Context, path, diffRange)
+	if err != nil {
+		return errors.Wrap(err, "detect changed files")
+	}
+	affected, err := g.Affected(changedFiles)
+	if err != nil {
+		return err
+	}
+	if app.affectedJSON {
+		dt, err := json.MarshalIndent(affected, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "json marshal affected targets")
+		}
+		fmt.Printf("%s\n", dt)
+		return nil
+	}
+	if !app.affectedBuild {
+		for _, ref := range affected {
+			fmt.Printf("%s\n", ref)
+		}
+		return nil
+	}
+	if len(affected) == 0 {
+		app.console.Printf("No target affected by the changes of %s\n", diffRange)
+		return nil
+	}
+	for _, ref := range affected {
+		target, err := domain.ParseTarget(ref)
+		if err != nil {
+			return errors.Wrapf(err, "parse target name %s", ref)
+		}
+		if path != "." && !filepath.IsAbs(target.LocalPath) {
+			target.LocalPath = filepath.Join(path, target.LocalPath)
+			if !filepath.IsAbs(target.LocalPath) && !strings.HasPrefix(target.LocalPath, ".") {
+				target.LocalPath = "./" + target.LocalPath
+			}
+		}
+		app.affectedTargets = append(app.affectedTargets, target)
+	}
+	app.console.Printf("Building %d affected targets\n", len(app.affectedTargets))
+	return app.actionBuild(c)
+}
+
+func (app *earthApp) actionCIGen(c *cli.Context) error {
+	if c.NArg() > 1 {
+		return errors.New("invalid number of arguments provided")
+	}
+	path := "."
+	if c.NArg() == 1 {
+		path = c.Args().First()
+	}
+	infos, err := earthfile2llb.GetTargetInfos(filepath.Join(path, "Earthfile"))
+	if err != nil {
+		return errors.Wrap(err, "get target infos")
+	}
+	opt := app.ciGenOpt
+	opt.Dir = filepath.ToSlash(path)
+	opt.Targets = app.ciGenTargets.Value()
+	dt, err := cigen.Generate(infos, opt)
+	if err != nil {
+		return errors.Wrap(err, "generate the CI pipeline")
+	}
+	if app.ciGenOutput == "" {
+		fmt.Printf("%s", dt)
+		return nil
+	}
+	err = os.MkdirAll(filepath.Dir(app.ciGenOutput), 0755)
+	if err != nil {
+		return errors.Wrapf(err, "mkdir all %s", filepath.Dir(app.ciGenOutput))
+	}
+	err = ioutil.WriteFile(app.ciGenOutput, dt, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "write %s", app.ciGenOutput)
+	}
+	app.console.Printf("CI pipeline as local %s\n", app.ciGenOutput)
+	return nil
+}
+
+func (app *earthApp) actionAttach(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("invalid number of arguments provided")
+	}
+	buildID := c.Args().Get(0)
+	err := terminal.Attach(c.Context, fmt.Sprintf("127.0.0.1:%d", app.buildkitdSettings.DebuggerPort), buildID)
+	if err != nil {
+		return errors.Wrapf(err, "attach to build %s", buildID)
+	}
+	return nil
+}
+
+func (app *earthApp) actionPrewarm(c *cli.Context) error {
+	app.prewarm = true
+	return app.actionBuild(c)
+}
+
+func (app *earthApp) actionBuildDiff(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return errors.New("invalid number of arguments provided")
+	}
+	before, err := builder.ReadBuildRecord(c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	after, err := builder.ReadBuildRecord(c.Args().Get(1))
+	if err != nil {
+		return err
+	}
+	diff := builder.DiffBuilds(before, after)
+	if app.buildDiffJSON {
+		dt, err := json.MarshalIndent(diff, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "json marshal build diff")
+		}
+		fmt.Printf("%s\n", dt)
+		return nil
+	}
+	builder.PrintBuildDiff(app.console, diff)
+	return nil
+}
+
+func (app *earthApp) actionDu(c *cli.Context) error {
+	if c.NArg() != 0 {
+		return errors.New("invalid arguments")
+	}
+	cleanCollection := cleanup.NewCollection()
+	defer cleanCollection.Close()
+	bkClient, err := app.newBuildkitdClient(c.Context, cleanCollection)
+	if err != nil {
+		return errors.Wrap(err, "buildkitd new client")
+	}
+	defer bkClient.Close()
+	usage, err := builder.CacheUsageOf(c.Context, bkClient, app.duByProject)
+	if err != nil {
+		return err
+	}
+	if app.duJSON {
+		dt, err := json.MarshalIndent(usage, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "json marshal cache usage")
+		}
+		fmt.Printf("%s\n", dt)
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "NAME\tRECORDS\tSIZE (MB)\tRECLAIMABLE (MB)\tLAST USED\n")
+	var total, reclaimable int64
+	for _, cu := range usage {
+		fmt.Fprintf(w, "%s\t%d\t%.1f\t%.1f\t%s\n",
+			cu.Name, cu.Records, float64(cu.Size)/1e6, float64(cu.Reclaimable)/1e6,
+			cu.LastUsedAt.Local().Format("2006-01-02 15:04"))
+		total += cu.Size
+		reclaimable += cu.Reclaimable
+	}
+	fmt.Fprintf(w, "TOTAL\t\t%.1f\t%.1f\t\n", float64(total)/1e6, float64(reclaimable)/1e6)
+	return w.Flush()
+}
+
+func (app *earthApp) actionPrune(c *cli.Context) error {
+	if c.NArg() != 0 {
+		return errors.New("invalid arguments")
+	}
+	if app.pruneReset {
+		// Prune by resetting container.
+		if app.buildkitHost != "" {
+			return errors.New("Cannot use prune --reset on non-default buildkit-host setting")
+		}
+		// Use twice the restart timeout for reset operations
+		// (needs extra time to also remove the files).
+		opTimeout := 2 * time.Duration(app.cfg.Global.BuildkitRestartTimeoutS) * time.Second
+		err := buildkitd.ResetCache(
+			c.Context, app.console, app.buildkitdImage, app.buildkitdSettings,
+			opTimeout)
+		if err != nil {
+			return errors.Wrap(err, "reset cache")
+		}
+		return nil
+	}
+
+	// Prune via API.
+	cleanCollection := cleanup.NewCollection()
+	defer cleanCollection.Close()
+	bkClient, err := app.newBuildkitdClient(c.Context, cleanCollection)
+	if err != nil {
+		return errors.Wrap(err, "buildkitd new client")
+	}
+	defer bkClient.Close()
+	if app.pruneKeepLast < 0 {
+		return errors.New("invalid --keep-last")
+	}
+	result, err := builder.Prune(c.Context, bkClient, builder.PruneOpt{
+		All:          app.pruneAll,
+		TargetPrefix: app.pruneTarget,
+		OlderThan:    app.pruneOlderThan,
+		KeepLast:     app.pruneKeepLast,
+	})
+	if err != nil {
+		return err
+	}
+	app.console.Printf("Pruned %d cache records, freeing %.1f MB\n", result.Records, float64(result.Size)/1e6)
+	return nil
+}
+
+func (app *earthApp) actionBuild(c *cli.Context) error {
+	sockName := fmt.Sprintf("debugger.sock.%d", time.Now().UnixNano())
+
+	if app.imageMode && app.artifactMode {
+		return errors.New("both image and artifact modes cannot be active at the same time")
+	}
+	if (app.imageMode && app.noOutput) || (app.artifactMode && app.noOutput) {
+		return errors.New("cannot use --no-output with image or artifact modes")
 	}
 	if app.push && app.noOutput {
 		return errors.New("cannot use --no-output with --push")
 	}
+	if app.pushRetries < 0 {
+		return errors.New("--push-retries may not be negative")
+	}
+	if app.sbomFormat != "" {
+		err := builder.ValidateSBOMFormat(app.sbomFormat)
+		if err != nil {
+			return err
+		}
+	}
+	if app.rekor && app.sbomFormat == "" && !app.provenance {
+		return errors.New("--rekor requires --sbom or --provenance")
+	}
 	var target domain.Target
+	// Several targets are built one after the other, for prewarm and affected --build.
+	var targets []domain.Target
 	var artifact domain.Artifact
 	destPath := "./"
-	if app.imageMode {
+	if app.affectedTargets != nil {
+		if app.imageMode || app.artifactMode {
+			return errors.New("affected is not supported with --image or --artifact")
+		}
+		targets = app.affectedTargets
+		target = targets[0]
+	} else if app.prewarm {
+		if app.imageMode || app.artifactMode {
+			return errors.New("prewarm is not supported with --image or --artifact")
+		}
+		if c.NArg() == 0 {
+			return fmt.Errorf(
+				"no target reference provided. Try %s prewarm +<target-name>", c.App.Name)
+		}
+		for _, targetName := range c.Args().Slice() {
+			t, err := domain.ParseTarget(targetName)
+			if err != nil {
+				return errors.Wrapf(err, "parse target name %s", targetName)
+			}
+			targets = append(targets, t)
+		}
+		target = targets[0]
+	} else if app.imageMode {
 		if c.NArg() == 0 {
 			cli.ShowAppHelp(c)
 			return fmt.Errorf(
@@ -919,13 +1955,167 @@ func (app *earthApp) actionBuild(c *cli.Context) error {
 			return errors.Wrapf(err, "parse target name %s", targetName)
 		}
 	}
-	bkClient, err := app.newBuildkitdClient(c.Context)
+	if target.IsPattern() && (app.imageMode || app.artifactMode) {
+		return errors.New("target patterns are not supported with --image or --artifact")
+	}
+	if len(app.buildArgMatrix.Value()) > 0 && (app.imageMode || app.artifactMode) {
+		return errors.New("--build-arg-matrix is not supported with --image or --artifact")
+	}
+	if app.plan && (app.imageMode || app.artifactMode) {
+		return errors.New("--plan is not supported with --image or --artifact")
+	}
+	if len(app.policies.Value()) > 0 && (app.imageMode || app.artifactMode) {
+		return errors.New("--policy is not supported with --image or --artifact")
+	}
+	if app.checkBaseImages {
+		if app.imageMode || app.artifactMode {
+			return errors.New("--check-base-images is not supported with --image or --artifact")
+		}
+		if app.plan || app.exportLLB != "" {
+			return errors.New("cannot use --check-base-images with --plan or --export-llb")
+		}
+	}
+	var llbFormat builder.LLBFormat
+	if app.exportLLB != "" {
+		if app.plan {
+			return errors.New("cannot use --export-llb with --plan")
+		}
+		var err error
+		llbFormat, err = builder.ParseLLBFormat(app.exportLLBFormat)
+		if err != nil {
+			return err
+		}
+		if app.exportLLB == "-" {
+			// Keep stdout for the definition.
+			app.console = app.console.WithWriter(os.Stderr)
+		}
+	}
+	if app.prewarm && (app.plan || app.checkBaseImages || app.exportLLB != "" || app.watch) {
+		return errors.New("prewarm is not supported with --plan, --check-base-images, --export-llb or --watch")
+	}
+	if app.recordBuild != "" && (app.prewarm || app.checkBaseImages || app.exportLLB != "") {
+		return errors.New("--record-build is not supported with prewarm, --check-base-images or --export-llb")
+	}
+	// Nothing is built when planning, checking the base images, pre-warming the cache or
+	// exporting the LLB.
+	dryRun := app.plan || app.checkBaseImages || app.prewarm || app.exportLLB != ""
+	if app.verifyReproducible {
+		if app.push {
+			return errors.New("cannot use --verify-reproducible with --push")
+		}
+		if app.artifactMode {
+			return errors.New("--verify-reproducible is not supported with --artifact")
+		}
+		if dryRun || app.watch {
+			return errors.New("cannot use --verify-reproducible with --plan, --check-base-images, --export-llb or --watch")
+		}
+		app.reproducible = true
+	}
+	var buildTimestamp time.Time
+	if app.reproducible {
+		var err error
+		buildTimestamp, err = sourceDateEpoch()
+		if err != nil {
+			return err
+		}
+	}
+	if app.watch {
+		if app.imageMode || app.artifactMode {
+			return errors.New("--watch is not supported with --image or --artifact")
+		}
+		if dryRun {
+			return errors.New("cannot use --watch with --plan, --check-base-images or --export-llb")
+		}
+		if app.tui {
+			return errors.New("cannot use --watch with --tui")
+		}
+	}
+	var view *tui.TUI
+	if app.tui && !dryRun {
+		if app.interactiveDebugging {
+			return errors.New("cannot use --tui with --interactive")
+		}
+		if app.console.JSONOutput() {
+			return errors.New("cannot use --tui with --log-format json")
+		}
+		if tui.IsSupported(os.Stdout) {
+			view = tui.New(fmt.Sprintf("earth %s", target.StringCanonical()), os.Stdout, os.Stdin)
+			defer view.Stop()
+			app.console = app.console.WithWriter(view.ConsoleWriter()).WithEventSink(view)
+		} else {
+			app.console.Warnf("Warning: --tui requires a terminal. Using the regular output instead\n")
+		}
+	}
+	if app.eventStreamAddr != "" {
+		eventServer := eventstream.New()
+		err := eventServer.Start(app.eventStreamAddr)
+		if err != nil {
+			return errors.Wrap(err, "start event stream")
+		}
+		defer eventServer.Close()
+		app.console = app.console.WithEventSink(eventServer)
+		app.console.Printf("Streaming build events on http://%s/events\n", eventServer.Addr())
+	}
+	if app.metricsAddr != "" {
+		metricsServer := metrics.New()
+		err := metricsServer.Start(app.metricsAddr)
+		if err != nil {
+			return errors.Wrap(err, "start metrics server")
+		}
+		defer metricsServer.Close()
+		app.console = app.console.WithEventSink(metricsServer)
+		app.console.Printf("Serving metrics on http://%s/metrics\n", metricsServer.Addr())
+	}
+	if app.targetLogDir != "" {
+		targetLogs, err := conslogging.NewTargetLogs(app.targetLogDir)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err := targetLogs.Close()
+			if err != nil {
+				app.console.Warnf("Warning: failed to write target logs: %v\n", err)
+			}
+		}()
+		app.console = app.console.WithEventSink(targetLogs)
+	}
+	convertCtx := c.Context
+	if app.otlpEndpoint != "" {
+		tracer, err := tracing.New(app.otlpEndpoint, "earth", fmt.Sprintf("earth %s", target.StringCanonical()))
+		if err != nil {
+			return errors.Wrap(err, "new tracer")
+		}
+		defer func() {
+			err := tracer.Close()
+			if err != nil {
+				app.console.Warnf("Warning: failed to export trace: %v\n", err)
+				return
+			}
+			app.console.Printf("Exported trace %s\n", tracer.TraceID())
+		}()
+		app.console = app.console.WithEventSink(tracer)
+		convertCtx = tracing.WithSpan(convertCtx, tracer.Root())
+	}
+	if app.interactiveDebugging && app.kubernetes {
+		// The debugger port of the pod is not reachable.
+		return errors.New("--interactive is not supported together with --kubernetes")
+	}
+	cleanCollection := cleanup.NewCollection()
+	defer cleanCollection.Close()
+	bkClient, err := app.newBuildkitdClient(c.Context, cleanCollection)
 	if err != nil {
 		return errors.Wrap(err, "buildkitd new client")
 	}
 	defer bkClient.Close()
-	resolver := buildcontext.NewResolver(bkClient, app.console, app.sessionID)
-	defer resolver.Close()
+	buildPlatforms := []specs.Platform{llbutil.TargetPlatform}
+	err = app.ensurePlatforms(c.Context, bkClient, buildPlatforms)
+	if err != nil {
+		return err
+	}
+	earthfileCacheDir, err := buildcontext.DefaultEarthfileCacheDir()
+	if err != nil {
+		return err
+	}
 	secrets := app.secrets.Value()
 	//interactive debugger settings are passed as secrets to avoid having it affect the cache hash
 
@@ -946,6 +2136,19 @@ func (app *earthApp) actionBuild(c *cli.Context) error {
 		Enabled:           app.interactiveDebugging,
 		SockPath:          fmt.Sprintf("/run/earthly/%s", sockName),
 		Term:              os.Getenv("TERM"),
+		MaxParallelism:    app.maxParallelism,
+		SerializedTargets: app.serializeTargets.Value(),
+	}
+	if app.attachable {
+		buildIDBytes := make([]byte, 6)
+		_, err := rand.Read(buildIDBytes)
+		if err != nil {
+			return errors.Wrap(err, "generate build ID")
+		}
+		debuggerSettings.BuildID = hex.EncodeToString(buildIDBytes)
+		app.console.Printf(
+			"Build ID: %s. Use earth attach %s to open a shell into the currently executing step\n",
+			debuggerSettings.BuildID, debuggerSettings.BuildID)
 	}
 
 	debuggerSettingsData, err := json.Marshal(&debuggerSettings)
@@ -954,17 +2157,56 @@ func (app *earthApp) actionBuild(c *cli.Context) error {
 	}
 	secretsMap[debuggercommon.DebuggerSettingsSecretsKey] = debuggerSettingsData
 
-	attachables := []session.Attachable{
-		secretsprovider.FromMap(secretsMap),
-		authprovider.NewDockerAuthProvider(os.Stderr),
+	signOpt := builder.SignOpt{
+		Enabled: app.sign,
 	}
-
-	if app.sshAuthSock != "" {
-		ssh, err := sshprovider.NewSSHAgentProvider([]sshprovider.AgentConfig{{
-			Paths: []string{app.sshAuthSock},
-		}})
-		if err != nil {
-			return errors.Wrap(err, "ssh agent provider")
+	if (app.sign || app.rekor) && app.signKeySecret != "" {
+		key, found := secretsMap[app.signKeySecret]
+		if !found {
+			return fmt.Errorf("signing key secret %s not set. Use --secret to set it", app.signKeySecret)
+		}
+		signOpt.Key = key
+		if app.signKeyPasswordSecret != "" {
+			password, found := secretsMap[app.signKeyPasswordSecret]
+			if !found {
+				return fmt.Errorf("signing key password secret %s not set. Use --secret to set it", app.signKeyPasswordSecret)
+			}
+			signOpt.KeyPassword = password
+		}
+		err = signOpt.Validate()
+		if err != nil {
+			return errors.Wrapf(err, "signing key secret %s", app.signKeySecret)
+		}
+	}
+	scanOpt, err := app.scanOpt()
+	if err != nil {
+		return err
+	}
+
+	secretsProvider := secretsprovider.FromMap(secretsMap)
+	attachables := []session.Attachable{
+		secretsProvider,
+		authprovider.NewDockerAuthProvider(os.Stderr),
+	}
+	gitAuth := buildcontext.GitAuth{
+		TokenSites:  config.TokenAuthSites(app.cfg),
+		Attachables: []session.Attachable{secretsProvider},
+	}
+	trustPolicy, err := earthfileTrustPolicy(app.cfg)
+	if err != nil {
+		return err
+	}
+	resolver := buildcontext.NewResolver(bkClient, app.console, app.sessionID, earthfileCacheDir, gitAuth, trustPolicy)
+	defer resolver.Close()
+
+	sshConfigs, err := sshAgentConfigs(app.sshAuthSock, app.sshAgents.Value())
+	if err != nil {
+		return err
+	}
+	if len(sshConfigs) > 0 {
+		ssh, err := sshprovider.NewSSHAgentProvider(sshConfigs)
+		if err != nil {
+			return errors.Wrap(err, "ssh agent provider")
 		}
 		attachables = append(attachables, ssh)
 	}
@@ -973,66 +2215,655 @@ func (app *earthApp) actionBuild(c *cli.Context) error {
 	if app.allowPrivileged {
 		enttlmnts = append(enttlmnts, entitlements.EntitlementSecurityInsecure)
 	}
-	b, err := builder.NewBuilder(
-		c.Context, bkClient, app.console, attachables, enttlmnts, app.noCache, app.remoteCache)
+	capPolicy := capabilityPolicy(app.allowPrivileged)
+	securityPolicy := earthfile2llb.SecurityPolicy{
+		Privileged: app.cfg.Global.SecurityPolicy.PrivilegedTargets,
+		HostBind:   app.cfg.Global.SecurityPolicy.HostBindTargets,
+		Locally:    app.cfg.Global.SecurityPolicy.LocallyTargets,
+	}
+	err = securityPolicy.Validate()
+	if err != nil {
+		return errors.Wrap(err, "invalid security_policy in the config")
+	}
+	caCerts, err := readCACerts(app.caCerts.Value())
 	if err != nil {
-		return errors.Wrap(err, "new builder")
+		return err
+	}
+	defaultResources, err := earthfile2llb.ParseResources(app.defaultCPUs, app.defaultMemory)
+	if err != nil {
+		return errors.Wrap(err, "invalid --default-cpus or --default-memory")
+	}
+	var workerClients []*client.Client
+	for _, workerHost := range app.buildkitWorkers.Value() {
+		workerClient, err := client.New(c.Context, workerHost)
+		if err != nil {
+			return errors.Wrapf(err, "buildkitd new client (worker %s)", workerHost)
+		}
+		defer workerClient.Close()
+		err = buildkitd.CheckPlatforms(c.Context, workerClient, workerHost, buildPlatforms)
+		if err != nil {
+			return err
+		}
+		workerClients = append(workerClients, workerClient)
 	}
 
 	if app.interactiveDebugging {
 		go terminal.ConnectTerm(c.Context, fmt.Sprintf("127.0.0.1:%d", app.buildkitdSettings.DebuggerPort))
 	}
 
-	varCollection, err := variables.ParseCommandLineBuildArgs(app.buildArgs.Value(), dotEnvMap)
-	if err != nil {
-		return errors.Wrap(err, "parse build args")
-	}
 	imageResolveMode := llb.ResolveModePreferLocal
 	if app.pull {
 		imageResolveMode = llb.ResolveModeForcePull
 	}
-	cleanCollection := cleanup.NewCollection()
-	defer cleanCollection.Close()
+	if app.interactiveDebugging {
+		for _, portSpec := range app.forwardPorts.Value() {
+			spec, err := portforward.ParseSpec(portSpec)
+			if err != nil {
+				return err
+			}
+			l, err := portforward.Forward(
+				c.Context, fmt.Sprintf("127.0.0.1:%d", app.buildkitdSettings.DebuggerPort), spec)
+			if err != nil {
+				return errors.Wrap(err, "forward port")
+			}
+			cleanCollection.Add(l.Close)
+		}
+	} else if len(app.forwardPorts.Value()) > 0 {
+		return errors.New("--forward-port requires --interactive")
+	}
+
+	bp := buildParams{
+		target:              target,
+		artifact:            artifact,
+		destPath:            destPath,
+		dryRun:              dryRun,
+		llbFormat:           llbFormat,
+		view:                view,
+		convertCtx:          convertCtx,
+		bkClient:            bkClient,
+		workerClients:       workerClients,
+		cleanCollection:     cleanCollection,
+		resolver:            resolver,
+		attachables:         attachables,
+		enttlmnts:           enttlmnts,
+		signOpt:             signOpt,
+		scanOpt:             scanOpt,
+		capPolicy:           capPolicy,
+		securityPolicy:      securityPolicy,
+		caCerts:             caCerts,
+		defaultResources:    defaultResources,
+		dotEnvMap:           dotEnvMap,
+		imageResolveMode:    imageResolveMode,
+		solveCache:          earthfile2llb.NewSolveCache(),
+		buildTimestamp:      buildTimestamp,
+		insecureRegistryFun: app.insecureRegistryFun(bkClient),
+	}
+	if app.watch {
+		return app.watchBuild(c, bp)
+	}
+	if app.verifyReproducible {
+		return app.verifyReproducibleBuild(c, bp)
+	}
+	if targets != nil {
+		for _, t := range targets {
+			bp.target = t
+			_, err = app.runBuild(c, bp)
+			if err != nil {
+				if app.prewarm {
+					return errors.Wrapf(err, "prewarm %s", t.String())
+				}
+				return errors.Wrapf(err, "build %s", t.String())
+			}
+		}
+		return nil
+	}
+	_, err = app.runBuild(c, bp)
+	return err
+}
+
+// buildParams are the settings of a build, which are shared by the builds of a
+// watch session.
+type buildParams struct {
+	target           domain.Target
+	artifact         domain.Artifact
+	destPath         string
+	dryRun           bool
+	llbFormat        builder.LLBFormat
+	view             *tui.TUI
+	convertCtx       context.Context
+	bkClient         *client.Client
+	workerClients    []*client.Client
+	cleanCollection  *cleanup.Collection
+	resolver         *buildcontext.Resolver
+	attachables      []session.Attachable
+	enttlmnts        []entitlements.Entitlement
+	signOpt          builder.SignOpt
+	scanOpt          builder.ScanOpt
+	capPolicy        earthfile2llb.CapabilityPolicy
+	securityPolicy   earthfile2llb.SecurityPolicy
+	caCerts          []byte
+	defaultResources earthfile2llb.Resources
+	dotEnvMap        map[string]string
+	imageResolveMode llb.ResolveMode
+	solveCache       *earthfile2llb.SolveCache
+	// buildTimestamp is the fixed timestamp of reproducible builds. The time of the
+	// build is used if zero.
+	buildTimestamp time.Time
+	// imageIDs receives the IDs of the images output by reproducible builds, if set.
+	imageIDs map[string]string
+	// insecureRegistryFun allows the insecure registries of FROM --insecure.
+	insecureRegistryFun earthfile2llb.InsecureRegistryFun
+}
+
+// runBuild converts and builds the target. It returns the converted target states,
+// if the conversion succeeded.
+func (app *earthApp) runBuild(c *cli.Context, bp buildParams) (*earthfile2llb.MultiTargetStates, error) {
+	buildCtx := c.Context
+	convertCtx := bp.convertCtx
+	if app.timeout > 0 {
+		deadline := time.Now().Add(app.timeout)
+		var cancelBuild, cancelConvert context.CancelFunc
+		buildCtx, cancelBuild = context.WithDeadline(buildCtx, deadline)
+		defer cancelBuild()
+		convertCtx, cancelConvert = context.WithDeadline(convertCtx, deadline)
+		defer cancelConvert()
+	}
+	b, err := builder.NewBuilder(
+		c.Context, bp.bkClient, app.console, bp.attachables, bp.enttlmnts, app.noCache, app.remoteCache)
+	if err != nil {
+		return nil, errors.Wrap(err, "new builder")
+	}
+	if app.reproducible {
+		b.SetReproducible(bp.buildTimestamp)
+	}
+	for i, workerClient := range bp.workerClients {
+		err = b.AddWorker(c.Context, workerClient)
+		if err != nil {
+			return nil, errors.Wrapf(err, "add worker %s", app.buildkitWorkers.Value()[i])
+		}
+	}
+	varCollection, err := variables.ParseCommandLineBuildArgs(app.buildArgs.Value(), bp.dotEnvMap)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse build args")
+	}
+	var buildArgMatrix []*variables.Collection
+	if len(app.buildArgMatrix.Value()) > 0 {
+		buildArgMatrix, err = variables.ParseCommandLineBuildArgMatrix(
+			app.buildArgMatrix.Value(), app.buildArgs.Value(), bp.dotEnvMap)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse build arg matrix")
+		}
+	}
+	var registryBuilderFun earthfile2llb.RegistryBuilderFun
+	if app.buildkitdSettings.EmbeddedRegistry && !bp.dryRun {
+		registryBuilderFun = b.MakeImageToRegistryBuilderFun(buildkitd.EmbeddedRegistryAddr)
+	}
+	dockerBuilderFun := b.MakeDockerLoadBuilderFun()
+	artifactBuilderFun := b.MakeArtifactBuilderFun()
+	if bp.dryRun {
+		dockerBuilderFun = builder.MakePlanDockerLoadBuilderFun()
+		artifactBuilderFun = builder.MakePlanArtifactBuilderFun()
+	}
 	mts, err := earthfile2llb.Earthfile2LLB(
-		c.Context, target, earthfile2llb.ConvertOpt{
-			Resolver:           resolver,
-			ImageResolveMode:   imageResolveMode,
-			DockerBuilderFun:   b.MakeImageAsTarBuilderFun(),
-			ArtifactBuilderFun: b.MakeArtifactBuilderFun(),
-			CleanCollection:    cleanCollection,
+		convertCtx, bp.target, earthfile2llb.ConvertOpt{
+			Resolver:           bp.resolver,
+			ImageResolveMode:   bp.imageResolveMode,
+			DockerBuilderFun:   dockerBuilderFun,
+			ArtifactBuilderFun: artifactBuilderFun,
+			RegistryBuilderFun: registryBuilderFun,
+			LocalRunner:        localrun.NewRunner(runtime.GOOS),
+			CleanCollection:    bp.cleanCollection,
 			VarCollection:      varCollection,
+			BuildArgMatrix:     buildArgMatrix,
+			SolveCache:         bp.solveCache,
+			CapabilityPolicy:   bp.capPolicy,
+			SecurityPolicy:     bp.securityPolicy,
+			CACerts:            bp.caCerts,
+			Rootless:           app.buildkitdSettings.Rootless,
+			DefaultResources:   bp.defaultResources,
+			LabelFilter: earthfile2llb.LabelFilter{
+				Include: app.labels.Value(),
+				Exclude: app.excludeLabels.Value(),
+			},
+			AutoCacheMounts:      app.autoCacheMounts,
+			OCILabels:            app.ociLabels,
+			InteractiveDebugging: app.interactiveDebugging,
+			BuildTimestamp:       bp.buildTimestamp,
+			InsecureRegistryFun:  bp.insecureRegistryFun,
+			Timeouts: earthfile2llb.Timeouts{
+				ImageResolve: app.imageResolveTimeout,
+				GitResolve:   app.gitResolveTimeout,
+			},
 		})
 	if err != nil {
-		return err
+		if convertCtx.Err() == context.DeadlineExceeded {
+			return nil, errors.Wrapf(err, "timed out after %s, while interpreting the Earthfiles", app.timeout)
+		}
+		return nil, err
+	}
+	if app.buildkitdSettings.Rootless {
+		err = earthfile2llb.CheckRootless(mts)
+		if err != nil {
+			return mts, err
+		}
+	}
+	err = app.ensureTargetPlatforms(c.Context, bp, mts)
+	if err != nil {
+		return mts, err
+	}
+	if app.exportLLB != "" {
+		return mts, app.writeLLB(c.Context, mts, bp.llbFormat)
+	}
+	if app.prewarm {
+		return mts, b.Prewarm(buildCtx, mts)
+	}
+	if app.checkBaseImages {
+		report := builder.CheckBaseImages(c.Context, mts, imr.NewRegistry())
+		b.PrintFreshness(report)
+		if report.NumOutdated() > 0 {
+			return mts, fmt.Errorf("%d base images are outdated", report.NumOutdated())
+		}
+		return mts, nil
+	}
+	if app.recordBuild != "" {
+		record, err := builder.RecordBuild(c.Context, mts)
+		if err != nil {
+			return mts, errors.Wrap(err, "record build")
+		}
+		err = builder.WriteBuildRecord(record, app.recordBuild)
+		if err != nil {
+			return mts, err
+		}
+	}
+	historyPath, err := cacheHistoryPath()
+	if err != nil {
+		return mts, err
+	}
+	if app.plan || len(app.policies.Value()) > 0 {
+		plan, err := b.Plan(c.Context, mts, historyPath, builder.BuildOpt{
+			Push:     app.push,
+			NoOutput: app.noOutput,
+		})
+		if err != nil {
+			return mts, errors.Wrap(err, "plan")
+		}
+		if app.plan {
+			b.PrintPlan(plan)
+		}
+		if len(app.policies.Value()) > 0 {
+			input := &builder.PolicyInput{
+				Plan: plan,
+				Push: app.push,
+				Git:  policyGit(c.Context, bp.target),
+			}
+			err = b.CheckPolicy(c.Context, builder.NewRegoPolicy(app.policies.Value()), input)
+			if err != nil {
+				return mts, err
+			}
+		}
+		if app.plan {
+			return mts, nil
+		}
+	}
+	if bp.view != nil {
+		bp.view.SetTargets(mts.FinalStates)
+		err = bp.view.Start()
+		if err != nil {
+			return mts, err
+		}
+	}
+
+	checkpointPath, err := buildCheckpointPath(bp.target)
+	if err != nil {
+		return mts, err
+	}
+	checkpoint, err := builder.LoadCheckpoint(checkpointPath)
+	if err != nil {
+		app.console.Warnf("Warning: could not read the checkpoint of the previous build: %v\n", err)
+	} else if checkpoint != nil {
+		app.console.Printf(
+			"Resuming the build interrupted at %s (%d of %d targets completed)\n",
+			checkpoint.InterruptedAt.Format(time.RFC3339), checkpoint.NumCompleted(), len(checkpoint.Targets))
 	}
 
 	opts := builder.BuildOpt{
-		PrintSuccess: true,
-		Push:         app.push,
-		NoOutput:     app.noOutput,
+		PrintSuccess:            true,
+		Push:                    app.push,
+		NoOutput:                app.noOutput,
+		SBOMFormat:              app.sbomFormat,
+		SBOMDir:                 app.sbomDir,
+		Provenance:              app.provenance,
+		ProvenanceDir:           app.provenanceDir,
+		Sign:                    bp.signOpt,
+		Rekor:                   builder.RekorOpt{Enabled: app.rekor, URL: app.rekorURL},
+		OCIArchiveDir:           app.ociArchiveDir,
+		FaithfulArtifacts:       app.faithfulArtifacts,
+		RejectDanglingSymlinks:  app.rejectDanglingLinks,
+		ChecksumsDir:            app.checksumsDir,
+		SummaryPath:             app.summaryPath,
+		SizeReport:              app.sizeReport || app.sizeBaseline != "",
+		SizeBaselinePath:        app.sizeBaseline,
+		SizeRegressionThreshold: app.sizeThreshold,
+		Interrupt:               app.gracefulStop.ch,
+		CheckpointPath:          checkpointPath,
+		TargetTimeout:           app.targetTimeout,
+		PushRetry: builder.PushRetryOpt{
+			Retries: app.pushRetries,
+			Backoff: app.pushRetryBackoff,
+		},
+		Scan: bp.scanOpt,
 	}
 	if app.imageMode {
-		err = b.BuildOnlyImages(c.Context, mts, opts)
+		err = b.BuildOnlyImages(buildCtx, mts, opts)
+	} else if app.artifactMode {
+		err = b.BuildOnlyArtifact(buildCtx, mts, bp.artifact, bp.destPath, opts)
+	} else {
+		app.gracefulStop.enable()
+		err = b.Build(buildCtx, mts, opts)
+		app.gracefulStop.disable()
+		if err == nil && checkpoint != nil {
+			rmErr := os.Remove(checkpointPath)
+			if rmErr != nil && !os.IsNotExist(rmErr) {
+				app.console.Warnf("Warning: could not remove the checkpoint %s: %v\n", checkpointPath, rmErr)
+			}
+		}
+	}
+	if bp.imageIDs != nil {
+		for tag, id := range b.ImageIDs() {
+			bp.imageIDs[tag] = id
+		}
+	}
+	if app.criticalPath {
+		b.PrintCriticalPath()
+	}
+	if err == nil {
+		sizeErr := b.ReportSizes(opts)
+		if sizeErr != nil {
+			app.console.Warnf("Warning: could not report the output sizes: %v\n", sizeErr)
+		}
+	}
+	summaryErr := b.WriteSummary(opts, bp.target, err)
+	if summaryErr != nil {
+		app.console.Warnf("Warning: could not write the build summary: %v\n", summaryErr)
+	}
+	historyErr := b.SaveCacheHistory(historyPath)
+	if historyErr != nil {
+		app.console.Warnf("Warning: could not save the cache history: %v\n", historyErr)
+	}
+	if err == nil && app.cfg.Global.CacheKeepLast > 0 {
+		// Only the local buildkitd is pruned, not the other workers.
+		_, pruneErr := builder.Prune(c.Context, bp.bkClient, builder.PruneOpt{KeepLast: app.cfg.Global.CacheKeepLast})
+		if pruneErr != nil {
+			app.console.Warnf("Warning: could not prune the cache: %v\n", pruneErr)
+		}
+	}
+	return mts, err
+}
+
+// verifyReproducibleBuild builds the target, then builds it again without the cache,
+// and returns an error if the images output by the two builds differ.
+func (app *earthApp) verifyReproducibleBuild(c *cli.Context, bp buildParams) error {
+	first := make(map[string]string)
+	bp.imageIDs = first
+	_, err := app.runBuild(c, bp)
+	if err != nil {
+		return err
+	}
+	if len(first) == 0 {
+		return errors.New("--verify-reproducible requires a target which saves images")
+	}
+	app.console.Printf("Building again without the cache, to verify that the images are reproducible...\n")
+	second := make(map[string]string)
+	bp.imageIDs = second
+	bp.solveCache = earthfile2llb.NewSolveCache()
+	noCache := app.noCache
+	app.noCache = true
+	_, err = app.runBuild(c, bp)
+	app.noCache = noCache
+	if err != nil {
+		return err
+	}
+	diffs := builder.CompareImageIDs(first, second)
+	if len(diffs) > 0 {
+		return fmt.Errorf("the images are not reproducible:\n  %s", strings.Join(diffs, "\n  "))
+	}
+	tags := make([]string, 0, len(first))
+	for tag := range first {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		app.console.Printf("Image %s is reproducible: %s\n", tag, first[tag])
+	}
+	return nil
+}
+
+// sourceDateEpoch returns the timestamp of reproducible builds: the time set via the
+// env var SOURCE_DATE_EPOCH (in seconds since the Unix epoch), or the Unix epoch.
+func sourceDateEpoch() (time.Time, error) {
+	epochStr := os.Getenv("SOURCE_DATE_EPOCH")
+	if epochStr == "" {
+		return time.Unix(0, 0).UTC(), nil
+	}
+	epoch, err := strconv.ParseInt(epochStr, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "invalid SOURCE_DATE_EPOCH %s", epochStr)
+	}
+	return time.Unix(epoch, 0).UTC(), nil
+}
+
+// watchInterval is how often the build contexts are checked for changes, in watch mode.
+const watchInterval = 500 * time.Millisecond
+
+// watchBuild builds the target, then builds it again whenever the files of its local
+// build contexts change, until interrupted. The images built for WITH DOCKER --load
+// are kept across builds, unless built from files which changed, and buildkit only
+// transfers the files of the build contexts which changed.
+func (app *earthApp) watchBuild(c *cli.Context, bp buildParams) error {
+	for {
+		mts, err := app.runBuild(c, bp)
+		if err == builder.ErrInterrupted || c.Context.Err() != nil {
+			return err
+		}
+		if err != nil {
+			// Keep watching, for the fix.
+			app.console.Warnf("Error: %v\n", err)
+		}
+		dirs, ignored := app.watchPaths(bp.target, mts)
+		if len(dirs) == 0 {
+			return errors.New("--watch requires a local target, or a target depending on local targets")
+		}
+		watcher, err := buildcontext.NewWatcher(dirs, ignored, watchInterval)
 		if err != nil {
 			return err
 		}
-	} else if app.artifactMode {
-		err = b.BuildOnlyArtifact(c.Context, mts, artifact, destPath, opts)
+		app.console.Printf("Watching %s for changes...\n", strings.Join(dirs, ", "))
+		changed, err := watcher.Wait(c.Context)
+		if err != nil {
+			if c.Context.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		bp.solveCache.Invalidate(changed)
+		app.console.Printf("%d files changed. Building again...\n", len(changed))
+	}
+}
+
+// watchPaths returns the build context dirs to watch for the target, and the paths to
+// ignore within them, which are written by the build itself.
+func (app *earthApp) watchPaths(target domain.Target, mts *earthfile2llb.MultiTargetStates) ([]string, []string) {
+	var dirs []string
+	seen := make(map[string]bool)
+	addDir := func(t domain.Target) {
+		if t.IsRemote() {
+			return
+		}
+		dir := t.LocalPath
+		if t.IsPattern() {
+			dir = t.PatternDir()
+		}
+		if seen[dir] {
+			return
+		}
+		seen[dir] = true
+		dirs = append(dirs, dir)
+	}
+	// Watched even if the conversion failed, for fixes of the Earthfile.
+	addDir(target)
+	var ignored []string
+	for _, p := range []string{
+		app.sbomDir, app.provenanceDir, app.ociArchiveDir, app.checksumsDir,
+		app.summaryPath, app.targetLogDir} {
+		if p != "" {
+			ignored = append(ignored, p)
+		}
+	}
+	if mts == nil {
+		return dirs, ignored
+	}
+	for _, sts := range mts.AllStates() {
+		addDir(sts.Target)
+		for _, saveLocal := range sts.SaveLocals {
+			dest := saveLocal.DestPath
+			if sts.Target.IsLocalExternal() && !filepath.IsAbs(dest) {
+				dest = filepath.Join(sts.Target.LocalPath, dest)
+			}
+			ignored = append(ignored, dest)
+		}
+	}
+	return dirs, ignored
+}
+
+// writeLLB writes the LLB definition of the final target to app.exportLLB.
+func (app *earthApp) writeLLB(ctx context.Context, mts *earthfile2llb.MultiTargetStates, format builder.LLBFormat) error {
+	if app.exportLLB == "-" {
+		err := builder.ExportLLB(ctx, mts.FinalStates, format, os.Stdout)
 		if err != nil {
 			return err
 		}
 	} else {
-		err = b.Build(c.Context, mts, opts)
+		f, err := os.Create(app.exportLLB)
 		if err != nil {
+			return errors.Wrapf(err, "create %s", app.exportLLB)
+		}
+		err = builder.ExportLLB(ctx, mts.FinalStates, format, f)
+		if err != nil {
+			f.Close()
 			return err
 		}
+		err = f.Close()
+		if err != nil {
+			return errors.Wrapf(err, "close %s", app.exportLLB)
+		}
+		app.console.Printf("LLB of %s as local %s\n", mts.FinalStates.Target.StringCanonical(), app.exportLLB)
+	}
+	// Buildctl needs to be given the local sources.
+	localDirs := make(map[string]string)
+	for _, states := range mts.AllStates() {
+		for key, value := range states.LocalDirs {
+			localDirs[key] = value
+		}
+	}
+	var localArgs []string
+	for key, value := range localDirs {
+		localArgs = append(localArgs, fmt.Sprintf("--local %s=%s", key, value))
+	}
+	sort.Strings(localArgs)
+	if len(localArgs) > 0 {
+		app.console.Printf("Local sources: %s\n", strings.Join(localArgs, " "))
 	}
 	return nil
 }
 
-func (app *earthApp) newBuildkitdClient(ctx context.Context, opts ...client.ClientOpt) (*client.Client, error) {
+// cacheHistoryPath returns the path of the cache history file, used by --plan to
+// predict cache hits.
+func cacheHistoryPath() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.Wrap(err, "get user home dir")
+	}
+	return filepath.Join(homeDir, ".earthly", "cache-history"), nil
+}
+
+// buildCheckpointPath returns the path of the checkpoint of the interrupted builds of
+// the target.
+func buildCheckpointPath(target domain.Target) (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.Wrap(err, "get user home dir")
+	}
+	h := sha256.Sum256([]byte(target.StringCanonical()))
+	name := fmt.Sprintf("%s.json", hex.EncodeToString(h[:8]))
+	return filepath.Join(homeDir, ".earthly", "checkpoints", name), nil
+}
+
+// gracefulStop lets the build in progress be stopped gracefully, rather than
+// canceled, via builder.BuildOpt.Interrupt.
+type gracefulStop struct {
+	ch chan struct{}
+
+	mu      sync.Mutex
+	enabled bool
+	stopped bool
+}
+
+func newGracefulStop() *gracefulStop {
+	return &gracefulStop{ch: make(chan struct{})}
+}
+
+// enable is called when a build which can be stopped gracefully starts.
+func (gs *gracefulStop) enable() {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.enabled = true
+}
+
+// disable is called when the build completes.
+func (gs *gracefulStop) disable() {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.enabled = false
+}
+
+// stop asks the build to stop gracefully. It returns false if no build which can be
+// stopped gracefully is in progress.
+func (gs *gracefulStop) stop() bool {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if !gs.enabled || gs.stopped {
+		return false
+	}
+	gs.stopped = true
+	close(gs.ch)
+	return true
+}
+
+func (app *earthApp) newBuildkitdClient(ctx context.Context, cleanCollection *cleanup.Collection, opts ...client.ClientOpt) (*client.Client, error) {
+	if app.kubernetes {
+		if app.buildkitHost != "" {
+			return nil, errors.New("--kubernetes cannot be used together with --buildkit-host")
+		}
+		opTimeout := time.Duration(app.cfg.Global.BuildkitRestartTimeoutS) * time.Second
+		bkClient, err := buildkitd.NewKubernetesClient(
+			ctx, app.console, app.buildkitdImage, app.buildkitdSettings, app.kubernetesOpt,
+			opTimeout, cleanCollection, opts...)
+		if err != nil {
+			return nil, errors.Wrap(err, "buildkitd new client (kubernetes)")
+		}
+		return bkClient, nil
+	}
 	if app.buildkitHost == "" {
 		// Start our own.
+		isStarted, err := buildkitd.IsStarted(ctx)
+		if err == nil && isStarted {
+			// Keep the insecure registries allowed by the previous builds, rather than
+			// restarting the daemon without them.
+			registries, err := buildkitd.GetInsecureRegistries(ctx)
+			if err == nil {
+				app.buildkitdSettings.InsecureRegistries = registries
+			}
+		}
 		opTimeout := time.Duration(app.cfg.Global.BuildkitRestartTimeoutS) * time.Second
 		bkClient, err := buildkitd.NewClient(
 			ctx, app.console, app.buildkitdImage, app.buildkitdSettings, opTimeout)
@@ -1050,6 +2881,90 @@ func (app *earthApp) newBuildkitdClient(ctx context.Context, opts ...client.Clie
 	return bkClient, nil
 }
 
+// ensurePlatforms makes sure that the buildkit daemon can run the commands of the given
+// platforms. QEMU emulation is set up for the foreign platforms if earth started the
+// daemon, and is otherwise up to its host.
+func (app *earthApp) ensurePlatforms(ctx context.Context, bkClient *client.Client, targetPlatforms []specs.Platform) error {
+	switch {
+	case app.kubernetes:
+		return buildkitd.CheckPlatforms(ctx, bkClient, "(kubernetes)", targetPlatforms)
+	case app.buildkitHost != "":
+		return buildkitd.CheckPlatforms(ctx, bkClient, app.buildkitHost, targetPlatforms)
+	default:
+		return buildkitd.EnsurePlatforms(ctx, app.console, bkClient, targetPlatforms)
+	}
+}
+
+// ensureTargetPlatforms makes sure that the buildkit daemons can run the commands of the
+// targets built for their own platform, via FROM --platform.
+func (app *earthApp) ensureTargetPlatforms(ctx context.Context, bp buildParams, mts *earthfile2llb.MultiTargetStates) error {
+	var targetPlatforms []specs.Platform
+	for _, sts := range mts.AllStates() {
+		if platformInList(sts.Platform, targetPlatforms) || platformInList(sts.Platform, []specs.Platform{llbutil.TargetPlatform}) {
+			continue
+		}
+		targetPlatforms = append(targetPlatforms, sts.Platform)
+	}
+	if len(targetPlatforms) == 0 {
+		return nil
+	}
+	err := app.ensurePlatforms(ctx, bp.bkClient, targetPlatforms)
+	if err != nil {
+		return err
+	}
+	for i, workerClient := range bp.workerClients {
+		err = buildkitd.CheckPlatforms(ctx, workerClient, app.buildkitWorkers.Value()[i], targetPlatforms)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// platformInList returns whether the platform is one of the given ones.
+func platformInList(p specs.Platform, list []specs.Platform) bool {
+	for _, other := range list {
+		if platforms.Format(platforms.Normalize(p)) == platforms.Format(platforms.Normalize(other)) {
+			return true
+		}
+	}
+	return false
+}
+
+// insecureRegistryFun returns the function allowing the insecure registries of FROM
+// --insecure. The daemon started by earth is restarted with the registry added to its
+// settings. Other daemons are expected to allow the registry already, via the registry
+// sections of their buildkitd.toml.
+func (app *earthApp) insecureRegistryFun(bkClient *client.Client) earthfile2llb.InsecureRegistryFun {
+	var mu sync.Mutex
+	return func(ctx context.Context, registry string) error {
+		if app.kubernetes || app.buildkitHost != "" {
+			return nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, r := range app.buildkitdSettings.InsecureRegistries {
+			if r == registry {
+				return nil
+			}
+		}
+		app.console.
+			WithPrefix("buildkitd").
+			Printf("Allowing the insecure registry %s\n", registry)
+		registries := append([]string{}, app.buildkitdSettings.InsecureRegistries...)
+		registries = append(registries, registry)
+		sort.Strings(registries)
+		app.buildkitdSettings.InsecureRegistries = registries
+		opTimeout := time.Duration(app.cfg.Global.BuildkitRestartTimeoutS) * time.Second
+		err := buildkitd.MaybeRestart(ctx, app.console, app.buildkitdImage, app.buildkitdSettings, opTimeout)
+		if err != nil {
+			return errors.Wrap(err, "restart buildkitd")
+		}
+		// The client reconnects to the restarted daemon.
+		return buildkitd.WaitUntilReconnected(ctx, bkClient, opTimeout)
+	}
+}
+
 func processSecrets(secrets []string, dotEnvMap map[string]string) (map[string][]byte, error) {
 	finalSecrets := make(map[string][]byte)
 	for k, v := range dotEnvMap {
@@ -1072,6 +2987,155 @@ func processSecrets(secrets []string, dotEnvMap map[string]string) (map[string][
 	return finalSecrets, nil
 }
 
+// sshAgentConfigs returns the SSH agents to forward: the agent at sshAuthSock as the
+// default one, and those specified via --ssh, as <id>=<path>[,<path>...]. A path is
+// either an agent socket or a private key file.
+func sshAgentConfigs(sshAuthSock string, specs []string) ([]sshprovider.AgentConfig, error) {
+	var ret []sshprovider.AgentConfig
+	ids := make(map[string]bool)
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid --ssh %s. Expected <id>=<path>[,<path>...]", spec)
+		}
+		if ids[parts[0]] {
+			return nil, fmt.Errorf("duplicate --ssh id %s", parts[0])
+		}
+		ids[parts[0]] = true
+		ret = append(ret, sshprovider.AgentConfig{
+			ID:    parts[0],
+			Paths: strings.Split(parts[1], ","),
+		})
+	}
+	if sshAuthSock != "" && !ids["default"] {
+		ret = append(ret, sshprovider.AgentConfig{
+			ID:    "default",
+			Paths: []string{sshAuthSock},
+		})
+	}
+	return ret, nil
+}
+
+// policyGit returns the git metadata of the local directory of the target, for the
+// build policy. Nil if the target is remote, or not within a git repository.
+func policyGit(ctx context.Context, target domain.Target) *builder.PolicyGit {
+	if target.IsRemote() {
+		return nil
+	}
+	meta, err := buildcontext.Metadata(ctx, target.LocalPath)
+	if err != nil {
+		return nil
+	}
+	pg := &builder.PolicyGit{
+		Hash: meta.Hash,
+		Tags: meta.Tags,
+	}
+	if len(meta.Branch) > 0 {
+		pg.Branch = meta.Branch[0]
+	}
+	return pg
+}
+
+// scanOpt returns the settings of the vulnerability scan of the images before they are
+// pushed, per the --scan flags.
+func (app *earthApp) scanOpt() (builder.ScanOpt, error) {
+	if app.scanner == "" {
+		return builder.ScanOpt{}, nil
+	}
+	scanner, err := builder.NewScanner(app.scanner)
+	if err != nil {
+		return builder.ScanOpt{}, errors.Wrap(err, "invalid --scan")
+	}
+	failOn, err := builder.ParseSeverity(app.scanFailOn)
+	if err != nil {
+		return builder.ScanOpt{}, errors.Wrap(err, "invalid --scan-fail-on")
+	}
+	warnOn, err := builder.ParseSeverity(app.scanWarnOn)
+	if err != nil {
+		return builder.ScanOpt{}, errors.Wrap(err, "invalid --scan-warn-on")
+	}
+	return builder.ScanOpt{
+		Scanner: scanner,
+		FailOn:  failOn,
+		WarnOn:  warnOn,
+	}, nil
+}
+
+// earthfileTrustPolicy returns the trust policy of remote Earthfiles, as per the
+// earthfile_trust setting of the config.
+func earthfileTrustPolicy(cfg *config.Config) (buildcontext.TrustPolicy, error) {
+	var tp buildcontext.TrustPolicy
+	for _, etc := range cfg.Global.EarthfileTrust {
+		tp.Rules = append(tp.Rules, buildcontext.TrustRule{
+			Projects: etc.Projects,
+			Verify:   etc.Verify,
+			Keys:     etc.Keys,
+		})
+	}
+	err := tp.Validate()
+	if err != nil {
+		return buildcontext.TrustPolicy{}, errors.Wrap(err, "invalid earthfile_trust in the config")
+	}
+	return tp, nil
+}
+
+// capabilityPolicy returns the policy which rejects privileged commands, unless
+// privileged builds are allowed. This reports them before anything is built.
+func capabilityPolicy(allowPrivileged bool) earthfile2llb.CapabilityPolicy {
+	if allowPrivileged {
+		return nil
+	}
+	return func(target domain.Target, capabilities []string) error {
+		return errors.New("RUN --privileged requires the --allow-privileged (-P) flag")
+	}
+}
+
+// gcPolicies converts the cache_gc_policies of the config. The size of a policy
+// defaults to the size of the cache.
+func gcPolicies(policies []config.GCPolicyConfig, cacheSizeMb int) ([]buildkitd.GCPolicy, error) {
+	var ret []buildkitd.GCPolicy
+	for _, p := range policies {
+		maxSizeMb := p.MaxSizeMb
+		if maxSizeMb == 0 {
+			maxSizeMb = cacheSizeMb
+		}
+		var maxAge time.Duration
+		if p.MaxAge != "" {
+			var err error
+			maxAge, err = time.ParseDuration(p.MaxAge)
+			if err != nil || maxAge < 0 {
+				return nil, errors.Errorf("invalid max_age %s", p.MaxAge)
+			}
+		}
+		ret = append(ret, buildkitd.GCPolicy{
+			All:          p.All,
+			KeepBytes:    int64(maxSizeMb) * 1000000,
+			KeepDuration: maxAge,
+			Filters:      p.Filters,
+		})
+	}
+	return ret, nil
+}
+
+// readCACerts reads and concatenates the given PEM files of CA certificates.
+func readCACerts(paths []string) ([]byte, error) {
+	var ret []byte
+	for _, p := range paths {
+		dt, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read CA certs %s", p)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(dt) {
+			return nil, fmt.Errorf("no PEM encoded CA certificates found in %s", p)
+		}
+		ret = append(ret, dt...)
+		if !bytes.HasSuffix(dt, []byte("\n")) {
+			ret = append(ret, '\n')
+		}
+	}
+	return ret, nil
+}
+
 func defaultConfigPath() string {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
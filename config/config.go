@@ -27,17 +27,60 @@ type GlobalConfig struct {
 	BuildkitImage           string `yaml:"buildkit_image"`
 	DebuggerPort            int    `yaml:"debugger_port"`
 	BuildkitRestartTimeoutS int    `yaml:"buildkit_restart_timeout_s"`
+	LogFormat               string `yaml:"log_format"`
+	// CACerts are paths of additional CA certificates, trusted by the build commands.
+	CACerts []string `yaml:"ca_certs"`
+	// CacheGCPolicies replace the default garbage collection policies of the cache.
+	CacheGCPolicies []GCPolicyConfig `yaml:"cache_gc_policies"`
+	// CacheKeepLast is the number of builds of each target whose cache is kept, when
+	// pruning after each build. Disabled if zero.
+	CacheKeepLast int `yaml:"cache_keep_last"`
+	// MaxParallelism is the maximum number of commands run at the same time.
+	MaxParallelism int `yaml:"max_parallelism"`
+	// SerializeTargets are targets whose commands never run at the same time.
+	SerializeTargets []string `yaml:"serialize_targets"`
+	// SecurityPolicy restricts which targets may run privileged commands and mount
+	// host directories.
+	SecurityPolicy SecurityPolicyConfig `yaml:"security_policy"`
+	// EarthfileTrust are the rules verifying the signatures of remote Earthfiles.
+	EarthfileTrust []EarthfileTrustConfig `yaml:"earthfile_trust"`
 
 	// Obsolete.
 	CachePath string `yaml:"cache_path"`
 }
 
+// GCPolicyConfig contains a garbage collection policy of the cache
+type GCPolicyConfig struct {
+	MaxSizeMb int      `yaml:"max_size_mb"`
+	MaxAge    string   `yaml:"max_age"`
+	Filters   []string `yaml:"filters"`
+	All       bool     `yaml:"all"`
+}
+
+// SecurityPolicyConfig contains the patterns of the targets allowed to use the features
+// of Earthfiles which give commands access to the host. All targets are allowed if a
+// list is not set.
+type SecurityPolicyConfig struct {
+	PrivilegedTargets []string `yaml:"privileged_targets"`
+	HostBindTargets   []string `yaml:"host_bind_targets"`
+	LocallyTargets    []string `yaml:"locally_targets"`
+}
+
+// EarthfileTrustConfig is how the Earthfiles of the remote projects matching a pattern
+// are verified.
+type EarthfileTrustConfig struct {
+	Projects string   `yaml:"projects"`
+	Verify   string   `yaml:"verify"`
+	Keys     []string `yaml:"keys"`
+}
+
 // GitConfig contains git-specific config values
 type GitConfig struct {
 	// these are used for global config
 	GitURLInsteadOf string `yaml:"url_instead_of"`
 
 	// these are used for git vendors (e.g. github, gitlab)
+	// Auth is ssh, https or token
 	Auth     string `yaml:"auth"`
 	User     string `yaml:"user"`
 	Password string `yaml:"password"`
@@ -142,6 +185,9 @@ func CreateGitConfig(config *Config) (string, []string, error) {
 			// use https instead of ssh://git@....
 			lines = append(lines, fmt.Sprintf("[url %q]", url+"/"))
 			lines = append(lines, fmt.Sprintf("  insteadOf = git@%s:", url[8:]))
+		case "token":
+			// The remote repositories of the site are cloned over https, and authenticated
+			// via the token secret of the build. No rewriting.
 		case "ssh":
 			// use git@... instead of https://...
 			lines = append(lines, fmt.Sprintf("[url %q]", "git@"+url[8:]+":"))
@@ -157,6 +203,18 @@ func CreateGitConfig(config *Config) (string, []string, error) {
 	return gitConfig, credentials, nil
 }
 
+// TokenAuthSites returns the git sites configured with auth token, sorted.
+func TokenAuthSites(config *Config) []string {
+	var sites []string
+	for k, v := range config.Git {
+		if v.Auth == "token" {
+			sites = append(sites, k)
+		}
+	}
+	sort.Strings(sites)
+	return sites
+}
+
 func defaultRunPath() string {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
@@ -0,0 +1,119 @@
+package conslogging
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// CIGroupMode is the mode in which the output of targets is grouped into
+// collapsible sections, as supported by CI systems.
+type CIGroupMode int
+
+const (
+	// NoCIGroups disables grouping.
+	NoCIGroups CIGroupMode = iota
+	// GitHubCIGroups groups output via GitHub Actions ::group:: workflow commands.
+	GitHubCIGroups
+	// GitLabCIGroups groups output via GitLab CI collapsible sections.
+	GitLabCIGroups
+)
+
+// ParseCIGroupMode parses the CI group mode name. The mode "auto" detects the CI
+// system from the environment.
+func ParseCIGroupMode(name string) (CIGroupMode, error) {
+	switch name {
+	case "auto":
+		return DetectCIGroupMode(), nil
+	case "none":
+		return NoCIGroups, nil
+	case "github":
+		return GitHubCIGroups, nil
+	case "gitlab":
+		return GitLabCIGroups, nil
+	default:
+		return NoCIGroups, fmt.Errorf("invalid CI log group mode %s. Supported modes: auto, none, github, gitlab", name)
+	}
+}
+
+// DetectCIGroupMode returns the group mode of the CI system the process runs in, if
+// any.
+func DetectCIGroupMode() CIGroupMode {
+	switch {
+	case os.Getenv("GITHUB_ACTIONS") == "true":
+		return GitHubCIGroups
+	case os.Getenv("GITLAB_CI") == "true":
+		return GitLabCIGroups
+	default:
+		return NoCIGroups
+	}
+}
+
+// ciGroupState is the group currently open. It is shared between instances of the
+// console and is protected by the console mutex.
+type ciGroupState struct {
+	mode CIGroupMode
+	// key is the prefix and salt of the group currently open. Empty if none is open.
+	key       string
+	sectionID string
+	count     int
+}
+
+// WithCIGroups returns a ConsoleLogger which groups the output of each target into a
+// collapsible section. As the output of targets built in parallel is interleaved, a
+// new section is started whenever the output switches to a different target.
+func (cl ConsoleLogger) WithCIGroups(mode CIGroupMode) ConsoleLogger {
+	ret := cl.clone()
+	ret.ciGroups = &ciGroupState{mode: mode}
+	return ret
+}
+
+// switchCIGroup closes the currently open group, if it belongs to a different target,
+// and opens the group of this console's target, if any.
+func (cl ConsoleLogger) switchCIGroup() {
+	// Assumes mu locked.
+	g := cl.ciGroups
+	if g == nil || g.mode == NoCIGroups {
+		return
+	}
+	key := ""
+	if cl.prefix != "" {
+		key = cl.prefix + " " + cl.salt
+	}
+	if key == g.key {
+		return
+	}
+	cl.closeCIGroup()
+	if key == "" {
+		return
+	}
+	g.key = key
+	g.count++
+	title := cl.prefix
+	if cl.isCached {
+		title = fmt.Sprintf("%s (cached)", title)
+	}
+	switch g.mode {
+	case GitHubCIGroups:
+		fmt.Fprintf(cl.w, "::group::%s\n", title)
+	case GitLabCIGroups:
+		g.sectionID = fmt.Sprintf("earthly_%d", g.count)
+		fmt.Fprintf(cl.w, "\x1b[0Ksection_start:%d:%s[collapsed=true]\r\x1b[0K%s\n",
+			time.Now().Unix(), g.sectionID, title)
+	}
+}
+
+func (cl ConsoleLogger) closeCIGroup() {
+	// Assumes mu locked.
+	g := cl.ciGroups
+	if g == nil || g.key == "" {
+		return
+	}
+	switch g.mode {
+	case GitHubCIGroups:
+		fmt.Fprintf(cl.w, "::endgroup::\n")
+	case GitLabCIGroups:
+		fmt.Fprintf(cl.w, "\x1b[0Ksection_end:%d:%s\r\x1b[0K\n", time.Now().Unix(), g.sectionID)
+	}
+	g.key = ""
+}
@@ -0,0 +1,40 @@
+package conslogging
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/fatih/color"
+)
+
+func TestGitHubCIGroups(t *testing.T) {
+	var buf bytes.Buffer
+	cl := ConsoleLogger{
+		w:              &buf,
+		colorMode:      NoColor,
+		saltColors:     make(map[string]*color.Color),
+		nextColorIndex: new(int),
+		mu:             &sync.Mutex{},
+	}
+	cl = cl.WithCIGroups(GitHubCIGroups)
+	a := cl.WithPrefixAndSalt("+a", "1")
+	b := cl.WithPrefixAndSalt("+b", "2")
+	a.WithCached(true).Printf("--> RUN a\n")
+	a.Printf("a1\n")
+	b.PrintBytes([]byte("b1\nb2\n"))
+	cl.PrintSuccess()
+
+	expected := "::group::+a (cached)\n" +
+		"+a | *cached* --> RUN a\n" +
+		"+a | a1\n" +
+		"::endgroup::\n" +
+		"::group::+b\n" +
+		"+b | b1\n" +
+		"+b | b2\n" +
+		"::endgroup::\n" +
+		"=========================== SUCCESS ===========================\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+}
@@ -35,6 +35,13 @@ type ConsoleLogger struct {
 	colorMode ColorMode
 	isCached  bool
 	isFailed  bool
+	// jsonOutput enables emitting JSON events instead of text.
+	jsonOutput bool
+	// sinks receive all events, regardless of the output mode.
+	sinks []EventSink
+	// ciGroups is the state of CI log grouping, if enabled. It is shared between
+	// instances.
+	ciGroups *ciGroupState
 
 	// The following are shared between instances and are protected by the mutex.
 	mu             *sync.Mutex
@@ -62,6 +69,9 @@ func (cl ConsoleLogger) clone() ConsoleLogger {
 		salt:           cl.salt,
 		isCached:       cl.isCached,
 		isFailed:       cl.isFailed,
+		jsonOutput:     cl.jsonOutput,
+		sinks:          cl.sinks,
+		ciGroups:       cl.ciGroups,
 		saltColors:     cl.saltColors,
 		colorMode:      cl.colorMode,
 		nextColorIndex: cl.nextColorIndex,
@@ -69,6 +79,14 @@ func (cl ConsoleLogger) clone() ConsoleLogger {
 	}
 }
 
+// WithWriter returns a ConsoleLogger which writes to w. The writer is shared with all
+// loggers derived from the returned one.
+func (cl ConsoleLogger) WithWriter(w io.Writer) ConsoleLogger {
+	ret := cl.clone()
+	ret.w = w
+	return ret
+}
+
 // WithPrefix returns a ConsoleLogger with a prefix added.
 func (cl ConsoleLogger) WithPrefix(prefix string) ConsoleLogger {
 	ret := cl.clone()
@@ -108,6 +126,11 @@ func (cl ConsoleLogger) WithFailed(isFailed bool) ConsoleLogger {
 func (cl ConsoleLogger) PrintSuccess() {
 	cl.mu.Lock()
 	defer cl.mu.Unlock()
+	cl.printEvent(Event{Type: BuildSucceededEvent})
+	if cl.jsonOutput {
+		return
+	}
+	cl.switchCIGroup()
 	cl.color(successColor).Fprintf(cl.w, "=========================== SUCCESS ===========================\n")
 }
 
@@ -115,6 +138,11 @@ func (cl ConsoleLogger) PrintSuccess() {
 func (cl ConsoleLogger) PrintFailure() {
 	cl.mu.Lock()
 	defer cl.mu.Unlock()
+	cl.printEvent(Event{Type: BuildFailedEvent})
+	if cl.jsonOutput {
+		return
+	}
+	cl.switchCIGroup()
 	cl.color(warnColor).Fprintf(cl.w, "=========================== FAILURE ===========================\n")
 }
 
@@ -125,6 +153,10 @@ func (cl ConsoleLogger) Warnf(format string, args ...interface{}) {
 
 	c := cl.color(warnColor)
 	text := fmt.Sprintf(format, args...)
+	cl.printLogEvents("warn", text)
+	if cl.jsonOutput {
+		return
+	}
 	text = strings.TrimSuffix(text, "\n")
 
 	for _, line := range strings.Split(text, "\n") {
@@ -138,6 +170,10 @@ func (cl ConsoleLogger) Printf(format string, args ...interface{}) {
 	cl.mu.Lock()
 	defer cl.mu.Unlock()
 	text := fmt.Sprintf(format, args...)
+	cl.printLogEvents("info", text)
+	if cl.jsonOutput {
+		return
+	}
 	text = strings.TrimSuffix(text, "\n")
 	for _, line := range strings.Split(text, "\n") {
 		cl.printPrefix()
@@ -150,6 +186,10 @@ func (cl ConsoleLogger) Printf(format string, args ...interface{}) {
 func (cl ConsoleLogger) PrintBytes(data []byte) {
 	cl.mu.Lock()
 	defer cl.mu.Unlock()
+	cl.printLogEvents("info", string(data))
+	if cl.jsonOutput {
+		return
+	}
 
 	output := make([]byte, 0, len(data))
 	for len(data) > 0 {
@@ -183,6 +223,7 @@ func (cl ConsoleLogger) PrintBytes(data []byte) {
 
 func (cl ConsoleLogger) printPrefix() {
 	// Assumes mu locked.
+	cl.switchCIGroup()
 	if cl.prefix == "" {
 		return
 	}
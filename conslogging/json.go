@@ -0,0 +1,144 @@
+package conslogging
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Event types emitted in the JSON output mode.
+const (
+	// LogEvent is a line of console output.
+	LogEvent = "log"
+	// VertexStartedEvent is emitted when a command starts executing, or is found in
+	// the cache.
+	VertexStartedEvent = "vertex_started"
+	// VertexCompletedEvent is emitted when a command completes successfully.
+	VertexCompletedEvent = "vertex_completed"
+	// VertexFailedEvent is emitted when a command fails.
+	VertexFailedEvent = "vertex_failed"
+	// VertexProgressEvent is emitted periodically while a command makes progress, such
+	// as downloading an image or transferring files.
+	VertexProgressEvent = "vertex_progress"
+	// TargetStartedEvent is emitted when the first command of a target starts.
+	TargetStartedEvent = "target_started"
+	// TargetCompletedEvent is emitted once all commands of a target have executed.
+	TargetCompletedEvent = "target_completed"
+	// ArtifactExportedEvent is emitted when an artifact is saved locally.
+	ArtifactExportedEvent = "artifact_exported"
+	// ImageExportedEvent is emitted when an image is output, and possibly pushed.
+	ImageExportedEvent = "image_exported"
+	// BuildSucceededEvent is emitted when the build succeeds.
+	BuildSucceededEvent = "build_succeeded"
+	// BuildFailedEvent is emitted when the build fails.
+	BuildFailedEvent = "build_failed"
+	// ErrorEvent is emitted when earth exits with an error, with the code of its
+	// category and the exit code.
+	ErrorEvent = "error"
+)
+
+// Event is a structured build event, as emitted in the JSON output mode.
+type Event struct {
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	Target string    `json:"target,omitempty"`
+	// Salt distinguishes instances of the same target (eg with different build args).
+	Salt      string     `json:"-"`
+	Vertex    string     `json:"vertex,omitempty"`
+	Command   string     `json:"command,omitempty"`
+	Cached    bool       `json:"cached,omitempty"`
+	Failed    bool       `json:"failed,omitempty"`
+	Started   *time.Time `json:"started,omitempty"`
+	Completed *time.Time `json:"completed,omitempty"`
+	ExitCode  *int       `json:"exitCode,omitempty"`
+	Progress  int        `json:"progress,omitempty"`
+	Artifact  string     `json:"artifact,omitempty"`
+	Path      string     `json:"path,omitempty"`
+	Image     string     `json:"image,omitempty"`
+	Pushed    bool       `json:"pushed,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	ErrorCode string     `json:"errorCode,omitempty"`
+	Level     string     `json:"level,omitempty"`
+	Message   string     `json:"message,omitempty"`
+}
+
+// WithJSONOutput returns a ConsoleLogger which emits newline-delimited JSON events,
+// instead of human readable text.
+func (cl ConsoleLogger) WithJSONOutput(jsonOutput bool) ConsoleLogger {
+	ret := cl.clone()
+	ret.jsonOutput = jsonOutput
+	return ret
+}
+
+// JSONOutput returns whether the console emits JSON events.
+func (cl ConsoleLogger) JSONOutput() bool {
+	return cl.jsonOutput
+}
+
+// EventSink receives the structured events of a console, regardless of its output
+// mode.
+type EventSink interface {
+	// Event is called for each event. It must not block.
+	Event(ev Event)
+}
+
+// WithEventSink returns a ConsoleLogger which additionally passes all events to sink.
+func (cl ConsoleLogger) WithEventSink(sink EventSink) ConsoleLogger {
+	ret := cl.clone()
+	ret.sinks = append(append([]EventSink{}, cl.sinks...), sink)
+	return ret
+}
+
+// PrintEvent prints a structured event. The target, cached and failed fields are
+// filled in from the console, if not set. Events are only printed in the JSON output
+// mode, but are passed to the event sink in any mode.
+func (cl ConsoleLogger) PrintEvent(ev Event) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.printEvent(ev)
+}
+
+func (cl ConsoleLogger) printEvent(ev Event) {
+	// Assumes mu locked.
+	if !cl.jsonOutput && len(cl.sinks) == 0 {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	if ev.Target == "" {
+		ev.Target = cl.prefix
+		ev.Salt = cl.salt
+	}
+	ev.Cached = ev.Cached || cl.isCached
+	ev.Failed = ev.Failed || cl.isFailed
+	for _, sink := range cl.sinks {
+		sink.Event(ev)
+	}
+	if !cl.jsonOutput {
+		return
+	}
+	dt, err := json.Marshal(ev)
+	if err != nil {
+		// Should never happen.
+		return
+	}
+	cl.w.Write(dt)
+	cl.w.Write([]byte("\n"))
+}
+
+func (cl ConsoleLogger) printLogEvents(level string, text string) {
+	// Assumes mu locked.
+	if !cl.jsonOutput && len(cl.sinks) == 0 {
+		return
+	}
+	text = strings.TrimSuffix(text, "\n")
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		cl.printEvent(Event{
+			Type:    LogEvent,
+			Level:   level,
+			Message: line,
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package conslogging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fatih/color"
+)
+
+func TestJSONOutput(t *testing.T) {
+	var buf bytes.Buffer
+	cl := ConsoleLogger{
+		w:              &buf,
+		colorMode:      NoColor,
+		saltColors:     make(map[string]*color.Color),
+		nextColorIndex: new(int),
+		mu:             &sync.Mutex{},
+	}
+	cl = cl.WithJSONOutput(true).WithPrefixAndSalt("+build", "salt")
+	cl.Printf("line 1\nline 2\n")
+	cl.WithCached(true).PrintEvent(Event{Type: VertexStartedEvent, Command: "RUN true"})
+	cl.PrintFailure()
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected 4 events, got %d: %s", len(lines), buf.String())
+	}
+	var events []Event
+	for _, line := range lines {
+		var ev Event
+		err := json.Unmarshal([]byte(line), &ev)
+		if err != nil {
+			t.Fatalf("invalid event %s: %v", line, err)
+		}
+		if ev.Target != "+build" || ev.Time.IsZero() {
+			t.Errorf("unexpected event %s", line)
+		}
+		events = append(events, ev)
+	}
+	if events[1].Type != LogEvent || events[1].Message != "line 2" {
+		t.Errorf("unexpected log event %+v", events[1])
+	}
+	if events[2].Type != VertexStartedEvent || !events[2].Cached {
+		t.Errorf("unexpected vertex event %+v", events[2])
+	}
+	if events[3].Type != BuildFailedEvent {
+		t.Errorf("unexpected failure event %+v", events[3])
+	}
+}
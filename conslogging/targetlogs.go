@@ -0,0 +1,121 @@
+package conslogging
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// unsafeFileNameChars matches the characters replaced when deriving log file names
+// from target names.
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9._+-]+`)
+
+// TargetLogs is an EventSink which writes the output of each target into its own file
+// within a directory. Files are named after the canonical target name, followed by
+// its salt, such that instances of the same target built with different build args
+// do not clash.
+type TargetLogs struct {
+	dir string
+
+	mu    sync.Mutex
+	files map[string]*targetLogFile
+	err   error
+}
+
+type targetLogFile struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+// NewTargetLogs creates a new TargetLogs writing into dir, which is created if it does
+// not exist.
+func NewTargetLogs(dir string) (*TargetLogs, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.Wrapf(err, "create target log dir %s", dir)
+	}
+	return &TargetLogs{
+		dir:   dir,
+		files: make(map[string]*targetLogFile),
+	}, nil
+}
+
+// Event implements EventSink.
+func (tl *TargetLogs) Event(ev Event) {
+	if ev.Target == "" {
+		return
+	}
+	var line string
+	switch ev.Type {
+	case LogEvent:
+		line = ev.Message
+	case VertexStartedEvent:
+		line = fmt.Sprintf("--> %s", ev.Command)
+		if ev.Cached {
+			line = fmt.Sprintf("%s (cached)", line)
+		}
+	case VertexFailedEvent:
+		line = fmt.Sprintf("ERROR: %s", ev.Error)
+	default:
+		return
+	}
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	if tl.err != nil {
+		return
+	}
+	ltf, err := tl.file(ev.Target, ev.Salt)
+	if err != nil {
+		tl.err = err
+		return
+	}
+	_, err = fmt.Fprintf(ltf.w, "%s\n", line)
+	if err != nil {
+		tl.err = errors.Wrapf(err, "write target log %s", ltf.f.Name())
+	}
+}
+
+func (tl *TargetLogs) file(target string, salt string) (*targetLogFile, error) {
+	// Assumes mu locked.
+	key := target + " " + salt
+	ltf, found := tl.files[key]
+	if found {
+		return ltf, nil
+	}
+	name := unsafeFileNameChars.ReplaceAllString(target, "_")
+	if salt != "" {
+		name = fmt.Sprintf("%s.%s", name, salt)
+	}
+	p := filepath.Join(tl.dir, fmt.Sprintf("%s.log", name))
+	f, err := os.Create(p)
+	if err != nil {
+		return nil, errors.Wrapf(err, "create target log %s", p)
+	}
+	ltf = &targetLogFile{f: f, w: bufio.NewWriter(f)}
+	tl.files[key] = ltf
+	return ltf, nil
+}
+
+// Close flushes and closes all log files. It returns the first error encountered
+// while writing the logs, if any.
+func (tl *TargetLogs) Close() error {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	for _, ltf := range tl.files {
+		err := ltf.w.Flush()
+		if err != nil && tl.err == nil {
+			tl.err = errors.Wrapf(err, "write target log %s", ltf.f.Name())
+		}
+		err = ltf.f.Close()
+		if err != nil && tl.err == nil {
+			tl.err = errors.Wrapf(err, "close target log %s", ltf.f.Name())
+		}
+	}
+	tl.files = make(map[string]*targetLogFile)
+	return tl.err
+}
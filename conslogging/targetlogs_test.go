@@ -0,0 +1,42 @@
+package conslogging
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTargetLogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "earth-target-logs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tl, err := NewTargetLogs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl.Event(Event{Type: VertexStartedEvent, Target: "github.com/foo/bar+build", Salt: "1", Command: "RUN make"})
+	tl.Event(Event{Type: LogEvent, Target: "github.com/foo/bar+build", Salt: "1", Message: "ok"})
+	tl.Event(Event{Type: LogEvent, Target: "github.com/foo/bar+build", Salt: "2", Message: "other"})
+	tl.Event(Event{Type: LogEvent, Message: "no target"})
+	err = tl.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt, err := ioutil.ReadFile(filepath.Join(dir, "github.com_foo_bar+build.1.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dt) != "--> RUN make\nok\n" {
+		t.Errorf("unexpected log %q", dt)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected 2 log files, got %d", len(entries))
+	}
+}
@@ -0,0 +1,77 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Capabilities maps the names of the Linux capabilities (without the CAP_ prefix) to
+// their numbers.
+var Capabilities = map[string]int{
+	"CHOWN":            0,
+	"DAC_OVERRIDE":     1,
+	"DAC_READ_SEARCH":  2,
+	"FOWNER":           3,
+	"FSETID":           4,
+	"KILL":             5,
+	"SETGID":           6,
+	"SETUID":           7,
+	"SETPCAP":          8,
+	"LINUX_IMMUTABLE":  9,
+	"NET_BIND_SERVICE": 10,
+	"NET_BROADCAST":    11,
+	"NET_ADMIN":        12,
+	"NET_RAW":          13,
+	"IPC_LOCK":         14,
+	"IPC_OWNER":        15,
+	"SYS_MODULE":       16,
+	"SYS_RAWIO":        17,
+	"SYS_CHROOT":       18,
+	"SYS_PTRACE":       19,
+	"SYS_PACCT":        20,
+	"SYS_ADMIN":        21,
+	"SYS_BOOT":         22,
+	"SYS_NICE":         23,
+	"SYS_RESOURCE":     24,
+	"SYS_TIME":         25,
+	"SYS_TTY_CONFIG":   26,
+	"MKNOD":            27,
+	"LEASE":            28,
+	"AUDIT_WRITE":      29,
+	"AUDIT_CONTROL":    30,
+	"SETFCAP":          31,
+	"MAC_OVERRIDE":     32,
+	"MAC_ADMIN":        33,
+	"SYSLOG":           34,
+	"WAKE_ALARM":       35,
+	"BLOCK_SUSPEND":    36,
+	"AUDIT_READ":       37,
+}
+
+// DefaultCapabilities are the capabilities build commands run with, unless privileged.
+var DefaultCapabilities = []string{
+	"CHOWN", "DAC_OVERRIDE", "FSETID", "FOWNER", "MKNOD", "NET_RAW", "SETGID",
+	"SETUID", "SETFCAP", "SETPCAP", "NET_BIND_SERVICE", "SYS_CHROOT", "KILL",
+	"AUDIT_WRITE",
+}
+
+// ParseCapability returns the canonical name of a capability, which may be given in
+// any case and with or without the CAP_ prefix.
+func ParseCapability(name string) (string, error) {
+	canonical := strings.TrimPrefix(strings.ToUpper(name), "CAP_")
+	_, found := Capabilities[canonical]
+	if !found {
+		return "", fmt.Errorf("unknown capability %s", name)
+	}
+	return canonical, nil
+}
+
+// IsDefaultCapability returns true if build commands run with the capability by default.
+func IsDefaultCapability(name string) bool {
+	for _, c := range DefaultCapabilities {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,28 @@
+package common
+
+import "testing"
+
+func TestParseCapability(t *testing.T) {
+	for _, name := range []string{"NET_ADMIN", "net_admin", "CAP_NET_ADMIN", "cap_net_admin"} {
+		canonical, err := ParseCapability(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if canonical != "NET_ADMIN" {
+			t.Errorf("%s: expected NET_ADMIN, got %s", name, canonical)
+		}
+	}
+	_, err := ParseCapability("NET_ADMINS")
+	if err == nil {
+		t.Error("expected error for unknown capability")
+	}
+}
+
+func TestIsDefaultCapability(t *testing.T) {
+	if !IsDefaultCapability("CHOWN") {
+		t.Error("expected CHOWN to be a default capability")
+	}
+	if IsDefaultCapability("NET_ADMIN") {
+		t.Error("expected NET_ADMIN not to be a default capability")
+	}
+}
@@ -24,6 +24,21 @@ const TermID = 0x01
 // ShellID is a magic byte to identify the connection is from the shell
 const ShellID = 0x02
 
+// PortForwardID is a magic byte to identify the connection is a forwarded port. It is
+// followed by <uint16:port>, the port to connect to within the build environment, and
+// then by the raw data of the forwarded connection.
+const PortForwardID = 0x03
+
+// AttachableID is a magic byte to identify the connection is from a step of a build
+// which may be attached to. It is followed by a BuildIDData packet. Once a terminal
+// attaches, the server sends a StartShellSession packet and the step answers with a
+// StartShellSession packet, followed by the usual shell data packets.
+const AttachableID = 0x04
+
+// AttachID is a magic byte to identify the connection is from a terminal attaching to
+// a build. It is followed by a BuildIDData packet.
+const AttachID = 0x05
+
 ////////////////////////////////////////////////////////////////////
 // data packet identifiers
 
@@ -39,6 +54,12 @@ const PtyData = 0x03
 // WinSizeData identifies the terminal window data payload packet
 const WinSizeData = 0x04
 
+// BuildIDData identifies the build ID payload packet of attach connections
+const BuildIDData = 0x05
+
+// ErrorData identifies an error message payload packet, sent to the terminal
+const ErrorData = 0x06
+
 // End of network protocol magic numbers
 //******************************************************************************************
 
@@ -0,0 +1,26 @@
+package common
+
+import "strings"
+
+// SerializationLock returns the name of the lock serializing the commands of the given
+// target, if any of the specs matches it. A spec is of the form <target>[=<group>],
+// where <target> is either a canonical target name without tag, such as
+// github.com/foo/bar+itest, or +<name> to match the targets of that name in any
+// project. Targets of the same group share the lock; by default each target has its
+// own.
+func SerializationLock(specs []string, target string) (string, bool) {
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		pattern := parts[0]
+		matches := pattern == target ||
+			(strings.HasPrefix(pattern, "+") && strings.HasSuffix(target, pattern))
+		if !matches {
+			continue
+		}
+		if len(parts) == 2 && parts[1] != "" {
+			return "group:" + parts[1], true
+		}
+		return "target:" + target, true
+	}
+	return "", false
+}
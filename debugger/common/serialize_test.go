@@ -0,0 +1,25 @@
+package common
+
+import "testing"
+
+func TestSerializationLock(t *testing.T) {
+	specs := []string{"+itest", "github.com/foo/bar+e2e=ports", "github.com/foo/baz+e2e=ports"}
+	tests := []struct {
+		target   string
+		expected string
+		ok       bool
+	}{
+		{"github.com/foo/bar+itest", "target:github.com/foo/bar+itest", true},
+		{"github.com/foo/qux+itest", "target:github.com/foo/qux+itest", true},
+		{"github.com/foo/bar+myitest", "", false},
+		{"github.com/foo/bar+e2e", "group:ports", true},
+		{"github.com/foo/baz+e2e", "group:ports", true},
+		{"github.com/foo/qux+e2e", "", false},
+	}
+	for _, tt := range tests {
+		actual, ok := SerializationLock(specs, tt.target)
+		if actual != tt.expected || ok != tt.ok {
+			t.Errorf("%s: expected %q, %v, got %q, %v", tt.target, tt.expected, tt.ok, actual, ok)
+		}
+	}
+}
@@ -3,10 +3,89 @@ package common
 // DebuggerSettingsSecretsKey stores the secrets key name
 const DebuggerSettingsSecretsKey = "earthly_debugger_settings"
 
+// BreakpointArg is passed to the debugger, instead of a command, to open a debugger
+// shell at a BREAKPOINT.
+const BreakpointArg = "--breakpoint"
+
 // DebuggerSettings is used to pass settings to the debugger
 type DebuggerSettings struct {
 	DebugLevelLogging bool   `json:"debugLevel"`
 	Enabled           bool   `json:"enabled"`
 	SockPath          string `json:"sockPath"`
 	Term              string `json:"term"`
+	// BuildID is the ID of the build which can be attached to via earth attach. The
+	// build is not attachable if empty.
+	BuildID string `json:"buildID"`
+	// MaxParallelism is the maximum number of commands run at the same time by the
+	// buildkit daemon. Not limited if zero.
+	MaxParallelism int `json:"maxParallelism"`
+	// SerializedTargets are the targets whose commands never run at the same time, of
+	// the form <target>[=<group>] (see SerializationLock).
+	SerializedTargets []string `json:"serializedTargets"`
 }
+
+// RunTimeoutEnvVar is set for the debugger to the timeout of the command (RUN --timeout),
+// as a duration such as 10m. The command is killed once the timeout elapses.
+const RunTimeoutEnvVar = "EARTHLY_RUN_TIMEOUT"
+
+// RunIgnoreFailureEnvVar is set for the debugger when the command is run again after it
+// failed, for saving the SAVE ARTIFACT --on-failure artifacts. The debugger exits
+// successfully even if the command fails.
+const RunIgnoreFailureEnvVar = "EARTHLY_RUN_IGNORE_FAILURE"
+
+// TimeoutExitCode is the exit code of commands killed because of their timeout.
+const TimeoutExitCode = 124
+
+// CACertsEnvVar is set for the debugger to the path of the additional CA certificates
+// trusted by the command. The debugger combines them with the system certificates and
+// points the usual env vars (SSL_CERT_FILE etc.) at the combined bundle.
+const CACertsEnvVar = "EARTHLY_CA_CERTS_FILE"
+
+// CACertsDir is the directory in which the additional CA certificates are mounted. It is
+// writable and discarded after the command, such that it may hold the combined bundle.
+const CACertsDir = "/run/earthly-ca"
+
+// CACertsFile is the name of the additional CA certificates file, within CACertsDir.
+const CACertsFile = "extra-ca-certificates.crt"
+
+// CacheTargetEnvVar is set in the commands to the target running them, by its canonical
+// name without the tag.
+const CacheTargetEnvVar = "EARTHLY_CACHE_TARGET"
+
+// LockArg is passed to the debugger, followed by a command, to acquire the concurrency
+// locks of the target (see DebuggerSettings) and then exec the command, which holds them
+// until it exits. It is used by the WITH DOCKER wrapper, such that the locks also cover
+// the Docker daemon and the services it starts.
+const LockArg = "--lock"
+
+// LockedEnvVar is set once the concurrency locks have been acquired via LockArg, such
+// that the debugger does not acquire them again.
+const LockedEnvVar = "EARTHLY_LOCKED"
+
+// LocksDir is the directory holding the lock files of the concurrency limits. It is
+// shared by all the commands run by the buildkit daemon.
+const LocksDir = "/run/earthly/locks"
+
+// ReadSocketArg is passed to the debugger, instead of a command, followed by the path
+// of a unix socket, to copy what is read from the socket to stdout. It is used to
+// stream the images of DOCKER LOAD and WITH DOCKER --load into docker load, via a
+// socket forwarded from the earth binary.
+const ReadSocketArg = "--read-socket"
+
+// AssertArg is passed to the debugger, instead of a command, followed by the kind of
+// assertion and its arguments, to check an ASSERT.
+const AssertArg = "--assert"
+
+// The kinds of assertions checked by the debugger.
+const (
+	// AssertExists checks that a file exists: <path>.
+	AssertExists = "exists"
+	// AssertNotExists checks that a file does not exist: <path>.
+	AssertNotExists = "not-exists"
+	// AssertContent checks the content of a file: <path> <expected content>.
+	AssertContent = "content"
+	// AssertContains checks that a file contains a text: <path> <text>.
+	AssertContains = "contains"
+	// AssertExitCode checks the exit code of a shell command: <code> <command>.
+	AssertExitCode = "exit-code"
+)
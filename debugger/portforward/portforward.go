@@ -0,0 +1,108 @@
+package portforward
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/earthly/earthly/debugger/common"
+	"github.com/earthly/earthly/logging"
+
+	"github.com/pkg/errors"
+)
+
+// Spec describes a port forwarded from the build environment to the host.
+type Spec struct {
+	// HostPort is the port listened on, on the host.
+	HostPort uint16
+	// ContainerPort is the port connected to, within the build environment.
+	ContainerPort uint16
+}
+
+// ParseSpec parses a port forwarding spec of the form <host-port>:<container-port>,
+// or <port>, if both are the same.
+func ParseSpec(spec string) (Spec, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	hostPort, err := parsePort(parts[0])
+	if err != nil {
+		return Spec{}, errors.Wrapf(err, "invalid port forwarding spec %s", spec)
+	}
+	containerPort := hostPort
+	if len(parts) == 2 {
+		containerPort, err = parsePort(parts[1])
+		if err != nil {
+			return Spec{}, errors.Wrapf(err, "invalid port forwarding spec %s", spec)
+		}
+	}
+	return Spec{HostPort: hostPort, ContainerPort: containerPort}, nil
+}
+
+func parsePort(str string) (uint16, error) {
+	port, err := strconv.ParseUint(str, 10, 16)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parse port %s", str)
+	}
+	if port == 0 {
+		return 0, fmt.Errorf("invalid port %s", str)
+	}
+	return uint16(port), nil
+}
+
+// Forward listens on the host port of spec and forwards each connection, via the
+// debugger server at debuggerAddr, to the container port of spec. Connections to the
+// build environment are only made when a connection is accepted, such that the port
+// needs to be open only while it is used (eg during an interactive debugger session).
+// The returned listener needs to be closed to stop forwarding.
+func Forward(ctx context.Context, debuggerAddr string, spec Spec) (net.Listener, error) {
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", spec.HostPort))
+	if err != nil {
+		return nil, errors.Wrapf(err, "listen on port %d", spec.HostPort)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				// Listener closed.
+				return
+			}
+			go forwardConn(ctx, conn, debuggerAddr, spec)
+		}
+	}()
+	return l, nil
+}
+
+func forwardConn(ctx context.Context, conn net.Conn, debuggerAddr string, spec Spec) {
+	log := logging.GetLogger(ctx).With("port", spec.ContainerPort)
+	defer conn.Close()
+	var d net.Dialer
+	debuggerConn, err := d.DialContext(ctx, "tcp", debuggerAddr)
+	if err != nil {
+		log.Error(errors.Wrap(err, "failed to connect to remote debugger"))
+		return
+	}
+	defer debuggerConn.Close()
+	_, err = debuggerConn.Write([]byte{common.PortForwardID})
+	if err != nil {
+		log.Error(errors.Wrap(err, "failed to write PortForwardID connection"))
+		return
+	}
+	err = binary.Write(debuggerConn, binary.LittleEndian, spec.ContainerPort)
+	if err != nil {
+		log.Error(errors.Wrap(err, "failed to write forwarded port"))
+		return
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(debuggerConn, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, debuggerConn)
+		done <- struct{}{}
+	}()
+	<-done
+}
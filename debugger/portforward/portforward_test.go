@@ -0,0 +1,89 @@
+package portforward
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/earthly/earthly/debugger/server"
+)
+
+func TestParseSpec(t *testing.T) {
+	spec, err := ParseSpec("8080:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.HostPort != 8080 || spec.ContainerPort != 80 {
+		t.Errorf("unexpected spec %v", spec)
+	}
+	spec, err = ParseSpec("9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.HostPort != 9000 || spec.ContainerPort != 9000 {
+		t.Errorf("unexpected spec %v", spec)
+	}
+	for _, invalid := range []string{"", "abc", "0", "70000", "80:"} {
+		_, err = ParseSpec(invalid)
+		if err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestForward(t *testing.T) {
+	// An echo server, standing in for a server within the build environment.
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	echoPort := uint16(echo.Addr().(*net.TCPAddr).Port)
+
+	debuggerListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	debuggerAddr := debuggerListener.Addr().String()
+	s := server.NewServer(debuggerAddr)
+	go s.Serve(debuggerListener)
+
+	// Port 0 has the forwarder listen on a free port.
+	l, err := Forward(context.Background(), debuggerAddr, Spec{HostPort: 0, ContainerPort: echoPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	inputStr := "hello world"
+	_, err = conn.Write([]byte(inputStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(inputStr))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != inputStr {
+		t.Fatalf("want %v; got %v", inputStr, string(buf))
+	}
+}
@@ -2,12 +2,20 @@ package server
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"sync"
+	"time"
+
+	"github.com/earthly/earthly/debugger/common"
 )
 
+// attachAckTimeout is how long to wait for a step to acknowledge an attach session.
+const attachAckTimeout = 2 * time.Second
+
 // Server provides a debugger server
 type Server struct {
 	shellConn    net.Conn
@@ -19,6 +27,19 @@ type Server struct {
 
 	sigs chan os.Signal
 	addr string
+
+	// attachables holds the steps which may be attached to, by build ID, in the order
+	// they were registered.
+	attachables map[string][]*attachable
+}
+
+// attachable is a step of a build which may be attached to.
+type attachable struct {
+	conn net.Conn
+	// ready is signalled once the step has acknowledged the start of a shell session.
+	ready chan struct{}
+	// done is closed once the attach session is over.
+	done chan struct{}
 }
 
 func (s *Server) handleConn(conn net.Conn, readFrom, writeTo chan []byte) {
@@ -82,6 +103,15 @@ func (s *Server) handleRequest(conn net.Conn) {
 		isShellConn = true
 	case 0x02:
 		isShellConn = false
+	case common.PortForwardID:
+		s.handlePortForwardConn(conn)
+		return
+	case common.AttachableID:
+		s.handleAttachableConn(conn)
+		return
+	case common.AttachID:
+		s.handleAttachConn(conn)
+		return
 	default:
 		fmt.Fprintf(os.Stderr, "unexpected data: %v", buf[0])
 		return
@@ -112,12 +142,161 @@ func (s *Server) handleRequest(conn net.Conn) {
 	}
 }
 
+// handlePortForwardConn connects conn to the requested port within the build
+// environment, which shares the network of the server.
+func (s *Server) handlePortForwardConn(conn net.Conn) {
+	var port uint16
+	err := binary.Read(conn, binary.LittleEndian, &port)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read forwarded port: %v\n", err)
+		return
+	}
+	targetConn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to connect to forwarded port %d: %v\n", port, err)
+		return
+	}
+	defer targetConn.Close()
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(targetConn, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, targetConn)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func readBuildID(conn net.Conn) (string, error) {
+	dataType, data, err := common.ReadDataPacket(conn)
+	if err != nil {
+		return "", err
+	}
+	if dataType != common.BuildIDData {
+		return "", fmt.Errorf("unexpected data type %d, expected build ID", dataType)
+	}
+	return string(data), nil
+}
+
+// handleAttachableConn registers a step which may be attached to, until it finishes
+// or until an attach session with it is over.
+func (s *Server) handleAttachableConn(conn net.Conn) {
+	buildID, err := readBuildID(conn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read attachable build ID: %v\n", err)
+		return
+	}
+	a := &attachable{
+		conn:  conn,
+		ready: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+	s.mux.Lock()
+	s.attachables[buildID] = append(s.attachables[buildID], a)
+	s.mux.Unlock()
+
+	// The step only sends data once asked to start a shell session. An error here
+	// means that the step has finished.
+	dataType, _, err := common.ReadDataPacket(conn)
+	if err != nil || dataType != common.StartShellSession {
+		s.removeAttachable(buildID, a)
+		return
+	}
+	a.ready <- struct{}{}
+	<-a.done
+}
+
+func (s *Server) removeAttachable(buildID string, a *attachable) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	list := s.attachables[buildID]
+	for i, other := range list {
+		if other == a {
+			s.attachables[buildID] = append(list[:i:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(s.attachables[buildID]) == 0 {
+		delete(s.attachables, buildID)
+	}
+}
+
+// popAttachable returns the most recently registered step of the given build.
+func (s *Server) popAttachable(buildID string) (*attachable, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	list := s.attachables[buildID]
+	if len(list) == 0 {
+		return nil, false
+	}
+	a := list[len(list)-1]
+	s.attachables[buildID] = list[:len(list)-1]
+	if len(s.attachables[buildID]) == 0 {
+		delete(s.attachables, buildID)
+	}
+	return a, true
+}
+
+// handleAttachConn connects a terminal to the currently executing step of a build.
+func (s *Server) handleAttachConn(conn net.Conn) {
+	buildID, err := readBuildID(conn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read attach build ID: %v\n", err)
+		return
+	}
+	for {
+		a, ok := s.popAttachable(buildID)
+		if !ok {
+			msg := fmt.Sprintf("no step of build %s is currently running", buildID)
+			common.WriteDataPacket(conn, common.ErrorData, []byte(msg))
+			return
+		}
+		err = common.WriteDataPacket(a.conn, common.StartShellSession, nil)
+		if err == nil {
+			select {
+			case <-a.ready:
+			case <-time.After(attachAckTimeout):
+				err = fmt.Errorf("timeout waiting for the step to start a shell")
+			}
+		}
+		if err != nil {
+			// The step has likely finished in the meantime. Try the next one.
+			close(a.done)
+			continue
+		}
+		err = common.WriteDataPacket(conn, common.StartShellSession, nil)
+		if err != nil {
+			close(a.done)
+			return
+		}
+		done := make(chan struct{}, 2)
+		go func() {
+			io.Copy(a.conn, conn)
+			done <- struct{}{}
+		}()
+		go func() {
+			io.Copy(conn, a.conn)
+			done <- struct{}{}
+		}()
+		<-done
+		close(a.done)
+		return
+	}
+}
+
 // Start starts the debug server listener
 func (s *Server) Start() error {
 	l, err := net.Listen("tcp", s.addr)
 	if err != nil {
 		return err
 	}
+	return s.Serve(l)
+}
+
+// Serve serves the connections accepted by the listener, until it is closed.
+func (s *Server) Serve(l net.Listener) error {
 	defer l.Close()
 
 	for {
@@ -137,5 +316,6 @@ func NewServer(addr string) *Server {
 		addr:            addr,
 		dataForShell:    make(chan []byte, 100),
 		dataForTerminal: make(chan []byte, 100),
+		attachables:     make(map[string][]*attachable),
 	}
 }
@@ -57,3 +57,96 @@ func TestServer(t *testing.T) {
 	}
 
 }
+
+func TestServerAttach(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	s := NewServer(addr)
+	go s.Serve(l)
+
+	// no step registered yet
+	termConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = termConn.Write([]byte{common.AttachID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = common.WriteDataPacket(termConn, common.BuildIDData, []byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataType, _, err := common.ReadDataPacket(termConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dataType != common.ErrorData {
+		t.Fatalf("want error data; got %v", dataType)
+	}
+	termConn.Close()
+
+	// register the step
+	stepConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = stepConn.Write([]byte{common.AttachableID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = common.WriteDataPacket(stepConn, common.BuildIDData, []byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// then attach
+	termConn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer termConn.Close()
+	_, err = termConn.Write([]byte{common.AttachID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = common.WriteDataPacket(termConn, common.BuildIDData, []byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataType, _, err = common.ReadDataPacket(stepConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dataType != common.StartShellSession {
+		t.Fatalf("want start shell session; got %v", dataType)
+	}
+	err = common.WriteDataPacket(stepConn, common.StartShellSession, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = common.WriteDataPacket(stepConn, common.PtyData, []byte("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataType, _, err = common.ReadDataPacket(termConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dataType != common.StartShellSession {
+		t.Fatalf("want start shell session; got %v", dataType)
+	}
+	dataType, data, err := common.ReadDataPacket(termConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dataType != common.PtyData || string(data) != "hello world" {
+		t.Fatalf("want pty data hello world; got %v %q", dataType, string(data))
+	}
+}
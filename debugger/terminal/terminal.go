@@ -48,8 +48,6 @@ func getWindowSizePayload() ([]byte, error) {
 
 // ConnectTerm presents a terminal to the shell repeater
 func ConnectTerm(ctx context.Context, addr string) error {
-	log := logging.GetLogger(ctx)
-
 	var d net.Dialer
 
 	conn, err := d.DialContext(ctx, "tcp", addr)
@@ -62,6 +60,35 @@ func ConnectTerm(ctx context.Context, addr string) error {
 	if err != nil {
 		return errors.Wrap(err, "failed to write TermID connection")
 	}
+	return runTerm(ctx, conn, false)
+}
+
+// Attach presents a terminal attached to the currently executing step of the build
+// with the given ID. It returns once the shell session is over.
+func Attach(ctx context.Context, addr string, buildID string) error {
+	var d net.Dialer
+
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to remote debugger")
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte{common.AttachID})
+	if err != nil {
+		return errors.Wrap(err, "failed to write AttachID connection")
+	}
+	err = common.WriteDataPacket(conn, common.BuildIDData, []byte(buildID))
+	if err != nil {
+		return errors.Wrap(err, "failed to write build ID")
+	}
+	return runTerm(ctx, conn, true)
+}
+
+// runTerm connects stdin and stdout to the shell sessions received over conn. If
+// singleSession is set, it returns once the first session is over.
+func runTerm(ctx context.Context, conn net.Conn, singleSession bool) error {
+	log := logging.GetLogger(ctx)
 
 	sigs := make(chan os.Signal, 10)
 	signal.Notify(sigs, syscall.SIGWINCH)
@@ -71,6 +98,7 @@ func ConnectTerm(ctx context.Context, addr string) error {
 	ctx, cancel := context.WithCancel(ctx)
 
 	ts := &termState{}
+	remoteErrCh := make(chan error, 1)
 	go func() {
 	outer:
 		for {
@@ -93,6 +121,12 @@ func ConnectTerm(ctx context.Context, addr string) error {
 					log.Error(err)
 					break outer
 				}
+				if singleSession {
+					break outer
+				}
+			case common.ErrorData:
+				remoteErrCh <- errors.New(string(data))
+				break outer
 			case common.PtyData:
 				err := handlePtyData(data)
 				if err != nil {
@@ -158,8 +192,13 @@ func ConnectTerm(ctx context.Context, addr string) error {
 	}()
 
 	<-ctx.Done()
+	select {
+	case err := <-remoteErrCh:
+		return err
+	default:
+	}
 	fmt.Fprintf(os.Stderr, "exiting interactive debugger shell\n")
-	err = ts.restore()
+	err := ts.restore()
 	if err != nil {
 		return err
 	}
@@ -20,33 +20,168 @@ func GetID(tarFilePath string) (string, error) {
 		return "", errors.Wrapf(err, "open file %s for reading", tarFilePath)
 	}
 	defer tarFile.Close()
-	bufTarFile := bufio.NewReader(tarFile)
-	tarR := tar.NewReader(bufTarFile)
+	id, err := GetIDFromReader(bufio.NewReader(tarFile))
+	if err != nil {
+		return "", errors.Wrapf(err, "tar %s", tarFilePath)
+	}
+	return id, nil
+}
+
+// maxBlobSize is the maximum size of blobs kept in memory while looking for the
+// manifest of an OCI archive. Manifests and indexes are small JSON documents.
+const maxBlobSize = 4 * 1024 * 1024
+
+// GetIDFromReader returns the docker sha256 ID of the image stored within the tar
+// stream r. Both docker archives (manifest.json based) and OCI archives (index.json
+// based) are supported. For docker archives, the stream is only read up to the
+// manifest.
+func GetIDFromReader(r io.Reader) (string, error) {
+	tarR := tar.NewReader(r)
+	var indexDt []byte
+	blobs := make(map[string][]byte)
 	for {
 		header, err := tarR.Next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return "", errors.Wrapf(err, "reading tar %s", tarFilePath)
+			return "", errors.Wrap(err, "reading tar")
+		}
+		if header.FileInfo().IsDir() {
+			continue
 		}
-		if header.Name == "manifest.json" && !header.FileInfo().IsDir() {
+		name := strings.TrimPrefix(header.Name, "./")
+		switch {
+		case name == "manifest.json":
 			dt, err := ioutil.ReadAll(tarR)
 			if err != nil {
-				return "", errors.Wrapf(err, "read manifest.json from tar %s", tarFilePath)
+				return "", errors.Wrap(err, "read manifest.json from tar")
 			}
-			var jsonData []struct {
-				Config string `json:"Config"`
-			}
-			err = json.Unmarshal(dt, &jsonData)
+			return parseManifest(dt)
+		case name == "index.json":
+			indexDt, err = ioutil.ReadAll(tarR)
 			if err != nil {
-				return "", errors.Wrapf(err, "unmarshal json tar manifest for %s", tarFilePath)
+				return "", errors.Wrap(err, "read index.json from tar")
 			}
-			if len(jsonData) != 1 {
-				return "", fmt.Errorf("Unexpected len != 1 docker manifest in %s", tarFilePath)
+		case strings.HasPrefix(name, "blobs/") && header.Size <= maxBlobSize:
+			parts := strings.Split(name, "/")
+			if len(parts) != 3 {
+				continue
 			}
-			return strings.TrimSuffix(jsonData[0].Config, ".json"), nil
+			dt, err := ioutil.ReadAll(tarR)
+			if err != nil {
+				return "", errors.Wrapf(err, "read %s from tar", name)
+			}
+			blobs[fmt.Sprintf("%s:%s", parts[1], parts[2])] = dt
 		}
 	}
-	return "", fmt.Errorf("Docker tar manifest.json not found in tar %s", tarFilePath)
+	if indexDt != nil {
+		return parseOCIIndex(indexDt, blobs)
+	}
+	return "", errors.New("Neither docker manifest.json nor OCI index.json found in tar")
+}
+
+func parseManifest(dt []byte) (string, error) {
+	var jsonData []struct {
+		Config string `json:"Config"`
+	}
+	err := json.Unmarshal(dt, &jsonData)
+	if err != nil {
+		return "", errors.Wrap(err, "unmarshal json tar manifest")
+	}
+	if len(jsonData) != 1 {
+		return "", fmt.Errorf("Unexpected len != 1 docker manifest")
+	}
+	config := strings.TrimSuffix(jsonData[0].Config, ".json")
+	// Newer docker archives reference the config as an OCI blob.
+	config = strings.Replace(strings.TrimPrefix(config, "blobs/"), "/", ":", 1)
+	return config, nil
+}
+
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+}
+
+type ociManifestOrIndex struct {
+	// Manifests is set for indexes.
+	Manifests []ociDescriptor `json:"manifests"`
+	// Config is set for image manifests.
+	Config *ociDescriptor `json:"config"`
+}
+
+// parseOCIIndex follows the OCI index (and any nested indexes) down to the image
+// manifest and returns the digest of the image config, which is the image ID.
+func parseOCIIndex(dt []byte, blobs map[string][]byte) (string, error) {
+	// Limit the depth of nested indexes.
+	for depth := 0; depth < 8; depth++ {
+		var m ociManifestOrIndex
+		err := json.Unmarshal(dt, &m)
+		if err != nil {
+			return "", errors.Wrap(err, "unmarshal OCI index or manifest")
+		}
+		if m.Config != nil {
+			return m.Config.Digest, nil
+		}
+		if len(m.Manifests) != 1 {
+			return "", fmt.Errorf("Unexpected len %d != 1 OCI index manifests", len(m.Manifests))
+		}
+		var ok bool
+		dt, ok = blobs[m.Manifests[0].Digest]
+		if !ok {
+			return "", fmt.Errorf("OCI manifest blob %s not found in tar", m.Manifests[0].Digest)
+		}
+	}
+	return "", errors.New("OCI index nested too deeply")
+}
+
+// Inspector extracts the docker image ID from a tar stream written to it, such
+// that the ID is known once the stream has been passed on (eg to a file or to
+// docker load), without having to read the tar again.
+type Inspector struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	id   string
+	err  error
+}
+
+// NewInspector creates a new Inspector. Close must be called once the whole tar
+// has been written.
+func NewInspector() *Inspector {
+	pr, pw := io.Pipe()
+	ins := &Inspector{
+		pw:   pw,
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(ins.done)
+		ins.id, ins.err = GetIDFromReader(pr)
+		// Drain the remainder, so that writes never block.
+		_, _ = io.Copy(ioutil.Discard, pr)
+		pr.Close()
+	}()
+	return ins
+}
+
+// Write implements io.Writer.
+func (ins *Inspector) Write(p []byte) (int, error) {
+	n, err := ins.pw.Write(p)
+	if err == io.ErrClosedPipe {
+		// The inspector is no longer interested in the stream.
+		return len(p), nil
+	}
+	return n, err
+}
+
+// Close signals the end of the tar stream and waits for the inspection to finish.
+func (ins *Inspector) Close() error {
+	err := ins.pw.Close()
+	<-ins.done
+	return err
+}
+
+// ID returns the docker image ID found in the tar stream. It must only be called
+// after Close.
+func (ins *Inspector) ID() (string, error) {
+	return ins.id, ins.err
 }
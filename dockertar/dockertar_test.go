@@ -0,0 +1,95 @@
+package dockertar
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+)
+
+func makeTar(t *testing.T, files map[string]string, order []string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range order {
+		content := files[name]
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tw.Write([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestInspector(t *testing.T) {
+	files := map[string]string{
+		"layer.tar":     string(bytes.Repeat([]byte("x"), 100000)),
+		"manifest.json": `[{"Config":"sha256:abcd.json","RepoTags":["foo:latest"]}]`,
+		"other":         "trailing",
+	}
+	dt := makeTar(t, files, []string{"layer.tar", "manifest.json", "other"})
+
+	ins := NewInspector()
+	var out bytes.Buffer
+	_, err := io.Copy(io.MultiWriter(&out, ins), bytes.NewReader(dt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ins.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := ins.ID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "sha256:abcd" {
+		t.Errorf("unexpected id %s", id)
+	}
+	if !bytes.Equal(out.Bytes(), dt) {
+		t.Error("tar stream was not passed through unchanged")
+	}
+}
+
+func TestInspectorNoManifest(t *testing.T) {
+	dt := makeTar(t, map[string]string{"a": "b"}, []string{"a"})
+	ins := NewInspector()
+	_, err := ins.Write(dt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ins.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ins.ID()
+	if err == nil {
+		t.Error("expected error for tar without manifest")
+	}
+}
+
+func TestGetIDFromReaderOCI(t *testing.T) {
+	files := map[string]string{
+		"oci-layout":          `{"imageLayoutVersion":"1.0.0"}`,
+		"index.json":          `{"schemaVersion":2,"manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"sha256:1111"}]}`,
+		"blobs/sha256/1111":   `{"schemaVersion":2,"config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:2222"}}`,
+		"blobs/sha256/2222":   `{}`,
+		"blobs/sha256/layer0": string(bytes.Repeat([]byte("x"), 1000)),
+	}
+	// OCI archives may list blobs after the index.
+	dt := makeTar(t, files, []string{"oci-layout", "index.json", "blobs/sha256/layer0", "blobs/sha256/2222", "blobs/sha256/1111"})
+	id, err := GetIDFromReader(bytes.NewReader(dt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "sha256:2222" {
+		t.Errorf("unexpected id %s", id)
+	}
+}
@@ -0,0 +1,625 @@
+package dockertar
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// Media types of the uncompressed and gzip-compressed layers, which Normalize supports.
+const (
+	mediaTypeDockerLayer     = "application/vnd.docker.image.rootfs.diff.tar"
+	mediaTypeDockerLayerGzip = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+)
+
+// configFieldsStripped are the fields of image configs which describe the host the image
+// was built on, rather than the image.
+var configFieldsStripped = []string{"container", "container_config", "docker_version"}
+
+// Normalize rewrites the image archive read from r (a docker archive or an OCI archive,
+// as written by buildkit) to w, such that the same image contents always result in the
+// same image ID and layer digests:
+//   - the entries of the layers are sorted by path, and their timestamps are set to epoch;
+//   - the layers are recompressed deterministically;
+//   - the created times of the image config and of its history are set to epoch, and the
+//     fields describing the build host are removed;
+//   - the entries of the archive itself are sorted, with fixed metadata.
+//
+// Only single-platform images with uncompressed or gzip-compressed layers are supported.
+func Normalize(r io.Reader, w io.Writer, epoch time.Time) error {
+	epoch = epoch.UTC()
+	tmpDir, err := ioutil.TempDir("", "earthly-normalize")
+	if err != nil {
+		return errors.Wrap(err, "create temp dir")
+	}
+	defer os.RemoveAll(tmpDir)
+	a, err := readArchive(r, tmpDir)
+	if err != nil {
+		return err
+	}
+	err = a.normalize(epoch)
+	if err != nil {
+		return err
+	}
+	return a.write(w, epoch)
+}
+
+// archive is an image archive, whose blobs are stored in a temp dir.
+type archive struct {
+	tmpDir       string
+	ociLayout    []byte
+	index        []byte
+	manifestJSON []byte
+	// blobs are the paths of the blobs within tmpDir, by digest.
+	blobs map[digest.Digest]string
+}
+
+func readArchive(r io.Reader, tmpDir string) (*archive, error) {
+	a := &archive{
+		tmpDir: tmpDir,
+		blobs:  make(map[digest.Digest]string),
+	}
+	tarR := tar.NewReader(r)
+	for {
+		header, err := tarR.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "reading tar")
+		}
+		if header.FileInfo().IsDir() {
+			continue
+		}
+		name := strings.TrimPrefix(header.Name, "./")
+		switch {
+		case name == "oci-layout":
+			a.ociLayout, err = ioutil.ReadAll(tarR)
+		case name == "index.json":
+			a.index, err = ioutil.ReadAll(tarR)
+		case name == "manifest.json":
+			a.manifestJSON, err = ioutil.ReadAll(tarR)
+		case strings.HasPrefix(name, "blobs/"):
+			parts := strings.Split(name, "/")
+			if len(parts) != 3 {
+				return nil, fmt.Errorf("unexpected blob %s in tar", name)
+			}
+			dgst := digest.NewDigestFromEncoded(digest.Algorithm(parts[1]), parts[2])
+			_, err = a.storeBlob(dgst, tarR)
+		default:
+			return nil, fmt.Errorf("unexpected file %s in tar", name)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "read %s from tar", name)
+		}
+	}
+	if a.index == nil {
+		return nil, errors.New("OCI index.json not found in tar")
+	}
+	return a, nil
+}
+
+// storeBlob copies the blob read from r to the temp dir.
+func (a *archive) storeBlob(dgst digest.Digest, r io.Reader) (string, error) {
+	err := dgst.Validate()
+	if err != nil {
+		return "", err
+	}
+	p := filepath.Join(a.tmpDir, fmt.Sprintf("%s-%s", dgst.Algorithm(), dgst.Encoded()))
+	f, err := os.Create(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return "", err
+	}
+	a.blobs[dgst] = p
+	return p, nil
+}
+
+func (a *archive) readBlob(dgst digest.Digest) ([]byte, error) {
+	p, ok := a.blobs[dgst]
+	if !ok {
+		return nil, fmt.Errorf("blob %s not found in tar", dgst)
+	}
+	return ioutil.ReadFile(p)
+}
+
+// putBlob stores the given blob and returns its descriptor, based on desc.
+func (a *archive) putBlob(dt []byte, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	desc.Digest = digest.FromBytes(dt)
+	desc.Size = int64(len(dt))
+	p := filepath.Join(a.tmpDir, fmt.Sprintf("%s-%s", desc.Digest.Algorithm(), desc.Digest.Encoded()))
+	err := ioutil.WriteFile(p, dt, 0644)
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrapf(err, "write blob %s", desc.Digest)
+	}
+	a.blobs[desc.Digest] = p
+	return desc, nil
+}
+
+func (a *archive) normalize(epoch time.Time) error {
+	var index ocispec.Index
+	err := json.Unmarshal(a.index, &index)
+	if err != nil {
+		return errors.Wrap(err, "unmarshal OCI index")
+	}
+	if len(index.Manifests) == 0 {
+		return errors.New("no OCI index manifests")
+	}
+	// An image exported with several names has one index entry per name, all of the
+	// same manifest.
+	for _, desc := range index.Manifests[1:] {
+		if desc.Digest != index.Manifests[0].Digest {
+			return errors.New("unexpected OCI index manifests of different images")
+		}
+	}
+	manifestDt, err := a.readBlob(index.Manifests[0].Digest)
+	if err != nil {
+		return err
+	}
+	// The manifest is kept as a generic object, to preserve the fields unknown to the
+	// OCI spec (such as the media type of docker manifests).
+	var manifestObj map[string]json.RawMessage
+	err = json.Unmarshal(manifestDt, &manifestObj)
+	if err != nil {
+		return errors.Wrap(err, "unmarshal image manifest")
+	}
+	var manifest ocispec.Manifest
+	err = json.Unmarshal(manifestDt, &manifest)
+	if err != nil {
+		return errors.Wrap(err, "unmarshal image manifest")
+	}
+	if len(manifest.Layers) == 0 && manifest.Config.Digest == "" {
+		return errors.New("multi-platform images are not supported")
+	}
+	var diffIDs []digest.Digest
+	for i, layer := range manifest.Layers {
+		newLayer, diffID, err := a.normalizeLayer(layer, epoch)
+		if err != nil {
+			return errors.Wrapf(err, "normalize layer %s", layer.Digest)
+		}
+		manifest.Layers[i] = newLayer
+		diffIDs = append(diffIDs, diffID)
+	}
+	configDt, err := a.readBlob(manifest.Config.Digest)
+	if err != nil {
+		return err
+	}
+	configDt, err = normalizeConfig(configDt, diffIDs, epoch)
+	if err != nil {
+		return err
+	}
+	manifest.Config, err = a.putBlob(configDt, manifest.Config)
+	if err != nil {
+		return err
+	}
+	manifestObj["config"], err = json.Marshal(manifest.Config)
+	if err != nil {
+		return errors.Wrap(err, "marshal config descriptor")
+	}
+	manifestObj["layers"], err = json.Marshal(manifest.Layers)
+	if err != nil {
+		return errors.Wrap(err, "marshal layer descriptors")
+	}
+	manifestDt, err = json.Marshal(manifestObj)
+	if err != nil {
+		return errors.Wrap(err, "marshal image manifest")
+	}
+	manifestDesc, err := a.putBlob(manifestDt, index.Manifests[0])
+	if err != nil {
+		return err
+	}
+	for i, desc := range index.Manifests {
+		desc.Digest = manifestDesc.Digest
+		desc.Size = manifestDesc.Size
+		if _, ok := desc.Annotations[ocispec.AnnotationCreated]; ok {
+			desc.Annotations[ocispec.AnnotationCreated] = epoch.UTC().Format(time.RFC3339)
+		}
+		index.Manifests[i] = desc
+	}
+	a.index, err = json.Marshal(index)
+	if err != nil {
+		return errors.Wrap(err, "marshal OCI index")
+	}
+	if a.manifestJSON != nil {
+		a.manifestJSON, err = normalizeDockerManifest(a.manifestJSON, manifest)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizeConfig sets the created times of the image config and of its history to
+// epoch, and the diff IDs of its layers to those given.
+func normalizeConfig(dt []byte, diffIDs []digest.Digest, epoch time.Time) ([]byte, error) {
+	var config map[string]json.RawMessage
+	err := json.Unmarshal(dt, &config)
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshal image config")
+	}
+	var history []ocispec.History
+	if config["history"] != nil {
+		err = json.Unmarshal(config["history"], &history)
+		if err != nil {
+			return nil, errors.Wrap(err, "unmarshal image history")
+		}
+	}
+	for i := range history {
+		history[i].Created = &epoch
+	}
+	for _, field := range configFieldsStripped {
+		delete(config, field)
+	}
+	config["created"], err = json.Marshal(epoch)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal created time")
+	}
+	config["history"], err = json.Marshal(history)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal image history")
+	}
+	config["rootfs"], err = json.Marshal(ocispec.RootFS{Type: "layers", DiffIDs: diffIDs})
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal image rootfs")
+	}
+	dt, err = json.Marshal(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal image config")
+	}
+	return dt, nil
+}
+
+// normalizeDockerManifest points the manifest.json of docker archives to the
+// normalized config and layers.
+func normalizeDockerManifest(dt []byte, manifest ocispec.Manifest) ([]byte, error) {
+	var dockerManifest []map[string]json.RawMessage
+	err := json.Unmarshal(dt, &dockerManifest)
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshal json tar manifest")
+	}
+	if len(dockerManifest) != 1 {
+		return nil, fmt.Errorf("Unexpected len != 1 docker manifest")
+	}
+	dockerManifest[0]["Config"], err = json.Marshal(blobPath(manifest.Config.Digest))
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal docker manifest config")
+	}
+	var layers []string
+	for _, layer := range manifest.Layers {
+		layers = append(layers, blobPath(layer.Digest))
+	}
+	dockerManifest[0]["Layers"], err = json.Marshal(layers)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal docker manifest layers")
+	}
+	dt, err = json.Marshal(dockerManifest)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal json tar manifest")
+	}
+	return dt, nil
+}
+
+// layerEntry is an entry of a layer, whose contents are spooled to a temp file.
+type layerEntry struct {
+	header *tar.Header
+	offset int64
+}
+
+// normalizeLayer rewrites the layer with sorted entries and fixed timestamps. It
+// returns the descriptor of the new layer, as well as its diff ID.
+func (a *archive) normalizeLayer(desc ocispec.Descriptor, epoch time.Time) (ocispec.Descriptor, digest.Digest, error) {
+	var compressed bool
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageLayerGzip, mediaTypeDockerLayerGzip:
+		compressed = true
+	case ocispec.MediaTypeImageLayer, mediaTypeDockerLayer:
+	default:
+		return ocispec.Descriptor{}, "", fmt.Errorf("unsupported layer media type %s", desc.MediaType)
+	}
+	p, ok := a.blobs[desc.Digest]
+	if !ok {
+		return ocispec.Descriptor{}, "", fmt.Errorf("blob %s not found in tar", desc.Digest)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if compressed {
+		gzR, err := gzip.NewReader(f)
+		if err != nil {
+			return ocispec.Descriptor{}, "", errors.Wrap(err, "gzip reader")
+		}
+		defer gzR.Close()
+		r = gzR
+	}
+	spool, err := ioutil.TempFile(a.tmpDir, "layer")
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	defer spool.Close()
+	entries, err := spoolLayer(r, spool)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	out, err := ioutil.TempFile(a.tmpDir, "layer")
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	defer out.Close()
+	blobDigester := digest.Canonical.Digester()
+	counter := &countingWriter{w: io.MultiWriter(out, blobDigester.Hash())}
+	var tarOut io.Writer = counter
+	var gzW *gzip.Writer
+	if compressed {
+		// The gzip header is left without name and timestamp.
+		gzW = gzip.NewWriter(counter)
+		tarOut = gzW
+	}
+	diffIDDigester := digest.Canonical.Digester()
+	err = writeLayer(io.MultiWriter(tarOut, diffIDDigester.Hash()), spool, entries, epoch)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	if gzW != nil {
+		err = gzW.Close()
+		if err != nil {
+			return ocispec.Descriptor{}, "", errors.Wrap(err, "gzip close")
+		}
+	}
+	desc.Digest = blobDigester.Digest()
+	desc.Size = counter.n
+	newPath := filepath.Join(a.tmpDir, fmt.Sprintf("%s-%s", desc.Digest.Algorithm(), desc.Digest.Encoded()))
+	err = os.Rename(out.Name(), newPath)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	a.blobs[desc.Digest] = newPath
+	return desc, diffIDDigester.Digest(), nil
+}
+
+// spoolLayer copies the contents of the entries of the layer tar read from r to spool,
+// and returns the entries, sorted by path.
+func spoolLayer(r io.Reader, spool *os.File) ([]layerEntry, error) {
+	var entries []layerEntry
+	var offset int64
+	tarR := tar.NewReader(r)
+	for {
+		header, err := tarR.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "reading layer tar")
+		}
+		n, err := io.Copy(spool, tarR)
+		if err != nil {
+			return nil, errors.Wrap(err, "spool layer tar")
+		}
+		entries = append(entries, layerEntry{header: header, offset: offset})
+		offset += n
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].header.Name < entries[j].header.Name
+	})
+	return entries, nil
+}
+
+// writeLayer writes the layer tar of the given entries, in order, except that hard
+// links are written right after their targets, when these come later.
+func writeLayer(w io.Writer, spool *os.File, entries []layerEntry, epoch time.Time) error {
+	tarW := tar.NewWriter(w)
+	names := make(map[string]bool)
+	for _, e := range entries {
+		names[e.header.Name] = true
+	}
+	written := make(map[string]bool)
+	pendingLinks := make(map[string][]layerEntry)
+	var write func(e layerEntry) error
+	write = func(e layerEntry) error {
+		h := normalizeHeader(e.header, epoch)
+		err := tarW.WriteHeader(h)
+		if err != nil {
+			return errors.Wrapf(err, "write header %s", h.Name)
+		}
+		if h.Size > 0 {
+			_, err = io.Copy(tarW, io.NewSectionReader(spool, e.offset, h.Size))
+			if err != nil {
+				return errors.Wrapf(err, "write %s", h.Name)
+			}
+		}
+		written[h.Name] = true
+		for _, link := range pendingLinks[h.Name] {
+			err = write(link)
+			if err != nil {
+				return err
+			}
+		}
+		delete(pendingLinks, h.Name)
+		return nil
+	}
+	for _, e := range entries {
+		if e.header.Typeflag == tar.TypeLink && names[e.header.Linkname] && !written[e.header.Linkname] {
+			pendingLinks[e.header.Linkname] = append(pendingLinks[e.header.Linkname], e)
+			continue
+		}
+		err := write(e)
+		if err != nil {
+			return err
+		}
+	}
+	return tarW.Close()
+}
+
+// normalizeHeader returns a copy of the header with its timestamps set to epoch.
+func normalizeHeader(header *tar.Header, epoch time.Time) *tar.Header {
+	h := *header
+	h.ModTime = epoch
+	h.AccessTime = time.Time{}
+	h.ChangeTime = time.Time{}
+	if h.PAXRecords != nil {
+		h.PAXRecords = make(map[string]string)
+		for k, v := range header.PAXRecords {
+			switch k {
+			case "atime", "ctime", "mtime":
+			default:
+				h.PAXRecords[k] = v
+			}
+		}
+	}
+	return &h
+}
+
+// write writes the archive, with its entries sorted and fixed metadata.
+func (a *archive) write(w io.Writer, epoch time.Time) error {
+	tarW := tar.NewWriter(w)
+	writeFile := func(name string, dt []byte) error {
+		err := tarW.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(dt)),
+			ModTime:  epoch,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "write header %s", name)
+		}
+		_, err = tarW.Write(dt)
+		return errors.Wrapf(err, "write %s", name)
+	}
+	writeDir := func(name string) error {
+		err := tarW.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     name,
+			Mode:     0755,
+			ModTime:  epoch,
+		})
+		return errors.Wrapf(err, "write header %s", name)
+	}
+	if a.ociLayout != nil {
+		err := writeFile("oci-layout", a.ociLayout)
+		if err != nil {
+			return err
+		}
+	}
+	err := writeFile("index.json", a.index)
+	if err != nil {
+		return err
+	}
+	if a.manifestJSON != nil {
+		err = writeFile("manifest.json", a.manifestJSON)
+		if err != nil {
+			return err
+		}
+	}
+	// Only the blobs referenced by the normalized image are written.
+	referenced, err := a.referencedBlobs()
+	if err != nil {
+		return err
+	}
+	err = writeDir("blobs/")
+	if err != nil {
+		return err
+	}
+	algDirs := make(map[digest.Algorithm]bool)
+	for _, dgst := range referenced {
+		if !algDirs[dgst.Algorithm()] {
+			algDirs[dgst.Algorithm()] = true
+			err = writeDir(fmt.Sprintf("blobs/%s/", dgst.Algorithm()))
+			if err != nil {
+				return err
+			}
+		}
+		err = a.writeBlob(tarW, dgst, epoch)
+		if err != nil {
+			return err
+		}
+	}
+	return tarW.Close()
+}
+
+func (a *archive) writeBlob(tarW *tar.Writer, dgst digest.Digest, epoch time.Time) error {
+	name := blobPath(dgst)
+	f, err := os.Open(a.blobs[dgst])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	err = tarW.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     fi.Size(),
+		ModTime:  epoch,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "write header %s", name)
+	}
+	_, err = io.Copy(tarW, f)
+	return errors.Wrapf(err, "write %s", name)
+}
+
+// referencedBlobs returns the digests of the manifest, config and layers of the image,
+// sorted.
+func (a *archive) referencedBlobs() ([]digest.Digest, error) {
+	var index ocispec.Index
+	err := json.Unmarshal(a.index, &index)
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshal OCI index")
+	}
+	manifestDt, err := a.readBlob(index.Manifests[0].Digest)
+	if err != nil {
+		return nil, err
+	}
+	var manifest ocispec.Manifest
+	err = json.Unmarshal(manifestDt, &manifest)
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshal image manifest")
+	}
+	seen := make(map[digest.Digest]bool)
+	var ret []digest.Digest
+	for _, desc := range append([]ocispec.Descriptor{index.Manifests[0], manifest.Config}, manifest.Layers...) {
+		if !seen[desc.Digest] {
+			seen[desc.Digest] = true
+			ret = append(ret, desc.Digest)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret, nil
+}
+
+func blobPath(dgst digest.Digest) string {
+	return fmt.Sprintf("blobs/%s/%s", dgst.Algorithm(), dgst.Encoded())
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
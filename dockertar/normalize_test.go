@@ -0,0 +1,285 @@
+package dockertar
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type layerFile struct {
+	name     string
+	linkname string
+	content  string
+	modTime  time.Time
+}
+
+// makeImageArchive returns a docker archive as written by buildkit, with a single
+// gzip-compressed layer holding the given files, in order.
+func makeImageArchive(t *testing.T, files []layerFile, created time.Time) []byte {
+	var layerBuf bytes.Buffer
+	gzW := gzip.NewWriter(&layerBuf)
+	tw := tar.NewWriter(gzW)
+	for _, f := range files {
+		h := &tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content)), ModTime: f.modTime}
+		if f.linkname != "" {
+			h = &tar.Header{Typeflag: tar.TypeLink, Name: f.name, Linkname: f.linkname, ModTime: f.modTime}
+		}
+		err := tw.WriteHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tw.Write([]byte(f.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzW.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layer := layerBuf.Bytes()
+	config := fmt.Sprintf(
+		`{"architecture":"amd64","os":"linux","created":%q,"history":[{"created":%q,"created_by":"RUN true"}],"rootfs":{"type":"layers","diff_ids":["sha256:0000"]}}`,
+		created.Format(time.RFC3339Nano), created.Format(time.RFC3339Nano))
+	configDgst := digest.FromString(config)
+	layerDgst := digest.FromBytes(layer)
+	manifest := fmt.Sprintf(
+		`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","config":{"mediaType":"application/vnd.docker.container.image.v1+json","digest":%q,"size":%d},"layers":[{"mediaType":"application/vnd.docker.image.rootfs.diff.tar.gzip","digest":%q,"size":%d}]}`,
+		configDgst, len(config), layerDgst, len(layer))
+	manifestDgst := digest.FromString(manifest)
+	index := fmt.Sprintf(
+		`{"schemaVersion":2,"manifests":[{"mediaType":"application/vnd.docker.distribution.manifest.v2+json","digest":%q,"size":%d}]}`,
+		manifestDgst, len(manifest))
+	manifestJSON := fmt.Sprintf(
+		`[{"Config":"blobs/sha256/%s","RepoTags":["foo:latest"],"Layers":["blobs/sha256/%s"]}]`,
+		configDgst.Encoded(), layerDgst.Encoded())
+	archiveFiles := map[string]string{
+		"oci-layout":           `{"imageLayoutVersion":"1.0.0"}`,
+		"index.json":           index,
+		"manifest.json":        manifestJSON,
+		blobPath(configDgst):   config,
+		blobPath(layerDgst):    string(layer),
+		blobPath(manifestDgst): manifest,
+	}
+	return makeTar(t, archiveFiles, []string{
+		blobPath(layerDgst), blobPath(configDgst), blobPath(manifestDgst), "oci-layout", "index.json", "manifest.json"})
+}
+
+func normalize(t *testing.T, dt []byte, epoch time.Time) []byte {
+	var out bytes.Buffer
+	err := Normalize(bytes.NewReader(dt), &out, epoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestNormalize(t *testing.T) {
+	epoch := time.Unix(1600000000, 0)
+	t1 := time.Date(2020, 10, 1, 12, 0, 0, 123, time.UTC)
+	t2 := time.Date(2020, 10, 2, 8, 30, 0, 0, time.UTC)
+	a := makeImageArchive(t, []layerFile{
+		{name: "b", content: "bbb", modTime: t1},
+		{name: "a", content: "aa", modTime: t1},
+		{name: "c", linkname: "b", modTime: t1},
+	}, t1)
+	b := makeImageArchive(t, []layerFile{
+		{name: "a", content: "aa", modTime: t2},
+		{name: "b", content: "bbb", modTime: t2},
+		{name: "c", linkname: "b", modTime: t2},
+	}, t2)
+	if bytes.Equal(a, b) {
+		t.Fatal("expected different archives")
+	}
+	normA := normalize(t, a, epoch)
+	normB := normalize(t, b, epoch)
+	if !bytes.Equal(normA, normB) {
+		t.Error("expected identical normalized archives")
+	}
+	// Normalizing is idempotent.
+	if !bytes.Equal(normalize(t, normA, epoch), normA) {
+		t.Error("expected normalizing a normalized archive to leave it unchanged")
+	}
+
+	id, err := GetIDFromReader(bytes.NewReader(normA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := readTar(t, normA)
+	var config ocispec.Image
+	err = json.Unmarshal(files[blobPath(digest.Digest(id))], &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.Created.Equal(epoch) || !config.History[0].Created.Equal(epoch) {
+		t.Errorf("unexpected created times %v, %v", config.Created, config.History[0].Created)
+	}
+	if len(config.RootFS.DiffIDs) != 1 {
+		t.Fatalf("unexpected diff IDs %v", config.RootFS.DiffIDs)
+	}
+	var manifest ocispec.Manifest
+	var index ocispec.Index
+	err = json.Unmarshal(files["index.json"], &index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(files[blobPath(index.Manifests[0].Digest)], &manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := files[blobPath(manifest.Layers[0].Digest)]
+	if digest.FromBytes(layer) != manifest.Layers[0].Digest || int64(len(layer)) != manifest.Layers[0].Size {
+		t.Error("layer does not match its descriptor")
+	}
+	gzR, err := gzip.NewReader(bytes.NewReader(layer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layerTar, err := ioutil.ReadAll(gzR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest.FromBytes(layerTar) != config.RootFS.DiffIDs[0] {
+		t.Error("layer does not match its diff ID")
+	}
+	tarR := tar.NewReader(bytes.NewReader(layerTar))
+	var names []string
+	for {
+		h, err := tarR.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !h.ModTime.Equal(epoch) {
+			t.Errorf("unexpected mtime %v of %s", h.ModTime, h.Name)
+		}
+		names = append(names, h.Name)
+	}
+	if fmt.Sprint(names) != "[a b c]" {
+		t.Errorf("unexpected layer entries %v", names)
+	}
+}
+
+func TestNormalizeHardLinkOrder(t *testing.T) {
+	// The hard link sorts before its target.
+	dt := makeImageArchive(t, []layerFile{
+		{name: "z", content: "zzz"},
+		{name: "a", linkname: "z"},
+	}, time.Now())
+	norm := normalize(t, dt, time.Unix(0, 0))
+	files := readTar(t, norm)
+	var index ocispec.Index
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(files["index.json"], &index); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(files[blobPath(index.Manifests[0].Digest)], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	gzR, err := gzip.NewReader(bytes.NewReader(files[blobPath(manifest.Layers[0].Digest)]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarR := tar.NewReader(gzR)
+	var names []string
+	for {
+		h, err := tarR.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, h.Name)
+	}
+	if fmt.Sprint(names) != "[z a]" {
+		t.Errorf("unexpected layer entries %v", names)
+	}
+}
+
+func TestNormalizeMultipleNames(t *testing.T) {
+	// Images exported with several names have one index entry per name.
+	withNames := func(dt []byte, created time.Time) []byte {
+		files := readTar(t, dt)
+		var index ocispec.Index
+		if err := json.Unmarshal(files["index.json"], &index); err != nil {
+			t.Fatal(err)
+		}
+		var manifests []ocispec.Descriptor
+		for _, name := range []string{"foo:latest", "bar:latest"} {
+			desc := index.Manifests[0]
+			desc.Annotations = map[string]string{
+				ocispec.AnnotationRefName: name,
+				ocispec.AnnotationCreated: created.Format(time.RFC3339Nano),
+			}
+			manifests = append(manifests, desc)
+		}
+		index.Manifests = manifests
+		indexDt, err := json.Marshal(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		strFiles := make(map[string]string)
+		var order []string
+		for name, content := range files {
+			strFiles[name] = string(content)
+			order = append(order, name)
+		}
+		strFiles["index.json"] = string(indexDt)
+		sort.Strings(order)
+		return makeTar(t, strFiles, order)
+	}
+	epoch := time.Unix(1600000000, 0)
+	t1 := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	t2 := time.Date(2020, 10, 2, 8, 30, 0, 0, time.UTC)
+	a := withNames(makeImageArchive(t, []layerFile{{name: "a", content: "aa", modTime: t1}}, t1), t1)
+	b := withNames(makeImageArchive(t, []layerFile{{name: "a", content: "aa", modTime: t2}}, t2), t2)
+	normA := normalize(t, a, epoch)
+	if !bytes.Equal(normA, normalize(t, b, epoch)) {
+		t.Error("expected identical normalized archives")
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(readTar(t, normA)["index.json"], &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 2 || index.Manifests[0].Digest != index.Manifests[1].Digest {
+		t.Fatalf("unexpected index manifests %v", index.Manifests)
+	}
+	if index.Manifests[1].Annotations[ocispec.AnnotationRefName] != "bar:latest" {
+		t.Errorf("unexpected annotations %v", index.Manifests[1].Annotations)
+	}
+}
+
+func readTar(t *testing.T, dt []byte) map[string][]byte {
+	files := make(map[string][]byte)
+	tarR := tar.NewReader(bytes.NewReader(dt))
+	for {
+		h, err := tarR.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(tarR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[h.Name] = content
+	}
+	return files
+}
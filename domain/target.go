@@ -6,6 +6,9 @@ import (
 	"strings"
 )
 
+// patternSuffix is the suffix of the local path of pattern targets.
+const patternSuffix = "..."
+
 // Target is a earth target identifier.
 type Target struct {
 	// Remote and canonical representation.
@@ -35,6 +38,22 @@ func (et Target) IsLocalExternal() bool {
 	return et.LocalPath != "." && et.LocalPath != ""
 }
 
+// IsPattern returns whether the target is a pattern, such as ./services/...+test, which
+// stands for the target of the same name in every Earthfile under a local dir.
+func (et Target) IsPattern() bool {
+	return et.IsLocalExternal() &&
+		(et.LocalPath == patternSuffix || strings.HasSuffix(et.LocalPath, "/"+patternSuffix))
+}
+
+// PatternDir returns the local dir under which the Earthfiles of a pattern target are
+// searched.
+func (et Target) PatternDir() string {
+	if et.LocalPath == patternSuffix {
+		return "."
+	}
+	return strings.TrimSuffix(et.LocalPath, "/"+patternSuffix)
+}
+
 // IsRemote returns whether the target is remote.
 func (et Target) IsRemote() bool {
 	return !et.IsLocalExternal() && !et.IsLocalInternal()
@@ -152,6 +171,10 @@ func JoinTargets(target1 Target, target2 Target) (Target, error) {
 					return Target{}, fmt.Errorf(
 						"Absolute path %s not supported as reference in external target context", ret.LocalPath)
 				}
+				if ret.IsPattern() {
+					return Target{}, fmt.Errorf(
+						"Target pattern %s not supported in external target context", ret.String())
+				}
 				ret.ProjectPath = path.Join(
 					target1.ProjectPath, ret.LocalPath)
 				ret.LocalPath = ""
@@ -0,0 +1,55 @@
+package domain
+
+import "testing"
+
+func TestTargetPattern(t *testing.T) {
+	tests := []struct {
+		name       string
+		pattern    bool
+		patternDir string
+	}{
+		{"./services/...+test", true, "./services"},
+		{"./...+test", true, "."},
+		{"../...+test", true, ".."},
+		{"/abs/...+test", true, "/abs"},
+		{"./services+test", false, ""},
+		{"./services/...x+test", false, ""},
+		{"+test", false, ""},
+		{"github.com/foo/bar/...+test", false, ""},
+	}
+	for _, test := range tests {
+		target, err := ParseTarget(test.name)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if target.IsPattern() != test.pattern {
+			t.Errorf("%s: IsPattern() = %v, expected %v", test.name, target.IsPattern(), test.pattern)
+			continue
+		}
+		if test.pattern && target.PatternDir() != test.patternDir {
+			t.Errorf("%s: PatternDir() = %s, expected %s", test.name, target.PatternDir(), test.patternDir)
+		}
+	}
+}
+
+func TestJoinTargetPattern(t *testing.T) {
+	pattern, err := ParseTarget("./...+test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	joined, err := JoinTargets(Target{LocalPath: "./services", Target: "all"}, pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if joined.String() != "./services/...+test" || !joined.IsPattern() {
+		t.Errorf("got %s, expected the pattern ./services/...+test", joined.String())
+	}
+	remote, err := ParseTarget("github.com/foo/bar+all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = JoinTargets(remote, pattern)
+	if err == nil {
+		t.Errorf("expected an error for a pattern in a remote target context")
+	}
+}
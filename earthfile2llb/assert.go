@@ -0,0 +1,165 @@
+package earthfile2llb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/earthly/earthly/debugger/common"
+	"github.com/earthly/earthly/earthfile2llb/image"
+	"github.com/earthly/earthly/logging"
+	"github.com/moby/buildkit/client/llb"
+)
+
+// assertConfig is the kind of the assertions on the image config, which are checked
+// during the conversion, rather than by the debugger.
+const assertConfig = "config"
+
+// Assertion is an ASSERT command.
+type Assertion struct {
+	// Kind is one of the common.Assert* kinds, or assertConfig.
+	Kind string
+	// Args are the arguments of the assertion, as expected by the debugger. For config
+	// assertions, the field and the expected value.
+	Args []string
+}
+
+// String returns the assertion in the form of the command.
+func (a Assertion) String() string {
+	return fmt.Sprintf("ASSERT --%s %s", a.Kind, strings.Join(a.Args, " "))
+}
+
+// ParseAssertion parses the words of an ASSERT command, following its --<kind> flag.
+func ParseAssertion(kind string, words []string) (Assertion, error) {
+	switch kind {
+	case common.AssertExists, common.AssertNotExists:
+		if len(words) != 1 {
+			return Assertion{}, fmt.Errorf("ASSERT --%s requires a path", kind)
+		}
+		return Assertion{Kind: kind, Args: words}, nil
+	case common.AssertContent, common.AssertContains, assertConfig:
+		if len(words) < 2 {
+			what := "a path and a text"
+			if kind == assertConfig {
+				what = "a field and a value"
+			}
+			return Assertion{}, fmt.Errorf("ASSERT --%s requires %s", kind, what)
+		}
+		if kind == assertConfig {
+			// The value of list fields may be given as multiple words.
+			return Assertion{Kind: kind, Args: words}, nil
+		}
+		return Assertion{Kind: kind, Args: []string{words[0], assertionText(words[1:])}}, nil
+	case common.AssertExitCode:
+		if len(words) < 2 {
+			return Assertion{}, fmt.Errorf("ASSERT --%s requires an exit code and a command", kind)
+		}
+		return Assertion{Kind: kind, Args: []string{words[0], strings.Join(words[1:], " ")}}, nil
+	default:
+		return Assertion{}, fmt.Errorf("unknown ASSERT --%s", kind)
+	}
+}
+
+// assertionText joins the words of an expected text. A text within double quotes is
+// unquoted, with escape sequences such as \n interpreted.
+func assertionText(words []string) string {
+	text := strings.Join(words, " ")
+	var unquoted string
+	if len(text) >= 2 && text[0] == '"' && json.Unmarshal([]byte(text), &unquoted) == nil {
+		return unquoted
+	}
+	return text
+}
+
+// Assert applies the earth ASSERT command. Assertions on the image config are checked
+// right away. The others are checked by a command run in the build environment, which
+// fails the target if they do not hold.
+func (c *Converter) Assert(ctx context.Context, a Assertion) error {
+	logging.GetLogger(ctx).With("assertion", a.String()).Info("Applying ASSERT")
+	if a.Kind == assertConfig {
+		return checkConfigAssertion(c.mts.FinalStates.SideEffectsImage, a.Args[0], a.Args[1:])
+	}
+	opts := []llb.RunOption{
+		llb.WithCustomNamef("%s%s", c.vertexPrefix(), a),
+	}
+	args := append([]string{common.AssertArg, a.Kind}, a.Args...)
+	return c.internalRun(ctx, args, nil, false, withShellAndEnvVars, false, nil, a.String(), opts...)
+}
+
+// checkConfigAssertion checks the value of a field of the image config. The fields
+// are USER, WORKDIR, ENTRYPOINT, CMD, EXPOSE, VOLUME, ENV.<name> and LABEL.<name>.
+// List values are compared as space separated words, and may also be given in the
+// JSON form, as in ["/bin/app", "--serve"].
+func checkConfigAssertion(img *image.Image, field string, expectedWords []string) error {
+	var jsonWords []string
+	if json.Unmarshal([]byte(strings.Join(expectedWords, " ")), &jsonWords) == nil {
+		expectedWords = jsonWords
+	}
+	expected := strings.Join(expectedWords, " ")
+	var actual string
+	config := img.Config
+	switch {
+	case field == "USER":
+		actual = config.User
+	case field == "WORKDIR":
+		actual = config.WorkingDir
+	case field == "ENTRYPOINT":
+		actual = strings.Join(config.Entrypoint, " ")
+	case field == "CMD":
+		actual = strings.Join(config.Cmd, " ")
+	case field == "EXPOSE":
+		for i, port := range expectedWords {
+			if !strings.Contains(port, "/") {
+				expectedWords[i] = port + "/tcp"
+			}
+		}
+		expected = strings.Join(sortedCopy(expectedWords), " ")
+		actual = strings.Join(sortedKeys(config.ExposedPorts), " ")
+	case field == "VOLUME":
+		expected = strings.Join(sortedCopy(expectedWords), " ")
+		actual = strings.Join(sortedKeys(config.Volumes), " ")
+	case strings.HasPrefix(field, "ENV."):
+		name := strings.TrimPrefix(field, "ENV.")
+		found := false
+		for _, kv := range config.Env {
+			parts := strings.SplitN(kv, "=", 2)
+			if parts[0] == name && len(parts) == 2 {
+				actual = parts[1]
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("ASSERT --config %s failed: env var %s is not set, expected %q", field, name, expected)
+		}
+	case strings.HasPrefix(field, "LABEL."):
+		name := strings.TrimPrefix(field, "LABEL.")
+		value, found := config.Labels[name]
+		if !found {
+			return fmt.Errorf("ASSERT --config %s failed: label %s is not set, expected %q", field, name, expected)
+		}
+		actual = value
+	default:
+		return fmt.Errorf("ASSERT --config: unsupported field %s", field)
+	}
+	if actual != expected {
+		return fmt.Errorf("ASSERT --config %s failed: expected %q, got %q", field, expected, actual)
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedCopy(strs []string) []string {
+	ret := append([]string{}, strs...)
+	sort.Strings(ret)
+	return ret
+}
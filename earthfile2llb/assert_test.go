@@ -0,0 +1,90 @@
+package earthfile2llb
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/earthly/earthly/debugger/common"
+	"github.com/earthly/earthly/earthfile2llb/image"
+)
+
+func TestParseAssertion(t *testing.T) {
+	tests := []struct {
+		kind     string
+		words    []string
+		expected []string
+	}{
+		{common.AssertExists, []string{"/out/report.xml"}, []string{"/out/report.xml"}},
+		{common.AssertContent, []string{"out.txt", "hello", "world"}, []string{"out.txt", "hello world"}},
+		{common.AssertContent, []string{"out.txt", `"hello\nworld"`}, []string{"out.txt", "hello\nworld"}},
+		{common.AssertContains, []string{"out.txt", "'ok'"}, []string{"out.txt", "'ok'"}},
+		{common.AssertExitCode, []string{"1", "./app", "--fail"}, []string{"1", "./app --fail"}},
+		{assertConfig, []string{"EXPOSE", "8080", "53/udp"}, []string{"EXPOSE", "8080", "53/udp"}},
+	}
+	for _, tt := range tests {
+		a, err := ParseAssertion(tt.kind, tt.words)
+		if err != nil {
+			t.Errorf("%s %v: %v", tt.kind, tt.words, err)
+			continue
+		}
+		if !reflect.DeepEqual(a.Args, tt.expected) {
+			t.Errorf("%s %v: expected %q, got %q", tt.kind, tt.words, tt.expected, a.Args)
+		}
+	}
+
+	invalid := []struct {
+		kind  string
+		words []string
+	}{
+		{common.AssertExists, nil},
+		{common.AssertNotExists, []string{"a", "b"}},
+		{common.AssertContent, []string{"out.txt"}},
+		{common.AssertExitCode, []string{"0"}},
+		{assertConfig, []string{"USER"}},
+		{"equals", []string{"a", "b"}},
+	}
+	for _, tt := range invalid {
+		_, err := ParseAssertion(tt.kind, tt.words)
+		if err == nil {
+			t.Errorf("%s %v: expected an error", tt.kind, tt.words)
+		}
+	}
+}
+
+func TestCheckConfigAssertion(t *testing.T) {
+	img := image.NewImage()
+	img.Config.User = "jack"
+	img.Config.Cmd = []string{"/bin/bash", "abc"}
+	img.Config.ExposedPorts["8080/tcp"] = struct{}{}
+	img.Config.ExposedPorts["53/udp"] = struct{}{}
+	img.Config.Volumes["/data"] = struct{}{}
+	img.Config.Env = append(img.Config.Env, "MODE=release build")
+	img.Config.Labels["org.example.team"] = "infra"
+
+	tests := []struct {
+		field string
+		words []string
+		ok    bool
+	}{
+		{"USER", []string{"jack"}, true},
+		{"USER", []string{"root"}, false},
+		{"WORKDIR", []string{"/"}, true},
+		{"CMD", []string{"/bin/bash", "abc"}, true},
+		{"CMD", []string{`["/bin/bash",`, `"abc"]`}, true},
+		{"CMD", []string{"/bin/sh"}, false},
+		{"EXPOSE", []string{"53/udp", "8080"}, true},
+		{"EXPOSE", []string{"8080"}, false},
+		{"VOLUME", []string{"/data"}, true},
+		{"ENV.MODE", []string{"release", "build"}, true},
+		{"ENV.MISSING", []string{"x"}, false},
+		{"LABEL.org.example.team", []string{"infra"}, true},
+		{"LABEL.missing", []string{"x"}, false},
+		{"HEALTHCHECK", []string{"NONE"}, false},
+	}
+	for _, tt := range tests {
+		err := checkConfigAssertion(img, tt.field, tt.words)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s %v: expected ok=%t, got %v", tt.field, tt.words, tt.ok, err)
+		}
+	}
+}
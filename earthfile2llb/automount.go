@@ -0,0 +1,222 @@
+package earthfile2llb
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/earthly/earthly/earthfile2llb/image"
+	"github.com/earthly/earthly/logging"
+	"github.com/moby/buildkit/client/llb"
+)
+
+// autoCacheRoot is the dir of the persistent caches of the automatic cache mounts.
+// Unlike the caches of RUN --mount type=cache, they are shared by all targets, as the
+// package caches of the toolchains are keyed by content.
+const autoCacheRoot = "/run/cache/auto"
+
+// toolchain is a language toolchain whose package caches are mounted automatically
+// into the RUN commands using it, with --auto-cache-mounts.
+type toolchain struct {
+	name string
+	// envVars are the env vars set by the images of the toolchain (such as the official
+	// ones), by which the toolchain is detected.
+	envVars []string
+	// commands are the commands of the toolchain which use the caches.
+	commands []string
+	// cacheDirs returns the cache dirs of the toolchain, given the env of the image and
+	// the home dir of its user ("" if unknown).
+	cacheDirs func(env map[string]string, home string) []string
+	sharing   llb.CacheMountSharingMode
+}
+
+var toolchains = []toolchain{
+	{
+		name:     "go",
+		envVars:  []string{"GOLANG_VERSION", "GOPATH"},
+		commands: []string{"go"},
+		cacheDirs: func(env map[string]string, home string) []string {
+			modCache := env["GOMODCACHE"]
+			if modCache == "" {
+				gopath := env["GOPATH"]
+				if gopath == "" && home != "" {
+					gopath = path.Join(home, "go")
+				}
+				if gopath != "" {
+					modCache = path.Join(gopath, "pkg/mod")
+				}
+			}
+			buildCache := env["GOCACHE"]
+			if buildCache == "" && home != "" {
+				buildCache = path.Join(home, ".cache/go-build")
+			}
+			return nonEmpty(modCache, buildCache)
+		},
+		sharing: llb.CacheMountShared,
+	},
+	{
+		name:     "node",
+		envVars:  []string{"NODE_VERSION"},
+		commands: []string{"npm", "npx"},
+		cacheDirs: func(env map[string]string, home string) []string {
+			if env["npm_config_cache"] != "" {
+				return []string{env["npm_config_cache"]}
+			}
+			return nonEmpty(homeDir(home, ".npm"))
+		},
+		sharing: llb.CacheMountShared,
+	},
+	{
+		name:     "python",
+		envVars:  []string{"PYTHON_VERSION", "PYTHON_PIP_VERSION"},
+		commands: []string{"pip", "pip3"},
+		cacheDirs: func(env map[string]string, home string) []string {
+			if env["PIP_NO_CACHE_DIR"] != "" {
+				return nil
+			}
+			if env["PIP_CACHE_DIR"] != "" {
+				return []string{env["PIP_CACHE_DIR"]}
+			}
+			return nonEmpty(homeDir(home, ".cache/pip"))
+		},
+		sharing: llb.CacheMountShared,
+	},
+	{
+		name:     "cargo",
+		envVars:  []string{"CARGO_HOME", "RUSTUP_HOME"},
+		commands: []string{"cargo"},
+		cacheDirs: func(env map[string]string, home string) []string {
+			cargoHome := env["CARGO_HOME"]
+			if cargoHome == "" {
+				cargoHome = homeDir(home, ".cargo")
+			}
+			if cargoHome == "" {
+				return nil
+			}
+			return []string{path.Join(cargoHome, "registry"), path.Join(cargoHome, "git")}
+		},
+		sharing: llb.CacheMountShared,
+	},
+	{
+		name:     "maven",
+		envVars:  []string{"MAVEN_HOME"},
+		commands: []string{"mvn", "mvnw", "./mvnw"},
+		cacheDirs: func(env map[string]string, home string) []string {
+			return nonEmpty(homeDir(home, ".m2/repository"))
+		},
+		// The local repository of maven does not support concurrent use.
+		sharing: llb.CacheMountLocked,
+	},
+}
+
+// autoCacheDir is a cache dir mounted automatically.
+type autoCacheDir struct {
+	toolchain string
+	dir       string
+	sharing   llb.CacheMountSharingMode
+}
+
+// autoCacheMounts returns the cache mounts of the package caches of the toolchains of
+// the image which the command uses.
+func autoCacheMounts(ctx context.Context, img *image.Image, args []string, mounts []string) []llb.RunOption {
+	var opts []llb.RunOption
+	for _, acd := range autoCacheDirs(img, args, mounts) {
+		logging.GetLogger(ctx).
+			With("toolchain", acd.toolchain).
+			With("dir", acd.dir).
+			Info("Adding automatic cache mount")
+		cachePath := path.Join(autoCacheRoot, acd.toolchain, acd.dir)
+		opts = append(opts, llb.AddMount(acd.dir, llb.Scratch(), llb.AsPersistentCacheDir(cachePath, acd.sharing)))
+	}
+	return opts
+}
+
+// autoCacheDirs returns the package cache dirs of the toolchains of the image which the
+// command uses. The dirs already mounted via RUN --mount are skipped.
+func autoCacheDirs(img *image.Image, args []string, mounts []string) []autoCacheDir {
+	env := make(map[string]string)
+	for _, kv := range img.Config.Env {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		}
+	}
+	home := env["HOME"]
+	if home == "" {
+		switch img.Config.User {
+		case "", "root", "0", "0:0", "root:root":
+			home = "/root"
+		}
+	}
+	words := commandWords(args)
+	mounted := make(map[string]bool)
+	for _, mount := range mounts {
+		for _, kv := range strings.Split(mount, ",") {
+			if strings.HasPrefix(kv, "target=") {
+				mounted[path.Clean(strings.TrimPrefix(kv, "target="))] = true
+			}
+		}
+	}
+	var ret []autoCacheDir
+	for _, tc := range toolchains {
+		if !tc.detected(env) || !tc.usedBy(words) {
+			continue
+		}
+		for _, dir := range tc.cacheDirs(env, home) {
+			dir = path.Clean(dir)
+			if !path.IsAbs(dir) || mounted[dir] {
+				continue
+			}
+			mounted[dir] = true
+			ret = append(ret, autoCacheDir{toolchain: tc.name, dir: dir, sharing: tc.sharing})
+		}
+	}
+	return ret
+}
+
+func (tc toolchain) detected(env map[string]string) bool {
+	for _, name := range tc.envVars {
+		if env[name] != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (tc toolchain) usedBy(words map[string]bool) bool {
+	for _, cmd := range tc.commands {
+		if words[cmd] {
+			return true
+		}
+	}
+	return false
+}
+
+// commandWords returns the words of a command, split on whitespace and on the shell
+// operators separating commands.
+func commandWords(args []string) map[string]bool {
+	words := make(map[string]bool)
+	for _, w := range strings.FieldsFunc(strings.Join(args, " "), func(r rune) bool {
+		return strings.ContainsRune(" \t\n;&|()`", r)
+	}) {
+		words[w] = true
+	}
+	return words
+}
+
+func homeDir(home string, rel string) string {
+	if home == "" {
+		return ""
+	}
+	return path.Join(home, rel)
+}
+
+func nonEmpty(strs ...string) []string {
+	var ret []string
+	for _, s := range strs {
+		if s != "" {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
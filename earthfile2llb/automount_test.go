@@ -0,0 +1,49 @@
+package earthfile2llb
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/earthly/earthly/earthfile2llb/image"
+)
+
+func TestAutoCacheDirs(t *testing.T) {
+	withEnv := func(user string, env ...string) *image.Image {
+		img := image.NewImage()
+		img.Config.User = user
+		img.Config.Env = append(img.Config.Env, env...)
+		return img
+	}
+	golang := withEnv("", "GOLANG_VERSION=1.15", "GOPATH=/go")
+	tests := []struct {
+		img      *image.Image
+		args     []string
+		mounts   []string
+		expected []string
+	}{
+		{golang, []string{"go build ./..."}, nil, []string{"/go/pkg/mod", "/root/.cache/go-build"}},
+		{golang, []string{"make && go test ./..."}, nil, []string{"/go/pkg/mod", "/root/.cache/go-build"}},
+		// Not using the toolchain.
+		{golang, []string{"make"}, nil, nil},
+		{golang, []string{"go build"}, []string{"type=cache,target=/go/pkg/mod/"}, []string{"/root/.cache/go-build"}},
+		// The toolchain is not in the image.
+		{image.NewImage(), []string{"go", "build"}, nil, nil},
+		{withEnv("", "NODE_VERSION=14"), []string{"npm ci"}, nil, []string{"/root/.npm"}},
+		// The home of the user is unknown.
+		{withEnv("node", "NODE_VERSION=14"), []string{"npm ci"}, nil, nil},
+		{withEnv("node", "NODE_VERSION=14", "HOME=/home/node"), []string{"npm ci"}, nil, []string{"/home/node/.npm"}},
+		{withEnv("", "PYTHON_VERSION=3.8"), []string{"pip install -r requirements.txt"}, nil, []string{"/root/.cache/pip"}},
+		{withEnv("", "PYTHON_VERSION=3.8", "PIP_NO_CACHE_DIR=1"), []string{"pip install ."}, nil, nil},
+		{withEnv("", "CARGO_HOME=/usr/local/cargo"), []string{"cargo build"}, nil, []string{"/usr/local/cargo/registry", "/usr/local/cargo/git"}},
+		{withEnv("", "MAVEN_HOME=/usr/share/maven"), []string{"mvn package"}, nil, []string{"/root/.m2/repository"}},
+	}
+	for _, test := range tests {
+		var dirs []string
+		for _, acd := range autoCacheDirs(test.img, test.args, test.mounts) {
+			dirs = append(dirs, acd.dir)
+		}
+		if !reflect.DeepEqual(dirs, test.expected) {
+			t.Errorf("%v %v: got %v, expected %v", test.img.Config.Env, test.args, dirs, test.expected)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package earthfile2llb
+
+import (
+	"regexp"
+	"strconv"
+
+	"github.com/earthly/earthly/debugger/common"
+	"github.com/earthly/earthly/domain"
+)
+
+// CacheTargetEnvVar is set in the commands of RUN and WITH DOCKER to the target which
+// runs them. Buildkit includes the command in the description of the cache records it
+// produces, which allows attributing the records to targets (see CacheTargetOf).
+//
+// The debugger also relies on it for the concurrency limits of targets. As a
+// consequence, identical commands of different targets are cached separately.
+const CacheTargetEnvVar = common.CacheTargetEnvVar
+
+var cacheTargetRegexp = regexp.MustCompile(CacheTargetEnvVar + `='([^']*)'`)
+
+// cacheTarget returns the name under which the cache of the target is recorded: its
+// canonical name, but without the tag, such that the cache is shared across tags.
+func cacheTarget(target domain.Target) string {
+	targetCopy := target
+	targetCopy.Tag = ""
+	return targetCopy.StringCanonical()
+}
+
+// CacheTargetOf returns the target which produced a cache record, given the description
+// of the record, if known.
+func CacheTargetOf(description string) (string, bool) {
+	match := cacheTargetRegexp.FindStringSubmatch(description)
+	if match == nil {
+		return "", false
+	}
+	return match[1], true
+}
+
+// CacheTargetFilter returns a buildkit prune filter matching the cache records of the
+// targets starting with the given prefix, for example github.com/foo/bar+ for all the
+// targets of a project.
+func CacheTargetFilter(prefix string) string {
+	return "description~=" + strconv.Quote(CacheTargetEnvVar+"='"+regexp.QuoteMeta(prefix))
+}
@@ -0,0 +1,34 @@
+package earthfile2llb
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCacheTargetOf(t *testing.T) {
+	envVar := shellEnvVar(CacheTargetEnvVar, "github.com/foo/bar+build")
+	description := "mount / from exec /bin/sh -c " + envVar + " /usr/bin/earth_debugger /bin/sh -c 'make'"
+	target, ok := CacheTargetOf(description)
+	if !ok || target != "github.com/foo/bar+build" {
+		t.Errorf("expected github.com/foo/bar+build, got %q, %v", target, ok)
+	}
+	_, ok = CacheTargetOf("pulled from docker.io/library/alpine:3.11")
+	if ok {
+		t.Error("expected no target")
+	}
+
+	filter := CacheTargetFilter("github.com/foo/bar+")
+	value, err := strconv.Unquote(strings.TrimPrefix(filter, "description~="))
+	if err != nil {
+		t.Fatal(err)
+	}
+	re := regexp.MustCompile(value)
+	if !re.MatchString(description) {
+		t.Errorf("filter %s does not match %s", filter, description)
+	}
+	if re.MatchString(strings.Replace(description, "foo/bar", "foo/baz", 1)) {
+		t.Errorf("filter %s matches another project", filter)
+	}
+}
@@ -0,0 +1,202 @@
+package earthfile2llb
+
+import (
+	"fmt"
+	"strings"
+)
+
+// evalCondition evaluates a condition expression, such as
+// `$EARTHLY_GIT_BRANCH == main && $RELEASE != false`. The operands are expanded via
+// expand. Supported operators are ==, !=, !, && and ||, together with parentheses.
+// An operand on its own is true unless it is empty, "false" or "0".
+func evalCondition(expr string, expand func(string) (string, error)) (bool, error) {
+	tokens, err := tokenizeCondition(unquoteCondition(expr))
+	if err != nil {
+		return false, err
+	}
+	if len(tokens) == 0 {
+		return false, fmt.Errorf("empty condition")
+	}
+	p := &conditionParser{tokens: tokens, expand: expand}
+	ret, err := p.parseOr()
+	if err != nil {
+		return false, err
+	}
+	if p.pos != len(p.tokens) {
+		return false, fmt.Errorf("unexpected %s in condition %s", p.tokens[p.pos].text, expr)
+	}
+	return ret, nil
+}
+
+type conditionToken struct {
+	text       string
+	isOperator bool
+}
+
+var conditionOperators = []string{"==", "!=", "&&", "||", "!", "(", ")"}
+
+// unquoteCondition removes the double quotes around the condition, if the entire
+// condition is quoted.
+func unquoteCondition(expr string) string {
+	if len(expr) < 2 || expr[0] != '"' || expr[len(expr)-1] != '"' {
+		return expr
+	}
+	for i := 1; i < len(expr)-1; i++ {
+		if expr[i] == '\\' {
+			i++
+		} else if expr[i] == '"' {
+			return expr
+		}
+	}
+	return expr[1 : len(expr)-1]
+}
+
+func tokenizeCondition(expr string) ([]conditionToken, error) {
+	var tokens []conditionToken
+	var operand strings.Builder
+	flushOperand := func() {
+		if operand.Len() > 0 {
+			tokens = append(tokens, conditionToken{text: operand.String()})
+			operand.Reset()
+		}
+	}
+	var quote byte
+	for i := 0; i < len(expr); i++ {
+		ch := expr[i]
+		if quote != 0 {
+			operand.WriteByte(ch)
+			if ch == '\\' && quote == '"' && i+1 < len(expr) {
+				i++
+				operand.WriteByte(expr[i])
+			} else if ch == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch {
+		case ch == '"' || ch == '\'':
+			quote = ch
+			operand.WriteByte(ch)
+			continue
+		case ch == '\\' && i+1 < len(expr):
+			operand.WriteByte(ch)
+			i++
+			operand.WriteByte(expr[i])
+			continue
+		case ch == ' ' || ch == '\t':
+			flushOperand()
+			continue
+		}
+		isOperator := false
+		for _, op := range conditionOperators {
+			if strings.HasPrefix(expr[i:], op) {
+				flushOperand()
+				tokens = append(tokens, conditionToken{text: op, isOperator: true})
+				i += len(op) - 1
+				isOperator = true
+				break
+			}
+		}
+		if !isOperator {
+			operand.WriteByte(ch)
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in condition %s", expr)
+	}
+	flushOperand()
+	return tokens, nil
+}
+
+type conditionParser struct {
+	tokens []conditionToken
+	pos    int
+	expand func(string) (string, error)
+}
+
+func (p *conditionParser) acceptOperator(op string) bool {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].isOperator && p.tokens[p.pos].text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *conditionParser) parseOr() (bool, error) {
+	ret, err := p.parseAnd()
+	if err != nil {
+		return false, err
+	}
+	for p.acceptOperator("||") {
+		rhs, err := p.parseAnd()
+		if err != nil {
+			return false, err
+		}
+		ret = ret || rhs
+	}
+	return ret, nil
+}
+
+func (p *conditionParser) parseAnd() (bool, error) {
+	ret, err := p.parseUnary()
+	if err != nil {
+		return false, err
+	}
+	for p.acceptOperator("&&") {
+		rhs, err := p.parseUnary()
+		if err != nil {
+			return false, err
+		}
+		ret = ret && rhs
+	}
+	return ret, nil
+}
+
+func (p *conditionParser) parseUnary() (bool, error) {
+	if p.acceptOperator("!") {
+		ret, err := p.parseUnary()
+		return !ret, err
+	}
+	if p.acceptOperator("(") {
+		ret, err := p.parseOr()
+		if err != nil {
+			return false, err
+		}
+		if !p.acceptOperator(")") {
+			return false, fmt.Errorf("missing ) in condition")
+		}
+		return ret, nil
+	}
+	lhs, err := p.parseOperand()
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case p.acceptOperator("=="):
+		rhs, err := p.parseOperand()
+		if err != nil {
+			return false, err
+		}
+		return lhs == rhs, nil
+	case p.acceptOperator("!="):
+		rhs, err := p.parseOperand()
+		if err != nil {
+			return false, err
+		}
+		return lhs != rhs, nil
+	default:
+		return lhs != "" && lhs != "false" && lhs != "0", nil
+	}
+}
+
+func (p *conditionParser) parseOperand() (string, error) {
+	if p.pos >= len(p.tokens) {
+		return "", fmt.Errorf("unexpected end of condition")
+	}
+	token := p.tokens[p.pos]
+	if token.isOperator {
+		return "", fmt.Errorf("unexpected %s in condition", token.text)
+	}
+	p.pos++
+	return p.expand(token.text)
+}
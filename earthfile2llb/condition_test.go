@@ -0,0 +1,92 @@
+package earthfile2llb
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/antlr/antlr4/runtime/Go/antlr"
+	"github.com/earthly/earthly/ast"
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/earthfile2llb/image"
+	"github.com/earthly/earthly/earthfile2llb/parser"
+	"github.com/earthly/earthly/earthfile2llb/variables"
+	"github.com/moby/buildkit/client/llb"
+)
+
+func TestEvalCondition(t *testing.T) {
+	vc := variables.NewCollection()
+	vc.AddActive("BRANCH", variables.NewConstant("main"), true)
+	vc.AddActive("RELEASE", variables.NewConstant("false"), true)
+	vc.AddActive("EMPTY", variables.NewConstant(""), true)
+	tests := []struct {
+		expr     string
+		expected bool
+	}{
+		{`$BRANCH == main`, true},
+		{`"$BRANCH == main"`, true},
+		{`$BRANCH==main`, true},
+		{`$BRANCH != main`, false},
+		{`"$EMPTY" == ""`, true},
+		{`$EMPTY == main`, false},
+		{`$RELEASE`, false},
+		{`!$RELEASE`, true},
+		{`$BRANCH`, true},
+		{`$BRANCH == main && $RELEASE`, false},
+		{`$BRANCH == main || $RELEASE`, true},
+		{`!($BRANCH == dev || $RELEASE) && "$BRANCH" == 'main'`, true},
+		{`${BRANCH}-x == main-x`, true},
+	}
+	for _, tt := range tests {
+		actual, err := evalCondition(tt.expr, vc.Expand)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if actual != tt.expected {
+			t.Errorf("%s: expected %t, got %t", tt.expr, tt.expected, actual)
+		}
+	}
+
+	for _, expr := range []string{``, `$BRANCH ==`, `($BRANCH`, `$BRANCH main`, `"main`} {
+		_, err := evalCondition(expr, vc.Expand)
+		if err == nil {
+			t.Errorf("%s: expected error", expr)
+		}
+	}
+}
+
+func TestSaveImagePushIf(t *testing.T) {
+	tests := []struct {
+		condition string
+		expected  string
+	}{
+		{`"$BRANCH == main"`, "no non-push commands allowed after a --push"},
+		{`"$BRANCH == release"`, ""},
+	}
+	for _, tt := range tests {
+		c := &Converter{
+			mts: &MultiTargetStates{FinalStates: &SingleTargetStates{
+				Target:           domain.Target{LocalPath: ".", Target: "base"},
+				SideEffectsState: llb.Scratch(),
+				SideEffectsImage: image.NewImage(),
+			}},
+			varCollection: variables.NewCollection(),
+		}
+		c.varCollection.AddActive("BRANCH", variables.NewConstant("main"), true)
+		earthfile := "SAVE IMAGE --push --push-if " + tt.condition + " app:latest\nRUN echo done\n"
+		stream := antlr.NewCommonTokenStream(ast.NewLexer(antlr.NewInputStream(earthfile)), 0)
+		l := newListener(context.Background(), c, "Earthfile", "base")
+		antlr.ParseTreeWalkerDefault.Walk(l, parser.NewEarthParser(stream).EarthFile())
+		err := l.Err()
+		if tt.expected == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tt.condition, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%s: expected error %q, got %v", tt.condition, tt.expected, err)
+		}
+	}
+}
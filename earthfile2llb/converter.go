@@ -8,29 +8,32 @@ import (
 	"fmt"
 	"hash/fnv"
 	"io/ioutil"
-	"math/rand"
+	"net"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/containerd/containerd/platforms"
 	"github.com/docker/distribution/reference"
 	"github.com/earthly/earthly/buildcontext"
 	"github.com/earthly/earthly/cleanup"
 	"github.com/earthly/earthly/debugger/common"
-	"github.com/earthly/earthly/dockertar"
 	"github.com/earthly/earthly/domain"
 	"github.com/earthly/earthly/earthfile2llb/dedup"
 	"github.com/earthly/earthly/earthfile2llb/image"
 	"github.com/earthly/earthly/earthfile2llb/imr"
 	"github.com/earthly/earthly/earthfile2llb/variables"
+	"github.com/earthly/earthly/errcode"
 	"github.com/earthly/earthly/llbutil"
 	"github.com/earthly/earthly/llbutil/llbgit"
+	"github.com/earthly/earthly/localrun"
 	"github.com/earthly/earthly/logging"
 	"github.com/moby/buildkit/client/llb"
 	"github.com/moby/buildkit/frontend/dockerfile/dockerfile2llb"
 	solverpb "github.com/moby/buildkit/solver/pb"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 )
 
@@ -48,23 +51,74 @@ type Converter struct {
 	artifactBuilderFun ArtifactBuilderFun
 	cleanCollection    *cleanup.Collection
 	nextArgIndex       int
-	solveCache         map[string]llb.State
+	solveCache         *SolveCache
+	registryBuilderFun RegistryBuilderFun
 	imageResolveMode   llb.ResolveMode
+	buildTimestamp     time.Time
+	argsProviders      []variables.BuiltinArgsProvider
+	capabilityPolicy   CapabilityPolicy
+	customCommands     map[string]CommandHandler
+	securityPolicy     SecurityPolicy
+	caCerts            []byte
+	rootless           bool
+	defaultResources   Resources
+	// project is the project config applying to the Earthfile of the target.
+	project *buildcontext.Project
+	// labelFilter selects the targets matched by target patterns, as per the command
+	// line.
+	labelFilter LabelFilter
+	// autoCacheMounts enables the automatic cache mounts of the toolchains.
+	autoCacheMounts bool
+	// ociLabels enables the OCI annotation labels of the saved images.
+	ociLabels bool
+	// interactiveDebugging enables BREAKPOINT.
+	interactiveDebugging bool
+	// insecureRegistryFun allows the registries of the images of FROM --insecure.
+	insecureRegistryFun InsecureRegistryFun
+	// platform is the platform the target is built for.
+	platform specs.Platform
+	// labelsSet are the labels set via LABEL by the target, which take precedence over
+	// the OCI annotation labels.
+	labelsSet map[string]bool
+	// extraHosts are the /etc/hosts entries added to the RUN commands of the target
+	// via HOST.
+	extraHosts []extraHost
+	// timeouts are the timeouts of the resolutions of images and remote repositories.
+	timeouts Timeouts
+	// metaResolver resolves the configs of the images.
+	metaResolver llb.ImageMetaResolver
+	// localRunner translates the paths of the target to paths of the host, once it is
+	// declared LOCALLY.
+	localRunner *localrun.Runner
+	// locally is set once the target is declared LOCALLY.
+	locally bool
+	// localDir is the dir of the Earthfile on the host, in which the commands of the
+	// target are executed once it is declared LOCALLY.
+	localDir string
+}
+
+type extraHost struct {
+	host string
+	ip   net.IP
 }
 
 // NewConverter constructs a new converter for a given earth target.
 func NewConverter(ctx context.Context, target domain.Target, bc *buildcontext.Data, opt ConvertOpt) (*Converter, error) {
+	platform := llbutil.TargetPlatform
+	if opt.Platform != nil {
+		platform = *opt.Platform
+	}
 	sts := &SingleTargetStates{
 		Target: target,
 		TargetInput: dedup.TargetInput{
 			TargetCanonical: target.StringCanonical(),
+			Platform:        platformInput(platform),
 		},
-		SideEffectsState: llb.Scratch().Platform(llbutil.TargetPlatform),
+		SideEffectsState: llb.Scratch().Platform(platform),
 		SideEffectsImage: image.NewImage(),
-		ArtifactsState:   llb.Scratch().Platform(llbutil.TargetPlatform),
+		ArtifactsState:   llb.Scratch().Platform(platform),
 		LocalDirs:        bc.LocalDirs,
 		Ongoing:          true,
-		Salt:             fmt.Sprintf("%d", rand.Int()),
 	}
 	mts := &MultiTargetStates{
 		FinalStates:   sts,
@@ -74,27 +128,87 @@ func NewConverter(ctx context.Context, target domain.Target, bc *buildcontext.Da
 		ovVar, _, _ := opt.VarCollection.Get(key)
 		sts.TargetInput = sts.TargetInput.WithBuildArgInput(ovVar.BuildArgInput(key, ""))
 	}
+	salt, err := targetSalt(sts.TargetInput)
+	if err != nil {
+		return nil, err
+	}
+	sts.Salt = salt
+	if bc.GitMetadata != nil && bc.GitMetadata.RemoteURL != "" {
+		gitMaterial := Material{URI: fmt.Sprintf("git+%s", bc.GitMetadata.RemoteURL)}
+		if bc.GitMetadata.Hash != "" {
+			gitMaterial.Digest = map[string]string{"sha1": bc.GitMetadata.Hash}
+		}
+		sts.AddMaterials(gitMaterial)
+	}
+	if target.IsRemote() {
+		sts.SourceStates = append(sts.SourceStates, bc.BuildContext)
+	}
+	if target.IsRemote() && bc.GitMetadata != nil {
+		sts.RemoteSource = &RemoteSource{
+			Repository: path.Join(bc.GitMetadata.GitVendor, bc.GitMetadata.GitProject),
+			Ref:        target.Tag,
+			Hash:       bc.GitMetadata.Hash,
+		}
+	}
+	varCollection, err := opt.VarCollection.WithBuiltinBuildArgs(
+		target, platform, bc.GitMetadata, opt.BuildTimestamp, opt.BuiltinArgsProviders)
+	if err != nil {
+		return nil, err
+	}
 	targetStr := target.String()
 	opt.VisitedStates[targetStr] = append(opt.VisitedStates[targetStr], sts)
 	return &Converter{
-		gitMeta:            bc.GitMetadata,
-		resolver:           opt.Resolver,
-		imageResolveMode:   opt.ImageResolveMode,
-		mts:                mts,
-		buildContext:       bc.BuildContext,
-		cacheContext:       makeCacheContext(target),
-		varCollection:      opt.VarCollection.WithBuiltinBuildArgs(target, bc.GitMetadata),
-		dockerBuilderFun:   opt.DockerBuilderFun,
-		artifactBuilderFun: opt.ArtifactBuilderFun,
-		cleanCollection:    opt.CleanCollection,
-		solveCache:         opt.SolveCache,
+		gitMeta:              bc.GitMetadata,
+		resolver:             opt.Resolver,
+		imageResolveMode:     opt.ImageResolveMode,
+		mts:                  mts,
+		buildContext:         bc.BuildContext,
+		cacheContext:         makeCacheContext(target),
+		varCollection:        varCollection,
+		dockerBuilderFun:     opt.DockerBuilderFun,
+		artifactBuilderFun:   opt.ArtifactBuilderFun,
+		cleanCollection:      opt.CleanCollection,
+		solveCache:           opt.SolveCache,
+		registryBuilderFun:   opt.RegistryBuilderFun,
+		buildTimestamp:       opt.BuildTimestamp,
+		argsProviders:        opt.BuiltinArgsProviders,
+		capabilityPolicy:     opt.CapabilityPolicy,
+		customCommands:       opt.CustomCommands,
+		securityPolicy:       opt.SecurityPolicy,
+		caCerts:              opt.CACerts,
+		rootless:             opt.Rootless,
+		defaultResources:     opt.DefaultResources,
+		project:              bc.Project,
+		labelFilter:          opt.LabelFilter,
+		autoCacheMounts:      opt.AutoCacheMounts,
+		ociLabels:            opt.OCILabels,
+		insecureRegistryFun:  opt.InsecureRegistryFun,
+		platform:             platform,
+		labelsSet:            make(map[string]bool),
+		timeouts:             opt.Timeouts,
+		metaResolver:         opt.MetaResolver,
+		localRunner:          opt.LocalRunner,
+		interactiveDebugging: opt.InteractiveDebugging,
 	}, nil
 }
 
-// From applies the earth FROM command.
-func (c *Converter) From(ctx context.Context, imageName string, buildArgs []string) error {
+// From applies the earth FROM command. If insecure is set, the image may be pulled over
+// plain HTTP, or with an untrusted TLS certificate. If platform is set, the rest of the
+// target is built for that platform, rather than for the platform of the caller.
+func (c *Converter) From(ctx context.Context, imageName string, buildArgs []string, insecure bool, platform string) error {
+	if platform != "" {
+		p, err := platforms.Parse(platform)
+		if err != nil {
+			return errors.Wrapf(err, "parse platform %s", platform)
+		}
+		c.platform = platforms.Normalize(p)
+		c.varCollection = c.varCollection.WithTargetPlatform(c.platform)
+	}
 	if strings.Contains(imageName, "+") {
 		// Target-based FROM.
+		if insecure {
+			return errors.New("--insecure not supported in target FROM")
+		}
 		return c.fromTarget(ctx, imageName, buildArgs)
 	}
 
@@ -102,12 +216,12 @@ func (c *Converter) From(ctx context.Context, imageName string, buildArgs []stri
 	if len(buildArgs) != 0 {
 		return errors.New("--build-arg not supported in non-target FROM")
 	}
-	return c.fromClassical(ctx, imageName)
+	return c.fromClassical(ctx, imageName, insecure)
 }
 
-func (c *Converter) fromClassical(ctx context.Context, imageName string) error {
+func (c *Converter) fromClassical(ctx context.Context, imageName string, insecure bool) error {
 	state, img, newVariables, err := c.internalFromClassical(
-		ctx, imageName,
+		ctx, imageName, c.platform, insecure,
 		llb.WithCustomNamef("%sFROM %s", c.vertexPrefix(), imageName))
 	if err != nil {
 		return err
@@ -125,7 +239,8 @@ func (c *Converter) fromTarget(ctx context.Context, targetName string, buildArgs
 	if err != nil {
 		return errors.Wrapf(err, "parse target name %s", targetName)
 	}
-	mts, err := c.Build(ctx, depTarget.String(), buildArgs)
+	// The target is built for the platform of this one.
+	mts, err := c.buildForPlatform(ctx, depTarget.String(), buildArgs, &c.platform)
 	if err != nil {
 		return errors.Wrapf(err, "apply build %s", depTarget.String())
 	}
@@ -151,6 +266,7 @@ func (c *Converter) fromTarget(ctx context.Context, targetName string, buildArgs
 		c.varCollection.AddActive(k, variables.NewConstantEnvVar(v), true)
 	}
 	c.mts.FinalStates.SideEffectsImage = saveImage.Image.Clone()
+	c.mts.FinalStates.AddMaterials(relevantDepState.Materials...)
 	return nil
 }
 
@@ -181,7 +297,7 @@ func (c *Converter) FromDockerfile(ctx context.Context, contextPath string, dfPa
 			return err
 		}
 		dfPath = filepath.Join(pathArtifact, "Dockerfile")
-		buildContext = llb.Scratch().Platform(llbutil.TargetPlatform)
+		buildContext = llb.Scratch().Platform(c.platform)
 		buildContext = llbutil.CopyOp(
 			mts.FinalStates.ArtifactsState, []string{contextArtifact.Artifact},
 			buildContext, "/", true, true, "",
@@ -204,9 +320,9 @@ func (c *Converter) FromDockerfile(ctx context.Context, contextPath string, dfPa
 		if err != nil {
 			return errors.Wrap(err, "join targets")
 		}
-		data, err := c.resolver.Resolve(ctx, dockerfileMetaTarget)
+		data, err := resolveBuildContext(ctx, c.resolver, dockerfileMetaTarget, c.timeouts.GitResolve)
 		if err != nil {
-			return errors.Wrap(err, "resolve build context for dockerfile")
+			return errcode.Wrap(errors.Wrap(err, "resolve build context for dockerfile"), errcode.ContextResolution)
 		}
 		for ldk, ld := range data.LocalDirs {
 			c.mts.FinalStates.LocalDirs[ldk] = ld
@@ -227,10 +343,10 @@ func (c *Converter) FromDockerfile(ctx context.Context, contextPath string, dfPa
 	state, dfImg, err := dockerfile2llb.Dockerfile2LLB(ctx, dfData, dockerfile2llb.ConvertOpt{
 		BuildContext:     &buildContext,
 		ContextLocalName: c.mts.FinalTarget().String(),
-		MetaResolver:     imr.Default(),
+		MetaResolver:     imr.WithTimeout(c.metaResolver, c.timeouts.ImageResolve),
 		ImageResolveMode: c.imageResolveMode,
 		Target:           dfTarget,
-		TargetPlatform:   &llbutil.TargetPlatform,
+		TargetPlatform:   &c.platform,
 		LLBCaps:          &caps,
 		BuildArgs:        newVarCollection.AsMap(),
 		Excludes:         nil, // TODO: Need to process this correctly.
@@ -277,6 +393,13 @@ func (c *Converter) CopyArtifact(ctx context.Context, artifactName string, dest
 	}
 	// Grab the artifacts state in the dep states, after we've built it.
 	relevantDepState := mts.FinalStates
+	c.mts.FinalStates.AddMaterials(relevantDepState.Materials...)
+	if c.locally {
+		if chown != "" {
+			return errors.New("COPY --chown is not supported after LOCALLY")
+		}
+		return c.copyArtifactLocally(ctx, mts, artifact, dest)
+	}
 	// Copy.
 	c.mts.FinalStates.SideEffectsState = llbutil.CopyOp(
 		relevantDepState.ArtifactsState, []string{artifact.Artifact},
@@ -309,8 +432,9 @@ func (c *Converter) CopyClassical(ctx context.Context, srcs []string, dest strin
 			dest))
 }
 
-// Run applies the earth RUN command.
-func (c *Converter) Run(ctx context.Context, args []string, mounts []string, secretKeyValues []string, privileged bool, withEntrypoint bool, withDocker bool, isWithShell bool, pushFlag bool, withSSH bool) error {
+// Run applies the earth RUN command. If outputVar is not empty, the stdout of the
+// command is captured into a build arg with that name.
+func (c *Converter) Run(ctx context.Context, args []string, mounts []string, secretKeyValues []string, privileged bool, withEntrypoint bool, withDocker bool, isWithShell bool, pushFlag bool, sshSockets []string, outputVar string, capAdd []string, timeout time.Duration, retries int) error {
 	if withDocker {
 		fmt.Printf("Warning: RUN --with-docker is deprecated. Use WITH DOCKER ... RUN ... END instead\n")
 	}
@@ -322,8 +446,24 @@ func (c *Converter) Run(ctx context.Context, args []string, mounts []string, sec
 		With("withEntrypoint", withEntrypoint).
 		With("withDocker", withDocker).
 		With("push", pushFlag).
-		With("withSSH", withSSH).
+		With("ssh", sshSockets).
+		With("output", outputVar).
+		With("capAdd", capAdd).
+		With("timeout", timeout).
+		With("retries", retries).
 		Info("Applying RUN")
+	if c.locally {
+		if len(mounts) != 0 || len(secretKeyValues) != 0 || privileged || withEntrypoint ||
+			withDocker || pushFlag || len(sshSockets) != 0 || outputVar != "" ||
+			len(capAdd) != 0 || timeout > 0 || retries > 0 {
+			return errors.New("RUN flags are not supported after LOCALLY")
+		}
+		return c.runLocally(ctx, args, isWithShell)
+	}
+	err := c.checkMounts("RUN", mounts)
+	if err != nil {
+		return err
+	}
 	var opts []llb.RunOption
 	mountRunOpts, err := parseMounts(mounts, c.mts.FinalStates.Target, c.mts.FinalStates.TargetInput, c.cacheContext)
 	if err != nil {
@@ -341,31 +481,121 @@ func (c *Converter) Run(ctx context.Context, args []string, mounts []string, sec
 		finalArgs = append(c.mts.FinalStates.SideEffectsImage.Config.Entrypoint, args...)
 		isWithShell = false // Don't use shell when --entrypoint is passed.
 	}
-	if privileged {
-		opts = append(opts, llb.Security(llb.SecurityModeInsecure))
+	if c.autoCacheMounts {
+		opts = append(opts, autoCacheMounts(ctx, c.mts.FinalStates.SideEffectsImage, finalArgs, mounts)...)
+	}
+	// The debugger, which wraps the command, enforces the timeout.
+	if timeout > 0 {
+		opts = append(opts, llb.AddEnv(common.RunTimeoutEnvVar, timeout.String()))
 	}
 	runStr := fmt.Sprintf(
-		"RUN %s%s%s%s%s",
+		"RUN %s%s%s%s%s%s%s%s%s%s",
 		strIf(privileged, "--privileged "),
+		joinWrap(capAdd, "--cap-add ", " --cap-add ", " "),
+		strIf(timeout > 0, fmt.Sprintf("--timeout %s ", timeout)),
+		strIf(retries > 0, fmt.Sprintf("--retry %d ", retries)),
 		strIf(withDocker, "--with-docker "),
 		strIf(withEntrypoint, "--entrypoint "),
 		strIf(pushFlag, "--push "),
+		strIf(outputVar != "", fmt.Sprintf("--output %s ", outputVar)),
+		joinWrap(sshSockets, "--ssh-id ", " --ssh-id ", " "),
 		strings.Join(finalArgs, " "))
+	err = checkCapAdd(capAdd)
+	if err != nil {
+		return err
+	}
+	if (privileged || withDocker) && c.skipRootless(runStr) {
+		return nil
+	}
+	if privileged {
+		err = c.checkCapabilities([]string{allCapabilities}, "RUN --privileged")
+		if err != nil {
+			return err
+		}
+		opts = append(opts, llb.Security(llb.SecurityModeInsecure))
+	}
 	shellWrap := withShellAndEnvVars
 	if withDocker {
 		shellWrap = withDockerdWrapOld
 	}
-	opts = append(opts, llb.WithCustomNamef("%s%s", c.vertexPrefix(), runStr))
-	return c.internalRun(ctx, finalArgs, secretKeyValues, isWithShell, shellWrap, pushFlag, withSSH, runStr, opts...)
+	vertexName := fmt.Sprintf("%s%s", c.vertexPrefix(), runStr)
+	opts = append(opts, llb.WithCustomName(vertexName))
+	if retries > 0 {
+		// Retried by the builder, rather than within the container, such that a failed
+		// attempt does not leave its changes to the filesystem to the next one.
+		if c.mts.FinalStates.Retries == nil {
+			c.mts.FinalStates.Retries = make(map[string]int)
+		}
+		c.mts.FinalStates.Retries[vertexName] = retries
+	}
+	if outputVar != "" {
+		return c.runWithOutput(finalArgs, secretKeyValues, isWithShell, sshSockets, outputVar, opts...)
+	}
+	return c.internalRun(ctx, finalArgs, secretKeyValues, isWithShell, shellWrap, pushFlag, sshSockets, runStr, opts...)
+}
+
+// runWithOutput runs the args on the side effects state, capturing their stdout
+// into the build arg outputVar.
+func (c *Converter) runWithOutput(args []string, secretKeyValues []string, isWithShell bool, sshSockets []string, outputVar string, opts ...llb.RunOption) error {
+	if !isWithShell {
+		return errors.New("RUN --output is only supported in the shell form")
+	}
+	outPath := path.Join(buildArgsOutDir, outputVar)
+	outArgs := []string{fmt.Sprintf("( %s ) >%s", strings.Join(args, " "), shellQuote(outPath))}
+	finalOpts, err := c.runOpts(outArgs, secretKeyValues, isWithShell, withShellAndEnvVars, sshSockets, opts...)
+	if err != nil {
+		return err
+	}
+	execState := c.mts.FinalStates.SideEffectsState.Run(finalOpts...)
+	outState := execState.AddMount(buildArgsOutDir, llb.Scratch().Platform(c.platform))
+	c.mts.FinalStates.SideEffectsState = execState.Root()
+	variable := variables.NewVariable(
+		buildArgState(outState, outputVar), c.mts.FinalStates.TargetInput, c.nextArgIndex)
+	c.nextArgIndex++
+	c.varCollection.AddActive(outputVar, variable, true)
+	return nil
+}
+
+// Breakpoint applies the earth BREAKPOINT command.
+func (c *Converter) Breakpoint(ctx context.Context) error {
+	logging.GetLogger(ctx).Info("Applying BREAKPOINT")
+	if !c.interactiveDebugging {
+		// Nothing to pause for. The command would also never be cached.
+		return nil
+	}
+	opts := []llb.RunOption{
+		// The build needs to pause every time.
+		llb.IgnoreCache,
+		llb.WithCustomNamef("%sBREAKPOINT", c.vertexPrefix()),
+	}
+	return c.internalRun(
+		ctx, []string{common.BreakpointArg}, nil, false, withShellAndEnvVars, false, nil, "BREAKPOINT", opts...)
 }
 
 // SaveArtifact applies the earth SAVE ARTIFACT command.
-func (c *Converter) SaveArtifact(ctx context.Context, saveFrom string, saveTo string, saveAsLocalTo string) error {
+func (c *Converter) SaveArtifact(ctx context.Context, saveFrom string, saveTo string, saveAsLocalTo string, saveAsRemoteTo string, onFailure bool) error {
 	logging.GetLogger(ctx).
 		With("saveFrom", saveFrom).
 		With("saveTo", saveTo).
 		With("saveAsLocalTo", saveAsLocalTo).
+		With("saveAsRemoteTo", saveAsRemoteTo).
+		With("onFailure", onFailure).
 		Info("Applying SAVE ARTIFACT")
+	if onFailure && saveAsLocalTo == "" {
+		return errors.New("SAVE ARTIFACT --on-failure requires AS LOCAL")
+	}
+	saveFromState := c.mts.FinalStates.SideEffectsState
+	if c.locally {
+		if saveAsLocalTo != "" || saveAsRemoteTo != "" {
+			return errors.New("SAVE ARTIFACT AS LOCAL and AS REMOTE are not supported after LOCALLY")
+		}
+		var err error
+		saveFrom, err = c.localContextPath(saveFrom)
+		if err != nil {
+			return err
+		}
+		saveFromState = c.buildContext
+	}
 	saveToAdjusted := saveTo
 	if saveTo == "" || saveTo == "." || strings.HasSuffix(saveTo, "/") {
 		absSaveFrom, err := llbutil.Abs(ctx, c.mts.FinalStates.SideEffectsState, saveFrom)
@@ -388,12 +618,12 @@ func (c *Converter) SaveArtifact(ctx context.Context, saveFrom string, saveTo st
 		Artifact: artifactPath,
 	}
 	c.mts.FinalStates.ArtifactsState = llbutil.CopyOp(
-		c.mts.FinalStates.SideEffectsState, []string{saveFrom}, c.mts.FinalStates.ArtifactsState,
+		saveFromState, []string{saveFrom}, c.mts.FinalStates.ArtifactsState,
 		saveToAdjusted, true, true, "",
 		llb.WithCustomNamef(
 			"%sSAVE ARTIFACT %s %s", c.vertexPrefix(), saveFrom, artifact.String()))
 	if saveAsLocalTo != "" {
-		separateArtifactsState := llb.Scratch().Platform(llbutil.TargetPlatform)
+		separateArtifactsState := llb.Scratch().Platform(c.platform)
 		separateArtifactsState = llbutil.CopyOp(
 			c.mts.FinalStates.SideEffectsState, []string{saveFrom}, separateArtifactsState,
 			saveToAdjusted, true, false, "",
@@ -401,36 +631,113 @@ func (c *Converter) SaveArtifact(ctx context.Context, saveFrom string, saveTo st
 				"%sSAVE ARTIFACT %s %s AS LOCAL %s",
 				c.vertexPrefix(), saveFrom, artifact.String(), saveAsLocalTo))
 		c.mts.FinalStates.SeparateArtifactsState = append(c.mts.FinalStates.SeparateArtifactsState, separateArtifactsState)
-		c.mts.FinalStates.SaveLocals = append(c.mts.FinalStates.SaveLocals, SaveLocal{
+		saveLocal := SaveLocal{
 			DestPath:     saveAsLocalTo,
 			ArtifactPath: artifactPath,
 			Index:        len(c.mts.FinalStates.SeparateArtifactsState) - 1,
+		}
+		c.mts.FinalStates.SaveLocals = append(c.mts.FinalStates.SaveLocals, saveLocal)
+		if onFailure {
+			ofs := OnFailureSave{SaveLocal: saveLocal, State: separateArtifactsState}
+			for _, step := range c.mts.FinalStates.RunSteps {
+				ofs.FailedStepStates = append(ofs.FailedStepStates, llbutil.CopyOp(
+					step.IgnoreFailureState, []string{saveFrom},
+					llb.Scratch().Platform(c.platform), saveToAdjusted, true, false, "",
+					llb.WithCustomNamef(
+						"%sSAVE ARTIFACT --on-failure %s %s AS LOCAL %s",
+						c.vertexPrefix(), saveFrom, artifact.String(), saveAsLocalTo)))
+			}
+			c.mts.FinalStates.OnFailureSaves = append(c.mts.FinalStates.OnFailureSaves, ofs)
+		}
+	}
+	if saveAsRemoteTo != "" {
+		separateArtifactsState := llb.Scratch().Platform(c.platform)
+		separateArtifactsState = llbutil.CopyOp(
+			c.mts.FinalStates.SideEffectsState, []string{saveFrom}, separateArtifactsState,
+			saveToAdjusted, true, false, "",
+			llb.WithCustomNamef("[internal] SAVE ARTIFACT %s %s (for remote)", saveFrom, artifact.String()))
+		uploadState, err := c.saveArtifactRemote(
+			ctx, separateArtifactsState, artifactPath, saveAsRemoteTo,
+			llb.WithCustomNamef(
+				"%sSAVE ARTIFACT %s %s AS REMOTE %s",
+				c.vertexPrefix(), saveFrom, artifact.String(), saveAsRemoteTo))
+		if err != nil {
+			return err
+		}
+		c.mts.FinalStates.SaveRemotes = append(c.mts.FinalStates.SaveRemotes, SaveRemote{
+			State:        uploadState,
+			ArtifactPath: artifactPath,
+			DestURL:      saveAsRemoteTo,
 		})
 	}
 	return nil
 }
 
 // SaveImage applies the earth SAVE IMAGE command.
-func (c *Converter) SaveImage(ctx context.Context, imageNames []string, pushImages bool) {
-	logging.GetLogger(ctx).With("image", imageNames).With("push", pushImages).Info("Applying SAVE IMAGE")
+func (c *Converter) SaveImage(ctx context.Context, imageNames []string, pushImages bool, insecurePush bool, compression LayerCompression) {
+	logging.GetLogger(ctx).
+		With("image", imageNames).
+		With("push", pushImages).
+		With("insecure", insecurePush).
+		With("compression", compression.Type).
+		Info("Applying SAVE IMAGE")
 	if len(imageNames) == 0 {
 		// Use an empty image name if none provided. This will not be exported
 		// as docker image, but will allow for importing / referencing within
 		// earthfiles.
 		imageNames = []string{""}
 	}
+	img := c.mts.FinalStates.SideEffectsImage.Clone()
+	if c.ociLabels {
+		for key, value := range ociLabels(c.gitMeta, c.buildTimestamp) {
+			if !c.labelsSet[key] {
+				img.Config.Labels[key] = value
+			}
+		}
+	}
 	for _, imageName := range imageNames {
 		c.mts.FinalStates.SaveImages = append(c.mts.FinalStates.SaveImages, SaveImage{
-			State:     c.mts.FinalStates.SideEffectsState,
-			Image:     c.mts.FinalStates.SideEffectsImage.Clone(),
-			DockerTag: imageName,
-			Push:      pushImages,
+			State:       c.mts.FinalStates.SideEffectsState,
+			Image:       img.Clone(),
+			DockerTag:   imageName,
+			Push:        pushImages,
+			Insecure:    insecurePush,
+			Compression: compression,
 		})
 	}
 }
 
+// PushAfter declares that the outputs of the current target, including its push
+// commands, are only to be built after the outputs of the given target.
+func (c *Converter) PushAfter(ctx context.Context, targetName string) error {
+	logging.GetLogger(ctx).
+		With("target-name", targetName).
+		Info("Applying RUN --after")
+	relTarget, err := domain.ParseTarget(targetName)
+	if err != nil {
+		return errors.Wrapf(err, "earth target parse %s", targetName)
+	}
+	target, err := domain.JoinTargets(c.mts.FinalStates.Target, relTarget)
+	if err != nil {
+		return errors.Wrap(err, "join targets")
+	}
+	for _, existing := range c.mts.FinalStates.PushAfter {
+		if existing.StringCanonical() == target.StringCanonical() {
+			return nil
+		}
+	}
+	c.mts.FinalStates.PushAfter = append(c.mts.FinalStates.PushAfter, target)
+	return nil
+}
+
 // Build applies the earth BUILD command.
 func (c *Converter) Build(ctx context.Context, fullTargetName string, buildArgs []string) (*MultiTargetStates, error) {
+	return c.buildForPlatform(ctx, fullTargetName, buildArgs, nil)
+}
+
+// buildForPlatform applies the earth BUILD command, building the target for the given
+// platform, or for the default platform of the build if nil.
+func (c *Converter) buildForPlatform(ctx context.Context, fullTargetName string, buildArgs []string, platform *specs.Platform) (*MultiTargetStates, error) {
 	logging.GetLogger(ctx).
 		With("full-target-name", fullTargetName).
 		With("build-args", buildArgs).
@@ -444,8 +751,60 @@ func (c *Converter) Build(ctx context.Context, fullTargetName string, buildArgs
 	if err != nil {
 		return nil, errors.Wrap(err, "join targets")
 	}
+	if target.IsPattern() {
+		return nil, fmt.Errorf("target pattern %s is only supported by BUILD", fullTargetName)
+	}
+	mts, err := c.buildTarget(ctx, target, relTarget.IsExternal(), buildArgs, platform)
+	if err != nil {
+		return nil, errors.Wrapf(err, "earthfile2llb for %s", fullTargetName)
+	}
+	return mts, nil
+}
+
+// BuildPattern applies the earth BUILD command with a target pattern, such as
+// ./services/...+test. The target is built for each Earthfile under the dir of the
+// pattern which declares it, and whose labels match the filter.
+func (c *Converter) BuildPattern(ctx context.Context, fullTargetName string, buildArgs []string, filter LabelFilter) error {
+	logging.GetLogger(ctx).
+		With("target-pattern", fullTargetName).
+		With("build-args", buildArgs).
+		Info("Applying BUILD with target pattern")
+
+	relTarget, err := domain.ParseTarget(fullTargetName)
+	if err != nil {
+		return errors.Wrapf(err, "earth target parse %s", fullTargetName)
+	}
+	pattern, err := domain.JoinTargets(c.mts.FinalStates.Target, relTarget)
+	if err != nil {
+		return errors.Wrap(err, "join targets")
+	}
+	if !pattern.IsPattern() {
+		return fmt.Errorf("%s is not a target pattern", fullTargetName)
+	}
+	matches, err := expandPattern(ctx, pattern, c.labelFilter, filter)
+	if err != nil {
+		return err
+	}
+	return c.buildPatternMatches(ctx, matches, true, buildArgs)
+}
+
+// buildPatternMatches builds the targets matched by a target pattern, in order.
+func (c *Converter) buildPatternMatches(ctx context.Context, matches []domain.Target, isExternal bool, buildArgs []string) error {
+	for _, match := range matches {
+		mts, err := c.buildTarget(ctx, match, isExternal, buildArgs, nil)
+		if err != nil {
+			return errors.Wrapf(err, "earthfile2llb for %s", match.String())
+		}
+		c.mts.FinalStates.PatternMatches = append(c.mts.FinalStates.PatternMatches, mts.FinalStates)
+	}
+	return nil
+}
+
+// buildTarget converts the target, as a dependency of the current target.
+func (c *Converter) buildTarget(ctx context.Context, target domain.Target, isExternal bool, buildArgs []string, platform *specs.Platform) (*MultiTargetStates, error) {
+	var err error
 	newVarCollection := c.varCollection
-	if relTarget.IsExternal() {
+	if isExternal {
 		// Don't allow transitive overriding variables to cross project boundaries.
 		newVarCollection = variables.NewCollection()
 	}
@@ -457,24 +816,44 @@ func (c *Converter) Build(ctx context.Context, fullTargetName string, buildArgs
 	// Recursion.
 	mts, err := Earthfile2LLB(
 		ctx, target, ConvertOpt{
-			Resolver:         c.resolver,
-			ImageResolveMode: c.imageResolveMode,
-			DockerBuilderFun: c.dockerBuilderFun,
-			CleanCollection:  c.cleanCollection,
-			VisitedStates:    c.mts.VisitedStates,
-			VarCollection:    newVarCollection,
-			SolveCache:       c.solveCache,
+			Resolver:             c.resolver,
+			ImageResolveMode:     c.imageResolveMode,
+			DockerBuilderFun:     c.dockerBuilderFun,
+			ArtifactBuilderFun:   c.artifactBuilderFun,
+			CleanCollection:      c.cleanCollection,
+			VisitedStates:        c.mts.VisitedStates,
+			VarCollection:        newVarCollection,
+			SolveCache:           c.solveCache,
+			RegistryBuilderFun:   c.registryBuilderFun,
+			BuildTimestamp:       c.buildTimestamp,
+			BuiltinArgsProviders: c.argsProviders,
+			CapabilityPolicy:     c.capabilityPolicy,
+			CustomCommands:       c.customCommands,
+			SecurityPolicy:       c.securityPolicy,
+			CACerts:              c.caCerts,
+			Rootless:             c.rootless,
+			DefaultResources:     c.defaultResources,
+			LabelFilter:          c.labelFilter,
+			AutoCacheMounts:      c.autoCacheMounts,
+			OCILabels:            c.ociLabels,
+			InsecureRegistryFun:  c.insecureRegistryFun,
+			Platform:             platform,
+			Timeouts:             c.timeouts,
+			MetaResolver:         c.metaResolver,
+			LocalRunner:          c.localRunner,
+			InteractiveDebugging: c.interactiveDebugging,
 		})
 	if err != nil {
-		return nil, errors.Wrapf(err, "earthfile2llb for %s", fullTargetName)
+		return nil, err
 	}
 	c.directDeps = append(c.directDeps, mts.FinalStates)
 	return mts, nil
 }
 
-// Workdir applies the WORKDIR command.
-func (c *Converter) Workdir(ctx context.Context, workdirPath string) {
-	logging.GetLogger(ctx).With("workdir", workdirPath).Info("Applying WORKDIR")
+// Workdir applies the WORKDIR command. The directories created are owned by chown
+// (user[:group], as names or numeric IDs) if set, and by the user of the image otherwise.
+func (c *Converter) Workdir(ctx context.Context, workdirPath string, chown string) {
+	logging.GetLogger(ctx).With("workdir", workdirPath).With("chown", chown).Info("Applying WORKDIR")
 	c.mts.FinalStates.SideEffectsState = c.mts.FinalStates.SideEffectsState.Dir(workdirPath)
 	workdirAbs := workdirPath
 	if !path.IsAbs(workdirAbs) {
@@ -486,7 +865,11 @@ func (c *Converter) Workdir(ctx context.Context, workdirPath string) {
 		mkdirOpts := []llb.MkdirOption{
 			llb.WithParents(true),
 		}
-		if c.mts.FinalStates.SideEffectsImage.Config.User != "" {
+		switch {
+		case chown != "":
+			// Names are resolved against the /etc/passwd and /etc/group of the image.
+			mkdirOpts = append(mkdirOpts, llb.WithUser(chown))
+		case c.mts.FinalStates.SideEffectsImage.Config.User != "":
 			mkdirOpts = append(mkdirOpts, llb.WithUser(c.mts.FinalStates.SideEffectsImage.Config.User))
 		}
 		opts := []llb.ConstraintsOpt{
@@ -516,6 +899,19 @@ func (c *Converter) Entrypoint(ctx context.Context, entrypointArgs []string, isW
 	c.mts.FinalStates.SideEffectsImage.Config.Entrypoint = withShell(entrypointArgs, isWithShell)
 }
 
+// ClearCmd applies the CMD --clear command, which removes the command of the image.
+func (c *Converter) ClearCmd(ctx context.Context) {
+	logging.GetLogger(ctx).Info("Applying CMD --clear")
+	c.mts.FinalStates.SideEffectsImage.Config.Cmd = nil
+}
+
+// ClearEntrypoint applies the ENTRYPOINT --clear command, which removes the entrypoint
+// of the image.
+func (c *Converter) ClearEntrypoint(ctx context.Context) {
+	logging.GetLogger(ctx).Info("Applying ENTRYPOINT --clear")
+	c.mts.FinalStates.SideEffectsImage.Config.Entrypoint = nil
+}
+
 // Expose applies the EXPOSE command.
 func (c *Converter) Expose(ctx context.Context, ports []string) {
 	logging.GetLogger(ctx).With("ports", ports).Info("Applying EXPOSE")
@@ -524,6 +920,13 @@ func (c *Converter) Expose(ctx context.Context, ports []string) {
 	}
 }
 
+// ClearExpose applies the EXPOSE --clear command, which removes the given ports from the
+// exposed ports of the image, or all of them if none are given.
+func (c *Converter) ClearExpose(ctx context.Context, ports []string) {
+	logging.GetLogger(ctx).With("ports", ports).Info("Applying EXPOSE --clear")
+	c.mts.FinalStates.SideEffectsImage.RemoveExposedPorts(ports...)
+}
+
 // Volume applies the VOLUME command.
 func (c *Converter) Volume(ctx context.Context, volumes []string) {
 	logging.GetLogger(ctx).With("volumes", volumes).Info("Applying VOLUME")
@@ -532,6 +935,13 @@ func (c *Converter) Volume(ctx context.Context, volumes []string) {
 	}
 }
 
+// ClearVolume applies the VOLUME --clear command, which removes the given volumes from
+// the image, or all of them if none are given.
+func (c *Converter) ClearVolume(ctx context.Context, volumes []string) {
+	logging.GetLogger(ctx).With("volumes", volumes).Info("Applying VOLUME --clear")
+	c.mts.FinalStates.SideEffectsImage.RemoveVolumes(volumes...)
+}
+
 // Env applies the ENV command.
 func (c *Converter) Env(ctx context.Context, envKey string, envValue string) {
 	logging.GetLogger(ctx).With("env-key", envKey).With("env-value", envValue).Info("Applying ENV")
@@ -544,6 +954,13 @@ func (c *Converter) Env(ctx context.Context, envKey string, envValue string) {
 // Arg applies the ARG command.
 func (c *Converter) Arg(ctx context.Context, argKey string, defaultArgValue string) {
 	logging.GetLogger(ctx).With("arg-key", argKey).With("arg-value", defaultArgValue).Info("Applying ARG")
+	if c.project != nil {
+		projectValue, found := c.project.Args[argKey]
+		if found {
+			// The project config takes precedence over the default of the Earthfile.
+			defaultArgValue = projectValue
+		}
+	}
 	effective := c.varCollection.AddActive(argKey, variables.NewConstant(defaultArgValue), false)
 	c.mts.FinalStates.TargetInput = c.mts.FinalStates.TargetInput.WithBuildArgInput(
 		effective.BuildArgInput(argKey, defaultArgValue))
@@ -554,9 +971,16 @@ func (c *Converter) Label(ctx context.Context, labels map[string]string) {
 	logging.GetLogger(ctx).With("labels", labels).Info("Applying LABEL")
 	for key, value := range labels {
 		c.mts.FinalStates.SideEffectsImage.Config.Labels[key] = value
+		c.labelsSet[key] = true
 	}
 }
 
+// Host applies the HOST command.
+func (c *Converter) Host(ctx context.Context, host string, ip net.IP) {
+	logging.GetLogger(ctx).With("host", host).With("ip", ip.String()).Info("Applying HOST")
+	c.extraHosts = append(c.extraHosts, extraHost{host: host, ip: ip})
+}
+
 // GitClone applies the GIT CLONE command.
 func (c *Converter) GitClone(ctx context.Context, gitURL string, branch string, dest string) error {
 	logging.GetLogger(ctx).With("git-url", gitURL).With("branch", branch).Info("Applying GIT CLONE")
@@ -576,6 +1000,9 @@ func (c *Converter) GitClone(ctx context.Context, gitURL string, branch string,
 
 // WithDockerRun applies an entire WITH DOCKER ... RUN ... END clause.
 func (c *Converter) WithDockerRun(ctx context.Context, args []string, opt WithDockerOpt) error {
+	if c.skipRootless(fmt.Sprintf("WITH DOCKER RUN %s", strings.Join(args, " "))) {
+		return nil
+	}
 	wdr := &withDockerRun{
 		c: c,
 	}
@@ -585,6 +1012,9 @@ func (c *Converter) WithDockerRun(ctx context.Context, args []string, opt WithDo
 // DockerLoadOld applies the DOCKER LOAD command (outside of WITH DOCKER).
 func (c *Converter) DockerLoadOld(ctx context.Context, targetName string, dockerTag string, buildArgs []string) error {
 	fmt.Printf("Warning: DOCKER LOAD outside of WITH DOCKER is deprecated\n")
+	if c.skipRootless(fmt.Sprintf("DOCKER LOAD %s %s", targetName, dockerTag)) {
+		return nil
+	}
 	logging.GetLogger(ctx).With("target-name", targetName).With("dockerTag", dockerTag).Info("Applying DOCKER LOAD")
 	depTarget, err := domain.ParseTarget(targetName)
 	if err != nil {
@@ -596,6 +1026,7 @@ func (c *Converter) DockerLoadOld(ctx context.Context, targetName string, docker
 	}
 	err = c.solveAndLoadOld(
 		ctx, mts, depTarget.String(), dockerTag,
+		fmt.Sprintf("DOCKER LOAD %s %s", depTarget.String(), dockerTag),
 		llb.WithCustomNamef(
 			"%sDOCKER LOAD %s %s", c.vertexPrefix(), depTarget.String(), dockerTag))
 	if err != nil {
@@ -607,9 +1038,12 @@ func (c *Converter) DockerLoadOld(ctx context.Context, targetName string, docker
 // DockerPullOld applies the DOCKER PULL command (outside of WITH DOCKER).
 func (c *Converter) DockerPullOld(ctx context.Context, dockerTag string) error {
 	fmt.Printf("Warning: DOCKER PULL outside of WITH DOCKER is deprecated\n")
+	if c.skipRootless(fmt.Sprintf("DOCKER PULL %s", dockerTag)) {
+		return nil
+	}
 	logging.GetLogger(ctx).With("dockerTag", dockerTag).Info("Applying DOCKER PULL")
 	state, image, _, err := c.internalFromClassical(
-		ctx, dockerTag,
+		ctx, dockerTag, c.platform, false,
 		llb.WithCustomNamef("%sDOCKER PULL %s", c.vertexPrefix(), dockerTag),
 	)
 	if err != nil {
@@ -629,7 +1063,7 @@ func (c *Converter) DockerPullOld(ctx context.Context, dockerTag string) error {
 		},
 	}
 	err = c.solveAndLoadOld(
-		ctx, mts, dockerTag, dockerTag,
+		ctx, mts, dockerTag, dockerTag, fmt.Sprintf("DOCKER PULL %s", dockerTag),
 		llb.WithCustomNamef("%sDOCKER LOAD (PULL %s)", c.vertexPrefix(), dockerTag))
 	if err != nil {
 		return err
@@ -653,7 +1087,7 @@ func (c *Converter) Healthcheck(ctx context.Context, isNone bool, cmdArgs []stri
 	} else {
 		// TODO: Should support also CMD without shell (exec form).
 		//       See https://github.com/moby/buildkit/blob/master/frontend/dockerfile/dockerfile2llb/image.go#L18
-		hc.Test = append([]string{"CMD-SHELL", strings.Join(cmdArgs, " ")})
+		hc.Test = []string{"CMD-SHELL", strings.Join(cmdArgs, " ")}
 		hc.Interval = interval
 		hc.Timeout = timeout
 		hc.StartPeriod = startPeriod
@@ -662,8 +1096,79 @@ func (c *Converter) Healthcheck(ctx context.Context, isNone bool, cmdArgs []stri
 	c.mts.FinalStates.SideEffectsImage.Config.Healthcheck = hc
 }
 
+// allCapabilities stands for all capabilities (RUN --privileged), when checked against
+// the capability policy.
+const allCapabilities = "ALL"
+
+// checkCapAdd returns an error if RUN --cap-add requests capabilities which commands do
+// not have by default. Buildkit cannot grant individual capabilities to a command: the
+// only way to grant them is to run it in insecure mode, as with RUN --privileged.
+func checkCapAdd(capAdd []string) error {
+	extra := extraCapabilities(capAdd)
+	if len(extra) == 0 {
+		return nil
+	}
+	return fmt.Errorf(
+		"%s is not supported, as commands cannot be granted individual capabilities. Use RUN --privileged instead",
+		joinWrap(extra, "RUN --cap-add ", " --cap-add ", ""))
+}
+
+// extraCapabilities returns the capabilities which commands do not have by default.
+func extraCapabilities(capAdd []string) []string {
+	var extra []string
+	for _, capability := range capAdd {
+		if !common.IsDefaultCapability(capability) {
+			extra = append(extra, capability)
+		}
+	}
+	return extra
+}
+
+// skipRootless returns true if the build is rootless, in which case the command
+// cmdStr, which requires privileges, is not converted. The command is recorded
+// instead, such that all such commands can be reported once the conversion
+// completes. See CheckRootless.
+func (c *Converter) skipRootless(cmdStr string) bool {
+	if !c.rootless {
+		return false
+	}
+	c.mts.FinalStates.RootlessViolations = append(c.mts.FinalStates.RootlessViolations, cmdStr)
+	return true
+}
+
+// checkCapabilities returns an error if the statement, which grants the given
+// capabilities to its commands, is not allowed by the security policy or by the
+// capability policy.
+func (c *Converter) checkCapabilities(capabilities []string, statement string) error {
+	err := c.securityPolicy.check(c.mts.FinalStates.Target, privilegedFeature, statement)
+	if err != nil {
+		return err
+	}
+	if c.capabilityPolicy == nil {
+		return nil
+	}
+	err = c.capabilityPolicy(c.mts.FinalStates.Target, capabilities)
+	if err != nil {
+		return errors.Wrapf(err, "capabilities of %s", c.mts.FinalStates.Target.String())
+	}
+	return nil
+}
+
+// checkMounts returns an error if the --mount specs of the command cmd (RUN or WITH
+// DOCKER) mount host directories, and the security policy does not allow the target to.
+func (c *Converter) checkMounts(cmd string, mounts []string) error {
+	for _, mount := range mounts {
+		if isHostBindMount(mount) {
+			statement := fmt.Sprintf("%s --mount %s", cmd, mount)
+			return c.securityPolicy.check(c.mts.FinalStates.Target, hostBindFeature, statement)
+		}
+	}
+	return nil
+}
+
 // FinalizeStates returns the LLB states.
 func (c *Converter) FinalizeStates() *MultiTargetStates {
+	c.mts.FinalStates.OwnSideEffectsState = c.mts.FinalStates.SideEffectsState
 	// Create an artificial bond to depStates so that side-effects of deps are built automatically.
 	for _, depStates := range c.directDeps {
 		c.mts.FinalStates.SideEffectsState = withDependency(
@@ -673,21 +1178,73 @@ func (c *Converter) FinalizeStates() *MultiTargetStates {
 			depStates.Target)
 	}
 
+	c.mts.FinalStates.Deps = c.directDeps
+	c.mts.FinalStates.Platform = c.platform
 	c.mts.FinalStates.Ongoing = false
 	return c.mts
 }
 
-func (c *Converter) internalRun(ctx context.Context, args []string, secretKeyValues []string, isWithShell bool, shellWrap shellWrapFun, pushFlag bool, withSSH bool, commandStr string, opts ...llb.RunOption) error {
+func (c *Converter) internalRun(ctx context.Context, args []string, secretKeyValues []string, isWithShell bool, shellWrap shellWrapFun, pushFlag bool, sshSockets []string, commandStr string, opts ...llb.RunOption) error {
+	finalOpts, err := c.runOpts(args, secretKeyValues, isWithShell, shellWrap, sshSockets, opts...)
+	if err != nil {
+		return err
+	}
+	if pushFlag {
+		// For push-flagged commands, make sure they run every time - don't use cache.
+		finalOpts = append(finalOpts, llb.IgnoreCache)
+		runPush := &c.mts.FinalStates.RunPush
+		if c.mts.FinalStates.HasPushImages() {
+			// Declared after SAVE IMAGE --push. Execute only once the images have been pushed.
+			runPush = &c.mts.FinalStates.RunPushAfterImages
+		}
+		if !runPush.Initialized {
+			// If this is the first push-flagged command, initialize the state with the latest
+			// side-effects state.
+			runPush.State = c.mts.FinalStates.SideEffectsState
+			runPush.Initialized = true
+		}
+		// Don't run on SideEffectsState. We want push-flagged commands to be executed only
+		// *after* the build. Save this for later.
+		runPush.State = runPush.State.Run(finalOpts...).Root()
+		runPush.CommandStrs = append(runPush.CommandStrs, commandStr)
+	} else {
+		// Should the command fail, it is run again without failing, for saving the
+		// SAVE ARTIFACT --on-failure artifacts as left by the command.
+		ignoreFailureOpts := append(finalOpts[:len(finalOpts):len(finalOpts)],
+			llb.AddEnv(common.RunIgnoreFailureEnvVar, "true"),
+			llb.WithCustomNamef("%s%s (for SAVE ARTIFACT --on-failure)", c.vertexPrefix(), commandStr))
+		step := RunStep{
+			State:              c.mts.FinalStates.SideEffectsState.Run(finalOpts...).Root(),
+			IgnoreFailureState: c.mts.FinalStates.SideEffectsState.Run(ignoreFailureOpts...).Root(),
+		}
+		c.mts.FinalStates.RunSteps = append(c.mts.FinalStates.RunSteps, step)
+		c.mts.FinalStates.SideEffectsState = step.State
+	}
+	return nil
+}
+
+const (
+	// defaultSSHID is the ID of the SSH agent socket forwarded via RUN --ssh.
+	defaultSSHID = "default"
+	// sshSocketsDir is the dir in which the SSH agent sockets selected via
+	// RUN --ssh-id are mounted, as <id>.sock, unless a target path is given.
+	sshSocketsDir = "/run/ssh"
+)
+
+// runOpts returns the options of a run of the given args, in the current build environment.
+func (c *Converter) runOpts(args []string, secretKeyValues []string, isWithShell bool, shellWrap shellWrapFun, sshSockets []string, opts ...llb.RunOption) ([]llb.RunOption, error) {
 	finalOpts := opts
-	var extraEnvVars []string
+	extraEnvVars := []string{
+		shellEnvVar(CacheTargetEnvVar, cacheTarget(c.mts.FinalStates.Target)),
+	}
 	// Secrets.
 	for _, secretKeyValue := range secretKeyValues {
 		parts := strings.SplitN(secretKeyValue, "=", 2)
 		if len(parts) != 2 {
-			return fmt.Errorf("Invalid secret definition %s", secretKeyValue)
+			return nil, fmt.Errorf("Invalid secret definition %s", secretKeyValue)
 		}
 		if !strings.HasPrefix(parts[1], "+secrets/") {
-			return fmt.Errorf("Secret definition %s not supported. Must start with +secrets/", secretKeyValue)
+			return nil, fmt.Errorf("Secret definition %s not supported. Must start with +secrets/", secretKeyValue)
 		}
 		envVar := parts[0]
 		secretID := strings.TrimPrefix(parts[1], "+secrets/")
@@ -699,8 +1256,7 @@ func (c *Converter) internalRun(ctx context.Context, args []string, secretKeyVal
 			llb.SecretFileOpt(0, 0, 0444),
 		}
 		finalOpts = append(finalOpts, llb.AddSecret(secretPath, secretOpts...))
-		// TODO: The use of cat here might not be portable.
-		extraEnvVars = append(extraEnvVars, fmt.Sprintf("%s=\"$(cat %s)\"", envVar, secretPath))
+		extraEnvVars = append(extraEnvVars, shellEnvVarFromFile(envVar, secretPath))
 	}
 	// Build args.
 	for _, buildArgName := range c.varCollection.SortedActiveVariables() {
@@ -709,12 +1265,11 @@ func (c *Converter) internalRun(ctx context.Context, args []string, secretKeyVal
 			continue
 		}
 		if ba.IsConstant() {
-			extraEnvVars = append(extraEnvVars, fmt.Sprintf("%s=\"%s\"", buildArgName, ba.ConstantValue()))
+			extraEnvVars = append(extraEnvVars, shellEnvVar(buildArgName, ba.ConstantValue()))
 		} else {
 			buildArgPath := path.Join("/run/buildargs", buildArgName)
 			finalOpts = append(finalOpts, llb.AddMount(buildArgPath, ba.VariableState(), llb.SourcePath(buildArgPath)))
-			// TODO: The use of cat here might not be portable.
-			extraEnvVars = append(extraEnvVars, fmt.Sprintf("%s=\"$(cat %s)\"", buildArgName, buildArgPath))
+			extraEnvVars = append(extraEnvVars, shellEnvVarFromFile(buildArgName, buildArgPath))
 		}
 	}
 	// Debugger.
@@ -729,79 +1284,68 @@ func (c *Converter) internalRun(ctx context.Context, args []string, secretKeyVal
 	runEarthlyMount := llb.AddMount("/run/earthly", llb.Scratch(),
 		llb.HostBind(), llb.SourcePath("/run/earthly"))
 	finalOpts = append(finalOpts, debuggerSecretMount, debuggerMount, runEarthlyMount)
-	if withSSH {
-		finalOpts = append(finalOpts, llb.AddSSHSocket())
+	// CA certs. The debugger (and the dockerd wrapper) combine them with the system
+	// certs of the image, within the same mount, which is discarded afterwards.
+	if len(c.caCerts) > 0 {
+		caCertsState := llb.Scratch().Platform(c.platform).File(
+			llb.Mkfile(path.Join("/", common.CACertsFile), 0644, c.caCerts),
+			llb.WithCustomName("[internal] CA certs"))
+		finalOpts = append(finalOpts,
+			llb.AddMount(common.CACertsDir, caCertsState),
+			llb.AddEnv(common.CACertsEnvVar, path.Join(common.CACertsDir, common.CACertsFile)))
+	}
+	// Extra hosts.
+	for _, eh := range c.extraHosts {
+		finalOpts = append(finalOpts, llb.AddExtraHost(eh.host, eh.ip))
+	}
+	// SSH agent sockets.
+	for _, sshSocket := range sshSockets {
+		parts := strings.SplitN(sshSocket, "=", 2)
+		sshOpts := []llb.SSHOption{llb.SSHID(parts[0])}
+		switch {
+		case len(parts) == 2:
+			sshOpts = append(sshOpts, llb.SSHSocketTarget(parts[1]))
+		case parts[0] != defaultSSHID:
+			sshOpts = append(sshOpts, llb.SSHSocketTarget(path.Join(sshSocketsDir, parts[0]+".sock")))
+		}
+		finalOpts = append(finalOpts, llb.AddSSHSocket(sshOpts...))
 	}
 	// Shell and debugger wrap.
 	finalArgs := shellWrap(args, extraEnvVars, isWithShell, true)
 	finalOpts = append(finalOpts, llb.Args(finalArgs))
-	if pushFlag {
-		// For push-flagged commands, make sure they run every time - don't use cache.
-		finalOpts = append(finalOpts, llb.IgnoreCache)
-		if !c.mts.FinalStates.RunPush.Initialized {
-			// If this is the first push-flagged command, initialize the state with the latest
-			// side-effects state.
-			c.mts.FinalStates.RunPush.State = c.mts.FinalStates.SideEffectsState
-			c.mts.FinalStates.RunPush.Initialized = true
-		}
-		// Don't run on SideEffectsState. We want push-flagged commands to be executed only
-		// *after* the build. Save this for later.
-		c.mts.FinalStates.RunPush.State = c.mts.FinalStates.RunPush.State.Run(finalOpts...).Root()
-		c.mts.FinalStates.RunPush.CommandStrs = append(
-			c.mts.FinalStates.RunPush.CommandStrs, commandStr)
-	} else {
-		c.mts.FinalStates.SideEffectsState = c.mts.FinalStates.SideEffectsState.Run(finalOpts...).Root()
-	}
-	return nil
+	return finalOpts, nil
 }
 
-func (c *Converter) solveAndLoadOld(ctx context.Context, mts *MultiTargetStates, opName string, dockerTag string, opts ...llb.RunOption) error {
-	// Use a builder to create docker .tar file, mount it via a local build context,
-	// then docker load it within the current side effects state.
-	outDir, err := ioutil.TempDir("/tmp", "earthly-docker-load")
+func (c *Converter) solveAndLoadOld(ctx context.Context, mts *MultiTargetStates, opName string, dockerTag string, statement string, opts ...llb.RunOption) error {
+	// Use a builder to create the docker image, then stream it into docker load
+	// within the current side effects state.
+	err := c.checkCapabilities([]string{allCapabilities}, statement)
 	if err != nil {
-		return errors.Wrap(err, "mk temp dir for docker load")
+		return err
 	}
-	c.cleanCollection.Add(func() error {
-		return os.RemoveAll(outDir)
-	})
-	outFile := path.Join(outDir, "image.tar")
-	err = c.dockerBuilderFun(ctx, mts, dockerTag, outFile)
-	if err != nil {
-		return errors.Wrapf(err, "build target %s for docker load", opName)
+	if c.dockerBuilderFun == nil {
+		return errors.New("DOCKER LOAD and DOCKER PULL are not supported by this build")
 	}
-	dockerImageID, err := dockertar.GetID(outFile)
+	socketID, err := c.dockerBuilderFun(ctx, mts, dockerTag)
 	if err != nil {
-		return errors.Wrap(err, "inspect docker tar after build")
+		return errors.Wrapf(err, "build target %s for docker load", opName)
 	}
-	// Use the docker image ID + dockerTag as sessionID. This will cause
-	// buildkit to use cache when these are the same as before (eg a docker image
-	// that is identical as before).
-	sessionIDKey := fmt.Sprintf("%s-%s", dockerTag, dockerImageID)
-	sha256SessionIDKey := sha256.Sum256([]byte(sessionIDKey))
-	sessionID := hex.EncodeToString(sha256SessionIDKey[:])
-	// Add the tar to the local context.
-	tarContext := llb.Local(
-		opName,
-		llb.SharedKeyHint(opName),
-		llb.SessionID(sessionID),
-		llb.Platform(llbutil.TargetPlatform),
-		llb.WithCustomNamef("[internal] docker tar context %s %s", opName, sessionID),
-	)
-	c.mts.FinalStates.LocalDirs[opName] = outDir
-
 	c.mts.FinalStates.SideEffectsState = c.mts.FinalStates.SideEffectsState.File(
 		llb.Mkdir("/var/lib/docker", 0755, llb.WithParents(true)),
 		llb.WithCustomNamef("[internal] mkdir /var/lib/docker"),
 	)
+	saveImage, _ := mts.FinalStates.LastSaveImage()
+	load := dockerLoad{socketID: socketID, state: saveImage.State}
 	loadOpts := []llb.RunOption{
 		llb.Args(
 			withDockerdWrapOld(
-				[]string{"docker", "load", "</src/image.tar"}, []string{}, true, false)),
-		llb.AddMount("/src", tarContext, llb.Readonly),
-		llb.Dir("/src"),
+				[]string{debuggerPath, common.ReadSocketArg, dockerLoadSocketPath, "|", "docker", "load"},
+				[]string{}, true, false)),
+		llb.AddMount(debuggerPath, llb.Scratch(),
+			llb.HostBind(), llb.SourcePath("/usr/bin/earth_debugger")),
 		llb.Security(llb.SecurityModeInsecure),
 	}
+	loadOpts = append(loadOpts, load.runOpts(dockerLoadSocketPath, dockerLoadImagePath)...)
 	loadOpts = append(loadOpts, opts...)
 	loadOp := c.mts.FinalStates.SideEffectsState.Run(loadOpts...)
 	c.mts.FinalStates.SideEffectsState = loadOp.AddMount(
@@ -810,7 +1354,18 @@ func (c *Converter) solveAndLoadOld(ctx context.Context, mts *MultiTargetStates,
 	return nil
 }
 
+// dockerLoadSocketPath is the path of the socket serving the image of DOCKER LOAD
+// outside of WITH DOCKER.
+const dockerLoadSocketPath = "/run/earthly-docker-load.sock"
+
+// dockerLoadImagePath is the path the image of DOCKER LOAD is mounted at, outside of
+// WITH DOCKER.
+const dockerLoadImagePath = "/run/earthly-docker-load"
+
 func (c *Converter) solveArtifact(ctx context.Context, mts *MultiTargetStates, artifact domain.Artifact) (string, error) {
+	if c.artifactBuilderFun == nil {
+		return "", errors.New("FROM DOCKERFILE with an artifact as build context is not supported by this build")
+	}
 	outDir, err := ioutil.TempDir("/tmp", "earthly-solve-artifact")
 	if err != nil {
 		return "", errors.Wrap(err, "mk temp dir for solve artifact")
@@ -825,11 +1380,11 @@ func (c *Converter) solveArtifact(ctx context.Context, mts *MultiTargetStates, a
 	return outDir, nil
 }
 
-func (c *Converter) internalFromClassical(ctx context.Context, imageName string, opts ...llb.ImageOption) (llb.State, *image.Image, *variables.Collection, error) {
+func (c *Converter) internalFromClassical(ctx context.Context, imageName string, platform specs.Platform, insecure bool, opts ...llb.ImageOption) (llb.State, *image.Image, *variables.Collection, error) {
 	logging.GetLogger(ctx).With("image", imageName).Info("Applying FROM")
 	if imageName == "scratch" {
 		// FROM scratch
-		return llb.Scratch().Platform(llbutil.TargetPlatform), image.NewImage(),
+		return llb.Scratch().Platform(platform), image.NewImage(),
 			c.varCollection.WithResetEnvVars(), nil
 	}
 	ref, err := reference.ParseNormalizedNamed(imageName)
@@ -837,30 +1392,47 @@ func (c *Converter) internalFromClassical(ctx context.Context, imageName string,
 		return llb.State{}, nil, nil, errors.Wrapf(err, "parse normalized named %s", imageName)
 	}
 	baseImageName := reference.TagNameOnly(ref).String()
-	metaResolver := imr.Default()
+	metaResolver := c.metaResolver
+	if insecure {
+		if c.insecureRegistryFun == nil {
+			return llb.State{}, nil, nil, errors.New("FROM --insecure is not supported by this build")
+		}
+		registry := reference.Domain(ref)
+		err = c.insecureRegistryFun(ctx, registry)
+		if err != nil {
+			return llb.State{}, nil, nil, errors.Wrapf(err, "allow insecure registry %s", registry)
+		}
+		metaResolver = imr.Insecure()
+	}
+	metaResolver = imr.WithTimeout(metaResolver, c.timeouts.ImageResolve)
 	dgst, dt, err := metaResolver.ResolveImageConfig(
 		ctx, baseImageName,
 		llb.ResolveImageConfigOpt{
-			Platform:    &llbutil.TargetPlatform,
+			Platform:    &platform,
 			ResolveMode: c.imageResolveMode.String(),
 			LogName:     fmt.Sprintf("%sLoad metadata", c.imageVertexPrefix(imageName)),
 		})
 	if err != nil {
-		return llb.State{}, nil, nil, errors.Wrapf(err, "resolve image config for %s", imageName)
+		return llb.State{}, nil, nil, errcode.Wrap(
+			errors.Wrapf(err, "resolve image config for %s", imageName), errcode.ContextResolution)
 	}
 	var img image.Image
 	err = json.Unmarshal(dt, &img)
 	if err != nil {
 		return llb.State{}, nil, nil, errors.Wrapf(err, "unmarshal image config for %s", imageName)
 	}
+	baseImageMaterial := Material{URI: fmt.Sprintf("pkg:docker/%s", baseImageName)}
 	if dgst != "" {
 		ref, err = reference.WithDigest(ref, dgst)
 		if err != nil {
 			return llb.State{}, nil, nil, errors.Wrapf(err, "reference add digest %v for %s", dgst, imageName)
 		}
+		baseImageMaterial.Digest = map[string]string{dgst.Algorithm().String(): dgst.Hex()}
 	}
-	allOpts := append(opts, llb.Platform(llbutil.TargetPlatform), c.imageResolveMode)
+	c.mts.FinalStates.AddMaterials(baseImageMaterial)
+	allOpts := append(opts, llb.Platform(platform), c.imageResolveMode)
 	state := llb.Image(ref.String(), allOpts...)
+	c.mts.FinalStates.SourceStates = append(c.mts.FinalStates.SourceStates, state)
 	state, img2, newVarCollection := c.applyFromImage(state, &img)
 	return state, img2, newVarCollection, nil
 }
@@ -896,42 +1468,70 @@ func (c *Converter) applyFromImage(state llb.State, img *image.Image) (llb.State
 }
 
 // ExpandArgs expands args in the provided word.
-func (c *Converter) ExpandArgs(word string) string {
+func (c *Converter) ExpandArgs(word string) (string, error) {
 	return c.varCollection.Expand(word)
 }
 
 func (c *Converter) processNonConstantBuildArgFunc(ctx context.Context) variables.ProcessNonConstantVariableFunc {
 	return func(name string, expression string) (llb.State, dedup.TargetInput, int, error) {
-		// Run the expression on the side effects state.
-		srcBuildArgDir := "/run/buildargs-src"
-		srcBuildArgPath := path.Join(srcBuildArgDir, name)
-		c.mts.FinalStates.SideEffectsState = c.mts.FinalStates.SideEffectsState.File(
-			llb.Mkdir(srcBuildArgDir, 0755, llb.WithParents(true)),
-			llb.WithCustomNamef("[internal] mkdir %s", srcBuildArgDir))
-		buildArgPath := path.Join("/run/buildargs", name)
-		args := strings.Split(fmt.Sprintf("echo \"%s\" >%s", expression, srcBuildArgPath), " ")
-		err := c.internalRun(
-			ctx, args, []string{}, true, withShellAndEnvVars, false, false, expression,
-			llb.WithCustomNamef("%sRUN %s", c.vertexPrefix(), expression))
+		// The expression is evaluated in an isolated state derived from the side effects
+		// state, which is left untouched. The state is mounted into every RUN which
+		// follows (see runOpts), as the args are available to all of them as env vars,
+		// so the evaluation executes whenever any of them, or a target the arg is passed
+		// to, is built. Its result is content-cached when mounted.
+		outPath := path.Join(buildArgsOutDir, name)
+		// The expression is intentionally interpreted by the shell. Only the destination
+		// path is quoted.
+		args := []string{fmt.Sprintf("echo \"%s\" >%s", expression, shellQuote(outPath))}
+		opts, err := c.runOpts(
+			args, []string{}, true, withShellAndEnvVars, nil,
+			llb.WithCustomNamef("%sARG %s=%s", c.vertexPrefix(), name, expression))
 		if err != nil {
 			return llb.State{}, dedup.TargetInput{}, 0, errors.Wrapf(err, "run %v", expression)
 		}
-		// Copy the result of the expression into a separate, isolated state.
-		buildArgState := llb.Scratch().Platform(llbutil.TargetPlatform)
-		buildArgState = llbutil.CopyOp(
-			c.mts.FinalStates.SideEffectsState, []string{srcBuildArgPath},
-			buildArgState, buildArgPath, false, false, "",
-			llb.WithCustomNamef("[internal] copy buildarg %s", name))
-		// Store the state with the expression result for later use.
+		outState := c.mts.FinalStates.SideEffectsState.Run(opts...).AddMount(
+			buildArgsOutDir, llb.Scratch().Platform(c.platform))
 		argIndex := c.nextArgIndex
 		c.nextArgIndex++
-		// Remove intermediary file from side effects state.
-		c.mts.FinalStates.SideEffectsState = c.mts.FinalStates.SideEffectsState.File(
-			llb.Rm(srcBuildArgPath, llb.WithAllowNotFound(true)),
-			llb.WithCustomNamef("[internal] rm %s", srcBuildArgPath))
+		return buildArgState(outState, name), c.mts.FinalStates.TargetInput, argIndex, nil
+	}
+}
+
+// buildArgsOutDir is the dir in which the value of a variable build arg is written,
+// within an isolated mount.
+const buildArgsOutDir = "/run/buildargs-out"
 
-		return buildArgState, c.mts.FinalStates.TargetInput, argIndex, nil
+// buildArgState returns a state holding the value of a variable build arg at
+// /run/buildargs/<name>, where consumers expect it, given the state of the
+// buildArgsOutDir mount it was written to.
+func buildArgState(outState llb.State, name string) llb.State {
+	return llbutil.CopyOp(
+		outState, []string{path.Join("/", name)},
+		llb.Scratch().Platform(llbutil.TargetPlatform), path.Join("/run/buildargs", name),
+		false, false, "",
+		llb.WithCustomNamef("[internal] copy buildarg %s", name))
+}
+
+// platformInput returns the platform recorded in the input of a target built for the
+// given platform, which is empty for the default platform of the build.
+func platformInput(platform specs.Platform) string {
+	formatted := platforms.Format(platforms.Normalize(platform))
+	if formatted == platforms.Format(platforms.Normalize(llbutil.TargetPlatform)) {
+		return ""
+	}
+	return formatted
+}
+
+// targetSalt returns the salt distinguishing the instances of a target built with
+// different build args, derived from the input of the target. Being deterministic, the
+// vertex names (and thus the logs) of a target are the same across builds, and the
+// progress of instances with the same input is aggregated.
+func targetSalt(ti dedup.TargetInput) (string, error) {
+	hash, err := ti.Hash()
+	if err != nil {
+		return "", err
 	}
+	return hash[:8], nil
 }
 
 func (c *Converter) vertexPrefix() string {
@@ -968,10 +1568,7 @@ func makeCacheContext(target domain.Target) llb.State {
 }
 
 func cacheKey(target domain.Target) string {
-	// Use the canonical target, but wihout the tag for cache matching.
-	targetCopy := target
-	targetCopy.Tag = ""
-	digest := sha256.Sum256([]byte(targetCopy.StringCanonical()))
+	digest := sha256.Sum256([]byte(cacheTarget(target)))
 	return hex.EncodeToString(digest[:])
 }
 
@@ -988,3 +1585,16 @@ func strIf(condition bool, str string) string {
 	}
 	return ""
 }
+
+// parseExtraHost parses an /etc/hosts entry of the form <host>:<ip>.
+func parseExtraHost(extraHostStr string) (string, net.IP, error) {
+	parts := strings.SplitN(extraHostStr, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", nil, fmt.Errorf("invalid host entry %s. Expected <host>:<ip>", extraHostStr)
+	}
+	ip := net.ParseIP(parts[1])
+	if ip == nil {
+		return "", nil, fmt.Errorf("invalid IP %s of host entry %s", parts[1], extraHostStr)
+	}
+	return parts[0], ip, nil
+}
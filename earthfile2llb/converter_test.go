@@ -0,0 +1,152 @@
+package earthfile2llb
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/earthfile2llb/dedup"
+	"github.com/earthly/earthly/earthfile2llb/image"
+	"github.com/earthly/earthly/earthfile2llb/variables"
+	"github.com/earthly/earthly/llbutil"
+	"github.com/moby/buildkit/client/llb"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestTargetSalt(t *testing.T) {
+	ti := dedup.TargetInput{TargetCanonical: "github.com/foo/bar+build"}
+	withArg := ti.WithBuildArgInput(dedup.BuildArgInput{Name: "VERSION", IsConstant: true, ConstantValue: "1"})
+	withOtherArg := ti.WithBuildArgInput(dedup.BuildArgInput{Name: "VERSION", IsConstant: true, ConstantValue: "2"})
+
+	salt, err := targetSalt(ti)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(salt) != 8 {
+		t.Errorf("unexpected salt %s", salt)
+	}
+	again, err := targetSalt(dedup.TargetInput{TargetCanonical: "github.com/foo/bar+build"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != salt {
+		t.Errorf("expected the same salt for the same input, got %s and %s", salt, again)
+	}
+	saltArg, err := targetSalt(withArg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saltOtherArg, err := targetSalt(withOtherArg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saltArg == salt || saltArg == saltOtherArg {
+		t.Errorf("expected different salts for different build args, got %s, %s and %s", salt, saltArg, saltOtherArg)
+	}
+}
+
+func TestPlatformInput(t *testing.T) {
+	if platformInput(llbutil.TargetPlatform) != "" {
+		t.Errorf("expected no platform input for the default platform, got %s", platformInput(llbutil.TargetPlatform))
+	}
+	arm := specs.Platform{OS: "linux", Architecture: "arm64"}
+	if llbutil.TargetPlatform.Architecture == "arm64" {
+		arm = specs.Platform{OS: "linux", Architecture: "amd64"}
+	}
+	armInput := platformInput(arm)
+	if armInput == "" {
+		t.Fatalf("expected a platform input for %v", arm)
+	}
+	ti := dedup.TargetInput{TargetCanonical: "github.com/foo/bar+build"}
+	withPlatform := ti
+	withPlatform.Platform = armInput
+	if ti.Equals(withPlatform) {
+		t.Error("expected target inputs of different platforms to differ")
+	}
+	salt, err := targetSalt(ti)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saltPlatform, err := targetSalt(withPlatform)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if salt == saltPlatform {
+		t.Errorf("expected different salts for different platforms, got %s", salt)
+	}
+}
+
+func TestCheckCapAdd(t *testing.T) {
+	err := checkCapAdd([]string{"CHOWN", "NET_BIND_SERVICE"})
+	if err != nil {
+		t.Errorf("expected the default capabilities to be accepted, got %v", err)
+	}
+	err = checkCapAdd([]string{"CHOWN", "SYS_ADMIN", "NET_ADMIN"})
+	if err == nil || !strings.HasPrefix(err.Error(), "RUN --cap-add SYS_ADMIN --cap-add NET_ADMIN is not supported") {
+		t.Errorf("expected the extra capabilities to be rejected, got %v", err)
+	}
+}
+
+func TestRunRetries(t *testing.T) {
+	c := &Converter{
+		mts: &MultiTargetStates{FinalStates: &SingleTargetStates{
+			Target:           domain.Target{LocalPath: ".", Target: "deps"},
+			Salt:             "abc",
+			SideEffectsState: llb.Image("alpine:3.11"),
+			SideEffectsImage: image.NewImage(),
+		}},
+		varCollection: variables.NewCollection(),
+	}
+	ctx := context.Background()
+	err := c.Run(ctx, []string{"go", "mod", "download"}, nil, nil, false, false, false, true, false, nil, "", nil, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int{"[+deps abc] RUN --retry 2 go mod download": 2}
+	if !reflect.DeepEqual(c.mts.FinalStates.Retries, expected) {
+		t.Errorf("expected the retries to be recorded by vertex name, got %v", c.mts.FinalStates.Retries)
+	}
+	def, err := c.mts.FinalStates.SideEffectsState.Marshal(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, md := range def.Metadata {
+		found = found || md.Description["llb.customname"] == "[+deps abc] RUN --retry 2 go mod download"
+	}
+	if !found {
+		t.Error("expected the retries to be recorded by the name of the vertex of the command")
+	}
+}
+
+func TestBreakpoint(t *testing.T) {
+	for _, interactive := range []bool{false, true} {
+		c := &Converter{
+			mts: &MultiTargetStates{FinalStates: &SingleTargetStates{
+				Target:           domain.Target{LocalPath: ".", Target: "debug"},
+				SideEffectsState: llb.Image("alpine:3.11"),
+				SideEffectsImage: image.NewImage(),
+			}},
+			varCollection:        variables.NewCollection(),
+			interactiveDebugging: interactive,
+		}
+		ctx := context.Background()
+		before, err := c.mts.FinalStates.SideEffectsState.Marshal(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Breakpoint(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after, err := c.mts.FinalStates.SideEffectsState.Marshal(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed := len(after.Def) != len(before.Def); changed != interactive {
+			t.Errorf("interactive %v: expected the breakpoint to be added only in interactive mode", interactive)
+		}
+	}
+}
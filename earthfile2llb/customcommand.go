@@ -0,0 +1,99 @@
+package earthfile2llb
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/earthly/earthly/domain"
+	"github.com/moby/buildkit/client/llb"
+)
+
+// CommandHandler applies a custom command of Earthfiles, registered via
+// ConvertOpt.CustomCommands. It is called with the converter of the target the command
+// is part of, whose methods manipulate the state of the target (Run, CopyArtifact,
+// Env, SetState, etc.), and with the arguments following the name of the command, with
+// the build args expanded. Handlers are trusted: the states they set are not checked
+// against the capability and security policies.
+type CommandHandler = func(ctx context.Context, c *Converter, args []string) error
+
+var customCommandNameRe = regexp.MustCompile(`^[A-Z]+( [A-Z]+)*$`)
+
+// builtinCommands are the commands of Earthfiles, which custom commands may not
+// override.
+var builtinCommands = []string{
+	"FROM", "FROM DOCKERFILE", "COPY", "SAVE ARTIFACT", "SAVE IMAGE", "RUN", "EXPOSE",
+	"VOLUME", "ENV", "ARG", "LABEL", "BUILD", "WORKDIR", "USER", "CMD", "ENTRYPOINT",
+	"GIT CLONE", "DOCKER LOAD", "DOCKER PULL", "ADD", "STOPSIGNAL", "ONBUILD",
+	"HEALTHCHECK", "SHELL", "WITH DOCKER", "END", "BREAKPOINT", "HOST", "ASSERT",
+	"LOCALLY",
+}
+
+// ValidateCustomCommands returns an error if the name of a custom command is invalid.
+// Names are one or more upper case words, such as TERRAFORM APPLY, and may not start
+// with a builtin command.
+func ValidateCustomCommands(commands map[string]CommandHandler) error {
+	for name := range commands {
+		if !customCommandNameRe.MatchString(name) {
+			return fmt.Errorf("invalid custom command name %q: expected upper case words separated by spaces", name)
+		}
+		for _, builtin := range builtinCommands {
+			if name == builtin || strings.HasPrefix(name, builtin+" ") {
+				return fmt.Errorf("custom command %s conflicts with the builtin command %s", name, builtin)
+			}
+		}
+	}
+	return nil
+}
+
+// matchCustomCommand returns the name and the handler of the custom command invoked by
+// a statement, and the arguments of the command. If several names match, the longest
+// one is used, such that TERRAFORM APPLY takes precedence over TERRAFORM.
+func matchCustomCommand(commands map[string]CommandHandler, commandName string, words []string) (string, CommandHandler, []string, bool) {
+	var matchName string
+	var matchWords int
+	for name := range commands {
+		nameWords := strings.Split(name, " ")
+		if nameWords[0] != commandName || len(nameWords)-1 > len(words) {
+			continue
+		}
+		matched := true
+		for i, w := range nameWords[1:] {
+			if words[i] != w {
+				matched = false
+				break
+			}
+		}
+		if matched && (matchName == "" || len(nameWords) > matchWords) {
+			matchName = name
+			matchWords = len(nameWords)
+		}
+	}
+	if matchName == "" {
+		return "", nil, nil, false
+	}
+	return matchName, commands[matchName], words[matchWords-1:], true
+}
+
+// Target returns the target being converted.
+func (c *Converter) Target() domain.Target {
+	return c.mts.FinalStates.Target
+}
+
+// State returns the current state of the target, which the next command applies to.
+func (c *Converter) State() llb.State {
+	return c.mts.FinalStates.SideEffectsState
+}
+
+// SetState replaces the current state of the target, such as with a state derived
+// from State.
+func (c *Converter) SetState(state llb.State) {
+	c.mts.FinalStates.SideEffectsState = state
+}
+
+// VertexPrefix returns the prefix of the names of the LLB operations of the target, via
+// which the output of the operations is attributed to the target in the console.
+func (c *Converter) VertexPrefix() string {
+	return c.vertexPrefix()
+}
@@ -0,0 +1,97 @@
+package earthfile2llb
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/antlr/antlr4/runtime/Go/antlr"
+	"github.com/earthly/earthly/ast"
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/earthfile2llb/parser"
+	"github.com/earthly/earthly/earthfile2llb/variables"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/pkg/errors"
+)
+
+func TestValidateCustomCommands(t *testing.T) {
+	handler := func(ctx context.Context, c *Converter, args []string) error { return nil }
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"TERRAFORM", true},
+		{"TERRAFORM APPLY", true},
+		{"terraform", false},
+		{"TERRAFORM  APPLY", false},
+		{"RUN", false},
+		{"SAVE ARTIFACT", false},
+		{"SAVE", true},
+		{"DOCKER LOAD FAST", false},
+		{"DOCKER COMPOSE", true},
+		{"ASSERT", false},
+	}
+	for _, tt := range tests {
+		err := ValidateCustomCommands(map[string]CommandHandler{tt.name: handler})
+		if (err == nil) != tt.valid {
+			t.Errorf("%q: expected valid %v, got %v", tt.name, tt.valid, err)
+		}
+	}
+}
+
+func TestCustomCommand(t *testing.T) {
+	var calls []string
+	record := func(name string) CommandHandler {
+		return func(ctx context.Context, c *Converter, args []string) error {
+			calls = append(calls, name+" "+strings.Join(args, " "))
+			if name == "TERRAFORM APPLY" {
+				c.SetState(c.State().File(llb.Mkdir("/terraform", 0755), llb.WithCustomNamef("%sTERRAFORM APPLY", c.VertexPrefix())))
+			}
+			if name == "FAIL" {
+				return errors.New("failed")
+			}
+			return nil
+		}
+	}
+	commands := map[string]CommandHandler{
+		"TERRAFORM":       record("TERRAFORM"),
+		"TERRAFORM APPLY": record("TERRAFORM APPLY"),
+		"FAIL":            record("FAIL"),
+	}
+	convert := func(earthfile string) (*Converter, error) {
+		c := &Converter{
+			mts: &MultiTargetStates{FinalStates: &SingleTargetStates{
+				Target:           domain.Target{LocalPath: ".", Target: "base"},
+				SideEffectsState: llb.Scratch(),
+			}},
+			varCollection:  variables.NewCollection(),
+			customCommands: commands,
+		}
+		stream := antlr.NewCommonTokenStream(ast.NewLexer(antlr.NewInputStream(earthfile)), 0)
+		l := newListener(context.Background(), c, "Earthfile", "base")
+		antlr.ParseTreeWalkerDefault.Walk(l, parser.NewEarthParser(stream).EarthFile())
+		return c, l.Err()
+	}
+
+	c, err := convert("TERRAFORM APPLY -auto-approve ./infra\nTERRAFORM fmt\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"TERRAFORM APPLY -auto-approve ./infra", "TERRAFORM fmt"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected calls %v, got %v", expected, calls)
+	}
+	if c.State().Output() == nil {
+		t.Error("expected the state set by the handler")
+	}
+
+	_, err = convert("FAIL\n")
+	if err == nil || !strings.Contains(err.Error(), "Earthfile:1:1 FAIL: apply FAIL: failed") {
+		t.Errorf("unexpected error %v", err)
+	}
+	_, err = convert("PULUMI up\n")
+	if err == nil || !strings.Contains(err.Error(), "Invalid command PULUMI up") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
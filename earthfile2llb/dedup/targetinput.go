@@ -15,6 +15,9 @@ type TargetInput struct {
 	TargetCanonical string `json:"targetCanonical"`
 	// BuildArgs are the build args used to build this target.
 	BuildArgs []BuildArgInput `json:"buildArgs"`
+	// Platform is the platform this target is built for, if not the default platform of
+	// the build (as per FROM --platform of the caller).
+	Platform string `json:"platform,omitempty"`
 }
 
 // WithBuildArgInput returns a clone of the current target input, with a
@@ -34,7 +37,7 @@ func (ti TargetInput) WithBuildArgInput(bai BuildArgInput) TargetInput {
 
 // Equals compares to another TargetInput for equality.
 func (ti TargetInput) Equals(other TargetInput) bool {
-	if ti.TargetCanonical != other.TargetCanonical {
+	if ti.TargetCanonical != other.TargetCanonical || ti.Platform != other.Platform {
 		return false
 	}
 	if len(ti.BuildArgs) != len(other.BuildArgs) {
@@ -52,6 +55,7 @@ func (ti TargetInput) clone() TargetInput {
 	tiCopy := TargetInput{
 		TargetCanonical: ti.TargetCanonical,
 		BuildArgs:       make([]BuildArgInput, 0, len(ti.BuildArgs)),
+		Platform:        ti.Platform,
 	}
 	for _, bai := range ti.BuildArgs {
 		baiCopy := bai.clone()
@@ -73,6 +77,7 @@ func (ti TargetInput) cloneNoTag() (TargetInput, error) {
 	tiCopy := TargetInput{
 		TargetCanonical: targetStr,
 		BuildArgs:       make([]BuildArgInput, 0, len(ti.BuildArgs)),
+		Platform:        ti.Platform,
 	}
 	for _, bai := range ti.BuildArgs {
 		baiCopy, err := bai.cloneNoTag()
@@ -0,0 +1,309 @@
+package earthfile2llb
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/earthly/earthly/domain"
+	"github.com/pkg/errors"
+)
+
+// DepGraph is the graph of the dependencies between the targets of the local Earthfiles
+// of a directory tree, as declared. Like TargetInfo, it is built without converting the
+// targets, so values referencing build args are not expanded.
+//
+// Targets are identified relative to the root of the tree, such as +build for the
+// Earthfile at the root, or ./services/api+docker for another one.
+type DepGraph struct {
+	root    string
+	targets map[string]*depTarget
+}
+
+// depTarget is a target of the graph.
+type depTarget struct {
+	// dir is the directory of the Earthfile of the target, relative to the root, in
+	// slash form.
+	dir string
+	// deps are the targets referenced by the target. Local targets are relative to the
+	// root, and remote targets as written.
+	deps []string
+	// sources are the files read from the build context, relative to the root, in slash
+	// form.
+	sources []string
+}
+
+// LoadDepGraph parses the Earthfiles of the directory tree root, and those of the local
+// targets they reference outside of it.
+func LoadDepGraph(root string) (*DepGraph, error) {
+	g := &DepGraph{root: root, targets: make(map[string]*depTarget)}
+	var dirs []string
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && p != root && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() && info.Name() == "Earthfile" {
+			dir, err := filepath.Rel(root, filepath.Dir(p))
+			if err != nil {
+				return err
+			}
+			dirs = append(dirs, filepath.ToSlash(dir))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "walk %s", root)
+	}
+	loaded := make(map[string]bool)
+	for len(dirs) > 0 {
+		dir := dirs[0]
+		dirs = dirs[1:]
+		if loaded[dir] {
+			continue
+		}
+		loaded[dir] = true
+		referenced, err := g.load(dir)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, referenced...)
+	}
+	return g, nil
+}
+
+// load adds the targets of the Earthfile of dir to the graph, and returns the
+// directories of the local targets they reference.
+func (g *DepGraph) load(dir string) ([]string, error) {
+	base, infos, err := getEarthfileInfos(filepath.Join(g.root, filepath.FromSlash(dir), "Earthfile"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse Earthfile of %s", dir)
+	}
+	var referenced []string
+	for _, info := range infos {
+		dt := &depTarget{dir: dir}
+		for _, dep := range append(append([]string{}, base.Deps...), info.Deps...) {
+			target, err := domain.ParseTarget(dep)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parse dep %s of %s", dep, info.Name)
+			}
+			if target.IsRemote() {
+				dt.deps = appendUnique(dt.deps, target.String())
+				continue
+			}
+			depDir := localTargetDir(dir, target.LocalPath)
+			referenced = append(referenced, depDir)
+			dt.deps = appendUnique(dt.deps, depTargetRef(depDir, target.Target))
+		}
+		for _, src := range append(append([]string{}, base.Sources...), info.Sources...) {
+			dt.sources = appendUnique(dt.sources, path.Join(dir, filepath.ToSlash(src)))
+		}
+		g.targets[depTargetRef(dir, info.Name)] = dt
+	}
+	return referenced, nil
+}
+
+// localTargetDir returns the directory, relative to the root, of a local target
+// referenced with localPath from the Earthfile of dir.
+func localTargetDir(dir string, localPath string) string {
+	localPath = filepath.ToSlash(localPath)
+	if path.IsAbs(localPath) {
+		// Kept as is, the root being unknown to the Earthfiles.
+		return path.Clean(localPath)
+	}
+	return path.Join(dir, localPath)
+}
+
+// depTargetRef returns the reference, relative to the root, of the target name of the
+// Earthfile of dir.
+func depTargetRef(dir string, name string) string {
+	localPath := dir
+	if dir != "." && !path.IsAbs(dir) && !strings.HasPrefix(dir, "../") {
+		localPath = "./" + dir
+	}
+	return domain.Target{LocalPath: localPath, Target: name}.String()
+}
+
+// normalizeRef returns the reference of the target relative to the root, as it appears
+// in the graph.
+func (g *DepGraph) normalizeRef(ref string) (string, error) {
+	target, err := domain.ParseTarget(ref)
+	if err != nil {
+		return "", errors.Wrapf(err, "parse target %s", ref)
+	}
+	if target.IsRemote() {
+		return target.String(), nil
+	}
+	normalized := depTargetRef(localTargetDir(".", target.LocalPath), target.Target)
+	if _, found := g.targets[normalized]; !found {
+		return "", fmt.Errorf("target %s not found", ref)
+	}
+	return normalized, nil
+}
+
+// Targets returns the local targets of the graph, sorted.
+func (g *DepGraph) Targets() []string {
+	var ret []string
+	for ref := range g.targets {
+		ret = append(ret, ref)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Deps returns the targets the given target depends on, directly or transitively,
+// sorted. Remote targets are included, but not their own dependencies.
+func (g *DepGraph) Deps(ref string) ([]string, error) {
+	ref, err := g.normalizeRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	visited := make(map[string]bool)
+	var visit func(ref string)
+	visit = func(ref string) {
+		dt, found := g.targets[ref]
+		if !found {
+			return
+		}
+		for _, dep := range dt.deps {
+			if visited[dep] {
+				continue
+			}
+			visited[dep] = true
+			visit(dep)
+		}
+	}
+	visit(ref)
+	delete(visited, ref)
+	return sortedRefs(visited), nil
+}
+
+// ReverseDeps returns the local targets which depend on the given target, directly or
+// transitively, sorted.
+func (g *DepGraph) ReverseDeps(ref string) ([]string, error) {
+	ref, err := g.normalizeRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	dependents := g.dependents(map[string]bool{ref: true})
+	delete(dependents, ref)
+	return sortedRefs(dependents), nil
+}
+
+// Affected returns the local targets affected by changes to the given files, sorted. The
+// files are relative to the root, or absolute. A target is affected if a file it reads
+// from its build context changed, if its Earthfile (or the .earthignore next to it)
+// changed, or if a target it depends on is affected. Sources referencing build args
+// are assumed to match any file of the directory of their Earthfile.
+func (g *DepGraph) Affected(changedFiles []string) ([]string, error) {
+	var files []string
+	for _, f := range changedFiles {
+		if filepath.IsAbs(f) {
+			absRoot, err := filepath.Abs(g.root)
+			if err != nil {
+				return nil, errors.Wrapf(err, "abs %s", g.root)
+			}
+			// Paths reported by tools such as git have their symlinks resolved.
+			if resolved, err := filepath.EvalSymlinks(absRoot); err == nil && !strings.HasPrefix(f, absRoot) {
+				absRoot = resolved
+			}
+			rel, err := filepath.Rel(absRoot, f)
+			if err != nil {
+				return nil, errors.Wrapf(err, "rel %s", f)
+			}
+			f = rel
+		}
+		files = append(files, path.Clean(filepath.ToSlash(f)))
+	}
+	affected := make(map[string]bool)
+	for ref, dt := range g.targets {
+		for _, f := range files {
+			if dt.affectedBy(f) {
+				affected[ref] = true
+				break
+			}
+		}
+	}
+	return sortedRefs(g.dependents(affected)), nil
+}
+
+// affectedBy returns whether the target is affected by a change of the file.
+func (dt *depTarget) affectedBy(file string) bool {
+	if file == path.Join(dt.dir, "Earthfile") || file == path.Join(dt.dir, ".earthignore") {
+		return true
+	}
+	for _, src := range dt.sources {
+		if strings.Contains(src, "$") {
+			if withinDir(file, dt.dir) {
+				return true
+			}
+			continue
+		}
+		// The source may be a directory, or a pattern matching a parent directory of
+		// the file.
+		for p := file; ; p = path.Dir(p) {
+			matched, err := path.Match(src, p)
+			if p == src || (err == nil && matched) {
+				return true
+			}
+			if p == "." || p == "/" || path.Base(p) == ".." {
+				break
+			}
+		}
+	}
+	return false
+}
+
+// withinDir returns whether the file is within dir, both relative to the same root.
+func withinDir(file string, dir string) bool {
+	return dir == "." && !strings.HasPrefix(file, "../") || file == dir || strings.HasPrefix(file, dir+"/")
+}
+
+// dependents returns the given targets, and the local targets which depend on them,
+// directly or transitively.
+func (g *DepGraph) dependents(refs map[string]bool) map[string]bool {
+	reverse := make(map[string][]string)
+	for ref, dt := range g.targets {
+		for _, dep := range dt.deps {
+			reverse[dep] = append(reverse[dep], ref)
+		}
+	}
+	ret := make(map[string]bool)
+	var visit func(ref string)
+	visit = func(ref string) {
+		if ret[ref] {
+			return
+		}
+		ret[ref] = true
+		for _, dependent := range reverse[ref] {
+			visit(dependent)
+		}
+	}
+	for ref := range refs {
+		visit(ref)
+	}
+	return ret
+}
+
+func appendUnique(slice []string, s string) []string {
+	for _, existing := range slice {
+		if existing == s {
+			return slice
+		}
+	}
+	return append(slice, s)
+}
+
+func sortedRefs(m map[string]bool) []string {
+	ret := []string{}
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,133 @@
+package earthfile2llb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const depsRootEarthfile = `FROM alpine:3.11
+COPY go.mod ./
+
+build:
+    COPY --dir src ./
+    COPY ./lib+lib/out ./
+    SAVE ARTIFACT out
+
+docker:
+    FROM +build
+    SAVE IMAGE app
+
+docs:
+    COPY docs/*.md ./
+    BUILD github.com/foo/bar+baz
+`
+
+const depsLibEarthfile = `FROM alpine:3.11
+
+lib:
+    COPY *.go ./
+    SAVE ARTIFACT out
+
+generated:
+    COPY $SRC ./
+`
+
+func loadTestDepGraph(t *testing.T) *DepGraph {
+	dir, err := ioutil.TempDir("", "earth-deps-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = os.MkdirAll(filepath.Join(dir, "lib"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "Earthfile"), []byte(depsRootEarthfile), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "lib", "Earthfile"), []byte(depsLibEarthfile), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := LoadDepGraph(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestDepGraphDeps(t *testing.T) {
+	g := loadTestDepGraph(t)
+	expectedTargets := []string{"+build", "+docker", "+docs", "./lib+generated", "./lib+lib"}
+	if !reflect.DeepEqual(g.Targets(), expectedTargets) {
+		t.Errorf("expected targets %v, got %v", expectedTargets, g.Targets())
+	}
+	tests := []struct {
+		target   string
+		deps     []string
+		reverse  []string
+		notFound bool
+	}{
+		{"+docker", []string{"+build", "./lib+lib"}, []string{}, false},
+		{"./+build", []string{"./lib+lib"}, []string{"+docker"}, false},
+		{"./lib+lib", []string{}, []string{"+build", "+docker"}, false},
+		{"+docs", []string{"github.com/foo/bar+baz"}, []string{}, false},
+		{"+missing", nil, nil, true},
+	}
+	for _, test := range tests {
+		deps, err := g.Deps(test.target)
+		if test.notFound {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.target)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.target, err)
+			continue
+		}
+		if !reflect.DeepEqual(deps, test.deps) {
+			t.Errorf("%s: expected deps %v, got %v", test.target, test.deps, deps)
+		}
+		reverse, err := g.ReverseDeps(test.target)
+		if err != nil {
+			t.Errorf("%s: %v", test.target, err)
+			continue
+		}
+		if !reflect.DeepEqual(reverse, test.reverse) {
+			t.Errorf("%s: expected reverse deps %v, got %v", test.target, test.reverse, reverse)
+		}
+	}
+}
+
+func TestDepGraphAffected(t *testing.T) {
+	g := loadTestDepGraph(t)
+	tests := []struct {
+		files    []string
+		expected []string
+	}{
+		{[]string{"src/main.go"}, []string{"+build", "+docker"}},
+		{[]string{"./src/pkg/util.go"}, []string{"+build", "+docker"}},
+		{[]string{"lib/util.go"}, []string{"+build", "+docker", "./lib+generated", "./lib+lib"}},
+		{[]string{"docs/index.md"}, []string{"+docs"}},
+		{[]string{"docs/api/index.md"}, []string{}},
+		{[]string{"go.mod"}, []string{"+build", "+docker", "+docs"}},
+		{[]string{"lib/Earthfile"}, []string{"+build", "+docker", "./lib+generated", "./lib+lib"}},
+		{[]string{"README.md", "lib/README.md"}, []string{"./lib+generated"}},
+		{nil, []string{}},
+	}
+	for _, test := range tests {
+		affected, err := g.Affected(test.files)
+		if err != nil {
+			t.Errorf("%v: %v", test.files, err)
+			continue
+		}
+		if !reflect.DeepEqual(affected, test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.files, test.expected, affected)
+		}
+	}
+}
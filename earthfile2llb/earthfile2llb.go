@@ -3,17 +3,27 @@ package earthfile2llb
 import (
 	"context"
 	"fmt"
+	"path"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/antlr/antlr4/runtime/Go/antlr"
+	"github.com/earthly/earthly/ast"
 	"github.com/earthly/earthly/buildcontext"
 	"github.com/earthly/earthly/cleanup"
 	"github.com/earthly/earthly/domain"
 	"github.com/earthly/earthly/earthfile2llb/antlrhandler"
+	"github.com/earthly/earthly/earthfile2llb/imr"
 	"github.com/earthly/earthly/earthfile2llb/parser"
 	"github.com/earthly/earthly/earthfile2llb/variables"
+	"github.com/earthly/earthly/errcode"
+	"github.com/earthly/earthly/llbutil"
+	"github.com/earthly/earthly/localrun"
 	"github.com/earthly/earthly/logging"
+	"github.com/earthly/earthly/tracing"
 	"github.com/moby/buildkit/client/llb"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 )
 
@@ -25,7 +35,7 @@ type ConvertOpt struct {
 	ImageResolveMode llb.ResolveMode
 	// DockerBuilderFun is a fun that can be used to execute an image build. This
 	// is used as part of operations like DOCKER LOAD and DOCKER PULL, where
-	// a tar image is needed in the middle of a build.
+	// an image needs to be loaded into docker in the middle of a build.
 	DockerBuilderFun DockerBuilderFun
 	// ArtifactBuilderFun is a fun that can be used to execute build of an artifact.
 	// This is used as part of operations like FROM DOCKERFILE +.../..., where
@@ -38,27 +48,130 @@ type ConvertOpt struct {
 	VisitedStates map[string][]*SingleTargetStates
 	// VarCollection is a collection of build args used for overriding args in the build.
 	VarCollection *variables.Collection
-	// A cache for image solves. depTargetInputHash -> context containing image.tar.
-	SolveCache map[string]llb.State
+	// BuildArgMatrix are sets of build args the target is converted with, each in place of
+	// VarCollection. The final states of the result depend on the states of the target for
+	// each set, which are built in a single solve, sharing the commands not depending on
+	// the build args. The target is converted once, with VarCollection, if empty.
+	BuildArgMatrix []*variables.Collection
+	// SolveCache is a cache for the images built for WITH DOCKER --load. A new one is
+	// created if nil.
+	SolveCache *SolveCache
+	// RegistryBuilderFun is a fun that can be used to build an image and push it to the
+	// embedded registry. If set, WITH DOCKER pulls images from the embedded registry
+	// instead of loading them from tar files.
+	RegistryBuilderFun RegistryBuilderFun
+	// BuildTimestamp is the time the build started at, exposed as EARTHLY_BUILD_TIMESTAMP.
+	// If not set, the time of the conversion is used.
+	BuildTimestamp time.Time
+	// BuiltinArgsProviders compute additional builtin args, made available to every target
+	// of the build. The names of the args may not start with EARTHLY_.
+	BuiltinArgsProviders []variables.BuiltinArgsProvider
+	// CapabilityPolicy restricts the targets which may run privileged commands, via RUN
+	// --privileged and WITH DOCKER. All are allowed if nil.
+	CapabilityPolicy CapabilityPolicy
+	// SecurityPolicy restricts which targets may run privileged commands and mount
+	// host directories. All are allowed if its lists are nil.
+	SecurityPolicy SecurityPolicy
+	// CACerts are additional CA certificates (PEM encoded) trusted by the RUN commands
+	// of the build, and by the Docker daemons of WITH DOCKER.
+	CACerts []byte
+	// Rootless indicates that the build runs without privileges. Commands requiring
+	// privileges are not converted and are reported by CheckRootless instead.
+	Rootless bool
+	// DefaultResources are the resource limits of the WITH DOCKER commands which do not
+	// specify their own, via --cpus and --memory. Not limited if zero.
+	DefaultResources Resources
+	// LabelFilter selects the targets matched by the target patterns of the build, by
+	// their labels, in addition to the filters of BUILD.
+	LabelFilter LabelFilter
+	// AutoCacheMounts enables the automatic cache mounts of the package caches of the
+	// toolchains detected in the images (go, npm, pip, cargo, maven), for the RUN
+	// commands using them.
+	AutoCacheMounts bool
+	// OCILabels enables the labels org.opencontainers.image.* (source, revision, created
+	// and version) of the saved images, as per the git metadata of their targets. The
+	// labels set via LABEL take precedence.
+	OCILabels bool
+	// InsecureRegistryFun is called with the registries of the images of FROM --insecure,
+	// before pulling them. FROM --insecure is not supported if nil.
+	InsecureRegistryFun InsecureRegistryFun
+	// Platform is the platform the target is built for, as per FROM --platform of the
+	// caller. The default platform of the build (llbutil.TargetPlatform) is used if nil.
+	Platform *specs.Platform
+	// Timeouts are the timeouts of the resolutions of images and remote repositories.
+	Timeouts Timeouts
+	// CustomCommands are the handlers of the custom commands of Earthfiles, by name
+	// (eg TERRAFORM APPLY). See ValidateCustomCommands for the valid names.
+	CustomCommands map[string]CommandHandler
+	// MetaResolver resolves the configs of the images of FROM, DOCKER PULL and FROM
+	// DOCKERFILE, such as via the buildkit gateway. imr.Default() is used if nil.
+	MetaResolver llb.ImageMetaResolver
+	// LocalRunner is the runner of the host, which translates the paths of the targets
+	// declared LOCALLY. Their commands are not executed by the conversion, but recorded
+	// as the LocalSteps of their states. LOCALLY is not supported if nil.
+	LocalRunner *localrun.Runner
+	// InteractiveDebugging indicates that the interactive debugger is enabled. BREAKPOINT
+	// does nothing otherwise.
+	InteractiveDebugging bool
 }
 
-// DockerBuilderFun is a function able to build a target into a docker tar file.
-type DockerBuilderFun = func(ctx context.Context, mts *MultiTargetStates, dockerTag string, outFile string) error
+// DockerBuilderFun is a function able to build a target into a docker image, which is
+// then served as a docker tar via the socket forwarded by the session of the returned
+// ID, to be streamed into docker load. The ID changes whenever the definition or the
+// config of the image does.
+type DockerBuilderFun = func(ctx context.Context, mts *MultiTargetStates, dockerTag string) (string, error)
+
+// RegistryBuilderFun is a function able to build a target and push it to the embedded
+// registry, as the given repository. It returns a ref (including digest) which can be
+// pulled from within WITH DOCKER.
+type RegistryBuilderFun = func(ctx context.Context, mts *MultiTargetStates, repoName string) (string, error)
 
 // ArtifactBuilderFun is a function able to build an artifact and output it locally.
 type ArtifactBuilderFun = func(ctx context.Context, mts *MultiTargetStates, artifact domain.Artifact, outFile string) error
 
+// InsecureRegistryFun is a function making sure that the buildkit daemon allows plain HTTP
+// connections to the given registry, as well as TLS connections with untrusted
+// certificates.
+type InsecureRegistryFun = func(ctx context.Context, registry string) error
+
+// CapabilityPolicy returns an error if the target is not allowed to run commands with
+// the given capabilities, in addition to the default ones. The capability ALL stands
+// for RUN --privileged and WITH DOCKER, which are the only ways to grant capabilities.
+type CapabilityPolicy = func(target domain.Target, capabilities []string) error
+
 // Earthfile2LLB parses a earthfile and executes the statements for a given target.
 func Earthfile2LLB(ctx context.Context, target domain.Target, opt ConvertOpt) (mts *MultiTargetStates, err error) {
 	if opt.SolveCache == nil {
-		opt.SolveCache = make(map[string]llb.State)
+		opt.SolveCache = NewSolveCache()
 	}
 	if opt.VisitedStates == nil {
 		opt.VisitedStates = make(map[string][]*SingleTargetStates)
 	}
+	if opt.BuildTimestamp.IsZero() {
+		opt.BuildTimestamp = time.Now()
+	}
+	if opt.Platform == nil {
+		opt.Platform = &llbutil.TargetPlatform
+	}
+	if opt.MetaResolver == nil {
+		opt.MetaResolver = imr.Default()
+	}
+	err = ValidateCustomCommands(opt.CustomCommands)
+	if err != nil {
+		return nil, err
+	}
+	if len(opt.BuildArgMatrix) > 0 {
+		return convertMatrix(ctx, target, opt)
+	}
+	if target.IsPattern() {
+		return convertPattern(ctx, target, opt)
+	}
 	// Check if we have previously converted this target, with the same build args.
 	targetStr := target.String()
 	for _, sts := range opt.VisitedStates[targetStr] {
+		if sts.TargetInput.Platform != platformInput(*opt.Platform) {
+			continue
+		}
 		same := true
 		for _, bai := range sts.TargetInput.BuildArgs {
 			if sts.Ongoing && !bai.IsConstant {
@@ -80,8 +193,8 @@ func Earthfile2LLB(ctx context.Context, target domain.Target, opt ConvertOpt) (m
 		}
 		if same {
 			if sts.Ongoing {
-				return nil, fmt.Errorf(
-					"Infinite recursion detected for target %s", targetStr)
+				return nil, errcode.Wrap(fmt.Errorf(
+					"Infinite recursion detected for target %s", targetStr), errcode.Parse)
 			}
 			// Use the already built states.
 			return &MultiTargetStates{
@@ -90,10 +203,17 @@ func Earthfile2LLB(ctx context.Context, target domain.Target, opt ConvertOpt) (m
 			}, nil
 		}
 	}
+	ctx, span := tracing.StartSpan(ctx, fmt.Sprintf("convert %s", target.StringCanonical()))
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
 	// Resolve build context.
-	bc, err := opt.Resolver.Resolve(ctx, target)
+	bc, err := resolveBuildContext(ctx, opt.Resolver, target, opt.Timeouts.GitResolve)
 	if err != nil {
-		return nil, errors.Wrapf(err, "resolve build context for target %s", target.String())
+		return nil, errcode.Wrap(
+			errors.Wrapf(err, "resolve build context for target %s", target.String()),
+			errcode.ContextResolution)
 	}
 	// Convert.
 	targetCtx := logging.With(ctx, "target", target)
@@ -107,32 +227,41 @@ func Earthfile2LLB(ctx context.Context, target domain.Target, opt ConvertOpt) (m
 	if err != nil {
 		return nil, err
 	}
-	walkErr := walkTree(newListener(targetCtx, converter, target.Target), tree)
-	if len(errorListener.Errs) > 0 {
-		var errString []string
-		for _, err := range errorListener.Errs {
-			errString = append(errString, err.Error())
-		}
-		return nil, fmt.Errorf(strings.Join(errString, "\n"))
+	sourceFile := bc.BuildFilePath
+	if target.IsRemote() {
+		sourceFile = path.Join(target.Registry, target.ProjectPath, "Earthfile")
 	}
-	if errorStrategy.Err != nil {
-		var errString []string
-		errString = append(errString,
-			fmt.Sprintf(
-				"Syntax error: line %d:%d when parsing %s",
-				errorStrategy.RE.GetOffendingToken().GetLine(),
-				errorStrategy.RE.GetOffendingToken().GetColumn(),
-				errorStrategy.ErrContext.GetText()))
-		errString = append(errString,
-			fmt.Sprintf("Details: %s", errorStrategy.RE.GetMessage()))
-		return nil, errors.Wrapf(errorStrategy.Err, "%s", strings.Join(errString, "\n"))
+	walkErr := walkTree(newListener(targetCtx, converter, sourceFile, target.Target), tree)
+	err = syntaxError(errorListener, errorStrategy)
+	if err != nil {
+		return nil, errcode.Wrap(err, errcode.Parse)
 	}
 	if walkErr != nil {
-		return nil, walkErr
+		// Errors of the dependencies, such as failures of builds triggered during the
+		// conversion, keep their own category.
+		return nil, errcode.Wrap(walkErr, errcode.Parse)
 	}
 	return converter.FinalizeStates(), nil
 }
 
+// CheckRootless returns an error listing the commands which could not be converted
+// because the build is rootless, if any.
+func CheckRootless(mts *MultiTargetStates) error {
+	var lines []string
+	for _, sts := range mts.AllStates() {
+		for _, cmdStr := range sts.RootlessViolations {
+			lines = append(lines, fmt.Sprintf("  %s: %s", sts.Target.String(), cmdStr))
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	sort.Strings(lines)
+	return fmt.Errorf(
+		"the following commands require privileges, which are not available with a rootless buildkitd:\n%s",
+		strings.Join(lines, "\n"))
+}
+
 func walkTree(l *listener, tree parser.IEarthFileContext) (err error) {
 	defer func() {
 		r := recover()
@@ -148,6 +277,30 @@ func walkTree(l *listener, tree parser.IEarthFileContext) (err error) {
 	return nil
 }
 
+// syntaxError returns the syntax errors encountered while parsing, if any.
+func syntaxError(errorListener *antlrhandler.ReturnErrorListener, errorStrategy *antlrhandler.ReturnErrorStrategy) error {
+	if len(errorListener.Errs) > 0 {
+		var errString []string
+		for _, err := range errorListener.Errs {
+			errString = append(errString, err.Error())
+		}
+		return fmt.Errorf(strings.Join(errString, "\n"))
+	}
+	if errorStrategy.Err != nil {
+		var errString []string
+		errString = append(errString,
+			fmt.Sprintf(
+				"Syntax error: line %d:%d when parsing %s",
+				errorStrategy.RE.GetOffendingToken().GetLine(),
+				errorStrategy.RE.GetOffendingToken().GetColumn(),
+				errorStrategy.ErrContext.GetText()))
+		errString = append(errString,
+			fmt.Sprintf("Details: %s", errorStrategy.RE.GetMessage()))
+		return errors.Wrapf(errorStrategy.Err, "%s", strings.Join(errString, "\n"))
+	}
+	return nil
+}
+
 // ParseDebug parses a earthfile and prints debug information about it.
 func ParseDebug(filename string) error {
 	tree, err := newEarthfileTree(
@@ -164,7 +317,7 @@ func newEarthfileTree(filename string, errorListener antlr.ErrorListener, errorS
 	if err != nil {
 		return nil, errors.Wrapf(err, "new file stream %s", filename)
 	}
-	lexer := newLexer(input)
+	lexer := ast.NewLexer(input)
 	stream := antlr.NewCommonTokenStream(lexer, 0)
 	p := parser.NewEarthParser(stream)
 	p.AddErrorListener(errorListener)
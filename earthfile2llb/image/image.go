@@ -1,6 +1,8 @@
 package image
 
 import (
+	"strings"
+
 	"github.com/earthly/earthly/llbutil"
 	"github.com/moby/buildkit/frontend/dockerfile/dockerfile2llb"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
@@ -82,6 +84,33 @@ func (img *Image) Clone() *Image {
 	return clone
 }
 
+// RemoveExposedPorts removes the given ports from the exposed ports of the image, or
+// all of them if none are given. A port without a protocol stands for its tcp port.
+func (img *Image) RemoveExposedPorts(ports ...string) {
+	if len(ports) == 0 {
+		img.Config.ExposedPorts = make(map[string]struct{})
+		return
+	}
+	for _, port := range ports {
+		delete(img.Config.ExposedPorts, port)
+		if !strings.Contains(port, "/") {
+			delete(img.Config.ExposedPorts, port+"/tcp")
+		}
+	}
+}
+
+// RemoveVolumes removes the given volumes from the image, or all of them if none are
+// given.
+func (img *Image) RemoveVolumes(volumes ...string) {
+	if len(volumes) == 0 {
+		img.Config.Volumes = make(map[string]struct{})
+		return
+	}
+	for _, volume := range volumes {
+		delete(img.Config.Volumes, volume)
+	}
+}
+
 // Config is a docker compatible config for an image.
 type Config struct {
 	specs.ImageConfig
@@ -0,0 +1,53 @@
+package image
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func keys(m map[string]struct{}) string {
+	var ret []string
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return fmt.Sprint(ret)
+}
+
+func TestRemoveExposedPorts(t *testing.T) {
+	tests := []struct {
+		ports    []string
+		expected string
+	}{
+		{nil, "[]"},
+		{[]string{"80"}, "[443/tcp 53/udp 8080]"},
+		{[]string{"8080", "53/udp"}, "[443/tcp 80/tcp]"},
+		{[]string{"53"}, "[443/tcp 53/udp 80/tcp 8080]"},
+	}
+	for _, test := range tests {
+		img := NewImage()
+		for _, port := range []string{"80/tcp", "443/tcp", "53/udp", "8080"} {
+			img.Config.ExposedPorts[port] = struct{}{}
+		}
+		img.RemoveExposedPorts(test.ports...)
+		got := keys(img.Config.ExposedPorts)
+		if got != test.expected {
+			t.Errorf("RemoveExposedPorts(%v): expected %s, got %s", test.ports, test.expected, got)
+		}
+	}
+}
+
+func TestRemoveVolumes(t *testing.T) {
+	img := NewImage()
+	img.Config.Volumes["/data"] = struct{}{}
+	img.Config.Volumes["/var/lib/db"] = struct{}{}
+	img.RemoveVolumes("/data", "/missing")
+	if got := keys(img.Config.Volumes); got != "[/var/lib/db]" {
+		t.Errorf("unexpected volumes %s", got)
+	}
+	img.RemoveVolumes()
+	if got := keys(img.Config.Volumes); got != "[]" {
+		t.Errorf("unexpected volumes %s", got)
+	}
+}
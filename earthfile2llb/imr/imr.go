@@ -5,26 +5,32 @@ package imr
 
 import (
 	"context"
+	"crypto/tls"
+	"net/http"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/containerd/remotes"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/docker/cli/cli/config"
-	"github.com/docker/docker/pkg/locker"
 	"github.com/moby/buildkit/client/llb"
 	"github.com/moby/buildkit/util/contentutil"
 	"github.com/moby/buildkit/util/imageutil"
 	digest "github.com/opencontainers/go-digest"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
 )
 
 var defaultImageMetaResolver llb.ImageMetaResolver
 var defaultImageMetaResolverOnce sync.Once
+var insecureImageMetaResolver llb.ImageMetaResolver
+var insecureImageMetaResolverOnce sync.Once
 
 type imageMetaResolverOpts struct {
 	platform *specs.Platform
+	insecure bool
 }
 
 // ImageMetaResolverOpt represents an ImageMetaResolver option,
@@ -37,23 +43,35 @@ func WithDefaultPlatform(p *specs.Platform) ImageMetaResolverOpt {
 	}
 }
 
+// WithInsecure allows plain HTTP connections to the registries, as well as TLS
+// connections with untrusted certificates.
+func WithInsecure() ImageMetaResolverOpt {
+	return func(o *imageMetaResolverOpts) {
+		o.insecure = true
+	}
+}
+
 // New returns a new ImageMetaResolver.
 func New(ctx context.Context, with ...ImageMetaResolverOpt) llb.ImageMetaResolver {
-	r := docker.NewResolver(docker.ResolverOptions{
-		Authorizer: docker.NewDockerAuthorizer(
-			docker.WithAuthCreds(makeCredentialsFun()),
-		),
-	})
 	var opts imageMetaResolverOpts
 	for _, f := range with {
 		f(&opts)
 	}
+	authorizer := docker.NewDockerAuthorizer(
+		docker.WithAuthCreds(makeCredentialsFun()),
+	)
+	resolverOpts := docker.ResolverOptions{
+		Authorizer: authorizer,
+	}
+	if opts.insecure {
+		resolverOpts.Hosts = insecureHosts(authorizer)
+	}
 	return &imageMetaResolver{
-		resolver: r,
+		resolver: docker.NewResolver(resolverOpts),
 		platform: opts.platform,
 		buffer:   contentutil.NewBuffer(),
 		cache:    map[string]resolveResult{},
-		locker:   locker.New(),
+		inflight: map[string]*resolveCall{},
 	}
 }
 
@@ -65,12 +83,53 @@ func Default() llb.ImageMetaResolver {
 	return defaultImageMetaResolver
 }
 
+// Insecure returns the ImageMetaResolver instance allowing insecure registries.
+func Insecure() llb.ImageMetaResolver {
+	insecureImageMetaResolverOnce.Do(func() {
+		insecureImageMetaResolver = New(context.Background(), WithInsecure())
+	})
+	return insecureImageMetaResolver
+}
+
+// insecureHosts returns the registry hosts which try plain HTTP first, and then TLS
+// without verifying the certificate of the registry.
+func insecureHosts(authorizer docker.Authorizer) docker.RegistryHosts {
+	httpHosts := docker.ConfigureDefaultRegistries(
+		docker.WithAuthorizer(authorizer),
+		docker.WithPlainHTTP(docker.MatchAllHosts),
+	)
+	tlsHosts := docker.ConfigureDefaultRegistries(
+		docker.WithAuthorizer(authorizer),
+		docker.WithClient(&http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		}),
+	)
+	return func(host string) ([]docker.RegistryHost, error) {
+		var hosts []docker.RegistryHost
+		for _, registryHosts := range []docker.RegistryHosts{httpHosts, tlsHosts} {
+			h, err := registryHosts(host)
+			if err != nil {
+				return nil, err
+			}
+			hosts = append(hosts, h...)
+		}
+		return hosts, nil
+	}
+}
+
 type imageMetaResolver struct {
 	resolver remotes.Resolver
 	buffer   contentutil.Buffer
 	platform *specs.Platform
-	locker   *locker.Locker
-	cache    map[string]resolveResult
+
+	mu    sync.Mutex
+	cache map[string]resolveResult
+	// inflight are the resolutions in progress, by key. Concurrent resolutions of the
+	// same image wait for the one in progress, rather than resolving it again.
+	inflight map[string]*resolveCall
 }
 
 type resolveResult struct {
@@ -78,10 +137,14 @@ type resolveResult struct {
 	dgst   digest.Digest
 }
 
-func (imr *imageMetaResolver) ResolveImageConfig(ctx context.Context, ref string, opt llb.ResolveImageConfigOpt) (digest.Digest, []byte, error) {
-	imr.locker.Lock(ref)
-	defer imr.locker.Unlock(ref)
+// resolveCall is a resolution in progress. done is closed once it completes.
+type resolveCall struct {
+	done chan struct{}
+	res  resolveResult
+	err  error
+}
 
+func (imr *imageMetaResolver) ResolveImageConfig(ctx context.Context, ref string, opt llb.ResolveImageConfigOpt) (digest.Digest, []byte, error) {
 	platform := opt.Platform
 	if platform == nil {
 		platform = imr.platform
@@ -89,19 +152,61 @@ func (imr *imageMetaResolver) ResolveImageConfig(ctx context.Context, ref string
 
 	k := imr.key(ref, platform)
 
-	if res, ok := imr.cache[k]; ok {
-		return res.dgst, res.config, nil
+	for {
+		imr.mu.Lock()
+		if res, ok := imr.cache[k]; ok {
+			imr.mu.Unlock()
+			return res.dgst, res.config, nil
+		}
+		call, ok := imr.inflight[k]
+		if !ok {
+			call = &resolveCall{done: make(chan struct{})}
+			imr.inflight[k] = call
+			imr.mu.Unlock()
+			return imr.resolve(ctx, ref, platform, k, call)
+		}
+		imr.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return "", nil, ctx.Err()
+		case <-call.done:
+		}
+		if call.err == nil {
+			return call.res.dgst, call.res.config, nil
+		}
+		if !isContextErr(call.err) {
+			return "", nil, call.err
+		}
+		// The resolution in progress was canceled or timed out with the context of
+		// its caller, while this one may still proceed. Try again.
 	}
+}
 
+// resolve performs the resolution of call, which is in progress under the key k.
+func (imr *imageMetaResolver) resolve(ctx context.Context, ref string, platform *specs.Platform, k string, call *resolveCall) (digest.Digest, []byte, error) {
 	dgst, config, err := imageutil.Config(ctx, ref, imr.resolver, imr.buffer, nil, platform)
+	call.res = resolveResult{dgst: dgst, config: config}
+	call.err = err
+
+	imr.mu.Lock()
+	delete(imr.inflight, k)
+	if err == nil {
+		imr.cache[k] = call.res
+	}
+	imr.mu.Unlock()
+	close(call.done)
+
 	if err != nil {
 		return "", nil, err
 	}
-
-	imr.cache[k] = resolveResult{dgst: dgst, config: config}
 	return dgst, config, nil
 }
 
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
 func (imr *imageMetaResolver) key(ref string, platform *specs.Platform) string {
 	if platform != nil {
 		ref += platforms.Format(*platform)
@@ -132,3 +237,27 @@ func makeCredentialsFun() func(host string) (string, string, error) {
 		return ac.Username, secret, nil
 	}
 }
+
+// WithTimeout returns resolver, with each resolution of an image config limited to
+// timeout. Not limited if zero.
+func WithTimeout(resolver llb.ImageMetaResolver, timeout time.Duration) llb.ImageMetaResolver {
+	if timeout == 0 {
+		return resolver
+	}
+	return &timeoutResolver{resolver: resolver, timeout: timeout}
+}
+
+type timeoutResolver struct {
+	resolver llb.ImageMetaResolver
+	timeout  time.Duration
+}
+
+func (tr *timeoutResolver) ResolveImageConfig(ctx context.Context, ref string, opt llb.ResolveImageConfigOpt) (digest.Digest, []byte, error) {
+	resolveCtx, cancel := context.WithTimeout(ctx, tr.timeout)
+	defer cancel()
+	dgst, config, err := tr.resolver.ResolveImageConfig(resolveCtx, ref, opt)
+	if err != nil && ctx.Err() == nil && resolveCtx.Err() == context.DeadlineExceeded {
+		return "", nil, errors.Wrapf(context.DeadlineExceeded, "timed out after %s", tr.timeout)
+	}
+	return dgst, config, err
+}
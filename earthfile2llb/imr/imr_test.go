@@ -0,0 +1,79 @@
+package imr
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/remotes"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/util/contentutil"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// hangingResolver is a registry which never responds.
+type hangingResolver struct {
+	remotes.Resolver
+	started chan struct{}
+}
+
+func (hr *hangingResolver) Resolve(ctx context.Context, ref string) (string, specs.Descriptor, error) {
+	close(hr.started)
+	<-ctx.Done()
+	return "", specs.Descriptor{}, ctx.Err()
+}
+
+func TestResolveImageConfigCanceled(t *testing.T) {
+	hr := &hangingResolver{started: make(chan struct{})}
+	imr := &imageMetaResolver{
+		resolver: hr,
+		buffer:   contentutil.NewBuffer(),
+		cache:    map[string]resolveResult{},
+		inflight: map[string]*resolveCall{},
+	}
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	defer cancel1()
+	go imr.ResolveImageConfig(ctx1, "docker.io/library/alpine:3.11", llb.ResolveImageConfigOpt{})
+	<-hr.started
+
+	// Waits for the resolution in progress, until canceled.
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel2()
+	_, _, err := imr.ResolveImageConfig(ctx2, "docker.io/library/alpine:3.11", llb.ResolveImageConfigOpt{})
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected the deadline to be exceeded, got %v", err)
+	}
+}
+
+// slowResolver is an image config resolver which responds after delay.
+type slowResolver struct {
+	delay time.Duration
+}
+
+func (sr *slowResolver) ResolveImageConfig(ctx context.Context, ref string, opt llb.ResolveImageConfigOpt) (digest.Digest, []byte, error) {
+	select {
+	case <-time.After(sr.delay):
+		return digest.FromString(ref), []byte("{}"), nil
+	case <-ctx.Done():
+		return "", nil, ctx.Err()
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	resolver := &slowResolver{delay: time.Second}
+	if WithTimeout(resolver, 0) != resolver {
+		t.Error("expected no timeout")
+	}
+	_, _, err := WithTimeout(resolver, 10*time.Millisecond).ResolveImageConfig(
+		context.Background(), "alpine:3.11", llb.ResolveImageConfigOpt{})
+	if err == nil || !strings.Contains(err.Error(), "timed out after 10ms") {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+	_, _, err = WithTimeout(&slowResolver{}, time.Second).ResolveImageConfig(
+		context.Background(), "alpine:3.11", llb.ResolveImageConfigOpt{})
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,139 @@
+package imr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/docker/distribution/reference"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// Registry queries the current state of the repositories of image registries, using the
+// standard docker credentials already available on the system.
+type Registry struct {
+	resolver remotes.Resolver
+	hosts    docker.RegistryHosts
+}
+
+// NewRegistry returns a new Registry.
+func NewRegistry() *Registry {
+	authorizer := docker.NewDockerAuthorizer(
+		docker.WithAuthCreds(makeCredentialsFun()),
+	)
+	hosts := docker.ConfigureDefaultRegistries(docker.WithAuthorizer(authorizer))
+	return &Registry{
+		resolver: docker.NewResolver(docker.ResolverOptions{Hosts: hosts}),
+		hosts:    hosts,
+	}
+}
+
+// ResolveDigest returns the digest the given image reference currently points to. For
+// multi-platform images, this is the digest of the image index.
+func (r *Registry) ResolveDigest(ctx context.Context, ref string) (digest.Digest, error) {
+	_, desc, err := r.resolver.Resolve(ctx, ref)
+	if err != nil {
+		return "", errors.Wrapf(err, "resolve %s", ref)
+	}
+	return desc.Digest, nil
+}
+
+// linkNextRegexp matches the Link header pointing to the next page of a paginated list.
+var linkNextRegexp = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="?next"?`)
+
+// ListTags returns the tags of the repository of the given image name.
+func (r *Registry) ListTags(ctx context.Context, name string) ([]string, error) {
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse normalized named %s", name)
+	}
+	hosts, err := r.hosts(reference.Domain(named))
+	if err != nil {
+		return nil, errors.Wrapf(err, "registry hosts of %s", name)
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no registry host for %s", name)
+	}
+	host := hosts[0]
+	ctx = docker.WithScope(ctx, fmt.Sprintf("repository:%s:pull", reference.Path(named)))
+	u := &url.URL{
+		Scheme: host.Scheme,
+		Host:   host.Host,
+		Path:   fmt.Sprintf("%s/%s/tags/list", host.Path, reference.Path(named)),
+	}
+	var tags []string
+	for u != nil {
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		next, err := getJSON(ctx, host, u, &page)
+		if err != nil {
+			return nil, errors.Wrapf(err, "list tags of %s", named.Name())
+		}
+		tags = append(tags, page.Tags...)
+		u = next
+	}
+	return tags, nil
+}
+
+// getJSON gets the given registry URL and decodes the JSON response into v. The request
+// is authorized, and retried once if the registry asks for another authorization. It
+// returns the URL of the next page, if the response is paginated.
+func getJSON(ctx context.Context, host docker.RegistryHost, u *url.URL, v interface{}) (*url.URL, error) {
+	client := host.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	var resp *http.Response
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Accept", "application/json")
+		if host.Authorizer != nil {
+			err = host.Authorizer.Authorize(ctx, req)
+			if err != nil {
+				return nil, errors.Wrap(err, "authorize")
+			}
+		}
+		resp, err = client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 || host.Authorizer == nil {
+			break
+		}
+		err = host.Authorizer.AddResponses(ctx, []*http.Response{resp})
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "authorize")
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status %s: %s", resp.Status, body)
+	}
+	err := json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode response")
+	}
+	m := linkNextRegexp.FindStringSubmatch(resp.Header.Get("Link"))
+	if m == nil {
+		return nil, nil
+	}
+	next, err := u.Parse(m[1])
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse next link %s", m[1])
+	}
+	return next, nil
+}
@@ -0,0 +1,345 @@
+package earthfile2llb
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/antlr/antlr4/runtime/Go/antlr"
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/earthfile2llb/antlrhandler"
+	"github.com/earthly/earthly/earthfile2llb/parser"
+	"github.com/pkg/errors"
+)
+
+// Lint rules.
+const (
+	// LintUnusedArg flags ARGs which are not referenced after being declared.
+	LintUnusedArg = "unused-arg"
+	// LintMissingCopySource flags COPY sources which are not in the build context.
+	LintMissingCopySource = "missing-copy-source"
+	// LintFixedImageTag flags pushed images whose tag does not depend on a build arg.
+	LintFixedImageTag = "fixed-image-tag"
+	// LintExternalSecret flags secret-like build args passed to remote targets.
+	LintExternalSecret = "external-secret"
+	// LintDeprecated flags deprecated constructs.
+	LintDeprecated = "deprecated"
+)
+
+// LintIssue is a problem found in an Earthfile by Lint.
+type LintIssue struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// String returns the issue in the form file:line:column: message (rule).
+func (li LintIssue) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s (%s)", li.File, li.Line, li.Column, li.Message, li.Rule)
+}
+
+var secretLikeNameRegexp = regexp.MustCompile(`(?i)(secret|token|password|passwd|credential|private_?key|api_?key)`)
+
+// Lint parses an Earthfile and returns the issues found within it, in the order
+// in which they appear. The paths referenced by COPY are resolved relative to
+// the directory of the Earthfile.
+func Lint(filename string) (issues []LintIssue, err error) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			err = fmt.Errorf("parser failure: %v", r)
+		}
+	}()
+	errorListener := antlrhandler.NewReturnErrorListener()
+	errorStrategy := antlrhandler.NewReturnErrorStrategy()
+	tree, err := newEarthfileTree(filename, errorListener, errorStrategy)
+	if err != nil {
+		return nil, errors.Wrap(err, "new earthfile tree")
+	}
+	err = syntaxError(errorListener, errorStrategy)
+	if err != nil {
+		return nil, err
+	}
+	ll := &lintListener{
+		filename:      filename,
+		dir:           filepath.Dir(filename),
+		currentTarget: "base",
+		issues:        []LintIssue{},
+	}
+	antlr.ParseTreeWalkerDefault.Walk(ll, tree)
+	sort.SliceStable(ll.issues, func(i, j int) bool {
+		if ll.issues[i].Line != ll.issues[j].Line {
+			return ll.issues[i].Line < ll.issues[j].Line
+		}
+		return ll.issues[i].Column < ll.issues[j].Column
+	})
+	return ll.issues, nil
+}
+
+type lintListener struct {
+	*parser.BaseEarthParserListener
+	filename      string
+	dir           string
+	currentTarget string
+	issues        []LintIssue
+
+	// baseArgs are the unreferenced ARGs of the base target, which may be
+	// referenced anywhere in the Earthfile.
+	baseArgs []lintArg
+	// targetArgs are the unreferenced ARGs of the current target.
+	targetArgs []lintArg
+
+	stmtWords []string
+}
+
+type lintArg struct {
+	name   string
+	line   int
+	column int
+}
+
+func (l *lintListener) addIssue(token antlr.Token, rule string, format string, a ...interface{}) {
+	l.issues = append(l.issues, LintIssue{
+		File:    l.filename,
+		Line:    token.GetLine(),
+		Column:  token.GetColumn() + 1,
+		Rule:    rule,
+		Message: fmt.Sprintf(format, a...),
+	})
+}
+
+func (l *lintListener) flushUnusedArgs(args []lintArg) {
+	for _, arg := range args {
+		l.issues = append(l.issues, LintIssue{
+			File:    l.filename,
+			Line:    arg.line,
+			Column:  arg.column,
+			Rule:    LintUnusedArg,
+			Message: fmt.Sprintf("ARG %s is declared but never used", arg.name),
+		})
+	}
+}
+
+func (l *lintListener) EnterTargetHeader(c *parser.TargetHeaderContext) {
+	l.flushUnusedArgs(l.targetArgs)
+	l.targetArgs = nil
+	l.currentTarget = strings.TrimSuffix(c.GetText(), ":")
+}
+
+func (l *lintListener) ExitEarthFile(c *parser.EarthFileContext) {
+	l.flushUnusedArgs(l.baseArgs)
+	l.flushUnusedArgs(l.targetArgs)
+	l.baseArgs = nil
+	l.targetArgs = nil
+}
+
+func (l *lintListener) EnterStmt(c *parser.StmtContext) {
+	l.stmtWords = nil
+}
+
+func (l *lintListener) ExitStmt(c *parser.StmtContext) {
+	if c.GetStop() == nil {
+		return
+	}
+	text := c.GetStart().GetInputStream().GetText(c.GetStart().GetStart(), c.GetStop().GetStop())
+	passedThrough := passedThroughBuildArgs(l.stmtWords)
+	l.baseArgs = referencedArgsRemoved(l.baseArgs, text, passedThrough)
+	l.targetArgs = referencedArgsRemoved(l.targetArgs, text, passedThrough)
+}
+
+func (l *lintListener) EnterStmtWord(c *parser.StmtWordContext) {
+	l.stmtWords = append(l.stmtWords, replaceEscape(c.GetText()))
+}
+
+func (l *lintListener) ExitArgStmt(c *parser.ArgStmtContext) {
+	arg := lintArg{
+		name:   c.EnvArgKey().GetText(),
+		line:   c.GetStart().GetLine(),
+		column: c.GetStart().GetColumn() + 1,
+	}
+	if l.currentTarget == "base" {
+		l.baseArgs = append(l.baseArgs, arg)
+	} else {
+		l.targetArgs = append(l.targetArgs, arg)
+	}
+}
+
+func (l *lintListener) ExitFromStmt(c *parser.FromStmtContext) {
+	fs := flag.NewFlagSet("FROM", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	buildArgs := new(StringSliceFlag)
+	fs.Var(buildArgs, "build-arg", "")
+	err := fs.Parse(l.stmtWords)
+	if err != nil || fs.NArg() != 1 || !strings.Contains(fs.Arg(0), "+") {
+		// Errors are reported by the conversion.
+		return
+	}
+	target, err := domain.ParseTarget(fs.Arg(0))
+	if err != nil {
+		return
+	}
+	l.checkExternalSecrets(c.GetStart(), target, buildArgs.Args)
+}
+
+func (l *lintListener) ExitBuildStmt(c *parser.BuildStmtContext) {
+	fs := flag.NewFlagSet("BUILD", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	buildArgs := new(StringSliceFlag)
+	fs.Var(buildArgs, "build-arg", "")
+	fs.Var(new(StringSliceFlag), "label", "")
+	fs.Var(new(StringSliceFlag), "exclude-label", "")
+	err := fs.Parse(l.stmtWords)
+	if err != nil || fs.NArg() != 1 {
+		return
+	}
+	target, err := domain.ParseTarget(fs.Arg(0))
+	if err != nil {
+		return
+	}
+	l.checkExternalSecrets(c.GetStart(), target, buildArgs.Args)
+}
+
+func (l *lintListener) ExitCopyStmt(c *parser.CopyStmtContext) {
+	fs := flag.NewFlagSet("COPY", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.String("from", "", "")
+	fs.Bool("dir", false, "")
+	fs.String("chown", "", "")
+	buildArgs := new(StringSliceFlag)
+	fs.Var(buildArgs, "build-arg", "")
+	err := fs.Parse(l.stmtWords)
+	if err != nil || fs.NArg() < 2 {
+		return
+	}
+	for _, src := range fs.Args()[:fs.NArg()-1] {
+		if strings.Contains(src, "+") {
+			artifact, err := domain.ParseArtifact(src)
+			if err == nil {
+				l.checkExternalSecrets(c.GetStart(), artifact.Target, buildArgs.Args)
+			}
+			continue
+		}
+		if strings.Contains(src, "$") {
+			// Depends on the value of an arg.
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(l.dir, src))
+		if err != nil || len(matches) > 0 {
+			continue
+		}
+		l.addIssue(c.GetStart(), LintMissingCopySource,
+			"COPY source %s does not exist in the build context", src)
+	}
+}
+
+func (l *lintListener) ExitRunStmt(c *parser.RunStmtContext) {
+	fs := flag.NewFlagSet("RUN", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.Bool("push", false, "")
+	fs.Bool("privileged", false, "")
+	fs.Bool("entrypoint", false, "")
+	withDocker := fs.Bool("with-docker", false, "")
+	fs.Bool("ssh", false, "")
+	fs.Var(new(StringSliceFlag), "ssh-id", "")
+	fs.String("output", "", "")
+	fs.Var(new(StringSliceFlag), "secret", "")
+	fs.Var(new(StringSliceFlag), "mount", "")
+	fs.Var(new(StringSliceFlag), "after", "")
+	fs.Var(new(StringSliceFlag), "cap-add", "")
+	fs.String("timeout", "", "")
+	fs.String("retry", "", "")
+	err := fs.Parse(l.stmtWords)
+	if err != nil {
+		return
+	}
+	if *withDocker {
+		l.addIssue(c.GetStart(), LintDeprecated,
+			"RUN --with-docker is deprecated, use WITH DOCKER ... END instead")
+	}
+}
+
+func (l *lintListener) ExitSaveImage(c *parser.SaveImageContext) {
+	fs := flag.NewFlagSet("SAVE IMAGE", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	pushFlag := fs.Bool("push", false, "")
+	fs.String("compression", "", "")
+	fs.String("push-if", "", "")
+	fs.Bool("insecure", false, "")
+	err := fs.Parse(l.stmtWords)
+	if err != nil || !*pushFlag {
+		return
+	}
+	for _, imageName := range fs.Args() {
+		if strings.Contains(imageName, "$") {
+			continue
+		}
+		l.addIssue(c.GetStart(), LintFixedImageTag,
+			"pushed image %s has a fixed tag, consider tagging it with a build arg such as $VERSION",
+			imageName)
+	}
+}
+
+func (l *lintListener) checkExternalSecrets(token antlr.Token, target domain.Target, buildArgs []string) {
+	if !target.IsRemote() || strings.Contains(target.StringCanonical(), "$") {
+		// Not remote, or depends on the value of an arg.
+		return
+	}
+	for _, ba := range buildArgs {
+		name := strings.SplitN(ba, "=", 2)[0]
+		if secretLikeNameRegexp.MatchString(name) ||
+			strings.Contains(ba, "+secrets/") || strings.Contains(ba, "/run/secrets") {
+			l.addIssue(token, LintExternalSecret,
+				"build arg %s looks like a secret and is passed to the remote target %s", name, target.String())
+		}
+	}
+}
+
+// passedThroughBuildArgs returns the names of the build args passed via
+// --build-arg without a value, which use the value of the arg in scope.
+func passedThroughBuildArgs(words []string) []string {
+	var names []string
+	for i, word := range words {
+		var ba string
+		switch {
+		case (word == "--build-arg" || word == "-build-arg") && i+1 < len(words):
+			ba = words[i+1]
+		case strings.HasPrefix(word, "--build-arg="):
+			ba = strings.TrimPrefix(word, "--build-arg=")
+		default:
+			continue
+		}
+		if !strings.Contains(ba, "=") {
+			names = append(names, ba)
+		}
+	}
+	return names
+}
+
+// referencedArgsRemoved returns the args which are not referenced by the given
+// statement text.
+func referencedArgsRemoved(args []lintArg, text string, passedThrough []string) []lintArg {
+	var ret []lintArg
+	for _, arg := range args {
+		if argReferenced(arg.name, text, passedThrough) {
+			continue
+		}
+		ret = append(ret, arg)
+	}
+	return ret
+}
+
+func argReferenced(name string, text string, passedThrough []string) bool {
+	for _, pt := range passedThrough {
+		if pt == name {
+			return true
+		}
+	}
+	re := regexp.MustCompile(`\$\{?` + regexp.QuoteMeta(name) + `([^A-Za-z0-9_]|$)`)
+	return re.MatchString(text)
+}
@@ -0,0 +1,69 @@
+package earthfile2llb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const lintEarthfile = `FROM alpine:3.11
+ARG BASEARG=1
+ARG UNUSEDBASE=1
+
+build:
+    ARG VERSION=dev
+    ARG UNUSED
+    ARG PASSED
+    COPY main.go missing.go ./
+    RUN echo "${VERSION} $BASEARG"
+    BUILD --build-arg PASSED +other
+    BUILD --build-arg GH_TOKEN=abc github.com/foo/bar+baz
+    SAVE IMAGE --push org/app:latest org/app:$VERSION
+
+other:
+    RUN --with-docker echo hi
+`
+
+func TestLint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "earth-lint-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "Earthfile")
+	err = ioutil.WriteFile(path, []byte(lintEarthfile), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issues, err := Lint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		line int
+		rule string
+	}{
+		{3, LintUnusedArg},
+		{7, LintUnusedArg},
+		{9, LintMissingCopySource},
+		{12, LintExternalSecret},
+		{13, LintFixedImageTag},
+		{16, LintDeprecated},
+	}
+	if len(issues) != len(expected) {
+		t.Fatalf("expected %d issues, got %+v", len(expected), issues)
+	}
+	for i, e := range expected {
+		if issues[i].Line != e.line || issues[i].Rule != e.rule {
+			t.Errorf("issue %d: expected %s at line %d, got %s", i, e.rule, e.line, issues[i].String())
+		}
+	}
+	if issues[1].Column != 5 {
+		t.Errorf("expected column 5, got %d", issues[1].Column)
+	}
+}
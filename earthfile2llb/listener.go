@@ -5,10 +5,15 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"net"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/antlr/antlr4/runtime/Go/antlr"
+	"github.com/earthly/earthly/debugger/common"
+	"github.com/earthly/earthly/domain"
 	"github.com/earthly/earthly/earthfile2llb/parser"
 	"github.com/pkg/errors"
 )
@@ -19,6 +24,8 @@ type listener struct {
 	*parser.BaseEarthParserListener
 	converter *Converter
 	ctx       context.Context
+	// filename is the Earthfile, as reported in the location of errors.
+	filename string
 
 	executeTarget   string
 	currentTarget   string
@@ -38,12 +45,15 @@ type listener struct {
 	stmtWords []string
 
 	err error
+	// errLocated is set once err is wrapped in a SourceError.
+	errLocated bool
 }
 
-func newListener(ctx context.Context, converter *Converter, executeTarget string) *listener {
+func newListener(ctx context.Context, converter *Converter, filename string, executeTarget string) *listener {
 	return &listener{
 		ctx:           ctx,
 		converter:     converter,
+		filename:      filename,
 		executeTarget: executeTarget,
 		currentTarget: "base",
 		targetFound:   (executeTarget == "base"),
@@ -64,7 +74,7 @@ func (l *listener) EnterTargetHeader(c *parser.TargetHeaderContext) {
 	// Apply implicit SAVE IMAGE for +base.
 	if l.executeTarget == "base" {
 		if !l.saveImageExists {
-			l.converter.SaveImage(l.ctx, []string{}, false)
+			l.converter.SaveImage(l.ctx, []string{}, false, false, LayerCompression{})
 		}
 		l.saveImageExists = true
 	}
@@ -85,9 +95,10 @@ func (l *listener) EnterTargetHeader(c *parser.TargetHeaderContext) {
 		return
 	}
 	// Apply implicit FROM +base
-	err := l.converter.From(l.ctx, "+base", nil)
+	err := l.converter.From(l.ctx, "+base", nil, false, "")
 	if err != nil {
 		l.err = errors.Wrap(err, "apply implicit FROM +base")
+		l.locateErr(c.GetStart(), c.GetStop())
 		return
 	}
 	l.pushOnlyAllowed = false
@@ -116,6 +127,44 @@ func (l *listener) EnterStmt(c *parser.StmtContext) {
 	l.labelKeys = nil
 	l.labelValues = nil
 	l.execMode = false
+	if l.converter.locally && l.err == nil && !allowedLocally(c) {
+		l.err = fmt.Errorf("%s is not supported after LOCALLY", c.GetStart().GetText())
+	}
+}
+
+// allowedLocally returns whether the statement is supported after LOCALLY: the commands
+// executed on the host, the hand-off of artifacts and the commands which do not depend
+// on the environment of the target.
+func allowedLocally(c *parser.StmtContext) bool {
+	switch {
+	case c.RunStmt() != nil, c.CopyStmt() != nil, c.ArgStmt() != nil, c.BuildStmt() != nil:
+		return true
+	case c.SaveStmt() != nil:
+		return c.SaveStmt().(*parser.SaveStmtContext).SaveArtifact() != nil
+	case c.GenericCommandStmt() != nil:
+		switch c.GenericCommandStmt().(*parser.GenericCommandStmtContext).CommandName().GetText() {
+		case "BREAKPOINT", "HOST", "ASSERT", "LOCALLY":
+			return false
+		}
+		// Custom commands apply the commands above.
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *listener) ExitStmt(c *parser.StmtContext) {
+	l.locateErr(c.GetStart(), c.GetStop())
+}
+
+// locateErr wraps the error of the statement spanning from start to stop, if any, in a
+// SourceError.
+func (l *listener) locateErr(start antlr.Token, stop antlr.Token) {
+	if l.err == nil || l.errLocated {
+		return
+	}
+	l.err = newSourceError(l.filename, start, stop, l.err)
+	l.errLocated = true
 }
 
 func (l *listener) ExitFromStmt(c *parser.FromStmtContext) {
@@ -129,6 +178,8 @@ func (l *listener) ExitFromStmt(c *parser.FromStmtContext) {
 	fs := flag.NewFlagSet("FROM", flag.ContinueOnError)
 	buildArgs := new(StringSliceFlag)
 	fs.Var(buildArgs, "build-arg", "")
+	insecure := fs.Bool("insecure", false, "")
+	platform := fs.String("platform", "", "")
 	err := fs.Parse(l.stmtWords)
 	if err != nil {
 		l.err = errors.Wrapf(err, "invalid FROM arguments %v", l.stmtWords)
@@ -146,7 +197,11 @@ func (l *listener) ExitFromStmt(c *parser.FromStmtContext) {
 	for i, ba := range buildArgs.Args {
 		buildArgs.Args[i] = l.expandArgs(ba)
 	}
-	err = l.converter.From(l.ctx, imageName, buildArgs.Args)
+	*platform = l.expandArgs(*platform)
+	if l.err != nil {
+		return
+	}
+	err = l.converter.From(l.ctx, imageName, buildArgs.Args, *insecure, *platform)
 	if err != nil {
 		l.err = errors.Wrapf(err, "apply FROM %s", imageName)
 		return
@@ -181,6 +236,9 @@ func (l *listener) ExitFromDockerfileStmt(c *parser.FromDockerfileStmtContext) {
 	}
 	*dfPath = l.expandArgs(*dfPath)
 	*dfTarget = l.expandArgs(*dfTarget)
+	if l.err != nil {
+		return
+	}
 	err = l.converter.FromDockerfile(l.ctx, path, *dfPath, *dfTarget, buildArgs.Args)
 	if err != nil {
 		l.err = errors.Wrap(err, "from dockerfile")
@@ -224,6 +282,9 @@ func (l *listener) ExitCopyStmt(c *parser.CopyStmtContext) {
 		buildArgs.Args[i] = l.expandArgs(ba)
 	}
 	*chown = l.expandArgs(*chown)
+	if l.err != nil {
+		return
+	}
 	allClassical := true
 	allArtifacts := true
 	for _, src := range srcs {
@@ -250,6 +311,11 @@ func (l *listener) ExitCopyStmt(c *parser.CopyStmtContext) {
 			l.err = fmt.Errorf("build args not supported for non +artifact arguments case %v", l.stmtWords)
 			return
 		}
+		if l.converter.locally {
+			// The files of the build context are already on the host.
+			l.err = errors.New("COPY of the build context is not supported after LOCALLY")
+			return
+		}
 		l.converter.CopyClassical(l.ctx, srcs, dest, *isDirCopy, *chown)
 	}
 }
@@ -269,15 +335,28 @@ func (l *listener) ExitRunStmt(c *parser.RunStmtContext) {
 	withEntrypoint := fs.Bool("entrypoint", false, "")
 	withDocker := fs.Bool("with-docker", false, "")
 	withSSH := fs.Bool("ssh", false, "")
+	sshIDs := new(StringSliceFlag)
+	fs.Var(sshIDs, "ssh-id", "")
+	output := fs.String("output", "", "")
 	secrets := new(StringSliceFlag)
 	fs.Var(secrets, "secret", "")
 	mounts := new(StringSliceFlag)
 	fs.Var(mounts, "mount", "")
+	pushAfter := new(StringSliceFlag)
+	fs.Var(pushAfter, "after", "")
+	capAdd := new(StringSliceFlag)
+	fs.Var(capAdd, "cap-add", "")
+	timeoutStr := fs.String("timeout", "", "")
+	retryStr := fs.String("retry", "0", "")
 	err := fs.Parse(l.stmtWords)
 	if err != nil {
 		l.err = errors.Wrapf(err, "invalid RUN arguments %v", l.stmtWords)
 		return
 	}
+	if len(pushAfter.Args) > 0 && !*pushFlag {
+		l.err = fmt.Errorf("RUN --after can only be used together with --push: %s", c.GetText())
+		return
+	}
 	withShell := !l.execMode
 	if *withDocker {
 		*privileged = true
@@ -286,17 +365,73 @@ func (l *listener) ExitRunStmt(c *parser.RunStmtContext) {
 		l.err = fmt.Errorf("no non-push commands allowed after a --push: %s", c.GetText())
 		return
 	}
+	if *output != "" && (*pushFlag || *withDocker || *withEntrypoint || l.withDocker != nil) {
+		l.err = fmt.Errorf("RUN --output cannot be combined with --push, --with-docker, --entrypoint or WITH DOCKER: %s", c.GetText())
+		return
+	}
+	if *output != "" && !argNameRegexp.MatchString(*output) {
+		l.err = fmt.Errorf("invalid RUN --output variable name %s", *output)
+		return
+	}
 	// TODO: In the bracket case, should flags be outside of the brackets?
 
 	for i, m := range mounts.Args {
 		mounts.Args[i] = l.expandArgs(m)
 	}
+	for i, secret := range secrets.Args {
+		secrets.Args[i] = l.expandArgs(secret)
+	}
+	for i, after := range pushAfter.Args {
+		pushAfter.Args[i] = l.expandArgs(after)
+	}
+	var sshSockets []string
+	if *withSSH {
+		sshSockets = append(sshSockets, defaultSSHID)
+	}
+	for _, sshID := range sshIDs.Args {
+		sshID = l.expandArgs(sshID)
+		if !sshIDRegexp.MatchString(strings.SplitN(sshID, "=", 2)[0]) {
+			l.err = fmt.Errorf("invalid RUN --ssh-id %s", sshID)
+			return
+		}
+		sshSockets = append(sshSockets, sshID)
+	}
+	var timeout time.Duration
+	if *timeoutStr != "" {
+		timeout, err = time.ParseDuration(l.expandArgs(*timeoutStr))
+		if err != nil || timeout <= 0 {
+			l.err = fmt.Errorf("invalid RUN --timeout %s", *timeoutStr)
+			return
+		}
+	}
+	retries, err := strconv.Atoi(l.expandArgs(*retryStr))
+	if err != nil || retries < 0 {
+		l.err = fmt.Errorf("invalid RUN --retry %s", *retryStr)
+		return
+	}
+	for i, capability := range capAdd.Args {
+		capAdd.Args[i], err = common.ParseCapability(l.expandArgs(capability))
+		if err != nil {
+			l.err = errors.Wrapf(err, "invalid RUN --cap-add %s", capability)
+			return
+		}
+	}
 	// Note: Not expanding args for the run itself, as that will be take care of by the shell.
 
+	if l.err != nil {
+		return
+	}
 	if l.withDocker == nil {
+		for _, after := range pushAfter.Args {
+			err = l.converter.PushAfter(l.ctx, after)
+			if err != nil {
+				l.err = errors.Wrapf(err, "apply RUN --after %s", after)
+				return
+			}
+		}
 		err = l.converter.Run(
 			l.ctx, fs.Args(), mounts.Args, secrets.Args, *privileged, *withEntrypoint, *withDocker,
-			withShell, *pushFlag, *withSSH)
+			withShell, *pushFlag, sshSockets, *output, capAdd.Args, timeout, retries)
 		if err != nil {
 			l.err = errors.Wrap(err, "run")
 			return
@@ -309,6 +444,10 @@ func (l *listener) ExitRunStmt(c *parser.RunStmtContext) {
 			l.err = fmt.Errorf("RUN --push not allowed in WITH DOCKER")
 			return
 		}
+		if timeout > 0 || retries > 0 {
+			l.err = fmt.Errorf("RUN --timeout and --retry not allowed in WITH DOCKER")
+			return
+		}
 		if l.withDockerRan {
 			l.err = fmt.Errorf("Only one RUN command allowed in WITH DOCKER")
 			return
@@ -334,37 +473,55 @@ func (l *listener) ExitSaveArtifact(c *parser.SaveArtifactContext) {
 		l.err = fmt.Errorf("no non-push commands allowed after a --push: %s", c.GetText())
 		return
 	}
-	if len(l.stmtWords) == 0 {
+	fs := flag.NewFlagSet("SAVE ARTIFACT", flag.ContinueOnError)
+	onFailure := fs.Bool("on-failure", false, "")
+	err := fs.Parse(l.stmtWords)
+	if err != nil {
+		l.err = errors.Wrapf(err, "invalid SAVE ARTIFACT arguments %v", l.stmtWords)
+		return
+	}
+	words := fs.Args()
+	if len(words) == 0 {
 		l.err = fmt.Errorf("no arguments provided to the SAVE ARTIFACT command")
 		return
 	}
-	if len(l.stmtWords) > 5 {
+	if len(words) > 5 {
 		l.err = fmt.Errorf("too many arguments provided to the SAVE ARTIFACT command: %v", l.stmtWords)
 		return
 	}
 	saveAsLocalTo := ""
+	saveAsRemoteTo := ""
 	saveTo := "./"
-	if len(l.stmtWords) >= 4 {
-		if strings.Join(l.stmtWords[len(l.stmtWords)-3:len(l.stmtWords)-1], " ") == "AS LOCAL" {
-			saveAsLocalTo = l.stmtWords[len(l.stmtWords)-1]
-			if len(l.stmtWords) == 5 {
-				saveTo = l.stmtWords[1]
+	if len(words) >= 4 {
+		asStr := strings.Join(words[len(words)-3:len(words)-1], " ")
+		if asStr == "AS LOCAL" || asStr == "AS REMOTE" {
+			if asStr == "AS LOCAL" {
+				saveAsLocalTo = words[len(words)-1]
+			} else {
+				saveAsRemoteTo = words[len(words)-1]
+			}
+			if len(words) == 5 {
+				saveTo = words[1]
 			}
 		} else {
 			l.err = fmt.Errorf("invalid arguments for SAVE ARTIFACT command: %v", l.stmtWords)
 			return
 		}
-	} else if len(l.stmtWords) == 2 {
-		saveTo = l.stmtWords[1]
-	} else if len(l.stmtWords) == 3 {
+	} else if len(words) == 2 {
+		saveTo = words[1]
+	} else if len(words) == 3 {
 		l.err = fmt.Errorf("invalid arguments for SAVE ARTIFACT command: %v", l.stmtWords)
 		return
 	}
 
-	saveFrom := l.expandArgs(l.stmtWords[0])
+	saveFrom := l.expandArgs(words[0])
 	saveTo = l.expandArgs(saveTo)
 	saveAsLocalTo = l.expandArgs(saveAsLocalTo)
-	err := l.converter.SaveArtifact(l.ctx, saveFrom, saveTo, saveAsLocalTo)
+	saveAsRemoteTo = l.expandArgs(saveAsRemoteTo)
+	if l.err != nil {
+		return
+	}
+	err = l.converter.SaveArtifact(l.ctx, saveFrom, saveTo, saveAsLocalTo, saveAsRemoteTo, *onFailure)
 	if err != nil {
 		l.err = errors.Wrap(err, "apply SAVE ARTIFACT")
 		return
@@ -384,11 +541,31 @@ func (l *listener) ExitSaveImage(c *parser.SaveImageContext) {
 
 	fs := flag.NewFlagSet("SAVE IMAGE", flag.ContinueOnError)
 	pushFlag := fs.Bool("push", false, "")
+	compressionType := fs.String("compression", "", "")
+	pushIf := fs.String("push-if", "", "")
+	insecure := fs.Bool("insecure", false, "")
 	err := fs.Parse(l.stmtWords)
 	if err != nil {
 		l.err = errors.Wrapf(err, "invalid SAVE IMAGE arguments %v", l.stmtWords)
 		return
 	}
+	if *pushIf != "" && !*pushFlag {
+		l.err = fmt.Errorf("SAVE IMAGE --push-if can only be used together with --push: %s", c.GetText())
+		return
+	}
+	if *insecure && !*pushFlag {
+		l.err = fmt.Errorf("SAVE IMAGE --insecure can only be used together with --push: %s", c.GetText())
+		return
+	}
+	compression := LayerCompression{Type: l.expandArgs(*compressionType)}
+	if l.err != nil {
+		return
+	}
+	err = compression.Validate()
+	if err != nil {
+		l.err = errors.Wrapf(err, "invalid SAVE IMAGE arguments %v", l.stmtWords)
+		return
+	}
 	if !*pushFlag && l.pushOnlyAllowed {
 		l.err = fmt.Errorf("no non-push commands allowed after a --push: %s", c.GetText())
 		return
@@ -402,8 +579,19 @@ func (l *listener) ExitSaveImage(c *parser.SaveImageContext) {
 	for i, img := range imageNames {
 		imageNames[i] = l.expandArgs(img)
 	}
-	l.converter.SaveImage(l.ctx, imageNames, *pushFlag)
-	if *pushFlag {
+	if l.err != nil {
+		return
+	}
+	shouldPush := *pushFlag
+	if *pushIf != "" {
+		shouldPush, err = evalCondition(*pushIf, l.converter.ExpandArgs)
+		if err != nil {
+			l.err = errors.Wrapf(err, "invalid SAVE IMAGE --push-if %s", *pushIf)
+			return
+		}
+	}
+	l.converter.SaveImage(l.ctx, imageNames, shouldPush, *insecure, compression)
+	if shouldPush {
 		l.pushOnlyAllowed = true
 	}
 }
@@ -419,6 +607,10 @@ func (l *listener) ExitBuildStmt(c *parser.BuildStmtContext) {
 	fs := flag.NewFlagSet("BUILD", flag.ContinueOnError)
 	buildArgs := new(StringSliceFlag)
 	fs.Var(buildArgs, "build-arg", "")
+	labels := new(StringSliceFlag)
+	fs.Var(labels, "label", "")
+	excludeLabels := new(StringSliceFlag)
+	fs.Var(excludeLabels, "exclude-label", "")
 	err := fs.Parse(l.stmtWords)
 	if err != nil {
 		l.err = errors.Wrapf(err, "invalid BUILD arguments %v", l.stmtWords)
@@ -432,7 +624,23 @@ func (l *listener) ExitBuildStmt(c *parser.BuildStmtContext) {
 	for i, arg := range buildArgs.Args {
 		buildArgs.Args[i] = l.expandArgs(arg)
 	}
-	_, err = l.converter.Build(l.ctx, fullTargetName, buildArgs.Args)
+	if l.err != nil {
+		return
+	}
+	target, err := domain.ParseTarget(fullTargetName)
+	if err != nil {
+		l.err = errors.Wrapf(err, "parse target %s", fullTargetName)
+		return
+	}
+	filter := LabelFilter{Include: labels.Args, Exclude: excludeLabels.Args}
+	if target.IsPattern() {
+		err = l.converter.BuildPattern(l.ctx, fullTargetName, buildArgs.Args, filter)
+	} else if !filter.IsEmpty() {
+		l.err = fmt.Errorf("BUILD --label and --exclude-label require a target pattern: %s", fullTargetName)
+		return
+	} else {
+		_, err = l.converter.Build(l.ctx, fullTargetName, buildArgs.Args)
+	}
 	if err != nil {
 		l.err = errors.Wrapf(err, "apply BUILD %s", fullTargetName)
 		return
@@ -447,12 +655,23 @@ func (l *listener) ExitWorkdirStmt(c *parser.WorkdirStmtContext) {
 		l.err = fmt.Errorf("no non-push commands allowed after a --push: %s", c.GetText())
 		return
 	}
-	if len(l.stmtWords) != 1 {
+	fs := flag.NewFlagSet("WORKDIR", flag.ContinueOnError)
+	chown := fs.String("chown", "", "")
+	err := fs.Parse(l.stmtWords)
+	if err != nil {
+		l.err = errors.Wrapf(err, "invalid WORKDIR arguments %v", l.stmtWords)
+		return
+	}
+	if fs.NArg() != 1 {
 		l.err = fmt.Errorf("invalid number of arguments for WORKDIR: %v", l.stmtWords)
 		return
 	}
-	workdirPath := l.expandArgs(l.stmtWords[0])
-	l.converter.Workdir(l.ctx, workdirPath)
+	workdirPath := l.expandArgs(fs.Arg(0))
+	*chown = l.expandArgs(*chown)
+	if l.err != nil {
+		return
+	}
+	l.converter.Workdir(l.ctx, workdirPath, *chown)
 }
 
 func (l *listener) ExitUserStmt(c *parser.UserStmtContext) {
@@ -468,6 +687,9 @@ func (l *listener) ExitUserStmt(c *parser.UserStmtContext) {
 		return
 	}
 	user := l.expandArgs(l.stmtWords[0])
+	if l.err != nil {
+		return
+	}
 	l.converter.User(l.ctx, user)
 }
 
@@ -480,12 +702,19 @@ func (l *listener) ExitCmdStmt(c *parser.CmdStmtContext) {
 		return
 	}
 	withShell := !l.execMode
+	if withShell && isClearFlag(l.stmtWords) {
+		l.converter.ClearCmd(l.ctx)
+		return
+	}
 	cmdArgs := l.stmtWords
 	if !withShell {
 		for i, arg := range cmdArgs {
 			cmdArgs[i] = l.expandArgs(arg)
 		}
 	}
+	if l.err != nil {
+		return
+	}
 	l.converter.Cmd(l.ctx, cmdArgs, withShell)
 }
 
@@ -498,12 +727,19 @@ func (l *listener) ExitEntrypointStmt(c *parser.EntrypointStmtContext) {
 		return
 	}
 	withShell := !l.execMode
+	if withShell && isClearFlag(l.stmtWords) {
+		l.converter.ClearEntrypoint(l.ctx)
+		return
+	}
 	entArgs := l.stmtWords
 	if !withShell {
 		for i, arg := range entArgs {
 			entArgs[i] = l.expandArgs(arg)
 		}
 	}
+	if l.err != nil {
+		return
+	}
 	l.converter.Entrypoint(l.ctx, entArgs, withShell)
 }
 
@@ -515,14 +751,28 @@ func (l *listener) ExitExposeStmt(c *parser.ExposeStmtContext) {
 		l.err = fmt.Errorf("no non-push commands allowed after a --push: %s", c.GetText())
 		return
 	}
-	if len(l.stmtWords) == 0 {
+	fs := flag.NewFlagSet("EXPOSE", flag.ContinueOnError)
+	clearFlag := fs.Bool("clear", false, "")
+	err := fs.Parse(l.stmtWords)
+	if err != nil {
+		l.err = errors.Wrapf(err, "invalid EXPOSE arguments %v", l.stmtWords)
+		return
+	}
+	if fs.NArg() == 0 && !*clearFlag {
 		l.err = fmt.Errorf("no arguments provided to the EXPOSE command")
 		return
 	}
-	ports := l.stmtWords
+	ports := fs.Args()
 	for i, port := range ports {
 		ports[i] = l.expandArgs(port)
 	}
+	if l.err != nil {
+		return
+	}
+	if *clearFlag {
+		l.converter.ClearExpose(l.ctx, ports)
+		return
+	}
 	l.converter.Expose(l.ctx, ports)
 }
 
@@ -534,14 +784,28 @@ func (l *listener) ExitVolumeStmt(c *parser.VolumeStmtContext) {
 		l.err = fmt.Errorf("no non-push commands allowed after a --push: %s", c.GetText())
 		return
 	}
-	if len(l.stmtWords) == 0 {
+	fs := flag.NewFlagSet("VOLUME", flag.ContinueOnError)
+	clearFlag := fs.Bool("clear", false, "")
+	err := fs.Parse(l.stmtWords)
+	if err != nil {
+		l.err = errors.Wrapf(err, "invalid VOLUME arguments %v", l.stmtWords)
+		return
+	}
+	if fs.NArg() == 0 && !*clearFlag {
 		l.err = fmt.Errorf("no arguments provided to the VOLUME command")
 		return
 	}
-	volumes := l.stmtWords
+	volumes := fs.Args()
 	for i, volume := range volumes {
 		volumes[i] = l.expandArgs(volume)
 	}
+	if l.err != nil {
+		return
+	}
+	if *clearFlag {
+		l.converter.ClearVolume(l.ctx, volumes)
+		return
+	}
 	l.converter.Volume(l.ctx, volumes)
 }
 
@@ -555,6 +819,9 @@ func (l *listener) ExitEnvStmt(c *parser.EnvStmtContext) {
 	}
 	key := l.envArgKey // Note: Not expanding args for key.
 	value := l.expandArgs(l.envArgValue)
+	if l.err != nil {
+		return
+	}
 	l.converter.Env(l.ctx, key, value)
 }
 
@@ -568,6 +835,9 @@ func (l *listener) ExitArgStmt(c *parser.ArgStmtContext) {
 	}
 	key := l.envArgKey // Note: Not expanding args for key.
 	value := l.expandArgs(l.envArgValue)
+	if l.err != nil {
+		return
+	}
 	l.converter.Arg(l.ctx, key, value)
 }
 
@@ -591,6 +861,9 @@ func (l *listener) ExitLabelStmt(c *parser.LabelStmtContext) {
 	for i := range l.labelKeys {
 		labels[l.expandArgs(l.labelKeys[i])] = l.expandArgs(l.labelValues[i])
 	}
+	if l.err != nil {
+		return
+	}
 	l.converter.Label(l.ctx, labels)
 }
 
@@ -616,6 +889,9 @@ func (l *listener) ExitGitCloneStmt(c *parser.GitCloneStmtContext) {
 	gitURL := l.expandArgs(fs.Arg(0))
 	gitCloneDest := l.expandArgs(fs.Arg(1))
 	*branch = l.expandArgs(*branch)
+	if l.err != nil {
+		return
+	}
 	err = l.converter.GitClone(l.ctx, gitURL, *branch, gitCloneDest)
 	if err != nil {
 		l.err = errors.Wrap(err, "git clone")
@@ -648,6 +924,9 @@ func (l *listener) ExitDockerLoadStmt(c *parser.DockerLoadStmtContext) {
 	for i, arg := range buildArgs.Args {
 		buildArgs.Args[i] = l.expandArgs(arg)
 	}
+	if l.err != nil {
+		return
+	}
 	if l.withDocker == nil {
 		err = l.converter.DockerLoadOld(l.ctx, fullTargetName, imageName, buildArgs.Args)
 		if err != nil {
@@ -680,6 +959,9 @@ func (l *listener) ExitDockerPullStmt(c *parser.DockerPullStmtContext) {
 		return
 	}
 	imageName := l.expandArgs(l.stmtWords[0])
+	if l.err != nil {
+		return
+	}
 	if l.withDocker == nil {
 		err := l.converter.DockerPullOld(l.ctx, imageName)
 		if err != nil {
@@ -704,15 +986,35 @@ func (l *listener) ExitHealthcheckStmt(c *parser.HealthcheckStmtContext) {
 		return
 	}
 	fs := flag.NewFlagSet("HEALTHCHECK", flag.ContinueOnError)
-	interval := fs.Duration("interval", 30*time.Second, "")
-	timeout := fs.Duration("timeout", 30*time.Second, "")
-	startPeriod := fs.Duration("start-period", 0, "")
-	retries := fs.Int("retries", 3, "")
+	intervalStr := fs.String("interval", "30s", "")
+	timeoutStr := fs.String("timeout", "30s", "")
+	startPeriodStr := fs.String("start-period", "0s", "")
+	retriesStr := fs.String("retries", "3", "")
 	err := fs.Parse(l.stmtWords)
 	if err != nil {
 		l.err = errors.Wrapf(err, "invalid HEALTHCHECK arguments %v", l.stmtWords)
 		return
 	}
+	interval, err := time.ParseDuration(l.expandArgs(*intervalStr))
+	if err != nil {
+		l.err = errors.Wrapf(err, "parse HEALTHCHECK --interval %s", *intervalStr)
+		return
+	}
+	timeout, err := time.ParseDuration(l.expandArgs(*timeoutStr))
+	if err != nil {
+		l.err = errors.Wrapf(err, "parse HEALTHCHECK --timeout %s", *timeoutStr)
+		return
+	}
+	startPeriod, err := time.ParseDuration(l.expandArgs(*startPeriodStr))
+	if err != nil {
+		l.err = errors.Wrapf(err, "parse HEALTHCHECK --start-period %s", *startPeriodStr)
+		return
+	}
+	retries, err := strconv.Atoi(l.expandArgs(*retriesStr))
+	if err != nil {
+		l.err = errors.Wrapf(err, "parse HEALTHCHECK --retries %s", *retriesStr)
+		return
+	}
 	if fs.NArg() == 0 {
 		l.err = fmt.Errorf("invalid number of arguments for HEALTHCHECK: %s", l.stmtWords)
 		return
@@ -743,7 +1045,10 @@ func (l *listener) ExitHealthcheckStmt(c *parser.HealthcheckStmtContext) {
 	for i, arg := range cmdArgs {
 		cmdArgs[i] = l.expandArgs(arg)
 	}
-	l.converter.Healthcheck(l.ctx, isNone, cmdArgs, *interval, *timeout, *startPeriod, *retries)
+	if l.err != nil {
+		return
+	}
+	l.converter.Healthcheck(l.ctx, isNone, cmdArgs, interval, timeout, startPeriod, retries)
 }
 
 func (l *listener) ExitWithDockerStmt(c *parser.WithDockerStmtContext) {
@@ -754,15 +1059,79 @@ func (l *listener) ExitWithDockerStmt(c *parser.WithDockerStmtContext) {
 		l.err = fmt.Errorf("no non-push commands allowed after a --push: %s", c.GetText())
 		return
 	}
-	if len(l.stmtWords) != 0 {
-		l.err = fmt.Errorf("WITH DOCKER does not take any arguments: %s", c.GetText())
+	fs := flag.NewFlagSet("WITH DOCKER", flag.ContinueOnError)
+	composeFiles := new(StringSliceFlag)
+	fs.Var(composeFiles, "compose", "")
+	composeServices := new(StringSliceFlag)
+	fs.Var(composeServices, "service", "")
+	cacheDataRoot := fs.Bool("cache-data-root", false, "")
+	runtime := fs.String("runtime", WithDockerRuntimeDocker, "")
+	noWaitHealthy := fs.Bool("no-wait-healthy", false, "")
+	waitTimeoutStr := fs.String("wait-timeout", DefaultWaitTimeout.String(), "")
+	extraHosts := new(StringSliceFlag)
+	fs.Var(extraHosts, "add-host", "")
+	cpusStr := fs.String("cpus", "", "")
+	memoryStr := fs.String("memory", "", "")
+	err := fs.Parse(l.stmtWords)
+	if err != nil {
+		l.err = errors.Wrapf(err, "invalid WITH DOCKER arguments %v", l.stmtWords)
+		return
+	}
+	if fs.NArg() != 0 {
+		l.err = fmt.Errorf("invalid WITH DOCKER arguments: %s", c.GetText())
+		return
+	}
+	if len(composeServices.Args) != 0 && len(composeFiles.Args) == 0 {
+		l.err = fmt.Errorf("WITH DOCKER --service requires --compose: %s", c.GetText())
+		return
+	}
+	*runtime = l.expandArgs(*runtime)
+	err = ValidateWithDockerRuntime(*runtime)
+	if err != nil {
+		l.err = errors.Wrapf(err, "invalid WITH DOCKER arguments %v", l.stmtWords)
+		return
+	}
+	waitTimeout, err := time.ParseDuration(l.expandArgs(*waitTimeoutStr))
+	if err != nil {
+		l.err = errors.Wrapf(err, "parse WITH DOCKER --wait-timeout %s", *waitTimeoutStr)
+		return
+	}
+	for i, cf := range composeFiles.Args {
+		composeFiles.Args[i] = l.expandArgs(cf)
+	}
+	for i, cs := range composeServices.Args {
+		composeServices.Args[i] = l.expandArgs(cs)
+	}
+	for i, eh := range extraHosts.Args {
+		extraHosts.Args[i] = l.expandArgs(eh)
+		_, _, err = parseExtraHost(extraHosts.Args[i])
+		if err != nil {
+			l.err = errors.Wrap(err, "invalid WITH DOCKER --add-host")
+			return
+		}
+	}
+	resources, err := ParseResources(l.expandArgs(*cpusStr), l.expandArgs(*memoryStr))
+	if err != nil {
+		l.err = errors.Wrap(err, "invalid WITH DOCKER arguments")
+		return
+	}
+	if l.err != nil {
 		return
 	}
 	if l.withDocker != nil {
 		l.err = fmt.Errorf("cannot use WITH DOCKER within WITH DOCKER")
 		return
 	}
-	l.withDocker = new(WithDockerOpt)
+	l.withDocker = &WithDockerOpt{
+		ComposeFiles:    composeFiles.Args,
+		ComposeServices: composeServices.Args,
+		CacheDataRoot:   *cacheDataRoot,
+		Runtime:         *runtime,
+		WaitHealthy:     !*noWaitHealthy,
+		WaitTimeout:     waitTimeout,
+		ExtraHosts:      extraHosts.Args,
+		Resources:       resources,
+	}
 }
 
 func (l *listener) ExitEndStmt(c *parser.EndStmtContext) {
@@ -817,7 +1186,131 @@ func (l *listener) ExitGenericCommandStmt(c *parser.GenericCommandStmtContext) {
 	if l.shouldSkip() {
 		return
 	}
-	l.err = fmt.Errorf("Invalid command %s", c.GetText())
+	switch c.CommandName().GetText() {
+	case "BREAKPOINT":
+		l.breakpoint(c)
+	case "HOST":
+		l.host(c)
+	case "ASSERT":
+		l.assert(c)
+	case "LOCALLY":
+		l.locally(c)
+	default:
+		l.customCommand(c)
+	}
+}
+
+func (l *listener) customCommand(c *parser.GenericCommandStmtContext) {
+	name, handler, words, found := matchCustomCommand(
+		l.converter.customCommands, c.CommandName().GetText(), l.stmtWords)
+	if !found {
+		l.err = fmt.Errorf("Invalid command %s", c.GetText())
+		return
+	}
+	if l.pushOnlyAllowed {
+		l.err = fmt.Errorf("no non-push commands allowed after a --push: %s", c.GetText())
+		return
+	}
+	args := make([]string, 0, len(words))
+	for _, word := range words {
+		args = append(args, l.expandArgs(word))
+	}
+	if l.err != nil {
+		return
+	}
+	err := handler(l.ctx, l.converter, args)
+	if err != nil {
+		l.err = errors.Wrapf(err, "apply %s", name)
+		return
+	}
+}
+
+func (l *listener) host(c *parser.GenericCommandStmtContext) {
+	if l.pushOnlyAllowed {
+		l.err = fmt.Errorf("no non-push commands allowed after a --push: %s", c.GetText())
+		return
+	}
+	if len(l.stmtWords) != 2 {
+		l.err = fmt.Errorf("invalid number of arguments for HOST: %v", l.stmtWords)
+		return
+	}
+	host := l.expandArgs(l.stmtWords[0])
+	ipStr := l.expandArgs(l.stmtWords[1])
+	if l.err != nil {
+		return
+	}
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		l.err = fmt.Errorf("invalid IP %s for HOST %s", ipStr, host)
+		return
+	}
+	l.converter.Host(l.ctx, host, ip)
+}
+
+func (l *listener) assert(c *parser.GenericCommandStmtContext) {
+	if l.pushOnlyAllowed {
+		l.err = fmt.Errorf("no non-push commands allowed after a --push: %s", c.GetText())
+		return
+	}
+	if len(l.stmtWords) == 0 || !strings.HasPrefix(l.stmtWords[0], "--") {
+		l.err = fmt.Errorf("invalid ASSERT arguments %v: expected --<kind> followed by its arguments", l.stmtWords)
+		return
+	}
+	kind := strings.TrimPrefix(l.stmtWords[0], "--")
+	words := make([]string, 0, len(l.stmtWords)-1)
+	for _, word := range l.stmtWords[1:] {
+		words = append(words, l.expandArgs(word))
+	}
+	if l.err != nil {
+		return
+	}
+	a, err := ParseAssertion(kind, words)
+	if err != nil {
+		l.err = err
+		return
+	}
+	err = l.converter.Assert(l.ctx, a)
+	if err != nil {
+		l.err = errors.Wrap(err, "apply ASSERT")
+		return
+	}
+}
+
+func (l *listener) breakpoint(c *parser.GenericCommandStmtContext) {
+	if l.pushOnlyAllowed {
+		l.err = fmt.Errorf("no non-push commands allowed after a --push: %s", c.GetText())
+		return
+	}
+	if len(l.stmtWords) != 0 {
+		l.err = fmt.Errorf("invalid number of arguments for BREAKPOINT: %v", l.stmtWords)
+		return
+	}
+	err := l.converter.Breakpoint(l.ctx)
+	if err != nil {
+		l.err = errors.Wrap(err, "apply BREAKPOINT")
+		return
+	}
+}
+
+func (l *listener) locally(c *parser.GenericCommandStmtContext) {
+	if l.pushOnlyAllowed {
+		l.err = fmt.Errorf("no non-push commands allowed after a --push: %s", c.GetText())
+		return
+	}
+	if len(l.stmtWords) != 0 {
+		l.err = fmt.Errorf("invalid number of arguments for LOCALLY: %v", l.stmtWords)
+		return
+	}
+	if l.currentTarget == "base" {
+		// The base recipe is inherited by all the targets of the Earthfile.
+		l.err = errors.New("LOCALLY is not supported in the base recipe")
+		return
+	}
+	err := l.converter.Locally(l.ctx)
+	if err != nil {
+		l.err = errors.Wrap(err, "apply LOCALLY")
+		return
+	}
 }
 
 //
@@ -875,8 +1368,17 @@ func (l *listener) shouldSkip() bool {
 	return l.err != nil || l.currentTarget != l.executeTarget
 }
 
+// expandArgs expands the args within the word. Any error is recorded as the
+// listener error, causing the conversion to fail.
 func (l *listener) expandArgs(word string) string {
-	return l.converter.ExpandArgs(word)
+	ret, err := l.converter.ExpandArgs(word)
+	if err != nil {
+		if l.err == nil {
+			l.err = err
+		}
+		return word
+	}
+	return ret
 }
 
 // StringSliceFlag is a flag backed by a string slice.
@@ -898,8 +1400,18 @@ func (ssf *StringSliceFlag) Set(arg string) error {
 	return nil
 }
 
+var argNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+var sshIDRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
 var lineContinuationRegexp = regexp.MustCompile("\\\\(\\n|(\\r\\n))[\\t ]*")
 
 func replaceEscape(str string) string {
 	return lineContinuationRegexp.ReplaceAllString(str, "")
 }
+
+// isClearFlag returns whether the shell form arguments of CMD or ENTRYPOINT consist of
+// the --clear flag only.
+func isClearFlag(words []string) bool {
+	return len(words) == 1 && words[0] == "--clear"
+}
@@ -0,0 +1,131 @@
+package earthfile2llb
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/earthfile2llb/image"
+	"github.com/earthly/earthly/logging"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/pkg/errors"
+)
+
+// LocalStep is a command of a target declared LOCALLY, which is executed on the host
+// by the builder: either a RUN command, or the output of an artifact to the host via
+// COPY.
+type LocalStep struct {
+	// CommandStr is the command, as printed.
+	CommandStr string
+	// Dir is the dir of the host in which the command is executed: the dir of the
+	// Earthfile.
+	Dir string
+	// Args are the args of the RUN command, executed via the shell of the host if
+	// WithShell.
+	Args      []string
+	WithShell bool
+	// Env are the build args of the target, as env vars (KEY=VALUE).
+	Env []string
+	// ArtifactStates are the states of the target of the artifact copied, for a COPY.
+	ArtifactStates *MultiTargetStates
+	Artifact       domain.Artifact
+	// Dest is the path of the host the artifact is output to. It ends with / if the
+	// artifact is placed within that dir.
+	Dest string
+}
+
+// IsCopy returns whether the step outputs an artifact to the host.
+func (ls LocalStep) IsCopy() bool {
+	return ls.ArtifactStates != nil
+}
+
+// Locally applies the earth LOCALLY command. The rest of the target is executed on the
+// host, in the dir of the Earthfile, rather than in a container: its RUN commands are
+// executed on the host, the artifacts it copies are output to the host, and the files
+// it saves as artifacts are taken from the host. The commands are recorded as the
+// LocalSteps of the target, which the builder executes before solving the states which
+// depend on them.
+func (c *Converter) Locally(ctx context.Context) error {
+	logging.GetLogger(ctx).Info("Applying LOCALLY")
+	if c.localRunner == nil {
+		return errors.New("LOCALLY is not supported by this build")
+	}
+	target := c.mts.FinalStates.Target
+	if target.IsRemote() {
+		// The Earthfiles of remote targets are not meant to execute commands on the
+		// host, and they have no dir on the host to execute them in.
+		return fmt.Errorf("LOCALLY is not supported in the remote target %s", target.String())
+	}
+	err := c.securityPolicy.check(target, locallyFeature, "LOCALLY")
+	if err != nil {
+		return err
+	}
+	dir, err := filepath.Abs(filepath.FromSlash(target.LocalPath))
+	if err != nil {
+		return errors.Wrapf(err, "abs path of %s", target.LocalPath)
+	}
+	c.locally = true
+	c.localDir = dir
+	c.mts.FinalStates.SideEffectsState = llb.Scratch().Platform(c.platform)
+	c.mts.FinalStates.SideEffectsImage = image.NewImage()
+	return nil
+}
+
+// runLocally records the RUN command of a LOCALLY target, which is executed on the
+// host. The build args are passed as env vars, as in containers. Unlike the commands
+// executed in containers, the command is never cached.
+func (c *Converter) runLocally(ctx context.Context, args []string, isWithShell bool) error {
+	var env []string
+	for _, name := range c.varCollection.SortedActiveVariables() {
+		ba, _, _ := c.varCollection.Get(name)
+		if ba.IsEnvVar() {
+			continue
+		}
+		if !ba.IsConstant() {
+			return fmt.Errorf("build arg %s cannot be used after LOCALLY, as its value is only known within the build", name)
+		}
+		env = append(env, fmt.Sprintf("%s=%s", name, ba.ConstantValue()))
+	}
+	c.mts.FinalStates.LocalSteps = append(c.mts.FinalStates.LocalSteps, LocalStep{
+		CommandStr: fmt.Sprintf("LOCALLY RUN %s", strings.Join(args, " ")),
+		Dir:        c.localDir,
+		Args:       args,
+		WithShell:  isWithShell,
+		Env:        env,
+	})
+	return nil
+}
+
+// copyArtifactLocally records the output of the artifact of the already converted
+// target states mts to dest on the host, relative to the dir of the Earthfile. This
+// hands the artifacts of the containerized targets over to the commands of a LOCALLY
+// target.
+func (c *Converter) copyArtifactLocally(ctx context.Context, mts *MultiTargetStates, artifact domain.Artifact, dest string) error {
+	hostDest := c.localRunner.HostPath(c.localDir, dest)
+	if strings.HasSuffix(dest, "/") || dest == "." {
+		// The artifacts are placed within the dir.
+		hostDest += "/"
+	}
+	c.mts.FinalStates.LocalSteps = append(c.mts.FinalStates.LocalSteps, LocalStep{
+		CommandStr:     fmt.Sprintf("LOCALLY COPY %s %s", artifact.String(), dest),
+		Dir:            c.localDir,
+		ArtifactStates: mts,
+		Artifact:       artifact,
+		Dest:           hostDest,
+	})
+	return nil
+}
+
+// localContextPath returns the path of the file saveFrom, saved via SAVE ARTIFACT by a
+// LOCALLY target, within the build context. The files of the host are handed over to
+// the containerized targets via the build context, which is read once the commands of
+// the target have been executed.
+func (c *Converter) localContextPath(saveFrom string) (string, error) {
+	p, err := c.localRunner.ContextPath(saveFrom)
+	if err != nil {
+		return "", errors.Wrap(err, "SAVE ARTIFACT after LOCALLY")
+	}
+	return p, nil
+}
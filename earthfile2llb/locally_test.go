@@ -0,0 +1,185 @@
+package earthfile2llb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/antlr/antlr4/runtime/Go/antlr"
+	"github.com/earthly/earthly/ast"
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/earthfile2llb/parser"
+	"github.com/earthly/earthly/earthfile2llb/variables"
+	"github.com/earthly/earthly/localrun"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/solver/pb"
+)
+
+func TestLocally(t *testing.T) {
+	dir, err := ioutil.TempDir("", "earthly-locally")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	newConverter := func(target domain.Target, sp SecurityPolicy) *Converter {
+		return &Converter{
+			mts: &MultiTargetStates{FinalStates: &SingleTargetStates{
+				Target:           target,
+				SideEffectsState: llb.Image("alpine:3.11"),
+				ArtifactsState:   llb.Scratch(),
+			}},
+			buildContext:   llb.Local("context"),
+			varCollection:  variables.NewCollection(),
+			securityPolicy: sp,
+			localRunner:    localrun.NewRunner(runtime.GOOS),
+		}
+	}
+	ctx := context.Background()
+	c := newConverter(domain.Target{LocalPath: dir, Target: "release"}, SecurityPolicy{})
+	err = c.Locally(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.localDir != dir {
+		t.Errorf("expected the commands to run in %s, got %s", dir, c.localDir)
+	}
+	c.Arg(ctx, "VERSION", "1.2.3")
+	err = c.Run(ctx, []string{"echo", "done", ">", "out.txt"}, nil, nil, false, false, false, true, false, nil, "", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected the command not to be executed by the conversion, got %v", err)
+	}
+	steps := c.mts.FinalStates.LocalSteps
+	if len(steps) != 1 {
+		t.Fatalf("expected 1 local step, got %d", len(steps))
+	}
+	if steps[0].IsCopy() || steps[0].Dir != dir || !steps[0].WithShell || strings.Join(steps[0].Args, " ") != "echo done > out.txt" {
+		t.Errorf("unexpected local step %+v", steps[0])
+	}
+	if strings.Join(steps[0].Env, " ") != "VERSION=1.2.3" {
+		t.Errorf("expected the build args to be passed as env vars, got %v", steps[0].Env)
+	}
+	err = c.Run(ctx, []string{"true"}, nil, nil, true, false, false, true, false, nil, "", nil, 0, 0)
+	if err == nil || err.Error() != "RUN flags are not supported after LOCALLY" {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	artifactStates := &MultiTargetStates{}
+	err = c.copyArtifactLocally(ctx, artifactStates, domain.Artifact{Target: domain.Target{LocalPath: ".", Target: "build"}, Artifact: "app"}, "dist/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps = c.mts.FinalStates.LocalSteps
+	if len(steps) != 2 || !steps[1].IsCopy() || steps[1].ArtifactStates != artifactStates {
+		t.Fatalf("expected the copy to be recorded as a local step, got %+v", steps)
+	}
+	expected := filepath.Join(dir, "dist") + "/"
+	if steps[1].Dest != expected {
+		t.Errorf("expected the artifact to be output to %s, got %s", expected, steps[1].Dest)
+	}
+
+	err = c.SaveArtifact(ctx, "./dist/app", "", "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fromLocalSource(t, c.mts.FinalStates.ArtifactsState, "local://context") {
+		t.Error("expected the artifact to be taken from the build context")
+	}
+	err = c.SaveArtifact(ctx, "../secrets", "", "", "", false)
+	if err == nil || !strings.Contains(err.Error(), "../secrets is not within the dir of the Earthfile") {
+		t.Errorf("unexpected error %v", err)
+	}
+	err = c.SaveArtifact(ctx, "dist/app", "", "dist/app", "", false)
+	if err == nil {
+		t.Error("expected SAVE ARTIFACT AS LOCAL to be rejected")
+	}
+
+	remote := domain.Target{Registry: "github.com", ProjectPath: "acme/ci", Target: "release"}
+	err = newConverter(remote, SecurityPolicy{}).Locally(ctx)
+	if err == nil || err.Error() != "LOCALLY is not supported in the remote target github.com/acme/ci+release" {
+		t.Errorf("unexpected error %v", err)
+	}
+	sp := SecurityPolicy{Locally: []string{"+release"}}
+	err = newConverter(domain.Target{LocalPath: ".", Target: "test"}, sp).Locally(ctx)
+	if err == nil || err.Error() != "+test is not allowed to execute commands on the host (LOCALLY) by the security policy" {
+		t.Errorf("unexpected error %v", err)
+	}
+	err = newConverter(domain.Target{LocalPath: ".", Target: "release"}, sp).Locally(ctx)
+	if err != nil {
+		t.Errorf("expected the target to be allowed, got %v", err)
+	}
+	c = newConverter(domain.Target{LocalPath: ".", Target: "release"}, SecurityPolicy{})
+	c.localRunner = nil
+	err = c.Locally(ctx)
+	if err == nil {
+		t.Error("expected LOCALLY to be rejected without a runner")
+	}
+}
+
+func TestLocallyStatements(t *testing.T) {
+	convert := func(earthfile string, locally bool) error {
+		c := &Converter{
+			mts: &MultiTargetStates{FinalStates: &SingleTargetStates{
+				Target:           domain.Target{LocalPath: ".", Target: "base"},
+				SideEffectsState: llb.Scratch(),
+			}},
+			varCollection: variables.NewCollection(),
+			locally:       locally,
+		}
+		stream := antlr.NewCommonTokenStream(ast.NewLexer(antlr.NewInputStream(earthfile)), 0)
+		l := newListener(context.Background(), c, "Earthfile", "base")
+		antlr.ParseTreeWalkerDefault.Walk(l, parser.NewEarthParser(stream).EarthFile())
+		return l.Err()
+	}
+	tests := []struct {
+		earthfile string
+		locally   bool
+		expected  string
+	}{
+		{"LOCALLY\n", false, "LOCALLY is not supported in the base recipe"},
+		{"LOCALLY now\n", false, "invalid number of arguments for LOCALLY"},
+		{"ENV MODE=release\n", true, "ENV is not supported after LOCALLY"},
+		{"SAVE IMAGE app:latest\n", true, "SAVE IMAGE is not supported after LOCALLY"},
+		{"HOST db.internal 10.0.0.5\n", true, "HOST is not supported after LOCALLY"},
+		{"COPY go.mod ./\n", true, "COPY of the build context is not supported after LOCALLY"},
+		{"ARG VERSION=1.2.3\n", true, ""},
+	}
+	for _, tt := range tests {
+		err := convert(tt.earthfile, tt.locally)
+		if tt.expected == "" {
+			if err != nil {
+				t.Errorf("%q: unexpected error %v", tt.earthfile, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%q: expected error %q, got %v", tt.earthfile, tt.expected, err)
+		}
+	}
+}
+
+// fromLocalSource returns whether the state is built from the local source of the given
+// identifier.
+func fromLocalSource(t *testing.T, state llb.State, identifier string) bool {
+	def, err := state.Marshal(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dt := range def.Def {
+		var op pb.Op
+		err := op.Unmarshal(dt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if src := op.GetSource(); src != nil && src.Identifier == identifier {
+			return true
+		}
+	}
+	return false
+}
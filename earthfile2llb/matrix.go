@@ -0,0 +1,49 @@
+package earthfile2llb
+
+import (
+	"context"
+
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/earthfile2llb/dedup"
+	"github.com/earthly/earthly/earthfile2llb/image"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/pkg/errors"
+)
+
+// convertMatrix converts the target once for each set of build args of the build arg
+// matrix. The resulting target does nothing by itself: it depends on the target for
+// each set, which are built in parallel.
+func convertMatrix(ctx context.Context, target domain.Target, opt ConvertOpt) (*MultiTargetStates, error) {
+	platform := *opt.Platform
+	sts := &SingleTargetStates{
+		Target: target,
+		TargetInput: dedup.TargetInput{
+			TargetCanonical: target.StringCanonical(),
+			Platform:        platformInput(platform),
+		},
+		SideEffectsState: llb.Scratch().Platform(platform),
+		SideEffectsImage: image.NewImage(),
+		ArtifactsState:   llb.Scratch().Platform(platform),
+		LocalDirs:        make(map[string]string),
+	}
+	for i, varCollection := range opt.BuildArgMatrix {
+		setOpt := opt
+		setOpt.BuildArgMatrix = nil
+		setOpt.VarCollection = varCollection
+		mts, err := Earthfile2LLB(ctx, target, setOpt)
+		if err != nil {
+			return nil, errors.Wrapf(err, "build arg set %d of %d", i+1, len(opt.BuildArgMatrix))
+		}
+		sts.MatrixStates = append(sts.MatrixStates, mts.FinalStates)
+	}
+	sts.OwnSideEffectsState = sts.SideEffectsState
+	for _, setStates := range sts.MatrixStates {
+		sts.SideEffectsState = withDependency(
+			sts.SideEffectsState, target, setStates.SideEffectsState, setStates.Target)
+	}
+	sts.Deps = sts.MatrixStates
+	return &MultiTargetStates{
+		FinalStates:   sts,
+		VisitedStates: opt.VisitedStates,
+	}, nil
+}
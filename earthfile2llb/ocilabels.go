@@ -0,0 +1,41 @@
+package earthfile2llb
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/earthly/earthly/buildcontext"
+)
+
+// The OCI annotations describing the source of an image, added as labels to the saved
+// images with --oci-labels.
+const (
+	ociLabelSource   = "org.opencontainers.image.source"
+	ociLabelRevision = "org.opencontainers.image.revision"
+	ociLabelCreated  = "org.opencontainers.image.created"
+	ociLabelVersion  = "org.opencontainers.image.version"
+)
+
+// ociLabels returns the OCI annotation labels of the images saved by a target, given
+// the git metadata of its build context (nil if none) and the time of the build.
+func ociLabels(gitMeta *buildcontext.GitMetadata, created time.Time) map[string]string {
+	labels := map[string]string{
+		ociLabelCreated: created.UTC().Format(time.RFC3339),
+	}
+	if gitMeta == nil {
+		return labels
+	}
+	switch {
+	case gitMeta.GitVendor != "" && gitMeta.GitProject != "":
+		labels[ociLabelSource] = fmt.Sprintf("https://%s/%s", gitMeta.GitVendor, gitMeta.GitProject)
+	case gitMeta.RemoteURL != "":
+		labels[ociLabelSource] = gitMeta.RemoteURL
+	}
+	if gitMeta.Hash != "" {
+		labels[ociLabelRevision] = gitMeta.Hash
+	}
+	if len(gitMeta.Tags) > 0 {
+		labels[ociLabelVersion] = gitMeta.Tags[0]
+	}
+	return labels
+}
@@ -0,0 +1,51 @@
+package earthfile2llb
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/earthly/earthly/buildcontext"
+)
+
+func TestOCILabels(t *testing.T) {
+	created := time.Unix(1602755400, 0)
+	tests := []struct {
+		gitMeta  *buildcontext.GitMetadata
+		expected map[string]string
+	}{
+		{nil, map[string]string{ociLabelCreated: "2020-10-15T09:50:00Z"}},
+		{
+			&buildcontext.GitMetadata{
+				RemoteURL:  "git@github.com:earthly/earthly.git",
+				GitVendor:  "github.com",
+				GitProject: "earthly/earthly",
+				Hash:       "41cb5666ade67b29e42bef121144456d3977a67a",
+				Tags:       []string{"v0.3.6"},
+			},
+			map[string]string{
+				ociLabelCreated:  "2020-10-15T09:50:00Z",
+				ociLabelSource:   "https://github.com/earthly/earthly",
+				ociLabelRevision: "41cb5666ade67b29e42bef121144456d3977a67a",
+				ociLabelVersion:  "v0.3.6",
+			},
+		},
+		{
+			&buildcontext.GitMetadata{
+				RemoteURL: "ssh://git.example.com/repo.git",
+				Hash:      "41cb5666ade67b29e42bef121144456d3977a67a",
+			},
+			map[string]string{
+				ociLabelCreated:  "2020-10-15T09:50:00Z",
+				ociLabelSource:   "ssh://git.example.com/repo.git",
+				ociLabelRevision: "41cb5666ade67b29e42bef121144456d3977a67a",
+			},
+		},
+	}
+	for _, test := range tests {
+		got := ociLabels(test.gitMeta, created)
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("got %v, expected %v", got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package earthfile2llb
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/earthly/earthly/buildcontext"
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/logging"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/pkg/errors"
+)
+
+// convertPattern converts a pattern target given on the command line. The resulting
+// target does nothing by itself: it depends on each of the targets matched, which are
+// built in parallel.
+func convertPattern(ctx context.Context, pattern domain.Target, opt ConvertOpt) (*MultiTargetStates, error) {
+	matches, err := expandPattern(ctx, pattern, opt.LabelFilter)
+	if err != nil {
+		return nil, err
+	}
+	bc := &buildcontext.Data{
+		BuildContext: llb.Scratch(),
+		Target:       pattern,
+		LocalDirs:    make(map[string]string),
+	}
+	converter, err := NewConverter(logging.With(ctx, "target", pattern), pattern, bc, opt)
+	if err != nil {
+		return nil, err
+	}
+	// The build args of the command line apply to all the targets matched.
+	err = converter.buildPatternMatches(ctx, matches, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	return converter.FinalizeStates(), nil
+}
+
+// LabelFilter selects the targets matched by target patterns, by the labels they are
+// tagged with.
+type LabelFilter struct {
+	// Include are the labels of which a target needs at least one. All targets are
+	// included if empty.
+	Include []string
+	// Exclude are the labels of which a target needs none.
+	Exclude []string
+}
+
+// IsEmpty returns whether the filter selects all targets.
+func (f LabelFilter) IsEmpty() bool {
+	return len(f.Include) == 0 && len(f.Exclude) == 0
+}
+
+// Matches returns whether a target tagged with the given labels is selected.
+func (f LabelFilter) Matches(labels []string) bool {
+	has := func(label string) bool {
+		for _, l := range labels {
+			if l == label {
+				return true
+			}
+		}
+		return false
+	}
+	for _, label := range f.Exclude {
+		if has(label) {
+			return false
+		}
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	for _, label := range f.Include {
+		if has(label) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandPattern returns the targets matched by a target pattern: the target of the
+// same name, for each Earthfile under the dir of the pattern which declares it, and
+// whose labels match all the filters. It is an error if none declares the target, or
+// if the filters exclude all of them.
+func expandPattern(ctx context.Context, pattern domain.Target, filters ...LabelFilter) ([]domain.Target, error) {
+	dir := pattern.PatternDir()
+	buildFiles, err := buildcontext.FindBuildFiles(filepath.FromSlash(dir))
+	if err != nil {
+		return nil, errors.Wrapf(err, "find the Earthfiles of %s", pattern.String())
+	}
+	// The Earthfiles are parsed one at a time: the generated parser shares its DFA
+	// cache across instances, without synchronization. The matched targets are still
+	// built in parallel.
+	var matches []domain.Target
+	declared := 0
+	for _, buildFile := range buildFiles {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		info, found, err := findTargetInfo(buildFile, pattern.Target)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+		declared++
+		selected := true
+		for _, f := range filters {
+			selected = selected && f.Matches(info.Labels)
+		}
+		if !selected {
+			continue
+		}
+		localPath := filepath.ToSlash(filepath.Dir(buildFile))
+		if !path.IsAbs(localPath) && !strings.HasPrefix(localPath, ".") {
+			localPath = "./" + localPath
+		}
+		matches = append(matches, domain.Target{LocalPath: localPath, Target: pattern.Target})
+	}
+	if declared == 0 {
+		return nil, fmt.Errorf(
+			"no Earthfile under %s declares the target %s (%d Earthfiles found)", dir, pattern.Target, len(buildFiles))
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf(
+			"the label filters exclude all the %d targets matched by %s", declared, pattern.String())
+	}
+	logging.GetLogger(ctx).
+		With("target-pattern", pattern.String()).
+		With("matches", len(matches)).
+		With("excluded", declared-len(matches)).
+		Info("Expanded target pattern")
+	return matches, nil
+}
+
+// findTargetInfo returns the description of the target, if the Earthfile declares it.
+func findTargetInfo(buildFile string, targetName string) (TargetInfo, bool, error) {
+	infos, err := GetTargetInfos(buildFile)
+	if err != nil {
+		return TargetInfo{}, false, errors.Wrapf(err, "parse %s", buildFile)
+	}
+	for _, info := range infos {
+		if info.Name == targetName {
+			return info, true, nil
+		}
+	}
+	return TargetInfo{}, false, nil
+}
@@ -0,0 +1,94 @@
+package earthfile2llb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/earthly/earthly/domain"
+)
+
+func TestExpandPattern(t *testing.T) {
+	dir, err := ioutil.TempDir("", "earth-pattern-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	earthfiles := map[string]string{
+		"a/Earthfile":        "FROM alpine:3.11\ntest:\n    RUN true\n",
+		"b/Earthfile":        "FROM alpine:3.11\nbuild:\n    RUN true\n",
+		"c/nested/Earthfile": "FROM alpine:3.11\nbuild:\n    RUN true\n# earthly:labels=slow\ntest:\n    RUN true\n",
+	}
+	for name, content := range earthfiles {
+		p := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(p), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(p, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	pattern, err := domain.ParseTarget(filepath.ToSlash(dir) + "/...+test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches, err := expandPattern(context.Background(), pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, match := range matches {
+		names = append(names, match.String())
+	}
+	expected := []string{
+		filepath.ToSlash(dir) + "/a+test",
+		filepath.ToSlash(dir) + "/c/nested+test",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("got %v, expected %v", names, expected)
+	}
+
+	matches, err = expandPattern(context.Background(), pattern, LabelFilter{Exclude: []string{"slow"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].String() != expected[0] {
+		t.Errorf("got %v, expected only %s", matches, expected[0])
+	}
+	_, err = expandPattern(context.Background(), pattern, LabelFilter{Include: []string{"integration"}})
+	if err == nil {
+		t.Errorf("expected an error when all the targets are excluded")
+	}
+
+	pattern.Target = "missing"
+	_, err = expandPattern(context.Background(), pattern)
+	if err == nil {
+		t.Errorf("expected an error for a target declared by no Earthfile")
+	}
+}
+
+func TestLabelFilter(t *testing.T) {
+	tests := []struct {
+		filter   LabelFilter
+		labels   []string
+		expected bool
+	}{
+		{LabelFilter{}, nil, true},
+		{LabelFilter{Include: []string{"fast"}}, []string{"unit", "fast"}, true},
+		{LabelFilter{Include: []string{"fast"}}, nil, false},
+		{LabelFilter{Include: []string{"fast", "unit"}}, []string{"unit"}, true},
+		{LabelFilter{Exclude: []string{"slow"}}, []string{"slow"}, false},
+		{LabelFilter{Exclude: []string{"slow"}}, nil, true},
+		{LabelFilter{Include: []string{"unit"}, Exclude: []string{"slow"}}, []string{"unit", "slow"}, false},
+	}
+	for _, test := range tests {
+		if test.filter.Matches(test.labels) != test.expected {
+			t.Errorf("%+v matching %v: expected %v", test.filter, test.labels, test.expected)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package earthfile2llb
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Resources are the resource limits of a WITH DOCKER command, as per its --cpus and
+// --memory flags.
+type Resources struct {
+	// CPUs is the number of CPUs the command may use. Not limited if zero.
+	CPUs float64
+	// Memory is the maximum memory the command may use, in bytes. Not limited if zero.
+	Memory int64
+}
+
+// withDefaults returns the resources, with the limits which are not set taken from
+// defaults.
+func (r Resources) withDefaults(defaults Resources) Resources {
+	if r.CPUs == 0 {
+		r.CPUs = defaults.CPUs
+	}
+	if r.Memory == 0 {
+		r.Memory = defaults.Memory
+	}
+	return r
+}
+
+// String returns the resources as command flags.
+func (r Resources) String() string {
+	var parts []string
+	if r.CPUs > 0 {
+		parts = append(parts, fmt.Sprintf("--cpus %s", strconv.FormatFloat(r.CPUs, 'f', -1, 64)))
+	}
+	if r.Memory > 0 {
+		parts = append(parts, fmt.Sprintf("--memory %s", formatMemory(r.Memory)))
+	}
+	return strings.Join(parts, " ")
+}
+
+// ParseResources parses the values of the --cpus and --memory flags. Empty values
+// mean no limit.
+func ParseResources(cpusStr string, memoryStr string) (Resources, error) {
+	var r Resources
+	if cpusStr != "" {
+		cpus, err := strconv.ParseFloat(cpusStr, 64)
+		if err != nil || cpus <= 0 || math.IsInf(cpus, 0) {
+			return Resources{}, fmt.Errorf("invalid --cpus %s", cpusStr)
+		}
+		r.CPUs = cpus
+	}
+	if memoryStr != "" {
+		memory, err := parseMemory(memoryStr)
+		if err != nil {
+			return Resources{}, err
+		}
+		r.Memory = memory
+	}
+	return r, nil
+}
+
+var memoryUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"g", 1 << 30},
+	{"m", 1 << 20},
+	{"k", 1 << 10},
+	{"b", 1},
+}
+
+// parseMemory parses a memory amount, such as 512m or 2g, the same way as docker
+// run --memory.
+func parseMemory(s string) (int64, error) {
+	lower := strings.ToLower(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range memoryUnits {
+		if strings.HasSuffix(lower, unit.suffix) {
+			lower = strings.TrimSuffix(lower, unit.suffix)
+			multiplier = unit.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n <= 0 || n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("invalid --memory %s", s)
+	}
+	return n * multiplier, nil
+}
+
+// formatMemory formats a memory amount in the largest unit it is a multiple of.
+func formatMemory(bytes int64) string {
+	for _, unit := range memoryUnits {
+		if bytes%unit.bytes == 0 {
+			return fmt.Sprintf("%d%s", bytes/unit.bytes, strings.TrimSuffix(unit.suffix, "b"))
+		}
+	}
+	return strconv.FormatInt(bytes, 10)
+}
@@ -0,0 +1,41 @@
+package earthfile2llb
+
+import "testing"
+
+func TestParseResources(t *testing.T) {
+	tests := []struct {
+		cpus     string
+		memory   string
+		expected Resources
+		ok       bool
+	}{
+		{"", "", Resources{}, true},
+		{"1.5", "", Resources{CPUs: 1.5}, true},
+		{"", "512m", Resources{Memory: 512 << 20}, true},
+		{"2", "2G", Resources{CPUs: 2, Memory: 2 << 30}, true},
+		{"", "1024", Resources{Memory: 1024}, true},
+		{"", "64kb", Resources{}, false},
+		{"0", "", Resources{}, false},
+		{"abc", "", Resources{}, false},
+		{"", "-1m", Resources{}, false},
+		{"", "m", Resources{}, false},
+	}
+	for _, tt := range tests {
+		actual, err := ParseResources(tt.cpus, tt.memory)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseResources(%q, %q): expected ok %v, got error %v", tt.cpus, tt.memory, tt.ok, err)
+			continue
+		}
+		if actual != tt.expected {
+			t.Errorf("ParseResources(%q, %q): expected %+v, got %+v", tt.cpus, tt.memory, tt.expected, actual)
+		}
+	}
+}
+
+func TestResourcesString(t *testing.T) {
+	r := Resources{CPUs: 0.5, Memory: 3 << 29}
+	expected := "--cpus 0.5 --memory 1536m"
+	if r.String() != expected {
+		t.Errorf("expected %q, got %q", expected, r.String())
+	}
+}
@@ -0,0 +1,180 @@
+package earthfile2llb
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/earthly/earthly/llbutil"
+	"github.com/earthly/earthly/logging"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/pkg/errors"
+)
+
+const (
+	s3UploaderImage     = "docker.io/amazon/aws-cli:2.1.24"
+	gcsUploaderImage    = "docker.io/google/cloud-sdk:326.0.0-alpine"
+	httpUploaderImage   = "docker.io/curlimages/curl:7.74.0"
+	remoteArtifactsPath = "/artifacts"
+)
+
+// s3SecretIDs are the secrets which, if provided, are passed to the S3 uploader as
+// env vars of the same name.
+var s3SecretIDs = []string{
+	"AWS_ACCESS_KEY_ID",
+	"AWS_SECRET_ACCESS_KEY",
+	"AWS_SESSION_TOKEN",
+	"AWS_DEFAULT_REGION",
+}
+
+// gcsCredentialsSecretID is the secret which, if provided, holds the JSON key of the
+// service account used by the GCS uploader.
+const gcsCredentialsSecretID = "GOOGLE_APPLICATION_CREDENTIALS"
+
+// Secrets which, if provided, are used to authenticate against HTTP artifact
+// repositories (eg Artifactory or Nexus). The token takes precedence over the
+// username and password.
+const (
+	httpUsernameSecretID = "ARTIFACT_REPO_USERNAME"
+	httpPasswordSecretID = "ARTIFACT_REPO_PASSWORD"
+	httpTokenSecretID    = "ARTIFACT_REPO_TOKEN"
+)
+
+// remoteURLFilePlaceholder is the placeholder of remote URL templates which is
+// replaced with the name of each uploaded artifact.
+const remoteURLFilePlaceholder = "{file}"
+
+// saveArtifactRemote creates the state which uploads the artifact found at artifactPath
+// within artifactsState to the object storage or HTTP artifact repository URL destURL.
+func (c *Converter) saveArtifactRemote(ctx context.Context, artifactsState llb.State, artifactPath string, destURL string, opts ...llb.RunOption) (llb.State, error) {
+	logging.GetLogger(ctx).
+		With("artifactPath", artifactPath).
+		With("destURL", destURL).
+		Info("Applying SAVE ARTIFACT AS REMOTE")
+	destURL, err := c.expandRemoteURLTemplate(destURL)
+	if err != nil {
+		return llb.State{}, err
+	}
+	u, err := url.Parse(destURL)
+	if err != nil {
+		return llb.State{}, errors.Wrapf(err, "parse remote url %s", destURL)
+	}
+	if u.Host == "" {
+		return llb.State{}, fmt.Errorf("no bucket or host specified in remote url %s", destURL)
+	}
+	srcDir, srcPattern := splitWildcards(path.Join(remoteArtifactsPath, artifactPath))
+	srcGlob := shellQuote(path.Join(remoteArtifactsPath, artifactPath))
+	if srcPattern != "" {
+		// Keep the wildcard part unquoted, such that the shell expands it.
+		srcGlob = fmt.Sprintf("%s/%s", shellQuote(srcDir), srcPattern)
+	}
+	var uploaderImage string
+	var setup []string
+	var runOpts []llb.RunOption
+	switch u.Scheme {
+	case "s3":
+		uploaderImage = s3UploaderImage
+		for _, secretID := range s3SecretIDs {
+			secretPath := path.Join("/run/secrets", secretID)
+			runOpts = append(runOpts, llb.AddSecret(
+				secretPath, llb.SecretID(secretID), llb.SecretFileOpt(0, 0, 0444), llb.SecretOptional))
+			setup = append(setup, fmt.Sprintf(
+				"if [ -f %s ]; then export %s; fi",
+				shellQuote(secretPath), shellEnvVarFromFile(secretID, secretPath)))
+		}
+		// Large files are uploaded in multiple parts by the aws cli.
+		setup = append(setup,
+			`upload() { if [ -d "$1" ]; then aws s3 cp --recursive "$1" "$2"; else aws s3 cp "$1" "$2"; fi; }`)
+	case "gs":
+		uploaderImage = gcsUploaderImage
+		secretPath := path.Join("/run/secrets", gcsCredentialsSecretID)
+		runOpts = append(runOpts, llb.AddSecret(
+			secretPath, llb.SecretID(gcsCredentialsSecretID), llb.SecretFileOpt(0, 0, 0444), llb.SecretOptional))
+		setup = append(setup, fmt.Sprintf(
+			"if [ -f %s ]; then gcloud auth activate-service-account --key-file=%s; fi",
+			shellQuote(secretPath), shellQuote(secretPath)))
+		// Large files are uploaded in parallel, as composite objects.
+		gsutil := "gsutil -o GSUtil:parallel_composite_upload_threshold=150M"
+		setup = append(setup, fmt.Sprintf(
+			`upload() { if [ -d "$1" ]; then %s -m cp -r "$1" "$2"; else %s cp "$1" "$2"; fi; }`,
+			gsutil, gsutil))
+	case "http", "https":
+		uploaderImage = httpUploaderImage
+		secretPaths := make(map[string]string)
+		for _, secretID := range []string{httpUsernameSecretID, httpPasswordSecretID, httpTokenSecretID} {
+			secretPath := path.Join("/run/secrets", secretID)
+			secretPaths[secretID] = shellQuote(secretPath)
+			runOpts = append(runOpts, llb.AddSecret(
+				secretPath, llb.SecretID(secretID), llb.SecretFileOpt(0, 0, 0444), llb.SecretOptional))
+		}
+		// The credentials are passed via a curl config file, such that they do not
+		// show up in the process list.
+		setup = append(setup,
+			"auth_config=$(mktemp)",
+			fmt.Sprintf(
+				`if [ -f %s ]; then printf 'header = "Authorization: Bearer %%s"\n' "$(cat %s)" > "$auth_config"; `+
+					`elif [ -f %s ]; then printf 'user = "%%s:%%s"\n' "$(cat %s)" "$(cat %s 2>/dev/null)" > "$auth_config"; fi`,
+				secretPaths[httpTokenSecretID], secretPaths[httpTokenSecretID],
+				secretPaths[httpUsernameSecretID], secretPaths[httpUsernameSecretID], secretPaths[httpPasswordSecretID]),
+			`upload_file() { curl --fail --silent --show-error --config "$auth_config" --upload-file "$1" "$2"; }`,
+			// Repositories have no notion of directories. Upload each file within.
+			`upload() { if [ -d "$1" ]; then (cd "$1" && find . -type f) | while read -r p; do upload_file "$1/${p#./}" "$2/${p#./}"; done; else upload_file "$1" "$2"; fi; }`,
+		)
+	default:
+		return llb.State{}, fmt.Errorf(
+			"unsupported remote url scheme %s. Supported schemes: s3, gs, http, https", u.Scheme)
+	}
+	script := []string{"set -e"}
+	script = append(script, setup...)
+	script = append(script,
+		fmt.Sprintf("for f in %s; do", srcGlob),
+		`[ -e "$f" ] || { echo "artifact $f not found"; exit 1; }`,
+		`file="$(basename "$f")"`,
+	)
+	if strings.Contains(destURL, remoteURLFilePlaceholder) {
+		var quotedParts []string
+		for _, part := range strings.Split(destURL, remoteURLFilePlaceholder) {
+			quotedParts = append(quotedParts, shellQuote(part))
+		}
+		script = append(script, fmt.Sprintf(`dest=%s`, strings.Join(quotedParts, `"$file"`)))
+	} else {
+		script = append(script,
+			fmt.Sprintf("dest=%s", shellQuote(destURL)),
+			`case "$dest" in */) dest="$dest$file";; esac`)
+	}
+	script = append(script,
+		`upload "$f" "$dest"`,
+		"done",
+	)
+	runOpts = append(runOpts,
+		llb.Args([]string{"/bin/sh", "-c", strings.Join(script, "\n")}),
+		llb.AddMount(remoteArtifactsPath, artifactsState, llb.Readonly),
+		// Uploads are side effects. Always perform them.
+		llb.IgnoreCache,
+	)
+	runOpts = append(runOpts, opts...)
+	uploadState := llb.Image(uploaderImage, llb.Platform(llbutil.TargetPlatform)).Run(runOpts...)
+	return uploadState.Root(), nil
+}
+
+// expandRemoteURLTemplate replaces the placeholders {target}, {version}, {os} and
+// {arch} within the remote URL destURL. The {file} placeholder is left in place, as
+// it is only known at upload time.
+func (c *Converter) expandRemoteURLTemplate(destURL string) (string, error) {
+	if strings.Contains(destURL, "{version}") {
+		variable, active, found := c.varCollection.Get("VERSION")
+		if !found || !active || !variable.IsConstant() {
+			return "", fmt.Errorf(
+				"remote url %s uses {version}, but no constant VERSION arg is declared", destURL)
+		}
+		destURL = strings.Replace(destURL, "{version}", variable.ConstantValue(), -1)
+	}
+	replacer := strings.NewReplacer(
+		"{target}", c.mts.FinalStates.Target.Target,
+		"{os}", llbutil.TargetPlatform.OS,
+		"{arch}", llbutil.TargetPlatform.Architecture,
+	)
+	return replacer.Replace(destURL), nil
+}
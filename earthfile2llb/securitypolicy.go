@@ -0,0 +1,130 @@
+package earthfile2llb
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/errcode"
+)
+
+// SecurityPolicy restricts which targets may use the features of Earthfiles which give
+// commands access to the host. Each list holds the patterns of the targets allowed to
+// use the feature. A pattern is a target reference, in which * matches any sequence of
+// characters other than /, such as github.com/acme/*+docker. A pattern without a
+// target name stands for all the targets of the project, such as github.com/acme/ci.
+// All the targets are allowed if a list is nil. No target is allowed if it is empty.
+type SecurityPolicy struct {
+	// Privileged are the targets allowed to run commands with more than the default
+	// capabilities: RUN --privileged, RUN --cap-add and WITH DOCKER.
+	Privileged []string
+	// HostBind are the targets allowed to mount host directories into commands, via
+	// RUN --mount type=bind-experimental.
+	HostBind []string
+	// Locally are the targets allowed to execute commands on the host, via LOCALLY.
+	Locally []string
+}
+
+// Features restricted by the security policy.
+const (
+	privilegedFeature = "privileged"
+	hostBindFeature   = "host-bind"
+	locallyFeature    = "locally"
+)
+
+// SecurityPolicyError is returned when a target uses a feature the security policy does
+// not allow it to use.
+type SecurityPolicyError struct {
+	Target string
+	// Feature is privileged, host-bind or locally.
+	Feature string
+	// Statement is the offending statement, such as RUN --privileged or
+	// RUN --mount type=bind-experimental,target=/src.
+	Statement string
+}
+
+func (spe *SecurityPolicyError) Error() string {
+	switch spe.Feature {
+	case privilegedFeature:
+		return fmt.Sprintf("%s is not allowed to run privileged commands (%s) by the security policy", spe.Target, spe.Statement)
+	case hostBindFeature:
+		return fmt.Sprintf("%s is not allowed to mount host directories (%s) by the security policy", spe.Target, spe.Statement)
+	case locallyFeature:
+		return fmt.Sprintf("%s is not allowed to execute commands on the host (%s) by the security policy", spe.Target, spe.Statement)
+	default:
+		return fmt.Sprintf("%s is not allowed to use %s (%s) by the security policy", spe.Target, spe.Feature, spe.Statement)
+	}
+}
+
+// ErrorCategory implements errcode.Categorized.
+func (spe *SecurityPolicyError) ErrorCategory() errcode.Category {
+	return errcode.PolicyViolation
+}
+
+// Validate returns an error if a pattern of the policy is invalid.
+func (sp SecurityPolicy) Validate() error {
+	for _, patterns := range [][]string{sp.Privileged, sp.HostBind, sp.Locally} {
+		for _, pattern := range patterns {
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return fmt.Errorf("invalid target pattern %s", pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// check returns a SecurityPolicyError if the target is not allowed to use the feature,
+// naming the statement which uses it.
+func (sp SecurityPolicy) check(target domain.Target, feature string, statement string) error {
+	var patterns []string
+	switch feature {
+	case privilegedFeature:
+		patterns = sp.Privileged
+	case hostBindFeature:
+		patterns = sp.HostBind
+	case locallyFeature:
+		patterns = sp.Locally
+	}
+	if patterns == nil {
+		return nil
+	}
+	for _, pattern := range patterns {
+		if matchTargetPattern(pattern, target) {
+			return nil
+		}
+	}
+	return &SecurityPolicyError{Target: target.StringCanonical(), Feature: feature, Statement: statement}
+}
+
+// matchTargetPattern returns whether the target matches the pattern of the security
+// policy. The target is matched both with and without the tag of its project.
+func matchTargetPattern(pattern string, target domain.Target) bool {
+	if !strings.Contains(pattern, "+") {
+		pattern += "+*"
+	}
+	candidates := []string{target.StringCanonical(), target.String()}
+	if target.Tag != "" {
+		untagged := target
+		untagged.Tag = ""
+		candidates = append(candidates, untagged.StringCanonical())
+	}
+	for _, candidate := range candidates {
+		matched, err := path.Match(pattern, candidate)
+		if err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// isHostBindMount returns whether the RUN --mount spec mounts a host directory.
+func isHostBindMount(mount string) bool {
+	for _, kvPair := range strings.Split(mount, ",") {
+		if kvPair == "type=bind-experimental" {
+			return true
+		}
+	}
+	return false
+}
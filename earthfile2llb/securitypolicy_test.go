@@ -0,0 +1,124 @@
+package earthfile2llb
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/earthfile2llb/image"
+	"github.com/earthly/earthly/earthfile2llb/variables"
+	"github.com/earthly/earthly/errcode"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/pkg/errors"
+)
+
+func TestMatchTargetPattern(t *testing.T) {
+	remote := domain.Target{Registry: "github.com", ProjectPath: "acme/ci", Tag: "main", Target: "docker"}
+	local := domain.Target{LocalPath: ".", Target: "build"}
+	external := domain.Target{LocalPath: "./tools", Target: "lint"}
+	tests := []struct {
+		pattern  string
+		target   domain.Target
+		expected bool
+	}{
+		{"github.com/acme/ci+docker", remote, true},
+		{"github.com/acme/ci:main+docker", remote, true},
+		{"github.com/acme/ci:v1+docker", remote, false},
+		{"github.com/acme/ci", remote, true},
+		{"github.com/acme/*+docker", remote, true},
+		{"github.com/acme/*", remote, true},
+		{"github.com/*+docker", remote, false},
+		{"github.com/acme/ci+build", remote, false},
+		{"+build", local, true},
+		{"+*", local, true},
+		{"+build", external, false},
+		{"./tools+*", external, true},
+		{"./tools", external, true},
+	}
+	for _, tt := range tests {
+		actual := matchTargetPattern(tt.pattern, tt.target)
+		if actual != tt.expected {
+			t.Errorf("%s %s: expected %v, got %v", tt.pattern, tt.target.String(), tt.expected, actual)
+		}
+	}
+}
+
+func TestSecurityPolicyCheck(t *testing.T) {
+	target := domain.Target{Registry: "github.com", ProjectPath: "thirdparty/app", Target: "build"}
+	err := SecurityPolicy{}.check(target, privilegedFeature, "RUN --privileged")
+	if err != nil {
+		t.Errorf("expected all targets to be allowed, got %v", err)
+	}
+	sp := SecurityPolicy{
+		Privileged: []string{"github.com/acme/*"},
+		HostBind:   []string{},
+	}
+	err = sp.check(target, privilegedFeature, "RUN --privileged")
+	if err == nil || err.Error() != "github.com/thirdparty/app+build is not allowed to run privileged commands (RUN --privileged) by the security policy" {
+		t.Errorf("unexpected error %v", err)
+	}
+	err = sp.check(domain.Target{Registry: "github.com", ProjectPath: "acme/ci", Target: "docker"}, privilegedFeature, "RUN --privileged")
+	if err != nil {
+		t.Errorf("expected the target to be allowed, got %v", err)
+	}
+	err = sp.check(domain.Target{Registry: "github.com", ProjectPath: "acme/ci", Target: "docker"}, hostBindFeature, "RUN --mount type=bind-experimental,target=/src")
+	if err == nil {
+		t.Error("expected no target to be allowed to mount host directories")
+	}
+	if errcode.CategoryOf(errcode.Wrap(errors.Wrap(err, "apply RUN"), errcode.Parse)) != errcode.PolicyViolation {
+		t.Errorf("expected a policy violation, got %s", errcode.CategoryOf(err))
+	}
+	if (SecurityPolicy{Locally: []string{"github.com/[acme"}}).Validate() == nil {
+		t.Error("expected an invalid LOCALLY pattern")
+	}
+	if (SecurityPolicy{Privileged: []string{"github.com/[acme"}}).Validate() == nil {
+		t.Error("expected an invalid pattern")
+	}
+}
+
+func TestIsHostBindMount(t *testing.T) {
+	if !isHostBindMount("type=bind-experimental,source=/var/run/docker.sock,target=/var/run/docker.sock") {
+		t.Error("expected a host bind mount")
+	}
+	if isHostBindMount("type=cache,target=/root/.cache") {
+		t.Error("expected no host bind mount")
+	}
+}
+
+func TestSecurityPolicyStatement(t *testing.T) {
+	c := &Converter{
+		mts: &MultiTargetStates{FinalStates: &SingleTargetStates{
+			Target:           domain.Target{Registry: "github.com", ProjectPath: "thirdparty/app", Target: "build"},
+			SideEffectsState: llb.Image("alpine:3.11"),
+			SideEffectsImage: image.NewImage(),
+		}},
+		varCollection:  variables.NewCollection(),
+		securityPolicy: SecurityPolicy{Privileged: []string{}, HostBind: []string{}},
+	}
+	ctx := context.Background()
+	tests := []struct {
+		run      func() error
+		expected string
+	}{
+		{
+			func() error {
+				return c.Run(ctx, []string{"mount"}, nil, nil, true, false, false, true, false, nil, "", nil, 0, 0)
+			},
+			"(RUN --privileged)",
+		},
+		{
+			func() error {
+				mounts := []string{"type=cache,target=/root/.cache", "type=bind-experimental,source=/var/run/docker.sock,target=/var/run/docker.sock"}
+				return c.Run(ctx, []string{"docker", "ps"}, mounts, nil, false, false, false, true, false, nil, "", nil, 0, 0)
+			},
+			"(RUN --mount type=bind-experimental,source=/var/run/docker.sock,target=/var/run/docker.sock)",
+		},
+	}
+	for _, tt := range tests {
+		err := tt.run()
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("expected an error naming %s, got %v", tt.expected, err)
+		}
+	}
+}
@@ -37,25 +37,38 @@ func withShell(args []string, withShell bool) []string {
 	return args
 }
 
+// strWithEnvVars creates a shell command string which runs args with the given env vars
+// prepended. The env vars are expected to already be in the shell-safe form produced by
+// shellEnvVar or shellEnvVarFromFile. In the shell form, args are joined as a single script
+// and passed to /bin/sh -c. In the exec form, each arg is quoted individually, such that
+// it reaches the process verbatim.
 func strWithEnvVars(args []string, envVars []string, withShell bool, withDebugger bool) string {
 	var cmdParts []string
-	cmdParts = append(cmdParts, strings.Join(envVars, " "))
+	cmdParts = append(cmdParts, envVars...)
 	if withDebugger {
 		cmdParts = append(cmdParts, debuggerPath)
 	}
 	if withShell {
-		var escapedArgs []string
+		cmdParts = append(cmdParts, "/bin/sh", "-c", shellQuote(strings.Join(args, " ")))
+	} else {
 		for _, arg := range args {
-			escapedArgs = append(escapedArgs, escapeShellSingleQuotes(arg))
+			cmdParts = append(cmdParts, shellQuote(arg))
 		}
-		cmdParts = append(cmdParts, "/bin/sh", "-c")
-		cmdParts = append(cmdParts, fmt.Sprintf("'%s'", strings.Join(escapedArgs, " ")))
-	} else {
-		cmdParts = append(cmdParts, args...)
 	}
 	return strings.Join(cmdParts, " ")
 }
 
+// shellEnvVar returns a NAME=value assignment in which value is taken literally by the shell.
+func shellEnvVar(name string, value string) string {
+	return fmt.Sprintf("%s=%s", name, shellQuote(value))
+}
+
+// shellEnvVarFromFile returns a NAME=value assignment in which value is read from a file.
+func shellEnvVarFromFile(name string, filePath string) string {
+	// TODO: The use of cat here might not be portable.
+	return fmt.Sprintf("%s=\"$(cat %s)\"", name, shellQuote(filePath))
+}
+
 type shellWrapFun func(args []string, envVars []string, withShell bool, withDebugger bool) []string
 
 func withShellAndEnvVars(args []string, envVars []string, withShell bool, withDebugger bool) []string {
@@ -87,7 +100,7 @@ func withDockerdWrapOld(args []string, envVars []string, withShell bool, withDeb
 			"let i+=1\n" +
 			"done\n" +
 			// Run provided args.
-			strWithEnvVars(args, envVars, withShell, withDebugger) + "\n" +
+			escapeHeredoc(strWithEnvVars(args, envVars, withShell, withDebugger)) + "\n" +
 			"exit_code=\"\\$?\"\n" +
 			// Shut down dockerd.
 			"kill \"\\$dockerd_pid\" &>/dev/null\n" +
@@ -105,6 +118,18 @@ func withDockerdWrapOld(args []string, envVars []string, withShell bool, withDeb
 	}
 }
 
+// shellQuote wraps arg in single quotes, such that the shell does not interpret any of
+// its contents.
+func shellQuote(arg string) string {
+	return fmt.Sprintf("'%s'", escapeShellSingleQuotes(arg))
+}
+
 func escapeShellSingleQuotes(arg string) string {
 	return strings.Replace(arg, "'", "'\"'\"'", -1)
 }
+
+// escapeHeredoc escapes the characters which would otherwise be expanded within an
+// unquoted heredoc, such that the inner shell receives the command unaltered.
+func escapeHeredoc(str string) string {
+	return strings.NewReplacer("\\", "\\\\", "$", "\\$", "`", "\\`").Replace(str)
+}
@@ -0,0 +1,67 @@
+package earthfile2llb
+
+import (
+	"os/exec"
+	"testing"
+)
+
+var adversarialValues = []string{
+	"",
+	"simple",
+	"with space",
+	"double\"quote",
+	"single'quote",
+	"'",
+	"''",
+	"$HOME",
+	"${HOME}",
+	"$(echo injected)",
+	"`echo injected`",
+	"back\\slash",
+	"trailing\\",
+	"semi;colon && echo injected",
+	"new\nline",
+	"glob*?[a]",
+	"\"'$`\\",
+}
+
+func runSh(t *testing.T, args []string) string {
+	out, err := exec.Command(args[0], args[1:]...).Output()
+	if err != nil {
+		t.Fatalf("run %v: %v", args, err)
+	}
+	return string(out)
+}
+
+func TestShellEnvVar(t *testing.T) {
+	for _, value := range adversarialValues {
+		envVars := []string{shellEnvVar("VALUE", value)}
+		args := withShellAndEnvVars([]string{"printf", "%s", "\"$VALUE\""}, envVars, true, false)
+		got := runSh(t, args)
+		if got != value {
+			t.Errorf("env var: got %q, want %q", got, value)
+		}
+	}
+}
+
+func TestShellExecForm(t *testing.T) {
+	for _, value := range adversarialValues {
+		args := withShellAndEnvVars([]string{"printf", "%s", value}, nil, false, false)
+		got := runSh(t, args)
+		if got != value {
+			t.Errorf("exec form: got %q, want %q", got, value)
+		}
+	}
+}
+
+func TestShellHeredoc(t *testing.T) {
+	for _, value := range adversarialValues {
+		script := strWithEnvVars(
+			[]string{"printf", "%s", value}, []string{shellEnvVar("VALUE", value)}, false, false)
+		args := []string{"/bin/sh", "-c", "/bin/sh <<EOF\n" + escapeHeredoc(script) + "\nEOF"}
+		got := runSh(t, args)
+		if got != value {
+			t.Errorf("heredoc: got %q, want %q", got, value)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package earthfile2llb
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// SolveCache holds the images built for WITH DOCKER --load, such that identical
+// images (same target input and docker tag) are only built once. The cache may be
+// kept across builds, as in watch mode, provided that the images built from files
+// which have changed are invalidated in between.
+type SolveCache struct {
+	// loadSockets are the IDs of the sockets serving the images as docker tars, by
+	// image solve key.
+	loadSockets map[string]cachedLoadSocket
+	// pullRefs are the pullable image refs, by target input hash, when images are
+	// passed via the embedded registry.
+	pullRefs map[string]cachedPullRef
+}
+
+type cachedLoadSocket struct {
+	socketID string
+	// localPaths are the dirs of the local targets the image was built from.
+	localPaths []string
+}
+
+type cachedPullRef struct {
+	pullRef    string
+	localPaths []string
+}
+
+// NewSolveCache returns an empty solve cache.
+func NewSolveCache() *SolveCache {
+	return &SolveCache{
+		loadSockets: make(map[string]cachedLoadSocket),
+		pullRefs:    make(map[string]cachedPullRef),
+	}
+}
+
+// Invalidate drops the images built from local targets within which any of the given
+// paths is. It returns the number of images dropped.
+func (sc *SolveCache) Invalidate(changedPaths []string) int {
+	n := 0
+	for key, entry := range sc.loadSockets {
+		if containsAny(entry.localPaths, changedPaths) {
+			delete(sc.loadSockets, key)
+			n++
+		}
+	}
+	for solveID, entry := range sc.pullRefs {
+		if containsAny(entry.localPaths, changedPaths) {
+			delete(sc.pullRefs, solveID)
+			n++
+		}
+	}
+	return n
+}
+
+// localPathsOf returns the absolute dirs of the local targets involved in a build.
+func localPathsOf(mts *MultiTargetStates) []string {
+	var ret []string
+	seen := make(map[string]bool)
+	for _, sts := range mts.AllStates() {
+		if sts.Target.IsRemote() {
+			continue
+		}
+		dir, err := filepath.Abs(sts.Target.LocalPath)
+		if err != nil {
+			dir = sts.Target.LocalPath
+		}
+		if !seen[dir] {
+			seen[dir] = true
+			ret = append(ret, dir)
+		}
+	}
+	return ret
+}
+
+// containsAny returns whether any of the paths is one of the dirs, or within one.
+func containsAny(dirs []string, paths []string) bool {
+	for _, dir := range dirs {
+		for _, p := range paths {
+			if p == dir || strings.HasPrefix(p, dir+string(filepath.Separator)) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,30 @@
+package earthfile2llb
+
+import (
+	"testing"
+)
+
+func TestSolveCacheInvalidate(t *testing.T) {
+	sc := NewSolveCache()
+	sc.loadSockets["a"] = cachedLoadSocket{localPaths: []string{"/src/app", "/src/lib"}}
+	sc.loadSockets["b"] = cachedLoadSocket{localPaths: []string{"/src/tools"}}
+	sc.pullRefs["c"] = cachedPullRef{pullRef: "reg/c@sha256:1", localPaths: []string{"/src/lib"}}
+	sc.pullRefs["d"] = cachedPullRef{pullRef: "reg/d@sha256:2"}
+
+	n := sc.Invalidate([]string{"/src/lib/util.go", "/src/app2/main.go"})
+	if n != 2 {
+		t.Errorf("expected 2 entries invalidated, got %d", n)
+	}
+	if _, found := sc.loadSockets["a"]; found {
+		t.Errorf("expected a to be invalidated")
+	}
+	if _, found := sc.loadSockets["b"]; !found {
+		t.Errorf("expected b to be kept")
+	}
+	if _, found := sc.pullRefs["c"]; found {
+		t.Errorf("expected c to be invalidated")
+	}
+	if _, found := sc.pullRefs["d"]; !found {
+		t.Errorf("expected d to be kept")
+	}
+}
@@ -0,0 +1,79 @@
+package earthfile2llb
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/antlr/antlr4/runtime/Go/antlr"
+)
+
+// maxSnippetLen is the maximum length of the snippet of a SourceError, in characters.
+const maxSnippetLen = 80
+
+// SourceError is an error of the conversion of a statement of an Earthfile, with the
+// location of the statement.
+type SourceError struct {
+	// File is the path of the Earthfile, or its reference within its repository for
+	// remote targets (eg github.com/foo/bar/Earthfile).
+	File string
+	// Line and Column are the position of the start of the statement, starting at 1.
+	Line   int
+	Column int
+	// Snippet is the statement, as written, shortened if long.
+	Snippet string
+	Err     error
+}
+
+// Error implements error.
+func (se *SourceError) Error() string {
+	return fmt.Sprintf("%s:%d:%d %s: %v", se.File, se.Line, se.Column, se.Snippet, se.Err)
+}
+
+// Cause returns the underlying error, for errors.Cause.
+func (se *SourceError) Cause() error {
+	return se.Err
+}
+
+// Unwrap returns the underlying error, for errors.Is and errors.As.
+func (se *SourceError) Unwrap() error {
+	return se.Err
+}
+
+// InnermostSourceError returns the source error of err closest to the cause of err, if
+// any. When a target fails to convert a target it depends on (eg via BUILD), this is
+// the location of the failure within the dependency.
+func InnermostSourceError(err error) (*SourceError, bool) {
+	var innermost *SourceError
+	for err != nil {
+		if se, ok := err.(*SourceError); ok {
+			innermost = se
+		}
+		causer, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		err = causer.Cause()
+	}
+	return innermost, innermost != nil
+}
+
+// newSourceError returns err located at the tokens spanning from start to stop of the
+// Earthfile file.
+func newSourceError(file string, start antlr.Token, stop antlr.Token, err error) *SourceError {
+	if stop == nil {
+		stop = start
+	}
+	snippet := start.GetInputStream().GetText(start.GetStart(), stop.GetStop())
+	snippet = strings.Join(strings.Fields(replaceEscape(snippet)), " ")
+	if utf8.RuneCountInString(snippet) > maxSnippetLen {
+		snippet = string([]rune(snippet)[:maxSnippetLen-3]) + "..."
+	}
+	return &SourceError{
+		File:    file,
+		Line:    start.GetLine(),
+		Column:  start.GetColumn() + 1,
+		Snippet: snippet,
+		Err:     err,
+	}
+}
@@ -0,0 +1,54 @@
+package earthfile2llb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/antlr/antlr4/runtime/Go/antlr"
+	"github.com/earthly/earthly/ast"
+	"github.com/earthly/earthly/earthfile2llb/parser"
+	pkgerrors "github.com/pkg/errors"
+)
+
+func TestNewSourceError(t *testing.T) {
+	input := antlr.NewInputStream("build:\n    RUN --mount=type=cache,target=/root/.cache \\\n        go build ./...\n")
+	stream := antlr.NewCommonTokenStream(ast.NewLexer(input), 0)
+	stream.Fill()
+	var start, stop antlr.Token
+	for _, token := range stream.GetAllTokens() {
+		switch token.GetTokenType() {
+		case parser.EarthLexerRUN:
+			start = token
+		case parser.EarthLexerAtom:
+			stop = token
+		}
+	}
+	if start == nil || stop == nil {
+		t.Fatal("statement tokens not found")
+	}
+	se := newSourceError("Earthfile", start, stop, errors.New("invalid mount"))
+	if se.Line != 2 || se.Column != 5 {
+		t.Errorf("unexpected position %d:%d", se.Line, se.Column)
+	}
+	expectedSnippet := "RUN --mount=type=cache,target=/root/.cache go build ./..."
+	if se.Snippet != expectedSnippet {
+		t.Errorf("expected snippet %q, got %q", expectedSnippet, se.Snippet)
+	}
+	expectedErr := "Earthfile:2:5 " + expectedSnippet + ": invalid mount"
+	if se.Error() != expectedErr {
+		t.Errorf("expected error %q, got %q", expectedErr, se.Error())
+	}
+}
+
+func TestInnermostSourceError(t *testing.T) {
+	inner := &SourceError{File: "lib/Earthfile", Line: 3, Column: 5, Snippet: "RUN false", Err: errors.New("failed")}
+	outer := &SourceError{File: "Earthfile", Line: 7, Column: 5, Snippet: "BUILD ./lib+lib", Err: pkgerrors.Wrap(inner, "apply build")}
+	se, found := InnermostSourceError(pkgerrors.Wrap(outer, "parse"))
+	if !found || se != inner {
+		t.Errorf("expected the inner source error, got %v", se)
+	}
+	_, found = InnermostSourceError(errors.New("no location"))
+	if found {
+		t.Error("expected no source error")
+	}
+}
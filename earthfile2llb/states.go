@@ -1,10 +1,14 @@
 package earthfile2llb
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/earthly/earthly/domain"
 	"github.com/earthly/earthly/earthfile2llb/dedup"
 	"github.com/earthly/earthly/earthfile2llb/image"
 	"github.com/moby/buildkit/client/llb"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 // MultiTargetStates holds LLB states representing multiple earth targets,
@@ -34,18 +38,68 @@ func (mts *MultiTargetStates) AllStates() []*SingleTargetStates {
 
 // SingleTargetStates holds LLB states representing a earth target.
 type SingleTargetStates struct {
-	Target                 domain.Target
-	TargetInput            dedup.TargetInput
-	SideEffectsImage       *image.Image
-	SideEffectsState       llb.State
+	Target           domain.Target
+	TargetInput      dedup.TargetInput
+	SideEffectsImage *image.Image
+	SideEffectsState llb.State
+	// OwnSideEffectsState is the SideEffectsState without the artificial dependencies
+	// on the side effects of the targets this target depends on. Set once the target
+	// is converted.
+	OwnSideEffectsState    llb.State
 	ArtifactsState         llb.State
 	SeparateArtifactsState []llb.State
 	SaveLocals             []SaveLocal
-	SaveImages             []SaveImage
-	RunPush                RunPush
-	LocalDirs              map[string]string
-	Ongoing                bool
-	Salt                   string
+	// OnFailureSaves are the artifacts saved via SAVE ARTIFACT --on-failure, which are
+	// output even if a RUN command of the target fails. They are part of SaveLocals too.
+	OnFailureSaves []OnFailureSave
+	// RunSteps are the RUN commands of the target, in order.
+	RunSteps []RunStep
+	// Retries are the number of times the RUN --retry commands of the target are retried
+	// on failure, by the name of their vertex. The builder retries a command by solving
+	// it again, from the state it started from.
+	Retries map[string]int
+	// LocalSteps are the commands of the target executed on the host, after LOCALLY, in
+	// order. They are executed by the builder, before the states which may read their
+	// outputs from the build context are solved.
+	LocalSteps  []LocalStep
+	SaveRemotes []SaveRemote
+	SaveImages  []SaveImage
+	RunPush     RunPush
+	// RunPushAfterImages are the RUN --push commands declared after SAVE IMAGE --push.
+	// They are executed once the images of the target have been output.
+	RunPushAfterImages RunPush
+	// PushAfter are the targets whose outputs (including pushes) need to complete
+	// before the outputs of this target, as declared via RUN --push --after.
+	PushAfter []domain.Target
+	LocalDirs map[string]string
+	Ongoing   bool
+	Salt      string
+	// Materials are the inputs the target was built from (source repository,
+	// base images). They are used for recording build provenance.
+	Materials []Material
+	// RootlessViolations are the commands of the target which were not converted, as
+	// they require privileges, which a rootless build does not have.
+	RootlessViolations []string
+	// Deps are the targets this target directly depends on (via FROM, COPY, BUILD
+	// etc), in the order they were referenced. Set once the target is converted.
+	Deps []*SingleTargetStates
+	// PatternMatches are the targets built via BUILD with a target pattern, in order.
+	// For a pattern target given on the command line, they are the targets matched.
+	PatternMatches []*SingleTargetStates
+	// MatrixStates are the states of the target for each set of build args of the build
+	// arg matrix of the build (see ConvertOpt.BuildArgMatrix), in order. Only set for the
+	// final states of such a build.
+	MatrixStates []*SingleTargetStates
+	// RemoteSource is the remote repository the target was read from. Only set for
+	// remote targets.
+	RemoteSource *RemoteSource
+	// SourceStates are the states of the images the target pulls (via FROM, DOCKER PULL
+	// etc) and of its build context, for remote targets. They can be solved without
+	// executing any command of the target, for pre-warming the cache.
+	SourceStates []llb.State
+	// Platform is the platform the commands of the target run for, as per FROM
+	// --platform. Set once the target is converted.
+	Platform specs.Platform
 }
 
 // LastSaveImage returns the last save image available (if any).
@@ -56,6 +110,52 @@ func (sts *SingleTargetStates) LastSaveImage() (SaveImage, bool) {
 	return sts.SaveImages[len(sts.SaveImages)-1], true
 }
 
+// HasPushImages returns true if any of the images saved is to be pushed.
+func (sts *SingleTargetStates) HasPushImages() bool {
+	for _, saveImage := range sts.SaveImages {
+		if saveImage.Push {
+			return true
+		}
+	}
+	return false
+}
+
+// AddMaterials adds the given materials, skipping any which already exist.
+func (sts *SingleTargetStates) AddMaterials(materials ...Material) {
+	for _, m := range materials {
+		found := false
+		for _, existing := range sts.Materials {
+			if existing.URI == m.URI {
+				found = true
+				break
+			}
+		}
+		if !found {
+			sts.Materials = append(sts.Materials, m)
+		}
+	}
+}
+
+// Material is an input that a target was built from.
+type Material struct {
+	// URI identifies the material (e.g. git+https://github.com/foo/bar or
+	// pkg:docker/alpine:3.11).
+	URI string `json:"uri"`
+	// Digest holds the digests of the material, keyed by algorithm.
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+// RemoteSource is a remote repository, at the commit a ref resolved to.
+type RemoteSource struct {
+	// Repository identifies the repository (e.g. github.com/foo/bar).
+	Repository string
+	// Ref is the ref of the repository referenced (branch, tag or commit), or the
+	// default branch if none was.
+	Ref string
+	// Hash is the commit the ref resolved to.
+	Hash string
+}
+
 // SaveLocal is an artifact path to be saved to local disk.
 type SaveLocal struct {
 	// DestPath is the local dest path to copy the artifact to.
@@ -66,12 +166,76 @@ type SaveLocal struct {
 	Index int
 }
 
+// OnFailureSave is an artifact saved locally via SAVE ARTIFACT --on-failure.
+type OnFailureSave struct {
+	SaveLocal
+	// FailedStepStates are the artifacts states should the RUN step of the same index
+	// fail. They hold the artifact as left by the failed command. There is one per step
+	// preceding the SAVE ARTIFACT command.
+	FailedStepStates []llb.State
+	// State is the artifacts state should a RUN step following the SAVE ARTIFACT
+	// command fail.
+	State llb.State
+}
+
+// RunStep is a RUN command of a target, outside of RUN --push.
+type RunStep struct {
+	// State is the state once the command has run.
+	State llb.State
+	// IgnoreFailureState is the state once the command has run again, from the same
+	// state, without failing if the command fails.
+	IgnoreFailureState llb.State
+}
+
+// SaveRemote is an artifact to be uploaded to object storage.
+type SaveRemote struct {
+	// State performs the upload, when solved.
+	State llb.State
+	// ArtifactPath is the relative path within the artifacts image.
+	ArtifactPath string
+	// DestURL is the object storage URL to upload to.
+	DestURL string
+}
+
 // SaveImage is a docker image to be saved.
 type SaveImage struct {
 	State     llb.State
 	Image     *image.Image
 	DockerTag string
 	Push      bool
+	// Insecure allows pushing the image over plain HTTP, or with an untrusted TLS
+	// certificate.
+	Insecure    bool
+	Compression LayerCompression
+}
+
+// LayerCompression is the compression applied to the layers of an image, when it is
+// exported or pushed.
+type LayerCompression struct {
+	// Type is one of LayerCompressionTypes. The exporter default is used if empty.
+	Type string
+}
+
+// LayerCompressionTypes lists the layer compression types supported by the exporters
+// of buildkit.
+var LayerCompressionTypes = []string{"gzip", "uncompressed"}
+
+// Validate returns an error if the layer compression is not supported.
+func (lc LayerCompression) Validate() error {
+	if lc.Type == "" {
+		return nil
+	}
+	found := false
+	for _, t := range LayerCompressionTypes {
+		if t == lc.Type {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("invalid compression %s. Supported compressions: %s", lc.Type, strings.Join(LayerCompressionTypes, ", "))
+	}
+	return nil
 }
 
 // RunPush is a series of RUN --push commands to be run after the build has been deemed as
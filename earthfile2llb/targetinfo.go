@@ -0,0 +1,401 @@
+package earthfile2llb
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/antlr/antlr4/runtime/Go/antlr"
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/earthfile2llb/antlrhandler"
+	"github.com/earthly/earthly/earthfile2llb/parser"
+	"github.com/pkg/errors"
+)
+
+// TargetInfo describes a target of an Earthfile, as declared. Values are not
+// expanded, as that requires converting the target.
+type TargetInfo struct {
+	Name string `json:"name"`
+	// Doc is the comment immediately preceding the target, without the leading #.
+	Doc string `json:"doc,omitempty"`
+	// Labels are the labels the target is tagged with, via a
+	// "# earthly:labels=<label>,..." line of its comment. They are used for selecting
+	// the targets matched by target patterns.
+	Labels []string `json:"labels"`
+	// Line is the line of the Earthfile the target is declared on.
+	Line      int            `json:"line"`
+	Args      []ArgInfo      `json:"args"`
+	Artifacts []ArtifactInfo `json:"artifacts"`
+	Images    []ImageInfo    `json:"images"`
+	// Deps are the targets referenced via FROM, COPY and BUILD, relative to the
+	// Earthfile, in the order of their first reference.
+	Deps []string `json:"deps"`
+	// Sources are the local files the target reads from its build context, via COPY,
+	// FROM DOCKERFILE and WITH DOCKER --compose, relative to the Earthfile, as written.
+	Sources []string `json:"sources"`
+}
+
+// ArgInfo describes an ARG of a target.
+type ArgInfo struct {
+	Name    string `json:"name"`
+	Default string `json:"default,omitempty"`
+	// Required is set when the ARG declares no default value.
+	Required bool `json:"required"`
+	Line     int  `json:"line"`
+}
+
+// ArtifactInfo describes a SAVE ARTIFACT of a target.
+type ArtifactInfo struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Local is the path the artifact is saved to locally (AS LOCAL), if any.
+	Local string `json:"local,omitempty"`
+	// Remote is the URL the artifact is uploaded to (AS REMOTE), if any.
+	Remote string `json:"remote,omitempty"`
+	Line   int    `json:"line"`
+}
+
+// ImageInfo describes the SAVE IMAGE of a target.
+type ImageInfo struct {
+	Names []string `json:"names"`
+	Push  bool     `json:"push"`
+	// PushIf is the condition which gates the push (SAVE IMAGE --push-if), if any.
+	PushIf string `json:"pushIf,omitempty"`
+	Line   int    `json:"line"`
+}
+
+// GetTargetInfos parses an Earthfile and returns the description of its targets, in
+// the order of their declaration.
+func GetTargetInfos(filename string) ([]TargetInfo, error) {
+	_, infos, err := getEarthfileInfos(filename)
+	return infos, err
+}
+
+// getEarthfileInfos parses an Earthfile and returns the description of its base target,
+// whose deps and sources all the targets share, and of its targets.
+func getEarthfileInfos(filename string) (base TargetInfo, infos []TargetInfo, err error) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			err = fmt.Errorf("parser failure: %v", r)
+		}
+	}()
+	dt, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return TargetInfo{}, nil, errors.Wrapf(err, "read %s", filename)
+	}
+	errorListener := antlrhandler.NewReturnErrorListener()
+	errorStrategy := antlrhandler.NewReturnErrorStrategy()
+	tree, err := newEarthfileTree(filename, errorListener, errorStrategy)
+	if err != nil {
+		return TargetInfo{}, nil, errors.Wrap(err, "new earthfile tree")
+	}
+	err = syntaxError(errorListener, errorStrategy)
+	if err != nil {
+		return TargetInfo{}, nil, err
+	}
+	tic := &targetInfoCollector{
+		lines: strings.Split(string(dt), "\n"),
+		base:  TargetInfo{Name: "base", Deps: []string{}, Sources: []string{}},
+	}
+	antlr.ParseTreeWalkerDefault.Walk(tic, tree)
+	if tic.err != nil {
+		return TargetInfo{}, nil, tic.err
+	}
+	return tic.base, tic.targets, nil
+}
+
+type targetInfoCollector struct {
+	*parser.BaseEarthParserListener
+	lines   []string
+	base    TargetInfo
+	targets []TargetInfo
+
+	stmtWords []string
+	err       error
+}
+
+func (l *targetInfoCollector) current() *TargetInfo {
+	if len(l.targets) == 0 {
+		// Statements of the base target.
+		return nil
+	}
+	return &l.targets[len(l.targets)-1]
+}
+
+// currentOrBase returns the current target, or the base target for its statements.
+func (l *targetInfoCollector) currentOrBase() *TargetInfo {
+	ti := l.current()
+	if ti == nil {
+		return &l.base
+	}
+	return ti
+}
+
+func (l *targetInfoCollector) EnterTargetHeader(c *parser.TargetHeaderContext) {
+	line := c.GetStart().GetLine()
+	name := strings.TrimSuffix(c.GetText(), ":")
+	doc, labels, err := parseTargetMetadata(l.docComment(line))
+	if err != nil && l.err == nil {
+		l.err = errors.Wrapf(err, "target %s (line %d)", name, line)
+	}
+	l.targets = append(l.targets, TargetInfo{
+		Name:      name,
+		Doc:       doc,
+		Labels:    labels,
+		Line:      line,
+		Args:      []ArgInfo{},
+		Artifacts: []ArtifactInfo{},
+		Images:    []ImageInfo{},
+		Deps:      []string{},
+		Sources:   []string{},
+	})
+}
+
+// docComment returns the comment lines immediately preceding the given line.
+func (l *targetInfoCollector) docComment(line int) string {
+	var doc []string
+	for i := line - 2; i >= 0 && i < len(l.lines); i-- {
+		trimmed := strings.TrimSpace(l.lines[i])
+		if !strings.HasPrefix(trimmed, "#") {
+			break
+		}
+		trimmed = strings.TrimPrefix(trimmed, "#")
+		trimmed = strings.TrimPrefix(trimmed, " ")
+		doc = append([]string{trimmed}, doc...)
+	}
+	return strings.Join(doc, "\n")
+}
+
+// targetMetadataPrefix is the prefix of the lines of the comment of a target which
+// declare metadata, rather than document it.
+const targetMetadataPrefix = "earthly:"
+
+var labelRe = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// parseTargetMetadata splits the comment of a target into its documentation and the
+// labels declared via its metadata lines.
+func parseTargetMetadata(comment string) (string, []string, error) {
+	var doc []string
+	labels := []string{}
+	for _, line := range strings.Split(comment, "\n") {
+		if !strings.HasPrefix(line, targetMetadataPrefix) {
+			doc = append(doc, line)
+			continue
+		}
+		kv := strings.SplitN(strings.TrimPrefix(line, targetMetadataPrefix), "=", 2)
+		if len(kv) != 2 || kv[0] != "labels" {
+			return "", nil, fmt.Errorf("invalid metadata %s, expected %slabels=<label>,...", line, targetMetadataPrefix)
+		}
+		for _, label := range strings.Split(kv[1], ",") {
+			label = strings.TrimSpace(label)
+			if !labelRe.MatchString(label) {
+				return "", nil, fmt.Errorf("invalid label %q", label)
+			}
+			labels = append(labels, label)
+		}
+	}
+	return strings.Join(doc, "\n"), labels, nil
+}
+
+func (l *targetInfoCollector) EnterStmt(c *parser.StmtContext) {
+	l.stmtWords = nil
+}
+
+func (l *targetInfoCollector) EnterStmtWord(c *parser.StmtWordContext) {
+	l.stmtWords = append(l.stmtWords, replaceEscape(c.GetText()))
+}
+
+func (l *targetInfoCollector) ExitStmtWordsMaybeJSON(c *parser.StmtWordsMaybeJSONContext) {
+	var words []string
+	err := json.Unmarshal([]byte(c.GetText()), &words)
+	if err == nil {
+		l.stmtWords = words
+	}
+}
+
+func (l *targetInfoCollector) ExitArgStmt(c *parser.ArgStmtContext) {
+	ti := l.current()
+	if ti == nil {
+		return
+	}
+	arg := ArgInfo{
+		Name:     c.EnvArgKey().GetText(),
+		Required: c.EQUALS() == nil,
+		Line:     c.GetStart().GetLine(),
+	}
+	if c.EnvArgValue() != nil {
+		arg.Default = c.EnvArgValue().GetText()
+	}
+	ti.Args = append(ti.Args, arg)
+}
+
+func (l *targetInfoCollector) ExitSaveArtifact(c *parser.SaveArtifactContext) {
+	ti := l.current()
+	if ti == nil || len(l.stmtWords) == 0 {
+		return
+	}
+	// Mirrors the parsing of the arguments in the listener.
+	words := l.stmtWords
+	artifact := ArtifactInfo{
+		From: words[0],
+		To:   "./",
+		Line: c.GetStart().GetLine(),
+	}
+	if len(words) >= 4 {
+		as := strings.Join(words[len(words)-3:len(words)-1], " ")
+		switch as {
+		case "AS LOCAL":
+			artifact.Local = words[len(words)-1]
+		case "AS REMOTE":
+			artifact.Remote = words[len(words)-1]
+		}
+		if len(words) == 5 {
+			artifact.To = words[1]
+		}
+	} else if len(words) == 2 {
+		artifact.To = words[1]
+	}
+	ti.Artifacts = append(ti.Artifacts, artifact)
+}
+
+func (l *targetInfoCollector) ExitSaveImage(c *parser.SaveImageContext) {
+	ti := l.current()
+	if ti == nil {
+		return
+	}
+	fs := flag.NewFlagSet("SAVE IMAGE", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	pushFlag := fs.Bool("push", false, "")
+	fs.String("compression", "", "")
+	pushIf := fs.String("push-if", "", "")
+	fs.Bool("insecure", false, "")
+	err := fs.Parse(l.stmtWords)
+	if err != nil {
+		l.err = errors.Wrapf(err, "invalid SAVE IMAGE arguments %v", l.stmtWords)
+		return
+	}
+	names := fs.Args()
+	if names == nil {
+		names = []string{}
+	}
+	ti.Images = append(ti.Images, ImageInfo{
+		Names:  names,
+		Push:   *pushFlag,
+		PushIf: unquoteCondition(*pushIf),
+		Line:   c.GetStart().GetLine(),
+	})
+}
+
+func (l *targetInfoCollector) ExitFromStmt(c *parser.FromStmtContext) {
+	fs := flag.NewFlagSet("FROM", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.Var(new(StringSliceFlag), "build-arg", "")
+	err := fs.Parse(l.stmtWords)
+	if err != nil || fs.NArg() != 1 || !strings.Contains(fs.Arg(0), "+") {
+		// Errors are reported by the conversion.
+		return
+	}
+	target, err := domain.ParseTarget(fs.Arg(0))
+	if err == nil {
+		l.addDep(target.String())
+	}
+}
+
+func (l *targetInfoCollector) ExitBuildStmt(c *parser.BuildStmtContext) {
+	fs := flag.NewFlagSet("BUILD", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.Var(new(StringSliceFlag), "build-arg", "")
+	fs.Var(new(StringSliceFlag), "label", "")
+	fs.Var(new(StringSliceFlag), "exclude-label", "")
+	err := fs.Parse(l.stmtWords)
+	if err != nil || fs.NArg() != 1 {
+		return
+	}
+	target, err := domain.ParseTarget(fs.Arg(0))
+	if err == nil {
+		l.addDep(target.String())
+	}
+}
+
+func (l *targetInfoCollector) ExitCopyStmt(c *parser.CopyStmtContext) {
+	fs := flag.NewFlagSet("COPY", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.String("from", "", "")
+	fs.Bool("dir", false, "")
+	fs.String("chown", "", "")
+	fs.Var(new(StringSliceFlag), "build-arg", "")
+	err := fs.Parse(l.stmtWords)
+	if err != nil || fs.NArg() < 2 {
+		return
+	}
+	for _, src := range fs.Args()[:fs.NArg()-1] {
+		if !strings.Contains(src, "+") {
+			l.addSource(src)
+			continue
+		}
+		artifact, err := domain.ParseArtifact(src)
+		if err == nil {
+			l.addDep(artifact.Target.String())
+		}
+	}
+}
+
+func (l *targetInfoCollector) ExitFromDockerfileStmt(c *parser.FromDockerfileStmtContext) {
+	fs := flag.NewFlagSet("FROM DOCKERFILE", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.Var(new(StringSliceFlag), "build-arg", "")
+	fs.String("target", "", "")
+	dfPath := fs.String("f", "", "")
+	err := fs.Parse(l.stmtWords)
+	if err != nil || fs.NArg() != 1 {
+		return
+	}
+	if strings.Contains(fs.Arg(0), "+") {
+		// The build context is an artifact.
+		artifact, err := domain.ParseArtifact(fs.Arg(0))
+		if err == nil {
+			l.addDep(artifact.Target.String())
+		}
+	} else {
+		l.addSource(fs.Arg(0))
+	}
+	if *dfPath != "" {
+		l.addSource(*dfPath)
+	}
+}
+
+func (l *targetInfoCollector) ExitWithDockerStmt(c *parser.WithDockerStmtContext) {
+	// Only --compose is of interest, the other flags being validated by the conversion.
+	for i, word := range l.stmtWords {
+		switch {
+		case word == "--compose" && i+1 < len(l.stmtWords):
+			l.addSource(l.stmtWords[i+1])
+		case strings.HasPrefix(word, "--compose="):
+			l.addSource(strings.TrimPrefix(word, "--compose="))
+		}
+	}
+}
+
+func (l *targetInfoCollector) addDep(target string) {
+	ti := l.currentOrBase()
+	for _, dep := range ti.Deps {
+		if dep == target {
+			return
+		}
+	}
+	ti.Deps = append(ti.Deps, target)
+}
+
+func (l *targetInfoCollector) addSource(src string) {
+	ti := l.currentOrBase()
+	for _, existing := range ti.Sources {
+		if existing == src {
+			return
+		}
+	}
+	ti.Sources = append(ti.Sources, src)
+}
@@ -0,0 +1,112 @@
+package earthfile2llb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const targetInfoEarthfile = `FROM alpine:3.11
+ARG BASEARG=1
+
+# Builds the binary.
+# Set VERSION to stamp it.
+build:
+    ARG VERSION=dev
+    ARG NAME
+    ARG EMPTY=
+    RUN echo "$NAME $VERSION" >out
+    SAVE ARTIFACT out /out AS LOCAL build/out
+    SAVE ARTIFACT out
+
+# earthly:labels=slow, release
+docker:
+    FROM +build
+    SAVE IMAGE --push --insecure org/app:latest org/app:dev
+`
+
+func TestGetTargetInfos(t *testing.T) {
+	dir, err := ioutil.TempDir("", "earth-targetinfo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "Earthfile")
+	err = ioutil.WriteFile(path, []byte(targetInfoEarthfile), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err := GetTargetInfos(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("expected 2 targets, got %+v", infos)
+	}
+	build := infos[0]
+	if build.Name != "build" || build.Line != 6 {
+		t.Errorf("unexpected target %s at line %d", build.Name, build.Line)
+	}
+	if build.Doc != "Builds the binary.\nSet VERSION to stamp it." {
+		t.Errorf("unexpected doc %q", build.Doc)
+	}
+	expectedArgs := []ArgInfo{
+		{Name: "VERSION", Default: "dev", Line: 7},
+		{Name: "NAME", Required: true, Line: 8},
+		{Name: "EMPTY", Line: 9},
+	}
+	if len(build.Args) != len(expectedArgs) {
+		t.Fatalf("expected args %+v, got %+v", expectedArgs, build.Args)
+	}
+	for i := range expectedArgs {
+		if build.Args[i] != expectedArgs[i] {
+			t.Errorf("arg %d: expected %+v, got %+v", i, expectedArgs[i], build.Args[i])
+		}
+	}
+	expectedArtifacts := []ArtifactInfo{
+		{From: "out", To: "/out", Local: "build/out", Line: 11},
+		{From: "out", To: "./", Line: 12},
+	}
+	if len(build.Artifacts) != len(expectedArtifacts) {
+		t.Fatalf("expected artifacts %+v, got %+v", expectedArtifacts, build.Artifacts)
+	}
+	for i := range expectedArtifacts {
+		if build.Artifacts[i] != expectedArtifacts[i] {
+			t.Errorf("artifact %d: expected %+v, got %+v", i, expectedArtifacts[i], build.Artifacts[i])
+		}
+	}
+	docker := infos[1]
+	if docker.Doc != "" {
+		t.Errorf("unexpected doc %q", docker.Doc)
+	}
+	if !reflect.DeepEqual(docker.Labels, []string{"slow", "release"}) {
+		t.Errorf("unexpected labels %v", docker.Labels)
+	}
+	if !reflect.DeepEqual(docker.Deps, []string{"+build"}) {
+		t.Errorf("unexpected deps %v", docker.Deps)
+	}
+	if len(build.Labels) != 0 {
+		t.Errorf("unexpected labels %v", build.Labels)
+	}
+	if len(docker.Images) != 1 || !docker.Images[0].Push || len(docker.Images[0].Names) != 2 {
+		t.Errorf("unexpected images %+v", docker.Images)
+	}
+}
+
+func TestParseTargetMetadata(t *testing.T) {
+	doc, labels, err := parseTargetMetadata("Runs the tests.\nearthly:labels=fast,unit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc != "Runs the tests." || !reflect.DeepEqual(labels, []string{"fast", "unit"}) {
+		t.Errorf("got doc %q and labels %v", doc, labels)
+	}
+	for _, comment := range []string{"earthly:labels=", "earthly:labels=a b", "earthly:owner=me"} {
+		_, _, err := parseTargetMetadata(comment)
+		if err == nil {
+			t.Errorf("%s: expected an error", comment)
+		}
+	}
+}
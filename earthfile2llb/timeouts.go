@@ -0,0 +1,36 @@
+package earthfile2llb
+
+import (
+	"context"
+	"time"
+
+	"github.com/earthly/earthly/buildcontext"
+	"github.com/earthly/earthly/domain"
+	"github.com/pkg/errors"
+)
+
+// Timeouts are the timeouts of the operations of the conversion which reach out to the
+// network, and may otherwise hang on network issues. Not limited if zero.
+type Timeouts struct {
+	// ImageResolve limits each resolution of the config of an image, such as the base
+	// image of a FROM.
+	ImageResolve time.Duration
+	// GitResolve limits each resolution of the build context of a target, which clones
+	// the repository of remote targets.
+	GitResolve time.Duration
+}
+
+// resolveBuildContext resolves the build context of target, within timeout. Not limited
+// if zero.
+func resolveBuildContext(ctx context.Context, resolver *buildcontext.Resolver, target domain.Target, timeout time.Duration) (*buildcontext.Data, error) {
+	if timeout == 0 {
+		return resolver.Resolve(ctx, target)
+	}
+	resolveCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	bc, err := resolver.Resolve(resolveCtx, target)
+	if err != nil && ctx.Err() == nil && resolveCtx.Err() == context.DeadlineExceeded {
+		return nil, errors.Wrapf(context.DeadlineExceeded, "timed out after %s", timeout)
+	}
+	return bc, err
+}
@@ -5,16 +5,23 @@ import (
 	"os"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/containerd/containerd/platforms"
 	"github.com/earthly/earthly/buildcontext"
 	"github.com/earthly/earthly/domain"
 	"github.com/earthly/earthly/earthfile2llb/dedup"
 	"github.com/moby/buildkit/client/llb"
 	dfShell "github.com/moby/buildkit/frontend/dockerfile/shell"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 )
 
+// shortHashLength is the length of the git hash in EARTHLY_GIT_SHORT_HASH.
+const shortHashLength = 8
+
 // ProcessNonConstantVariableFunc is a function which takes in an expression and
 // turns it into a state, target intput and arg index.
 type ProcessNonConstantVariableFunc func(name string, expression string) (argState llb.State, ti dedup.TargetInput, argIndex int, err error)
@@ -69,6 +76,48 @@ func ParseCommandLineBuildArgs(args []string, dotEnvMap map[string]string) (*Col
 	return ret, nil
 }
 
+// ParseCommandLineBuildArgMatrix parses a build arg matrix, where each entry is a build arg
+// with comma separated values (e.g. GO_VERSION=1.14,1.15). It returns a collection for
+// each combination of the values, in order, with the given constant build args too.
+func ParseCommandLineBuildArgMatrix(matrix []string, args []string, dotEnvMap map[string]string) ([]*Collection, error) {
+	combinations := [][]string{nil}
+	seen := make(map[string]bool)
+	for _, entry := range matrix {
+		splitEntry := strings.SplitN(entry, "=", 2)
+		if len(splitEntry) != 2 || splitEntry[0] == "" {
+			return nil, fmt.Errorf("invalid build arg matrix entry %s", entry)
+		}
+		key := splitEntry[0]
+		if seen[key] {
+			return nil, fmt.Errorf("build arg %s appears more than once in the matrix", key)
+		}
+		seen[key] = true
+		var next [][]string
+		for _, combination := range combinations {
+			for _, value := range strings.Split(splitEntry[1], ",") {
+				withValue := append(append([]string{}, combination...), fmt.Sprintf("%s=%s", key, value))
+				next = append(next, withValue)
+			}
+		}
+		combinations = next
+	}
+	for _, arg := range args {
+		key := strings.SplitN(arg, "=", 2)[0]
+		if seen[key] {
+			return nil, fmt.Errorf("build arg %s is set both as a build arg and in the matrix", key)
+		}
+	}
+	var ret []*Collection
+	for _, combination := range combinations {
+		c, err := ParseCommandLineBuildArgs(append(combination, args...), dotEnvMap)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, c)
+	}
+	return ret, nil
+}
+
 // Get returns a variable by name.
 func (c *Collection) Get(name string) (Variable, bool, bool) {
 	variable, found := c.variables[name]
@@ -79,8 +128,9 @@ func (c *Collection) Get(name string) (Variable, bool, bool) {
 	return variable, active, found
 }
 
-// Expand expands constant build args within the given word.
-func (c *Collection) Expand(word string) string {
+// Expand expands constant build args within the given word. A literal $ can be
+// obtained by escaping it as \$ or by single-quoting it.
+func (c *Collection) Expand(word string) (string, error) {
 	shlex := dfShell.NewLex('\\')
 	argsMap := make(map[string]string)
 	for varName := range c.activeVariables {
@@ -92,10 +142,9 @@ func (c *Collection) Expand(word string) string {
 	}
 	ret, err := shlex.ProcessWordWithMap(word, argsMap)
 	if err != nil {
-		// No effect if there is an error.
-		return word
+		return "", errors.Wrapf(err, "expand %s", word)
 	}
-	return ret
+	return ret, nil
 }
 
 // AsMap returns the constant variables (active and inactive) as a map.
@@ -163,9 +212,14 @@ func (c *Collection) WithResetEnvVars() *Collection {
 	return ret
 }
 
+// BuiltinArgsProvider computes additional builtin args for a target, at conversion time.
+// The gitMeta is nil if no git metadata is available for the target.
+type BuiltinArgsProvider func(target domain.Target, gitMeta *buildcontext.GitMetadata) (map[string]string, error)
+
 // WithBuiltinBuildArgs returns a new collection containing the current variables together with
-// builtin args. This operation does not modify the current collection.
-func (c *Collection) WithBuiltinBuildArgs(target domain.Target, gitMeta *buildcontext.GitMetadata) *Collection {
+// builtin args, including the ones computed by the given providers. The platform is the one
+// the target is built for. This operation does not modify the current collection.
+func (c *Collection) WithBuiltinBuildArgs(target domain.Target, platform specs.Platform, gitMeta *buildcontext.GitMetadata, buildTimestamp time.Time, providers []BuiltinArgsProvider) (*Collection, error) {
 	ret := NewCollection()
 	// Copy existing variables.
 	for k, v := range c.variables {
@@ -180,9 +234,22 @@ func (c *Collection) WithBuiltinBuildArgs(target domain.Target, gitMeta *buildco
 	ret.variables["EARTHLY_TARGET_NAME"] = NewConstant(target.Target)
 	ret.variables["EARTHLY_TARGET_TAG"] = NewConstant(target.Tag)
 	ret.variables["EARTHLY_TARGET_TAG_DOCKER"] = NewConstant(dockerTagSafe(target.Tag))
+	ret.variables["EARTHLY_BUILD_TIMESTAMP"] = NewConstant(strconv.FormatInt(buildTimestamp.Unix(), 10))
+	// The platform args, as in Dockerfiles, for cross-compiling from the native platform.
+	for name, value := range platformArgs("TARGET", platform) {
+		ret.variables[name] = NewConstant(value)
+	}
+	for name, value := range platformArgs("USER", platforms.DefaultSpec()) {
+		ret.variables[name] = NewConstant(value)
+	}
 
 	if gitMeta != nil {
 		ret.variables["EARTHLY_GIT_HASH"] = NewConstant(gitMeta.Hash)
+		shortHash := gitMeta.Hash
+		if len(shortHash) > shortHashLength {
+			shortHash = shortHash[:shortHashLength]
+		}
+		ret.variables["EARTHLY_GIT_SHORT_HASH"] = NewConstant(shortHash)
 		branch := ""
 		if len(gitMeta.Branch) > 0 {
 			branch = gitMeta.Branch[0]
@@ -196,9 +263,67 @@ func (c *Collection) WithBuiltinBuildArgs(target domain.Target, gitMeta *buildco
 		ret.variables["EARTHLY_GIT_ORIGIN_URL"] = NewConstant(gitMeta.RemoteURL)
 		ret.variables["EARTHLY_GIT_PROJECT_NAME"] = NewConstant(gitMeta.GitProject)
 	}
+
+	// Add the builtin build args of the providers.
+	provided := make(map[string]bool)
+	for _, provider := range providers {
+		args, err := provider(target, gitMeta)
+		if err != nil {
+			return nil, errors.Wrapf(err, "compute builtin args for %s", target.String())
+		}
+		for name, value := range args {
+			if strings.HasPrefix(name, "EARTHLY_") || isPlatformArg(name) || provided[name] {
+				return nil, fmt.Errorf("builtin arg %s is already defined", name)
+			}
+			provided[name] = true
+			ret.variables[name] = NewConstant(value)
+		}
+	}
+	return ret, nil
+}
+
+// WithTargetPlatform returns a copy of the current collection, with the builtin args
+// describing the target platform (TARGETPLATFORM, TARGETOS, TARGETARCH and TARGETVARIANT)
+// set as per the given platform. This operation does not modify the current collection.
+func (c *Collection) WithTargetPlatform(platform specs.Platform) *Collection {
+	ret := NewCollection()
+	for k, v := range c.variables {
+		ret.variables[k] = v
+	}
+	for k := range c.activeVariables {
+		ret.activeVariables[k] = true
+	}
+	for k := range c.overridingVariables {
+		ret.overridingVariables[k] = true
+	}
+	for name, value := range platformArgs("TARGET", platform) {
+		ret.variables[name] = NewConstant(value)
+	}
 	return ret
 }
 
+// platformArgs returns the builtin args describing a platform, normalized, such as
+// TARGETPLATFORM=linux/arm/v7, TARGETOS=linux, TARGETARCH=arm and TARGETVARIANT=v7 for
+// the prefix TARGET.
+func platformArgs(prefix string, platform specs.Platform) map[string]string {
+	platform = platforms.Normalize(platform)
+	return map[string]string{
+		prefix + "PLATFORM": platforms.Format(platform),
+		prefix + "OS":       platform.OS,
+		prefix + "ARCH":     platform.Architecture,
+		prefix + "VARIANT":  platform.Variant,
+	}
+}
+
+func isPlatformArg(name string) bool {
+	for _, prefix := range []string{"TARGET", "USER"} {
+		if _, found := platformArgs(prefix, specs.Platform{})[name]; found {
+			return true
+		}
+	}
+	return false
+}
+
 // WithParseBuildArgs takes in a slice of build args to be parsed and returns another collection
 // containing the current build args, together with the newly parsed build args. This operation does
 // not modify the current collection.
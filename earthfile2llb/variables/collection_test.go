@@ -1,6 +1,14 @@
 package variables
 
-import "testing"
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/earthly/earthly/buildcontext"
+	"github.com/earthly/earthly/domain"
+)
 
 func TestDockerTagSafe(t *testing.T) {
 	var tests = []struct {
@@ -28,3 +36,163 @@ func TestDockerTagSafe(t *testing.T) {
 		}
 	}
 }
+
+func TestExpand(t *testing.T) {
+	c := NewCollection()
+	c.AddActive("VERSION", NewConstant("1.2.3"), false)
+	var tests = []struct {
+		word     string
+		expanded string
+	}{
+		{"org/app:$VERSION", "org/app:1.2.3"},
+		{"dist/${VERSION}/out", "dist/1.2.3/out"},
+		{"${UNSET:-default}", "default"},
+		{"\\$VERSION", "$VERSION"},
+		{"'$VERSION'", "$VERSION"},
+		{"$(echo $VERSION)", "$(echo 1.2.3)"},
+	}
+	for _, tt := range tests {
+		ans, err := c.Expand(tt.word)
+		if err != nil {
+			t.Errorf("expand %s: %v", tt.word, err)
+			continue
+		}
+		if ans != tt.expanded {
+			t.Errorf("got %s, want %s", ans, tt.expanded)
+		}
+	}
+	_, err := c.Expand("${VERSION")
+	if err == nil {
+		t.Errorf("expected error for unterminated substitution")
+	}
+}
+
+func TestWithBuiltinBuildArgs(t *testing.T) {
+	target := domain.Target{LocalPath: ".", Target: "build", Tag: "john/work"}
+	gitMeta := &buildcontext.GitMetadata{
+		Hash:   "41cb5666ade67b29e42bef121144456d3977a67a",
+		Branch: []string{"john/work"},
+	}
+	c, err := NewCollection().WithBuiltinBuildArgs(
+		target, platforms.MustParse("linux/arm/v7"), gitMeta, time.Unix(1602755400, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"EARTHLY_TARGET_NAME":       "build",
+		"EARTHLY_TARGET_TAG_DOCKER": "john_work",
+		"EARTHLY_GIT_SHORT_HASH":    "41cb5666",
+		"EARTHLY_GIT_BRANCH":        "john/work",
+		"EARTHLY_BUILD_TIMESTAMP":   "1602755400",
+		"TARGETPLATFORM":            "linux/arm/v7",
+		"TARGETOS":                  "linux",
+		"TARGETARCH":                "arm",
+		"TARGETVARIANT":             "v7",
+		"USERPLATFORM":              platforms.Format(platforms.DefaultSpec()),
+	}
+	for name, value := range expected {
+		variable, _, found := c.Get(name)
+		if !found {
+			t.Errorf("builtin arg %s not found", name)
+			continue
+		}
+		if variable.ConstantValue() != value {
+			t.Errorf("%s: got %s, want %s", name, variable.ConstantValue(), value)
+		}
+	}
+}
+
+func TestWithTargetPlatform(t *testing.T) {
+	c, err := NewCollection().WithBuiltinBuildArgs(
+		domain.Target{LocalPath: ".", Target: "build"}, platforms.MustParse("linux/amd64"), nil,
+		time.Unix(1602755400, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arm := c.WithTargetPlatform(platforms.MustParse("linux/arm64"))
+	expected := map[string]string{
+		"TARGETPLATFORM": "linux/arm64",
+		"TARGETARCH":     "arm64",
+		"TARGETVARIANT":  "",
+		"EARTHLY_TARGET": "+build",
+	}
+	for name, value := range expected {
+		variable, _, found := arm.Get(name)
+		if !found {
+			t.Errorf("builtin arg %s not found", name)
+			continue
+		}
+		if variable.ConstantValue() != value {
+			t.Errorf("%s: got %s, want %s", name, variable.ConstantValue(), value)
+		}
+	}
+	variable, _, _ := c.Get("TARGETPLATFORM")
+	if variable.ConstantValue() != "linux/amd64" {
+		t.Errorf("the original collection was modified: %s", variable.ConstantValue())
+	}
+}
+
+func TestWithBuiltinBuildArgsProviders(t *testing.T) {
+	target := domain.Target{LocalPath: ".", Target: "build"}
+	ciProvider := func(target domain.Target, gitMeta *buildcontext.GitMetadata) (map[string]string, error) {
+		return map[string]string{"CI_JOB_ID": "42"}, nil
+	}
+	c, err := NewCollection().WithBuiltinBuildArgs(
+		target, platforms.DefaultSpec(), nil, time.Now(), []BuiltinArgsProvider{ciProvider})
+	if err != nil {
+		t.Fatal(err)
+	}
+	variable, _, found := c.Get("CI_JOB_ID")
+	if !found || variable.ConstantValue() != "42" {
+		t.Errorf("expected CI_JOB_ID=42, got %+v", variable)
+	}
+
+	conflictProvider := func(target domain.Target, gitMeta *buildcontext.GitMetadata) (map[string]string, error) {
+		return map[string]string{"EARTHLY_TARGET": "other"}, nil
+	}
+	_, err = NewCollection().WithBuiltinBuildArgs(
+		target, platforms.DefaultSpec(), nil, time.Now(), []BuiltinArgsProvider{conflictProvider})
+	if err == nil {
+		t.Errorf("expected error when overriding an earthly builtin arg")
+	}
+
+	platformProvider := func(target domain.Target, gitMeta *buildcontext.GitMetadata) (map[string]string, error) {
+		return map[string]string{"TARGETARCH": "arm64"}, nil
+	}
+	_, err = NewCollection().WithBuiltinBuildArgs(
+		target, platforms.DefaultSpec(), nil, time.Now(), []BuiltinArgsProvider{platformProvider})
+	if err == nil {
+		t.Errorf("expected error when overriding a platform builtin arg")
+	}
+}
+
+func TestParseCommandLineBuildArgMatrix(t *testing.T) {
+	matrix, err := ParseCommandLineBuildArgMatrix(
+		[]string{"GO=1.14,1.15", "OS=linux,darwin,windows"}, []string{"NAME=app"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matrix) != 6 {
+		t.Fatalf("expected 6 combinations, got %d", len(matrix))
+	}
+	var combinations []string
+	for _, c := range matrix {
+		var values []string
+		for _, key := range []string{"GO", "OS", "NAME"} {
+			v, _, _ := c.Get(key)
+			values = append(values, v.ConstantValue())
+		}
+		combinations = append(combinations, strings.Join(values, " "))
+	}
+	expected := "1.14 linux app,1.14 darwin app,1.14 windows app,1.15 linux app,1.15 darwin app,1.15 windows app"
+	if strings.Join(combinations, ",") != expected {
+		t.Errorf("unexpected combinations %v", combinations)
+	}
+
+	for _, invalid := range [][]string{{"GO"}, {"=1"}, {"GO=1", "GO=2"}, {"NAME=a,b"}} {
+		_, err := ParseCommandLineBuildArgMatrix(invalid, []string{"NAME=app"}, nil)
+		if err == nil {
+			t.Errorf("expected an error for the matrix %v", invalid)
+		}
+	}
+}
@@ -5,21 +5,27 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
-	"io/ioutil"
-	"os"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/earthly/earthly/dockertar"
 	"github.com/earthly/earthly/domain"
 	"github.com/earthly/earthly/earthfile2llb/dedup"
-	"github.com/earthly/earthly/llbutil"
 	"github.com/earthly/earthly/logging"
 	"github.com/moby/buildkit/client/llb"
 	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
 )
 
-const dockerdWrapperPath = "/var/earthly/dockerd-wrapper.sh"
+const (
+	dockerdWrapperPath = "/var/earthly/dockerd-wrapper.sh"
+	dockerdCachePath   = "/var/earthly/dind-cache"
+)
+
+// DefaultWaitTimeout is the default maximum time to wait for the compose services of
+// WITH DOCKER to become healthy.
+const DefaultWaitTimeout = 60 * time.Second
 
 // DockerLoadOpt holds parameters for DOCKER LOAD commands.
 type DockerLoadOpt struct {
@@ -36,25 +42,84 @@ type WithDockerOpt struct {
 	WithEntrypoint bool
 	Pulls          []string
 	Loads          []DockerLoadOpt
+	// ComposeFiles are the docker-compose files to bring up before the RUN.
+	ComposeFiles []string
+	// ComposeServices are the services to bring up. If empty, all services are used.
+	ComposeServices []string
+	// CacheDataRoot persists the docker daemon data root (and thus any pulled image
+	// layers) in a cache mount, across builds of the same target.
+	CacheDataRoot bool
+	// Runtime is the container runtime started within WITH DOCKER. One of
+	// WithDockerRuntimes.
+	Runtime string
+	// WaitHealthy causes the RUN to only start once the containers of the
+	// ComposeServices are running and healthy.
+	WaitHealthy bool
+	// WaitTimeout is the maximum time to wait for the compose services to become
+	// healthy.
+	WaitTimeout time.Duration
+	// ExtraHosts are /etc/hosts entries, of the form <host>:<ip>, added to the RUN.
+	ExtraHosts []string
+	// Resources limit the daemon, its containers and the RUN, together.
+	Resources Resources
+}
+
+const (
+	// WithDockerRuntimeDocker runs dockerd within WITH DOCKER.
+	WithDockerRuntimeDocker = "docker"
+	// WithDockerRuntimePodman runs podman (serving the docker API) within WITH DOCKER.
+	WithDockerRuntimePodman = "podman"
+	// WithDockerRuntimeNerdctl runs containerd, used via nerdctl, within WITH DOCKER.
+	WithDockerRuntimeNerdctl = "nerdctl"
+)
+
+// WithDockerRuntimes lists the container runtimes supported in WITH DOCKER.
+var WithDockerRuntimes = []string{WithDockerRuntimeDocker, WithDockerRuntimePodman, WithDockerRuntimeNerdctl}
+
+// ValidateWithDockerRuntime returns an error if the runtime is not supported.
+func ValidateWithDockerRuntime(runtime string) error {
+	for _, r := range WithDockerRuntimes {
+		if r == runtime {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid runtime %s. Supported runtimes: %s", runtime, strings.Join(WithDockerRuntimes, ", "))
 }
 
 type withDockerRun struct {
-	c        *Converter
-	tarLoads []llb.State
+	c *Converter
+	// loads are the images loaded, served as docker tars via sockets.
+	loads []dockerLoad
+	// registryPulls are entries of the form <pull-ref>=<docker-tag>, for images
+	// pulled from the embedded registry.
+	registryPulls []string
 }
 
 func (wdr *withDockerRun) Run(ctx context.Context, args []string, opt WithDockerOpt) error {
+	err := wdr.c.checkMounts("WITH DOCKER", opt.Mounts)
+	if err != nil {
+		return err
+	}
+	// Convert all pulls and loads first (this is not thread-safe), then solve the
+	// resulting images concurrently.
+	var solves []imageSolve
 	for _, pullImageName := range opt.Pulls {
-		err := wdr.pull(ctx, pullImageName)
+		is, err := wdr.pull(ctx, pullImageName)
 		if err != nil {
 			return errors.Wrap(err, "pull")
 		}
+		solves = append(solves, is)
 	}
 	for _, loadOpt := range opt.Loads {
-		err := wdr.load(ctx, loadOpt)
+		is, err := wdr.load(ctx, loadOpt)
 		if err != nil {
 			return errors.Wrap(err, "load")
 		}
+		solves = append(solves, is)
+	}
+	err = wdr.solveImages(ctx, solves)
+	if err != nil {
+		return err
 	}
 	logging.GetLogger(ctx).
 		With("args", args).
@@ -75,16 +140,27 @@ func (wdr *withDockerRun) Run(ctx context.Context, args []string, opt WithDocker
 		"/var/earthly/dind", llb.Scratch(), llb.HostBind(), llb.SourcePath("/tmp/earthly/dind")))
 	runOpts = append(runOpts, llb.AddMount(
 		dockerdWrapperPath, llb.Scratch(), llb.HostBind(), llb.SourcePath(dockerdWrapperPath)))
+	if opt.CacheDataRoot {
+		key, err := cacheKeyTargetInput(wdr.c.mts.FinalStates.TargetInput)
+		if err != nil {
+			return err
+		}
+		// The cache is locked, as only one docker daemon may use a data root at a time.
+		cachePath := path.Join("/run/cache", key, "with-docker-data-root")
+		runOpts = append(runOpts, llb.AddMount(
+			dockerdCachePath, wdr.c.cacheContext,
+			llb.AsPersistentCacheDir(cachePath, llb.CacheMountLocked)))
+	}
 	// This seems to make earthly-in-earthly work
 	// (and docker run --privileged, together with -v /sys/fs/cgroup:/sys/fs/cgroup),
 	// however, it breaks regular cases.
 	//runOpts = append(runOpts, llb.AddMount(
 	//"/sys/fs/cgroup", llb.Scratch(), llb.HostBind(), llb.SourcePath("/sys/fs/cgroup")))
-	var tarPaths []string
-	for index, tarContext := range wdr.tarLoads {
-		loadDir := fmt.Sprintf("/var/earthly/load-%d", index)
-		runOpts = append(runOpts, llb.AddMount(loadDir, tarContext, llb.Readonly))
-		tarPaths = append(tarPaths, path.Join(loadDir, "image.tar"))
+	var socketPaths []string
+	for index, load := range wdr.loads {
+		socketPath := fmt.Sprintf("/var/earthly/load-%d.sock", index)
+		runOpts = append(runOpts, load.runOpts(socketPath, fmt.Sprintf("/var/earthly/load-%d", index))...)
+		socketPaths = append(socketPaths, socketPath)
 	}
 
 	finalArgs := args
@@ -97,9 +173,48 @@ func (wdr *withDockerRun) Run(ctx context.Context, args []string, opt WithDocker
 		finalArgs = append(wdr.c.mts.FinalStates.SideEffectsImage.Config.Entrypoint, args...)
 		opt.WithShell = false // Don't use shell when --entrypoint is passed.
 	}
+	for _, extraHostStr := range opt.ExtraHosts {
+		host, ip, err := parseExtraHost(extraHostStr)
+		if err != nil {
+			return err
+		}
+		runOpts = append(runOpts, llb.AddExtraHost(host, ip))
+	}
+	err = wdr.c.checkCapabilities([]string{allCapabilities}, "WITH DOCKER")
+	if err != nil {
+		return errors.Wrap(err, "WITH DOCKER")
+	}
 	runOpts = append(runOpts, llb.Security(llb.SecurityModeInsecure))
+	var composeStr string
+	for _, cf := range opt.ComposeFiles {
+		composeStr += fmt.Sprintf("--compose %s ", cf)
+	}
+	for _, cs := range opt.ComposeServices {
+		composeStr += fmt.Sprintf("--service %s ", cs)
+	}
+	for _, eh := range opt.ExtraHosts {
+		composeStr += fmt.Sprintf("--add-host %s ", eh)
+	}
+	if opt.CacheDataRoot {
+		composeStr += "--cache-data-root "
+	}
+	if len(opt.ComposeFiles) != 0 {
+		if !opt.WaitHealthy {
+			composeStr += "--no-wait-healthy "
+		} else if opt.WaitTimeout != DefaultWaitTimeout {
+			composeStr += fmt.Sprintf("--wait-timeout %s ", opt.WaitTimeout)
+		}
+	}
+	if opt.Runtime != "" && opt.Runtime != WithDockerRuntimeDocker {
+		composeStr += fmt.Sprintf("--runtime %s ", opt.Runtime)
+	}
+	if opt.Resources != (Resources{}) {
+		composeStr += fmt.Sprintf("%s ", opt.Resources)
+	}
+	opt.Resources = opt.Resources.withDefaults(wdr.c.defaultResources)
 	runStr := fmt.Sprintf(
-		"WITH DOCKER RUN %s%s",
+		"WITH DOCKER %sRUN %s%s",
+		composeStr,
 		strIf(opt.WithEntrypoint, "--entrypoint "),
 		strings.Join(finalArgs, " "))
 	runOpts = append(runOpts, llb.WithCustomNamef("%s%s", wdr.c.vertexPrefix(), runStr))
@@ -107,18 +222,44 @@ func (wdr *withDockerRun) Run(ctx context.Context, args []string, opt WithDocker
 	if err != nil {
 		return errors.Wrap(err, "compute dind id")
 	}
-	shellWrap := makeWithDockerdWrapFun(dindID, tarPaths)
-	return wdr.c.internalRun(ctx, finalArgs, opt.Secrets, opt.WithShell, shellWrap, false, false, runStr, runOpts...)
+	shellWrap := makeWithDockerdWrapFun(dindID, socketPaths, wdr.registryPulls, opt)
+	return wdr.c.internalRun(ctx, finalArgs, opt.Secrets, opt.WithShell, shellWrap, false, nil, runStr, runOpts...)
+}
+
+// dockerLoad is an image loaded into docker from within a RUN, served as a docker tar
+// via the socket of the given ID.
+type dockerLoad struct {
+	socketID string
+	state    llb.State
+}
+
+// runOpts returns the options of the RUN loading the image, which reads the docker tar
+// from socketPath. The socket ID changes whenever the definition or the config of the
+// image does, and the image is mounted read-only at mountPath, such that the RUN is
+// re-executed whenever the image changes, even if only the build contexts it is built
+// from do. The mount also has the image built before the RUN reads the socket.
+func (dl dockerLoad) runOpts(socketPath string, mountPath string) []llb.RunOption {
+	return []llb.RunOption{
+		llb.AddSSHSocket(llb.SSHID(dl.socketID), llb.SSHSocketTarget(socketPath)),
+		llb.AddMount(mountPath, dl.state, llb.Readonly),
+	}
 }
 
-func (wdr *withDockerRun) pull(ctx context.Context, dockerTag string) error {
+// imageSolve is an image which needs to be made available within WITH DOCKER.
+type imageSolve struct {
+	mts       *MultiTargetStates
+	opName    string
+	dockerTag string
+}
+
+func (wdr *withDockerRun) pull(ctx context.Context, dockerTag string) (imageSolve, error) {
 	logging.GetLogger(ctx).With("dockerTag", dockerTag).Info("Applying DOCKER PULL")
 	state, image, _, err := wdr.c.internalFromClassical(
-		ctx, dockerTag,
+		ctx, dockerTag, wdr.c.platform, false,
 		llb.WithCustomNamef("%sDOCKER PULL %s", wdr.c.imageVertexPrefix(dockerTag), dockerTag),
 	)
 	if err != nil {
-		return err
+		return imageSolve{}, err
 	}
 	mts := &MultiTargetStates{
 		FinalStates: &SingleTargetStates{
@@ -136,80 +277,156 @@ func (wdr *withDockerRun) pull(ctx context.Context, dockerTag string) error {
 			},
 		},
 	}
-	return wdr.solveImage(
-		ctx, mts, dockerTag, dockerTag,
-		llb.WithCustomNamef("%sDOCKER LOAD (PULL %s)", wdr.c.imageVertexPrefix(dockerTag), dockerTag))
+	return imageSolve{
+		mts:       mts,
+		opName:    dockerTag,
+		dockerTag: dockerTag,
+	}, nil
 }
 
-func (wdr *withDockerRun) load(ctx context.Context, opt DockerLoadOpt) error {
+func (wdr *withDockerRun) load(ctx context.Context, opt DockerLoadOpt) (imageSolve, error) {
 	logging.GetLogger(ctx).With("target-name", opt.Target).With("dockerTag", opt.ImageName).Info("Applying DOCKER LOAD")
 	depTarget, err := domain.ParseTarget(opt.Target)
 	if err != nil {
-		return errors.Wrapf(err, "parse target %s", opt.Target)
+		return imageSolve{}, errors.Wrapf(err, "parse target %s", opt.Target)
 	}
 	mts, err := wdr.c.Build(ctx, depTarget.String(), opt.BuildArgs)
 	if err != nil {
-		return err
+		return imageSolve{}, err
 	}
-	return wdr.solveImage(
-		ctx, mts, depTarget.String(), opt.ImageName,
-		llb.WithCustomNamef(
-			"%sDOCKER LOAD %s %s", wdr.c.imageVertexPrefix(depTarget.String()), depTarget.String(), opt.ImageName))
+	return imageSolve{
+		mts:       mts,
+		opName:    depTarget.String(),
+		dockerTag: opt.ImageName,
+	}, nil
 }
 
-func (wdr *withDockerRun) solveImage(ctx context.Context, mts *MultiTargetStates, opName string, dockerTag string, opts ...llb.RunOption) error {
-	solveID, err := mts.FinalStates.TargetInput.Hash()
+// solveImages solves the given images concurrently. Identical images (same target
+// input and docker tag) are only solved once, including across WITH DOCKER blocks
+// of the same build.
+func (wdr *withDockerRun) solveImages(ctx context.Context, solves []imageSolve) error {
+	solveIDs := make([]string, len(solves))
+	results := make([]imageSolveResult, len(solves))
+	found := make([]bool, len(solves))
+	firstIndex := make(map[string]int)
+	eg, egCtx := errgroup.WithContext(ctx)
+	for index, is := range solves {
+		solveID, err := is.mts.FinalStates.TargetInput.Hash()
+		if err != nil {
+			return errors.Wrap(err, "target input hash")
+		}
+		solveIDs[index] = solveID
+		key := imageSolveKey(solveID, is.dockerTag)
+		results[index], found[index] = wdr.cachedImageSolve(solveID, key)
+		if found[index] {
+			continue
+		}
+		if _, inFlight := firstIndex[key]; inFlight {
+			continue
+		}
+		firstIndex[key] = index
+		index, is := index, is
+		eg.Go(func() error {
+			var err error
+			results[index], err = wdr.solveImage(egCtx, is, solveID, key)
+			return err
+		})
+	}
+	err := eg.Wait()
 	if err != nil {
-		return errors.Wrap(err, "target input hash")
+		return err
 	}
-	tarContext, found := wdr.c.solveCache[solveID]
-	if found {
-		wdr.tarLoads = append(wdr.tarLoads, tarContext)
-		return nil
+	// Record results in order, such that the resulting RUN is deterministic.
+	for index, is := range solves {
+		key := imageSolveKey(solveIDs[index], is.dockerTag)
+		if !found[index] {
+			results[index] = results[firstIndex[key]]
+			wdr.cacheImageSolve(solveIDs[index], key, is.mts, results[index])
+		}
+		if results[index].pullRef != "" {
+			// The pull ref contains the image digest. As it ends up in the command of the
+			// RUN, the RUN is re-executed whenever the image changes.
+			wdr.registryPulls = append(
+				wdr.registryPulls, fmt.Sprintf("%s=%s", results[index].pullRef, is.dockerTag))
+		} else {
+			saveImage, _ := is.mts.FinalStates.LastSaveImage()
+			wdr.loads = append(wdr.loads, dockerLoad{socketID: results[index].socketID, state: saveImage.State})
+		}
 	}
-	// Use a builder to create docker .tar file, mount it via a local build context,
-	// then docker load it within the current side effects state.
-	outDir, err := ioutil.TempDir("/tmp", "earthly-docker-load")
-	if err != nil {
-		return errors.Wrap(err, "mk temp dir for docker load")
+	return nil
+}
+
+// imageSolveResult is the outcome of solving an image. Either socketID or pullRef is set.
+type imageSolveResult struct {
+	socketID string
+	pullRef  string
+}
+
+func imageSolveKey(solveID string, dockerTag string) string {
+	digest := sha256.Sum256([]byte(fmt.Sprintf("%s-%s", solveID, dockerTag)))
+	return hex.EncodeToString(digest[:])
+}
+
+func (wdr *withDockerRun) cachedImageSolve(solveID string, key string) (imageSolveResult, bool) {
+	if wdr.c.registryBuilderFun != nil {
+		entry, found := wdr.c.solveCache.pullRefs[solveID]
+		return imageSolveResult{pullRef: entry.pullRef}, found
 	}
-	wdr.c.cleanCollection.Add(func() error {
-		return os.RemoveAll(outDir)
-	})
-	outFile := path.Join(outDir, "image.tar")
-	err = wdr.c.dockerBuilderFun(ctx, mts, dockerTag, outFile)
-	if err != nil {
-		return errors.Wrapf(err, "build target %s for docker load", opName)
+	entry, found := wdr.c.solveCache.loadSockets[key]
+	return imageSolveResult{socketID: entry.socketID}, found
+}
+
+func (wdr *withDockerRun) cacheImageSolve(solveID string, key string, mts *MultiTargetStates, result imageSolveResult) {
+	localPaths := localPathsOf(mts)
+	if result.pullRef != "" {
+		wdr.c.solveCache.pullRefs[solveID] = cachedPullRef{pullRef: result.pullRef, localPaths: localPaths}
+		return
 	}
-	dockerImageID, err := dockertar.GetID(outFile)
+	wdr.c.solveCache.loadSockets[key] = cachedLoadSocket{socketID: result.socketID, localPaths: localPaths}
+}
+
+func (wdr *withDockerRun) solveImage(ctx context.Context, is imageSolve, solveID string, key string) (imageSolveResult, error) {
+	if wdr.c.registryBuilderFun != nil {
+		// The repository is named after the target input hash, such that the same
+		// target invoked with different build args does not share a repository.
+		pullRef, err := wdr.c.registryBuilderFun(ctx, is.mts, fmt.Sprintf("earthly-with-docker/%s", solveID))
+		if err != nil {
+			return imageSolveResult{}, errors.Wrapf(err, "build target %s for embedded registry", is.opName)
+		}
+		return imageSolveResult{pullRef: pullRef}, nil
+	}
+	if wdr.c.dockerBuilderFun == nil {
+		return imageSolveResult{}, errors.New("WITH DOCKER --load and --pull are not supported by this build")
+	}
+	// The image is streamed into docker load, via the socket, from within the RUN.
+	socketID, err := wdr.c.dockerBuilderFun(ctx, is.mts, is.dockerTag)
 	if err != nil {
-		return errors.Wrap(err, "inspect docker tar after build")
-	}
-	// Use the docker image ID + dockerTag as sessionID. This will cause
-	// buildkit to use cache when these are the same as before (eg a docker image
-	// that is identical as before).
-	sessionIDKey := fmt.Sprintf("%s-%s", dockerTag, dockerImageID)
-	sha256SessionIDKey := sha256.Sum256([]byte(sessionIDKey))
-	sessionID := hex.EncodeToString(sha256SessionIDKey[:])
-	// Add the tar to the local context.
-	tarContext = llb.Local(
-		solveID,
-		llb.SharedKeyHint(opName),
-		llb.SessionID(sessionID),
-		llb.Platform(llbutil.TargetPlatform),
-		llb.WithCustomNamef("[internal] docker tar context %s %s", opName, sessionID),
-	)
-	wdr.tarLoads = append(wdr.tarLoads, tarContext)
-	wdr.c.mts.FinalStates.LocalDirs[solveID] = outDir
-	wdr.c.solveCache[solveID] = tarContext
-	return nil
+		return imageSolveResult{}, errors.Wrapf(err, "build target %s for docker load", is.opName)
+	}
+	return imageSolveResult{socketID: socketID}, nil
 }
 
-func makeWithDockerdWrapFun(dindID string, tarPaths []string) shellWrapFun {
+func makeWithDockerdWrapFun(dindID string, socketPaths []string, registryPulls []string, opt WithDockerOpt) shellWrapFun {
 	dockerRoot := path.Join("/var/earthly/dind", dindID)
+	if opt.CacheDataRoot {
+		dockerRoot = path.Join(dockerdCachePath, "data-root")
+	}
 	params := []string{
-		fmt.Sprintf("EARTHLY_DOCKERD_DATA_ROOT=\"%s\"", dockerRoot),
-		fmt.Sprintf("EARTHLY_DOCKER_LOAD_IMAGES=\"%s\"", strings.Join(tarPaths, " ")),
+		shellEnvVar("EARTHLY_DOCKERD_DATA_ROOT", dockerRoot),
+		shellEnvVar("EARTHLY_DOCKERD_CACHE_DATA_ROOT", strIf(opt.CacheDataRoot, "true")),
+		shellEnvVar("EARTHLY_DOCKERD_RUNTIME", opt.Runtime),
+		shellEnvVar("EARTHLY_WAIT_HEALTHY", strIf(opt.WaitHealthy, "true")),
+		shellEnvVar("EARTHLY_WAIT_HEALTHY_TIMEOUT", strconv.Itoa(int(opt.WaitTimeout.Seconds()))),
+		shellEnvVar("EARTHLY_DOCKER_LOAD_SOCKETS", strings.Join(socketPaths, " ")),
+		shellEnvVar("EARTHLY_DOCKER_PULL_IMAGES", strings.Join(registryPulls, " ")),
+		shellEnvVar("EARTHLY_COMPOSE_FILES", strings.Join(opt.ComposeFiles, " ")),
+		shellEnvVar("EARTHLY_COMPOSE_SERVICES", strings.Join(opt.ComposeServices, " ")),
+	}
+	if opt.Resources.CPUs > 0 {
+		params = append(params, shellEnvVar("EARTHLY_DOCKERD_CPU_QUOTA", strconv.Itoa(int(opt.Resources.CPUs*100000))))
+	}
+	if opt.Resources.Memory > 0 {
+		params = append(params, shellEnvVar("EARTHLY_DOCKERD_MEMORY", strconv.FormatInt(opt.Resources.Memory, 10)))
 	}
 	return func(args []string, envVars []string, isWithShell bool, withDebugger bool) []string {
 		return []string{
@@ -0,0 +1,121 @@
+// Package errcode categorizes the errors of builds, such that CI wrappers can tell
+// infrastructure errors from build failures. Each category has a stable code, surfaced
+// in the JSON output and the build summary, and an exit code.
+package errcode
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// Category is the category of an error. Its value is the stable code of the category.
+type Category string
+
+const (
+	// Unknown is the category of uncategorized errors.
+	Unknown Category = "unknown"
+	// Canceled is the category of builds canceled, eg via Ctrl+C.
+	Canceled Category = "canceled"
+	// Parse is the category of errors in Earthfiles, such as syntax errors or invalid
+	// commands.
+	Parse Category = "parse"
+	// ContextResolution is the category of errors resolving the inputs of a build, such
+	// as build contexts, remote repositories and base images.
+	ContextResolution Category = "context-resolution"
+	// ExecFailure is the category of commands of the build which failed.
+	ExecFailure Category = "exec-failure"
+	// PushFailure is the category of pushes of images which failed.
+	PushFailure Category = "push-failure"
+	// CacheError is the category of errors importing or exporting the cache.
+	CacheError Category = "cache-error"
+	// PolicyViolation is the category of builds rejected by the build policy, before
+	// being executed.
+	PolicyViolation Category = "policy-violation"
+)
+
+// ExitCode returns the exit code of earth for errors of the category. Exec failures
+// and uncategorized errors exit with 1, as all errors used to.
+func (c Category) ExitCode() int {
+	switch c {
+	case Canceled:
+		return 2
+	case Parse:
+		return 3
+	case ContextResolution:
+		return 4
+	case PushFailure:
+		return 5
+	case CacheError:
+		return 6
+	case PolicyViolation:
+		return 7
+	default:
+		return 1
+	}
+}
+
+// Categorized is implemented by the error types of earth which have a category of
+// their own.
+type Categorized interface {
+	error
+	ErrorCategory() Category
+}
+
+// Error is an error with a category.
+type Error struct {
+	Category Category
+	Err      error
+}
+
+// Error implements error. The category is not part of the message.
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// ErrorCategory implements Categorized.
+func (e *Error) ErrorCategory() Category {
+	return e.Category
+}
+
+// Cause returns the underlying error, for errors.Cause.
+func (e *Error) Cause() error {
+	return e.Err
+}
+
+// Unwrap returns the underlying error, for errors.Is and errors.As.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Wrap returns err with the given category. It returns nil if err is nil.
+func Wrap(err error, category Category) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Category: category, Err: err}
+}
+
+// CategoryOf returns the category of err. Errors caused by context.Canceled are
+// Canceled. When err has several categories, such as a push failure wrapped by a parse
+// error of the target which triggered it, the one closest to the cause of err wins.
+func CategoryOf(err error) Category {
+	if errors.Is(err, context.Canceled) {
+		return Canceled
+	}
+	category := Unknown
+	for e := err; e != nil; {
+		if ce, ok := e.(Categorized); ok {
+			category = ce.ErrorCategory()
+		}
+		switch u := e.(type) {
+		case interface{ Cause() error }:
+			e = u.Cause()
+		case interface{ Unwrap() error }:
+			e = u.Unwrap()
+		default:
+			e = nil
+		}
+	}
+	return category
+}
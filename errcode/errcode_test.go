@@ -0,0 +1,59 @@
+package errcode
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestCategoryOf(t *testing.T) {
+	push := Wrap(errors.New("push failed"), PushFailure)
+	tests := []struct {
+		name     string
+		err      error
+		expected Category
+	}{
+		{"uncategorized", errors.New("boom"), Unknown},
+		{"categorized", Wrap(errors.New("syntax error"), Parse), Parse},
+		{"wrapped", errors.Wrap(Wrap(errors.New("no such repo"), ContextResolution), "resolve"), ContextResolution},
+		{"innermost", Wrap(errors.Wrap(push, "apply build +push"), Parse), PushFailure},
+		{"fmt wrapped", fmt.Errorf("build: %w", push), PushFailure},
+		{"canceled", errors.Wrap(context.Canceled, "solve"), Canceled},
+		{"canceled categorized", Wrap(errors.Wrap(context.Canceled, "solve"), ExecFailure), Canceled},
+	}
+	for _, tt := range tests {
+		actual := CategoryOf(tt.err)
+		if actual != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.expected, actual)
+		}
+	}
+}
+
+func TestWrap(t *testing.T) {
+	if Wrap(nil, Parse) != nil {
+		t.Error("expected nil")
+	}
+	err := Wrap(errors.New("boom"), ExecFailure)
+	if err.Error() != "boom" {
+		t.Errorf("unexpected message %q", err.Error())
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	codes := make(map[int]Category)
+	for _, c := range []Category{Canceled, Parse, ContextResolution, PushFailure, CacheError, PolicyViolation} {
+		code := c.ExitCode()
+		if code <= 1 {
+			t.Errorf("expected a distinct exit code for %s, got %d", c, code)
+		}
+		if other, found := codes[code]; found {
+			t.Errorf("%s and %s have the same exit code %d", c, other, code)
+		}
+		codes[code] = c
+	}
+	if ExecFailure.ExitCode() != 1 || Unknown.ExitCode() != 1 {
+		t.Error("expected exec failures and unknown errors to exit with 1")
+	}
+}
@@ -0,0 +1,190 @@
+package eventstream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/earthly/earthly/conslogging"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxHistory is the number of events kept for replaying to subscribers which
+	// connect after the build has started.
+	maxHistory = 10000
+	// subscriberBufferSize is the number of events buffered for each subscriber.
+	// Events are dropped for subscribers which cannot keep up.
+	subscriberBufferSize = 1024
+	// shutdownTimeout is the time given to subscribers to receive the remaining
+	// events, when the server is closed.
+	shutdownTimeout = 2 * time.Second
+)
+
+// Server streams the events of a build to subscribers over HTTP. Events are streamed
+// from GET /events as newline-delimited JSON or, if requested via the
+// Accept: text/event-stream header, as server-sent events. Subscribers first receive
+// the events emitted before they connected.
+type Server struct {
+	mu          sync.Mutex
+	history     []conslogging.Event
+	subscribers map[chan conslogging.Event]struct{}
+	closed      bool
+
+	srv *http.Server
+	ln  net.Listener
+}
+
+// New creates a new event stream server. Start needs to be called to serve
+// subscribers.
+func New() *Server {
+	s := &Server{
+		subscribers: make(map[chan conslogging.Event]struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", s.handleEvents)
+	s.srv = &http.Server{Handler: mux}
+	return s
+}
+
+// Start starts listening for subscribers on addr.
+func (s *Server) Start(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "listen on %s", addr)
+	}
+	s.ln = ln
+	go s.srv.Serve(ln)
+	return nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Event implements conslogging.EventSink.
+func (s *Server) Event(ev conslogging.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	if len(s.history) < maxHistory {
+		s.history = append(s.history, ev)
+	}
+	for ch := range s.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			// Slow subscriber. Drop the event rather than blocking the build.
+		}
+	}
+}
+
+// Close ends the streams of all subscribers, once they have received the remaining
+// events, and stops the server.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		for ch := range s.subscribers {
+			close(ch)
+		}
+	}
+	s.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := s.srv.Shutdown(ctx)
+	if err != nil {
+		return errors.Wrap(err, "shutdown event stream server")
+	}
+	return nil
+}
+
+func (s *Server) subscribe() ([]conslogging.Event, chan conslogging.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history := make([]conslogging.Event, len(s.history))
+	copy(history, s.history)
+	ch := make(chan conslogging.Event, subscriberBufferSize)
+	if s.closed {
+		close(ch)
+		return history, ch
+	}
+	s.subscribers[ch] = struct{}{}
+	return history, ch
+}
+
+func (s *Server) unsubscribe(ch chan conslogging.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, found := s.subscribers[ch]
+	if !found {
+		return
+	}
+	delete(s.subscribers, ch)
+	if !s.closed {
+		close(ch)
+	}
+}
+
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	isSSE := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if isSSE {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	history, ch := s.subscribe()
+	defer s.unsubscribe(ch)
+	write := func(ev conslogging.Event) error {
+		dt, err := json.Marshal(ev)
+		if err != nil {
+			return errors.Wrap(err, "marshal event")
+		}
+		if isSSE {
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, dt)
+		} else {
+			_, err = fmt.Fprintf(w, "%s\n", dt)
+		}
+		return err
+	}
+	for _, ev := range history {
+		err := write(ev)
+		if err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			err := write(ev)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
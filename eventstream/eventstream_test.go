@@ -0,0 +1,59 @@
+package eventstream
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/earthly/earthly/conslogging"
+)
+
+func TestServer(t *testing.T) {
+	s := New()
+	err := s.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Event(conslogging.Event{Type: conslogging.TargetStartedEvent, Target: "+build"})
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/events", s.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	// The event emitted before subscribing is replayed.
+	if !scanner.Scan() {
+		t.Fatalf("expected replayed event: %v", scanner.Err())
+	}
+	var ev conslogging.Event
+	err = json.Unmarshal(scanner.Bytes(), &ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Type != conslogging.TargetStartedEvent || ev.Target != "+build" {
+		t.Errorf("unexpected event %+v", ev)
+	}
+
+	s.Event(conslogging.Event{Type: conslogging.TargetCompletedEvent, Target: "+build"})
+	if !scanner.Scan() {
+		t.Fatalf("expected live event: %v", scanner.Err())
+	}
+	err = json.Unmarshal(scanner.Bytes(), &ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Type != conslogging.TargetCompletedEvent {
+		t.Errorf("unexpected event %+v", ev)
+	}
+
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scanner.Scan() {
+		t.Errorf("expected end of stream, got %s", scanner.Text())
+	}
+}
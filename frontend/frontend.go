@@ -0,0 +1,210 @@
+// Package frontend builds Earthfiles as a buildkit gateway frontend, such that they can
+// be built directly by buildctl or docker buildx, without the earth binary. The
+// Earthfile and the build context are read via the session of the buildkit client,
+// and the output of the target is returned to buildkit, which exports it as per the
+// exporter of the client (image, local dir, etc).
+package frontend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/earthly/earthly/buildcontext"
+	"github.com/earthly/earthly/cleanup"
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/earthly/earthly/earthfile2llb/variables"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/exporter/containerimage/exptypes"
+	gwclient "github.com/moby/buildkit/frontend/gateway/client"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// The frontend options are named as those of the Dockerfile frontend, where they
+// apply, such that docker buildx build --target, --build-arg, --platform and -f work
+// the same.
+const (
+	keyTarget           = "target"
+	keyFilename         = "filename"
+	keyBuildArgPrefix   = "build-arg:"
+	keyPlatform         = "platform"
+	keyNoCache          = "no-cache"
+	keyImageResolveMode = "image-resolve-mode"
+	keyOutput           = "output"
+)
+
+const (
+	// OutputImage outputs the image of the last SAVE IMAGE of the target.
+	OutputImage = "image"
+	// OutputArtifacts outputs the artifacts of the target (SAVE ARTIFACT), as a
+	// directory.
+	OutputArtifacts = "artifacts"
+)
+
+// Build converts the target of an Earthfile to LLB and solves it via the gateway
+// client c, as per the frontend options. The commands of the target, and those of the
+// targets it builds via BUILD, are executed. The result is the image of the last
+// SAVE IMAGE of the target, or its artifacts if it saves no image, or if the output
+// option is artifacts.
+//
+// The outputs the earth binary handles are not output: SAVE ARTIFACT AS LOCAL, SAVE
+// IMAGE tags and pushes, and RUN --push commands. Targets of remote repositories and
+// the commands building images in the middle of the build (WITH DOCKER --load and
+// --pull, DOCKER LOAD) are not supported.
+func Build(ctx context.Context, c gwclient.Client) (*gwclient.Result, error) {
+	opts := c.BuildOpts().Opts
+	target, err := parseTarget(opts[keyTarget])
+	if err != nil {
+		return nil, err
+	}
+	varCollection, err := variables.ParseCommandLineBuildArgs(buildArgs(opts), nil)
+	if err != nil {
+		return nil, err
+	}
+	platform, err := parsePlatform(opts[keyPlatform])
+	if err != nil {
+		return nil, err
+	}
+	resolveMode, err := parseResolveMode(opts[keyImageResolveMode])
+	if err != nil {
+		return nil, err
+	}
+	output := opts[keyOutput]
+	if output != "" && output != OutputImage && output != OutputArtifacts {
+		return nil, fmt.Errorf("invalid output %s: expected %s or %s", output, OutputImage, OutputArtifacts)
+	}
+	_, noCache := opts[keyNoCache]
+
+	resolver, err := buildcontext.NewGatewayResolver(c, opts[keyFilename])
+	if err != nil {
+		return nil, err
+	}
+	defer resolver.Close()
+	cleanCollection := cleanup.NewCollection()
+	defer cleanCollection.Close()
+	mts, err := earthfile2llb.Earthfile2LLB(ctx, target, earthfile2llb.ConvertOpt{
+		Resolver:         resolver,
+		ImageResolveMode: resolveMode,
+		CleanCollection:  cleanCollection,
+		VarCollection:    varCollection,
+		Platform:         platform,
+		MetaResolver:     c,
+	})
+	if err != nil {
+		return nil, err
+	}
+	states := mts.FinalStates
+
+	// Executing the side effects executes the commands of the targets built via BUILD
+	// too.
+	_, err = solve(ctx, c, states.SideEffectsState, noCache)
+	if err != nil {
+		return nil, errors.Wrap(err, "solve side effects")
+	}
+	saveImage, hasImage := states.LastSaveImage()
+	if output == OutputImage && !hasImage {
+		return nil, fmt.Errorf("target %s saves no image", target.String())
+	}
+	res := gwclient.NewResult()
+	if output == OutputArtifacts || !hasImage {
+		ref, err := solve(ctx, c, states.ArtifactsState, noCache)
+		if err != nil {
+			return nil, errors.Wrap(err, "solve artifacts")
+		}
+		res.SetRef(ref)
+		return res, nil
+	}
+	ref, err := solve(ctx, c, saveImage.State, noCache)
+	if err != nil {
+		return nil, errors.Wrap(err, "solve image")
+	}
+	imgJSON, err := json.Marshal(saveImage.Image)
+	if err != nil {
+		return nil, errors.Wrap(err, "image json marshal")
+	}
+	res.AddMeta(exptypes.ExporterImageConfigKey, imgJSON)
+	res.SetRef(ref)
+	return res, nil
+}
+
+func solve(ctx context.Context, c gwclient.Client, state llb.State, noCache bool) (gwclient.Reference, error) {
+	if noCache {
+		state = state.SetMarshalDefaults(llb.IgnoreCache)
+	}
+	def, err := state.Marshal(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal")
+	}
+	res, err := c.Solve(ctx, gwclient.SolveRequest{Definition: def.ToPB()})
+	if err != nil {
+		return nil, err
+	}
+	return res.SingleRef()
+}
+
+// parseTarget parses the target option, which is the name of a target of the
+// Earthfile (build, +build) or a target of another dir of the build context
+// (./sub+build).
+func parseTarget(s string) (domain.Target, error) {
+	if s == "" {
+		return domain.Target{}, errors.New("no target specified: set the target option (eg --opt target=+build)")
+	}
+	if !strings.Contains(s, "+") {
+		s = "+" + s
+	}
+	target, err := domain.ParseTarget(s)
+	if err != nil {
+		return domain.Target{}, err
+	}
+	if target.IsRemote() {
+		return domain.Target{}, fmt.Errorf("remote target %s is not supported by the buildkit frontend", s)
+	}
+	return target, nil
+}
+
+// buildArgs returns the build args of the options, as KEY=VALUE, sorted by key.
+func buildArgs(opts map[string]string) []string {
+	var args []string
+	for k, v := range opts {
+		if strings.HasPrefix(k, keyBuildArgPrefix) {
+			args = append(args, fmt.Sprintf("%s=%s", strings.TrimPrefix(k, keyBuildArgPrefix), v))
+		}
+	}
+	sort.Strings(args)
+	return args
+}
+
+// parsePlatform parses the platform option. The default platform of the build is
+// used if empty.
+func parsePlatform(s string) (*specs.Platform, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if strings.Contains(s, ",") {
+		return nil, fmt.Errorf("multiple platforms %s are not supported: build each platform separately", s)
+	}
+	p, err := platforms.Parse(s)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse platform %s", s)
+	}
+	p = platforms.Normalize(p)
+	return &p, nil
+}
+
+func parseResolveMode(s string) (llb.ResolveMode, error) {
+	switch s {
+	case "", "default":
+		return llb.ResolveModeDefault, nil
+	case "pull":
+		return llb.ResolveModeForcePull, nil
+	case "local":
+		return llb.ResolveModePreferLocal, nil
+	default:
+		return 0, fmt.Errorf("invalid image resolve mode %s: expected default, pull or local", s)
+	}
+}
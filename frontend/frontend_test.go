@@ -0,0 +1,204 @@
+package frontend
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/earthly/earthly/earthfile2llb/image"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/exporter/containerimage/exptypes"
+	gwclient "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/solver/pb"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	fstypes "github.com/tonistiigi/fsutil/types"
+)
+
+// fakeClient is a gateway client serving the files of the local dirs of the client
+// from memory. The solves of the local dirs return their files, and the other solves
+// return empty references.
+type fakeClient struct {
+	opts map[string]string
+	// locals holds the files of the local dirs, by local name and path.
+	locals map[string]map[string]string
+	// solved are the number of solves of definitions other than local dirs.
+	solved int
+}
+
+func (c *fakeClient) Solve(ctx context.Context, req gwclient.SolveRequest) (*gwclient.Result, error) {
+	res := gwclient.NewResult()
+	for _, dt := range req.Definition.Def {
+		var op pb.Op
+		err := op.Unmarshal(dt)
+		if err != nil {
+			return nil, err
+		}
+		src := op.GetSource()
+		if len(req.Definition.Def) == 2 && src != nil && strings.HasPrefix(src.Identifier, "local://") {
+			res.SetRef(&fakeRef{files: c.locals[strings.TrimPrefix(src.Identifier, "local://")]})
+			return res, nil
+		}
+	}
+	c.solved++
+	res.SetRef(&fakeRef{})
+	return res, nil
+}
+
+func (c *fakeClient) ResolveImageConfig(ctx context.Context, ref string, opt llb.ResolveImageConfigOpt) (digest.Digest, []byte, error) {
+	img := image.NewImage()
+	img.Config.Env = []string{"PATH=/usr/local/bin:/usr/bin:/bin"}
+	dt, err := json.Marshal(img)
+	if err != nil {
+		return "", nil, err
+	}
+	return digest.FromBytes(dt), dt, nil
+}
+
+func (c *fakeClient) BuildOpts() gwclient.BuildOpts {
+	return gwclient.BuildOpts{Opts: c.opts, SessionID: "session"}
+}
+
+func (c *fakeClient) Inputs(ctx context.Context) (map[string]llb.State, error) {
+	return nil, nil
+}
+
+type fakeRef struct {
+	files map[string]string
+}
+
+func (r *fakeRef) ToState() (llb.State, error) {
+	return llb.Scratch(), nil
+}
+
+func (r *fakeRef) ReadFile(ctx context.Context, req gwclient.ReadRequest) ([]byte, error) {
+	dt, found := r.files[req.Filename]
+	if !found {
+		return nil, errors.Wrapf(os.ErrNotExist, "read %s", req.Filename)
+	}
+	return []byte(dt), nil
+}
+
+func (r *fakeRef) StatFile(ctx context.Context, req gwclient.StatRequest) (*fstypes.Stat, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (r *fakeRef) ReadDir(ctx context.Context, req gwclient.ReadDirRequest) ([]*fstypes.Stat, error) {
+	return nil, errors.New("not implemented")
+}
+
+const testEarthfile = `FROM alpine:3.13
+WORKDIR /app
+
+build:
+    COPY main.go .
+    RUN go build -o app main.go
+    SAVE ARTIFACT app
+
+docker:
+    ARG MODE=dev
+    COPY +build/app .
+    COPY ./lib+lib/lib.so .
+    ENV MODE=$MODE
+    SAVE IMAGE app:latest
+`
+
+const testLibEarthfile = `FROM alpine:3.13
+
+lib:
+    RUN touch lib.so
+    SAVE ARTIFACT lib.so
+`
+
+func newFakeClient(opts map[string]string) *fakeClient {
+	return &fakeClient{
+		opts: opts,
+		locals: map[string]map[string]string{
+			"dockerfile": {"Earthfile": testEarthfile},
+			"context":    {"lib/Earthfile": testLibEarthfile, ".earthignore": "*.md\n"},
+		},
+	}
+}
+
+func TestBuildImage(t *testing.T) {
+	c := newFakeClient(map[string]string{"target": "+docker", "build-arg:MODE": "prod"})
+	res, err := Build(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Ref == nil {
+		t.Fatal("expected the image as the result")
+	}
+	var img image.Image
+	err = json.Unmarshal(res.Metadata[exptypes.ExporterImageConfigKey], &img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Config.WorkingDir != "/app" {
+		t.Errorf("expected workdir /app, got %s", img.Config.WorkingDir)
+	}
+	expectedEnv := []string{"PATH=/usr/local/bin:/usr/bin:/bin", "MODE=prod"}
+	if !reflect.DeepEqual(img.Config.Env, expectedEnv) {
+		t.Errorf("expected env %v, got %v", expectedEnv, img.Config.Env)
+	}
+	// The side effects, then the image.
+	if c.solved != 2 {
+		t.Errorf("expected 2 solves, got %d", c.solved)
+	}
+}
+
+func TestBuildArtifacts(t *testing.T) {
+	c := newFakeClient(map[string]string{"target": "build"})
+	res, err := Build(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Ref == nil || res.Metadata[exptypes.ExporterImageConfigKey] != nil {
+		t.Errorf("expected the artifacts as the result, got %+v", res)
+	}
+
+	c = newFakeClient(map[string]string{"target": "build", "output": "image"})
+	_, err = Build(context.Background(), c)
+	if err == nil || !strings.Contains(err.Error(), "saves no image") {
+		t.Errorf("expected an error for a target saving no image, got %v", err)
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	tests := []struct {
+		opts     map[string]string
+		expected string
+	}{
+		{map[string]string{}, "no target specified"},
+		{map[string]string{"target": "github.com/acme/lib+build"}, "remote target"},
+		{map[string]string{"target": "../other+build"}, "outside of the build context"},
+		{map[string]string{"target": "./missing+build"}, "No Earthfile nor build.earth"},
+		{map[string]string{"target": "build", "platform": "linux/amd64,linux/arm64"}, "multiple platforms"},
+		{map[string]string{"target": "build", "image-resolve-mode": "always"}, "invalid image resolve mode"},
+		{map[string]string{"target": "build", "output": "tar"}, "invalid output"},
+		{map[string]string{"target": "missing"}, "target missing not defined"},
+	}
+	for _, tt := range tests {
+		_, err := Build(context.Background(), newFakeClient(tt.opts))
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%v: expected an error containing %q, got %v", tt.opts, tt.expected, err)
+		}
+	}
+}
+
+func TestBuildArgs(t *testing.T) {
+	opts := map[string]string{
+		"target":          "build",
+		"build-arg:B":     "2",
+		"build-arg:A":     "1=1",
+		"build-arg:EMPTY": "",
+	}
+	expected := []string{"A=1=1", "B=2", "EMPTY="}
+	actual := buildArgs(opts)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
@@ -9,7 +9,10 @@ import (
 	"github.com/pkg/errors"
 )
 
-// CopyOp is a simplified llb copy operation.
+// CopyOp is a simplified llb copy operation. With allowWildcard, buildkit expands the
+// wildcards of the srcs via fsutil's ResolveWildcards, which walks the source dir
+// in lexical order, and copies the matches in that order. If several matches map to
+// the same destination (such as a dest which does not end with /), the last one wins.
 func CopyOp(srcState llb.State, srcs []string, destState llb.State, dest string, allowWildcard bool, isDir bool, chown string, opts ...llb.ConstraintsOpt) llb.State {
 	destAdjusted := dest
 	if dest == "." || dest == "" || strings.HasSuffix(dest, string(filepath.Separator)) {
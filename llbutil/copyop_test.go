@@ -0,0 +1,61 @@
+package llbutil
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	fscopy "github.com/tonistiigi/fsutil/copy"
+)
+
+// TestCopyWildcardOrder checks the order in which buildkit copies the matches of a
+// wildcard source of CopyOp, via the same functions as its file op backend.
+func TestCopyWildcardOrder(t *testing.T) {
+	src, err := ioutil.TempDir("", "earth-copy-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dest, err := ioutil.TempDir("", "earth-copy-dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	err = os.Mkdir(filepath.Join(src, "bin"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Created in non-lexical order.
+	for _, name := range []string{"b", "c", "a"} {
+		err = ioutil.WriteFile(filepath.Join(src, "bin", name), []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	matches, err := fscopy.ResolveWildcards(src, "/bin/*", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"bin/a", "bin/b", "bin/c"}
+	if !reflect.DeepEqual(matches, expected) {
+		t.Errorf("expected matches %v, got %v", expected, matches)
+	}
+	// A dest which does not end with / gets each match in turn.
+	for _, m := range matches {
+		err = fscopy.Copy(context.Background(), src, m, dest, "/usr/local/bin/app")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	dt, err := ioutil.ReadFile(filepath.Join(dest, "usr", "local", "bin", "app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dt) != "c" {
+		t.Errorf("expected the last match to win, got %s", dt)
+	}
+}
@@ -28,11 +28,8 @@ func Git(remote, ref string, opts ...llb.GitOption) llb.State {
 		id += "#" + ref
 	}
 
+	// Unlike llb.Git, the auth secrets are only set if requested via the options.
 	gi := &llb.GitInfo{}
-	// gi := &llb.GitInfo{
-	// 	AuthHeaderSecret: "GIT_AUTH_HEADER",
-	// 	AuthTokenSecret:  "GIT_AUTH_TOKEN",
-	// }
 	for _, o := range opts {
 		o.SetGitOption(gi)
 	}
@@ -45,14 +42,14 @@ func Git(remote, ref string, opts ...llb.GitOption) llb.State {
 		attrs[pb.AttrFullRemoteURL] = url
 		addCap(&gi.Constraints, pb.CapSourceGitFullURL)
 	}
-	// if gi.AuthTokenSecret != "" {
-	// 	attrs[pb.AttrAuthTokenSecret] = gi.AuthTokenSecret
-	// 	addCap(&gi.Constraints, pb.CapSourceGitHttpAuth)
-	// }
-	// if gi.AuthHeaderSecret != "" {
-	// 	attrs[pb.AttrAuthHeaderSecret] = gi.AuthHeaderSecret
-	// 	addCap(&gi.Constraints, pb.CapSourceGitHttpAuth)
-	// }
+	if gi.AuthTokenSecret != "" {
+		attrs[pb.AttrAuthTokenSecret] = gi.AuthTokenSecret
+		addCap(&gi.Constraints, pb.CapSourceGitHTTPAuth)
+	}
+	if gi.AuthHeaderSecret != "" {
+		attrs[pb.AttrAuthHeaderSecret] = gi.AuthHeaderSecret
+		addCap(&gi.Constraints, pb.CapSourceGitHTTPAuth)
+	}
 
 	addCap(&gi.Constraints, pb.CapSourceGit)
 
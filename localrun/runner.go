@@ -0,0 +1,136 @@
+// Package localrun executes the commands of the targets declared LOCALLY on the host,
+// rather than in containers. The shell the commands run in and the paths of the host
+// depend on the OS of the host: Linux (and other Unixes), macOS or Windows.
+package localrun
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	goosDarwin  = "darwin"
+	goosWindows = "windows"
+)
+
+// Runner executes commands on a host running a given OS.
+type Runner struct {
+	goos string
+}
+
+// NewRunner returns a runner for a host running the given OS, as per runtime.GOOS.
+func NewRunner(goos string) *Runner {
+	return &Runner{
+		goos: goos,
+	}
+}
+
+// ShellArgs returns the args executing the command via the shell of the host: sh on
+// Linux, zsh (the default shell of macOS, which tools such as codesign and xcrun are
+// documented with) on macOS and cmd on Windows.
+func (r *Runner) ShellArgs(command string) []string {
+	switch r.goos {
+	case goosWindows:
+		// /S keeps the quotes of the command as they are.
+		return []string{"cmd.exe", "/S", "/C", command}
+	case goosDarwin:
+		return []string{"/bin/zsh", "-c", command}
+	default:
+		return []string{"/bin/sh", "-c", command}
+	}
+}
+
+// Run executes the command in dir, a path of the host. The args are joined and
+// executed via the shell if withShell, or executed as they are otherwise. The env vars
+// (KEY=VALUE) are set in addition to those of earth. The output of the command, both
+// stdout and stderr, is written to out.
+func (r *Runner) Run(ctx context.Context, dir string, args []string, withShell bool, env []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("no command to run")
+	}
+	if withShell {
+		args = r.ShellArgs(strings.Join(args, " "))
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err := cmd.Run()
+	if err != nil {
+		return errors.Wrapf(err, "run %s on the host", strings.Join(args, " "))
+	}
+	return nil
+}
+
+// windowsVolumeRe matches the volume of an absolute Windows path, once slash-separated:
+// a drive (C:/) or a UNC share (//server/share).
+var windowsVolumeRe = regexp.MustCompile(`^([A-Za-z]:|//[^/]+/[^/]+)(/|$)`)
+
+// HostPath translates p, a slash-separated path of an Earthfile, to a path of the
+// host. A relative path is relative to dir, a path of the host. On Windows, a path
+// starting with / is relative to the volume of dir, and a path may start with a drive
+// (C:/tools).
+func (r *Runner) HostPath(dir string, p string) string {
+	if r.goos != goosWindows {
+		if path.IsAbs(p) {
+			return path.Clean(p)
+		}
+		return path.Join(dir, p)
+	}
+	dir = strings.ReplaceAll(dir, `\`, "/")
+	p = strings.ReplaceAll(p, `\`, "/")
+	var ret string
+	switch {
+	case windowsVolumeRe.MatchString(p):
+		ret = cleanWindows(p)
+	case strings.HasPrefix(p, "/"):
+		volume := ""
+		if m := windowsVolumeRe.FindStringSubmatch(dir); m != nil {
+			volume = m[1]
+		}
+		ret = volume + path.Clean(p)
+	default:
+		ret = cleanWindows(dir + "/" + p)
+	}
+	return strings.ReplaceAll(ret, "/", `\`)
+}
+
+// cleanWindows cleans the slash-separated Windows path p, keeping its volume.
+func cleanWindows(p string) string {
+	m := windowsVolumeRe.FindStringSubmatch(p)
+	if m == nil {
+		return path.Clean(p)
+	}
+	return m[1] + path.Clean("/"+strings.TrimPrefix(p, m[1]))
+}
+
+// ContextPath returns the path of the file of the host, which is saved via SAVE
+// ARTIFACT, within the build context of the target. The files are handed over to the
+// containerized targets via the build context, which is the dir of the Earthfile. p is
+// the slash-separated path of the Earthfile, relative to that dir. An error is returned
+// if p is outside of the dir.
+func (r *Runner) ContextPath(p string) (string, error) {
+	if r.goos == goosWindows {
+		p = strings.ReplaceAll(p, `\`, "/")
+		if windowsVolumeRe.MatchString(p) {
+			return "", fmt.Errorf("%s is not within the dir of the Earthfile", p)
+		}
+	}
+	if path.IsAbs(p) {
+		return "", fmt.Errorf("%s is not within the dir of the Earthfile", p)
+	}
+	clean := path.Clean(p)
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("%s is not within the dir of the Earthfile", p)
+	}
+	return clean, nil
+}
@@ -0,0 +1,134 @@
+package localrun
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestShellArgs(t *testing.T) {
+	tests := []struct {
+		goos     string
+		expected []string
+	}{
+		{"linux", []string{"/bin/sh", "-c", "echo hi"}},
+		{"freebsd", []string{"/bin/sh", "-c", "echo hi"}},
+		{"darwin", []string{"/bin/zsh", "-c", "echo hi"}},
+		{"windows", []string{"cmd.exe", "/S", "/C", "echo hi"}},
+	}
+	for _, test := range tests {
+		actual := NewRunner(test.goos).ShellArgs("echo hi")
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.goos, test.expected, actual)
+		}
+	}
+}
+
+func TestHostPath(t *testing.T) {
+	tests := []struct {
+		goos     string
+		dir      string
+		p        string
+		expected string
+	}{
+		{"linux", "/home/ci/app", "dist/app", "/home/ci/app/dist/app"},
+		{"linux", "/home/ci/app", "../out", "/home/ci/out"},
+		{"linux", "/home/ci/app", "/usr/local/bin/", "/usr/local/bin"},
+		{"darwin", "/Users/ci/app", "build/App.app", "/Users/ci/app/build/App.app"},
+		{"darwin", "/Users/ci/app", "/tmp/notarize.zip", "/tmp/notarize.zip"},
+		{"windows", `C:\ci\app`, "dist/app.exe", `C:\ci\app\dist\app.exe`},
+		{"windows", `C:\ci\app`, "../out/", `C:\ci\out`},
+		{"windows", `C:\ci\app`, "/tools/signtool.exe", `C:\tools\signtool.exe`},
+		{"windows", `C:\ci\app`, "D:/certs/../keys", `D:\keys`},
+		{"windows", `C:\ci\app`, `dist\app.exe`, `C:\ci\app\dist\app.exe`},
+		{"windows", `\\build\share\app`, "out", `\\build\share\app\out`},
+		{"windows", `\\build\share\app`, "/out", `\\build\share\out`},
+		{"windows", ".", "dist", "dist"},
+	}
+	for _, test := range tests {
+		actual := NewRunner(test.goos).HostPath(test.dir, test.p)
+		if actual != test.expected {
+			t.Errorf("%s %s %s: expected %s, got %s", test.goos, test.dir, test.p, test.expected, actual)
+		}
+	}
+}
+
+func TestContextPath(t *testing.T) {
+	tests := []struct {
+		goos      string
+		p         string
+		expected  string
+		expectErr bool
+	}{
+		{"linux", "dist/app", "dist/app", false},
+		{"linux", "./dist/../out/", "out", false},
+		{"linux", "/etc/passwd", "", true},
+		{"linux", "../secrets", "", true},
+		{"darwin", "build/App.app", "build/App.app", false},
+		{"windows", `dist\app.exe`, "dist/app.exe", false},
+		{"windows", "C:/Windows/win.ini", "", true},
+		{"windows", `\\build\share\key`, "", true},
+		{"windows", `..\secrets`, "", true},
+	}
+	for _, test := range tests {
+		actual, err := NewRunner(test.goos).ContextPath(test.p)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%s %s: expected an error", test.goos, test.p)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: unexpected error %v", test.goos, test.p, err)
+			continue
+		}
+		if actual != test.expected {
+			t.Errorf("%s %s: expected %s, got %s", test.goos, test.p, test.expected, actual)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "earthly-localrun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var stdout bytes.Buffer
+	r := NewRunner("linux")
+
+	err = r.Run(context.Background(), dir, []string{"echo", "$VERSION", ">version.txt", "&&", "pwd"}, true, []string{"VERSION=1.2.3"}, &stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt, err := ioutil.ReadFile(filepath.Join(dir, "version.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dt) != "1.2.3\n" {
+		t.Errorf("expected the env var to be set, got %q", string(dt))
+	}
+	if !strings.HasSuffix(strings.TrimSpace(stdout.String()), filepath.Base(dir)) {
+		t.Errorf("expected the command to run in %s, got %q", dir, stdout.String())
+	}
+
+	// The exec form is not run via the shell.
+	stdout.Reset()
+	err = r.Run(context.Background(), dir, []string{"echo", "$VERSION"}, false, nil, &stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "$VERSION\n" {
+		t.Errorf("expected the args as they are, got %q", stdout.String())
+	}
+
+	err = r.Run(context.Background(), dir, []string{"exit 3"}, true, nil, &stdout)
+	if err == nil {
+		t.Error("expected the failure of the command")
+	}
+}
@@ -0,0 +1,141 @@
+// Package metrics exposes the cache effectiveness of a build as Prometheus metrics.
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/earthly/earthly/conslogging"
+	"github.com/pkg/errors"
+)
+
+// shutdownTimeout is the time given to the scrapes in progress, when the server is
+// closed.
+const shutdownTimeout = 2 * time.Second
+
+// Server serves the metrics of a build from GET /metrics, in the Prometheus text
+// exposition format. The commands of the build are counted per target, as they start or
+// are found in the cache.
+type Server struct {
+	mu     sync.Mutex
+	counts map[string]*targetCounts
+
+	srv *http.Server
+	ln  net.Listener
+}
+
+type targetCounts struct {
+	commands int
+	cached   int
+}
+
+// New creates a new metrics server. Start needs to be called to serve scrapes.
+func New() *Server {
+	s := &Server{
+		counts: make(map[string]*targetCounts),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	s.srv = &http.Server{Handler: mux}
+	return s
+}
+
+// Start starts listening for scrapes on addr.
+func (s *Server) Start(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "listen on %s", addr)
+	}
+	s.ln = ln
+	go s.srv.Serve(ln)
+	return nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Event implements conslogging.EventSink. The internal operations of buildkit, such as
+// loading the build context, are not counted.
+func (s *Server) Event(ev conslogging.Event) {
+	if ev.Type != conslogging.VertexStartedEvent || ev.Target == "" || ev.Target == "internal" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tc, found := s.counts[ev.Target]
+	if !found {
+		tc = &targetCounts{}
+		s.counts[ev.Target] = tc
+	}
+	tc.commands++
+	if ev.Cached {
+		tc.cached++
+	}
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := s.srv.Shutdown(ctx)
+	if err != nil {
+		return errors.Wrap(err, "shutdown metrics server")
+	}
+	return nil
+}
+
+// WriteMetrics writes the metrics in the Prometheus text exposition format.
+func (s *Server) WriteMetrics(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	targets := make([]string, 0, len(s.counts))
+	for target := range s.counts {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	var sb strings.Builder
+	writeHeader(&sb, "earthly_commands_total", "counter", "The commands of the build, by target.")
+	for _, target := range targets {
+		fmt.Fprintf(&sb, "earthly_commands_total{target=\"%s\"} %d\n", escapeLabel(target), s.counts[target].commands)
+	}
+	writeHeader(&sb, "earthly_cached_commands_total", "counter", "The commands of the build which were cached, by target.")
+	for _, target := range targets {
+		fmt.Fprintf(&sb, "earthly_cached_commands_total{target=\"%s\"} %d\n", escapeLabel(target), s.counts[target].cached)
+	}
+	writeHeader(&sb, "earthly_cache_hit_ratio", "gauge", "The ratio of the commands of the build which were cached, by target.")
+	for _, target := range targets {
+		tc := s.counts[target]
+		fmt.Fprintf(&sb, "earthly_cache_hit_ratio{target=\"%s\"} %g\n", escapeLabel(target), float64(tc.cached)/float64(tc.commands))
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func writeHeader(sb *strings.Builder, name string, metricType string, help string) {
+	fmt.Fprintf(sb, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(sb, "# TYPE %s %s\n", name, metricType)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.WriteMetrics(w)
+}
@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/earthly/earthly/conslogging"
+)
+
+func TestServer(t *testing.T) {
+	s := New()
+	err := s.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, ev := range []conslogging.Event{
+		{Type: conslogging.VertexStartedEvent, Target: "+build", Cached: true},
+		{Type: conslogging.VertexStartedEvent, Target: "+build"},
+		{Type: conslogging.VertexStartedEvent, Target: "+build"},
+		{Type: conslogging.VertexStartedEvent, Target: "+build", Cached: true},
+		{Type: conslogging.VertexStartedEvent, Target: "+dep \"x\""},
+		{Type: conslogging.VertexStartedEvent, Target: "internal", Cached: true},
+		{Type: conslogging.VertexCompletedEvent, Target: "+build"},
+		{Type: conslogging.TargetStartedEvent, Target: "+build"},
+	} {
+		s.Event(ev)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/metrics", s.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	dt, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"# TYPE earthly_commands_total counter",
+		`earthly_commands_total{target="+build"} 4`,
+		`earthly_commands_total{target="+dep \"x\""} 1`,
+		`earthly_cached_commands_total{target="+build"} 2`,
+		`earthly_cached_commands_total{target="+dep \"x\""} 0`,
+		"# TYPE earthly_cache_hit_ratio gauge",
+		`earthly_cache_hit_ratio{target="+build"} 0.5`,
+		`earthly_cache_hit_ratio{target="+dep \"x\""} 0`,
+	}
+	lines := strings.Split(string(dt), "\n")
+	for _, line := range expected {
+		found := false
+		for _, l := range lines {
+			if l == line {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("expected %q in:\n%s", line, dt)
+		}
+	}
+	if strings.Contains(string(dt), "internal") {
+		t.Errorf("expected no internal commands in:\n%s", dt)
+	}
+}
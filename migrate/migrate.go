@@ -0,0 +1,200 @@
+// Package migrate rewrites Earthfiles which use deprecated syntax into the current
+// syntax. Only the statements which are migrated are rewritten: the rest of the
+// Earthfile, including its comments and its formatting, is preserved as is.
+package migrate
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/earthly/earthly/ast"
+	"github.com/pkg/errors"
+)
+
+// Change is a statement of an Earthfile which was rewritten, or which needs to be
+// rewritten by hand.
+type Change struct {
+	// Line is the line of the statement in the original Earthfile.
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+// Result is the outcome of the migration of an Earthfile.
+type Result struct {
+	// Earthfile is the migrated Earthfile.
+	Earthfile []byte `json:"-"`
+	// Changes are the statements rewritten.
+	Changes []Change `json:"changes"`
+	// Manual are the deprecated statements which could not be migrated automatically.
+	Manual []Change `json:"manual"`
+}
+
+// edit replaces the lines start to end (inclusive, starting at 1) of the Earthfile.
+type edit struct {
+	start, end int
+	lines      []string
+}
+
+var withDockerFlagRe = regexp.MustCompile(`-{1,2}with-docker(=true)?([ \t]+|\\\r?\n[ \t]*)`)
+
+// Migrate migrates the Earthfile dt, read from filename, to the current syntax. Each
+// RUN --with-docker becomes a WITH DOCKER ... END clause holding the RUN. The DOCKER
+// LOAD and DOCKER PULL statements outside of WITH DOCKER are moved into the WITH DOCKER
+// clauses of the RUN --with-docker commands which follow them in the same recipe. Those
+// which no RUN --with-docker follows are reported in Result.Manual.
+func Migrate(filename string, dt []byte) (*Result, error) {
+	ef, err := ast.ParseReader(filename, bytes.NewReader(dt))
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.SplitAfter(string(dt), "\n")
+	result := &Result{Changes: []Change{}, Manual: []Change{}}
+	var edits []edit
+	for _, block := range recipes(ef) {
+		edits = append(edits, migrateWithDocker(block, lines, result)...)
+	}
+	for i := len(edits) - 1; i >= 0; i-- {
+		e := edits[i]
+		tail := append([]string{}, lines[e.end:]...)
+		lines = append(append(lines[:e.start-1], e.lines...), tail...)
+	}
+	result.Earthfile = []byte(strings.Join(lines, ""))
+	if len(edits) > 0 {
+		_, err = ast.ParseReader(filename, bytes.NewReader(result.Earthfile))
+		if err != nil {
+			return nil, errors.Wrap(err, "parse migrated Earthfile")
+		}
+	}
+	return result, nil
+}
+
+func recipes(ef *ast.Earthfile) []ast.Block {
+	blocks := []ast.Block{ef.BaseRecipe}
+	for _, t := range ef.Targets {
+		blocks = append(blocks, t.Recipe)
+	}
+	return blocks
+}
+
+// migrateWithDocker returns the edits migrating the RUN --with-docker, DOCKER LOAD
+// and DOCKER PULL statements of a recipe. The edits are in the order of the lines.
+func migrateWithDocker(block ast.Block, lines []string, result *Result) []edit {
+	var edits []edit
+	var dockerStmts []ast.Statement
+	// moved holds the start lines of the DOCKER LOAD and DOCKER PULL statements moved
+	// into WITH DOCKER clauses.
+	moved := make(map[int]bool)
+	withDocker := false
+	for _, stmt := range block {
+		switch {
+		case stmt.Command == "WITH DOCKER":
+			withDocker = true
+		case stmt.Command == "END":
+			withDocker = false
+		case withDocker:
+		case stmt.Command == "DOCKER LOAD" || stmt.Command == "DOCKER PULL":
+			// The images are loaded into the docker daemon of all the RUN --with-docker
+			// commands which follow.
+			dockerStmts = append(dockerStmts, stmt)
+		case stmt.Command == "RUN" && hasWithDockerFlag(stmt.Args):
+			for _, ds := range dockerStmts {
+				if moved[ds.StartLine] {
+					continue
+				}
+				moved[ds.StartLine] = true
+				edits = append(edits, edit{start: ds.StartLine, end: ds.EndLine})
+				result.Changes = append(result.Changes, Change{
+					Line:    ds.StartLine,
+					Message: fmt.Sprintf("moved %s into the WITH DOCKER clauses of the RUN --with-docker commands which follow", ds.Command),
+				})
+			}
+			edits = append(edits, edit{
+				start: stmt.StartLine,
+				end:   stmt.EndLine,
+				lines: withDockerClause(stmt, dockerStmts, lines),
+			})
+			result.Changes = append(result.Changes, Change{
+				Line:    stmt.StartLine,
+				Message: "replaced RUN --with-docker with a WITH DOCKER clause",
+			})
+		}
+	}
+	for _, ds := range dockerStmts {
+		if !moved[ds.StartLine] {
+			result.Manual = append(result.Manual, Change{
+				Line:    ds.StartLine,
+				Message: fmt.Sprintf("%s outside of WITH DOCKER is deprecated, and no RUN --with-docker follows it: move it into a WITH DOCKER clause", ds.Command),
+			})
+		}
+	}
+	return edits
+}
+
+// runValueFlags are the flags of RUN which take a value.
+var runValueFlags = map[string]bool{
+	"ssh-id": true, "output": true, "secret": true, "mount": true, "after": true,
+	"cap-add": true, "timeout": true, "retry": true, "cpus": true, "memory": true,
+}
+
+// hasWithDockerFlag returns whether the --with-docker flag is set in the arguments of
+// a RUN statement. The flags are parsed as by the flag package: they end at the first
+// argument which is not a flag, or at --.
+func hasWithDockerFlag(args []string) bool {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			return false
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == "with-docker" || name == "with-docker=true" {
+			return true
+		}
+		if runValueFlags[name] {
+			// The value is the next argument.
+			i++
+		}
+	}
+	return false
+}
+
+// withDockerClause returns the lines of the WITH DOCKER clause replacing the
+// RUN --with-docker statement, holding the DOCKER LOAD and DOCKER PULL statements
+// which precede it. The statements of the clause are indented one level more than
+// the RUN statement.
+func withDockerClause(run ast.Statement, dockerStmts []ast.Statement, lines []string) []string {
+	runText := strings.Join(lines[run.StartLine-1:run.EndLine], "")
+	indent := runText[:run.StartColumn-1]
+	unit := indent
+	if unit == "" {
+		unit = "    "
+	}
+	loc := withDockerFlagRe.FindStringIndex(runText)
+	if loc != nil {
+		runText = runText[:loc[0]] + runText[loc[1]:]
+	}
+	runLines := strings.SplitAfter(strings.TrimSuffix(runText, "\n"), "\n")
+	clause := []string{indent + "WITH DOCKER\n"}
+	for _, ds := range dockerStmts {
+		dsLines := lines[ds.StartLine-1 : ds.EndLine]
+		dsIndent := dsLines[0][:ds.StartColumn-1]
+		for i, l := range dsLines {
+			if i == 0 {
+				l = indent + l[len(dsIndent):]
+			}
+			clause = append(clause, unit+withNewline(l))
+		}
+	}
+	for _, l := range runLines {
+		clause = append(clause, unit+withNewline(l))
+	}
+	return append(clause, indent+"END\n")
+}
+
+func withNewline(l string) string {
+	if strings.HasSuffix(l, "\n") {
+		return l
+	}
+	return l + "\n"
+}
@@ -0,0 +1,89 @@
+package migrate
+
+import (
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	earthfile := `FROM docker:19.03.12-dind
+
+# Integration tests.
+test:
+    COPY docker-compose.yml ./
+    DOCKER PULL redis:6 # cache
+    DOCKER LOAD --build-arg MODE=test \
+        +app app:test
+    # Start the services.
+    RUN --with-docker --privileged docker-compose up -d && \
+        ./test.sh
+    RUN --with-docker=true docker run app:test --version
+
+lint:
+	RUN --with-docker docker run linter
+	DOCKER PULL alpine:3.12
+	WITH DOCKER
+		DOCKER PULL alpine:3.13
+		RUN docker run alpine:3.13 true
+	END
+`
+	expected := `FROM docker:19.03.12-dind
+
+# Integration tests.
+test:
+    COPY docker-compose.yml ./
+    # Start the services.
+    WITH DOCKER
+        DOCKER PULL redis:6 # cache
+        DOCKER LOAD --build-arg MODE=test \
+            +app app:test
+        RUN --privileged docker-compose up -d && \
+            ./test.sh
+    END
+    WITH DOCKER
+        DOCKER PULL redis:6 # cache
+        DOCKER LOAD --build-arg MODE=test \
+            +app app:test
+        RUN docker run app:test --version
+    END
+
+lint:
+	WITH DOCKER
+		RUN docker run linter
+	END
+	DOCKER PULL alpine:3.12
+	WITH DOCKER
+		DOCKER PULL alpine:3.13
+		RUN docker run alpine:3.13 true
+	END
+`
+	result, err := Migrate("Earthfile", []byte(earthfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Earthfile) != expected {
+		t.Errorf("unexpected migrated Earthfile:\n%s", result.Earthfile)
+	}
+	expectedChanges := []int{6, 7, 10, 12, 15}
+	if len(result.Changes) != len(expectedChanges) {
+		t.Fatalf("unexpected changes %v", result.Changes)
+	}
+	for i, line := range expectedChanges {
+		if result.Changes[i].Line != line {
+			t.Errorf("expected change %d at line %d, got %v", i, line, result.Changes[i])
+		}
+	}
+	if len(result.Manual) != 1 || result.Manual[0].Line != 16 {
+		t.Errorf("unexpected manual changes %v", result.Manual)
+	}
+}
+
+func TestMigrateUnchanged(t *testing.T) {
+	earthfile := "FROM alpine:3.13\n\nbuild:\n    # Nothing to migrate.\n    RUN echo --with-docker\n"
+	result, err := Migrate("Earthfile", []byte(earthfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Earthfile) != earthfile || len(result.Changes) != 0 || len(result.Manual) != 0 {
+		t.Errorf("expected no changes, got %v\n%s", result.Changes, result.Earthfile)
+	}
+}
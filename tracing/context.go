@@ -0,0 +1,38 @@
+package tracing
+
+import (
+	"context"
+	"time"
+)
+
+type contextKey string
+
+const spanContextKey = contextKey("span")
+
+// WithSpan returns a new context with the span added to it. Spans started from the
+// context become children of the span.
+func WithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanContextKey, s)
+}
+
+// SpanFromContext returns the span associated with the context, or nil if tracing is
+// not enabled.
+func SpanFromContext(ctx context.Context) *Span {
+	v := ctx.Value(spanContextKey)
+	if v == nil {
+		return nil
+	}
+	return v.(*Span)
+}
+
+// StartSpan starts a new span as a child of the span within the context, and returns
+// a context containing the new span. If tracing is not enabled, the returned span is
+// nil.
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := parent.tracer.StartSpan(name, parent, time.Time{})
+	return WithSpan(ctx, s), s
+}
@@ -0,0 +1,60 @@
+package tracing
+
+import (
+	"github.com/earthly/earthly/conslogging"
+)
+
+// Event implements conslogging.EventSink. It records a span for each target executed,
+// as a child of the root span, and a span for each of its commands, as a child of the
+// target span.
+func (t *Tracer) Event(ev conslogging.Event) {
+	targetKey := ev.Target + " " + ev.Salt
+	switch ev.Type {
+	case conslogging.TargetStartedEvent:
+		s := t.StartSpan(ev.Target, t.root, ev.Time)
+		s.SetAttribute("earthly.target", ev.Target)
+		t.mu.Lock()
+		t.targets[targetKey] = s
+		t.mu.Unlock()
+	case conslogging.TargetCompletedEvent:
+		t.mu.Lock()
+		s := t.targets[targetKey]
+		t.mu.Unlock()
+		if ev.Failed {
+			s.SetErrorMessage("target failed")
+		}
+		s.EndAt(ev.Time)
+	case conslogging.VertexStartedEvent:
+		t.mu.Lock()
+		parent, found := t.targets[targetKey]
+		t.mu.Unlock()
+		if !found {
+			parent = t.root
+		}
+		start := ev.Time
+		if ev.Started != nil {
+			start = *ev.Started
+		}
+		s := t.StartSpan(ev.Command, parent, start)
+		s.SetAttribute("earthly.target", ev.Target)
+		s.SetAttribute("earthly.vertex", ev.Vertex)
+		if ev.Cached {
+			s.SetAttribute("earthly.cached", "true")
+		}
+		t.mu.Lock()
+		t.vertices[ev.Vertex] = s
+		t.mu.Unlock()
+	case conslogging.VertexCompletedEvent, conslogging.VertexFailedEvent:
+		t.mu.Lock()
+		s := t.vertices[ev.Vertex]
+		t.mu.Unlock()
+		if ev.Type == conslogging.VertexFailedEvent {
+			s.SetErrorMessage(ev.Error)
+		}
+		end := ev.Time
+		if ev.Completed != nil {
+			end = *ev.Completed
+		}
+		s.EndAt(end)
+	}
+}
@@ -0,0 +1,301 @@
+package tracing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// exportTimeout is the timeout for exporting the spans to the OTLP endpoint.
+const exportTimeout = 10 * time.Second
+
+// Tracer records the spans of a build and exports them to an OpenTelemetry collector
+// via OTLP (HTTP with JSON encoding), once the build completes. All spans of a build
+// share the same trace and descend from a single root span.
+type Tracer struct {
+	endpoint    string
+	serviceName string
+	traceID     string
+	root        *Span
+
+	mu    sync.Mutex
+	spans []*Span
+
+	// Used by the event sink.
+	targets  map[string]*Span
+	vertices map[string]*Span
+}
+
+// Span is a timed operation within a trace. A nil span is valid, and ignores all
+// calls, such that callers need not check whether tracing is enabled.
+type Span struct {
+	tracer   *Tracer
+	name     string
+	spanID   string
+	parentID string
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	errMsg   string
+}
+
+// New creates a new tracer exporting to the OTLP HTTP endpoint, such as
+// http://localhost:4318. The root span, named rootName, starts right away.
+func New(endpoint string, serviceName string, rootName string) (*Tracer, error) {
+	traceID, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint = endpoint + "/v1/traces"
+	}
+	t := &Tracer{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		traceID:     traceID,
+		targets:     make(map[string]*Span),
+		vertices:    make(map[string]*Span),
+	}
+	t.root = t.StartSpan(rootName, nil, time.Time{})
+	return t, nil
+}
+
+// Root returns the root span of the trace.
+func (t *Tracer) Root() *Span {
+	return t.root
+}
+
+// TraceID returns the hex-encoded ID of the trace.
+func (t *Tracer) TraceID() string {
+	return t.traceID
+}
+
+// StartSpan starts a new span, as a child of parent. If parent is nil, the span has
+// no parent. If start is zero, the span starts now.
+func (t *Tracer) StartSpan(name string, parent *Span, start time.Time) *Span {
+	spanID, err := randomHex(8)
+	if err != nil {
+		// Should never happen.
+		return nil
+	}
+	if start.IsZero() {
+		start = time.Now()
+	}
+	s := &Span{
+		tracer: t,
+		name:   name,
+		spanID: spanID,
+		start:  start,
+		attrs:  make(map[string]string),
+	}
+	if parent != nil {
+		s.parentID = parent.spanID
+	}
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+	return s
+}
+
+// SetAttribute sets an attribute of the span.
+func (s *Span) SetAttribute(key string, value string) {
+	if s == nil {
+		return
+	}
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.attrs[key] = value
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.SetErrorMessage(err.Error())
+}
+
+// SetErrorMessage marks the span as failed, with the given message.
+func (s *Span) SetErrorMessage(msg string) {
+	if s == nil {
+		return
+	}
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.errMsg = msg
+}
+
+// End ends the span now. Ending a span more than once has no effect.
+func (s *Span) End() {
+	s.EndAt(time.Time{})
+}
+
+// EndAt ends the span at the given time. If end is zero, the span ends now.
+func (s *Span) EndAt(end time.Time) {
+	if s == nil {
+		return
+	}
+	if end.IsZero() {
+		end = time.Now()
+	}
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	if s.end.IsZero() {
+		s.end = end
+	}
+}
+
+// Close ends the root span, as well as any span still open, and exports the trace.
+func (t *Tracer) Close() error {
+	now := time.Now()
+	t.mu.Lock()
+	for _, s := range t.spans {
+		if s.end.IsZero() {
+			s.end = now
+		}
+	}
+	body, err := t.marshal()
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: exportTimeout}
+	resp, err := client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "export trace to %s", t.endpoint)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		dt, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("export trace to %s: unexpected status %s: %s", t.endpoint, resp.Status, dt)
+	}
+	return nil
+}
+
+// The following mirror the JSON encoding of the OTLP trace export request.
+
+type otlpExportRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusCodeOK     = 1
+	otlpStatusCodeError  = 2
+)
+
+func (t *Tracer) marshal() ([]byte, error) {
+	// Assumes mu locked.
+	var spans []otlpSpan
+	for _, s := range t.spans {
+		span := otlpSpan{
+			TraceID:           t.traceID,
+			SpanID:            s.spanID,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        keyValues(s.attrs),
+			Status:            otlpStatus{Code: otlpStatusCodeOK},
+		}
+		if s.errMsg != "" {
+			span.Status = otlpStatus{Code: otlpStatusCodeError, Message: s.errMsg}
+		}
+		spans = append(spans, span)
+	}
+	req := otlpExportRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: keyValues(map[string]string{"service.name": t.serviceName}),
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: t.serviceName},
+				Spans: spans,
+			}},
+		}},
+	}
+	dt, err := json.Marshal(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal trace")
+	}
+	return dt, nil
+}
+
+func keyValues(attrs map[string]string) []otlpKeyValue {
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var kvs []otlpKeyValue
+	for _, key := range keys {
+		kvs = append(kvs, otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: attrs[key]}})
+	}
+	return kvs
+}
+
+func randomHex(n int) (string, error) {
+	dt := make([]byte, n)
+	_, err := rand.Read(dt)
+	if err != nil {
+		return "", errors.Wrap(err, "generate random id")
+	}
+	return hex.EncodeToString(dt), nil
+}
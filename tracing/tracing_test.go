@@ -0,0 +1,72 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/earthly/earthly/conslogging"
+)
+
+func TestTracerExport(t *testing.T) {
+	var req otlpExportRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		dt, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		err = json.Unmarshal(dt, &req)
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+	defer srv.Close()
+
+	tracer, err := New(srv.URL, "earth", "earth +build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := WithSpan(context.Background(), tracer.Root())
+	_, span := StartSpan(ctx, "convert +build")
+	span.End()
+	now := time.Now()
+	tracer.Event(conslogging.Event{Type: conslogging.TargetStartedEvent, Target: "+build", Time: now})
+	tracer.Event(conslogging.Event{Type: conslogging.VertexStartedEvent, Target: "+build", Vertex: "abc", Command: "RUN false", Time: now})
+	tracer.Event(conslogging.Event{Type: conslogging.VertexFailedEvent, Target: "+build", Vertex: "abc", Error: "exit code: 1", Time: now})
+	tracer.Event(conslogging.Event{Type: conslogging.TargetCompletedEvent, Target: "+build", Failed: true, Time: now})
+	err = tracer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	byName := make(map[string]otlpSpan)
+	for _, s := range spans {
+		if s.TraceID != tracer.TraceID() {
+			t.Errorf("unexpected trace id %s", s.TraceID)
+		}
+		byName[s.Name] = s
+	}
+	root := byName["earth +build"]
+	if root.ParentSpanID != "" {
+		t.Errorf("unexpected root parent %s", root.ParentSpanID)
+	}
+	if byName["convert +build"].ParentSpanID != root.SpanID {
+		t.Error("expected conversion span to be a child of the root")
+	}
+	target := byName["+build"]
+	if target.ParentSpanID != root.SpanID || target.Status.Code != otlpStatusCodeError {
+		t.Errorf("unexpected target span %+v", target)
+	}
+	vertex := byName["RUN false"]
+	if vertex.ParentSpanID != target.SpanID || vertex.Status.Message != "exit code: 1" {
+		t.Errorf("unexpected vertex span %+v", vertex)
+	}
+}
@@ -0,0 +1,223 @@
+package tui
+
+import (
+	"github.com/earthly/earthly/conslogging"
+	"github.com/earthly/earthly/earthfile2llb"
+)
+
+// maxLogLines is the number of log lines kept for each target.
+const maxLogLines = 5000
+
+type targetState int
+
+const (
+	targetPending targetState = iota
+	targetRunning
+	targetDone
+	targetFailed
+)
+
+// node is a target within the dependency tree.
+type node struct {
+	key      string
+	name     string
+	children []*node
+
+	state     targetState
+	vertices  map[string]*vertex
+	order     []string
+	completed int
+	cached    int
+	logs      []string
+}
+
+// vertex is a command executed as part of a target.
+type vertex struct {
+	command  string
+	progress int
+	running  bool
+	cached   bool
+	failed   bool
+}
+
+func newNode(key string, name string) *node {
+	return &node{
+		key:      key,
+		name:     name,
+		vertices: make(map[string]*vertex),
+	}
+}
+
+func (n *node) appendLog(line string) {
+	n.logs = append(n.logs, line)
+	if len(n.logs) > maxLogLines {
+		// Drop the oldest lines, in bulk, to avoid copying for every line.
+		n.logs = append([]string{}, n.logs[len(n.logs)-maxLogLines*9/10:]...)
+	}
+}
+
+func (n *node) vertex(id string, command string) *vertex {
+	v, found := n.vertices[id]
+	if !found {
+		v = &vertex{command: command}
+		n.vertices[id] = v
+		n.order = append(n.order, id)
+	}
+	return v
+}
+
+// runningVertices returns the commands of the target currently executing.
+func (n *node) runningVertices() []*vertex {
+	var ret []*vertex
+	for _, id := range n.order {
+		v := n.vertices[id]
+		if v.running {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// model is the state of the build, as displayed.
+type model struct {
+	roots []*node
+	nodes map[string]*node
+}
+
+func newModel() *model {
+	return &model{
+		nodes: make(map[string]*node),
+	}
+}
+
+func targetKey(target string, salt string) string {
+	return target + " " + salt
+}
+
+// setTree sets the dependency tree of the build, rooted at the final target.
+func (m *model) setTree(root *earthfile2llb.SingleTargetStates) {
+	visited := make(map[*earthfile2llb.SingleTargetStates]bool)
+	var build func(sts *earthfile2llb.SingleTargetStates) *node
+	build = func(sts *earthfile2llb.SingleTargetStates) *node {
+		key := targetKey(sts.Target.String(), sts.Salt)
+		n, found := m.nodes[key]
+		if !found {
+			n = newNode(key, sts.Target.StringCanonical())
+			m.nodes[key] = n
+		}
+		if visited[sts] {
+			return n
+		}
+		visited[sts] = true
+		seen := make(map[*node]bool)
+		for _, dep := range sts.Deps {
+			child := build(dep)
+			if seen[child] {
+				continue
+			}
+			seen[child] = true
+			n.children = append(n.children, child)
+		}
+		return n
+	}
+	// Keep any nodes reported before the tree was known.
+	rootNode := build(root)
+	var roots []*node
+	roots = append(roots, rootNode)
+	for _, n := range m.roots {
+		if n != rootNode {
+			roots = append(roots, n)
+		}
+	}
+	m.roots = roots
+}
+
+// node returns the node of the target, creating a top-level node if the target is
+// not part of the tree.
+func (m *model) node(target string, salt string) *node {
+	key := targetKey(target, salt)
+	n, found := m.nodes[key]
+	if !found {
+		n = newNode(key, target)
+		m.nodes[key] = n
+		m.roots = append(m.roots, n)
+	}
+	return n
+}
+
+func (m *model) handleEvent(ev conslogging.Event) {
+	if ev.Target == "" || ev.Target == "internal" {
+		return
+	}
+	n := m.node(ev.Target, ev.Salt)
+	switch ev.Type {
+	case conslogging.LogEvent:
+		n.appendLog(ev.Message)
+	case conslogging.TargetStartedEvent:
+		if n.state == targetPending {
+			n.state = targetRunning
+		}
+	case conslogging.TargetCompletedEvent:
+		if ev.Failed {
+			n.state = targetFailed
+		} else if n.state != targetFailed {
+			n.state = targetDone
+		}
+	case conslogging.VertexStartedEvent:
+		v := n.vertex(ev.Vertex, ev.Command)
+		if ev.Cached {
+			if !v.cached {
+				v.cached = true
+				n.cached++
+				n.completed++
+			}
+			return
+		}
+		v.running = true
+		if n.state == targetPending {
+			n.state = targetRunning
+		}
+	case conslogging.VertexProgressEvent:
+		v := n.vertex(ev.Vertex, ev.Command)
+		v.progress = ev.Progress
+	case conslogging.VertexCompletedEvent:
+		v := n.vertex(ev.Vertex, ev.Command)
+		if v.running {
+			v.running = false
+			n.completed++
+		}
+	case conslogging.VertexFailedEvent:
+		v := n.vertex(ev.Vertex, ev.Command)
+		v.running = false
+		v.failed = true
+		n.state = targetFailed
+	}
+}
+
+// flatRow is a row of the flattened dependency tree.
+type flatRow struct {
+	node  *node
+	depth int
+}
+
+// flatten returns the rows of the dependency tree, depth first. Targets which are
+// depended upon by several targets are only listed under the first one.
+func (m *model) flatten() []flatRow {
+	var rows []flatRow
+	seen := make(map[*node]bool)
+	var walk func(n *node, depth int)
+	walk = func(n *node, depth int) {
+		if seen[n] {
+			return
+		}
+		seen[n] = true
+		rows = append(rows, flatRow{node: n, depth: depth})
+		for _, child := range n.children {
+			walk(child, depth+1)
+		}
+	}
+	for _, n := range m.roots {
+		walk(n, 0)
+	}
+	return rows
+}
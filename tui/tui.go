@@ -0,0 +1,412 @@
+package tui
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/earthly/earthly/conslogging"
+	"github.com/earthly/earthly/earthfile2llb"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	renderInterval = 100 * time.Millisecond
+	// maxRunningRows is the number of running commands of the selected target shown.
+	maxRunningRows   = 5
+	progressBarWidth = 20
+)
+
+// TUI is a full-screen view of the build, showing the dependency tree of the targets,
+// the progress of their commands and the log of the selected target. It replaces the
+// regular console output while active. The console output produced meanwhile is
+// printed once the view exits, so that it remains available in the scrollback.
+type TUI struct {
+	title string
+	out   *os.File
+	in    *os.File
+
+	mu       sync.Mutex
+	model    *model
+	selected int
+	// scroll is the number of lines the log pane is scrolled up from the bottom.
+	scroll int
+	active bool
+	writer *bufferedWriter
+
+	oldState *terminal.State
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+}
+
+// IsSupported returns whether out is a terminal the TUI can be displayed on.
+func IsSupported(out *os.File) bool {
+	return terminal.IsTerminal(int(out.Fd()))
+}
+
+// New creates a new TUI, displayed on out, taking key presses from in. Start needs to
+// be called to display it.
+func New(title string, out *os.File, in *os.File) *TUI {
+	return &TUI{
+		title:  title,
+		out:    out,
+		in:     in,
+		model:  newModel(),
+		writer: &bufferedWriter{out: out},
+	}
+}
+
+// ConsoleWriter returns the writer the console needs to use, such that its output
+// does not interfere with the view. Until Start is called, and after the view exits,
+// output is passed through directly.
+func (t *TUI) ConsoleWriter() io.Writer {
+	return t.writer
+}
+
+// SetTargets sets the dependency tree of the build, rooted at the final target.
+func (t *TUI) SetTargets(root *earthfile2llb.SingleTargetStates) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.model.setTree(root)
+}
+
+// Event implements conslogging.EventSink.
+func (t *TUI) Event(ev conslogging.Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.model.handleEvent(ev)
+}
+
+// Start displays the view.
+func (t *TUI) Start() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.active {
+		return nil
+	}
+	inFd := int(t.in.Fd())
+	if terminal.IsTerminal(inFd) {
+		oldState, err := terminal.MakeRaw(inFd)
+		if err != nil {
+			return errors.Wrap(err, "make terminal raw")
+		}
+		t.oldState = oldState
+		go t.readInput()
+	}
+	t.writer.setBuffering(true)
+	t.active = true
+	t.stopCh = make(chan struct{})
+	t.doneCh = make(chan struct{})
+	// Switch to the alternate screen and hide the cursor.
+	t.out.WriteString("\x1b[?1049h\x1b[?25l")
+	go t.renderLoop(t.stopCh, t.doneCh)
+	return nil
+}
+
+// Stop exits the view, restoring the terminal, and prints the console output
+// produced while the view was active.
+func (t *TUI) Stop() {
+	t.mu.Lock()
+	if !t.active {
+		t.mu.Unlock()
+		return
+	}
+	t.active = false
+	close(t.stopCh)
+	doneCh := t.doneCh
+	t.mu.Unlock()
+	<-doneCh
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// Show the cursor and switch back to the main screen.
+	t.out.WriteString("\x1b[?25h\x1b[?1049l")
+	if t.oldState != nil {
+		terminal.Restore(int(t.in.Fd()), t.oldState)
+		t.oldState = nil
+	}
+	t.writer.setBuffering(false)
+}
+
+func (t *TUI) renderLoop(stopCh chan struct{}, doneCh chan struct{}) {
+	defer close(doneCh)
+	ticker := time.NewTicker(renderInterval)
+	defer ticker.Stop()
+	for {
+		t.render()
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *TUI) render() {
+	width, height, err := terminal.GetSize(int(t.out.Fd()))
+	if err != nil {
+		width, height = 80, 24
+	}
+	t.mu.Lock()
+	frame := t.frame(width, height)
+	t.mu.Unlock()
+	t.out.WriteString(frame)
+}
+
+// frame renders the whole screen.
+func (t *TUI) frame(width int, height int) string {
+	// Assumes mu locked.
+	rows := t.model.flatten()
+	if t.selected >= len(rows) {
+		t.selected = len(rows) - 1
+	}
+	if t.selected < 0 {
+		t.selected = 0
+	}
+	var lines []string
+	lines = append(lines, reverse(t.header(rows)))
+
+	// Dependency tree.
+	treeHeight := len(rows)
+	if treeHeight > height/2 {
+		treeHeight = height / 2
+	}
+	treeStart := 0
+	if t.selected >= treeHeight {
+		treeStart = t.selected - treeHeight + 1
+	}
+	for i := treeStart; i < treeStart+treeHeight && i < len(rows); i++ {
+		line := treeRow(rows[i])
+		if i == t.selected {
+			line = reverse(pad(line, width))
+		}
+		lines = append(lines, line)
+	}
+
+	// Running commands of the selected target.
+	var sel *node
+	if len(rows) > 0 {
+		sel = rows[t.selected].node
+	}
+	if sel == nil {
+		return render(lines, width, height)
+	}
+	lines = append(lines, reverse(fmt.Sprintf("─ %s ", sel.name)))
+	running := sel.runningVertices()
+	for i, v := range running {
+		if i == maxRunningRows {
+			lines = append(lines, fmt.Sprintf("  ... and %d more", len(running)-maxRunningRows))
+			break
+		}
+		lines = append(lines, fmt.Sprintf("  %s %3d%% %s", progressBar(v.progress, 100), v.progress, v.command))
+	}
+
+	// Log of the selected target.
+	logHeight := height - len(lines)
+	if logHeight < 1 {
+		return render(lines, width, height)
+	}
+	maxScroll := len(sel.logs) - logHeight
+	if maxScroll < 0 {
+		maxScroll = 0
+	}
+	if t.scroll > maxScroll {
+		t.scroll = maxScroll
+	}
+	end := len(sel.logs) - t.scroll
+	start := end - logHeight
+	if start < 0 {
+		start = 0
+	}
+	lines = append(lines, sel.logs[start:end]...)
+	return render(lines, width, height)
+}
+
+func (t *TUI) header(rows []flatRow) string {
+	var done, failed, cached int
+	for _, r := range rows {
+		switch r.node.state {
+		case targetDone:
+			done++
+		case targetFailed:
+			failed++
+		}
+		cached += r.node.cached
+	}
+	return fmt.Sprintf(
+		" %s │ %d/%d targets done │ %d failed │ %d cached │ ↑/↓ select, PgUp/PgDn scroll, q exit view ",
+		t.title, done, len(rows), failed, cached)
+}
+
+func treeRow(r flatRow) string {
+	n := r.node
+	status := "[ ]"
+	switch n.state {
+	case targetRunning:
+		status = "[~]"
+	case targetDone:
+		status = "[✓]"
+	case targetFailed:
+		status = "[✗]"
+	}
+	total := len(n.vertices)
+	line := fmt.Sprintf("%s%s %s %s %d/%d",
+		strings.Repeat("  ", r.depth), status, progressBar(n.completed, total), n.name, n.completed, total)
+	if n.cached > 0 {
+		line = fmt.Sprintf("%s (%d cached)", line, n.cached)
+	}
+	return line
+}
+
+func progressBar(current int, total int) string {
+	filled := 0
+	if total > 0 {
+		filled = progressBarWidth * current / total
+	}
+	if filled > progressBarWidth {
+		filled = progressBarWidth
+	}
+	return strings.Repeat("█", filled) + strings.Repeat("░", progressBarWidth-filled)
+}
+
+// render returns the escape sequences drawing lines on the whole screen.
+func render(lines []string, width int, height int) string {
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+	for i := 0; i < height; i++ {
+		if i < len(lines) {
+			b.WriteString(truncate(lines[i], width))
+		}
+		b.WriteString("\x1b[K")
+		if i < height-1 {
+			b.WriteString("\r\n")
+		}
+	}
+	return b.String()
+}
+
+func reverse(s string) string {
+	return "\x1b[7m" + s + "\x1b[0m"
+}
+
+func pad(s string, width int) string {
+	n := utf8.RuneCountInString(s)
+	if n >= width {
+		return s
+	}
+	return s + strings.Repeat(" ", width-n)
+}
+
+// truncate cuts s to width visible characters, skipping escape sequences and control
+// characters, which would otherwise break the layout.
+func truncate(s string, width int) string {
+	var b strings.Builder
+	visible := 0
+	inEscape := false
+	for _, r := range s {
+		switch {
+		case inEscape:
+			b.WriteRune(r)
+			if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+				inEscape = false
+			}
+		case r == '\x1b':
+			inEscape = true
+			b.WriteRune(r)
+		case r < ' ':
+			// Drop control characters, such as \r and \t.
+		default:
+			if visible == width {
+				continue
+			}
+			visible++
+			b.WriteRune(r)
+		}
+	}
+	if strings.Contains(s, "\x1b") {
+		b.WriteString("\x1b[0m")
+	}
+	return b.String()
+}
+
+func (t *TUI) readInput() {
+	buf := make([]byte, 16)
+	for {
+		n, err := t.in.Read(buf)
+		if err != nil {
+			return
+		}
+		t.mu.Lock()
+		if !t.active {
+			t.mu.Unlock()
+			return
+		}
+		quit := t.handleKey(buf[:n])
+		t.mu.Unlock()
+		if quit {
+			t.Stop()
+			return
+		}
+	}
+}
+
+// handleKey processes a key press. It returns true if the view should exit.
+func (t *TUI) handleKey(key []byte) bool {
+	// Assumes mu locked.
+	switch {
+	case bytes.Equal(key, []byte{3}):
+		// Ctrl+C. Raw mode disables the signal, so raise it.
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+	case bytes.Equal(key, []byte("q")):
+		return true
+	case bytes.Equal(key, []byte("\x1b[A")), bytes.Equal(key, []byte("k")):
+		t.selected--
+		t.scroll = 0
+	case bytes.Equal(key, []byte("\x1b[B")), bytes.Equal(key, []byte("j")):
+		t.selected++
+		t.scroll = 0
+	case bytes.Equal(key, []byte("\x1b[5~")):
+		t.scroll += 10
+	case bytes.Equal(key, []byte("\x1b[6~")):
+		t.scroll -= 10
+		if t.scroll < 0 {
+			t.scroll = 0
+		}
+	}
+	return false
+}
+
+// bufferedWriter passes writes through, unless buffering, in which case they are
+// kept until buffering ends.
+type bufferedWriter struct {
+	mu        sync.Mutex
+	out       io.Writer
+	buffering bool
+	buf       bytes.Buffer
+}
+
+func (w *bufferedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.buffering {
+		return w.buf.Write(p)
+	}
+	return w.out.Write(p)
+}
+
+func (w *bufferedWriter) setBuffering(buffering bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buffering = buffering
+	if !buffering && w.buf.Len() > 0 {
+		w.out.Write(w.buf.Bytes())
+		w.buf.Reset()
+	}
+}
@@ -0,0 +1,52 @@
+package tui
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/earthly/earthly/conslogging"
+	"github.com/earthly/earthly/domain"
+	"github.com/earthly/earthly/earthfile2llb"
+)
+
+func TestFrame(t *testing.T) {
+	depTarget, err := domain.ParseTarget("+deps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootTarget, err := domain.ParseTarget("+build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dep := &earthfile2llb.SingleTargetStates{Target: depTarget, Salt: "2"}
+	root := &earthfile2llb.SingleTargetStates{
+		Target: rootTarget,
+		Salt:   "1",
+		Deps:   []*earthfile2llb.SingleTargetStates{dep, dep},
+	}
+	tu := New("earth +build", nil, nil)
+	tu.SetTargets(root)
+	tu.Event(conslogging.Event{Type: conslogging.VertexStartedEvent, Target: "+deps", Salt: "2", Vertex: "a", Command: "FROM alpine", Cached: true})
+	tu.Event(conslogging.Event{Type: conslogging.TargetCompletedEvent, Target: "+deps", Salt: "2"})
+	tu.Event(conslogging.Event{Type: conslogging.VertexStartedEvent, Target: "+build", Salt: "1", Vertex: "b", Command: "RUN make"})
+	tu.Event(conslogging.Event{Type: conslogging.VertexProgressEvent, Target: "+build", Salt: "1", Vertex: "b", Progress: 50})
+	tu.Event(conslogging.Event{Type: conslogging.LogEvent, Target: "+build", Salt: "1", Message: "compiling"})
+
+	frame := tu.frame(200, 20)
+	for _, expected := range []string{
+		"1/2 targets done",
+		"1 cached",
+		"[~] ░░░░░░░░░░░░░░░░░░░░ +build 0/1",
+		"  [✓] ████████████████████ +deps 1/1 (1 cached)",
+		"██████████░░░░░░░░░░  50% RUN make",
+		"compiling",
+	} {
+		if !strings.Contains(frame, expected) {
+			t.Errorf("expected frame to contain %q:\n%s", expected, frame)
+		}
+	}
+	// The dependency is listed once.
+	if strings.Count(frame, "+deps") != 1 {
+		t.Errorf("expected +deps once:\n%s", frame)
+	}
+}